@@ -10,11 +10,14 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/alecthomas/units"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/oklog/run"
+	"github.com/oklog/ulid"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -23,8 +26,10 @@ import (
 	"github.com/prometheus/common/route"
 	"github.com/prometheus/prometheus/tsdb"
 	blocksAPI "github.com/thanos-io/thanos/pkg/api/blocks"
+	compactAPI "github.com/thanos-io/thanos/pkg/api/compact"
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/block/metastore"
 	"github.com/thanos-io/thanos/pkg/compact"
 	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/component"
@@ -33,10 +38,15 @@ import (
 	"github.com/thanos-io/thanos/pkg/extprom"
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
 	"github.com/thanos-io/thanos/pkg/logging"
+	thanosmodel "github.com/thanos-io/thanos/pkg/model"
+	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/client"
+	"github.com/thanos-io/thanos/pkg/pool"
 	"github.com/thanos-io/thanos/pkg/prober"
 	"github.com/thanos-io/thanos/pkg/runutil"
+	grpcserver "github.com/thanos-io/thanos/pkg/server/grpc"
 	httpserver "github.com/thanos-io/thanos/pkg/server/http"
+	"github.com/thanos-io/thanos/pkg/tls"
 	"github.com/thanos-io/thanos/pkg/ui"
 )
 
@@ -83,8 +93,8 @@ func registerCompact(app *extkingpin.App) {
 	conf := &compactConfig{}
 	conf.registerFlag(cmd)
 
-	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ <-chan struct{}, _ bool) error {
-		return runCompact(g, logger, tracer, reg, component.Compact, *conf, getFlagsMap(cmd.Flags()))
+	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, reload <-chan struct{}, _ bool) error {
+		return runCompact(g, logger, tracer, reg, component.Compact, *conf, getFlagsMap(cmd.Flags()), reload)
 	})
 }
 
@@ -96,8 +106,8 @@ func runCompact(
 	component component.Component,
 	conf compactConfig,
 	flagsMap map[string]string,
+	reload <-chan struct{},
 ) error {
-	deleteDelay := time.Duration(conf.deleteDelay)
 	halted := promauto.With(reg).NewGauge(prometheus.GaugeOpts{
 		Name: "thanos_compactor_halted",
 		Help: "Set to 1 if the compactor halted due to an unexpected error.",
@@ -131,20 +141,38 @@ func runCompact(
 		Name: "thanos_compact_garbage_collected_blocks_total",
 		Help: "Total number of blocks marked for deletion by compactor.",
 	})
-	_ = promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
-		Name: "thanos_delete_delay_seconds",
-		Help: "Configured delete delay in seconds.",
-	}, func() float64 {
-		return deleteDelay.Seconds()
-	})
+	if conf.maxBlocksPerCompaction < 0 || conf.maxBlocksPerCompaction == 1 {
+		return errors.Errorf("invalid --compact.max-blocks-per-compaction %d: must be 0 or at least 2", conf.maxBlocksPerCompaction)
+	}
 
 	downsampleMetrics := newDownsampleMetrics(reg)
 
+	if conf.jobsAPI && !conf.wait {
+		return errors.New("--compact.jobs-api works only with --wait")
+	}
+	if conf.onDemandAPI && !conf.wait {
+		return errors.New("--compact.on-demand-api works only with --wait")
+	}
+	if conf.readOnly {
+		// Read-only mode runs the whole cycle as dry run does, with the bucket denying any change that slips through.
+		conf.dryRun = true
+		conf.cleanupAuxDryRun = true
+		if conf.probeCapabilities {
+			level.Info(logger).Log("msg", "read-only mode: skipping probing of bucket capabilities, which writes into the bucket")
+			conf.probeCapabilities = false
+		}
+	}
+
 	httpProbe := prober.NewHTTP()
-	statusProber := prober.Combine(
+	grpcProbe := prober.NewGRPC()
+	probes := []prober.Probe{
 		httpProbe,
 		prober.NewInstrumentation(component, logger, extprom.WrapRegistererWithPrefix("thanos_", reg)),
-	)
+	}
+	if conf.jobsAPI {
+		probes = append(probes, grpcProbe)
+	}
+	statusProber := prober.Combine(probes...)
 
 	srv := httpserver.New(logger, reg, component, httpProbe,
 		httpserver.WithListen(conf.http.bindAddress),
@@ -167,10 +195,41 @@ func runCompact(
 		return err
 	}
 
-	bkt, err := client.NewBucket(logger, confContentYaml, reg, component.String())
+	var bkt objstore.InstrumentedBucket
+	bkt, err = client.NewBucket(logger, confContentYaml, reg, component.String())
 	if err != nil {
 		return err
 	}
+	if conf.readOnly {
+		bkt = objstore.NewReadOnlyBucket(logger, bkt, reg)
+		level.Info(logger).Log("msg", "read-only mode: all changes of the bucket are denied", "bucket", bkt.Name())
+	}
+	capsCtx, capsCancel := context.WithTimeout(context.Background(), time.Minute)
+	caps, err := objstore.DiscoverCapabilities(capsCtx, logger, bkt, conf.probeCapabilities)
+	capsCancel()
+	if err != nil {
+		return errors.Wrap(err, "discover bucket capabilities")
+	}
+	capability := promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "thanos_objstore_bucket_capability",
+		Help: "Whether the bucket supports the optional capability (1) or not (0), as discovered on startup.",
+	}, []string{"capability"})
+	for name, ok := range caps.Map() {
+		v := 0.0
+		if ok {
+			v = 1
+		}
+		capability.WithLabelValues(name).Set(v)
+	}
+	level.Info(logger).Log("msg", "discovered bucket capabilities", "bucket", bkt.Name(), "conditional_upload", caps.ConditionalUpload,
+		"batch_delete", caps.BatchDelete, "server_side_copy", caps.ServerSideCopy, "probed", caps.Probed, "range_get", caps.RangeGet, "consistent_listing", caps.ConsistentListing)
+	if !caps.ConditionalUpload {
+		level.Info(logger).Log("msg", "bucket does not support conditional uploads; deletion marks and metas of new blocks are verified by reading them back after upload instead", "bucket", bkt.Name())
+	}
+	if caps.Probed && !caps.ConsistentListing && !conf.strictGC {
+		level.Info(logger).Log("msg", "bucket listing is not consistent; enabling strict garbage collection", "bucket", bkt.Name())
+		conf.strictGC = true
+	}
 
 	relabelContentYaml, err := conf.selectorRelabelConf.Content()
 	if err != nil {
@@ -182,23 +241,112 @@ func runCompact(
 		return err
 	}
 
+	// Flags are defaults of the runtime configuration, overridden by the runtime config file, if any.
+	runtimeConf, err := compact.NewRuntimeConfigWatcher(logger, reg, conf.runtimeConfigFile, compact.RuntimeConfig{
+		RetentionRaw:          conf.retentionRaw,
+		RetentionFiveMin:      conf.retentionFiveMin,
+		RetentionOneHour:      conf.retentionOneHr,
+		CompactionConcurrency: conf.compactionConcurrency,
+		DeleteConcurrency:     conf.deleteConcurrency,
+		DeleteDelay:           conf.deleteDelay,
+		SelectorRelabelConfig: relabelConfig,
+	})
+	if err != nil {
+		return errors.Wrap(err, "load runtime config")
+	}
+	initialConf := runtimeConf.Config()
+	relabelConfig = initialConf.SelectorRelabelConfig
+	deleteDelay := time.Duration(initialConf.DeleteDelay)
+
+	_ = promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "thanos_delete_delay_seconds",
+		Help: "Configured delete delay in seconds.",
+	}, func() float64 {
+		return time.Duration(runtimeConf.Config().DeleteDelay).Seconds()
+	})
+
+	seriesRelabelContentYaml, err := conf.seriesRelabelConf.Content()
+	if err != nil {
+		return errors.Wrap(err, "get content of series relabel configuration")
+	}
+
+	seriesRelabelConfig, err := compact.ParseSeriesRelabelConfig(seriesRelabelContentYaml)
+	if err != nil {
+		return err
+	}
+
+	retentionRulesContentYaml, err := conf.retentionRulesConf.Content()
+	if err != nil {
+		return errors.Wrap(err, "get content of retention rules configuration")
+	}
+
+	retentionRules, err := compact.ParseRetentionRules(retentionRulesContentYaml)
+	if err != nil {
+		return err
+	}
+
+	metaStoreContentYaml, err := conf.metaStoreConf.Content()
+	if err != nil {
+		return errors.Wrap(err, "get content of metadata store configuration")
+	}
+
+	var metaStore block.MetaStore
+	if len(metaStoreContentYaml) > 0 {
+		metaStore, err = metastore.NewMetaStore(logger, metaStoreContentYaml)
+		if err != nil {
+			return errors.Wrap(err, "create metadata store")
+		}
+	}
+
 	// Ensure we close up everything properly.
+	var inventoryBkt objstore.Bucket
 	defer func() {
 		if err != nil {
 			runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+			if inventoryBkt != nil {
+				runutil.CloseWithLogOnErr(logger, inventoryBkt, "inventory bucket client")
+			}
+			if metaStore != nil {
+				runutil.CloseWithLogOnErr(logger, metaStore, "metadata store")
+			}
 		}
 	}()
 
 	// While fetching blocks, we filter out blocks that were marked for deletion by using IgnoreDeletionMarkFilter.
 	// The delay of deleteDelay/2 is added to ensure we fetch blocks that are meant to be deleted but do not have a replacement yet.
 	// This is to make sure compactor will not accidentally perform compactions with gap instead.
-	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, bkt, deleteDelay/2)
+	exemptBlocks := make([]ulid.ULID, 0, len(conf.deletionExemptBlocks))
+	for _, s := range conf.deletionExemptBlocks {
+		id, err := ulid.Parse(s)
+		if err != nil {
+			return errors.Wrapf(err, "parse deletion exempt block ID %q", s)
+		}
+		exemptBlocks = append(exemptBlocks, id)
+	}
+	if conf.minTime.PrometheusTimestamp() >= conf.maxTime.PrometheusTimestamp() {
+		return errors.Errorf("invalid argument: --min-time '%s' must be lower than --max-time '%s'", &conf.minTime, &conf.maxTime)
+	}
+	timePartitionFilter := block.NewTimePartitionOwnershipFilter(conf.minTime, conf.maxTime)
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilterWithExemptions(logger, bkt, deleteDelay/2, exemptBlocks)
 	duplicateBlocksFilter := block.NewDeduplicateFilter()
 
 	baseMetaFetcher, err := block.NewBaseFetcher(logger, 32, bkt, "", extprom.WrapRegistererWithPrefix("thanos_", reg))
 	if err != nil {
 		return errors.Wrap(err, "create meta fetcher")
 	}
+	if conf.adaptiveBlockSyncConcurrency {
+		baseMetaFetcher.UseAdaptiveConcurrency(block.NewAdaptiveConcurrency(
+			extprom.WrapRegistererWithPrefix("thanos_", reg),
+			conf.blockSyncConcurrency,
+			conf.maxBlockSyncConcurrency,
+			block.DefaultAdaptiveConcurrencyTargetLatency,
+		))
+	}
+
+	if conf.compressMeta {
+		baseMetaFetcher.ReadCompressedMetas()
+	}
+	baseMetaFetcher.AcceptMetaVersions(conf.maxMetaVersion)
 
 	enableVerticalCompaction := false
 	if len(conf.dedupReplicaLabels) > 0 {
@@ -216,18 +364,112 @@ func runCompact(
 		path.Join(conf.webConf.externalPrefix, "/loaded"),
 		conf.webConf.prefixHeaderName,
 	)
-	var sy *compact.Syncer
+	var deletionPolicies []compact.DeletionPolicy
+	if conf.deletionPolicyURL != "" {
+		deletionPolicies = append(deletionPolicies, compact.NewHTTPDeletionPolicy(logger, conf.deletionPolicyURL, conf.deletionPolicyTimeout))
+	}
+	if conf.storeAckMaxAge > 0 {
+		deletionPolicies = append(deletionPolicies, compact.NewStoreLoadAckPolicy(logger, bkt, conf.storeAckMaxAge))
+	}
+	var annotationPolicy *compact.RetentionAnnotationPolicy
+	if conf.retentionAnnotations {
+		annotationPolicy = compact.NewRetentionAnnotationPolicy(logger, reg, bkt)
+		deletionPolicies = append(deletionPolicies, annotationPolicy)
+	}
+	var deletionGate *compact.DeletionGate
+	if len(deletionPolicies) > 0 {
+		deletionGate = compact.NewDeletionGate(logger, reg, compact.DeletionPolicies(deletionPolicies...))
+	}
+	labelNormalizer := block.NewLabelNormalizer(logger, conf.caseFoldLabels)
+	syncerOpts := []compact.SyncerOption{
+		compact.WithGroupSizeAccounting(conf.groupSizeAccounting),
+		compact.WithTimePartition(timePartitionFilter),
+		compact.WithGarbageCollectionGate(deletionGate),
+		compact.WithDuplicatesGracePeriod(conf.compactedSourcesGracePeriod),
+	}
+	if conf.strictGC {
+		syncerOpts = append(syncerOpts, compact.WithStrictGarbageCollection(conf.gcMaxStaleness))
+	}
+	if conf.migrateNormalizedLabels {
+		syncerOpts = append(syncerOpts, compact.WithLabelNormalizationMigration(labelNormalizer))
+	}
+	if conf.verifyCoverage {
+		syncerOpts = append(syncerOpts, compact.WithCoverageVerification(compact.NewCoverageVerifier(logger, reg)))
+	}
+	if conf.inventoryDir != "" {
+		// Reports older than the delete delay may list objects of blocks deleted since, also after reloads of the delay.
+		checkInventoryMaxAge := func(c compact.RuntimeConfig) error {
+			if d := time.Duration(c.DeleteDelay); d > 0 && conf.inventoryMaxAge > d {
+				return errors.Errorf("max age of inventory reports %v must not exceed delete delay %v", conf.inventoryMaxAge, d)
+			}
+			return nil
+		}
+		if err := checkInventoryMaxAge(initialConf); err != nil {
+			return err
+		}
+		runtimeConf.Check(checkInventoryMaxAge)
+		inventoryConfContentYaml, err := conf.inventoryObjStore.Content()
+		if err != nil {
+			return err
+		}
+		var inventoryReportsBkt objstore.BucketReader = bkt
+		if len(inventoryConfContentYaml) > 0 {
+			// nil Prometheus registerer: don't create conflicting metrics.
+			inventoryBkt, err = client.NewBucket(logger, inventoryConfContentYaml, nil, component.String())
+			if err != nil {
+				return errors.Wrap(err, "create bucket client of inventory reports")
+			}
+			inventoryReportsBkt = inventoryBkt
+		}
+		inventory, err := objstore.NewInventoryReader(logger, reg, inventoryReportsBkt, conf.inventoryDir, objstore.InventoryFormat(conf.inventoryFormat), conf.inventoryMaxAge)
+		if err != nil {
+			return err
+		}
+		syncerOpts = append(syncerOpts, compact.WithInventory(inventory))
+	}
+
+	var (
+		sy                  *compact.Syncer
+		noCompactMarkFilter *block.NoCompactMarkFilter
+		quarantineFilter    *compact.QuarantineFilter
+		timeRangeFilter     *compact.TimeRangeFilter
+		shardFilter         = block.NewLabelShardedMetaFilter(relabelConfig)
+		pendingCommitFilter = block.NewPendingCommitFilter(logger, bkt)
+	)
 	{
 		// Make sure all compactor meta syncs are done through Syncer.SyncMeta for readability.
+		filters := []block.MetadataFilter{
+			timePartitionFilter,
+			shardFilter,
+			block.NewConsistencyDelayMetaFilter(logger, conf.consistencyDelay, extprom.WrapRegistererWithPrefix("thanos_", reg)),
+			pendingCommitFilter,
+			ignoreDeletionMarkFilter,
+		}
+		if conf.markTerminalBlocks {
+			noCompactMarkFilter = block.NewNoCompactMarkFilter(logger, bkt)
+			filters = append(filters, noCompactMarkFilter)
+		}
+		if conf.quarantineInconsistentBlocks {
+			quarantineFilter = compact.NewQuarantineFilter(logger, reg, bkt, conf.dryRun)
+			filters = append(filters, quarantineFilter)
+		}
+		if conf.checkTimeRanges {
+			timeRangeFilter, err = compact.NewTimeRangeFilter(logger, reg, bkt, path.Join(conf.dataDir, "time-range-check"), compact.TimeRangeAction(conf.timeRangeAction),
+				conf.timeRangeSampleRatio, deletionGate, blocksMarkedForDeletion, conf.dryRun)
+			if err != nil {
+				return errors.Wrap(err, "create time range filter")
+			}
+			filters = append(filters, timeRangeFilter)
+		}
+		filters = append(filters, duplicateBlocksFilter, block.NewHoldMarkFilter(logger, bkt))
 		cf := baseMetaFetcher.NewMetaFetcher(
-			extprom.WrapRegistererWithPrefix("thanos_", reg), []block.MetadataFilter{
-				block.NewLabelShardedMetaFilter(relabelConfig),
-				block.NewConsistencyDelayMetaFilter(logger, conf.consistencyDelay, extprom.WrapRegistererWithPrefix("thanos_", reg)),
-				ignoreDeletionMarkFilter,
-				duplicateBlocksFilter,
-			}, []block.MetadataModifier{block.NewReplicaLabelRemover(logger, conf.dedupReplicaLabels)},
+			extprom.WrapRegistererWithPrefix("thanos_", reg), filters, []block.MetadataModifier{
+				labelNormalizer,
+				block.NewReplicaLabelRemover(logger, conf.dedupReplicaLabels),
+			},
 		)
 		cf.UpdateOnChange(compactorView.Set)
+		cf.AllowPartialResults(conf.maxFailedMetaRatio)
 		sy, err = compact.NewSyncer(
 			logger,
 			reg,
@@ -237,7 +479,8 @@ func runCompact(
 			ignoreDeletionMarkFilter,
 			blocksMarkedForDeletion,
 			garbageCollectedBlocks,
-			conf.blockSyncConcurrency)
+			conf.blockSyncConcurrency,
+			syncerOpts...)
 		if err != nil {
 			return errors.Wrap(err, "create syncer")
 		}
@@ -255,11 +498,47 @@ func runCompact(
 	ctx, cancel := context.WithCancel(context.Background())
 	// Instantiate the compactor with different time slices. Timestamps in TSDB
 	// are in milliseconds.
-	comp, err := tsdb.NewLeveledCompactor(ctx, reg, logger, levels, downsample.NewPool())
+	// Chunk pool and download buffers are shared by all group compactions to cut allocations.
+	chunkPool := pool.NewInstrumentedChunkPool(reg, "compact", downsample.NewPool())
+	var comp tsdb.Compactor
+	comp, err = tsdb.NewLeveledCompactor(ctx, reg, logger, levels, chunkPool)
 	if err != nil {
 		cancel()
 		return errors.Wrap(err, "create compactor")
 	}
+	mergeFuncs := compact.MergeFuncs{
+		downsample.ResLevel0: compact.MergeFunc(conf.mergeFuncRaw),
+		downsample.ResLevel1: compact.MergeFunc(conf.mergeFuncFiveMin),
+		downsample.ResLevel2: compact.MergeFunc(conf.mergeFuncOneHr),
+	}
+	if err := mergeFuncs.Validate(); err != nil {
+		cancel()
+		return errors.Wrap(err, "validate merge functions")
+	}
+	if conf.chunkPassthrough {
+		comp = compact.NewChunkPassthroughCompactor(logger, reg, comp, chunkPool, mergeFuncs)
+	} else if enableVerticalCompaction {
+		// TSDB compaction reads aggregate chunks as empty, so overlapping downsampled blocks are always merged by Thanos.
+		comp = compact.NewDownsampledMergeCompactor(logger, reg, comp, chunkPool, mergeFuncs)
+	}
+	if conf.coalesceMaxBlockSize > 0 || conf.coalesceMaxBlockSeries > 0 {
+		// Tiny blocks are coalesced within windows of the first range compacted from multiple blocks.
+		window := levels[0]
+		if len(levels) > 1 {
+			window = levels[1]
+		}
+		comp = compact.NewCoalescingCompactor(logger, reg, comp, compact.CoalesceConfig{
+			MaxBlockBytes:  int64(conf.coalesceMaxBlockSize),
+			MaxBlockSeries: conf.coalesceMaxBlockSeries,
+			MinBlocks:      conf.coalesceMinBlocks,
+			Window:         window,
+		})
+	}
+	downloadBuffers, err := pool.NewBucketedBytesPool(compact.DownloadBufferSize, compact.DownloadBufferSize, 2, 0)
+	if err != nil {
+		cancel()
+		return errors.Wrap(err, "create download buffer pool")
+	}
 
 	var (
 		compactDir      = path.Join(conf.dataDir, "compact")
@@ -271,19 +550,280 @@ func runCompact(
 		return errors.Wrap(err, "clean working downsample directory")
 	}
 
-	grouper := compact.NewDefaultGrouper(logger, bkt, conf.acceptMalformedIndex, enableVerticalCompaction, reg, blocksMarkedForDeletion, garbageCollectedBlocks)
-	blocksCleaner := compact.NewBlocksCleaner(logger, bkt, ignoreDeletionMarkFilter, deleteDelay, blocksCleaned, blockCleanupFailures)
-	compactor, err := compact.NewBucketCompactor(logger, sy, grouper, comp, compactDir, bkt, conf.compactionConcurrency)
+	creatorID := conf.creatorID
+	if creatorID == "" {
+		if creatorID, err = os.Hostname(); err != nil {
+			cancel()
+			return errors.Wrap(err, "determine hostname; set --compact.creator-id")
+		}
+	}
+	fingerprint := block.NewFingerprint(creatorID)
+	level.Info(logger).Log("msg", "IDs of compacted blocks embed creator fingerprint", "creator", creatorID, "fingerprint", fingerprint)
+
+	if conf.preflight {
+		if conf.readOnly {
+			level.Info(logger).Log("msg", "read-only mode: skipping preflight checks, which write into the bucket")
+		} else {
+			report, err := compact.Preflight(ctx, logger, bkt, compact.PreflightConfig{Holder: creatorID, MaxWriteLatency: conf.preflightMaxWriteLatency})
+			if err != nil {
+				cancel()
+				return errors.Wrap(err, "preflight")
+			}
+			for _, c := range report.Checks {
+				level.Info(logger).Log("msg", "preflight check", "check", c.Name, "ok", c.OK, "duration", c.Duration, "err", c.Error)
+			}
+			level.Info(logger).Log("msg", "preflight checks done", "ok", report.OK(), "blocks", report.Blocks, "other_entries", len(report.OtherEntries), "write_latency", report.WriteLatency)
+			if err := report.Err(); err != nil {
+				cancel()
+				return err
+			}
+		}
+	}
+
+	retentionByResolution := initialConf.RetentionByResolution()
+
+	groupOpts := []compact.GroupOption{
+		compact.WithSkipOutOfOrderSeries(conf.skipOutOfOrderSeries),
+		compact.WithSeriesRelabelConfig(seriesRelabelConfig),
+		compact.WithMaxBlocksPerCompaction(conf.maxBlocksPerCompaction),
+		compact.WithCompressedMeta(conf.compressMeta),
+		compact.WithFileHashes(conf.fileHashes),
+		compact.WithDebugMetaPrefix(conf.debugMetasPrefix),
+		compact.WithDownloadBufferPool(pool.NewInstrumentedBytesPool(reg, "compact_download", downloadBuffers)),
+		compact.WithDeletionGate(deletionGate),
+		compact.WithPlanEstimateMetrics(compact.NewPlanEstimateMetrics(reg)),
+		compact.WithGroupResourceMetrics(compact.NewGroupResourceMetrics(reg)),
+		compact.WithCompactionRatioMetrics(compact.NewCompactionRatioMetrics(reg)),
+		compact.WithOutputChecks(compact.NewOutputCheckMetrics(reg), conf.outputMinSamplesRatio, compact.SampleLossAction(conf.sampleLossAction)),
+		// Sources left unmarked within the grace period are marked by garbage collection of the Syncer, given the same
+		// grace period.
+		compact.WithCompactedSourcesGracePeriod(conf.compactedSourcesGracePeriod),
+		compact.WithExternalMerge(conf.externalMerge),
+		compact.WithAppendCompaction(conf.appendMinRatio, compact.NewAppendCompactionMetrics(reg)),
+		compact.WithPipelinedUpload(conf.pipelinedUpload),
+		compact.WithCreatorFingerprint(fingerprint),
+	}
+	if metaStore != nil {
+		groupOpts = append(groupOpts, compact.WithBlockNotifier(compact.NewMetaStoreNotifier(metaStore)))
+	}
+	if conf.normalizeIndex {
+		groupOpts = append(groupOpts, compact.WithIndexNormalization(compact.NewIndexNormalizationMetrics(reg)))
+	}
+	if conf.mergeDuplicateSeries {
+		groupOpts = append(groupOpts, compact.WithDuplicateSeriesMerge(compact.NewDuplicateSeriesMetrics(reg)))
+	}
+	if conf.seriesFilter {
+		if conf.seriesFilterFPRate <= 0 || conf.seriesFilterFPRate >= 1 {
+			cancel()
+			return errors.Errorf("false positive rate of series filters has to be within (0, 1), got %v", conf.seriesFilterFPRate)
+		}
+		groupOpts = append(groupOpts, compact.WithSeriesFilters(conf.seriesFilterFPRate))
+	}
+	if conf.freshRange > 0 {
+		groupOpts = append(groupOpts, compact.WithFreshRangeGuard(conf.freshRange, conf.freshRangeQuiescence, compact.NewFreshRangeMetrics(reg)))
+	}
+	if conf.extLabelCollisions != "ignore" {
+		groupOpts = append(groupOpts, compact.WithExternalLabelCollisions(compact.ExternalLabelCollisionAction(conf.extLabelCollisions), compact.NewExternalLabelCollisionMetrics(reg)))
+	}
+	var terminalBlocks *compact.TerminalBlocks
+	if noCompactMarkFilter != nil {
+		terminalBlocks = compact.NewTerminalBlocks(reg, noCompactMarkFilter, levels, retentionByResolution)
+		groupOpts = append(groupOpts, compact.WithTerminalBlocks(terminalBlocks))
+	}
+	if conf.inspectIndexes {
+		groupOpts = append(groupOpts, compact.WithIndexInspection())
+	}
+	if len(conf.extensionsFromLabels) > 0 {
+		labelsByExtension := make(map[string]string, len(conf.extensionsFromLabels))
+		for _, e := range conf.extensionsFromLabels {
+			parts := strings.SplitN(e, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				cancel()
+				return errors.Errorf("invalid extension from label %q, expected <extension>=<label>", e)
+			}
+			labelsByExtension[parts[0]] = parts[1]
+		}
+		groupOpts = append(groupOpts, compact.WithMetaEnrichers(compact.NewLabelExtensionEnricher(labelsByExtension)))
+	}
+	groupOpts = append(groupOpts, compact.WithMissingChunks(compact.MissingChunksAction(conf.missingChunks), compact.NewMissingChunksMetrics(reg)))
+	var churnStats *compact.ChurnStatsTracker
+	if conf.churnStats {
+		churnStats = compact.NewChurnStatsTracker(logger, reg)
+		groupOpts = append(groupOpts, compact.WithChurnStats(churnStats))
+	}
+	defaultGrouper := compact.NewDefaultGrouper(
+		logger,
+		bkt,
+		conf.acceptMalformedIndex,
+		enableVerticalCompaction,
+		reg,
+		blocksMarkedForDeletion,
+		garbageCollectedBlocks,
+		groupOpts...,
+	)
+	var grouper compact.Grouper = defaultGrouper
+	if conf.groupTimeBucket > 0 {
+		bucket := int64(time.Duration(conf.groupTimeBucket) / time.Millisecond)
+		isLevel := false
+		for _, l := range levels[1:] {
+			isLevel = isLevel || l == bucket
+		}
+		if !isLevel {
+			cancel()
+			return errors.Errorf("compact.group-time-bucket %s must be one of the compaction levels above the first one", conf.groupTimeBucket)
+		}
+		if grouper, err = compact.NewTimeBucketGrouper(defaultGrouper, bucket); err != nil {
+			cancel()
+			return errors.Wrap(err, "create time bucket grouper")
+		}
+	}
+	deletionBudget := compact.DeletionBudget{MaxBlocks: conf.deleteMaxBlocksPerCycle, MaxBytes: int64(conf.deleteMaxBytesPerCycle)}
+	if err := deletionBudget.Validate(); err != nil {
+		cancel()
+		return errors.Wrap(err, "invalid deletion budget")
+	}
+	var cleanerOpts []compact.BlocksCleanerOption
+	if len(conf.deleteReadersURLs) > 0 {
+		readers := compact.NewHTTPReadersRegistry(logger, conf.deleteReadersURLs, conf.deleteReadersTimeout)
+		cleanerOpts = append(cleanerOpts, compact.WithReadersRegistry(readers, conf.deletePinnedMaxDeferral))
+	}
+	blocksCleaner := compact.NewBlocksCleanerWithBudget(logger, reg, bkt, ignoreDeletionMarkFilter, deleteDelay, initialConf.DeleteConcurrency, deletionBudget, blocksCleaned, blockCleanupFailures, cleanerOpts...)
+	auxCleaner := compact.NewAuxiliaryCleaner(logger, reg, bkt, conf.debugMetasPrefix, conf.cleanupDebugMetasAfter, conf.cleanupOrphanedMarkers, conf.cleanupAuxDryRun)
+	// Garbage collection scheduled with its own interval is not done by compaction iterations.
+	scheduledGC := conf.wait && conf.garbageCollectionInterval > 0
+	// Work directories are removed with all their content, so blocks are compacted in a subdirectory of the given
+	// ones, which may be e.g. roots of volumes.
+	compactDirs := []string{compactDir}
+	if len(conf.compactWorkDirs) > 0 {
+		compactDirs = compactDirs[:0]
+		for _, dir := range conf.compactWorkDirs {
+			compactDirs = append(compactDirs, path.Join(dir, "compact"))
+		}
+	}
+	compactorOpts := []compact.BucketCompactorOption{compact.WithRegisterer(reg), compact.WithCompactDirs(compactDirs...), compact.WithDryRun(conf.dryRun),
+		compact.WithSkipGarbageCollection(scheduledGC)}
+	if conf.backlogSLOWindow > 0 {
+		compactorOpts = append(compactorOpts, compact.WithBacklogSLO(compact.NewBacklogSLO(reg, levels[len(levels)-1], conf.backlogSLOWindow)))
+	}
+	if conf.memoryThrottleRatio > 0 {
+		limit, err := compact.MemoryLimit()
+		if err != nil {
+			cancel()
+			return errors.Wrap(err, "get memory limit")
+		}
+		if limit == 0 {
+			level.Warn(logger).Log("msg", "neither GOMEMLIMIT nor cgroup memory limit is set; group compactions are not throttled on memory usage")
+		} else {
+			level.Info(logger).Log("msg", "throttling group compactions on memory usage", "limit_bytes", limit, "ratio", conf.memoryThrottleRatio)
+			compactorOpts = append(compactorOpts, compact.WithMemoryGovernor(compact.NewMemoryGovernor(logger, reg, limit, conf.memoryThrottleRatio, 5*time.Second)))
+		}
+	}
+	if conf.profileSlowGroupThreshold > 0 || conf.profileOnHalt {
+		var profileBkt objstore.Bucket
+		if conf.profilePrefix != "" {
+			profileBkt = bkt
+		}
+		profiles := compact.NewProfileCapturer(logger, reg, path.Join(conf.dataDir, "profiles"), profileBkt, conf.profilePrefix, conf.profileCPUDuration)
+		compactorOpts = append(compactorOpts, compact.WithProfileCapturer(profiles, conf.profileSlowGroupThreshold, conf.profileOnHalt))
+	}
+	if conf.groupMaxConsecutiveFailures > 0 {
+		compactorOpts = append(compactorOpts, compact.WithGroupErrorBudget(compact.NewGroupErrorBudget(logger, reg, conf.groupMaxConsecutiveFailures, conf.groupFailureCoolDown)))
+	}
+	if conf.cycleDeadline > 0 || conf.cycleHardDeadline > 0 {
+		soft := conf.cycleDeadline
+		if soft == 0 {
+			soft = conf.cycleHardDeadline
+		}
+		deadline, err := compact.NewCycleDeadline(logger, reg, soft, conf.cycleHardDeadline, conf.dataDir)
+		if err != nil {
+			cancel()
+			return errors.Wrap(err, "create compaction cycle deadline")
+		}
+		compactorOpts = append(compactorOpts, compact.WithCycleDeadline(deadline))
+	}
+	compactorOpts = append(compactorOpts, compact.WithStagePolicies(compact.StagePolicies{
+		Download: compact.StagePolicy{Timeout: conf.downloadTimeout, Retries: conf.downloadRetries, Backoff: conf.stageRetryBackoff},
+		Upload:   compact.StagePolicy{Timeout: conf.uploadTimeout, Retries: conf.uploadRetries, Backoff: conf.stageRetryBackoff},
+	}))
+	if len(conf.concurrencyClasses) > 0 {
+		classes := make([]compact.SizeClass, 0, len(conf.concurrencyClasses))
+		for _, cls := range conf.concurrencyClasses {
+			c, err := compact.ParseSizeClass(cls)
+			if err != nil {
+				cancel()
+				return err
+			}
+			classes = append(classes, c)
+		}
+		limiter, err := compact.NewSizeClassLimiter(reg, classes)
+		if err != nil {
+			cancel()
+			return errors.Wrap(err, "create size class limiter")
+		}
+		compactorOpts = append(compactorOpts, compact.WithSizeClassLimiter(limiter))
+	}
+	var stealingDeletionMarkFilter *block.IgnoreDeletionMarkFilter
+	if conf.workStealing {
+		if len(relabelConfig) == 0 {
+			cancel()
+			return errors.New("work stealing requires blocks to be sharded by --selector.relabel-config")
+		}
+		runtimeConf.Check(func(c compact.RuntimeConfig) error {
+			if len(c.SelectorRelabelConfig) == 0 {
+				return errors.New("work stealing requires blocks to be sharded by selector relabel config")
+			}
+			return nil
+		})
+		stealingDeletionMarkFilter = block.NewIgnoreDeletionMarkFilterWithExemptions(logger, bkt, deleteDelay/2, exemptBlocks)
+		// Metas of all shards, filtered the same way as those synced by the Syncer otherwise.
+		filters := []block.MetadataFilter{
+			timePartitionFilter,
+			block.NewConsistencyDelayMetaFilter(logger, conf.consistencyDelay, nil),
+			block.NewPendingCommitFilter(logger, bkt),
+			stealingDeletionMarkFilter,
+		}
+		var stealingNoCompactMarkFilter *block.NoCompactMarkFilter
+		if conf.markTerminalBlocks {
+			stealingNoCompactMarkFilter = block.NewNoCompactMarkFilter(logger, bkt)
+			filters = append(filters, stealingNoCompactMarkFilter)
+		}
+		if quarantineFilter != nil {
+			filters = append(filters, quarantineFilter)
+		}
+		if timeRangeFilter != nil {
+			filters = append(filters, timeRangeFilter.ForAllShards())
+		}
+		filters = append(filters, block.NewDeduplicateFilter(), block.NewHoldMarkFilter(logger, bkt))
+		allShardsFetcher := baseMetaFetcher.NewMetaFetcher(nil, filters, []block.MetadataModifier{
+			labelNormalizer,
+			block.NewReplicaLabelRemover(logger, conf.dedupReplicaLabels),
+		}, "fetcher", "work-stealing")
+		claims := compact.NewGroupClaims(logger, reg, bkt, creatorID, conf.workStealingClaimTTL)
+		compactorOpts = append(compactorOpts, compact.WithWorkStealing(compact.NewWorkStealer(logger, reg, claims, allShardsFetcher, stealingNoCompactMarkFilter, conf.workStealingAfter, conf.workStealingMaxGroups)))
+	}
+	compactor, err := compact.NewBucketCompactor(logger, sy, grouper, comp, compactDir, bkt, initialConf.CompactionConcurrency, compactorOpts...)
 	if err != nil {
 		cancel()
 		return errors.Wrap(err, "create bucket compactor")
 	}
 
-	retentionByResolution := map[compact.ResolutionLevel]time.Duration{
-		compact.ResolutionLevelRaw: time.Duration(conf.retentionRaw),
-		compact.ResolutionLevel5m:  time.Duration(conf.retentionFiveMin),
-		compact.ResolutionLevel1h:  time.Duration(conf.retentionOneHr),
-	}
+	runtimeConf.Watch(func(c compact.RuntimeConfig) {
+		delay := time.Duration(c.DeleteDelay)
+		shardFilter.SetRelabelConfig(c.SelectorRelabelConfig)
+		ignoreDeletionMarkFilter.SetDelay(delay / 2)
+		if stealingDeletionMarkFilter != nil {
+			stealingDeletionMarkFilter.SetDelay(delay / 2)
+		}
+		blocksCleaner.SetDeleteDelay(delay)
+		blocksCleaner.SetConcurrency(c.DeleteConcurrency)
+		if terminalBlocks != nil {
+			terminalBlocks.SetRetention(c.RetentionByResolution())
+		}
+		// Validated by the watcher already.
+		_ = compactor.SetConcurrency(c.CompactionConcurrency)
+		level.Info(logger).Log("msg", "runtime config changed", "retentionRaw", c.RetentionRaw, "retention5m", c.RetentionFiveMin,
+			"retention1h", c.RetentionOneHour, "compactionConcurrency", c.CompactionConcurrency, "deleteConcurrency", c.DeleteConcurrency, "deleteDelay", c.DeleteDelay)
+	})
 
 	if retentionByResolution[compact.ResolutionLevelRaw].Seconds() != 0 {
 		level.Info(logger).Log("msg", "retention policy of raw samples is enabled", "duration", retentionByResolution[compact.ResolutionLevelRaw])
@@ -294,35 +834,161 @@ func runCompact(
 	if retentionByResolution[compact.ResolutionLevel1h].Seconds() != 0 {
 		level.Info(logger).Log("msg", "retention policy of 1 hour aggregated samples is enabled", "duration", retentionByResolution[compact.ResolutionLevel1h])
 	}
+	if len(retentionRules) > 0 {
+		level.Info(logger).Log("msg", "retention rules are enabled", "rules", len(retentionRules))
+	}
+
+	// Bucket index has to list all blocks in the bucket, so its fetcher has no filters.
+	var bucketIndexFetcher *block.MetaFetcher
+	if conf.bucketIndex {
+		bucketIndexFetcher = baseMetaFetcher.NewMetaFetcher(extprom.WrapRegistererWithPrefix("thanos_bucket_index_", reg), nil, nil, "component", "bucketIndex")
+	}
+	// Same holds for the metadata store.
+	var (
+		metaStoreFetcher    *block.MetaFetcher
+		metaStoreDrift      *prometheus.GaugeVec
+		metaStoreReconciled prometheus.Gauge
+	)
+	if metaStore != nil {
+		metaStoreFetcher = baseMetaFetcher.NewMetaFetcher(extprom.WrapRegistererWithPrefix("thanos_metadata_store_", reg), nil, nil, "component", "metadataStore")
+		metaStoreDrift = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_metadata_store_drift_blocks",
+			Help: "Number of blocks on which the metadata store disagreed with the bucket by the last reconciliation, by type of drift.",
+		}, []string{"type"})
+		metaStoreReconciled = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_metadata_store_last_reconciliation_timestamp_seconds",
+			Help: "Unix timestamp of the last successful reconciliation of the metadata store with the bucket.",
+		})
+	}
+
+	// Garbage collection, retention and cleanup run as part of each compaction run, unless they are scheduled with their
+	// own interval. Meta sync is then done by each of them, unless it is scheduled separately as well.
+	scheduled := func(interval time.Duration) bool { return conf.wait && interval > 0 }
+	syncedSnapshot := func() (*compact.MetaSnapshot, error) {
+		if !scheduled(conf.syncInterval) {
+			if err := sy.SyncMetas(ctx); err != nil {
+				return nil, errors.Wrap(err, "sync")
+			}
+		}
+		return sy.Snapshot(), nil
+	}
+
+	garbageCollectFn := func() error {
+		if _, err := syncedSnapshot(); err != nil {
+			return err
+		}
+		if err := sy.GarbageCollect(ctx); err != nil {
+			return errors.Wrap(err, "garbage collection")
+		}
+		return nil
+	}
+
+	retentionFn := func(snapshot *compact.MetaSnapshot) error {
+		if err := compact.ApplyRetentionPolicyByResolution(ctx, logger, bkt, snapshot.Metas, runtimeConf.Config().RetentionByResolution(), blocksMarkedForDeletion, deletionGate); err != nil {
+			return errors.Wrap(err, "retention failed")
+		}
+		if len(retentionRules) > 0 {
+			if err := compact.ApplyRetentionRules(ctx, logger, bkt, snapshot.Metas, retentionRules, blocksMarkedForDeletion, deletionGate); err != nil {
+				return errors.Wrap(err, "retention rules failed")
+			}
+		}
+		return nil
+	}
+
+	cleanupFn := func(snapshot *compact.MetaSnapshot) error {
+		compact.BestEffortCleanAbortedPartialUploads(ctx, logger, snapshot.Partial, bkt, partialUploadDeleteAttempts, blocksCleaned, blockCleanupFailures)
+		compact.BestEffortCleanAbortedCommits(ctx, logger, pendingCommitFilter.PendingCommits(), bkt, blocksCleaned, blockCleanupFailures)
+		if err := blocksCleaner.DeleteMarkedBlocks(ctx); err != nil {
+			return errors.Wrap(err, "error cleaning blocks")
+		}
+		if conf.cleanupDebugMetasAfter > 0 || conf.cleanupOrphanedMarkers {
+			if err := auxCleaner.Clean(ctx, snapshot.Partial); err != nil {
+				return compact.NewRetryError(errors.Wrap(err, "clean orphaned auxiliary objects"))
+			}
+		}
+
+		if bucketIndexFetcher != nil {
+			idx, err := block.UpdateBucketIndex(ctx, logger, bkt, bucketIndexFetcher)
+			if err != nil {
+				return compact.NewRetryError(errors.Wrap(err, "update bucket index"))
+			}
+			level.Info(logger).Log("msg", "updated bucket index", "blocks", len(idx.Blocks), "deletion_marks", len(idx.DeletionMarks))
+		}
+		if metaStoreFetcher != nil {
+			drift, err := block.ReconcileMetaStore(ctx, logger, metaStore, metaStoreFetcher)
+			if err != nil {
+				return compact.NewRetryError(errors.Wrap(err, "reconcile metadata store"))
+			}
+			metaStoreDrift.WithLabelValues("missing").Set(float64(len(drift.Missing)))
+			metaStoreDrift.WithLabelValues("outdated").Set(float64(len(drift.Outdated)))
+			metaStoreDrift.WithLabelValues("unknown").Set(float64(len(drift.Unknown)))
+			metaStoreReconciled.SetToCurrentTime()
+		}
+		return nil
+	}
+
+	var bucketQuota *compact.BucketQuota
+	if conf.bucketQuota > 0 {
+		bucketQuota = compact.NewBucketQuota(logger, reg, int64(conf.bucketQuota))
+	}
 
 	compactMainFn := func() error {
+		// Over the quota, retention and cleanup run first, and compaction only if they got the bucket under the quota.
+		prioritized := false
+		if bucketQuota != nil && !conf.dryRun {
+			snapshot, err := syncedSnapshot()
+			if err != nil {
+				return err
+			}
+			if bucketQuota.Check(snapshot) {
+				if err := retentionFn(snapshot); err != nil {
+					return err
+				}
+				if err := cleanupFn(snapshot); err != nil {
+					return err
+				}
+				prioritized = true
+
+				if err := sy.SyncMetas(ctx); err != nil {
+					return errors.Wrap(err, "sync after prioritized retention")
+				}
+				if bucketQuota.Check(sy.Snapshot()) {
+					bucketQuota.Defer()
+					return nil
+				}
+			}
+		}
+
 		if err := compactor.Compact(ctx); err != nil {
 			return errors.Wrap(err, "compaction")
 		}
+		if conf.dryRun {
+			level.Info(logger).Log("msg", "dry run: skipping downsampling, retention and deletion of blocks")
+			return nil
+		}
+		// Compaction leaves an up to date snapshot of the bucket, so there is no need to sync again before downsampling.
+		snapshot := sy.Snapshot()
 
 		if !conf.disableDownsampling {
 			// After all compactions are done, work down the downsampling backlog.
 			// We run two passes of this to ensure that the 1h downsampling is generated
 			// for 5m downsamplings created in the first run.
-			level.Info(logger).Log("msg", "start first pass of downsampling")
-			if err := sy.SyncMetas(ctx); err != nil {
-				return errors.Wrap(err, "sync before first pass of downsampling")
-			}
-
-			for _, meta := range sy.Metas() {
+			level.Info(logger).Log("msg", "start first pass of downsampling", "snapshot", snapshot.Version)
+			for _, meta := range snapshot.Metas {
 				groupKey := compact.DefaultGroupKey(meta.Thanos)
-				downsampleMetrics.downsamples.WithLabelValues(groupKey)
-				downsampleMetrics.downsampleFailures.WithLabelValues(groupKey)
+				downsampleMetrics.downsamples.WithLabelValues(compact.GroupID(groupKey))
+				downsampleMetrics.downsampleFailures.WithLabelValues(compact.GroupID(groupKey))
 			}
-			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, sy.Metas(), downsamplingDir); err != nil {
+			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, snapshot.Metas, downsamplingDir, block.WithCompressedMeta(conf.compressMeta), block.WithDebugMetaPrefix(conf.debugMetasPrefix), block.WithFileHashes(conf.fileHashes)); err != nil {
 				return errors.Wrap(err, "first pass of downsampling failed")
 			}
 
-			level.Info(logger).Log("msg", "start second pass of downsampling")
 			if err := sy.SyncMetas(ctx); err != nil {
 				return errors.Wrap(err, "sync before second pass of downsampling")
 			}
-			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, sy.Metas(), downsamplingDir); err != nil {
+			snapshot = sy.Snapshot()
+			level.Info(logger).Log("msg", "start second pass of downsampling", "snapshot", snapshot.Version)
+			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, snapshot.Metas, downsamplingDir, block.WithCompressedMeta(conf.compressMeta), block.WithDebugMetaPrefix(conf.debugMetasPrefix), block.WithFileHashes(conf.fileHashes)); err != nil {
 				return errors.Wrap(err, "second pass of downsampling failed")
 			}
 			level.Info(logger).Log("msg", "downsampling iterations done")
@@ -330,65 +996,231 @@ func runCompact(
 			level.Info(logger).Log("msg", "downsampling was explicitly disabled")
 		}
 
-		// TODO(bwplotka): Find a way to avoid syncing if no op was done.
-		if err := sy.SyncMetas(ctx); err != nil {
-			return errors.Wrap(err, "sync before first pass of downsampling")
-		}
-
-		if err := compact.ApplyRetentionPolicyByResolution(ctx, logger, bkt, sy.Metas(), retentionByResolution, blocksMarkedForDeletion); err != nil {
-			return errors.Wrap(err, "retention failed")
+		// Retention uses the last snapshot as well. Blocks uploaded by the second pass of downsampling are not in it,
+		// so they are subject to retention starting with the next run.
+		if !scheduled(conf.retentionInterval) && !prioritized {
+			if err := retentionFn(snapshot); err != nil {
+				return err
+			}
 		}
 
 		// No need to resync before partial uploads and delete marked blocks. Last sync should be valid.
-		compact.BestEffortCleanAbortedPartialUploads(ctx, logger, sy.Partial(), bkt, partialUploadDeleteAttempts, blocksCleaned, blockCleanupFailures)
-		if err := blocksCleaner.DeleteMarkedBlocks(ctx); err != nil {
-			return errors.Wrap(err, "error cleaning blocks")
+		if !scheduled(conf.cleanupInterval) && !prioritized {
+			if err := cleanupFn(snapshot); err != nil {
+				return err
+			}
 		}
 		return nil
 	}
 
-	g.Add(func() error {
-		defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+	// run runs f unless halted, continuing after retriable errors. Once any loop hits a critical error with halting
+	// enabled, all loops halt.
+	var (
+		haltOnce sync.Once
+		haltCh   = make(chan struct{})
 
-		if !conf.wait {
-			return compactMainFn()
+		writeHaltStatus = conf.haltStatus && !conf.readOnly
+		haltStatusOnce  sync.Once
+	)
+	// recordHaltStatus writes the halt status on halt errors of the compaction loop, and clears the halt status of a
+	// previous process once compaction recovered.
+	recordHaltStatus := func(err error) {
+		if !writeHaltStatus {
+			return
+		}
+		if err == nil {
+			haltStatusOnce.Do(func() {
+				if err := compact.ClearHaltStatus(ctx, bkt, creatorID); err != nil {
+					level.Warn(logger).Log("msg", "failed to clear halt status", "err", err)
+				}
+			})
+			return
+		}
+		if compact.Classify(err) != compact.ErrorClassHalt {
+			return
+		}
+		if werr := compact.WriteHaltStatus(ctx, bkt, creatorID, err, time.Now()); werr != nil {
+			level.Warn(logger).Log("msg", "failed to write halt status", "err", werr)
+		}
+	}
+	run := func(name string, f func() error) error {
+		select {
+		case <-haltCh:
+			select {}
+		default:
 		}
 
-		// --wait=true is specified.
-		return runutil.Repeat(conf.waitInterval, ctx.Done(), func() error {
-			err := compactMainFn()
-			if err == nil {
-				iterations.Inc()
-				return nil
-			}
+		err := f()
+		if name == "compaction" || err != nil {
+			recordHaltStatus(err)
+		}
+		if err == nil {
+			return nil
+		}
 
+		switch compact.Classify(err) {
+		case compact.ErrorClassHalt:
 			// The HaltError type signals that we hit a critical bug and should block
 			// for investigation. You should alert on this being halted.
-			if compact.IsHaltError(err) {
-				if conf.haltOnError {
-					level.Error(logger).Log("msg", "critical error detected; halting", "err", err)
-					halted.Set(1)
-					select {}
-				} else {
-					return errors.Wrap(err, "critical error detected")
-				}
+			if conf.haltOnError {
+				level.Error(logger).Log("msg", "critical error detected; halting", "loop", name, "err", err)
+				halted.Set(1)
+				haltOnce.Do(func() { close(haltCh) })
+				select {}
+			} else {
+				return errors.Wrap(err, "critical error detected")
 			}
-
+		case compact.ErrorClassRetry:
 			// The RetryError signals that we hit an retriable error (transient error, no connection).
 			// You should alert on this being triggered too frequently.
-			if compact.IsRetryError(err) {
-				level.Error(logger).Log("msg", "retriable error", "err", err)
-				retried.Inc()
-				// TODO(bplotka): use actual "retry()" here instead of waiting 5 minutes?
+			level.Error(logger).Log("msg", "retriable error", "loop", name, "err", err)
+			retried.Inc()
+			// TODO(bplotka): use actual "retry()" here instead of waiting 5 minutes?
+			return nil
+		}
+
+		return errors.Wrap(err, "error executing "+name)
+	}
+	// repeat runs f every interval until the context is done.
+	repeat := func(name string, interval time.Duration, f func() error) error {
+		return runutil.Repeat(interval, ctx.Done(), func() error {
+			return run(name, f)
+		})
+	}
+
+	if conf.runtimeConfigFile != "" {
+		g.Add(func() error {
+			runtimeConf.Run(ctx, reload, conf.runtimeConfigReloadInterval)
+			return nil
+		}, func(error) {
+			cancel()
+		})
+	}
+
+	if conf.leaseTTL > 0 && !conf.readOnly {
+		// The lease is renewed well before it expires, so a slow renewal does not let it lapse.
+		g.Add(func() error {
+			return runutil.Repeat(conf.leaseTTL/3, ctx.Done(), func() error {
+				if err := compact.RenewLease(ctx, logger, bkt, creatorID, conf.leaseTTL); err != nil {
+					level.Warn(logger).Log("msg", "failed to renew compactor lease", "err", err)
+				}
 				return nil
-			}
+			})
+		}, func(error) {
+			cancel()
+		})
+	}
+
+	var runSucceeded prometheus.Gauge
+	if conf.metricsPushURL != "" {
+		runSucceeded = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_run_succeeded",
+			Help: "Set to 1 if the compactor run pushing its metrics completed without error, 0 otherwise.",
+		})
+	}
+	g.Add(func() (err error) {
+		defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+		if inventoryBkt != nil {
+			defer runutil.CloseWithLogOnErr(logger, inventoryBkt, "inventory bucket client")
+		}
+		if metaStore != nil {
+			defer runutil.CloseWithLogOnErr(logger, metaStore, "metadata store")
+		}
+		if conf.metricsPushURL != "" {
+			// Metrics of short-lived runs are pushed on exit, as the run is likely over before being scraped.
+			defer func() {
+				runSucceeded.Set(0)
+				if err == nil {
+					runSucceeded.Set(1)
+				}
+				if perr := extprom.PushMetrics(conf.metricsPushURL, conf.metricsPushJob, conf.metricsPushGrouping, reg, conf.metricsPushTimeout); perr != nil {
+					level.Warn(logger).Log("msg", "failed to push metrics of the run", "err", perr)
+					return
+				}
+				level.Info(logger).Log("msg", "pushed metrics of the run", "url", conf.metricsPushURL, "job", conf.metricsPushJob)
+			}()
+		}
+
+		if !conf.wait {
+			err := compactMainFn()
+			recordHaltStatus(err)
+			return err
+		}
 
-			return errors.Wrap(err, "error executing compaction")
+		// --wait=true is specified.
+		return repeat("compaction", conf.waitInterval, func() error {
+			if err := compactMainFn(); err != nil {
+				return err
+			}
+			iterations.Inc()
+			return nil
 		})
 	}, func(error) {
 		cancel()
 	})
 
+	if conf.onDemandAPI {
+		g.Add(func() error {
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-compactor.OnDemandRequested():
+				}
+				if err := run("on-demand compaction", func() error {
+					return compactor.CompactOnDemand(ctx)
+				}); err != nil {
+					return err
+				}
+			}
+		}, func(error) {
+			cancel()
+		})
+	}
+	if scheduled(conf.syncInterval) {
+		g.Add(func() error {
+			return repeat("meta sync", conf.syncInterval, func() error {
+				return errors.Wrap(sy.SyncMetas(ctx), "sync")
+			})
+		}, func(error) {
+			cancel()
+		})
+	}
+	if scheduled(conf.garbageCollectionInterval) {
+		g.Add(func() error {
+			return repeat("garbage collection", conf.garbageCollectionInterval, garbageCollectFn)
+		}, func(error) {
+			cancel()
+		})
+	}
+	// Dry run does not change the bucket, so retention and cleanup do not run on their own either.
+	if scheduled(conf.retentionInterval) && !conf.dryRun {
+		g.Add(func() error {
+			return repeat("retention", conf.retentionInterval, func() error {
+				snapshot, err := syncedSnapshot()
+				if err != nil {
+					return err
+				}
+				return retentionFn(snapshot)
+			})
+		}, func(error) {
+			cancel()
+		})
+	}
+	if scheduled(conf.cleanupInterval) && !conf.dryRun {
+		g.Add(func() error {
+			return repeat("cleanup", conf.cleanupInterval, func() error {
+				snapshot, err := syncedSnapshot()
+				if err != nil {
+					return err
+				}
+				return cleanupFn(snapshot)
+			})
+		}, func(error) {
+			cancel()
+		})
+	}
+
 	if conf.wait {
 		r := route.New()
 
@@ -405,6 +1237,17 @@ func runCompact(
 		})}
 		logMiddleware := logging.NewHTTPServerMiddleware(logger, opts...)
 		api.Register(r.WithPrefix("/api/v1"), tracer, logger, ins, logMiddleware)
+		capi := compactAPI.NewCompactAPI(logger, compactor, ignoreDeletionMarkFilter)
+		capi.Register(r.WithPrefix("/api/v1"), tracer, logger, ins, logMiddleware)
+		if conf.onDemandAPI {
+			capi.RegisterOnDemand(r.WithPrefix("/api/v1"), tracer, logger, ins, logMiddleware)
+		}
+		if annotationPolicy != nil {
+			capi.RegisterRetentionAnnotations(annotationPolicy, r.WithPrefix("/api/v1"), tracer, logger, ins, logMiddleware)
+		}
+		if churnStats != nil {
+			capi.RegisterChurnStats(churnStats, r.WithPrefix("/api/v1"), tracer, logger, ins, logMiddleware)
+		}
 
 		// Separate fetcher for global view.
 		// TODO(bwplotka): Allow Bucket UI to visualize the state of the block as well.
@@ -416,6 +1259,26 @@ func runCompact(
 
 		srv.Handle("/", r)
 
+		if conf.jobsAPI {
+			tlsCfg, err := tls.NewServerConfig(log.With(logger, "protocol", "gRPC"),
+				conf.grpc.tlsSrvCert, conf.grpc.tlsSrvKey, conf.grpc.tlsSrvClientCA)
+			if err != nil {
+				return errors.Wrap(err, "setup gRPC server")
+			}
+
+			s := grpcserver.New(logger, reg, tracer, component, grpcProbe, nil, nil,
+				grpcserver.WithListen(conf.grpc.bindAddress),
+				grpcserver.WithGracePeriod(time.Duration(conf.grpc.gracePeriod)),
+				grpcserver.WithTLSConfig(tlsCfg),
+				grpcserver.WithCompactorServer(compact.NewGRPCServer(compactor)),
+			)
+			g.Add(func() error {
+				return s.ListenAndServe()
+			}, func(err error) {
+				s.Shutdown(err)
+			})
+		}
+
 		g.Add(func() error {
 			iterCtx, iterCancel := context.WithTimeout(ctx, conf.waitInterval)
 			_, _, _ = f.Fetch(iterCtx)
@@ -449,21 +1312,132 @@ type compactConfig struct {
 	acceptMalformedIndex                           bool
 	maxCompactionLevel                             int
 	http                                           httpConfig
+	grpc                                           grpcConfig
 	dataDir                                        string
 	objStore                                       extflag.PathOrContent
 	consistencyDelay                               time.Duration
 	retentionRaw, retentionFiveMin, retentionOneHr model.Duration
 	wait                                           bool
 	waitInterval                                   time.Duration
+	syncInterval                                   time.Duration
+	garbageCollectionInterval                      time.Duration
+	strictGC                                       bool
+	probeCapabilities                              bool
+	gcMaxStaleness                                 time.Duration
+	inventoryObjStore                              extflag.PathOrContent
+	inventoryDir                                   string
+	inventoryFormat                                string
+	inventoryMaxAge                                time.Duration
+	retentionInterval                              time.Duration
+	cleanupInterval                                time.Duration
 	disableDownsampling                            bool
 	blockSyncConcurrency                           int
 	blockViewerSyncBlockInterval                   time.Duration
 	compactionConcurrency                          int
+	concurrencyClasses                             []string
 	deleteDelay                                    model.Duration
+	deleteConcurrency                              int
+	runtimeConfigFile                              string
+	runtimeConfigReloadInterval                    time.Duration
+	deleteMaxBlocksPerCycle                        int
+	deleteMaxBytesPerCycle                         units.Base2Bytes
 	dedupReplicaLabels                             []string
+	chunkPassthrough                               bool
+	mergeFuncRaw                                   string
+	mergeFuncFiveMin                               string
+	mergeFuncOneHr                                 string
+	coalesceMaxBlockSize                           units.Base2Bytes
+	bucketQuota                                    units.Base2Bytes
+	coalesceMaxBlockSeries                         uint64
+	coalesceMinBlocks                              int
+	groupTimeBucket                                model.Duration
 	selectorRelabelConf                            extflag.PathOrContent
 	webConf                                        webConfig
 	label                                          string
+	skipOutOfOrderSeries                           bool
+	normalizeIndex                                 bool
+	mergeDuplicateSeries                           bool
+	seriesRelabelConf                              extflag.PathOrContent
+	metaStoreConf                                  extflag.PathOrContent
+	groupSizeAccounting                            bool
+	maxBlocksPerCompaction                         int
+	externalMerge                                  bool
+	appendMinRatio                                 float64
+	pipelinedUpload                                bool
+	churnStats                                     bool
+	extLabelCollisions                             string
+	missingChunks                                  string
+	preflight                                      bool
+	preflightMaxWriteLatency                       time.Duration
+	leaseTTL                                       time.Duration
+	markTerminalBlocks                             bool
+	inspectIndexes                                 bool
+	outputMinSamplesRatio                          float64
+	sampleLossAction                               string
+	extensionsFromLabels                           []string
+	workStealing                                   bool
+	workStealingClaimTTL                           time.Duration
+	workStealingAfter                              time.Duration
+	workStealingMaxGroups                          int
+	freshRange                                     time.Duration
+	freshRangeQuiescence                           time.Duration
+	seriesFilter                                   bool
+	seriesFilterFPRate                             float64
+	metricsPushURL                                 string
+	metricsPushJob                                 string
+	metricsPushGrouping                            map[string]string
+	metricsPushTimeout                             time.Duration
+	haltStatus                                     bool
+	creatorID                                      string
+	retentionAnnotations                           bool
+	retentionRulesConf                             extflag.PathOrContent
+	compactWorkDirs                                []string
+	deletionExemptBlocks                           []string
+	deletionPolicyURL                              string
+	deletionPolicyTimeout                          time.Duration
+	deleteReadersURLs                              []string
+	deleteReadersTimeout                           time.Duration
+	deletePinnedMaxDeferral                        time.Duration
+	storeAckMaxAge                                 time.Duration
+	compactedSourcesGracePeriod                    time.Duration
+	adaptiveBlockSyncConcurrency                   bool
+	maxBlockSyncConcurrency                        int
+	caseFoldLabels                                 []string
+	migrateNormalizedLabels                        bool
+	maxFailedMetaRatio                             float64
+	compressMeta                                   bool
+	fileHashes                                     bool
+	maxMetaVersion                                 int
+	minTime, maxTime                               thanosmodel.TimeOrDurationValue
+	jobsAPI                                        bool
+	onDemandAPI                                    bool
+	dryRun                                         bool
+	readOnly                                       bool
+	quarantineInconsistentBlocks                   bool
+	checkTimeRanges                                bool
+	timeRangeAction                                string
+	timeRangeSampleRatio                           float64
+	verifyCoverage                                 bool
+	cleanupDebugMetasAfter                         time.Duration
+	debugMetasPrefix                               string
+	cleanupOrphanedMarkers                         bool
+	cleanupAuxDryRun                               bool
+	bucketIndex                                    bool
+	backlogSLOWindow                               time.Duration
+	memoryThrottleRatio                            float64
+	profileSlowGroupThreshold                      time.Duration
+	profileOnHalt                                  bool
+	profileCPUDuration                             time.Duration
+	profilePrefix                                  string
+	groupMaxConsecutiveFailures                    int
+	groupFailureCoolDown                           time.Duration
+	cycleDeadline                                  time.Duration
+	cycleHardDeadline                              time.Duration
+	downloadTimeout                                time.Duration
+	downloadRetries                                int
+	uploadTimeout                                  time.Duration
+	uploadRetries                                  int
+	stageRetryBackoff                              time.Duration
 }
 
 func (cc *compactConfig) registerFlag(cmd extkingpin.FlagClause) {
@@ -476,6 +1450,8 @@ func (cc *compactConfig) registerFlag(cmd extkingpin.FlagClause) {
 		Hidden().Default(strconv.Itoa(compactions.maxLevel())).IntVar(&cc.maxCompactionLevel)
 
 	cc.http.registerFlag(cmd)
+	cc.grpc.registerFlag(cmd, "Listen ip:port address for the gRPC Compactor API, used only with --compact.jobs-api. "+
+		"Make sure this address is routable from clients of the API.")
 
 	cmd.Flag("data-dir", "Data directory in which to cache blocks and process compactions.").
 		Default("./data").StringVar(&cc.dataDir)
@@ -492,12 +1468,134 @@ func (cc *compactConfig) registerFlag(cmd extkingpin.FlagClause) {
 		Default("0d").SetValue(&cc.retentionFiveMin)
 	cmd.Flag("retention.resolution-1h", "How long to retain samples of resolution 2 (1 hour) in bucket. Setting this to 0d will retain samples of this resolution forever").
 		Default("0d").SetValue(&cc.retentionOneHr)
+	cmd.Flag("retention.annotations", "Keep blocks preserved by retention annotations in the "+metadata.RetentionAnnotationsDir+" directory of the bucket from deletion by retention. "+
+		"With --wait, annotations can be listed, added and removed under /api/v1/compactor/retention-annotations.").
+		Default("false").BoolVar(&cc.retentionAnnotations)
+	cc.retentionRulesConf = *extflag.RegisterPathOrContent(cmd, "retention.rules-config",
+		"YAML file that contains retention rules applied together with retention by resolution, e.g. keeping only the newest blocks of groups matching a selector. "+
+			"See format details: https://thanos.io/tip/components/compact.md/#retention-rules", false)
 
 	// TODO(kakkoyun, pgough): https://github.com/thanos-io/thanos/issues/2266.
 	cmd.Flag("wait", "Do not exit after all compactions have been processed and wait for new work.").
 		Short('w').BoolVar(&cc.wait)
 	cmd.Flag("wait-interval", "Wait interval between consecutive compaction runs and bucket refreshes. Only works when --wait flag specified.").
 		Default("5m").DurationVar(&cc.waitInterval)
+	cmd.Flag("wait-interval.sync", "If non-zero, sync metas of the bucket in a separate loop with this interval, whose snapshot is used by garbage collection, "+
+		"retention and cleanup scheduled with their own interval, instead of syncing on each of their runs. Compaction always syncs. Only works when --wait flag specified.").
+		Default("0s").DurationVar(&cc.syncInterval)
+	cmd.Flag("wait-interval.garbage-collection", "If non-zero, mark blocks replaced by compacted blocks for deletion in a separate loop with this interval, "+
+		"instead of on each compaction iteration. Only works when --wait flag specified.").
+		Default("0s").DurationVar(&cc.garbageCollectionInterval)
+	cmd.Flag("compact.garbage-collection.strict", "Before marking each block replaced by a compacted block for deletion, check in the bucket that the compacted block "+
+		"still exists and is not marked for deletion and that the replaced block is not marked yet, so blocks are not marked based on stale synced metas.").
+		Default("false").BoolVar(&cc.strictGC)
+	cmd.Flag("compact.garbage-collection.max-staleness", "If non-zero, metas synced longer ago than this are synced again before garbage collection. "+
+		"Only works with --compact.garbage-collection.strict.").
+		Default("0s").DurationVar(&cc.gcMaxStaleness)
+	cmd.Flag("objstore.probe-capabilities", "On startup, probe capabilities of the bucket that cannot be told from its client, i.e. whether range reads return only "+
+		"the requested range and whether listing is consistent, by writing, reading, listing and deleting an object in "+objstore.CapabilityProbeDir+" directory. "+
+		"The compactor enables --compact.garbage-collection.strict if listing is not consistent.").
+		Default("false").BoolVar(&cc.probeCapabilities)
+	cc.inventoryObjStore = *regCommonObjStoreFlags(cmd, "-inventory", false, "The object storage holding inventory reports of the bucket, the bucket itself if not set.")
+	cmd.Flag("objstore.inventory.dir", "If set, load the latest inventory report of the bucket exported by the provider into this directory on every sync, and use objects listed "+
+		"by it instead of requesting each object for group size accounting and strict garbage collection. Objects not listed are requested from the bucket.").
+		Default("").StringVar(&cc.inventoryDir)
+	cmd.Flag("objstore.inventory.format", "Format of inventory reports: 's3' for S3 Inventory reports in CSV format or 'gcs' for GCS Storage Insights inventory reports in CSV format.").
+		Default(string(objstore.InventoryFormatS3)).EnumVar(&cc.inventoryFormat, objstore.InventoryFormats...)
+	cmd.Flag("objstore.inventory.max-age", "Maximum age of inventory reports to use, measured from the time they were taken at. Must not exceed --delete-delay.").
+		Default("24h").DurationVar(&cc.inventoryMaxAge)
+	cmd.Flag("wait-interval.retention", "If non-zero, apply retention in a separate loop with this interval, instead of at the end of each compaction run. "+
+		"Only works when --wait flag specified.").
+		Default("0s").DurationVar(&cc.retentionInterval)
+	cmd.Flag("wait-interval.cleanup", "If non-zero, delete blocks marked for deletion and aborted partial uploads, clean auxiliary objects and update the bucket index "+
+		"in a separate loop with this interval, instead of at the end of each compaction run. Only works when --wait flag specified.").
+		Default("0s").DurationVar(&cc.cleanupInterval)
+	cmd.Flag("compact.jobs-api", "Serve the gRPC Compactor API on --grpc-address, streaming compaction job events and allowing to inspect the queue of groups and prioritize them. "+
+		"Only works when --wait flag specified.").
+		Default("false").BoolVar(&cc.jobsAPI)
+	cmd.Flag("compact.on-demand-api", "Serve POST /api/v1/compactor/compact on the HTTP address, triggering immediate sync and compaction of a group given by group key or blocks, "+
+		"and GET /api/v1/compactor/jobs/<id> to follow the requested job. Only works when --wait flag specified.").
+		Default("false").BoolVar(&cc.onDemandAPI)
+	cmd.Flag("compact.dry-run", "Sync, group and plan compactions of blocks, logging compactions, garbage collection and label migrations that would be done, "+
+		"without changing the bucket. Downsampling, retention and deletion of blocks are skipped. Useful to verify configuration against a bucket before the first real run.").
+		Default("false").BoolVar(&cc.dryRun)
+	cmd.Flag("compact.read-only", "Run the whole compaction cycle as with --compact.dry-run, including dry run of cleanup of auxiliary objects, with all changes of the bucket "+
+		"denied, logged and counted by thanos_objstore_bucket_denied_operations_total metric, e.g. to run a staging compactor against a production bucket. "+
+		"Probing of bucket capabilities is skipped.").
+		Default("false").BoolVar(&cc.readOnly)
+	cmd.Flag("compact.quarantine-inconsistent-blocks", "Place blocks whose meta is inconsistent with their compaction group, e.g. unknown resolution, resolution not matching "+
+		"the time range or parents of the block, or missing compaction metadata, under hold with '"+compact.QuarantineHoldReason+"' reason, instead of compacting them. "+
+		"Quarantined blocks are never compacted, removed by retention nor deleted until the hold is removed.").
+		Default("false").BoolVar(&cc.quarantineInconsistentBlocks)
+	cmd.Flag("compact.time-range-check", "Check once per block not created by compaction that chunks of its index are within the time range of its meta.json, "+
+		"handling blocks failing the check with compact.time-range-check.action instead of planning compactions with their bogus time ranges. "+
+		"Indexes are downloaded into data-dir.").
+		Default("false").BoolVar(&cc.checkTimeRanges)
+	cmd.Flag("compact.time-range-check.action", "What to do with blocks failing compact.time-range-check: 'skip' leaves them out of compaction, retention and garbage collection "+
+		"while the compactor runs, 'repair' uploads their copy with a time range covering all their chunks and marks them for deletion, and 'quarantine' places them "+
+		"under hold with '"+compact.QuarantineTimeRangeHoldReason+"' reason.").
+		Default(string(compact.TimeRangeSkip)).EnumVar(&cc.timeRangeAction, compact.TimeRangeActions...)
+	cmd.Flag("compact.time-range-check.sample-ratio", "Ratio of series of each index checked by compact.time-range-check, within (0, 1]. Blocks are repaired after checking all their series.").
+		Default("1").Float64Var(&cc.timeRangeSampleRatio)
+	cmd.Flag("compact.verify-coverage", "After each garbage collection, report time ranges of groups where raw data is gone, e.g. deleted by retention, but 5m or 1h downsampled blocks "+
+		"do not cover it. The report is served under /api/v1/compactor/coverage and gap hours are exposed as thanos_compact_coverage_gap_hours and thanos_compact_coverage_lost_hours metrics.").
+		Default("false").BoolVar(&cc.verifyCoverage)
+	cmd.Flag("compact.debug-metas-prefix", "Prefix in the bucket of debug metas, copies of meta.json uploaded together with every block written by the compactor. "+
+		"They record provenance of blocks after their deletion and are read by 'tools bucket history'.").
+		Default(block.DebugMetas).StringVar(&cc.debugMetasPrefix)
+	cmd.Flag("compact.cleanup.debug-metas-after", "If non-zero, delete debug metas under compact.debug-metas-prefix of blocks that no longer exist in the bucket and were created longer than this ago. "+
+		"Debug metas are uploaded together with every block and are never deleted otherwise.").
+		Default("0s").DurationVar(&cc.cleanupDebugMetasAfter)
+	cmd.Flag("compact.cleanup.orphaned-markers", "Delete markers (e.g. deletion marks) left in directories of blocks without any other block files, e.g. because deletion of the block was interrupted.").
+		Default("false").BoolVar(&cc.cleanupOrphanedMarkers)
+	cmd.Flag("compact.cleanup.dry-run", "Only log and count orphaned debug metas and markers that would be deleted with compact.cleanup.* flags, exposed as thanos_compact_orphaned_auxiliary_objects metric.").
+		Default("false").BoolVar(&cc.cleanupAuxDryRun)
+	cmd.Flag("compact.bucket-index", "Maintain "+metadata.BucketIndexFilename+" in the root of the bucket, listing metas of all blocks and their deletion marks, "+
+		"updated at the end of each compaction run. Store gateways with --store.bucket-index-max-staleness set load it instead of listing the whole bucket.").
+		Default("false").BoolVar(&cc.bucketIndex)
+	cc.metaStoreConf = *extflag.RegisterPathOrContent(cmd, "metadata-store.config",
+		"YAML file that contains configuration of the metadata store mirroring metas of all blocks in the bucket. The compactor stores metas of blocks it uploads "+
+			"and reconciles the store with the bucket at the end of each compaction run, so store gateways can load metas from it instead of listing the bucket. "+
+			"See format details: https://thanos.io/tip/components/compact.md/#metadata-store", false)
+	cmd.Flag("compact.backlog-slo-window", "If non-zero, track compaction backlog of each resolution at the beginning of each compaction run, together with compaction "+
+		"and backlog burn down rates over this window and projected time to drain the backlog, exposed as thanos_compact_backlog_* metrics.").
+		Default("0s").DurationVar(&cc.backlogSLOWindow)
+	cmd.Flag("compact.memory-throttle-ratio", "If non-zero, do not start new group compactions while memory usage of the process is above this fraction of its memory limit, "+
+		"the lower of GOMEMLIMIT and the cgroup memory limit, until running compactions release memory. A group is always compacted if no other compaction is running. "+
+		"Useful with compact.concurrency above 1 to avoid being OOM-killed in the middle of uploads.").
+		Default("0").Float64Var(&cc.memoryThrottleRatio)
+	cmd.Flag("compact.profile.slow-group-threshold", "If non-zero, capture CPU, heap and goroutine profiles once a group compaction runs longer than this, "+
+		"bundled with the group key and plan of the compaction for post-mortem analysis.").
+		Default("0s").DurationVar(&cc.profileSlowGroupThreshold)
+	cmd.Flag("compact.profile.on-halt", "Capture heap and goroutine profiles, bundled with the group key and plan, once a group compaction halts the compactor.").
+		Default("false").BoolVar(&cc.profileOnHalt)
+	cmd.Flag("compact.profile.cpu-duration", "Duration of CPU profiles captured for slow group compactions.").
+		Default("30s").DurationVar(&cc.profileCPUDuration)
+	cmd.Flag("compact.profile.prefix", "Prefix in the bucket to upload captured profile bundles to. If empty, bundles are written into the profiles directory of data-dir.").
+		Default("").StringVar(&cc.profilePrefix)
+	cmd.Flag("compact.group-max-consecutive-failures", "If non-zero, skip compaction of a group for compact.group-failure-cool-down once it failed this many times in a row, "+
+		"so a single persistently failing group does not fail every compaction run. Groups cooling down are exposed by thanos_compact_group_cooling_down metric.").
+		Default("0").IntVar(&cc.groupMaxConsecutiveFailures)
+	cmd.Flag("compact.group-failure-cool-down", "How long to skip compaction of a group that failed compact.group-max-consecutive-failures times in a row.").
+		Default("6h").DurationVar(&cc.groupFailureCoolDown)
+	cmd.Flag("compact.cycle-deadline", "If non-zero, stop starting group compactions once a compaction cycle runs this long, and carry groups left over to the next cycle, "+
+		"which compacts them first, so every group is compacted within a bounded number of cycles on buckets too large for a single one. "+
+		"Groups carried over are kept in "+compact.CarryOverFilename+" of data-dir across restarts.").
+		Default("0s").DurationVar(&cc.cycleDeadline)
+	cmd.Flag("compact.cycle-hard-deadline", "If non-zero, cancel group compactions still running once a compaction cycle runs this long, carrying their groups over to the next "+
+		"cycle before the others. Must not be shorter than compact.cycle-deadline.").
+		Default("0s").DurationVar(&cc.cycleHardDeadline)
+	cmd.Flag("compact.download-timeout", "If non-zero, timeout of each download of a source block of a compaction. Timed out downloads are retried up to compact.download-retries times.").
+		Default("0s").DurationVar(&cc.downloadTimeout)
+	cmd.Flag("compact.download-retries", "Number of times a timed out or failed download of a source block is retried before the compaction fails and is retried by the next compaction cycle.").
+		Default("0").IntVar(&cc.downloadRetries)
+	cmd.Flag("compact.upload-timeout", "If non-zero, timeout of each upload of a compacted block. Timed out uploads are retried up to compact.upload-retries times.").
+		Default("0s").DurationVar(&cc.uploadTimeout)
+	cmd.Flag("compact.upload-retries", "Number of times a timed out or failed upload of a compacted block is retried before the compaction fails and is retried by the next compaction cycle. "+
+		"Uploads of blocks whose chunks were uploaded while compacting are not retried.").
+		Default("0").IntVar(&cc.uploadRetries)
+	cmd.Flag("compact.stage-retry-backoff", "Time to wait before retrying a download or upload of a compaction.").
+		Default("10s").DurationVar(&cc.stageRetryBackoff)
 
 	cmd.Flag("downsampling.disable", "Disables downsampling. This is not recommended "+
 		"as querying long time ranges without non-downsampled data is not efficient and useful e.g it is not possible to render all samples for a human eye anyway").
@@ -505,11 +1603,149 @@ func (cc *compactConfig) registerFlag(cmd extkingpin.FlagClause) {
 
 	cmd.Flag("block-sync-concurrency", "Number of goroutines to use when syncing block metadata from object storage.").
 		Default("20").IntVar(&cc.blockSyncConcurrency)
+	cmd.Flag("block-sync-concurrency.adaptive", "Adapt number of goroutines syncing block metadata to the object storage: start at block-sync-concurrency, "+
+		"back off on bursts of errors and ramp up while latency is low. Current value is exposed as thanos_blocks_meta_effective_concurrency metric.").
+		Default("false").BoolVar(&cc.adaptiveBlockSyncConcurrency)
+	cmd.Flag("block-sync-concurrency.max", "Maximum number of goroutines to use when syncing block metadata with block-sync-concurrency.adaptive enabled.").
+		Default("100").IntVar(&cc.maxBlockSyncConcurrency)
+	cmd.Flag("block-sync.group-size-accounting", "Compute total size of objects of each compaction group on every sync and expose it together with its growth rate "+
+		"as thanos_compact_group_size_bytes and thanos_compact_group_size_growth_bytes_per_second metrics. Objects of each block are listed only once, when the block is first seen.").
+		Default("false").BoolVar(&cc.groupSizeAccounting)
+	cmd.Flag("block-sync.max-failed-meta-ratio", "Maximum fraction of blocks whose meta.json may fail to load (e.g. because of unreadable objects) for a sync "+
+		"to proceed without them instead of failing. 0 means any failure fails the sync. Groups the failed blocks may belong to, i.e. all groups for blocks "+
+		"never synced before, are not compacted until their meta.json loads again. Failed blocks are counted in thanos_compact_pending_blocks metric.").
+		Default("0").Float64Var(&cc.maxFailedMetaRatio)
 	cmd.Flag("block-viewer.global.sync-block-interval", "Repeat interval for syncing the blocks between local and remote view for /global Block Viewer UI.").
 		Default("1m").DurationVar(&cc.blockViewerSyncBlockInterval)
 
 	cmd.Flag("compact.concurrency", "Number of goroutines to use when compacting groups.").
 		Default("1").IntVar(&cc.compactionConcurrency)
+	cmd.Flag("compact.concurrency-class", "Size class of groups limited in how many of them are compacted concurrently, in the <name>:<min size>:<max concurrency> format, "+
+		"e.g. huge:100GiB:1 (repeated). A group is in the class with the highest min size not above the size of its blocks, estimated from their metas. "+
+		"Groups of a class at its limit are passed over by next groups. Groups smaller than all classes are limited by compact.concurrency only.").
+		PlaceHolder("<name>:<min-size>:<max-concurrency>").StringsVar(&cc.concurrencyClasses)
+	cmd.Flag("compact.skip-series-with-out-of-order-chunks", "Drop series with out-of-order chunks from source blocks during compaction instead of halting. "+
+		"Dropped series are logged and reported in /api/v1/compactor/status together with examples of their labels. NOTE: This causes data loss of the dropped series.").
+		Default("false").BoolVar(&cc.skipOutOfOrderSeries)
+	cmd.Flag("compact.normalize-index", "Normalize index of source blocks with unsorted symbols, series or labels, as written by some third-party TSDB writers, "+
+		"before compacting them instead of failing. Normalized blocks are counted in thanos_compact_normalized_index_* metrics.").
+		Default("false").BoolVar(&cc.normalizeIndex)
+	cmd.Flag("compact.merge-duplicate-series", "Merge series with the same labels in source blocks, as produced by upstream bugs of some TSDB writers, "+
+		"before compacting them instead of failing. Overlapping chunks of the duplicates are merged and deduplicated by timestamp. "+
+		"Blocks with merged series are counted in thanos_compact_duplicate_series_* metrics.").
+		Default("false").BoolVar(&cc.mergeDuplicateSeries)
+	cmd.Flag("compact.work-dir", "Directory in whose 'compact' subdirectory blocks of a group are downloaded and compacted (repeated). "+
+		"Only the subdirectory is owned and cleaned up by the compactor. If repeated, e.g. with directories on different local volumes, "+
+		"each group compaction is placed in the directory with the most free space not yet reserved by running compactions. "+
+		"Defaults to the 'compact' directory in data-dir.").
+		StringsVar(&cc.compactWorkDirs)
+	cmd.Flag("compact.compress-meta", "Upload zstd compressed copy of meta.json as meta.json.zst next to meta.json of compacted and downsampled blocks, "+
+		"and prefer it when syncing block metadata, reducing transfer for buckets with many blocks. Debug metas are uploaded compressed only.").
+		Default("false").BoolVar(&cc.compressMeta)
+	cmd.Flag("compact.file-hashes", "List files of compacted and downsampled blocks in meta.json with SHA-256 hashes of their content, and verify hashes "+
+		"of downloaded source blocks listed with them. Sizes of files are listed and verified regardless.").
+		Default("false").BoolVar(&cc.fileHashes)
+	cmd.Flag("block.meta-max-version", "Maximum version of meta.json of blocks to compact and downsample. Blocks with metas of newer versions than known "+
+		"to this Thanos version are processed by the meta fields known to it, and results get metas of the latest known version. Metas of versions higher than this fail the sync.").
+		Hidden().Default(strconv.Itoa(metadata.MetaVersionLatest)).IntVar(&cc.maxMetaVersion)
+	cmd.Flag("compact.max-blocks-per-compaction", "Maximum number of source blocks compacted at once. Compaction plans selecting more blocks are split into parts "+
+		"compacted one after another, which limits disk space and open files needed. 0 means no limit.").
+		Default("0").IntVar(&cc.maxBlocksPerCompaction)
+	cmd.Flag("compact.external-merge", "Merge source blocks of compaction plans whose estimated disk usage exceeds free space of the work directory without downloading their chunks. "+
+		"Only indexes are downloaded and merged, while chunks are streamed from source blocks into the compacted block in object storage, one source block at a time. "+
+		"Applies to plans of non-overlapping blocks only; plans needing series relabelling, index normalization or deletion of samples are compacted on disk.").
+		Default("false").BoolVar(&cc.externalMerge)
+	cmd.Flag("compact.append-min-ratio", "If non-zero, compaction plans of a large block and small blocks following it, whose large block has at least this many times as many samples "+
+		"as all small blocks together, are merged like with --compact.external-merge: chunks of the large block are copied into the compacted block as they are, "+
+		"server side if the bucket supports it, and chunks of the small blocks are appended, instead of rewriting the large block by every compaction of slowly growing groups.").
+		Default("0").Float64Var(&cc.appendMinRatio)
+	cmd.Flag("compact.pipelined-upload", "Upload chunk segments of compacted blocks while they are written, removing them from the work directory once uploaded. "+
+		"Overlaps compaction with the upload and lowers peak disk usage of compactions to roughly their source blocks and the index of the compacted block.").
+		Default("false").BoolVar(&cc.pipelinedUpload)
+	cmd.Flag("compact.churn-stats", "Compute series churn statistics of compactions from indexes of their source blocks and compacted block: the share of series present in only one source block "+
+		"and the entropy of label values. Statistics of the last compaction of each group are exposed as metrics and, with --wait, under /api/v1/compactor/churn.").
+		Default("false").BoolVar(&cc.churnStats)
+	cmd.Flag("compact.external-label-collisions", "What to do with series of source blocks having labels of the same names as external labels of their block, which are ambiguous at query time. "+
+		"'ignore' does not look for them, 'warn' logs and counts them, 'drop' removes the colliding labels of series, 'rename' prefixes their names with 'exported_' "+
+		"and 'halt' halts the compactor. Blocks whose series are rewritten are compacted on disk.").
+		Default("ignore").EnumVar(&cc.extLabelCollisions, append([]string{"ignore"}, compact.ExternalLabelCollisionActions...)...)
+	cmd.Flag("compact.missing-chunks", "What to do with source blocks whose chunk segment files are missing or truncated in the bucket once downloading them again did not help. "+
+		"'retry' fails the compaction to be retried in the next run, 'drop-series' compacts the block without series with unreadable chunks "+
+		"and 'quarantine' places the block under hold with '"+compact.QuarantineMissingChunksHoldReason+"' reason. Blocks merged externally are not checked.").
+		Default(string(compact.MissingChunksRetry)).EnumVar(&cc.missingChunks, compact.MissingChunksActions...)
+	cmd.Flag("compact.mark-terminal-blocks", "Mark level 1 blocks which no other block of their group is left to be compacted with, as the rest of the time range of the highest compaction level "+
+		"around them is past retention, with no-compact-mark.json, so compaction planning skips them. Blocks marked for no compaction are still removed by retention.").
+		Default("false").BoolVar(&cc.markTerminalBlocks)
+	cmd.Flag("compact.inspect-indexes", "Refine estimates of planned compactions with sizes of index tables of their source blocks, read from the TOC and the symbols table "+
+		"of their indexes in object storage using range requests, without downloading the indexes.").
+		Default("false").BoolVar(&cc.inspectIndexes)
+	cmd.Flag("compact.output-check.min-samples-ratio", "Minimum ratio of samples of compacted blocks to samples expected from their source blocks, which for vertical compactions "+
+		"are those of the source with the most samples within each overlapping time range. Compacted blocks with fewer samples, not spanning exactly the time range of their "+
+		"sources or with more samples than their sources are reported by warnings and thanos_compact_group_output_anomalies_total, and uploaded unless "+
+		"compact.output-check.sample-loss-action says otherwise. 0 disables the check of lost samples.").
+		Default("0.95").Float64Var(&cc.outputMinSamplesRatio)
+	cmd.Flag("compact.output-check.sample-loss-action", "What to do with compacted blocks with fewer samples than compact.output-check.min-samples-ratio: 'warn' uploads them, "+
+		"'halt' halts without uploading them and 'quarantine' places their source blocks under hold with '"+compact.QuarantineSampleLossHoldReason+"' reason instead of uploading them, "+
+		"so the group is compacted without them.").
+		Default(string(compact.SampleLossWarn)).EnumVar(&cc.sampleLossAction, compact.SampleLossActions...)
+	cmd.Flag("compact.extension-from-label", "Extension of metas of compacted blocks set from the value of an external label of their source blocks, "+
+		"in the <extension>=<label> format, e.g. team=tenant (repeated). Values are merged with values of the extension propagated from the source blocks.").
+		PlaceHolder("<extension>=<label>").StringsVar(&cc.extensionsFromLabels)
+	cmd.Flag("compact.work-stealing", "Claim groups in '"+metadata.GroupClaimsDir+"' directory of the bucket before compacting them, skipping groups claimed by other compactors, "+
+		"and once groups of own shard have nothing left to compact, claim and compact groups of other shards with no block uploaded for compact.work-stealing.steal-after. "+
+		"Source blocks are marked for deletion only if the claim is still held. Requires sharding by --selector.relabel-config, and has to be enabled for all compactors of the bucket.").
+		Default("false").BoolVar(&cc.workStealing)
+	cmd.Flag("compact.work-stealing.claim-ttl", "Time after which claims of groups expire and can be taken over by other compactors. Has to be longer than compaction of a group takes.").
+		Default("6h").DurationVar(&cc.workStealingClaimTTL)
+	cmd.Flag("compact.work-stealing.steal-after", "Minimum age of the newest block of a group of another shard for the group to be stolen, as its owner seems to fall behind.").
+		Default("2h").DurationVar(&cc.workStealingAfter)
+	cmd.Flag("compact.work-stealing.max-groups", "Maximum number of groups of other shards stolen after each compaction run.").
+		Default("1").IntVar(&cc.workStealingMaxGroups)
+	cmd.Flag("compact.fresh-range", "Range at the end of the time range of each group whose blocks are left out of compaction planning while blocks are still uploaded into it, "+
+		"so late blocks are compacted together with the rest of the range instead of causing recompactions. 0 disables the guard.").
+		Default("0s").DurationVar(&cc.freshRange)
+	cmd.Flag("compact.fresh-range.quiescence", "Time without any block of the fresh range of a group created after which the fresh range is compacted. See --compact.fresh-range.").
+		Default("30m").DurationVar(&cc.freshRangeQuiescence)
+	cmd.Flag("compact.series-filter", "Write a bloom filter of label pairs of each compacted block into its "+block.SeriesFilterFilename+" file, uploaded next to its index, "+
+		"so readers can skip blocks without series matching equality matchers of selective queries without reading their indexes.").
+		Default("false").BoolVar(&cc.seriesFilter)
+	cmd.Flag("compact.series-filter.false-positive-rate", "False positive rate of series filters written with compact.series-filter. Lower rates make filters larger.").
+		Default("0.01").Float64Var(&cc.seriesFilterFPRate)
+	cmd.Flag("metrics.push-url", "URL of a Pushgateway compatible endpoint all metrics of the compactor are pushed to when it exits, "+
+		"e.g. for compactors run as short-lived jobs without --wait, which exit before being scraped. Metrics pushed before with the same job and grouping labels are replaced.").
+		Default("").StringVar(&cc.metricsPushURL)
+	cmd.Flag("metrics.push-job", "Job label of metrics pushed to --metrics.push-url.").
+		Default("thanos-compact").StringVar(&cc.metricsPushJob)
+	cmd.Flag("metrics.push-grouping", "Grouping label of metrics pushed to --metrics.push-url in the <name>=<value> format, e.g. shard=0 for compactors sharing a bucket (repeated).").
+		PlaceHolder("<name>=<value>").StringMapVar(&cc.metricsPushGrouping)
+	cmd.Flag("metrics.push-timeout", "Timeout of pushing metrics to --metrics.push-url.").
+		Default("30s").DurationVar(&cc.metricsPushTimeout)
+	cmd.Flag("compact.halt-status", "When halting on a critical error, write the reason, IDs of blocks mentioned by it, the time and the creator ID of the compactor into "+
+		"'"+metadata.CompactorStatusDir+"/<creator ID>/"+metadata.HaltStatusFilename+"' of the bucket, so halts can be discovered without scraping logs. "+
+		"The file is deleted once compaction succeeds again, e.g. after a restart. Ignored in read-only mode.").
+		Default("false").BoolVar(&cc.haltStatus)
+	cmd.Flag("compact.creator-id", "Identity of this compactor, whose fingerprint is embedded in the entropy of IDs of compacted blocks to tell apart their creators "+
+		"and to avoid ULID collisions between compactors. Defaults to the hostname.").
+		Default("").StringVar(&cc.creatorID)
+	cmd.Flag("compact.preflight", "Before the first compaction run, check that the compactor can list, get, upload and delete objects of the bucket, "+
+		"that deletion marks are uploaded only if they do not exist yet, and that no other compactor holds an active lease of the bucket (see --compact.lease-ttl). "+
+		"The compactor exits if any check fails. Objects of the checks are written into '"+compact.PreflightDir+"' directory and deleted once checked.").
+		Default("false").BoolVar(&cc.preflight)
+	cmd.Flag("compact.preflight.max-write-latency", "Fail preflight checks if uploading a small object takes longer. 0s means no limit.").
+		Default("0s").DurationVar(&cc.preflightMaxWriteLatency)
+	cmd.Flag("compact.lease-ttl", "If positive, hold a lease of the bucket by renewing '"+metadata.CompactorLeaseFilename+"' in the root of the bucket every third of the TTL, "+
+		"identified by --compact.creator-id, so that other compactors detect it in preflight checks. The lease is not renewed while another compactor holds it.").
+		Default("0s").DurationVar(&cc.leaseTTL)
+	cmd.Flag("compact.group-key.case-fold-label", "Name of an external label whose name is matched case-insensitively and whose value is lower-cased "+
+		"before grouping blocks (repeated). Allows compacting together blocks uploaded with inconsistent label casing.").
+		StringsVar(&cc.caseFoldLabels)
+	cmd.Flag("compact.group-key.migrate-metas", "Rewrite meta.json of blocks whose external labels differ from the normalized form "+
+		"(see compact.group-key.case-fold-label), so all components see the normalized labels.").
+		Default("false").BoolVar(&cc.migrateNormalizedLabels)
+	cc.seriesRelabelConf = *extflag.RegisterPathOrContent(cmd, "compact.series-relabel-config",
+		"YAML file that contains relabeling configuration applied to labels of all series in source blocks during compaction. "+
+			"Follows Prometheus relabel-config syntax; only replace, labelmap, labeldrop and labelkeep actions are supported. "+
+			"NOTE: Changed series are persisted only when their blocks get compacted.", false)
 
 	cmd.Flag("delete-delay", "Time before a block marked for deletion is deleted from bucket. "+
 		"If delete-delay is non zero, blocks will be marked for deletion and compactor component will delete blocks marked for deletion from the bucket. "+
@@ -517,15 +1753,94 @@ func (cc *compactConfig) registerFlag(cmd extkingpin.FlagClause) {
 		"Note that deleting blocks immediately can cause query failures, if store gateway still has the block loaded, "+
 		"or compactor is ignoring the deletion because it's compacting the block at the same time.").
 		Default("48h").SetValue(&cc.deleteDelay)
+	cmd.Flag("delete.concurrency", "Number of blocks marked for deletion deleted from the bucket concurrently.").
+		Default("1").IntVar(&cc.deleteConcurrency)
+	cmd.Flag("delete.max-blocks-per-cycle", "Maximum number of blocks marked for deletion deleted from the bucket per cleanup cycle, oldest marks first. "+
+		"Blocks over the limit stay marked and are deleted by next cycles, spreading mass deletions, e.g. after retention changes, "+
+		"to avoid early deletion fees and throttling of object storage. 0 means no limit.").
+		Default("0").IntVar(&cc.deleteMaxBlocksPerCycle)
+	cmd.Flag("delete.max-bytes-per-cycle", "Maximum total size of blocks marked for deletion deleted from the bucket per cleanup cycle, "+
+		"like --delete.max-blocks-per-cycle. At least one block is deleted per cycle. Sizes are listed from the bucket before deletion. 0 means no limit.").
+		Default("0B").BytesVar(&cc.deleteMaxBytesPerCycle)
+
+	cmd.Flag("delete.exempt-block", "ID of a block that must never be deleted nor ignored by the compactor, even if marked for deletion, "+
+		"e.g. because of legal hold (repeated).").
+		StringsVar(&cc.deletionExemptBlocks)
+	cmd.Flag("delete.policy-url", "URL of an Open Policy Agent style data API asked before every block is marked for deletion, e.g. http://localhost:8181/v1/data/thanos/compact/allow_deletion. "+
+		"The block meta and the deletion reason are POSTed as {\"input\": {\"meta\": ..., \"reason\": ...}}; the block is kept unless the response is {\"result\": true}. "+
+		"Denied deletions are counted in thanos_compact_deletion_policy_denied_total metric.").
+		StringVar(&cc.deletionPolicyURL)
+	cmd.Flag("delete.policy-timeout", "Timeout of a single evaluation of the deletion policy configured with --delete.policy-url.").
+		Default("10s").DurationVar(&cc.deletionPolicyTimeout)
+	cmd.Flag("delete.readers-url", "Base URL of a reader of the bucket, e.g. a store gateway at http://store:10902, asked before deleting blocks for blocks pinned by its queries in flight, "+
+		"served under "+metadata.ReaderPinsPath+" (repeated). Deletion of pinned blocks is deferred until they are unpinned or --delete.pinned-max-deferral elapsed. "+
+		"If any reader cannot be asked, deletions of all blocks are deferred the same way.").
+		StringsVar(&cc.deleteReadersURLs)
+	cmd.Flag("delete.readers-timeout", "Timeout of asking a single reader configured with --delete.readers-url for pinned blocks.").
+		Default("10s").DurationVar(&cc.deleteReadersTimeout)
+	cmd.Flag("delete.pinned-max-deferral", "Maximum time deletion of blocks pinned by readers configured with --delete.readers-url is deferred for, since the blocks were due for deletion.").
+		Default("1h").DurationVar(&cc.deletePinnedMaxDeferral)
+	cmd.Flag("delete.store-ack-max-age", "If non-zero, source blocks of compactions and duplicates are not marked for deletion until every store gateway that loaded them "+
+		"also loaded a block replacing them, as acknowledged by store gateways with --store.load-ack-id. Acknowledgements not updated for longer than this are ignored. "+
+		"It should be a few times larger than --sync-block-duration of store gateways.").
+		Default("0s").DurationVar(&cc.storeAckMaxAge)
+	cmd.Flag("delete.compacted-sources-grace-period", "If non-zero, source blocks of compactions and other outdated blocks are not marked for deletion until the block replacing them "+
+		"was uploaded longer than this ago, as told by the modification time of its meta.json. It gives a window to roll back a corrupted compacted block by marking it for "+
+		"deletion, which makes its source blocks visible again.").
+		Default("0s").DurationVar(&cc.compactedSourcesGracePeriod)
 
 	cmd.Flag("deduplication.replica-label", "Label to treat as a replica indicator of blocks that can be deduplicated (repeated flag). This will merge multiple replica blocks into one. This process is irreversible."+
 		"Experimental. When it is set to true, compactor will ignore the given labels so that vertical compaction can merge the blocks."+
 		"Please note that this uses a NAIVE algorithm for merging (no smart replica deduplication, just chaining samples together)."+
 		"This works well for deduplication of blocks with **precisely the same samples** like produced by Receiver replication.").
 		Hidden().StringsVar(&cc.dedupReplicaLabels)
+	cmd.Flag("deduplication.chunk-passthrough", "Experimental. Merge overlapping raw blocks during vertical compaction at the level of chunks: chunks not overlapping with chunks "+
+		"of the same series from other blocks are copied verbatim and only overlapping ones are re-encoded. Numbers of copied and re-encoded chunks are exposed as "+
+		"thanos_compact_chunk_passthrough_copied_chunks_total and thanos_compact_chunk_passthrough_reencoded_chunks_total metrics.").
+		Hidden().Default("false").BoolVar(&cc.chunkPassthrough)
+	cmd.Flag("deduplication.merge-func.resolution-raw", "Experimental. Function merging overlapping chunks of raw blocks during vertical compaction: 'concat' appends chunks in order of time "+
+		"so earlier chunks win where they overlap, 'dedup' merges all samples deduplicated by timestamp like TSDB compaction and 'counter' merges like 'dedup' without "+
+		"counter resets none of the chunks saw, e.g. of replicas scraping counters at different times. Raw blocks are merged at the level of chunks unless this is 'dedup'.").
+		Hidden().Default(string(compact.MergeFuncDedup)).EnumVar(&cc.mergeFuncRaw, compact.MergeFuncNames...)
+	cmd.Flag("deduplication.merge-func.resolution-5m", "Experimental. Function merging overlapping aggregate chunks of blocks of resolution 1 (5 minutes) during vertical compaction, "+
+		"see deduplication.merge-func.resolution-raw. 'counter' takes counter aggregates applying counter resets between chunks, as queries do.").
+		Hidden().Default(string(compact.MergeFuncCounter)).EnumVar(&cc.mergeFuncFiveMin, compact.MergeFuncNames...)
+	cmd.Flag("deduplication.merge-func.resolution-1h", "Experimental. Function merging overlapping aggregate chunks of blocks of resolution 2 (1 hour) during vertical compaction, "+
+		"see deduplication.merge-func.resolution-5m.").
+		Hidden().Default(string(compact.MergeFuncCounter)).EnumVar(&cc.mergeFuncOneHr, compact.MergeFuncNames...)
+	cmd.Flag("compact.coalesce.max-block-size", "If non-zero, blocks with size estimated from their meta.json below this are tiny. As soon as the first compaction range "+
+		"(8h by default) of a group holds compact.coalesce.min-blocks tiny blocks, they are compacted into one, before leveled compaction would pick the range up. "+
+		"Useful for buckets receiving many small blocks, e.g. from many receivers.").
+		Default("0B").BytesVar(&cc.coalesceMaxBlockSize)
+	cmd.Flag("compact.coalesce.max-block-series", "If non-zero, blocks with fewer series than this are tiny, see compact.coalesce.max-block-size.").
+		Default("0").Uint64Var(&cc.coalesceMaxBlockSeries)
+	cmd.Flag("compact.coalesce.min-blocks", "Minimum number of tiny blocks within the first compaction range of a group coalesced into one block.").
+		Default("4").IntVar(&cc.coalesceMinBlocks)
+	cmd.Flag("compact.group-time-bucket", "If non-zero, split groups of blocks shorter than this into time buckets of this size, so that long-lived label sets "+
+		"are compacted in smaller units. Blocks of the bucket size and longer are merged across buckets by the remaining compaction levels. Must be one of the compaction levels above the first one, e.g. 2d.").
+		Default("0s").SetValue(&cc.groupTimeBucket)
+	cmd.Flag("compact.bucket-quota", "If non-zero, limit of live bytes in the bucket, i.e. size of blocks not marked for deletion estimated from their meta.json. "+
+		"While the bucket is over the limit, each compaction run applies retention and deletes marked blocks first, and compacts only once that got the bucket "+
+		"under the limit, as compactions temporarily add bytes. Quota pressure is exposed as thanos_compact_bucket_quota_* metrics.").
+		Default("0B").BytesVar(&cc.bucketQuota)
 
 	cc.selectorRelabelConf = *regSelectorRelabelFlags(cmd)
 
+	cmd.Flag("compact.runtime-config-file", "Path to YAML file with runtime configuration of the compactor, overriding retention, concurrency, "+
+		"delete delay and selector relabel configuration of the flags. It is reloaded on SIGHUP and every --compact.runtime-config-reload-interval, "+
+		"applying changes from the next compaction, retention or cleanup on. Invalid configurations are rejected, keeping the current one.").
+		Default("").StringVar(&cc.runtimeConfigFile)
+	cmd.Flag("compact.runtime-config-reload-interval", "Interval of reloading --compact.runtime-config-file. 0 means reloading only on SIGHUP.").
+		Default("0s").DurationVar(&cc.runtimeConfigReloadInterval)
+
+	cmd.Flag("min-time", "Start of the time partition handled by this compactor, inclusive. Only blocks with min time within the partition are "+
+		"synced, compacted, downsampled, garbage collected and deleted, so compactors with distinct partitions can run against the same bucket. "+
+		"Option can be a constant time in RFC3339 format or time duration relative to current time, such as -1d or 2h45m. Valid duration units are ms, s, m, h, d, w, y.").
+		Default("0000-01-01T00:00:00Z").SetValue(&cc.minTime)
+	cmd.Flag("max-time", "End of the time partition handled by this compactor, exclusive. Partial blocks are cleaned up only if the partition contains the current time. "+
+		"Option can be a constant time in RFC3339 format or time duration relative to current time, such as -1d or 2h45m. Valid duration units are ms, s, m, h, d, w, y.").
+		Default("9999-12-31T23:59:59Z").SetValue(&cc.maxTime)
+
 	cc.webConf.registerFlag(cmd)
 
 	cmd.Flag("bucket-web-label", "Prometheus label to use as timeline title in the bucket web UI").StringVar(&cc.label)
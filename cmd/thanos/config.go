@@ -21,9 +21,10 @@ type grpcConfig struct {
 	tlsSrvClientCA string
 }
 
-func (gc *grpcConfig) registerFlag(cmd extkingpin.FlagClause) *grpcConfig {
-	cmd.Flag("grpc-address",
-		"Listen ip:port address for gRPC endpoints (StoreAPI). Make sure this address is routable from other components.").
+// registerFlag registers gRPC server flags, describing the listen address with the given help, as what is served on it
+// differs between components.
+func (gc *grpcConfig) registerFlag(cmd extkingpin.FlagClause, addressHelp string) *grpcConfig {
+	cmd.Flag("grpc-address", addressHelp).
 		Default("0.0.0.0:10901").StringVar(&gc.bindAddress)
 	cmd.Flag("grpc-grace-period",
 		"Time to wait after an interrupt received for GRPC Server.").
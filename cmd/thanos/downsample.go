@@ -43,11 +43,11 @@ func newDownsampleMetrics(reg *prometheus.Registry) *DownsampleMetrics {
 	m.downsamples = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
 		Name: "thanos_compact_downsample_total",
 		Help: "Total number of downsampling attempts.",
-	}, []string{"group"})
+	}, []string{"group_id"})
 	m.downsampleFailures = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
 		Name: "thanos_compact_downsample_failures_total",
 		Help: "Total number of failed downsampling attempts.",
-	}, []string{"group"})
+	}, []string{"group_id"})
 
 	return m
 }
@@ -109,8 +109,8 @@ func RunDownsample(
 
 			for _, meta := range metas {
 				groupKey := compact.DefaultGroupKey(meta.Thanos)
-				metrics.downsamples.WithLabelValues(groupKey)
-				metrics.downsampleFailures.WithLabelValues(groupKey)
+				metrics.downsamples.WithLabelValues(compact.GroupID(groupKey))
+				metrics.downsampleFailures.WithLabelValues(compact.GroupID(groupKey))
 			}
 			if err := downsampleBucket(ctx, logger, metrics, bkt, metas, dataDir); err != nil {
 				return errors.Wrap(err, "downsampling failed")
@@ -158,6 +158,7 @@ func downsampleBucket(
 	bkt objstore.Bucket,
 	metas map[ulid.ULID]*metadata.Meta,
 	dir string,
+	uploadOpts ...block.UploadOption,
 ) error {
 	if err := os.RemoveAll(dir); err != nil {
 		return errors.Wrap(err, "clean working directory")
@@ -213,11 +214,11 @@ func downsampleBucket(
 			if m.MaxTime-m.MinTime < downsample.DownsampleRange0 {
 				continue
 			}
-			if err := processDownsampling(ctx, logger, bkt, m, dir, downsample.ResLevel1); err != nil {
-				metrics.downsampleFailures.WithLabelValues(compact.DefaultGroupKey(m.Thanos)).Inc()
+			if err := processDownsampling(ctx, logger, bkt, m, dir, downsample.ResLevel1, uploadOpts...); err != nil {
+				metrics.downsampleFailures.WithLabelValues(compact.GroupID(compact.DefaultGroupKey(m.Thanos))).Inc()
 				return errors.Wrap(err, "downsampling to 5 min")
 			}
-			metrics.downsamples.WithLabelValues(compact.DefaultGroupKey(m.Thanos)).Inc()
+			metrics.downsamples.WithLabelValues(compact.GroupID(compact.DefaultGroupKey(m.Thanos))).Inc()
 
 		case downsample.ResLevel1:
 			missing := false
@@ -236,17 +237,17 @@ func downsampleBucket(
 			if m.MaxTime-m.MinTime < downsample.DownsampleRange1 {
 				continue
 			}
-			if err := processDownsampling(ctx, logger, bkt, m, dir, downsample.ResLevel2); err != nil {
-				metrics.downsampleFailures.WithLabelValues(compact.DefaultGroupKey(m.Thanos)).Inc()
+			if err := processDownsampling(ctx, logger, bkt, m, dir, downsample.ResLevel2, uploadOpts...); err != nil {
+				metrics.downsampleFailures.WithLabelValues(compact.GroupID(compact.DefaultGroupKey(m.Thanos))).Inc()
 				return errors.Wrap(err, "downsampling to 60 min")
 			}
-			metrics.downsamples.WithLabelValues(compact.DefaultGroupKey(m.Thanos)).Inc()
+			metrics.downsamples.WithLabelValues(compact.GroupID(compact.DefaultGroupKey(m.Thanos))).Inc()
 		}
 	}
 	return nil
 }
 
-func processDownsampling(ctx context.Context, logger log.Logger, bkt objstore.Bucket, m *metadata.Meta, dir string, resolution int64) error {
+func processDownsampling(ctx context.Context, logger log.Logger, bkt objstore.Bucket, m *metadata.Meta, dir string, resolution int64, uploadOpts ...block.UploadOption) error {
 	begin := time.Now()
 	bdir := filepath.Join(dir, m.ULID.String())
 
@@ -254,8 +255,23 @@ func processDownsampling(ctx context.Context, logger log.Logger, bkt objstore.Bu
 	if err != nil {
 		return errors.Wrapf(err, "download block %s", m.ULID)
 	}
+	if err := block.VerifyFiles(bdir, m.Thanos.Files, false); err != nil {
+		return errors.Wrapf(err, "verify downloaded block %s", m.ULID)
+	}
 	level.Info(logger).Log("msg", "downloaded block", "id", m.ULID, "duration", time.Since(begin))
 
+	if m.Version > metadata.MetaVersionLatest {
+		// TSDB opens only blocks with meta of the latest known version, which is also the version of the downsampled block.
+		downgraded, err := m.ConvertTo(metadata.MetaVersionLatest)
+		if err != nil {
+			return errors.Wrapf(err, "downgrade meta of block %s", m.ULID)
+		}
+		m = downgraded
+		if err := metadata.Write(logger, bdir, m); err != nil {
+			return errors.Wrapf(err, "write downgraded meta of block %s", m.ULID)
+		}
+	}
+
 	if err := block.VerifyIndex(logger, filepath.Join(bdir, block.IndexFilename), m.MinTime, m.MaxTime); err != nil {
 		return errors.Wrap(err, "input block index not valid")
 	}
@@ -290,7 +306,7 @@ func processDownsampling(ctx context.Context, logger log.Logger, bkt objstore.Bu
 
 	begin = time.Now()
 
-	err = block.Upload(ctx, logger, bkt, resdir)
+	err = block.Upload(ctx, logger, bkt, resdir, uploadOpts...)
 	if err != nil {
 		return errors.Wrapf(err, "upload downsampled block %s", id)
 	}
@@ -65,6 +65,16 @@ func regCommonTracingFlags(app extkingpin.FlagClause) *extflag.PathOrContent {
 	)
 }
 
+func regSelectorFilterFlags(cmd extkingpin.FlagClause) *extflag.PathOrContent {
+	return extflag.RegisterPathOrContent(
+		cmd,
+		"selector.filter-config",
+		"YAML file that contains a list of block metadata filters (time range, label selector, minimum compaction level or deletion mark policy) that allows selecting blocks, "+
+			"applied after the ones configured by other flags. See format details: https://thanos.io/tip/components/store.md/#metadata-filters ",
+		false,
+	)
+}
+
 func regSelectorRelabelFlags(cmd extkingpin.FlagClause) *extflag.PathOrContent {
 	return extflag.RegisterPathOrContent(
 		cmd,
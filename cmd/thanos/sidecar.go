@@ -408,7 +408,7 @@ type sidecarConfig struct {
 
 func (sc *sidecarConfig) registerFlag(cmd extkingpin.FlagClause) {
 	sc.http.registerFlag(cmd)
-	sc.grpc.registerFlag(cmd)
+	sc.grpc.registerFlag(cmd, "Listen ip:port address for gRPC endpoints (StoreAPI). Make sure this address is routable from other components.")
 	sc.prometheus.registerFlag(cmd)
 	sc.connection.registerFlag(cmd)
 	sc.tsdb.registerFlag(cmd)
@@ -5,7 +5,9 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"path"
 	"time"
 
@@ -18,6 +20,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/route"
 	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/block/metastore"
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/extflag"
 	"github.com/thanos-io/thanos/pkg/extkingpin"
@@ -86,6 +90,7 @@ func registerStore(app *extkingpin.App) {
 		Hidden().Default("true").Bool()
 
 	selectorRelabelConf := regSelectorRelabelFlags(cmd)
+	selectorFilterConf := regSelectorFilterFlags(cmd)
 
 	postingOffsetsInMemSampling := cmd.Flag("store.index-header-posting-offsets-in-mem-sampling", "Controls what is the ratio of postings offsets store will hold in memory. "+
 		"Larger value will keep less offsets, which will increase CPU cycles needed for query touching those postings. It's meant for setups that want low baseline memory pressure and where less traffic is expected. "+
@@ -105,6 +110,25 @@ func registerStore(app *extkingpin.App) {
 		"Default is 24h, half of the default value for --delete-delay on compactor.").
 		Default("24h"))
 
+	bucketIndexMaxStaleness := modelDuration(cmd.Flag("store.bucket-index-max-staleness", "If non-zero, block metadata is loaded from "+metadata.BucketIndexFilename+
+		" maintained by compactor with --compact.bucket-index, instead of listing the whole bucket. If the index is missing or was not updated for longer than this duration, "+
+		"the bucket is listed as usual. It should be a few times larger than --wait-interval of compactor.").
+		Default("0s"))
+
+	metaStoreConfig := extflag.RegisterPathOrContent(cmd, "metadata-store.config",
+		"YAML file that contains configuration of the metadata store maintained by compactor with --metadata-store.config. If set, block metadata is loaded from the store "+
+			"instead of listing the bucket, falling back to the bucket if the store is unreachable or was not reconciled for longer than --store.metadata-store-max-staleness. "+
+			"See format details: https://thanos.io/tip/components/compact.md/#metadata-store",
+		false)
+
+	metaStoreMaxStaleness := modelDuration(cmd.Flag("store.metadata-store-max-staleness", "Maximum time since the last reconciliation of the metadata store with the bucket "+
+		"for the store to be used. It should be a few times larger than --wait-interval of compactor.").
+		Default("1h"))
+
+	loadAckID := cmd.Flag("store.load-ack-id", "If set, after every sync of blocks the store gateway uploads the list of loaded blocks to "+metadata.LoadAcksDir+"/<id>.json in the bucket. "+
+		"Compactor with --delete.store-ack-max-age set keeps source blocks of compactions until every store gateway loaded their replacement. The ID has to be unique among store gateways of the bucket.").
+		Default("").String()
+
 	webExternalPrefix := cmd.Flag("web.external-prefix", "Static prefix for all HTML links and redirect URLs in the bucket web UI interface. Actual endpoints are still served on / or the web.route-prefix. This allows thanos bucket web UI to be served behind a reverse proxy that strips a URL sub-path.").Default("").String()
 	webPrefixHeaderName := cmd.Flag("web.prefix-header", "Name of HTTP request header used for dynamic prefixing of UI links and redirects. This option is ignored if web.external-prefix argument is set. Security risk: enable this option only if a reverse proxy in front of thanos is resetting the header. The --web.prefix-header=X-Forwarded-Prefix option can be useful, for example, if Thanos UI is served via Traefik reverse proxy with PathPrefixStrip option enabled, which sends the stripped prefix value in X-Forwarded-Prefix header. This allows thanos UI to be served on a sub-path.").Default("").String()
 
@@ -141,10 +165,15 @@ func registerStore(app *extkingpin.App) {
 				MaxTime: *maxTime,
 			},
 			selectorRelabelConf,
+			selectorFilterConf,
 			*advertiseCompatibilityLabel,
 			*enablePostingsCompression,
 			time.Duration(*consistencyDelay),
 			time.Duration(*ignoreDeletionMarksDelay),
+			time.Duration(*bucketIndexMaxStaleness),
+			metaStoreConfig,
+			time.Duration(*metaStoreMaxStaleness),
+			*loadAckID,
 			*webExternalPrefix,
 			*webPrefixHeaderName,
 			*postingOffsetsInMemSampling,
@@ -174,9 +203,14 @@ func runStore(
 	blockSyncConcurrency int,
 	filterConf *store.FilterConfig,
 	selectorRelabelConf *extflag.PathOrContent,
+	selectorFilterConf *extflag.PathOrContent,
 	advertiseCompatibilityLabel, enablePostingsCompression bool,
 	consistencyDelay time.Duration,
 	ignoreDeletionMarksDelay time.Duration,
+	bucketIndexMaxStaleness time.Duration,
+	metaStoreConfig *extflag.PathOrContent,
+	metaStoreMaxStaleness time.Duration,
+	loadAckID string,
 	externalPrefix, prefixHeader string,
 	postingOffsetsInMemSampling int,
 	cachingBucketConfig *extflag.PathOrContent,
@@ -241,10 +275,26 @@ func runStore(
 		return errors.Wrap(err, "get content of index cache configuration")
 	}
 
+	metaStoreContentYaml, err := metaStoreConfig.Content()
+	if err != nil {
+		return errors.Wrap(err, "get content of metadata store configuration")
+	}
+
+	var metaStore block.MetaStore
+	if len(metaStoreContentYaml) > 0 {
+		metaStore, err = metastore.NewMetaStore(logger, metaStoreContentYaml)
+		if err != nil {
+			return errors.Wrap(err, "create metadata store")
+		}
+	}
+
 	// Ensure we close up everything properly.
 	defer func() {
 		if err != nil {
 			runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+			if metaStore != nil {
+				runutil.CloseWithLogOnErr(logger, metaStore, "metadata store")
+			}
 		}
 	}()
 
@@ -263,18 +313,38 @@ func runStore(
 		return errors.Wrap(err, "create index cache")
 	}
 
+	filterContentYaml, err := selectorFilterConf.Content()
+	if err != nil {
+		return errors.Wrap(err, "get content of metadata filters configuration")
+	}
+	configuredFilters, err := block.NewMetadataFilters(logger, bkt, extprom.WrapRegistererWithPrefix("thanos_", reg), filterContentYaml)
+	if err != nil {
+		return err
+	}
+
 	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, bkt, ignoreDeletionMarksDelay)
-	metaFetcher, err := block.NewMetaFetcher(logger, fetcherConcurrency, bkt, dataDir, extprom.WrapRegistererWithPrefix("thanos_", reg),
-		[]block.MetadataFilter{
-			block.NewTimePartitionMetaFilter(filterConf.MinTime, filterConf.MaxTime),
-			block.NewLabelShardedMetaFilter(relabelConfig),
-			block.NewConsistencyDelayMetaFilter(logger, consistencyDelay, extprom.WrapRegistererWithPrefix("thanos_", reg)),
-			ignoreDeletionMarkFilter,
-			block.NewDeduplicateFilter(),
-		}, nil)
+	baseMetaFetcher, err := block.NewBaseFetcher(logger, fetcherConcurrency, bkt, dataDir, extprom.WrapRegistererWithPrefix("thanos_", reg))
 	if err != nil {
-		return errors.Wrap(err, "meta fetcher")
+		return errors.Wrap(err, "create meta fetcher")
+	}
+	if bucketIndexMaxStaleness > 0 {
+		baseMetaFetcher.UseBucketIndex(bucketIndexMaxStaleness)
 	}
+	if metaStore != nil {
+		baseMetaFetcher.UseMetaStore(metaStore, metaStoreMaxStaleness)
+	}
+	// Configured filters go before the deduplication, so blocks are never deduplicated in favour of filtered out ones.
+	filters := append([]block.MetadataFilter{
+		block.NewTimePartitionMetaFilter(filterConf.MinTime, filterConf.MaxTime),
+		block.NewLabelShardedMetaFilter(relabelConfig),
+	}, configuredFilters...)
+	filters = append(filters,
+		block.NewConsistencyDelayMetaFilter(logger, consistencyDelay, extprom.WrapRegistererWithPrefix("thanos_", reg)),
+		block.NewPendingCommitFilter(logger, bkt),
+		ignoreDeletionMarkFilter,
+		block.NewDeduplicateFilter(),
+	)
+	metaFetcher := baseMetaFetcher.NewMetaFetcher(extprom.WrapRegistererWithPrefix("thanos_", reg), filters, nil)
 
 	// Limit the concurrency on queries against the Thanos store.
 	if maxConcurrency < 0 {
@@ -315,6 +385,9 @@ func runStore(
 		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(func() error {
 			defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+			if metaStore != nil {
+				defer runutil.CloseWithLogOnErr(logger, metaStore, "metadata store")
+			}
 
 			level.Info(logger).Log("msg", "initializing bucket store")
 			begin := time.Now()
@@ -325,10 +398,22 @@ func runStore(
 			level.Info(logger).Log("msg", "bucket store ready", "init_duration", time.Since(begin).String())
 			close(bucketStoreReady)
 
+			ackLoaded := func() {
+				if loadAckID == "" {
+					return
+				}
+				if err := block.UploadLoadAck(ctx, bkt, loadAckID, bs.LoadedBlocks()); err != nil {
+					level.Warn(logger).Log("msg", "uploading load ack failed", "err", err)
+				}
+			}
+			ackLoaded()
+
 			err := runutil.Repeat(syncInterval, ctx.Done(), func() error {
 				if err := bs.SyncBlocks(ctx); err != nil {
 					level.Warn(logger).Log("msg", "syncing blocks failed", "err", err)
+					return nil
 				}
+				ackLoaded()
 				return nil
 			})
 
@@ -366,6 +451,13 @@ func runStore(
 		compactorView := ui.NewBucketUI(logger, "", path.Join(externalPrefix, "/loaded"), prefixHeader)
 		compactorView.Register(r, extpromhttp.NewInstrumentationMiddleware(reg))
 		metaFetcher.UpdateOnChange(compactorView.Set)
+		// Blocks read by queries in flight, so compactors consulting this store gateway defer deleting them.
+		r.Get(metadata.ReaderPinsPath, func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(metadata.ReaderPins{Blocks: bs.PinnedBlocks()}); err != nil {
+				level.Warn(logger).Log("msg", "failed to write pinned blocks", "err", err)
+			}
+		})
 		srv.Handle("/", r)
 	}
 
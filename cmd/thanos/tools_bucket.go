@@ -7,7 +7,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -25,6 +27,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/route"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
 	v1 "github.com/thanos-io/thanos/pkg/api/blocks"
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
@@ -36,6 +39,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/extprom"
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
 	"github.com/thanos-io/thanos/pkg/logging"
+	"github.com/thanos-io/thanos/pkg/model"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/client"
 	"github.com/thanos-io/thanos/pkg/prober"
@@ -64,7 +68,7 @@ var (
 		sort.Strings(s)
 		return s
 	}
-	inspectColumns = []string{"ULID", "FROM", "UNTIL", "RANGE", "UNTIL-DOWN", "#SERIES", "#SAMPLES", "#CHUNKS", "COMP-LEVEL", "COMP-FAILED", "LABELS", "RESOLUTION", "SOURCE"}
+	inspectColumns = []string{"ULID", "FROM", "UNTIL", "RANGE", "UNTIL-DOWN", "#SERIES", "#SAMPLES", "#CHUNKS", "COMP-LEVEL", "COMP-FAILED", "LABELS", "RESOLUTION", "SOURCE", "PROVENANCE"}
 )
 
 func registerBucket(app extkingpin.AppClause) {
@@ -78,6 +82,12 @@ func registerBucket(app extkingpin.AppClause) {
 	registerBucketReplicate(cmd, objStoreConfig)
 	registerBucketDownsample(cmd, objStoreConfig)
 	registerBucketCleanup(cmd, objStoreConfig)
+	registerBucketHold(cmd, objStoreConfig)
+	registerBucketDeletionIntent(cmd, objStoreConfig)
+	registerBucketHistory(cmd, objStoreConfig)
+	registerBucketImport(cmd, objStoreConfig)
+	registerBucketMigrate(cmd, objStoreConfig)
+	registerBucketPreflight(cmd, objStoreConfig)
 }
 
 func registerBucketVerify(app extkingpin.AppClause, objStoreConfig *extflag.PathOrContent) {
@@ -526,7 +536,7 @@ func registerBucketCleanup(app extkingpin.AppClause, objStoreConfig *extflag.Pat
 		// This is to make sure compactor will not accidentally perform compactions with gap instead.
 		ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, bkt, *deleteDelay/2)
 		duplicateBlocksFilter := block.NewDeduplicateFilter()
-		blocksCleaner := compact.NewBlocksCleaner(logger, bkt, ignoreDeletionMarkFilter, *deleteDelay, stubCounter, stubCounter)
+		blocksCleaner := compact.NewBlocksCleaner(logger, bkt, ignoreDeletionMarkFilter, *deleteDelay, 1, stubCounter, stubCounter)
 
 		ctx := context.Background()
 
@@ -542,6 +552,7 @@ func registerBucketCleanup(app extkingpin.AppClause, objStoreConfig *extflag.Pat
 					block.NewConsistencyDelayMetaFilter(logger, *consistencyDelay, extprom.WrapRegistererWithPrefix(extpromPrefix, reg)),
 					ignoreDeletionMarkFilter,
 					duplicateBlocksFilter,
+					block.NewHoldMarkFilter(logger, bkt),
 				}, []block.MetadataModifier{block.NewReplicaLabelRemover(logger, make([]string, 0))},
 			)
 			sy, err = compact.NewSyncer(
@@ -576,6 +587,225 @@ func registerBucketCleanup(app extkingpin.AppClause, objStoreConfig *extflag.Pat
 	})
 }
 
+func registerBucketHold(app extkingpin.AppClause, objStoreConfig *extflag.PathOrContent) {
+	cmd := app.Command("hold", fmt.Sprintf("Places blocks under hold (e.g. legal hold) by uploading %s, or removes the hold. "+
+		"Blocks under hold are never compacted, removed by retention nor deleted.", metadata.HoldMarkFilename))
+	ids := cmd.Flag("id", "ID (ULID) of the block to place under hold or to remove the hold of (repeated).").Required().Strings()
+	reason := cmd.Flag("reason", "Human readable reason of the hold, stored in the hold mark.").String()
+	remove := cmd.Flag("remove", "Remove the hold of given blocks instead of placing it.").Bool()
+
+	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ <-chan struct{}, _ bool) error {
+		confContentYaml, err := objStoreConfig.Content()
+		if err != nil {
+			return err
+		}
+
+		blockIDs := make([]ulid.ULID, 0, len(*ids))
+		for _, id := range *ids {
+			u, err := ulid.Parse(id)
+			if err != nil {
+				return errors.Wrapf(err, "invalid ULID %q", id)
+			}
+			blockIDs = append(blockIDs, u)
+		}
+
+		bkt, err := client.NewBucket(logger, confContentYaml, reg, "hold")
+		if err != nil {
+			return err
+		}
+		defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+
+		// Dummy actor to immediately kill the group after the run function returns.
+		g.Add(func() error { return nil }, func(error) {})
+
+		ctx := context.Background()
+		for _, id := range blockIDs {
+			if *remove {
+				if err := block.RemoveHold(ctx, logger, bkt, id); err != nil {
+					return errors.Wrapf(err, "remove hold of block %s", id)
+				}
+				continue
+			}
+			if err := block.PlaceHold(ctx, logger, bkt, id, *reason); err != nil {
+				return errors.Wrapf(err, "place block %s under hold", id)
+			}
+		}
+		return nil
+	})
+}
+
+func registerBucketDeletionIntent(app extkingpin.AppClause, objStoreConfig *extflag.PathOrContent) {
+	cmd := app.Command("deletion-intent", fmt.Sprintf("Requests deletion of samples of matching series from blocks by appending a deletion intent to their %s, "+
+		"or clears all intents. Intents are applied by the compactor the next time the blocks are compacted.", metadata.PendingDeletionsFilename))
+	ids := cmd.Flag("id", "ID (ULID) of the block to delete samples from (repeated).").Required().Strings()
+	match := cmd.Flag("match", "Series selector of the series to delete samples of, e.g. '{job=\"foo\"}'.").String()
+	minTime := model.TimeOrDuration(cmd.Flag("min-time", "Start of time range of the deleted samples. Option can be a constant time in RFC3339 format or time duration relative to current time, such as -1d or 2h45m. Valid duration units are ms, s, m, h, d, w, y.").
+		Default("0000-01-01T00:00:00Z"))
+	maxTime := model.TimeOrDuration(cmd.Flag("max-time", "End of time range of the deleted samples. Option can be a constant time in RFC3339 format or time duration relative to current time, such as -1d or 2h45m. Valid duration units are ms, s, m, h, d, w, y.").
+		Default("9999-12-31T23:59:59Z"))
+	reason := cmd.Flag("reason", "Human readable reason of the deletion, stored in the intent.").String()
+	clear := cmd.Flag("clear", "Clear all pending deletion intents of given blocks instead of adding one.").Bool()
+
+	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ <-chan struct{}, _ bool) error {
+		confContentYaml, err := objStoreConfig.Content()
+		if err != nil {
+			return err
+		}
+
+		blockIDs := make([]ulid.ULID, 0, len(*ids))
+		for _, id := range *ids {
+			u, err := ulid.Parse(id)
+			if err != nil {
+				return errors.Wrapf(err, "invalid ULID %q", id)
+			}
+			blockIDs = append(blockIDs, u)
+		}
+		if !*clear && *match == "" {
+			return errors.New("match selector is required unless clearing deletion intents")
+		}
+
+		bkt, err := client.NewBucket(logger, confContentYaml, reg, "deletion-intent")
+		if err != nil {
+			return err
+		}
+		defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+
+		// Dummy actor to immediately kill the group after the run function returns.
+		g.Add(func() error { return nil }, func(error) {})
+
+		ctx := context.Background()
+		intent := metadata.DeletionIntent{
+			Matchers:    *match,
+			MinTime:     minTime.PrometheusTimestamp(),
+			MaxTime:     maxTime.PrometheusTimestamp(),
+			RequestTime: time.Now().Unix(),
+			Reason:      *reason,
+		}
+		for _, id := range blockIDs {
+			if *clear {
+				if err := block.ClearDeletionIntents(ctx, logger, bkt, id); err != nil {
+					return errors.Wrapf(err, "clear deletion intents of block %s", id)
+				}
+				continue
+			}
+			if err := block.AddDeletionIntent(ctx, logger, bkt, id, intent); err != nil {
+				return errors.Wrapf(err, "add deletion intent to block %s", id)
+			}
+		}
+		return nil
+	})
+}
+
+func registerBucketHistory(app extkingpin.AppClause, objStoreConfig *extflag.PathOrContent) {
+	cmd := app.Command("history", "Reconstructs blocks of the bucket at a past time from debug metas, including blocks compacted and deleted since then, "+
+		"in the same table as inspect. Blocks removed otherwise than by compaction, e.g. by retention, are not detected.")
+	at := model.TimeOrDuration(cmd.Flag("at", "Time to reconstruct the bucket at. Option can be a constant time in RFC3339 format or time duration relative to current time, such as -1d or 2h45m. Valid duration units are ms, s, m, h, d, w, y.").
+		Required())
+	prefix := cmd.Flag("debug-metas-prefix", "Prefix of debug metas in the bucket, as configured in compact.debug-metas-prefix.").Default(block.DebugMetas).String()
+	selector := cmd.Flag("selector", "Selects blocks based on label, e.g. '-l key1=\\\"value1\\\" -l key2=\\\"value2\\\"'. All key value pairs must match.").Short('l').
+		PlaceHolder("<name>=\\\"<value>\\\"").Strings()
+	sortBy := cmd.Flag("sort-by", "Sort by columns. It's also possible to sort by multiple columns, e.g. '--sort-by FROM --sort-by UNTIL'. I.e., if the 'FROM' value is equal the rows are then further sorted by the 'UNTIL' value.").
+		Default("FROM", "UNTIL").Enums(inspectColumns...)
+	timeout := cmd.Flag("timeout", "Timeout to download debug metas from remote storage").Default("5m").Duration()
+
+	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ <-chan struct{}, _ bool) error {
+		selectorLabels, err := parseFlagLabels(*selector)
+		if err != nil {
+			return errors.Wrap(err, "error parsing selector flag")
+		}
+
+		confContentYaml, err := objStoreConfig.Content()
+		if err != nil {
+			return err
+		}
+
+		bkt, err := client.NewBucket(logger, confContentYaml, reg, component.Bucket.String())
+		if err != nil {
+			return err
+		}
+		defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+
+		// Dummy actor to immediately kill the group after the run function returns.
+		g.Add(func() error { return nil }, func(error) {})
+
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+
+		metas, err := block.NewDebugMetaReader(bkt, *prefix).StateAt(ctx, timestamp.Time(at.PrometheusTimestamp()))
+		if err != nil {
+			return errors.Wrap(err, "reconstruct bucket state")
+		}
+
+		blockMetas := make([]*metadata.Meta, 0, len(metas))
+		for _, meta := range metas {
+			blockMetas = append(blockMetas, meta)
+		}
+		return printTable(blockMetas, selectorLabels, *sortBy)
+	})
+}
+
+func registerBucketImport(app extkingpin.AppClause, objStoreConfig *extflag.PathOrContent) {
+	cmd := app.Command("import", "Validates local Prometheus TSDB blocks, e.g. backfilled or migrated from another system, injects Thanos meta with given external labels "+
+		"and import source, and uploads them to the bucket. Source blocks are not modified.")
+	paths := cmd.Flag("path", "Directory of the block to import, or of a TSDB whose blocks are all imported (repeated).").Required().Strings()
+	extLabels := cmd.Flag("label", "External label of imported blocks in the form 'key=\\\"value\\\"' (repeated). At least one is required.").
+		PlaceHolder("<name>=\\\"<value>\\\"").Required().Strings()
+	splitRange := cmd.Flag("split-range", "If non-zero, split blocks crossing boundaries of time ranges of this size aligned to the Unix epoch, e.g. 2h to align "+
+		"them with the first compaction range of the compactor. Split blocks and blocks with tombstones are rewritten with new IDs.").Default("0s").Duration()
+	dataDir := cmd.Flag("data-dir", "Data directory in which to stage and rewrite blocks before upload.").Default("./data").String()
+
+	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ <-chan struct{}, _ bool) error {
+		lset, err := parseFlagLabels(*extLabels)
+		if err != nil {
+			return errors.Wrap(err, "parse labels")
+		}
+		conf := block.ImportConfig{Labels: lset.Map(), SplitRange: splitRange.Milliseconds()}
+
+		var bdirs []string
+		for _, p := range *paths {
+			if _, ok := block.IsBlockDir(p); ok {
+				bdirs = append(bdirs, p)
+				continue
+			}
+			fis, err := ioutil.ReadDir(p)
+			if err != nil {
+				return errors.Wrapf(err, "read %s", p)
+			}
+			for _, fi := range fis {
+				if _, ok := block.IsBlockDir(fi.Name()); ok && fi.IsDir() {
+					bdirs = append(bdirs, filepath.Join(p, fi.Name()))
+				}
+			}
+		}
+
+		confContentYaml, err := objStoreConfig.Content()
+		if err != nil {
+			return err
+		}
+
+		bkt, err := client.NewBucket(logger, confContentYaml, reg, "import")
+		if err != nil {
+			return err
+		}
+		defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+
+		// Dummy actor to immediately kill the group after the run function returns.
+		g.Add(func() error { return nil }, func(error) {})
+
+		if err := os.MkdirAll(*dataDir, os.ModePerm); err != nil {
+			return errors.Wrap(err, "create data dir")
+		}
+		ctx := context.Background()
+		for _, bdir := range bdirs {
+			if _, err := block.ImportBlock(ctx, logger, bkt, bdir, *dataDir, conf); err != nil {
+				return errors.Wrapf(err, "import block %s", bdir)
+			}
+		}
+		level.Info(logger).Log("msg", "import done", "blocks", len(bdirs))
+		return nil
+	})
+}
+
 func printTable(blockMetas []*metadata.Meta, selectorLabels labels.Labels, sortBy []string) error {
 	header := inspectColumns
 
@@ -612,6 +842,11 @@ func printTable(blockMetas []*metadata.Meta, selectorLabels labels.Labels, sortB
 		line = append(line, strings.Join(labels, ","))
 		line = append(line, time.Duration(blockMeta.Thanos.Downsample.Resolution*int64(time.Millisecond)).String())
 		line = append(line, string(blockMeta.Thanos.Source))
+		var provenance []string
+		for _, src := range blockMeta.Thanos.IngestionSources() {
+			provenance = append(provenance, string(src))
+		}
+		line = append(line, strings.Join(provenance, ","))
 		lines = append(lines, line)
 	}
 
@@ -709,3 +944,90 @@ func compare(s1, s2 string) bool {
 	}
 	return s1Time.Before(s2Time)
 }
+
+func registerBucketMigrate(app extkingpin.AppClause, objStoreConfig *extflag.PathOrContent) {
+	cmd := app.Command("migrate", fmt.Sprintf("Copies all blocks, their markers and other objects of the bucket into another bucket, e.g. of another "+
+		"provider, verifying every copy, so compaction continues where it left off once components are switched over. Once done, %s "+
+		"describing the outcome is uploaded into the root of the destination bucket. Interrupted migrations can be resumed by running it again.", block.MigrationManifestFilename))
+	toObjStoreConfig := regCommonObjStoreFlags(cmd, "-to", false, "The object storage which migrate data to.")
+	concurrency := cmd.Flag("concurrency", "Number of blocks to copy concurrently.").Default("4").Int()
+
+	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ <-chan struct{}, _ bool) error {
+		confContentYaml, err := objStoreConfig.Content()
+		if err != nil {
+			return err
+		}
+		toConfContentYaml, err := toObjStoreConfig.Content()
+		if err != nil {
+			return err
+		}
+		if len(toConfContentYaml) == 0 {
+			return errors.New("no destination object storage configured, use --objstore-to.config or --objstore-to.config-file")
+		}
+
+		src, err := client.NewBucket(logger, confContentYaml, reg, "migrate")
+		if err != nil {
+			return err
+		}
+		defer runutil.CloseWithLogOnErr(logger, src, "source bucket client")
+
+		dst, err := client.NewBucket(logger, toConfContentYaml, reg, "migrate-to")
+		if err != nil {
+			return err
+		}
+		defer runutil.CloseWithLogOnErr(logger, dst, "destination bucket client")
+
+		// Dummy actor to immediately kill the group after the run function returns.
+		g.Add(func() error { return nil }, func(error) {})
+
+		m, err := block.MigrateBucket(context.Background(), logger, src, dst, *concurrency)
+		if err != nil {
+			return errors.Wrap(err, "migrate bucket")
+		}
+		level.Info(logger).Log("msg", "migrated bucket", "blocks", len(m.Blocks), "objects", len(m.Objects),
+			"vanished", len(m.Vanished), "partial", len(m.Partial), "bucketIndexRebuilt", m.BucketIndexRebuilt, "duration", m.FinishedAt.Sub(m.StartedAt))
+		if len(m.Vanished) > 0 || len(m.Partial) > 0 {
+			level.Warn(logger).Log("msg", "some blocks were not copied; run the migration again once nothing writes into the source bucket", "vanished", fmt.Sprintf("%v", m.Vanished), "partial", fmt.Sprintf("%v", m.Partial))
+		}
+		return nil
+	})
+}
+
+func registerBucketPreflight(app extkingpin.AppClause, objStoreConfig *extflag.PathOrContent) {
+	cmd := app.Command("preflight", "Runs the compactor preflight checks against the bucket and prints their report as JSON, "+
+		"exiting with an error if any check fails. See --compact.preflight of the compactor.")
+	holder := cmd.Flag("holder", "Identity of the compactor to check for, whose own compactor lease is not reported. Defaults to the hostname.").String()
+	maxWriteLatency := cmd.Flag("max-write-latency", "Fail the checks if uploading a small object takes longer. 0s means no limit.").Default("0s").Duration()
+
+	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ <-chan struct{}, _ bool) error {
+		confContentYaml, err := objStoreConfig.Content()
+		if err != nil {
+			return err
+		}
+		if *holder == "" {
+			if *holder, err = os.Hostname(); err != nil {
+				return errors.Wrap(err, "determine hostname; set --holder")
+			}
+		}
+
+		bkt, err := client.NewBucket(logger, confContentYaml, reg, "preflight")
+		if err != nil {
+			return err
+		}
+		defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+
+		// Dummy actor to immediately kill the group after the run function returns.
+		g.Add(func() error { return nil }, func(error) {})
+
+		report, err := compact.Preflight(context.Background(), logger, bkt, compact.PreflightConfig{Holder: *holder, MaxWriteLatency: *maxWriteLatency})
+		if err != nil {
+			return errors.Wrap(err, "preflight")
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return errors.Wrap(err, "encode preflight report")
+		}
+		return report.Err()
+	})
+}
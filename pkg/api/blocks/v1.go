@@ -8,7 +8,9 @@ import (
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
 	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
 	"github.com/prometheus/common/route"
 	"github.com/thanos-io/thanos/pkg/api"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
@@ -48,12 +50,31 @@ func (bapi *BlocksAPI) Register(r *route.Router, tracer opentracing.Tracer, logg
 	instr := api.GetInstr(tracer, logger, ins, logMiddleware)
 
 	r.Get("/blocks", instr("blocks", bapi.blocks))
+	r.Get("/blocks/lineage", instr("blocks_lineage", bapi.lineage))
 }
 
 func (bapi *BlocksAPI) blocks(r *http.Request) (interface{}, []error, *api.ApiError) {
 	return bapi.blocksInfo, nil, nil
 }
 
+// lineage returns the DAG of all known ancestors of the block given by the id parameter, as of the last refresh.
+func (bapi *BlocksAPI) lineage(r *http.Request) (interface{}, []error, *api.ApiError) {
+	id, err := ulid.Parse(r.FormValue("id"))
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrap(err, "parse block id")}
+	}
+
+	metas := make(map[ulid.ULID]*metadata.Meta, len(bapi.blocksInfo.Blocks))
+	for i := range bapi.blocksInfo.Blocks {
+		metas[bapi.blocksInfo.Blocks[i].ULID] = &bapi.blocksInfo.Blocks[i]
+	}
+	l, err := metadata.BlockLineage(id, metas)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
+	}
+	return l, nil, nil
+}
+
 // Set updates the blocks' metadata in the API.
 func (bapi *BlocksAPI) Set(blocks []metadata.Meta, err error) {
 	if err != nil {
@@ -0,0 +1,224 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/route"
+	"github.com/thanos-io/thanos/pkg/api"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact"
+	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
+	"github.com/thanos-io/thanos/pkg/logging"
+)
+
+// CompactAPI is an API exposing the state of the compactor.
+type CompactAPI struct {
+	logger                   log.Logger
+	compactor                *compact.BucketCompactor
+	ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter
+	annotations              *compact.RetentionAnnotationPolicy
+	churn                    *compact.ChurnStatsTracker
+}
+
+// NewCompactAPI creates an API exposing the state of the given BucketCompactor and its deletion mark filter.
+func NewCompactAPI(logger log.Logger, compactor *compact.BucketCompactor, ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter) *CompactAPI {
+	return &CompactAPI{
+		logger:                   logger,
+		compactor:                compactor,
+		ignoreDeletionMarkFilter: ignoreDeletionMarkFilter,
+	}
+}
+
+// Register registers compactor endpoints. It does not register the endpoints of api.BaseAPI, so it can be used
+// on the same router as other APIs.
+func (capi *CompactAPI) Register(r *route.Router, tracer opentracing.Tracer, logger log.Logger, ins extpromhttp.InstrumentationMiddleware, logMiddleware *logging.HTTPServerMiddleware) {
+	instr := api.GetInstr(tracer, logger, ins, logMiddleware)
+
+	r.Get("/compactor/status", instr("compactor_status", capi.status))
+	r.Get("/compactor/deletion-marks", instr("compactor_deletion_marks", capi.deletionMarks))
+	r.Get("/compactor/queue", instr("compactor_queue", capi.queue))
+	r.Get("/compactor/coverage", instr("compactor_coverage", capi.coverage))
+	r.Get("/compactor/groups", instr("compactor_groups", capi.groups))
+	r.Get("/compactor/groups/:id", instr("compactor_group", capi.group))
+}
+
+// RegisterOnDemand registers endpoints requesting on-demand compaction of a group and following the requested jobs.
+// Requested jobs are run by BucketCompactor.CompactOnDemand, which the caller has to run once they are requested.
+func (capi *CompactAPI) RegisterOnDemand(r *route.Router, tracer opentracing.Tracer, logger log.Logger, ins extpromhttp.InstrumentationMiddleware, logMiddleware *logging.HTTPServerMiddleware) {
+	instr := api.GetInstr(tracer, logger, ins, logMiddleware)
+
+	r.Post("/compactor/compact", instr("compactor_compact", capi.compact))
+	r.Get("/compactor/jobs/:id", instr("compactor_job", capi.job))
+}
+
+// RegisterRetentionAnnotations registers endpoints listing, adding and removing retention annotations of the given
+// policy.
+func (capi *CompactAPI) RegisterRetentionAnnotations(p *compact.RetentionAnnotationPolicy, r *route.Router, tracer opentracing.Tracer, logger log.Logger, ins extpromhttp.InstrumentationMiddleware, logMiddleware *logging.HTTPServerMiddleware) {
+	instr := api.GetInstr(tracer, logger, ins, logMiddleware)
+	capi.annotations = p
+
+	r.Get("/compactor/retention-annotations", instr("compactor_retention_annotations", capi.retentionAnnotations))
+	r.Post("/compactor/retention-annotations", instr("compactor_retention_annotations_add", capi.addRetentionAnnotation))
+	r.Del("/compactor/retention-annotations/:name", instr("compactor_retention_annotations_remove", capi.removeRetentionAnnotation))
+}
+
+// RegisterChurnStats registers the endpoint returning series churn statistics of the most recent compactions of groups,
+// recorded by the given tracker. A single group can be selected by key or ID with the group parameter.
+func (capi *CompactAPI) RegisterChurnStats(t *compact.ChurnStatsTracker, r *route.Router, tracer opentracing.Tracer, logger log.Logger, ins extpromhttp.InstrumentationMiddleware, logMiddleware *logging.HTTPServerMiddleware) {
+	instr := api.GetInstr(tracer, logger, ins, logMiddleware)
+	capi.churn = t
+
+	r.Get("/compactor/churn", instr("compactor_churn", capi.churnStats))
+}
+
+func (capi *CompactAPI) churnStats(r *http.Request) (interface{}, []error, *api.ApiError) {
+	stats := capi.churn.Stats()
+	group := r.FormValue("group")
+	if group == "" {
+		return stats, nil, nil
+	}
+	for key, s := range stats {
+		if key == group || compact.GroupID(key) == group {
+			return s, nil, nil
+		}
+	}
+	return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("no churn statistics of group %q", group)}
+}
+
+func (capi *CompactAPI) retentionAnnotations(r *http.Request) (interface{}, []error, *api.ApiError) {
+	annotations, err := capi.annotations.Annotations(r.Context())
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: err}
+	}
+	return annotations, nil, nil
+}
+
+// addRetentionAnnotation adds the retention annotation given as JSON body, replacing an annotation of the same name.
+func (capi *CompactAPI) addRetentionAnnotation(r *http.Request) (interface{}, []error, *api.ApiError) {
+	var a metadata.RetentionAnnotation
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrap(err, "decode retention annotation")}
+	}
+	if err := a.Validate(); err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
+	}
+	if err := capi.annotations.Add(r.Context(), a); err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: err}
+	}
+	return nil, nil, nil
+}
+
+func (capi *CompactAPI) removeRetentionAnnotation(r *http.Request) (interface{}, []error, *api.ApiError) {
+	name := route.Param(r.Context(), "name")
+	if err := metadata.ValidateRetentionAnnotationName(name); err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
+	}
+	err := capi.annotations.Remove(r.Context(), name)
+	switch {
+	case err == nil:
+		return nil, nil, nil
+	case errors.Cause(err) == block.ErrRetentionAnnotationNotFound:
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
+	default:
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: err}
+	}
+}
+
+// compact requests compaction of the group with the given group key or the group of the given blocks (repeated block
+// parameter).
+func (capi *CompactAPI) compact(r *http.Request) (interface{}, []error, *api.ApiError) {
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrap(err, "parse form")}
+	}
+	req := compact.OnDemandRequest{Group: r.Form.Get("group")}
+	for _, b := range r.Form["block"] {
+		id, err := ulid.Parse(b)
+		if err != nil {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "parse block ID %q", b)}
+		}
+		req.Blocks = append(req.Blocks, id)
+	}
+	j, err := capi.compactor.RequestCompaction(req)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
+	}
+	return j, nil, nil
+}
+
+func (capi *CompactAPI) job(r *http.Request) (interface{}, []error, *api.ApiError) {
+	id := route.Param(r.Context(), "id")
+	j, ok := capi.compactor.OnDemandJob(id)
+	if !ok {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("unknown on-demand compaction job %q", id)}
+	}
+	return j, nil, nil
+}
+
+func (capi *CompactAPI) status(r *http.Request) (interface{}, []error, *api.ApiError) {
+	return capi.compactor.Status(), nil, nil
+}
+
+func (capi *CompactAPI) groups(r *http.Request) (interface{}, []error, *api.ApiError) {
+	return capi.compactor.Groups(), nil, nil
+}
+
+// group resolves the short ID of a group, as labeling metrics and logs, to the group.
+func (capi *CompactAPI) group(r *http.Request) (interface{}, []error, *api.ApiError) {
+	id := route.Param(r.Context(), "id")
+	g, ok := capi.compactor.ResolveGroup(id)
+	if !ok {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("unknown compaction group %q", id)}
+	}
+	return g, nil, nil
+}
+
+func (capi *CompactAPI) queue(r *http.Request) (interface{}, []error, *api.ApiError) {
+	return capi.compactor.Queue(), nil, nil
+}
+
+func (capi *CompactAPI) coverage(r *http.Request) (interface{}, []error, *api.ApiError) {
+	report, ok := capi.compactor.CoverageReport()
+	if !ok {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("coverage verification is not enabled")}
+	}
+	return report, nil, nil
+}
+
+// DeletionMarks describes blocks marked for deletion as seen on the last sync.
+type DeletionMarks struct {
+	// Marked are all blocks with deletion mark, excluding exempt ones.
+	Marked []*metadata.DeletionMark `json:"marked"`
+	// Ignored are blocks filtered out from compaction, because they were marked long enough ago.
+	Ignored []*metadata.DeletionMark `json:"ignored"`
+	// Exempt are blocks that are never ignored nor deleted.
+	Exempt []ulid.ULID `json:"exempt"`
+}
+
+func (capi *CompactAPI) deletionMarks(r *http.Request) (interface{}, []error, *api.ApiError) {
+	return DeletionMarks{
+		Marked:  sortedMarks(capi.ignoreDeletionMarkFilter.DeletionMarkBlocks()),
+		Ignored: sortedMarks(capi.ignoreDeletionMarkFilter.IgnoredBlocks()),
+		Exempt:  capi.ignoreDeletionMarkFilter.ExemptBlocks(),
+	}, nil, nil
+}
+
+func sortedMarks(marks map[ulid.ULID]*metadata.DeletionMark) []*metadata.DeletionMark {
+	res := make([]*metadata.DeletionMark, 0, len(marks))
+	for _, m := range marks {
+		res = append(res, m)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID.Compare(res[j].ID) < 0
+	})
+	return res
+}
@@ -0,0 +1,60 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// ErrRetentionAnnotationNotFound is returned by DeleteRetentionAnnotation if there is no annotation with the given name.
+var ErrRetentionAnnotationNotFound = errors.New("retention annotation not found")
+
+// UploadRetentionAnnotation validates the given annotation and uploads it, replacing an annotation of the same name.
+func UploadRetentionAnnotation(ctx context.Context, bkt objstore.Bucket, a metadata.RetentionAnnotation) error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	if a.CreatedAt == 0 {
+		a.CreatedAt = time.Now().Unix()
+	}
+	a.Version = metadata.RetentionAnnotationVersion1
+
+	b, err := json.Marshal(a)
+	if err != nil {
+		return errors.Wrap(err, "json encode retention annotation")
+	}
+	name := metadata.RetentionAnnotationFile(a.Name)
+	if err := bkt.Upload(ctx, name, bytes.NewBuffer(b)); err != nil {
+		return errors.Wrapf(err, "upload file %s to bucket", name)
+	}
+	return nil
+}
+
+// DeleteRetentionAnnotation deletes the retention annotation with the given name, so retention may delete the data it
+// preserved.
+func DeleteRetentionAnnotation(ctx context.Context, bkt objstore.Bucket, name string) error {
+	if err := metadata.ValidateRetentionAnnotationName(name); err != nil {
+		return err
+	}
+	file := metadata.RetentionAnnotationFile(name)
+	exists, err := bkt.Exists(ctx, file)
+	if err != nil {
+		return errors.Wrapf(err, "check exists %s in bucket", file)
+	}
+	if !exists {
+		return errors.Wrapf(ErrRetentionAnnotationNotFound, "annotation %s", name)
+	}
+	if err := bkt.Delete(ctx, file); err != nil {
+		return errors.Wrapf(err, "delete file %s from bucket", file)
+	}
+	return nil
+}
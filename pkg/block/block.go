@@ -9,11 +9,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -42,9 +42,13 @@ const (
 	DebugMetas = "debug/metas"
 )
 
+// ErrULIDCollision is returned by Upload with WithCollisionCheck if a different block with the same ULID is already in
+// the bucket.
+var ErrULIDCollision = errors.New("block ULID collision")
+
 // Download downloads directory that is mean to be block directory.
-func Download(ctx context.Context, logger log.Logger, bucket objstore.Bucket, id ulid.ULID, dst string) error {
-	if err := objstore.DownloadDir(ctx, logger, bucket, id.String(), dst); err != nil {
+func Download(ctx context.Context, logger log.Logger, bucket objstore.Bucket, id ulid.ULID, dst string, opts ...objstore.DownloadOption) error {
+	if err := objstore.DownloadDir(ctx, logger, bucket, id.String(), dst, opts...); err != nil {
 		return err
 	}
 
@@ -65,50 +69,256 @@ func Download(ctx context.Context, logger log.Logger, bucket objstore.Bucket, id
 // Upload uploads block from given block dir that ends with block id.
 // It makes sure cleanup is done on error to avoid partial block uploads.
 // It also verifies basic features of Thanos block.
+// Files of the block are listed with their sizes in the Thanos section of its meta.json, see metadata.File. With
+// WithFileHashes, files already in the bucket with their listed size and hash, e.g. left by an interrupted upload of the
+// same block, are not uploaded again. Each of them is downloaded in full to hash it, so resuming pays off only where
+// uploads are slower than downloads. Without hashes, all files are uploaded.
 // TODO(bplotka): Ensure bucket operations have reasonable backoff retries.
-func Upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string) error {
-	df, err := os.Stat(bdir)
+func Upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, opts ...UploadOption) error {
+	o := applyUploadOptions(opts)
+
+	u, err := prepareUpload(ctx, logger, bkt, bdir, o)
 	if err != nil {
 		return err
 	}
+	if err := u.uploadData(ctx, logger, bkt, o); err != nil {
+		return err
+	}
+	return u.commit(ctx, logger, bkt)
+}
+
+// blockUpload is a block verified by prepareUpload, whose meta.json is uploaded by commit once its data is uploaded.
+type blockUpload struct {
+	id          ulid.ULID
+	bdir        string
+	files       []metadata.File
+	metaContent []byte
+}
+
+// prepareUpload verifies the block in the given dir for upload and uploads its meta.json into the debug dir.
+func prepareUpload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, o uploadOptions) (*blockUpload, error) {
+	df, err := os.Stat(bdir)
+	if err != nil {
+		return nil, err
+	}
 	if !df.IsDir() {
-		return errors.Errorf("%s is not a directory", bdir)
+		return nil, errors.Errorf("%s is not a directory", bdir)
 	}
 
 	// Verify dir.
 	id, err := ulid.Parse(df.Name())
 	if err != nil {
-		return errors.Wrap(err, "not a block dir")
+		return nil, errors.Wrap(err, "not a block dir")
 	}
 
 	meta, err := metadata.Read(bdir)
 	if err != nil {
 		// No meta or broken meta file.
-		return errors.Wrap(err, "read meta")
+		return nil, errors.Wrap(err, "read meta")
 	}
 
 	if meta.Thanos.Labels == nil || len(meta.Thanos.Labels) == 0 {
-		return errors.New("empty external labels are not allowed for Thanos block.")
+		return nil, errors.New("empty external labels are not allowed for Thanos block.")
+	}
+
+	files, err := gatherUploadFiles(ctx, bkt, id, bdir, o)
+	if err != nil {
+		return nil, errors.Wrap(err, "list files of block")
+	}
+	// The uploaded meta.json lists the files, while the local one is left as it is.
+	meta.Thanos.Files = files
+	var buf bytes.Buffer
+	if err := metadata.Encode(&buf, meta); err != nil {
+		return nil, errors.Wrap(err, "encode meta with files")
+	}
+	metaContent := buf.Bytes()
+	// Objects of a complete block are only overwritten by a retry uploading the same block, never by a colliding one.
+	if o.collisionCheck {
+		if err := checkCollision(ctx, bkt, id, metaContent); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := NewDebugMetaWriter(logger, bkt, o.debugMetaPrefix, o.compressedMeta).Write(ctx, id, metaContent); err != nil {
+		return nil, errors.Wrap(err, "upload meta file to debug dir")
+	}
+	return &blockUpload{id: id, bdir: bdir, files: files, metaContent: metaContent}, nil
+}
+
+// gatherUploadFiles returns files of the block in the given dir, including chunk segments already uploaded and possibly
+// missing locally, whose sizes are taken from the bucket.
+func gatherUploadFiles(ctx context.Context, bkt objstore.Bucket, id ulid.ULID, bdir string, o uploadOptions) ([]metadata.File, error) {
+	files, err := GatherFiles(bdir, o.fileHashes)
+	if err != nil {
+		return nil, err
+	}
+	local := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		local[f.RelPath] = struct{}{}
+	}
+	var missing []string
+	for name := range o.uploadedChunks {
+		if _, ok := local[path.Join(ChunksDirname, name)]; !ok {
+			missing = append(missing, path.Join(ChunksDirname, name))
+		}
+	}
+	if len(missing) == 0 {
+		return files, nil
+	}
+	sizes, err := objectSizes(ctx, bkt, id, missing)
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range missing {
+		size, ok := sizes[rel]
+		if !ok {
+			return nil, errors.Errorf("uploaded chunk segment %s is neither in the bucket nor in the block dir", rel)
+		}
+		files = append(files, metadata.File{RelPath: rel, SizeBytes: size})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].RelPath < files[j].RelPath })
+	return files, nil
+}
+
+// resumedFiles returns paths of files of the block already in the bucket with their listed sizes and hashes, except chunk
+// segments known to be uploaded. Files listed without a hash are always uploaded again, as an object of the same size,
+// e.g. left zero-filled by an interrupted upload, may still differ in content.
+func (u *blockUpload) resumedFiles(ctx context.Context, bkt objstore.Bucket, o uploadOptions) (map[string]struct{}, error) {
+	relPaths := make([]string, 0, len(u.files))
+	for _, f := range u.files {
+		if _, ok := o.uploadedChunks[strings.TrimPrefix(f.RelPath, ChunksDirname+"/")]; ok || f.Hash == "" {
+			continue
+		}
+		relPaths = append(relPaths, f.RelPath)
+	}
+	resumed := map[string]struct{}{}
+	if len(relPaths) == 0 {
+		return resumed, nil
+	}
+	sizes, err := objectSizes(ctx, bkt, u.id, relPaths)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range u.files {
+		if size, ok := sizes[f.RelPath]; !ok || size != f.SizeBytes {
+			continue
+		}
+		h, err := objectHash(ctx, bkt, path.Join(u.id.String(), f.RelPath))
+		if err != nil {
+			return nil, errors.Wrapf(err, "hash of %s", f.RelPath)
+		}
+		if h == f.Hash {
+			resumed[f.RelPath] = struct{}{}
+		}
+	}
+	return resumed, nil
+}
+
+// uploadData uploads all files of the block but meta.json, cleaning the block up on error.
+func (u *blockUpload) uploadData(ctx context.Context, logger log.Logger, bkt objstore.Bucket, o uploadOptions) error {
+	resumed, err := u.resumedFiles(ctx, bkt, o)
+	if err != nil {
+		return cleanUp(logger, bkt, u.id, errors.Wrap(err, "check uploaded files"))
+	}
+	if len(resumed) > 0 {
+		level.Info(logger).Log("msg", "resuming upload of block; skipping files already uploaded", "block", u.id, "files", len(resumed))
+	}
+
+	uploadedChunks := make(map[string]struct{}, len(o.uploadedChunks)+len(resumed))
+	for n := range o.uploadedChunks {
+		uploadedChunks[n] = struct{}{}
+	}
+	for rel := range resumed {
+		if n := strings.TrimPrefix(rel, ChunksDirname+"/"); n != rel {
+			uploadedChunks[n] = struct{}{}
+		}
+	}
+	if err := uploadChunks(ctx, logger, bkt, u.id, u.bdir, uploadedChunks); err != nil {
+		return cleanUp(logger, bkt, u.id, errors.Wrap(err, "upload chunks"))
 	}
 
-	if err := objstore.UploadFile(ctx, logger, bkt, path.Join(bdir, MetaFilename), path.Join(DebugMetas, fmt.Sprintf("%s.json", id))); err != nil {
-		return errors.Wrap(err, "upload meta file to debug dir")
+	if _, ok := resumed[IndexFilename]; !ok {
+		if err := objstore.UploadFile(ctx, logger, bkt, path.Join(u.bdir, IndexFilename), path.Join(u.id.String(), IndexFilename)); err != nil {
+			return cleanUp(logger, bkt, u.id, errors.Wrap(err, "upload index"))
+		}
 	}
 
-	if err := objstore.UploadDir(ctx, logger, bkt, path.Join(bdir, ChunksDirname), path.Join(id.String(), ChunksDirname)); err != nil {
-		return cleanUp(logger, bkt, id, errors.Wrap(err, "upload chunks"))
+	// The series filter is optional, written by WriteSeriesFilter.
+	filterFile := path.Join(u.bdir, SeriesFilterFilename)
+	_, filterResumed := resumed[SeriesFilterFilename]
+	if _, err := os.Stat(filterFile); err == nil && !filterResumed {
+		if err := objstore.UploadFile(ctx, logger, bkt, filterFile, path.Join(u.id.String(), SeriesFilterFilename)); err != nil {
+			return cleanUp(logger, bkt, u.id, errors.Wrap(err, "upload series filter"))
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return cleanUp(logger, bkt, u.id, errors.Wrap(err, "stat series filter"))
 	}
 
-	if err := objstore.UploadFile(ctx, logger, bkt, path.Join(bdir, IndexFilename), path.Join(id.String(), IndexFilename)); err != nil {
-		return cleanUp(logger, bkt, id, errors.Wrap(err, "upload index"))
+	if o.compressedMeta {
+		if err := uploadCompressed(ctx, bkt, u.metaContent, path.Join(u.id.String(), CompressedMetaFilename)); err != nil {
+			return cleanUp(logger, bkt, u.id, errors.Wrap(err, "upload compressed meta file"))
+		}
 	}
+	return nil
+}
 
+// commit uploads meta.json of the block, cleaning the block up on error.
+func (u *blockUpload) commit(ctx context.Context, logger log.Logger, bkt objstore.Bucket) error {
 	// Meta.json always need to be uploaded as a last item. This will allow to assume block directories without meta file
-	// to be pending uploads.
-	if err := objstore.UploadFile(ctx, logger, bkt, path.Join(bdir, MetaFilename), path.Join(id.String(), MetaFilename)); err != nil {
-		return cleanUp(logger, bkt, id, errors.Wrap(err, "upload meta file"))
+	// to be pending uploads. It is uploaded only if the block has none yet, so a block with the same ID uploaded
+	// concurrently, e.g. by another compactor shard, is not overwritten.
+	metaFile := path.Join(u.id.String(), MetaFilename)
+	if err := objstore.UploadIfNotExists(ctx, bkt, metaFile, u.metaContent); err != nil {
+		if errors.Cause(err) != objstore.ErrObjectExists {
+			return cleanUp(logger, bkt, u.id, errors.Wrap(err, "upload meta file"))
+		}
+		// Same meta.json is there if a previous attempt already uploaded it. Otherwise the block is not ours to clean up.
+		if err := objstore.VerifyContent(ctx, bkt, metaFile, u.metaContent); err != nil {
+			return errors.Wrap(err, "upload meta file")
+		}
+	}
+
+	return nil
+}
+
+// uploadChunks uploads chunk segments of the block in the given directory, except the given already uploaded ones.
+func uploadChunks(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, bdir string, uploaded map[string]struct{}) error {
+	chunksDir := path.Join(bdir, ChunksDirname)
+	if len(uploaded) == 0 {
+		return objstore.UploadDir(ctx, logger, bkt, chunksDir, path.Join(id.String(), ChunksDirname))
+	}
+	files, err := ioutil.ReadDir(chunksDir)
+	if err != nil {
+		return errors.Wrapf(err, "read chunks dir %s", chunksDir)
+	}
+	for _, f := range files {
+		if _, ok := uploaded[f.Name()]; ok || f.IsDir() {
+			continue
+		}
+		if err := objstore.UploadFile(ctx, logger, bkt, path.Join(chunksDir, f.Name()), path.Join(id.String(), ChunksDirname, f.Name())); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
+// checkCollision returns ErrULIDCollision if the block with the given ID is in the bucket with meta.json different from
+// the given one.
+func checkCollision(ctx context.Context, bkt objstore.Bucket, id ulid.ULID, metaContent []byte) error {
+	metaFile := path.Join(id.String(), MetaFilename)
+	ok, err := bkt.Exists(ctx, metaFile)
+	if err != nil {
+		return errors.Wrapf(err, "check existence of %s", metaFile)
+	}
+	if !ok {
+		return nil
+	}
+	if err := objstore.VerifyContent(ctx, bkt, metaFile, metaContent); err != nil {
+		if errors.Cause(err) == objstore.ErrObjectExists {
+			return errors.Wrapf(ErrULIDCollision, "block %s created by %s already exists in bucket with different meta.json", id, FingerprintOf(id))
+		}
+		return err
+	}
 	return nil
 }
 
@@ -122,27 +332,35 @@ func cleanUp(logger log.Logger, bkt objstore.Bucket, id ulid.ULID, err error) er
 }
 
 // MarkForDeletion creates a file which stores information about when the block was marked for deletion.
+// Blocks under hold cannot be marked for deletion; ErrBlockUnderHold is returned instead.
 func MarkForDeletion(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, markedForDeletion prometheus.Counter) error {
-	deletionMarkFile := path.Join(id.String(), metadata.DeletionMarkFilename)
-	deletionMarkExists, err := bkt.Exists(ctx, deletionMarkFile)
-	if err != nil {
-		return errors.Wrapf(err, "check exists %s in bucket", deletionMarkFile)
-	}
-	if deletionMarkExists {
-		level.Warn(logger).Log("msg", "requested to mark for deletion, but file already exists; this should not happen; investigate", "err", errors.Errorf("file %s already exists in bucket", deletionMarkFile))
-		return nil
+	return MarkForDeletionWithReason(ctx, logger, bkt, id, "", markedForDeletion)
+}
+
+// MarkForDeletionWithReason works like MarkForDeletion, but records the given reason in the deletion mark.
+func MarkForDeletionWithReason(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, reason metadata.DeletionReason, markedForDeletion prometheus.Counter) error {
+	if err := checkNotHeld(ctx, bkt, id); err != nil {
+		return err
 	}
 
+	deletionMarkFile := path.Join(id.String(), metadata.DeletionMarkFilename)
 	deletionMark, err := json.Marshal(metadata.DeletionMark{
 		ID:           id,
 		DeletionTime: time.Now().Unix(),
+		Reason:       reason,
 		Version:      metadata.DeletionMarkVersion1,
 	})
 	if err != nil {
 		return errors.Wrap(err, "json encode deletion mark")
 	}
 
-	if err := bkt.Upload(ctx, deletionMarkFile, bytes.NewBuffer(deletionMark)); err != nil {
+	// Deletion mark is uploaded only if there is none yet, so marks of concurrent compactor shards do not overwrite each
+	// other.
+	if err := objstore.UploadIfNotExists(ctx, bkt, deletionMarkFile, deletionMark); err != nil {
+		if errors.Cause(err) == objstore.ErrObjectExists {
+			level.Warn(logger).Log("msg", "requested to mark for deletion, but file already exists; this should not happen; investigate", "err", errors.Errorf("file %s already exists in bucket", deletionMarkFile))
+			return nil
+		}
 		return errors.Wrapf(err, "upload file %s to bucket", deletionMarkFile)
 	}
 	markedForDeletion.Inc()
@@ -150,13 +368,178 @@ func MarkForDeletion(ctx context.Context, logger log.Logger, bkt objstore.Bucket
 	return nil
 }
 
+// ErrBlockUnderHold is returned when requested to delete or mark for deletion a block that is placed under hold.
+var ErrBlockUnderHold = errors.New("block is under hold")
+
+// PlaceHold uploads hold-mark.json for the block with given id, so it is not compacted, marked for deletion nor deleted
+// until the hold is removed. It is a no-op if the block is already under hold.
+func PlaceHold(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, reason string) error {
+	metaExists, err := bkt.Exists(ctx, path.Join(id.String(), MetaFilename))
+	if err != nil {
+		return errors.Wrapf(err, "check exists %s in bucket", path.Join(id.String(), MetaFilename))
+	}
+	if !metaExists {
+		return errors.Errorf("block %s does not exist in bucket", id)
+	}
+
+	holdMarkFile := path.Join(id.String(), metadata.HoldMarkFilename)
+	holdMark, err := json.Marshal(metadata.HoldMark{
+		ID:       id,
+		HoldTime: time.Now().Unix(),
+		Reason:   reason,
+		Version:  metadata.HoldMarkVersion1,
+	})
+	if err != nil {
+		return errors.Wrap(err, "json encode hold mark")
+	}
+
+	// Hold mark is uploaded only if there is none yet, so concurrent holds keep the reason of the first one.
+	if err := objstore.UploadIfNotExists(ctx, bkt, holdMarkFile, holdMark); err != nil {
+		if errors.Cause(err) == objstore.ErrObjectExists {
+			level.Info(logger).Log("msg", "requested to place block under hold, but it is already under hold", "block", id)
+			return nil
+		}
+		return errors.Wrapf(err, "upload file %s to bucket", holdMarkFile)
+	}
+	level.Info(logger).Log("msg", "block has been placed under hold", "block", id, "reason", reason)
+	return nil
+}
+
+// RemoveHold removes hold-mark.json of the block with given id. It is a no-op if the block is not under hold.
+func RemoveHold(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID) error {
+	holdMarkFile := path.Join(id.String(), metadata.HoldMarkFilename)
+	holdMarkExists, err := bkt.Exists(ctx, holdMarkFile)
+	if err != nil {
+		return errors.Wrapf(err, "check exists %s in bucket", holdMarkFile)
+	}
+	if !holdMarkExists {
+		level.Info(logger).Log("msg", "requested to remove hold of block, but it is not under hold", "block", id)
+		return nil
+	}
+
+	if err := bkt.Delete(ctx, holdMarkFile); err != nil {
+		return errors.Wrapf(err, "delete file %s from bucket", holdMarkFile)
+	}
+	level.Info(logger).Log("msg", "hold of block has been removed", "block", id)
+	return nil
+}
+
+// MarkForNoCompact uploads no-compact-mark.json for the block with given id, so it is excluded from compaction planning.
+// It is a no-op if the block is already marked.
+func MarkForNoCompact(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, reason metadata.NoCompactReason, details string, markedForNoCompact prometheus.Counter) error {
+	noCompactMarkFile := path.Join(id.String(), metadata.NoCompactMarkFilename)
+	noCompactMark, err := json.Marshal(metadata.NoCompactMark{
+		ID:            id,
+		NoCompactTime: time.Now().Unix(),
+		Reason:        reason,
+		Details:       details,
+		Version:       metadata.NoCompactMarkVersion1,
+	})
+	if err != nil {
+		return errors.Wrap(err, "json encode no-compact mark")
+	}
+
+	if err := objstore.UploadIfNotExists(ctx, bkt, noCompactMarkFile, noCompactMark); err != nil {
+		if errors.Cause(err) == objstore.ErrObjectExists {
+			level.Info(logger).Log("msg", "requested to mark block for no compaction, but it is already marked", "block", id)
+			return nil
+		}
+		return errors.Wrapf(err, "upload file %s to bucket", noCompactMarkFile)
+	}
+	markedForNoCompact.Inc()
+	level.Info(logger).Log("msg", "block has been marked for no compaction", "block", id, "reason", reason, "details", details)
+	return nil
+}
+
+// AddDeletionIntent appends given intent to pending-deletions.json of the block with given id. The intent is applied by
+// the compactor the next time the block is compacted; until then readers of the block can use it to mask deleted data.
+func AddDeletionIntent(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, intent metadata.DeletionIntent) error {
+	if _, err := intent.ParseMatchers(); err != nil {
+		return errors.Wrapf(err, "parse matchers %q", intent.Matchers)
+	}
+	if intent.MinTime > intent.MaxTime {
+		return errors.Errorf("invalid time range of deletion intent: min time %d is after max time %d", intent.MinTime, intent.MaxTime)
+	}
+
+	metaExists, err := bkt.Exists(ctx, path.Join(id.String(), MetaFilename))
+	if err != nil {
+		return errors.Wrapf(err, "check exists %s in bucket", path.Join(id.String(), MetaFilename))
+	}
+	if !metaExists {
+		return errors.Errorf("block %s does not exist in bucket", id)
+	}
+
+	pending, err := metadata.ReadPendingDeletions(ctx, objstore.WithNoopInstr(bkt), logger, id.String())
+	if err != nil {
+		if errors.Cause(err) != metadata.ErrorPendingDeletionsNotFound {
+			return errors.Wrapf(err, "read pending deletions of block %s", id)
+		}
+		pending = &metadata.PendingDeletions{ID: id, Version: metadata.PendingDeletionsVersion1}
+	}
+	pending.Intents = append(pending.Intents, intent)
+
+	if err := UploadPendingDeletions(ctx, bkt, *pending); err != nil {
+		return err
+	}
+	level.Info(logger).Log("msg", "deletion intent added to block", "block", id, "matchers", intent.Matchers, "mint", intent.MinTime, "maxt", intent.MaxTime, "pending", len(pending.Intents))
+	return nil
+}
+
+// UploadPendingDeletions uploads given pending deletions as pending-deletions.json of their block, replacing the existing one.
+func UploadPendingDeletions(ctx context.Context, bkt objstore.Bucket, pending metadata.PendingDeletions) error {
+	pendingDeletionsFile := path.Join(pending.ID.String(), metadata.PendingDeletionsFilename)
+	b, err := json.Marshal(pending)
+	if err != nil {
+		return errors.Wrap(err, "json encode pending deletions")
+	}
+	if err := bkt.Upload(ctx, pendingDeletionsFile, bytes.NewBuffer(b)); err != nil {
+		return errors.Wrapf(err, "upload file %s to bucket", pendingDeletionsFile)
+	}
+	return nil
+}
+
+// ClearDeletionIntents removes pending-deletions.json of the block with given id, e.g. once all intents were applied.
+// It is a no-op if the block has no pending deletions.
+func ClearDeletionIntents(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID) error {
+	pendingDeletionsFile := path.Join(id.String(), metadata.PendingDeletionsFilename)
+	exists, err := bkt.Exists(ctx, pendingDeletionsFile)
+	if err != nil {
+		return errors.Wrapf(err, "check exists %s in bucket", pendingDeletionsFile)
+	}
+	if !exists {
+		return nil
+	}
+	if err := bkt.Delete(ctx, pendingDeletionsFile); err != nil {
+		return errors.Wrapf(err, "delete file %s from bucket", pendingDeletionsFile)
+	}
+	level.Info(logger).Log("msg", "deletion intents of block have been cleared", "block", id)
+	return nil
+}
+
+func checkNotHeld(ctx context.Context, bkt objstore.Bucket, id ulid.ULID) error {
+	holdMarkFile := path.Join(id.String(), metadata.HoldMarkFilename)
+	held, err := bkt.Exists(ctx, holdMarkFile)
+	if err != nil {
+		return errors.Wrapf(err, "check exists %s in bucket", holdMarkFile)
+	}
+	if held {
+		return errors.Wrapf(ErrBlockUnderHold, "block %s", id)
+	}
+	return nil
+}
+
 // Delete removes directory that is meant to be block directory.
 // NOTE: Always prefer this method for deleting blocks.
 //  * We have to delete block's files in the certain order (meta.json first)
 //  to ensure we don't end up with malformed partial blocks. Thanos system handles well partial blocks
 //  only if they don't have meta.json. If meta.json is present Thanos assumes valid block.
 //  * This avoids deleting empty dir (whole bucket) by mistake.
+//  * Blocks under hold are never deleted; ErrBlockUnderHold is returned instead.
 func Delete(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID) error {
+	if err := checkNotHeld(ctx, bkt, id); err != nil {
+		return err
+	}
+
 	metaFile := path.Join(id.String(), MetaFilename)
 	ok, err := bkt.Exists(ctx, metaFile)
 	if err != nil {
@@ -177,20 +560,32 @@ func Delete(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid
 }
 
 // deleteDirRec removes all objects prefixed with dir from the bucket. It skips objects that return true for the passed keep function.
+// Objects are listed first and then deleted with batch requests if the bucket supports them (see objstore.BatchDeleter).
 // NOTE: For objects removal use `block.Delete` strictly.
 func deleteDirRec(ctx context.Context, logger log.Logger, bkt objstore.Bucket, dir string, keep func(name string) bool) error {
+	var names []string
+	if err := listDirRec(ctx, bkt, dir, func(name string) {
+		if !keep(name) {
+			names = append(names, name)
+		}
+	}); err != nil {
+		return err
+	}
+	if err := objstore.DeleteObjects(ctx, bkt, names); err != nil {
+		return err
+	}
+	level.Debug(logger).Log("msg", "deleted files", "dir", dir, "files", len(names), "bucket", bkt.Name())
+	return nil
+}
+
+// listDirRec calls f with all objects prefixed with dir.
+func listDirRec(ctx context.Context, bkt objstore.BucketReader, dir string, f func(name string)) error {
 	return bkt.Iter(ctx, dir, func(name string) error {
-		// If we hit a directory, call DeleteDir recursively.
+		// If we hit a directory, list it recursively.
 		if strings.HasSuffix(name, objstore.DirDelim) {
-			return deleteDirRec(ctx, logger, bkt, name, keep)
-		}
-		if keep(name) {
-			return nil
+			return listDirRec(ctx, bkt, name, f)
 		}
-		if err := bkt.Delete(ctx, name); err != nil {
-			return err
-		}
-		level.Debug(logger).Log("msg", "deleted file", "file", name, "bucket", bkt.Name())
+		f(name)
 		return nil
 	})
 }
@@ -218,6 +613,24 @@ func DownloadMeta(ctx context.Context, logger log.Logger, bkt objstore.Bucket, i
 	return m, nil
 }
 
+// UploadMeta replaces meta.json of the block in the bucket with the given meta. It's caller responsibility to make sure
+// that the change is safe for all readers of the block, e.g. that it does not change the block's time range.
+func UploadMeta(ctx context.Context, bkt objstore.Bucket, meta metadata.Meta) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(&meta); err != nil {
+		return errors.Wrapf(err, "encode meta.json for block %s", meta.ULID)
+	}
+	if err := uploadCompressedMetaIfExists(ctx, bkt, meta.ULID.String(), buf.Bytes()); err != nil {
+		return errors.Wrapf(err, "update compressed meta.json for block %s", meta.ULID)
+	}
+	if err := bkt.Upload(ctx, path.Join(meta.ULID.String(), MetaFilename), &buf); err != nil {
+		return errors.Wrapf(err, "upload meta.json for block %s", meta.ULID)
+	}
+	return nil
+}
+
 func IsBlockDir(path string) (id ulid.ULID, ok bool) {
 	id, err := ulid.Parse(filepath.Base(path))
 	return id, err == nil
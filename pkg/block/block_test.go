@@ -16,6 +16,7 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
@@ -24,6 +25,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/testutil"
 	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+	"golang.org/x/sync/errgroup"
 )
 
 func TestIsBlockDir(t *testing.T) {
@@ -117,8 +119,8 @@ func TestUpload(t *testing.T) {
 		testutil.NotOk(t, err)
 		testutil.Assert(t, strings.HasSuffix(err.Error(), "/chunks: no such file or directory"), "")
 
-		// Only debug meta.json present.
-		testutil.Equals(t, 1, len(bkt.Objects()))
+		// Nothing uploaded, as files of the block are listed before any upload.
+		testutil.Equals(t, 0, len(bkt.Objects()))
 	}
 	testutil.Ok(t, os.MkdirAll(path.Join(tmpDir, "test", b1.String(), ChunksDirname), os.ModePerm))
 	e2eutil.Copy(t, path.Join(tmpDir, b1.String(), ChunksDirname, "000001"), path.Join(tmpDir, "test", b1.String(), ChunksDirname, "000001"))
@@ -128,8 +130,8 @@ func TestUpload(t *testing.T) {
 		testutil.NotOk(t, err)
 		testutil.Assert(t, strings.HasSuffix(err.Error(), "/index: no such file or directory"), "")
 
-		// Only debug meta.json present.
-		testutil.Equals(t, 1, len(bkt.Objects()))
+		// Nothing uploaded, as files of the block are listed before any upload.
+		testutil.Equals(t, 0, len(bkt.Objects()))
 	}
 	e2eutil.Copy(t, path.Join(tmpDir, b1.String(), IndexFilename), path.Join(tmpDir, "test", b1.String(), IndexFilename))
 	testutil.Ok(t, os.Remove(path.Join(tmpDir, "test", b1.String(), MetaFilename)))
@@ -139,8 +141,8 @@ func TestUpload(t *testing.T) {
 		testutil.NotOk(t, err)
 		testutil.Assert(t, strings.HasSuffix(err.Error(), "/meta.json: no such file or directory"), "")
 
-		// Only debug meta.json present.
-		testutil.Equals(t, 1, len(bkt.Objects()))
+		// Nothing uploaded, as files of the block are listed before any upload.
+		testutil.Equals(t, 0, len(bkt.Objects()))
 	}
 	e2eutil.Copy(t, path.Join(tmpDir, b1.String(), MetaFilename), path.Join(tmpDir, "test", b1.String(), MetaFilename))
 	{
@@ -149,7 +151,7 @@ func TestUpload(t *testing.T) {
 		testutil.Equals(t, 4, len(bkt.Objects()))
 		testutil.Equals(t, 3751, len(bkt.Objects()[path.Join(b1.String(), ChunksDirname, "000001")]))
 		testutil.Equals(t, 401, len(bkt.Objects()[path.Join(b1.String(), IndexFilename)]))
-		testutil.Equals(t, 365, len(bkt.Objects()[path.Join(b1.String(), MetaFilename)]))
+		testutil.Equals(t, 507, len(bkt.Objects()[path.Join(b1.String(), MetaFilename)]))
 	}
 	{
 		// Test Upload is idempotent.
@@ -157,7 +159,7 @@ func TestUpload(t *testing.T) {
 		testutil.Equals(t, 4, len(bkt.Objects()))
 		testutil.Equals(t, 3751, len(bkt.Objects()[path.Join(b1.String(), ChunksDirname, "000001")]))
 		testutil.Equals(t, 401, len(bkt.Objects()[path.Join(b1.String(), IndexFilename)]))
-		testutil.Equals(t, 365, len(bkt.Objects()[path.Join(b1.String(), MetaFilename)]))
+		testutil.Equals(t, 507, len(bkt.Objects()[path.Join(b1.String(), MetaFilename)]))
 	}
 	{
 		// Upload with no external labels should be blocked.
@@ -176,6 +178,49 @@ func TestUpload(t *testing.T) {
 	}
 }
 
+func TestUpload_ULIDCollision(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-upload-collision")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String())))
+	objects := map[string]int{}
+	for name, b := range bkt.Objects() {
+		objects[name] = len(b)
+	}
+
+	// Different block with the same ULID is refused before anything is overwritten.
+	bdir := path.Join(tmpDir, "colliding", b1.String())
+	testutil.Ok(t, os.MkdirAll(path.Join(bdir, ChunksDirname), os.ModePerm))
+	e2eutil.Copy(t, path.Join(tmpDir, b1.String(), IndexFilename), path.Join(bdir, IndexFilename))
+	meta, err := metadata.Read(path.Join(tmpDir, b1.String()))
+	testutil.Ok(t, err)
+	meta.Thanos.Labels = map[string]string{"ext1": "val2"}
+	testutil.Ok(t, metadata.Write(log.NewNopLogger(), bdir, meta))
+
+	err = Upload(ctx, log.NewNopLogger(), bkt, bdir, WithCollisionCheck())
+	testutil.NotOk(t, err)
+	testutil.Equals(t, ErrULIDCollision, errors.Cause(err))
+	got := map[string]int{}
+	for name, b := range bkt.Objects() {
+		got[name] = len(b)
+	}
+	testutil.Equals(t, objects, got)
+
+	// Retried upload of the same block is not a collision.
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), WithCollisionCheck()))
+
+	// Without the check, the colliding block is only refused once its data is uploaded, by its meta.json.
+	testutil.NotOk(t, Upload(ctx, log.NewNopLogger(), bkt, bdir))
+}
+
 func TestDelete(t *testing.T) {
 	defer testutil.TolerantVerifyLeak(t)
 	ctx := context.Background()
@@ -277,3 +322,91 @@ func TestMarkForDeletion(t *testing.T) {
 		})
 	}
 }
+
+func TestHold(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-hold")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String())))
+
+	testutil.NotOk(t, PlaceHold(ctx, log.NewNopLogger(), bkt, ULID(1), "no such block"))
+
+	testutil.Ok(t, PlaceHold(ctx, log.NewNopLogger(), bkt, id, "case 42"))
+	// Placing the hold again is a no-op.
+	testutil.Ok(t, PlaceHold(ctx, log.NewNopLogger(), bkt, id, "case 43"))
+
+	m, err := metadata.ReadHoldMark(ctx, objstore.WithNoopInstr(bkt), log.NewNopLogger(), id.String())
+	testutil.Ok(t, err)
+	testutil.Equals(t, "case 42", m.Reason)
+
+	c := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	err = MarkForDeletion(ctx, log.NewNopLogger(), bkt, id, c)
+	testutil.Equals(t, ErrBlockUnderHold, errors.Cause(err))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(c))
+	testutil.Equals(t, ErrBlockUnderHold, errors.Cause(Delete(ctx, log.NewNopLogger(), bkt, id)))
+
+	testutil.Ok(t, RemoveHold(ctx, log.NewNopLogger(), bkt, id))
+	testutil.Ok(t, RemoveHold(ctx, log.NewNopLogger(), bkt, id))
+
+	// Concurrent holds keep the mark of whichever is placed first.
+	reasons := map[string]bool{"case 44": true, "case 45": true, "case 46": true}
+	g, gctx := errgroup.WithContext(ctx)
+	for reason := range reasons {
+		reason := reason
+		g.Go(func() error { return PlaceHold(gctx, log.NewNopLogger(), bkt, id, reason) })
+	}
+	testutil.Ok(t, g.Wait())
+	m, err = metadata.ReadHoldMark(ctx, objstore.WithNoopInstr(bkt), log.NewNopLogger(), id.String())
+	testutil.Ok(t, err)
+	testutil.Assert(t, reasons[m.Reason], "unexpected reason %q", m.Reason)
+	testutil.Ok(t, RemoveHold(ctx, log.NewNopLogger(), bkt, id))
+
+	testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), bkt, id, c))
+	testutil.Ok(t, Delete(ctx, log.NewNopLogger(), bkt, id))
+	// Still debug meta entry is expected.
+	testutil.Equals(t, 1, len(bkt.Objects()))
+}
+
+func TestDeletionIntents(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-deletion-intents")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String())))
+
+	intent := metadata.DeletionIntent{Matchers: `{a="1"}`, MinTime: 0, MaxTime: 10}
+	testutil.NotOk(t, AddDeletionIntent(ctx, log.NewNopLogger(), bkt, ULID(1), intent))
+	testutil.NotOk(t, AddDeletionIntent(ctx, log.NewNopLogger(), bkt, id, metadata.DeletionIntent{Matchers: "{", MaxTime: 10}))
+	testutil.NotOk(t, AddDeletionIntent(ctx, log.NewNopLogger(), bkt, id, metadata.DeletionIntent{Matchers: `{a="1"}`, MinTime: 10}))
+
+	testutil.Ok(t, AddDeletionIntent(ctx, log.NewNopLogger(), bkt, id, intent))
+	intent2 := metadata.DeletionIntent{Matchers: `{a="2"}`, MinTime: 5, MaxTime: 20, Reason: "GDPR"}
+	testutil.Ok(t, AddDeletionIntent(ctx, log.NewNopLogger(), bkt, id, intent2))
+
+	p, err := metadata.ReadPendingDeletions(ctx, objstore.WithNoopInstr(bkt), log.NewNopLogger(), id.String())
+	testutil.Ok(t, err)
+	testutil.Equals(t, &metadata.PendingDeletions{ID: id, Intents: []metadata.DeletionIntent{intent, intent2}, Version: metadata.PendingDeletionsVersion1}, p)
+
+	testutil.Ok(t, ClearDeletionIntents(ctx, log.NewNopLogger(), bkt, id))
+	// Clearing again is a no-op.
+	testutil.Ok(t, ClearDeletionIntents(ctx, log.NewNopLogger(), bkt, id))
+	_, err = metadata.ReadPendingDeletions(ctx, objstore.WithNoopInstr(bkt), log.NewNopLogger(), id.String())
+	testutil.Equals(t, metadata.ErrorPendingDeletionsNotFound, err)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// UploadBucketIndex uploads the given bucket index into the root of the bucket, replacing the previous one.
+func UploadBucketIndex(ctx context.Context, bkt objstore.Bucket, idx metadata.BucketIndex) error {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return errors.Wrap(err, "json encode bucket index")
+	}
+	if err := bkt.Upload(ctx, metadata.BucketIndexFilename, bytes.NewBuffer(b)); err != nil {
+		return errors.Wrapf(err, "upload file %s to bucket", metadata.BucketIndexFilename)
+	}
+	return nil
+}
+
+// UpdateBucketIndex builds the bucket index from metas returned by the given fetcher and deletion marks of those blocks
+// and uploads it. The fetcher should not filter out any blocks readers of the index might need, e.g. blocks marked for
+// deletion, so it is best to use one without filters. The index is not updated if the fetcher returns incomplete view.
+func UpdateBucketIndex(ctx context.Context, logger log.Logger, bkt objstore.InstrumentedBucket, fetcher MetadataFetcher) (*metadata.BucketIndex, error) {
+	metas, _, err := fetcher.Fetch(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch metas")
+	}
+
+	idx := metadata.BucketIndex{
+		UpdatedAt: time.Now().Unix(),
+		Blocks:    make([]metadata.Meta, 0, len(metas)),
+		Version:   metadata.BucketIndexVersion1,
+	}
+	for id, m := range metas {
+		idx.Blocks = append(idx.Blocks, *m)
+
+		mark, err := metadata.ReadDeletionMark(ctx, bkt, logger, id.String())
+		if err == metadata.ErrorDeletionMarkNotFound {
+			continue
+		}
+		if errors.Cause(err) == metadata.ErrorUnmarshalDeletionMark {
+			level.Warn(logger).Log("msg", "found partial deletion-mark.json; not including it in the bucket index", "block", id, "err", err)
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "read deletion mark of block %s", id)
+		}
+		idx.DeletionMarks = append(idx.DeletionMarks, *mark)
+	}
+	sort.Slice(idx.Blocks, func(i, j int) bool {
+		return idx.Blocks[i].ULID.Compare(idx.Blocks[j].ULID) < 0
+	})
+	sort.Slice(idx.DeletionMarks, func(i, j int) bool {
+		return idx.DeletionMarks[i].ID.Compare(idx.DeletionMarks[j].ID) < 0
+	})
+
+	if err := UploadBucketIndex(ctx, bkt, idx); err != nil {
+		return nil, err
+	}
+	return &idx, nil
+}
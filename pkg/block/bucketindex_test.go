@@ -0,0 +1,87 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestBucketIndex(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+	for i := 1; i <= 3; i++ {
+		var meta metadata.Meta
+		meta.Version = 1
+		meta.ULID = ULID(i)
+
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&meta))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(meta.ULID.String(), metadata.MetaFilename), &buf))
+	}
+	testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), bkt, ULID(2), promauto.With(nil).NewCounter(prometheus.CounterOpts{})))
+
+	// Index is built from all blocks, including the marked ones.
+	fetcher, err := NewMetaFetcher(log.NewNopLogger(), 20, bkt, "", nil, nil, nil)
+	testutil.Ok(t, err)
+	idx, err := UpdateBucketIndex(ctx, log.NewNopLogger(), bkt, fetcher)
+	testutil.Ok(t, err)
+
+	got, err := metadata.ReadBucketIndex(ctx, bkt, log.NewNopLogger())
+	testutil.Ok(t, err)
+	testutil.Equals(t, idx, got)
+	testutil.Equals(t, metadata.BucketIndexVersion1, got.Version)
+	testutil.Equals(t, 3, len(got.Blocks))
+	for i, m := range got.Blocks {
+		testutil.Equals(t, ULID(i+1), m.ULID)
+	}
+	testutil.Equals(t, 1, len(got.DeletionMarks))
+	testutil.Equals(t, ULID(2), got.DeletionMarks[0].ID)
+	testutil.Assert(t, !got.IsStale(time.Now(), time.Minute), "fresh index is stale")
+	testutil.Assert(t, got.IsStale(time.Now().Add(2*time.Minute), time.Minute), "old index is not stale")
+
+	// Block missing in the index is not visible to fetchers using it.
+	var meta metadata.Meta
+	meta.Version = 1
+	meta.ULID = ULID(4)
+	var buf bytes.Buffer
+	testutil.Ok(t, json.NewEncoder(&buf).Encode(&meta))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(meta.ULID.String(), metadata.MetaFilename), &buf))
+
+	b, err := NewBaseFetcher(log.NewNopLogger(), 20, bkt, "", nil)
+	testutil.Ok(t, err)
+	b.UseBucketIndex(time.Hour)
+	metas, _, err := b.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	compareSliceWithMapKeys(t, metas, ULIDs(1, 2, 3))
+
+	// Stale index is not used.
+	idx.UpdatedAt = time.Now().Add(-2 * time.Hour).Unix()
+	testutil.Ok(t, UploadBucketIndex(ctx, bkt, *idx))
+	metas, _, err = b.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	compareSliceWithMapKeys(t, metas, ULIDs(1, 2, 3, 4))
+
+	// Neither is missing one.
+	testutil.Ok(t, bkt.Delete(ctx, metadata.BucketIndexFilename))
+	_, err = metadata.ReadBucketIndex(ctx, bkt, log.NewNopLogger())
+	testutil.Equals(t, metadata.ErrorBucketIndexNotFound, err)
+	metas, _, err = b.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	compareSliceWithMapKeys(t, metas, ULIDs(1, 2, 3, 4))
+}
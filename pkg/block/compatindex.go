@@ -0,0 +1,146 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/encoding"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+	"github.com/prometheus/prometheus/tsdb/index"
+)
+
+// openIndexReader opens the index file with the TSDB index reader. If it fails because the index does not fulfill its
+// sort order assumptions, as written by some third-party TSDB writers, the index is opened with compatIndexReader.
+func openIndexReader(fn string) (tsdb.IndexReader, error) {
+	r, err := index.NewFileReader(fn)
+	if err == nil {
+		return r, nil
+	}
+	cr, cerr := newCompatIndexReader(fn)
+	if cerr != nil {
+		return nil, err
+	}
+	if !cr.unsortedSymbols {
+		_ = cr.Close()
+		return nil, err
+	}
+	return cr, nil
+}
+
+type byteSlice []byte
+
+func (b byteSlice) Len() int                    { return len(b) }
+func (b byteSlice) Range(start, end int) []byte { return b[start:end] }
+
+// compatIndexReader reads series of index files in version 2 format that the TSDB index reader refuses to open,
+// because their symbols are not sorted. Only iterating symbols and all series is supported, which is enough to
+// normalize the index with NormalizeIndex.
+type compatIndexReader struct {
+	f               *fileutil.MmapFile
+	b               byteSlice
+	symbols         *index.Symbols
+	dec             *index.Decoder
+	allPostings     uint64
+	unsortedSymbols bool
+}
+
+func newCompatIndexReader(fn string) (_ *compatIndexReader, err error) {
+	f, err := fileutil.OpenMmapFile(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "mmap index file")
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+		}
+	}()
+
+	r := &compatIndexReader{f: f, b: byteSlice(f.Bytes())}
+	if r.b.Len() < index.HeaderLen {
+		return nil, errors.Wrap(encoding.ErrInvalidSize, "index header")
+	}
+	if v := int(r.b[4]); v != index.FormatV2 {
+		return nil, errors.Errorf("unsupported index file version %d", v)
+	}
+	toc, err := index.NewTOCFromByteSlice(r.b)
+	if err != nil {
+		return nil, errors.Wrap(err, "read TOC")
+	}
+	r.symbols, err = index.NewSymbols(r.b, index.FormatV2, int(toc.Symbols))
+	if err != nil {
+		return nil, errors.Wrap(err, "read symbols")
+	}
+	r.dec = &index.Decoder{LookupSymbol: r.symbols.Lookup}
+
+	it := r.symbols.Iter()
+	for prev, first := "", true; it.Next(); first = false {
+		if !first && it.At() <= prev {
+			r.unsortedSymbols = true
+		}
+		prev = it.At()
+	}
+	if it.Err() != nil {
+		return nil, errors.Wrap(it.Err(), "iterate symbols")
+	}
+
+	allFound := false
+	name, value := index.AllPostingsKey()
+	if err := index.ReadOffsetTable(r.b, toc.PostingsTable, func(key []string, off uint64, _ int) error {
+		if len(key) == 2 && key[0] == name && key[1] == value {
+			r.allPostings, allFound = off, true
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "read postings table")
+	}
+	if !allFound {
+		return nil, errors.New("all postings not found in postings table")
+	}
+	return r, nil
+}
+
+func (r *compatIndexReader) Symbols() index.StringIter { return r.symbols.Iter() }
+
+// Postings returns postings of the all postings key only, in the order they are stored in the index.
+func (r *compatIndexReader) Postings(name string, values ...string) (index.Postings, error) {
+	allName, allValue := index.AllPostingsKey()
+	if name != allName || len(values) != 1 || values[0] != allValue {
+		return nil, errors.New("only all postings are supported for indexes with unsorted symbols")
+	}
+	d := encoding.NewDecbufAt(r.b, int(r.allPostings), castagnoli)
+	_, p, err := r.dec.Postings(d.Get())
+	if err != nil {
+		return nil, errors.Wrap(err, "decode postings")
+	}
+	return p, nil
+}
+
+// SortedPostings returns the given postings as they are; series are not necessarily sorted by labels in such indexes.
+func (r *compatIndexReader) SortedPostings(p index.Postings) index.Postings { return p }
+
+func (r *compatIndexReader) Series(id uint64, lset *labels.Labels, chks *[]chunks.Meta) error {
+	// Series are 16-byte padded and the ID is the multiple of 16 of the actual position.
+	d := encoding.NewDecbufUvarintAt(r.b, int(id*16), castagnoli)
+	if d.Err() != nil {
+		return d.Err()
+	}
+	return errors.Wrap(r.dec.Series(d.Get(), lset, chks), "read series")
+}
+
+func (r *compatIndexReader) SortedLabelValues(string) ([]string, error) {
+	return nil, errors.New("label values are not supported for indexes with unsorted symbols")
+}
+
+func (r *compatIndexReader) LabelValues(string) ([]string, error) {
+	return nil, errors.New("label values are not supported for indexes with unsorted symbols")
+}
+
+func (r *compatIndexReader) LabelNames() ([]string, error) {
+	return nil, errors.New("label names are not supported for indexes with unsorted symbols")
+}
+
+func (r *compatIndexReader) Close() error { return r.f.Close() }
@@ -0,0 +1,105 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// DefaultAdaptiveConcurrencyTargetLatency is the average latency of loading a single meta.json below which
+	// AdaptiveConcurrency ramps up.
+	DefaultAdaptiveConcurrencyTargetLatency = 500 * time.Millisecond
+
+	// adaptiveConcurrencyErrorRatio is the ratio of failed operations within a sync above which AdaptiveConcurrency backs off.
+	adaptiveConcurrencyErrorRatio = 0.05
+)
+
+// AdaptiveConcurrency adjusts the number of concurrent object storage operations used by the fetcher between syncs.
+// It backs off multiplicatively on bursts of errors (e.g. rate limiting or server errors of the provider) and cautiously
+// ramps up when observed latency is low. Go-routine safe.
+type AdaptiveConcurrency struct {
+	max           int
+	targetLatency time.Duration
+
+	mtx        sync.Mutex
+	current    int
+	ops        int
+	errs       int
+	latencySum time.Duration
+
+	effective prometheus.Gauge
+}
+
+// NewAdaptiveConcurrency returns AdaptiveConcurrency starting at initial concurrency and never exceeding max.
+func NewAdaptiveConcurrency(reg prometheus.Registerer, initial, max int, targetLatency time.Duration) *AdaptiveConcurrency {
+	if initial < 1 {
+		initial = 1
+	}
+	if max < initial {
+		max = initial
+	}
+	c := &AdaptiveConcurrency{
+		max:           max,
+		targetLatency: targetLatency,
+		current:       initial,
+		effective: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Subsystem: fetcherSubSys,
+			Name:      "effective_concurrency",
+			Help:      "Number of concurrent object storage operations used by the next blocks metadata synchronization.",
+		}),
+	}
+	c.effective.Set(float64(initial))
+	return c
+}
+
+// Concurrency returns current concurrency.
+func (c *AdaptiveConcurrency) Concurrency() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.current
+}
+
+// Observe records the outcome of a single object storage operation.
+func (c *AdaptiveConcurrency) Observe(latency time.Duration, err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.ops++
+	c.latencySum += latency
+	if err != nil {
+		c.errs++
+	}
+}
+
+// Adjust updates concurrency based on operations observed since the last call.
+func (c *AdaptiveConcurrency) Adjust() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	switch {
+	case c.ops == 0:
+	case float64(c.errs)/float64(c.ops) > adaptiveConcurrencyErrorRatio:
+		c.current /= 2
+		if c.current < 1 {
+			c.current = 1
+		}
+	case c.errs == 0 && c.latencySum/time.Duration(c.ops) < c.targetLatency:
+		step := c.current / 10
+		if step < 1 {
+			step = 1
+		}
+		c.current += step
+		if c.current > c.max {
+			c.current = c.max
+		}
+	}
+	c.ops, c.errs, c.latencySum = 0, 0, 0
+	c.effective.Set(float64(c.current))
+}
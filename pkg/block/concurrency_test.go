@@ -0,0 +1,54 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	c := NewAdaptiveConcurrency(prometheus.NewRegistry(), 20, 23, 100*time.Millisecond)
+	testutil.Equals(t, 20, c.Concurrency())
+
+	// No observations, no change.
+	c.Adjust()
+	testutil.Equals(t, 20, c.Concurrency())
+
+	// Low latency ramps up by 10%, up to max.
+	for i := 0; i < 10; i++ {
+		c.Observe(10*time.Millisecond, nil)
+	}
+	c.Adjust()
+	testutil.Equals(t, 22, c.Concurrency())
+	c.Observe(10*time.Millisecond, nil)
+	c.Adjust()
+	testutil.Equals(t, 23, c.Concurrency())
+
+	// High latency keeps concurrency.
+	c.Observe(time.Second, nil)
+	c.Adjust()
+	testutil.Equals(t, 23, c.Concurrency())
+
+	// Burst of errors backs off.
+	for i := 0; i < 10; i++ {
+		c.Observe(10*time.Millisecond, nil)
+	}
+	c.Observe(10*time.Millisecond, errors.New("503 slow down"))
+	c.Adjust()
+	testutil.Equals(t, 11, c.Concurrency())
+	testutil.Equals(t, 11.0, promtest.ToFloat64(c.effective))
+
+	for i := 0; i < 10; i++ {
+		c.Observe(10*time.Millisecond, errors.New("429 too many requests"))
+		c.Adjust()
+	}
+	testutil.Equals(t, 1, c.Concurrency())
+}
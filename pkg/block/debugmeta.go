@@ -0,0 +1,142 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// DebugMetaWriter copies meta.json of uploaded blocks to debug metas under the given prefix of the bucket. Debug metas
+// stay in the bucket after their blocks are deleted, so they record provenance of every block that was ever uploaded.
+type DebugMetaWriter struct {
+	logger     log.Logger
+	bkt        objstore.Bucket
+	prefix     string
+	compressed bool
+}
+
+// NewDebugMetaWriter returns DebugMetaWriter writing debug metas under the given prefix, or under DebugMetas if it is
+// empty. Compressed debug metas are zstd compressed, like meta.json.zst.
+func NewDebugMetaWriter(logger log.Logger, bkt objstore.Bucket, prefix string, compressed bool) *DebugMetaWriter {
+	if prefix == "" {
+		prefix = DebugMetas
+	}
+	return &DebugMetaWriter{logger: logger, bkt: bkt, prefix: prefix, compressed: compressed}
+}
+
+// Write copies the given content of meta.json of the block with the given ID.
+func (w *DebugMetaWriter) Write(ctx context.Context, id ulid.ULID, metaContent []byte) error {
+	if w.compressed {
+		return uploadCompressed(ctx, w.bkt, metaContent, path.Join(w.prefix, id.String()+".json.zst"))
+	}
+	dst := path.Join(w.prefix, id.String()+".json")
+	if err := w.bkt.Upload(ctx, dst, bytes.NewReader(metaContent)); err != nil {
+		return errors.Wrapf(err, "upload %s", dst)
+	}
+	return nil
+}
+
+// DebugMetaReader reads debug metas written by DebugMetaWriter under the given prefix.
+type DebugMetaReader struct {
+	bkt    objstore.BucketReader
+	prefix string
+}
+
+// NewDebugMetaReader returns DebugMetaReader reading debug metas under the given prefix, or under DebugMetas if it is
+// empty.
+func NewDebugMetaReader(bkt objstore.BucketReader, prefix string) *DebugMetaReader {
+	if prefix == "" {
+		prefix = DebugMetas
+	}
+	return &DebugMetaReader{bkt: bkt, prefix: prefix}
+}
+
+// Iter calls f with the block ID and object name of each debug meta. Objects not named after a block are skipped.
+func (r *DebugMetaReader) Iter(ctx context.Context, f func(id ulid.ULID, name string) error) error {
+	return r.bkt.Iter(ctx, r.prefix, func(name string) error {
+		base := path.Base(name)
+		id, err := ulid.Parse(base[:strings.Index(base+".", ".")])
+		if err != nil {
+			return nil
+		}
+		if !strings.HasSuffix(base, ".json") && !strings.HasSuffix(base, ".json.zst") {
+			return nil
+		}
+		return f(id, name)
+	})
+}
+
+// Read reads the debug meta of the given object name, as passed by Iter.
+func (r *DebugMetaReader) Read(ctx context.Context, name string) (_ *metadata.Meta, err error) {
+	rc, err := r.bkt.Get(ctx, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get %s", name)
+	}
+	defer runutil.CloseWithErrCapture(&err, rc, "close debug meta")
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", name)
+	}
+	if strings.HasSuffix(name, ".zst") {
+		if b, err = decompressMeta(b); err != nil {
+			return nil, errors.Wrapf(err, "decompress %s", name)
+		}
+	}
+	var m metadata.Meta
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %s", name)
+	}
+	return &m, nil
+}
+
+// StateAt reconstructs blocks of the bucket at the given time from debug metas, e.g. to investigate an incident after
+// the involved blocks were compacted and deleted. A block is in the state if it was created at or before the given
+// time and no block created by then was compacted from it. Blocks removed otherwise, e.g. by retention, are not
+// detected, since debug metas do not record deletions.
+func (r *DebugMetaReader) StateAt(ctx context.Context, t time.Time) (map[ulid.ULID]*metadata.Meta, error) {
+	metas := map[ulid.ULID]*metadata.Meta{}
+	if err := r.Iter(ctx, func(id ulid.ULID, name string) error {
+		if ulid.Time(id.Time()).After(t) {
+			return nil
+		}
+		if _, ok := metas[id]; ok {
+			return nil
+		}
+		m, err := r.Read(ctx, name)
+		if err != nil {
+			return err
+		}
+		metas[id] = m
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "read debug metas")
+	}
+
+	// Sources of a compaction are marked for deletion right after the compacted block is uploaded.
+	var compacted []ulid.ULID
+	for _, m := range metas {
+		for _, p := range m.Compaction.Parents {
+			compacted = append(compacted, p.ULID)
+		}
+	}
+	for _, id := range compacted {
+		delete(metas, id)
+	}
+	return metas, nil
+}
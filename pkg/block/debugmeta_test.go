@@ -0,0 +1,73 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestDebugMetaReader_StateAt(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	var (
+		a = ulid.MustNew(1000, nil)
+		b = ulid.MustNew(2000, nil)
+		c = ulid.MustNew(3000, nil)
+		d = ulid.MustNew(4000, nil)
+	)
+	write := func(id ulid.ULID, compressed bool, parents ...ulid.ULID) {
+		m := &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: id, Compaction: tsdb.BlockMetaCompaction{Level: 1}},
+			Thanos:    metadata.Thanos{Labels: map[string]string{"ext": "1"}},
+		}
+		for _, p := range parents {
+			m.Compaction.Level = 2
+			m.Compaction.Parents = append(m.Compaction.Parents, tsdb.BlockDesc{ULID: p})
+		}
+		var buf bytes.Buffer
+		testutil.Ok(t, metadata.Encode(&buf, m))
+		testutil.Ok(t, NewDebugMetaWriter(log.NewNopLogger(), bkt, "debug/custom", compressed).Write(ctx, id, buf.Bytes()))
+	}
+	write(a, false)
+	write(b, true)
+	write(c, false, a, b)
+	write(d, true)
+	testutil.Ok(t, bkt.Upload(ctx, "debug/custom/README", strings.NewReader("notes")))
+
+	r := NewDebugMetaReader(bkt, "debug/custom")
+	stateAt := func(ms int64) []ulid.ULID {
+		metas, err := r.StateAt(ctx, time.Unix(0, ms*int64(time.Millisecond)))
+		testutil.Ok(t, err)
+		var ids []ulid.ULID
+		for id, m := range metas {
+			testutil.Equals(t, id, m.ULID)
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i].Compare(ids[j]) < 0 })
+		return ids
+	}
+	testutil.Equals(t, []ulid.ULID(nil), stateAt(500))
+	testutil.Equals(t, []ulid.ULID{a, b}, stateAt(2500))
+	testutil.Equals(t, []ulid.ULID{c}, stateAt(3000))
+	testutil.Equals(t, []ulid.ULID{c, d}, stateAt(5000))
+
+	// Debug metas are not visible under other prefixes.
+	metas, err := NewDebugMetaReader(bkt, "").StateAt(ctx, time.Unix(5, 0))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(metas))
+}
@@ -11,6 +11,7 @@ import (
 	"path"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -64,14 +65,18 @@ const (
 	// Synced label values.
 	labelExcludedMeta = "label-excluded"
 	timeExcludedMeta  = "time-excluded"
+	levelExcludedMeta = "level-excluded"
 	tooFreshMeta      = "too-fresh"
 	duplicateMeta     = "duplicate"
 	// Blocks that are marked for deletion can be loaded as well. This is done to make sure that we load blocks that are meant to be deleted,
 	// but don't have a replacement block yet.
 	markedForDeletionMeta = "marked-for-deletion"
+	heldMeta              = "held"
+	pendingCommitMeta     = "pending-commit"
 
 	// Modified label values.
-	replicaRemovedMeta = "replica-label-removed"
+	replicaRemovedMeta  = "replica-label-removed"
+	labelNormalizedMeta = "label-normalized"
 )
 
 func newFetcherMetrics(reg prometheus.Registerer) *fetcherMetrics {
@@ -108,8 +113,11 @@ func newFetcherMetrics(reg prometheus.Registerer) *fetcherMetrics {
 		[]string{failedMeta},
 		[]string{labelExcludedMeta},
 		[]string{timeExcludedMeta},
+		[]string{levelExcludedMeta},
 		[]string{duplicateMeta},
 		[]string{markedForDeletionMeta},
+		[]string{heldMeta},
+		[]string{pendingCommitMeta},
 	)
 	m.modified = extprom.NewTxGaugeVec(
 		reg,
@@ -120,6 +128,7 @@ func newFetcherMetrics(reg prometheus.Registerer) *fetcherMetrics {
 		},
 		[]string{"modified"},
 		[]string{replicaRemovedMeta},
+		[]string{labelNormalizedMeta},
 	)
 	return &m
 }
@@ -140,9 +149,16 @@ type MetadataModifier interface {
 // BaseFetcher is a struct that synchronizes filtered metadata of all block in the object storage with the local state.
 // Go-routine safe.
 type BaseFetcher struct {
-	logger      log.Logger
-	concurrency int
-	bkt         objstore.InstrumentedBucketReader
+	logger              log.Logger
+	concurrency         int
+	adaptiveConcurrency *AdaptiveConcurrency
+	compressedMeta      bool
+	maxMetaVersion      int
+	bucketIndex         bool
+	bucketIndexMaxAge   time.Duration
+	metaStore           MetaStore
+	metaStoreMaxAge     time.Duration
+	bkt                 objstore.InstrumentedBucketReader
 
 	// Optional local directory to cache meta.json files.
 	cacheDir string
@@ -166,11 +182,12 @@ func NewBaseFetcher(logger log.Logger, concurrency int, bkt objstore.Instrumente
 	}
 
 	return &BaseFetcher{
-		logger:      log.With(logger, "component", "block.BaseFetcher"),
-		concurrency: concurrency,
-		bkt:         bkt,
-		cacheDir:    cacheDir,
-		cached:      map[ulid.ULID]*metadata.Meta{},
+		logger:         log.With(logger, "component", "block.BaseFetcher"),
+		concurrency:    concurrency,
+		maxMetaVersion: metadata.MetaVersionLatest,
+		bkt:            bkt,
+		cacheDir:       cacheDir,
+		cached:         map[ulid.ULID]*metadata.Meta{},
 		syncs: promauto.With(reg).NewCounter(prometheus.CounterOpts{
 			Subsystem: fetcherSubSys,
 			Name:      "base_syncs_total",
@@ -179,6 +196,41 @@ func NewBaseFetcher(logger log.Logger, concurrency int, bkt objstore.Instrumente
 	}, nil
 }
 
+// UseAdaptiveConcurrency makes the fetcher use concurrency controlled by given AdaptiveConcurrency instead of
+// the fixed one. It has to be called before first Fetch.
+func (f *BaseFetcher) UseAdaptiveConcurrency(c *AdaptiveConcurrency) {
+	f.adaptiveConcurrency = c
+}
+
+// ReadCompressedMetas makes the fetcher download compressed meta.json.zst of blocks that have one instead of meta.json,
+// falling back to meta.json otherwise. It has to be called before first Fetch.
+func (f *BaseFetcher) ReadCompressedMetas() {
+	f.compressedMeta = true
+}
+
+// AcceptMetaVersions makes the fetcher accept metas of versions up to maxVersion, which can be newer than
+// metadata.MetaVersionLatest, e.g. to not break while newer Thanos versions are rolled out. Such metas are parsed by the
+// fields known to this version of Thanos. It has to be called before first Fetch.
+func (f *BaseFetcher) AcceptMetaVersions(maxVersion int) {
+	f.maxMetaVersion = maxVersion
+}
+
+// UseBucketIndex makes the fetcher load metas of all blocks from the bucket index maintained by the compactor, instead of
+// listing the bucket and loading meta.json of each block. The fetcher falls back to listing the bucket if the index is
+// missing, unreadable or was not updated for longer than maxStaleness. It has to be called before first Fetch.
+func (f *BaseFetcher) UseBucketIndex(maxStaleness time.Duration) {
+	f.bucketIndex = true
+	f.bucketIndexMaxAge = maxStaleness
+}
+
+// UseMetaStore makes the fetcher load metas of all blocks from the given metadata store maintained by the compactor,
+// instead of listing the bucket. It falls back to the bucket index, if used, or to listing the bucket if the store is
+// unreachable or was not reconciled with the bucket for longer than maxStaleness. It has to be called before first Fetch.
+func (f *BaseFetcher) UseMetaStore(s MetaStore, maxStaleness time.Duration) {
+	f.metaStore = s
+	f.metaStoreMaxAge = maxStaleness
+}
+
 // NewMetaFetcher returns meta fetcher.
 func NewMetaFetcher(logger log.Logger, concurrency int, bkt objstore.InstrumentedBucketReader, dir string, reg prometheus.Registerer, filters []MetadataFilter, modifiers []MetadataModifier) (*MetaFetcher, error) {
 	b, err := NewBaseFetcher(logger, concurrency, bkt, dir, reg)
@@ -223,7 +275,7 @@ func (f *BaseFetcher) loadMeta(ctx context.Context, id ulid.ULID) (*metadata.Met
 
 	// Best effort load from local dir.
 	if f.cacheDir != "" {
-		m, err := metadata.Read(cachedBlockDir)
+		m, err := metadata.ReadMaxVersion(cachedBlockDir, f.maxMetaVersion)
 		if err == nil {
 			return m, nil
 		}
@@ -236,20 +288,9 @@ func (f *BaseFetcher) loadMeta(ctx context.Context, id ulid.ULID) (*metadata.Met
 		}
 	}
 
-	r, err := f.bkt.ReaderWithExpectedErrs(f.bkt.IsObjNotFoundErr).Get(ctx, metaFile)
-	if f.bkt.IsObjNotFoundErr(err) {
-		// Meta.json was deleted between bkt.Exists and here.
-		return nil, errors.Wrapf(ErrorSyncMetaNotFound, "%v", err)
-	}
+	metaContent, err := f.readMeta(ctx, id)
 	if err != nil {
-		return nil, errors.Wrapf(err, "get meta file: %v", metaFile)
-	}
-
-	defer runutil.CloseWithLogOnErr(f.logger, r, "close bkt meta get")
-
-	metaContent, err := ioutil.ReadAll(r)
-	if err != nil {
-		return nil, errors.Wrapf(err, "read meta file: %v", metaFile)
+		return nil, err
 	}
 
 	m := &metadata.Meta{}
@@ -257,7 +298,7 @@ func (f *BaseFetcher) loadMeta(ctx context.Context, id ulid.ULID) (*metadata.Met
 		return nil, errors.Wrapf(ErrorSyncMetaCorrupted, "meta.json %v unmarshal: %v", metaFile, err)
 	}
 
-	if m.Version != metadata.MetaVersion1 {
+	if m.Version < metadata.MetaVersion1 || m.Version > f.maxMetaVersion {
 		return nil, errors.Errorf("unexpected meta file: %s version: %d", metaFile, m.Version)
 	}
 
@@ -274,11 +315,50 @@ func (f *BaseFetcher) loadMeta(ctx context.Context, id ulid.ULID) (*metadata.Met
 	return m, nil
 }
 
+// readMeta returns content of meta.json of the block from object storage, preferring its compressed copy if enabled.
+func (f *BaseFetcher) readMeta(ctx context.Context, id ulid.ULID) ([]byte, error) {
+	if f.compressedMeta {
+		compressedMetaFile := path.Join(id.String(), CompressedMetaFilename)
+		content, err := f.readObject(ctx, compressedMetaFile)
+		switch {
+		case err == nil:
+			metaContent, err := decompressMeta(content)
+			if err == nil {
+				return metaContent, nil
+			}
+			level.Warn(f.logger).Log("msg", "decompression of meta.json failed; falling back to uncompressed one", "file", compressedMetaFile, "err", err)
+		case errors.Cause(err) != ErrorSyncMetaNotFound:
+			return nil, err
+		}
+	}
+	return f.readObject(ctx, path.Join(id.String(), MetaFilename))
+}
+
+func (f *BaseFetcher) readObject(ctx context.Context, name string) ([]byte, error) {
+	r, err := f.bkt.ReaderWithExpectedErrs(f.bkt.IsObjNotFoundErr).Get(ctx, name)
+	if f.bkt.IsObjNotFoundErr(err) {
+		// Object was deleted between bkt.Exists and here, or was never uploaded.
+		return nil, errors.Wrapf(ErrorSyncMetaNotFound, "%v", err)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "get meta file: %v", name)
+	}
+
+	defer runutil.CloseWithLogOnErr(f.logger, r, "close bkt meta get")
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read meta file: %v", name)
+	}
+	return content, nil
+}
+
 type response struct {
 	metas   map[ulid.ULID]*metadata.Meta
 	partial map[ulid.ULID]error
 	// If metaErr > 0 it means incomplete view, so some metas, failed to be loaded.
 	metaErrs tsdberrors.MultiError
+	failed   map[ulid.ULID]error
 
 	noMetas        float64
 	corruptedMetas float64
@@ -287,19 +367,47 @@ type response struct {
 func (f *BaseFetcher) fetchMetadata(ctx context.Context) (interface{}, error) {
 	f.syncs.Inc()
 
+	if f.metaStore != nil {
+		if resp, ok := f.fetchMetaStore(ctx); ok {
+			return resp, nil
+		}
+	}
+	if f.bucketIndex {
+		if resp, ok := f.fetchBucketIndex(ctx); ok {
+			return resp, nil
+		}
+	}
+
+	concurrency := f.concurrency
+	if f.adaptiveConcurrency != nil {
+		concurrency = f.adaptiveConcurrency.Concurrency()
+		defer f.adaptiveConcurrency.Adjust()
+	}
+
 	var (
 		resp = response{
 			metas:   make(map[ulid.ULID]*metadata.Meta),
 			partial: make(map[ulid.ULID]error),
+			failed:  make(map[ulid.ULID]error),
 		}
 		eg  errgroup.Group
-		ch  = make(chan ulid.ULID, f.concurrency)
+		ch  = make(chan ulid.ULID, concurrency)
 		mtx sync.Mutex
 	)
-	for i := 0; i < f.concurrency; i++ {
+	for i := 0; i < concurrency; i++ {
 		eg.Go(func() error {
 			for id := range ch {
+				begin := time.Now()
 				meta, err := f.loadMeta(ctx, id)
+				if f.adaptiveConcurrency != nil {
+					// Only failures of the object storage affect concurrency, not missing or corrupted meta.json files.
+					switch errors.Cause(err) {
+					case ErrorSyncMetaNotFound, ErrorSyncMetaCorrupted:
+						f.adaptiveConcurrency.Observe(time.Since(begin), nil)
+					default:
+						f.adaptiveConcurrency.Observe(time.Since(begin), err)
+					}
+				}
 				if err == nil {
 					mtx.Lock()
 					resp.metas[id] = meta
@@ -311,6 +419,7 @@ func (f *BaseFetcher) fetchMetadata(ctx context.Context) (interface{}, error) {
 				default:
 					mtx.Lock()
 					resp.metaErrs.Add(err)
+					resp.failed[id] = err
 					mtx.Unlock()
 					continue
 				case ErrorSyncMetaNotFound:
@@ -397,7 +506,65 @@ func (f *BaseFetcher) fetchMetadata(ctx context.Context) (interface{}, error) {
 	return resp, nil
 }
 
-func (f *BaseFetcher) fetch(ctx context.Context, metrics *fetcherMetrics, filters []MetadataFilter, modifiers []MetadataModifier) (_ map[ulid.ULID]*metadata.Meta, _ map[ulid.ULID]error, err error) {
+// fetchBucketIndex returns metas of all blocks listed in the bucket index, or false if the index cannot be used.
+func (f *BaseFetcher) fetchBucketIndex(ctx context.Context) (response, bool) {
+	idx, err := metadata.ReadBucketIndex(ctx, f.bkt, f.logger)
+	if err != nil {
+		level.Warn(f.logger).Log("msg", "failed to read bucket index; falling back to listing the bucket", "err", err)
+		return response{}, false
+	}
+	if idx.IsStale(time.Now(), f.bucketIndexMaxAge) {
+		level.Warn(f.logger).Log("msg", "bucket index is stale; falling back to listing the bucket", "updated", idx.Updated(), "max_staleness", f.bucketIndexMaxAge)
+		return response{}, false
+	}
+
+	resp := response{
+		metas:   make(map[ulid.ULID]*metadata.Meta, len(idx.Blocks)),
+		partial: make(map[ulid.ULID]error),
+		failed:  make(map[ulid.ULID]error),
+	}
+	for i := range idx.Blocks {
+		m := &idx.Blocks[i]
+		if m.Version < metadata.MetaVersion1 || m.Version > f.maxMetaVersion {
+			level.Warn(f.logger).Log("msg", "bucket index lists block with unexpected meta version; falling back to listing the bucket", "block", m.ULID, "version", m.Version)
+			return response{}, false
+		}
+		resp.metas[m.ULID] = m
+	}
+	f.cached = resp.metas
+	return resp, true
+}
+
+// fetchMetaStore returns metas of all blocks in the metadata store, or false if the store cannot be used.
+func (f *BaseFetcher) fetchMetaStore(ctx context.Context) (response, bool) {
+	metas, reconciled, err := f.metaStore.Metas(ctx)
+	if err != nil {
+		level.Warn(f.logger).Log("msg", "failed to read metadata store; falling back to the bucket", "err", err)
+		return response{}, false
+	}
+	if reconciled.IsZero() || time.Since(reconciled) > f.metaStoreMaxAge {
+		level.Warn(f.logger).Log("msg", "metadata store is stale; falling back to the bucket", "reconciled", reconciled, "max_staleness", f.metaStoreMaxAge)
+		return response{}, false
+	}
+
+	resp := response{
+		metas:   metas,
+		partial: make(map[ulid.ULID]error),
+		failed:  make(map[ulid.ULID]error),
+	}
+	for _, m := range metas {
+		if m.Version < metadata.MetaVersion1 || m.Version > f.maxMetaVersion {
+			level.Warn(f.logger).Log("msg", "metadata store holds block with unexpected meta version; falling back to the bucket", "block", m.ULID, "version", m.Version)
+			return response{}, false
+		}
+	}
+	f.cached = resp.metas
+	return resp, true
+}
+
+// fetch returns filtered and modified metas. If loading of some meta.json files failed, but not more than maxFailedRatio
+// of all blocks, the view is returned as complete and the failed blocks are returned as pending.
+func (f *BaseFetcher) fetch(ctx context.Context, metrics *fetcherMetrics, filters []MetadataFilter, modifiers []MetadataModifier, maxFailedRatio float64) (_ map[ulid.ULID]*metadata.Meta, _ map[ulid.ULID]error, pending map[ulid.ULID]error, err error) {
 	start := time.Now()
 	defer func() {
 		metrics.syncDuration.Observe(time.Since(start).Seconds())
@@ -415,7 +582,7 @@ func (f *BaseFetcher) fetch(ctx context.Context, metrics *fetcherMetrics, filter
 		return f.fetchMetadata(ctx)
 	})
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	resp := v.(response)
 
@@ -432,14 +599,14 @@ func (f *BaseFetcher) fetch(ctx context.Context, metrics *fetcherMetrics, filter
 	for _, filter := range filters {
 		// NOTE: filter can update synced metric accordingly to the reason of the exclude.
 		if err := filter.Filter(ctx, metas, metrics.synced); err != nil {
-			return nil, nil, errors.Wrap(err, "filter metas")
+			return nil, nil, nil, errors.Wrap(err, "filter metas")
 		}
 	}
 
 	for _, m := range modifiers {
 		// NOTE: modifier can update modified metric accordingly to the reason of the modification.
 		if err := m.Modify(ctx, metas, metrics.modified); err != nil {
-			return nil, nil, errors.Wrap(err, "modify metas")
+			return nil, nil, nil, errors.Wrap(err, "modify metas")
 		}
 	}
 
@@ -447,11 +614,21 @@ func (f *BaseFetcher) fetch(ctx context.Context, metrics *fetcherMetrics, filter
 	metrics.submit()
 
 	if len(resp.metaErrs) > 0 {
-		return metas, resp.partial, errors.Wrap(resp.metaErrs, "incomplete view")
+		total := len(resp.metas) + len(resp.partial) + len(resp.failed)
+		if maxFailedRatio <= 0 || float64(len(resp.failed))/float64(total) > maxFailedRatio {
+			return metas, resp.partial, nil, errors.Wrap(resp.metaErrs, "incomplete view")
+		}
+
+		// Copy as same response might be reused by different goroutines.
+		pending = make(map[ulid.ULID]error, len(resp.failed))
+		for id, err := range resp.failed {
+			pending[id] = err
+		}
+		level.Warn(f.logger).Log("msg", "some block metadata failed to load, proceeding without them", "pending", len(pending), "total", total, "err", resp.metaErrs.Err())
 	}
 
-	level.Info(f.logger).Log("msg", "successfully synchronized block metadata", "duration", time.Since(start).String(), "cached", len(f.cached), "returned", len(metas), "partial", len(resp.partial))
-	return metas, resp.partial, nil
+	level.Info(f.logger).Log("msg", "successfully synchronized block metadata", "duration", time.Since(start).String(), "cached", len(f.cached), "returned", len(metas), "partial", len(resp.partial), "pending", len(pending))
+	return metas, resp.partial, pending, nil
 }
 
 type MetaFetcher struct {
@@ -464,6 +641,30 @@ type MetaFetcher struct {
 	listener func([]metadata.Meta, error)
 
 	logger log.Logger
+
+	maxFailedRatio float64
+	mtx            sync.Mutex
+	pending        map[ulid.ULID]error
+}
+
+// AllowPartialResults makes Fetch succeed even if loading of some meta.json files fails (e.g. because of unreadable
+// objects), as long as the failed blocks are at most given fraction of all blocks in the bucket. Such blocks are
+// omitted from the returned metas and reported by Pending instead. Zero (default) means any failure fails the Fetch.
+// It has to be called before first Fetch.
+func (f *MetaFetcher) AllowPartialResults(maxFailedRatio float64) {
+	f.maxFailedRatio = maxFailedRatio
+}
+
+// Pending returns blocks whose meta.json failed to load during the last successful Fetch with partial results allowed.
+func (f *MetaFetcher) Pending() map[ulid.ULID]error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	pending := make(map[ulid.ULID]error, len(f.pending))
+	for id, err := range f.pending {
+		pending[id] = err
+	}
+	return pending
 }
 
 // Fetch returns all block metas as well as partial blocks (blocks without or with corrupted meta file) from the bucket.
@@ -471,7 +672,12 @@ type MetaFetcher struct {
 //
 // Returned error indicates a failure in fetching metadata. Returned meta can be assumed as correct, with some blocks missing.
 func (f *MetaFetcher) Fetch(ctx context.Context) (metas map[ulid.ULID]*metadata.Meta, partial map[ulid.ULID]error, err error) {
-	metas, partial, err = f.wrapped.fetch(ctx, f.metrics, f.filters, f.modifiers)
+	metas, partial, pending, err := f.wrapped.fetch(ctx, f.metrics, f.filters, f.modifiers, f.maxFailedRatio)
+	if err == nil {
+		f.mtx.Lock()
+		f.pending = pending
+		f.mtx.Unlock()
+	}
 	if f.listener != nil {
 		blocks := make([]metadata.Meta, 0, len(metas))
 		for _, meta := range metas {
@@ -512,11 +718,49 @@ func (f *TimePartitionMetaFilter) Filter(_ context.Context, metas map[ulid.ULID]
 	return nil
 }
 
+var _ MetadataFilter = &TimePartitionOwnershipFilter{}
+
+// TimePartitionOwnershipFilter is a BaseFetcher filter that filters out blocks not owned by the time partition
+// [minTime, maxTime). Unlike TimePartitionMetaFilter, each block is owned by exactly one of non-overlapping partitions,
+// based on its min time. Blocks created from blocks of a single partition, by compaction or downsampling, belong to the
+// same partition, so compactors of distinct partitions never work on the same blocks.
+// Not go-routine safe.
+type TimePartitionOwnershipFilter struct {
+	minTime, maxTime model.TimeOrDurationValue
+}
+
+// NewTimePartitionOwnershipFilter creates TimePartitionOwnershipFilter.
+func NewTimePartitionOwnershipFilter(minTime, maxTime model.TimeOrDurationValue) *TimePartitionOwnershipFilter {
+	return &TimePartitionOwnershipFilter{minTime: minTime, maxTime: maxTime}
+}
+
+// Contains returns true if the given timestamp in milliseconds falls into the partition.
+func (f *TimePartitionOwnershipFilter) Contains(t int64) bool {
+	return t >= f.minTime.PrometheusTimestamp() && t < f.maxTime.PrometheusTimestamp()
+}
+
+// Owns returns true if the block belongs to the partition.
+func (f *TimePartitionOwnershipFilter) Owns(m *metadata.Meta) bool {
+	return f.Contains(m.MinTime)
+}
+
+// Filter filters out blocks not owned by the partition.
+func (f *TimePartitionOwnershipFilter) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
+	for id, m := range metas {
+		if f.Owns(m) {
+			continue
+		}
+		synced.WithLabelValues(timeExcludedMeta).Inc()
+		delete(metas, id)
+	}
+	return nil
+}
+
 var _ MetadataFilter = &LabelShardedMetaFilter{}
 
 // LabelShardedMetaFilter represents struct that allows sharding.
-// Not go-routine safe.
 type LabelShardedMetaFilter struct {
+	mtx           sync.Mutex
 	relabelConfig []*relabel.Config
 }
 
@@ -525,11 +769,22 @@ func NewLabelShardedMetaFilter(relabelConfig []*relabel.Config) *LabelShardedMet
 	return &LabelShardedMetaFilter{relabelConfig: relabelConfig}
 }
 
+// SetRelabelConfig replaces the relabel configuration, applied from the next sync on.
+func (f *LabelShardedMetaFilter) SetRelabelConfig(relabelConfig []*relabel.Config) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.relabelConfig = relabelConfig
+}
+
 // Special label that will have an ULID of the meta.json being referenced to.
 const BlockIDLabel = "__block_id"
 
 // Filter filters out blocks that have no labels after relabelling of each block external (Thanos) labels.
 func (f *LabelShardedMetaFilter) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
+	f.mtx.Lock()
+	relabelConfig := f.relabelConfig
+	f.mtx.Unlock()
+
 	var lbls labels.Labels
 	for id, m := range metas {
 		lbls = lbls[:0]
@@ -538,7 +793,7 @@ func (f *LabelShardedMetaFilter) Filter(_ context.Context, metas map[ulid.ULID]*
 			lbls = append(lbls, labels.Label{Name: k, Value: v})
 		}
 
-		if processedLabels := relabel.Process(lbls, f.relabelConfig...); len(processedLabels) == 0 {
+		if processedLabels := relabel.Process(lbls, relabelConfig...); len(processedLabels) == 0 {
 			synced.WithLabelValues(labelExcludedMeta).Inc()
 			delete(metas, id)
 		}
@@ -548,22 +803,95 @@ func (f *LabelShardedMetaFilter) Filter(_ context.Context, metas map[ulid.ULID]*
 
 var _ MetadataFilter = &DeduplicateFilter{}
 
+// DuplicatesPolicy chooses which block to keep out of the blocks that have exactly the same sources.
+// It is given at least two metas and returns the ID of the block to keep; all others are filtered out as duplicates.
+// Blocks whose sources are a strict subset of other block's sources are always filtered out.
+type DuplicatesPolicy func(duplicates []*metadata.Meta) ulid.ULID
+
+// PreferOlderULID is a DuplicatesPolicy keeping the block with the oldest ULID. This is the default policy.
+func PreferOlderULID(duplicates []*metadata.Meta) ulid.ULID {
+	keep := duplicates[0]
+	for _, m := range duplicates[1:] {
+		if m.ULID.Compare(keep.ULID) < 0 {
+			keep = m
+		}
+	}
+	return keep.ULID
+}
+
+// PreferNewerULID is a DuplicatesPolicy keeping the block with the newest ULID.
+func PreferNewerULID(duplicates []*metadata.Meta) ulid.ULID {
+	keep := duplicates[0]
+	for _, m := range duplicates[1:] {
+		if m.ULID.Compare(keep.ULID) > 0 {
+			keep = m
+		}
+	}
+	return keep.ULID
+}
+
+// PreferLargerBlock is a DuplicatesPolicy keeping the block with the most samples. Ties are resolved by PreferOlderULID.
+func PreferLargerBlock(duplicates []*metadata.Meta) ulid.ULID {
+	var largest []*metadata.Meta
+	for _, m := range duplicates {
+		if len(largest) > 0 && m.Stats.NumSamples < largest[0].Stats.NumSamples {
+			continue
+		}
+		if len(largest) > 0 && m.Stats.NumSamples > largest[0].Stats.NumSamples {
+			largest = largest[:0]
+		}
+		largest = append(largest, m)
+	}
+	return PreferOlderULID(largest)
+}
+
+// PreferSource returns DuplicatesPolicy keeping the block uploaded by the first matching source from the given list.
+// If none of the blocks matches, the fallback policy is used.
+func PreferSource(fallback DuplicatesPolicy, sources ...metadata.SourceType) DuplicatesPolicy {
+	return func(duplicates []*metadata.Meta) ulid.ULID {
+		for _, src := range sources {
+			var matching []*metadata.Meta
+			for _, m := range duplicates {
+				if m.Thanos.Source == src {
+					matching = append(matching, m)
+				}
+			}
+			if len(matching) == 1 {
+				return matching[0].ULID
+			}
+			if len(matching) > 1 {
+				return fallback(matching)
+			}
+		}
+		return fallback(duplicates)
+	}
+}
+
 // DeduplicateFilter is a BaseFetcher filter that filters out older blocks that have exactly the same data.
 // Not go-routine safe.
 type DeduplicateFilter struct {
 	duplicateIDs []ulid.ULID
+	roots        map[int64]*Node
+	policy       DuplicatesPolicy
 	mu           sync.Mutex
 }
 
 // NewDeduplicateFilter creates DeduplicateFilter.
 func NewDeduplicateFilter() *DeduplicateFilter {
-	return &DeduplicateFilter{}
+	return NewDeduplicateFilterWithPolicy(PreferOlderULID)
+}
+
+// NewDeduplicateFilterWithPolicy creates DeduplicateFilter which uses given policy to choose which of the blocks
+// with the same sources to keep.
+func NewDeduplicateFilterWithPolicy(policy DuplicatesPolicy) *DeduplicateFilter {
+	return &DeduplicateFilter{policy: policy, roots: map[int64]*Node{}}
 }
 
 // Filter filters out duplicate blocks that can be formed
 // from two or more overlapping blocks that fully submatches the source blocks of the older blocks.
 func (f *DeduplicateFilter) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
 	f.duplicateIDs = f.duplicateIDs[:0]
+	f.roots = map[int64]*Node{}
 
 	var wg sync.WaitGroup
 
@@ -577,11 +905,16 @@ func (f *DeduplicateFilter) Filter(_ context.Context, metas map[ulid.ULID]*metad
 		wg.Add(1)
 		go func(res int64) {
 			defer wg.Done()
-			f.filterForResolution(NewNode(&metadata.Meta{
+			root := NewNode(&metadata.Meta{
 				BlockMeta: tsdb.BlockMeta{
 					ULID: ulid.MustNew(uint64(0), nil),
 				},
-			}), metasByResolution[res], metas, synced)
+			})
+			f.filterForResolution(root, metasByResolution[res], metas, synced)
+
+			f.mu.Lock()
+			f.roots[res] = root
+			f.mu.Unlock()
 		}(res)
 	}
 
@@ -591,11 +924,18 @@ func (f *DeduplicateFilter) Filter(_ context.Context, metas map[ulid.ULID]*metad
 }
 
 func (f *DeduplicateFilter) filterForResolution(root *Node, metaSlice []*metadata.Meta, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) {
+	keep := f.preferred(metaSlice)
 	sort.Slice(metaSlice, func(i, j int) bool {
 		ilen := len(metaSlice[i].Compaction.Sources)
 		jlen := len(metaSlice[j].Compaction.Sources)
 
 		if ilen == jlen {
+			// Blocks chosen by the policy have to be added to the tree first, so they become parents of their duplicates.
+			_, ikeep := keep[metaSlice[i].ULID]
+			_, jkeep := keep[metaSlice[j].ULID]
+			if ikeep != jkeep {
+				return ikeep
+			}
 			return metaSlice[i].ULID.Compare(metaSlice[j].ULID) < 0
 		}
 
@@ -618,11 +958,43 @@ func (f *DeduplicateFilter) filterForResolution(root *Node, metaSlice []*metadat
 	}
 }
 
+// preferred returns IDs of blocks chosen by the policy out of every set of blocks with exactly the same sources.
+func (f *DeduplicateFilter) preferred(metaSlice []*metadata.Meta) map[ulid.ULID]struct{} {
+	bySources := map[string][]*metadata.Meta{}
+	for _, m := range metaSlice {
+		sources := make([]string, 0, len(m.Compaction.Sources))
+		for _, s := range m.Compaction.Sources {
+			sources = append(sources, s.String())
+		}
+		sort.Strings(sources)
+		key := strings.Join(sources, ",")
+		bySources[key] = append(bySources[key], m)
+	}
+
+	keep := map[ulid.ULID]struct{}{}
+	for _, duplicates := range bySources {
+		if len(duplicates) < 2 {
+			continue
+		}
+		keep[f.policy(duplicates)] = struct{}{}
+	}
+	return keep
+}
+
 // DuplicateIDs returns slice of block ids that are filtered out by DeduplicateFilter.
 func (f *DeduplicateFilter) DuplicateIDs() []ulid.ULID {
 	return f.duplicateIDs
 }
 
+// Roots returns the block ancestry trees built during the last Filter call, by downsampling resolution.
+// Children of the root node are the blocks that were kept; all their descendants were filtered out as duplicates.
+func (f *DeduplicateFilter) Roots() map[int64]*Node {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.roots
+}
+
 func addNodeBySources(root *Node, add *Node) bool {
 	var rootNode *Node
 	for _, node := range root.Children {
@@ -705,6 +1077,108 @@ func (r *ReplicaLabelRemover) Modify(_ context.Context, metas map[ulid.ULID]*met
 	return nil
 }
 
+var _ MetadataModifier = &LabelNormalizer{}
+
+// LabelNormalizer is a BaseFetcher modifier that normalizes external labels of existing blocks, so blocks uploaded with
+// inconsistent label casing end up in the same compaction group. Names of configured labels are matched case-insensitively
+// and replaced with the configured name, their values are lower-cased. Go-routine safe.
+// NOTE: Ordering of labels does not need normalization, as labels are always sorted when converted from the map.
+type LabelNormalizer struct {
+	logger log.Logger
+
+	// caseFold maps lower-cased label names to the configured label names.
+	caseFold map[string]string
+
+	mtx        sync.Mutex
+	normalized map[ulid.ULID]struct{}
+}
+
+// NewLabelNormalizer creates a LabelNormalizer that case-folds given labels.
+func NewLabelNormalizer(logger log.Logger, caseFoldLabels []string) *LabelNormalizer {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	n := &LabelNormalizer{
+		logger:     logger,
+		caseFold:   make(map[string]string, len(caseFoldLabels)),
+		normalized: map[ulid.ULID]struct{}{},
+	}
+	for _, l := range caseFoldLabels {
+		n.caseFold[strings.ToLower(l)] = l
+	}
+	return n
+}
+
+// Normalize returns normalized copy of given external labels and true if they differed from the normalized form.
+func (n *LabelNormalizer) Normalize(lset map[string]string) (map[string]string, bool) {
+	// Iterate in stable order for conflicting names to resolve deterministically.
+	names := make([]string, 0, len(lset))
+	for name := range lset {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := make(map[string]string, len(lset))
+	changed := false
+	for _, name := range names {
+		value := lset[name]
+		target, ok := n.caseFold[strings.ToLower(name)]
+		if !ok {
+			res[name] = value
+			continue
+		}
+		normalized := strings.ToLower(value)
+		if prev, exists := res[target]; exists && prev != normalized {
+			level.Warn(n.logger).Log("msg", "conflicting values of case-folded label, keeping the one with configured name", "label", target)
+			if name != target {
+				changed = true
+				continue
+			}
+		}
+		res[target] = normalized
+		if name != target || value != normalized {
+			changed = true
+		}
+	}
+	return res, changed
+}
+
+// Modify modifies external labels of existing blocks, it normalizes configured labels of the metadata of blocks.
+func (n *LabelNormalizer) Modify(_ context.Context, metas map[ulid.ULID]*metadata.Meta, modified *extprom.TxGaugeVec) error {
+	if len(n.caseFold) == 0 {
+		return nil
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	n.normalized = map[ulid.ULID]struct{}{}
+	for id, meta := range metas {
+		lset, changed := n.Normalize(meta.Thanos.Labels)
+		if !changed {
+			continue
+		}
+		level.Debug(n.logger).Log("msg", "external labels normalized", "block", id)
+		metas[id].Thanos.Labels = lset
+		n.normalized[id] = struct{}{}
+		modified.WithLabelValues(labelNormalizedMeta).Inc()
+	}
+	return nil
+}
+
+// NormalizedBlocks returns IDs of blocks whose external labels were normalized during the last sync.
+func (n *LabelNormalizer) NormalizedBlocks() []ulid.ULID {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	ids := make([]ulid.ULID, 0, len(n.normalized))
+	for id := range n.normalized {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Compare(ids[j]) < 0 })
+	return ids
+}
+
 // ConsistencyDelayMetaFilter is a BaseFetcher filter that filters out blocks that are created before a specified consistency delay.
 // Not go-routine safe.
 type ConsistencyDelayMetaFilter struct {
@@ -752,33 +1226,91 @@ func (f *ConsistencyDelayMetaFilter) Filter(_ context.Context, metas map[ulid.UL
 
 // IgnoreDeletionMarkFilter is a filter that filters out the blocks that are marked for deletion after a given delay.
 // The delay duration is to make sure that the replacement block can be fetched before we filter out the old block.
-// Delay is not considered when computing DeletionMarkBlocks map.
-// Not go-routine safe.
+// Delay is not considered when computing DeletionMarkBlocks map, nor for blocks marked with EmptyCompactionResultDeletionReason,
+// as no block replaces them.
+// Filter is not go-routine safe.
 type IgnoreDeletionMarkFilter struct {
-	logger          log.Logger
-	delay           time.Duration
-	bkt             objstore.InstrumentedBucketReader
+	logger log.Logger
+	delay  time.Duration
+	bkt    objstore.InstrumentedBucketReader
+	exempt map[ulid.ULID]struct{}
+
+	mtx             sync.Mutex
 	deletionMarkMap map[ulid.ULID]*metadata.DeletionMark
+	ignored         map[ulid.ULID]*metadata.DeletionMark
 }
 
 // NewIgnoreDeletionMarkFilter creates IgnoreDeletionMarkFilter.
 func NewIgnoreDeletionMarkFilter(logger log.Logger, bkt objstore.InstrumentedBucketReader, delay time.Duration) *IgnoreDeletionMarkFilter {
-	return &IgnoreDeletionMarkFilter{
+	return NewIgnoreDeletionMarkFilterWithExemptions(logger, bkt, delay, nil)
+}
+
+// NewIgnoreDeletionMarkFilterWithExemptions creates IgnoreDeletionMarkFilter that never filters out nor reports
+// for deletion given exempt blocks (e.g. blocks under legal hold), even if they are marked for deletion.
+func NewIgnoreDeletionMarkFilterWithExemptions(logger log.Logger, bkt objstore.InstrumentedBucketReader, delay time.Duration, exempt []ulid.ULID) *IgnoreDeletionMarkFilter {
+	f := &IgnoreDeletionMarkFilter{
 		logger: logger,
 		bkt:    bkt,
 		delay:  delay,
+		exempt: make(map[ulid.ULID]struct{}, len(exempt)),
+	}
+	for _, id := range exempt {
+		f.exempt[id] = struct{}{}
 	}
+	return f
 }
 
-// DeletionMarkBlocks returns block ids that were marked for deletion.
+// DeletionMarkBlocks returns block ids that were marked for deletion. Exempt blocks are never included.
 func (f *IgnoreDeletionMarkFilter) DeletionMarkBlocks() map[ulid.ULID]*metadata.DeletionMark {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
 	return f.deletionMarkMap
 }
 
+// IgnoredBlocks returns block ids that were filtered out on last Filter call, because they were marked for deletion
+// more than delay duration ago.
+func (f *IgnoreDeletionMarkFilter) IgnoredBlocks() map[ulid.ULID]*metadata.DeletionMark {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return f.ignored
+}
+
+// IsExempt returns true if the given block must never be ignored nor deleted.
+func (f *IgnoreDeletionMarkFilter) IsExempt(id ulid.ULID) bool {
+	_, ok := f.exempt[id]
+	return ok
+}
+
+// ExemptBlocks returns sorted ids of blocks that must never be ignored nor deleted.
+func (f *IgnoreDeletionMarkFilter) ExemptBlocks() []ulid.ULID {
+	ids := make([]ulid.ULID, 0, len(f.exempt))
+	for id := range f.exempt {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Compare(ids[j]) < 0
+	})
+	return ids
+}
+
+// SetDelay replaces the delay, applied from the next sync on.
+func (f *IgnoreDeletionMarkFilter) SetDelay(delay time.Duration) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.delay = delay
+}
+
 // Filter filters out blocks that are marked for deletion after a given delay.
 // It also returns the blocks that can be deleted since they were uploaded delay duration before current time.
 func (f *IgnoreDeletionMarkFilter) Filter(ctx context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
-	f.deletionMarkMap = make(map[ulid.ULID]*metadata.DeletionMark)
+	f.mtx.Lock()
+	delay := f.delay
+	f.mtx.Unlock()
+
+	deletionMarkMap := make(map[ulid.ULID]*metadata.DeletionMark)
+	ignored := make(map[ulid.ULID]*metadata.DeletionMark)
 
 	for id := range metas {
 		deletionMark, err := metadata.ReadDeletionMark(ctx, f.bkt, f.logger, id.String())
@@ -792,12 +1324,180 @@ func (f *IgnoreDeletionMarkFilter) Filter(ctx context.Context, metas map[ulid.UL
 		if err != nil {
 			return err
 		}
-		f.deletionMarkMap[id] = deletionMark
-		if time.Since(time.Unix(deletionMark.DeletionTime, 0)).Seconds() > f.delay.Seconds() {
+		if f.IsExempt(id) {
+			level.Warn(f.logger).Log("msg", "block is marked for deletion, but it is exempt from deletion; ignoring the mark", "block", id)
+			continue
+		}
+		deletionMarkMap[id] = deletionMark
+		// Sources of an empty compaction have no data left to serve and no block replaces them, so the delay
+		// does not apply. Otherwise they would be compacted over and over again until it passes.
+		if deletionMark.Reason == metadata.EmptyCompactionResultDeletionReason ||
+			time.Since(time.Unix(deletionMark.DeletionTime, 0)).Seconds() > delay.Seconds() {
 			synced.WithLabelValues(markedForDeletionMeta).Inc()
+			ignored[id] = deletionMark
 			delete(metas, id)
 		}
 	}
+
+	f.mtx.Lock()
+	f.deletionMarkMap = deletionMarkMap
+	f.ignored = ignored
+	f.mtx.Unlock()
+	return nil
+}
+
+// HoldMarkFilter is a filter that filters out the blocks that are placed under hold, so they are never compacted,
+// removed by retention nor garbage collected. It must be placed after DeduplicateFilter, so held blocks still replace
+// their sources, e.g. sources of a held compacted block are not compacted again into a block overlapping it.
+// Filter is not go-routine safe.
+type HoldMarkFilter struct {
+	logger log.Logger
+	bkt    objstore.InstrumentedBucketReader
+
+	mtx  sync.Mutex
+	held map[ulid.ULID]*metadata.HoldMark
+}
+
+// NewHoldMarkFilter creates HoldMarkFilter.
+func NewHoldMarkFilter(logger log.Logger, bkt objstore.InstrumentedBucketReader) *HoldMarkFilter {
+	return &HoldMarkFilter{
+		logger: logger,
+		bkt:    bkt,
+	}
+}
+
+// HeldBlocks returns blocks that were found under hold on the last Filter call.
+func (f *HoldMarkFilter) HeldBlocks() map[ulid.ULID]*metadata.HoldMark {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return f.held
+}
+
+// Filter filters out blocks that are placed under hold.
+func (f *HoldMarkFilter) Filter(ctx context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
+	held := make(map[ulid.ULID]*metadata.HoldMark)
+
+	for id := range metas {
+		holdMark, err := metadata.ReadHoldMark(ctx, f.bkt, f.logger, id.String())
+		if err == metadata.ErrorHoldMarkNotFound {
+			continue
+		}
+		if errors.Cause(err) == metadata.ErrorUnmarshalHoldMark {
+			// Better safe than sorry; partially uploaded or broken mark still means the block was meant to be held.
+			level.Warn(f.logger).Log("msg", "found partial hold-mark.json; treating block as held", "block", id, "err", err)
+			holdMark = &metadata.HoldMark{ID: id, Version: metadata.HoldMarkVersion1}
+		} else if err != nil {
+			return err
+		}
+		held[id] = holdMark
+		synced.WithLabelValues(heldMeta).Inc()
+		delete(metas, id)
+	}
+
+	f.mtx.Lock()
+	f.held = held
+	f.mtx.Unlock()
+	return nil
+}
+
+// PendingCommitFilter is a filter that filters out blocks of pending commits, i.e. blocks uploaded together by
+// UploadMulti which are not all uploaded yet, or whose upload was aborted. It must be placed before DeduplicateFilter, so
+// that blocks of a pending commit do not replace their sources. Filter is not go-routine safe.
+type PendingCommitFilter struct {
+	logger log.Logger
+	bkt    objstore.InstrumentedBucketReader
+
+	mtx     sync.Mutex
+	commits []metadata.PendingCommit
+}
+
+// NewPendingCommitFilter creates PendingCommitFilter.
+func NewPendingCommitFilter(logger log.Logger, bkt objstore.InstrumentedBucketReader) *PendingCommitFilter {
+	return &PendingCommitFilter{
+		logger: logger,
+		bkt:    bkt,
+	}
+}
+
+// PendingCommits returns pending commits found on the last Filter call.
+func (f *PendingCommitFilter) PendingCommits() []metadata.PendingCommit {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return f.commits
+}
+
+// Filter filters out blocks of pending commits.
+func (f *PendingCommitFilter) Filter(ctx context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
+	commits, err := metadata.ReadPendingCommits(ctx, f.bkt, f.logger)
+	if err != nil {
+		return err
+	}
+	for _, c := range commits {
+		for _, id := range c.Blocks {
+			if _, ok := metas[id]; !ok {
+				continue
+			}
+			synced.WithLabelValues(pendingCommitMeta).Inc()
+			delete(metas, id)
+		}
+	}
+
+	f.mtx.Lock()
+	f.commits = commits
+	f.mtx.Unlock()
+	return nil
+}
+
+// NoCompactMarkFilter is a filter that gathers no-compact marks of blocks, without filtering them out, as marked blocks
+// are excluded from compaction only and still removed by retention and garbage collected.
+// Filter is not go-routine safe.
+type NoCompactMarkFilter struct {
+	logger log.Logger
+	bkt    objstore.InstrumentedBucketReader
+
+	mtx    sync.Mutex
+	marked map[ulid.ULID]*metadata.NoCompactMark
+}
+
+// NewNoCompactMarkFilter creates NoCompactMarkFilter.
+func NewNoCompactMarkFilter(logger log.Logger, bkt objstore.InstrumentedBucketReader) *NoCompactMarkFilter {
+	return &NoCompactMarkFilter{
+		logger: logger,
+		bkt:    bkt,
+	}
+}
+
+// NoCompactMarkedBlocks returns blocks that were found marked for no compaction on the last Filter call.
+func (f *NoCompactMarkFilter) NoCompactMarkedBlocks() map[ulid.ULID]*metadata.NoCompactMark {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return f.marked
+}
+
+// Filter gathers no-compact marks of the given blocks.
+func (f *NoCompactMarkFilter) Filter(ctx context.Context, metas map[ulid.ULID]*metadata.Meta, _ *extprom.TxGaugeVec) error {
+	marked := make(map[ulid.ULID]*metadata.NoCompactMark)
+
+	for id := range metas {
+		noCompactMark, err := metadata.ReadNoCompactMark(ctx, f.bkt, f.logger, id.String())
+		if err == metadata.ErrorNoCompactMarkNotFound {
+			continue
+		}
+		if errors.Cause(err) == metadata.ErrorUnmarshalNoCompactMark {
+			level.Warn(f.logger).Log("msg", "found partial no-compact-mark.json; treating block as marked", "block", id, "err", err)
+			noCompactMark = &metadata.NoCompactMark{ID: id, Version: metadata.NoCompactMarkVersion1}
+		} else if err != nil {
+			return err
+		}
+		marked[id] = noCompactMark
+	}
+
+	f.mtx.Lock()
+	f.marked = marked
+	f.mtx.Unlock()
 	return nil
 }
 
@@ -295,6 +295,46 @@ func TestMetaFetcher_Fetch(t *testing.T) {
 	})
 }
 
+func TestMetaFetcher_Fetch_PartialResults(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 4; i++ {
+		var meta metadata.Meta
+		meta.Version = 1
+		meta.ULID = ULID(i)
+		if i == 4 {
+			// Unknown version fails loading of the meta.json.
+			meta.Version = 20
+		}
+
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&meta))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(meta.ULID.String(), metadata.MetaFilename), &buf))
+	}
+
+	fetcher, err := NewMetaFetcher(log.NewNopLogger(), 20, objstore.WithNoopInstr(bkt), "", nil, nil, nil)
+	testutil.Ok(t, err)
+
+	// Too many failures.
+	fetcher.AllowPartialResults(0.2)
+	metas, _, err := fetcher.Fetch(ctx)
+	testutil.NotOk(t, err)
+	compareSliceWithMapKeys(t, metas, ULIDs(1, 2, 3))
+	testutil.Equals(t, 0, len(fetcher.Pending()))
+
+	fetcher.AllowPartialResults(0.25)
+	metas, partial, err := fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	compareSliceWithMapKeys(t, metas, ULIDs(1, 2, 3))
+	testutil.Equals(t, 0, len(partial))
+
+	pending := fetcher.Pending()
+	testutil.Equals(t, 1, len(pending))
+	testutil.NotOk(t, pending[ULID(4)])
+}
+
 func TestLabelShardedMetaFilter_Filter_Basic(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
 	defer cancel()
@@ -522,6 +562,35 @@ func TestTimePartitionMetaFilter_Filter(t *testing.T) {
 
 }
 
+func TestTimePartitionOwnershipFilter_Filter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	mint := time.Unix(0, 10*time.Millisecond.Nanoseconds())
+	maxt := time.Unix(0, 20*time.Millisecond.Nanoseconds())
+	f := NewTimePartitionOwnershipFilter(model.TimeOrDurationValue{Time: &mint}, model.TimeOrDurationValue{Time: &maxt})
+
+	input := map[ulid.ULID]*metadata.Meta{
+		// Overlaps the partition, but is owned by the previous one.
+		ULID(1): {BlockMeta: tsdb.BlockMeta{MinTime: 0, MaxTime: 15}},
+		ULID(2): {BlockMeta: tsdb.BlockMeta{MinTime: 10, MaxTime: 20}},
+		// Extends past the partition, but is still owned by it.
+		ULID(3): {BlockMeta: tsdb.BlockMeta{MinTime: 19, MaxTime: 40}},
+		ULID(4): {BlockMeta: tsdb.BlockMeta{MinTime: 20, MaxTime: 30}},
+	}
+	expected := map[ulid.ULID]*metadata.Meta{
+		ULID(2): input[ULID(2)],
+		ULID(3): input[ULID(3)],
+	}
+
+	m := newTestFetcherMetrics()
+	testutil.Ok(t, f.Filter(ctx, input, m.synced))
+
+	testutil.Equals(t, 2.0, promtest.ToFloat64(m.synced.WithLabelValues(timeExcludedMeta)))
+	testutil.Equals(t, expected, input)
+	testutil.Assert(t, f.Contains(10) && !f.Contains(20), "partition should contain its start only")
+}
+
 type sourcesAndResolution struct {
 	sources    []ulid.ULID
 	resolution int64
@@ -942,6 +1011,35 @@ func TestReplicaLabelRemover_Modify(t *testing.T) {
 	}
 }
 
+func TestLabelNormalizer_Modify(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	input := map[ulid.ULID]*metadata.Meta{
+		ULID(1): {Thanos: metadata.Thanos{Labels: map[string]string{"cluster": "eu1", "message": "Something"}}},
+		ULID(2): {Thanos: metadata.Thanos{Labels: map[string]string{"Cluster": "EU1", "message": "Something"}}},
+		ULID(3): {Thanos: metadata.Thanos{Labels: map[string]string{"CLUSTER": "Eu1", "cluster": "us1", "message": "Something"}}},
+	}
+	expected := map[ulid.ULID]*metadata.Meta{
+		ULID(1): {Thanos: metadata.Thanos{Labels: map[string]string{"cluster": "eu1", "message": "Something"}}},
+		ULID(2): {Thanos: metadata.Thanos{Labels: map[string]string{"cluster": "eu1", "message": "Something"}}},
+		ULID(3): {Thanos: metadata.Thanos{Labels: map[string]string{"cluster": "us1", "message": "Something"}}},
+	}
+
+	n := NewLabelNormalizer(log.NewNopLogger(), []string{"cluster"})
+	m := newTestFetcherMetrics()
+	testutil.Ok(t, n.Modify(ctx, input, m.modified))
+
+	testutil.Equals(t, 2.0, promtest.ToFloat64(m.modified.WithLabelValues(labelNormalizedMeta)))
+	testutil.Equals(t, expected, input)
+	testutil.Equals(t, []ulid.ULID{ULID(2), ULID(3)}, n.NormalizedBlocks())
+
+	// Nothing to normalize without configured labels.
+	m = newTestFetcherMetrics()
+	testutil.Ok(t, NewLabelNormalizer(log.NewNopLogger(), nil).Modify(ctx, input, m.modified))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(m.modified.WithLabelValues(labelNormalizedMeta)))
+}
+
 func compareSliceWithMapKeys(tb testing.TB, m map[ulid.ULID]*metadata.Meta, s []ulid.ULID) {
 	_, file, line, _ := runtime.Caller(1)
 	matching := true
@@ -1096,6 +1194,13 @@ func TestIgnoreDeletionMarkFilter_Filter(t *testing.T) {
 			Version:      1,
 		}
 
+		shouldIgnoreEmptyCompaction := &metadata.DeletionMark{
+			ID:           ULID(5),
+			DeletionTime: now.Add(-15 * time.Hour).Unix(),
+			Reason:       metadata.EmptyCompactionResultDeletionReason,
+			Version:      1,
+		}
+
 		var buf bytes.Buffer
 		testutil.Ok(t, json.NewEncoder(&buf).Encode(&shouldFetch))
 		testutil.Ok(t, bkt.Upload(ctx, path.Join(shouldFetch.ID.String(), metadata.DeletionMarkFilename), &buf))
@@ -1103,6 +1208,9 @@ func TestIgnoreDeletionMarkFilter_Filter(t *testing.T) {
 		testutil.Ok(t, json.NewEncoder(&buf).Encode(&shouldIgnore))
 		testutil.Ok(t, bkt.Upload(ctx, path.Join(shouldIgnore.ID.String(), metadata.DeletionMarkFilename), &buf))
 
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&shouldIgnoreEmptyCompaction))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(shouldIgnoreEmptyCompaction.ID.String(), metadata.DeletionMarkFilename), &buf))
+
 		testutil.Ok(t, bkt.Upload(ctx, path.Join(ULID(3).String(), metadata.DeletionMarkFilename), bytes.NewBufferString("not a valid deletion-mark.json")))
 
 		input := map[ulid.ULID]*metadata.Meta{
@@ -1110,6 +1218,7 @@ func TestIgnoreDeletionMarkFilter_Filter(t *testing.T) {
 			ULID(2): {},
 			ULID(3): {},
 			ULID(4): {},
+			ULID(5): {},
 		}
 
 		expected := map[ulid.ULID]*metadata.Meta{
@@ -1120,11 +1229,92 @@ func TestIgnoreDeletionMarkFilter_Filter(t *testing.T) {
 
 		m := newTestFetcherMetrics()
 		testutil.Ok(t, f.Filter(ctx, input, m.synced))
-		testutil.Equals(t, 1.0, promtest.ToFloat64(m.synced.WithLabelValues(markedForDeletionMeta)))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(m.synced.WithLabelValues(markedForDeletionMeta)))
 		testutil.Equals(t, expected, input)
 	})
 }
 
+func TestIgnoreDeletionMarkFilter_Exemptions(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	for _, id := range []ulid.ULID{ULID(1), ULID(2)} {
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&metadata.DeletionMark{
+			ID:           id,
+			DeletionTime: time.Now().Add(-60 * time.Hour).Unix(),
+			Version:      1,
+		}))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.DeletionMarkFilename), &buf))
+	}
+
+	f := NewIgnoreDeletionMarkFilterWithExemptions(log.NewNopLogger(), objstore.WithNoopInstr(bkt), 48*time.Hour, []ulid.ULID{ULID(2)})
+	input := map[ulid.ULID]*metadata.Meta{
+		ULID(1): {},
+		ULID(2): {},
+		ULID(3): {},
+	}
+
+	m := newTestFetcherMetrics()
+	testutil.Ok(t, f.Filter(ctx, input, m.synced))
+	testutil.Equals(t, map[ulid.ULID]*metadata.Meta{ULID(2): {}, ULID(3): {}}, input)
+
+	testutil.Assert(t, f.IsExempt(ULID(2)), "expected block to be exempt")
+	testutil.Equals(t, []ulid.ULID{ULID(2)}, f.ExemptBlocks())
+	testutil.Equals(t, 1, len(f.DeletionMarkBlocks()))
+	testutil.Equals(t, 1, len(f.IgnoredBlocks()))
+	_, ok := f.IgnoredBlocks()[ULID(1)]
+	testutil.Assert(t, ok, "expected block to be ignored")
+}
+
+func TestHoldMarkFilter_Filter(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	var buf bytes.Buffer
+	testutil.Ok(t, json.NewEncoder(&buf).Encode(&metadata.HoldMark{ID: ULID(1), HoldTime: time.Now().Unix(), Version: metadata.HoldMarkVersion1}))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ULID(1).String(), metadata.HoldMarkFilename), &buf))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ULID(2).String(), metadata.HoldMarkFilename), bytes.NewBufferString("not a valid hold-mark.json")))
+
+	f := NewHoldMarkFilter(log.NewNopLogger(), objstore.WithNoopInstr(bkt))
+	input := map[ulid.ULID]*metadata.Meta{
+		ULID(1): {},
+		ULID(2): {},
+		ULID(3): {},
+	}
+
+	m := newTestFetcherMetrics()
+	testutil.Ok(t, f.Filter(ctx, input, m.synced))
+	testutil.Equals(t, map[ulid.ULID]*metadata.Meta{ULID(3): {}}, input)
+	testutil.Equals(t, 2.0, promtest.ToFloat64(m.synced.WithLabelValues(heldMeta)))
+	testutil.Equals(t, 2, len(f.HeldBlocks()))
+}
+
+func TestNoCompactMarkFilter_Filter(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	logger := log.NewNopLogger()
+	testutil.Ok(t, MarkForNoCompact(ctx, logger, bkt, ULID(1), metadata.TerminalNoCompactReason, "no partners", prometheus.NewCounter(prometheus.CounterOpts{})))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ULID(2).String(), metadata.NoCompactMarkFilename), bytes.NewBufferString("not a valid no-compact-mark.json")))
+
+	f := NewNoCompactMarkFilter(logger, objstore.WithNoopInstr(bkt))
+	input := map[ulid.ULID]*metadata.Meta{
+		ULID(1): {},
+		ULID(2): {},
+		ULID(3): {},
+	}
+
+	m := newTestFetcherMetrics()
+	testutil.Ok(t, f.Filter(ctx, input, m.synced))
+	// Marked blocks are not filtered out.
+	testutil.Equals(t, 3, len(input))
+	marked := f.NoCompactMarkedBlocks()
+	testutil.Equals(t, 2, len(marked))
+	testutil.Equals(t, metadata.TerminalNoCompactReason, marked[ULID(1)].Reason)
+	testutil.Equals(t, "no partners", marked[ULID(1)].Details)
+}
+
 func BenchmarkDeduplicateFilter_Filter(b *testing.B) {
 
 	var (
@@ -1213,3 +1403,62 @@ func Test_ParseRelabelConfig(t *testing.T) {
 	testutil.NotOk(t, err)
 	testutil.Equals(t, "unsupported relabel action: labelmap", err.Error())
 }
+
+func TestDeduplicateFilter_Policy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	newMetas := func() map[ulid.ULID]*metadata.Meta {
+		metas := map[ulid.ULID]*metadata.Meta{}
+		for _, m := range []struct {
+			id      ulid.ULID
+			sources []ulid.ULID
+			samples uint64
+			source  metadata.SourceType
+		}{
+			{id: ULID(1), sources: []ulid.ULID{ULID(1)}, samples: 10, source: metadata.SidecarSource},
+			{id: ULID(2), sources: []ulid.ULID{ULID(2)}, samples: 10, source: metadata.SidecarSource},
+			{id: ULID(3), sources: []ulid.ULID{ULID(1), ULID(2)}, samples: 20, source: metadata.CompactorSource},
+			{id: ULID(4), sources: []ulid.ULID{ULID(2), ULID(1)}, samples: 30, source: metadata.BucketRepairSource},
+			{id: ULID(5), sources: []ulid.ULID{ULID(1), ULID(2)}, samples: 20, source: metadata.CompactorSource},
+		} {
+			metas[m.id] = &metadata.Meta{
+				BlockMeta: tsdb.BlockMeta{
+					ULID:       m.id,
+					Compaction: tsdb.BlockMetaCompaction{Sources: m.sources},
+					Stats:      tsdb.BlockStats{NumSamples: m.samples},
+				},
+				Thanos: metadata.Thanos{Source: m.source},
+			}
+		}
+		return metas
+	}
+
+	for _, tcase := range []struct {
+		name     string
+		policy   DuplicatesPolicy
+		expected ulid.ULID
+	}{
+		{name: "prefer older ULID", policy: PreferOlderULID, expected: ULID(3)},
+		{name: "prefer newer ULID", policy: PreferNewerULID, expected: ULID(5)},
+		{name: "prefer larger block", policy: PreferLargerBlock, expected: ULID(4)},
+		{name: "prefer compactor source", policy: PreferSource(PreferNewerULID, metadata.CompactorSource), expected: ULID(5)},
+		{name: "prefer unknown source", policy: PreferSource(PreferOlderULID, metadata.ReceiveSource), expected: ULID(3)},
+	} {
+		if ok := t.Run(tcase.name, func(t *testing.T) {
+			m := newTestFetcherMetrics()
+			metas := newMetas()
+
+			f := NewDeduplicateFilterWithPolicy(tcase.policy)
+			testutil.Ok(t, f.Filter(ctx, metas, m.synced))
+			compareSliceWithMapKeys(t, metas, []ulid.ULID{tcase.expected})
+			testutil.Equals(t, 4, len(f.DuplicateIDs()))
+
+			root := f.Roots()[0]
+			testutil.Equals(t, 1, len(root.Children))
+			testutil.Equals(t, tcase.expected, root.Children[0].ULID)
+		}); !ok {
+			return
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// GatherFiles returns files of the block in the given directory which are uploaded by Upload, sorted by path: its chunk
+// segments, index and series filter, if any. Hashes of their content are computed if hash is true.
+func GatherFiles(bdir string, hash bool) ([]metadata.File, error) {
+	var relPaths []string
+	chunks, err := ioutil.ReadDir(filepath.Join(bdir, ChunksDirname))
+	if err != nil {
+		return nil, errors.Wrap(err, "read chunks dir")
+	}
+	for _, f := range chunks {
+		if !f.IsDir() {
+			relPaths = append(relPaths, path.Join(ChunksDirname, f.Name()))
+		}
+	}
+	relPaths = append(relPaths, IndexFilename)
+	if _, err := os.Stat(filepath.Join(bdir, SeriesFilterFilename)); err == nil {
+		relPaths = append(relPaths, SeriesFilterFilename)
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "stat series filter")
+	}
+
+	files := make([]metadata.File, 0, len(relPaths))
+	for _, rel := range relPaths {
+		f, err := statFile(bdir, rel, hash)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].RelPath < files[j].RelPath })
+	return files, nil
+}
+
+func statFile(bdir, relPath string, hash bool) (metadata.File, error) {
+	fn := filepath.Join(bdir, filepath.FromSlash(relPath))
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return metadata.File{}, errors.Wrapf(err, "stat %s", relPath)
+	}
+	f := metadata.File{RelPath: relPath, SizeBytes: fi.Size()}
+	if hash {
+		if f.Hash, err = hashFile(fn); err != nil {
+			return metadata.File{}, errors.Wrapf(err, "hash %s", relPath)
+		}
+	}
+	return f, nil
+}
+
+func hashFile(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyFiles returns error if any of the given files, as listed in meta.json, is missing in the block in the given
+// directory or has a different size. Hashes of files listed with one are verified as well if verifyHashes is true.
+func VerifyFiles(bdir string, files []metadata.File, verifyHashes bool) error {
+	for _, f := range files {
+		got, err := statFile(bdir, f.RelPath, verifyHashes && f.Hash != "")
+		if err != nil {
+			return err
+		}
+		if got.SizeBytes != f.SizeBytes {
+			return errors.Errorf("size of %s is %d bytes, %d listed in meta", f.RelPath, got.SizeBytes, f.SizeBytes)
+		}
+		if got.Hash != "" && got.Hash != f.Hash {
+			return errors.Errorf("hash of %s is %s, %s listed in meta", f.RelPath, got.Hash, f.Hash)
+		}
+	}
+	return nil
+}
+
+// objectHash returns the hash of the content of the given object, as computed by GatherFiles for local files.
+func objectHash(ctx context.Context, bkt objstore.BucketReader, name string) (_ string, err error) {
+	r, err := bkt.Get(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	defer runutil.CloseWithErrCapture(&err, r, "close object")
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// objectSizes returns sizes of the given files of the block with the given ID uploaded to the bucket, listing the block
+// first, so uploads of blocks not in the bucket yet ask for attributes of no object.
+func objectSizes(ctx context.Context, bkt objstore.Bucket, id ulid.ULID, relPaths []string) (map[string]int64, error) {
+	wanted := make(map[string]struct{}, len(relPaths))
+	for _, rel := range relPaths {
+		wanted[rel] = struct{}{}
+	}
+	var present []string
+	if err := listDirRec(ctx, bkt, id.String(), func(name string) {
+		rel := strings.TrimPrefix(name, id.String()+objstore.DirDelim)
+		if _, ok := wanted[rel]; ok {
+			present = append(present, rel)
+		}
+	}); err != nil {
+		return nil, errors.Wrap(err, "list block objects")
+	}
+
+	sizes := make(map[string]int64, len(present))
+	for _, rel := range present {
+		attrs, err := bkt.Attributes(ctx, path.Join(id.String(), rel))
+		if err != nil {
+			return nil, errors.Wrapf(err, "attributes of %s", rel)
+		}
+		sizes[rel] = attrs.Size
+	}
+	return sizes, nil
+}
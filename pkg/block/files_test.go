@@ -0,0 +1,103 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestGatherAndVerifyFiles(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "test-block-files")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{labels.FromStrings("a", "1")}, 100, 0, 1000, labels.FromStrings("ext1", "val1"), 124)
+	testutil.Ok(t, err)
+	bdir := filepath.Join(tmpDir, id.String())
+
+	files, err := GatherFiles(bdir, false)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(files))
+	for i, rel := range []string{"chunks/000001", IndexFilename} {
+		fi, err := os.Stat(filepath.Join(bdir, rel))
+		testutil.Ok(t, err)
+		testutil.Equals(t, metadata.File{RelPath: rel, SizeBytes: fi.Size()}, files[i])
+	}
+	testutil.Ok(t, VerifyFiles(bdir, files, true))
+
+	hashed, err := GatherFiles(bdir, true)
+	testutil.Ok(t, err)
+	for _, f := range hashed {
+		testutil.Equals(t, 64, len(f.Hash))
+	}
+	testutil.Ok(t, VerifyFiles(bdir, hashed, true))
+
+	// Same size with different content is caught by hashes only.
+	index, err := ioutil.ReadFile(filepath.Join(bdir, IndexFilename))
+	testutil.Ok(t, err)
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(bdir, IndexFilename), make([]byte, len(index)), 0600))
+	testutil.Ok(t, VerifyFiles(bdir, hashed, false))
+	testutil.NotOk(t, VerifyFiles(bdir, hashed, true))
+
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(bdir, IndexFilename), index[:10], 0600))
+	testutil.NotOk(t, VerifyFiles(bdir, files, false))
+	testutil.Ok(t, os.Remove(filepath.Join(bdir, IndexFilename)))
+	testutil.NotOk(t, VerifyFiles(bdir, files, false))
+}
+
+func TestUpload_Files(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "test-block-upload-files")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{labels.FromStrings("a", "1")}, 100, 0, 1000, labels.FromStrings("ext1", "val1"), 124)
+	testutil.Ok(t, err)
+	bdir := filepath.Join(tmpDir, id.String())
+
+	// Index left zero-filled by an interrupted upload has the listed size, but not the listed hash, so it is overwritten.
+	index, err := ioutil.ReadFile(filepath.Join(bdir, IndexFilename))
+	testutil.Ok(t, err)
+	leftover := make([]byte, len(index))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), IndexFilename), bytes.NewReader(leftover)))
+
+	before, err := ioutil.ReadFile(filepath.Join(bdir, MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, bdir, WithFileHashes(true)))
+	testutil.Equals(t, index, bkt.Objects()[path.Join(id.String(), IndexFilename)])
+
+	meta, err := DownloadMeta(ctx, log.NewNopLogger(), bkt, id)
+	testutil.Ok(t, err)
+	files, err := GatherFiles(bdir, true)
+	testutil.Ok(t, err)
+	testutil.Equals(t, files, meta.Thanos.Files)
+
+	// The local meta.json is left as it is, while a retried upload uploads the same meta.json.
+	after, err := ioutil.ReadFile(filepath.Join(bdir, MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Equals(t, before, after)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, bdir, WithFileHashes(true)))
+
+	// Without hashes, files of the same size are uploaded again as well.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), IndexFilename), bytes.NewReader(leftover)))
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(id.String(), MetaFilename)))
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, bdir))
+	testutil.Equals(t, index, bkt.Objects()[path.Join(id.String(), IndexFilename)])
+}
@@ -0,0 +1,218 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	commonmodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/extprom"
+	"github.com/thanos-io/thanos/pkg/model"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// MetadataFilterType is the type of MetadataFilter declared in the configuration parsed by NewMetadataFilters.
+type MetadataFilterType string
+
+// Types of MetadataFilter registered by default.
+const (
+	TimeRangeFilter          MetadataFilterType = "TIME_RANGE"
+	LabelSelectorFilter      MetadataFilterType = "LABEL_SELECTOR"
+	MinCompactionLevelFilter MetadataFilterType = "MIN_COMPACTION_LEVEL"
+	DeletionMarkFilter       MetadataFilterType = "DELETION_MARK"
+)
+
+// MetadataFilterConfig declares a single MetadataFilter of the given type with its type specific configuration.
+type MetadataFilterConfig struct {
+	Type   MetadataFilterType `yaml:"type"`
+	Config interface{}        `yaml:"config"`
+}
+
+// MetadataFilterFactory creates MetadataFilter from its type specific YAML configuration, e.g. registered for a custom
+// filter type with RegisterMetadataFilter. Filters reading markers of blocks can use the given bucket.
+type MetadataFilterFactory func(logger log.Logger, bkt objstore.InstrumentedBucketReader, reg prometheus.Registerer, conf []byte) (MetadataFilter, error)
+
+var (
+	filterFactoriesMtx sync.RWMutex
+	filterFactories    = map[MetadataFilterType]MetadataFilterFactory{
+		TimeRangeFilter:          newTimeRangeFilterFromConfig,
+		LabelSelectorFilter:      newLabelSelectorFilterFromConfig,
+		MinCompactionLevelFilter: newMinCompactionLevelFilterFromConfig,
+		DeletionMarkFilter:       newDeletionMarkFilterFromConfig,
+	}
+)
+
+// RegisterMetadataFilter makes MetadataFilter of the given type available to NewMetadataFilters, so binaries can offer
+// custom filters in the same configuration as the built-in ones. It panics if the type is already registered.
+func RegisterMetadataFilter(typ MetadataFilterType, f MetadataFilterFactory) {
+	filterFactoriesMtx.Lock()
+	defer filterFactoriesMtx.Unlock()
+
+	typ = MetadataFilterType(strings.ToUpper(string(typ)))
+	if _, ok := filterFactories[typ]; ok {
+		panic("metadata filter " + string(typ) + " already registered")
+	}
+	filterFactories[typ] = f
+}
+
+// NewMetadataFilters parses the given YAML list of MetadataFilterConfig and returns the declared filters in the same
+// order. Empty configuration yields no filters.
+func NewMetadataFilters(logger log.Logger, bkt objstore.InstrumentedBucketReader, reg prometheus.Registerer, confContentYaml []byte) ([]MetadataFilter, error) {
+	var confs []MetadataFilterConfig
+	if err := yaml.UnmarshalStrict(confContentYaml, &confs); err != nil {
+		return nil, errors.Wrap(err, "parsing metadata filters config YAML")
+	}
+
+	filterFactoriesMtx.RLock()
+	defer filterFactoriesMtx.RUnlock()
+
+	filters := make([]MetadataFilter, 0, len(confs))
+	for i, c := range confs {
+		f, ok := filterFactories[MetadataFilterType(strings.ToUpper(string(c.Type)))]
+		if !ok {
+			return nil, errors.Errorf("metadata filter %d: type %q is not supported", i, c.Type)
+		}
+		conf, err := yaml.Marshal(c.Config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "metadata filter %d: marshal %s config", i, c.Type)
+		}
+		filter, err := f(logger, bkt, reg, conf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "metadata filter %d: create %s filter", i, c.Type)
+		}
+		level.Info(logger).Log("msg", "configured metadata filter", "type", c.Type)
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+type timeRangeFilterConfig struct {
+	MinTime string `yaml:"min_time"`
+	MaxTime string `yaml:"max_time"`
+}
+
+func newTimeRangeFilterFromConfig(_ log.Logger, _ objstore.InstrumentedBucketReader, _ prometheus.Registerer, conf []byte) (MetadataFilter, error) {
+	c := timeRangeFilterConfig{MinTime: "0000-01-01T00:00:00Z", MaxTime: "9999-12-31T23:59:59Z"}
+	if err := yaml.UnmarshalStrict(conf, &c); err != nil {
+		return nil, err
+	}
+	var minTime, maxTime model.TimeOrDurationValue
+	if err := minTime.Set(c.MinTime); err != nil {
+		return nil, errors.Wrap(err, "parse min_time")
+	}
+	if err := maxTime.Set(c.MaxTime); err != nil {
+		return nil, errors.Wrap(err, "parse max_time")
+	}
+	return NewTimePartitionMetaFilter(minTime, maxTime), nil
+}
+
+type labelSelectorFilterConfig struct {
+	Matchers string `yaml:"matchers"`
+}
+
+func newLabelSelectorFilterFromConfig(_ log.Logger, _ objstore.InstrumentedBucketReader, _ prometheus.Registerer, conf []byte) (MetadataFilter, error) {
+	var c labelSelectorFilterConfig
+	if err := yaml.UnmarshalStrict(conf, &c); err != nil {
+		return nil, err
+	}
+	matchers, err := parser.ParseMetricSelector(c.Matchers)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse matchers")
+	}
+	return NewLabelSelectorMetaFilter(matchers), nil
+}
+
+type minCompactionLevelFilterConfig struct {
+	Level int `yaml:"level"`
+}
+
+func newMinCompactionLevelFilterFromConfig(_ log.Logger, _ objstore.InstrumentedBucketReader, _ prometheus.Registerer, conf []byte) (MetadataFilter, error) {
+	var c minCompactionLevelFilterConfig
+	if err := yaml.UnmarshalStrict(conf, &c); err != nil {
+		return nil, err
+	}
+	if c.Level < 1 {
+		return nil, errors.Errorf("level has to be at least 1, got %d", c.Level)
+	}
+	return NewMinCompactionLevelMetaFilter(c.Level), nil
+}
+
+type deletionMarkFilterConfig struct {
+	Delay commonmodel.Duration `yaml:"delay"`
+}
+
+func newDeletionMarkFilterFromConfig(logger log.Logger, bkt objstore.InstrumentedBucketReader, _ prometheus.Registerer, conf []byte) (MetadataFilter, error) {
+	var c deletionMarkFilterConfig
+	if err := yaml.UnmarshalStrict(conf, &c); err != nil {
+		return nil, err
+	}
+	return NewIgnoreDeletionMarkFilter(logger, bkt, time.Duration(c.Delay)), nil
+}
+
+var _ MetadataFilter = &LabelSelectorMetaFilter{}
+
+// LabelSelectorMetaFilter is a MetadataFilter that filters out blocks whose external labels do not match all of the
+// given matchers. Missing labels match as empty ones.
+// Not go-routine safe.
+type LabelSelectorMetaFilter struct {
+	matchers []*labels.Matcher
+}
+
+// NewLabelSelectorMetaFilter creates LabelSelectorMetaFilter.
+func NewLabelSelectorMetaFilter(matchers []*labels.Matcher) *LabelSelectorMetaFilter {
+	return &LabelSelectorMetaFilter{matchers: matchers}
+}
+
+// Filter filters out blocks whose external labels do not match.
+func (f *LabelSelectorMetaFilter) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
+	for id, m := range metas {
+		for _, matcher := range f.matchers {
+			if matcher.Matches(m.Thanos.Labels[matcher.Name]) {
+				continue
+			}
+			synced.WithLabelValues(labelExcludedMeta).Inc()
+			delete(metas, id)
+			break
+		}
+	}
+	return nil
+}
+
+var _ MetadataFilter = &MinCompactionLevelMetaFilter{}
+
+// MinCompactionLevelMetaFilter is a MetadataFilter that filters out blocks of compaction level lower than the given one.
+// Not go-routine safe.
+type MinCompactionLevelMetaFilter struct {
+	level int
+}
+
+// NewMinCompactionLevelMetaFilter creates MinCompactionLevelMetaFilter.
+func NewMinCompactionLevelMetaFilter(level int) *MinCompactionLevelMetaFilter {
+	return &MinCompactionLevelMetaFilter{level: level}
+}
+
+// Filter filters out blocks of too low compaction level.
+func (f *MinCompactionLevelMetaFilter) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
+	for id, m := range metas {
+		if m.Compaction.Level >= f.level {
+			continue
+		}
+		synced.WithLabelValues(levelExcludedMeta).Inc()
+		delete(metas, id)
+	}
+	return nil
+}
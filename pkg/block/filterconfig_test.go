@@ -0,0 +1,109 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/extprom"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+type ulidDropFilter struct {
+	id ulid.ULID
+}
+
+func (f ulidDropFilter) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, _ *extprom.TxGaugeVec) error {
+	delete(metas, f.id)
+	return nil
+}
+
+func TestNewMetadataFilters(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+
+	RegisterMetadataFilter("test_drop_block", func(_ log.Logger, _ objstore.InstrumentedBucketReader, _ prometheus.Registerer, conf []byte) (MetadataFilter, error) {
+		return ulidDropFilter{id: ULID(6)}, nil
+	})
+
+	newMeta := func(id ulid.ULID, minTime, maxTime int64, level int, lset map[string]string) *metadata.Meta {
+		return &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: id, MinTime: minTime, MaxTime: maxTime, Compaction: tsdb.BlockMetaCompaction{Level: level}},
+			Thanos:    metadata.Thanos{Labels: lset},
+		}
+	}
+	input := map[ulid.ULID]*metadata.Meta{
+		// Too old.
+		ULID(1): newMeta(ULID(1), 0, 1000, 2, map[string]string{"cluster": "eu-1"}),
+		// Not selected by labels.
+		ULID(2): newMeta(ULID(2), 100000, 200000, 2, map[string]string{"cluster": "us-1"}),
+		ULID(3): newMeta(ULID(3), 100000, 200000, 2, map[string]string{"cluster": "eu-1", "env": "dev"}),
+		// Too low compaction level.
+		ULID(4): newMeta(ULID(4), 100000, 200000, 1, map[string]string{"cluster": "eu-2"}),
+		// Marked for deletion long ago.
+		ULID(5): newMeta(ULID(5), 100000, 200000, 3, map[string]string{"cluster": "eu-2"}),
+		// Dropped by the custom filter.
+		ULID(6): newMeta(ULID(6), 100000, 200000, 3, map[string]string{"cluster": "eu-2"}),
+		ULID(7): newMeta(ULID(7), 100000, 200000, 3, map[string]string{"cluster": "eu-2"}),
+	}
+	mark, err := json.Marshal(metadata.DeletionMark{ID: ULID(5), DeletionTime: time.Now().Add(-48 * time.Hour).Unix(), Version: metadata.DeletionMarkVersion1})
+	testutil.Ok(t, err)
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ULID(5).String(), metadata.DeletionMarkFilename), bytes.NewReader(mark)))
+
+	filters, err := NewMetadataFilters(log.NewNopLogger(), bkt, nil, []byte(`
+- type: TIME_RANGE
+  config:
+    min_time: 1970-01-01T00:01:00Z
+- type: label_selector
+  config:
+    matchers: '{cluster=~"eu-.*", env=""}'
+- type: MIN_COMPACTION_LEVEL
+  config:
+    level: 2
+- type: DELETION_MARK
+  config:
+    delay: 24h
+- type: TEST_DROP_BLOCK
+`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 5, len(filters))
+
+	m := newTestFetcherMetrics()
+	for _, f := range filters {
+		testutil.Ok(t, f.Filter(ctx, input, m.synced))
+	}
+	testutil.Equals(t, map[ulid.ULID]*metadata.Meta{ULID(7): input[ULID(7)]}, input)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.synced.WithLabelValues(timeExcludedMeta)))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(m.synced.WithLabelValues(labelExcludedMeta)))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.synced.WithLabelValues(levelExcludedMeta)))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.synced.WithLabelValues(markedForDeletionMeta)))
+
+	filters, err = NewMetadataFilters(log.NewNopLogger(), bkt, nil, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(filters))
+
+	for _, conf := range []string{
+		"- type: UNKNOWN",
+		"- type: MIN_COMPACTION_LEVEL\n  config:\n    level: 0",
+		"- type: LABEL_SELECTOR\n  config:\n    matchers: '{cluster='",
+		"- type: TIME_RANGE\n  config:\n    min_time: yesterday",
+		"- type: DELETION_MARK\n  config:\n    unknown: 1h",
+	} {
+		_, err := NewMetadataFilters(log.NewNopLogger(), bkt, nil, []byte(conf))
+		testutil.NotOk(t, err, conf)
+	}
+}
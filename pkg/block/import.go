@@ -0,0 +1,223 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/tombstones"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// ImportConfig configures import of foreign TSDB blocks by ImportBlock.
+type ImportConfig struct {
+	// Labels are external labels of the imported blocks. They are required, as for any Thanos block.
+	Labels map[string]string
+	// SplitRange, if non-zero, splits a block crossing boundaries of aligned time ranges of this size in milliseconds
+	// into a block per range, e.g. so imported blocks are aligned with compaction ranges of the compactor.
+	SplitRange int64
+}
+
+// ImportBlock validates the Prometheus TSDB block in the given directory, adapts it to a Thanos block and uploads it,
+// making backfilled or migrated data first-class blocks of the bucket. It returns IDs of the uploaded blocks.
+//
+// The block is staged in the given work directory, so the source block is never modified. Downsampled blocks and blocks
+// with critical index issues are rejected, while index with unsorted symbols or series, as written by some third-party
+// TSDB writers, is normalized. Blocks with tombstones or crossing boundaries of the configured split range are
+// rewritten, applying the tombstones and splitting them into aligned blocks; rewritten blocks get new IDs and list the
+// source block as their parent. Blocks are uploaded with Upload, so failed uploads are cleaned up and importing the
+// same unsplit block again is a no-op.
+func ImportBlock(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir, workDir string, conf ImportConfig, opts ...UploadOption) (_ []ulid.ULID, err error) {
+	if len(conf.Labels) == 0 {
+		return nil, errors.New("external labels of imported block are required")
+	}
+	id, ok := IsBlockDir(bdir)
+	if !ok {
+		return nil, errors.Errorf("%s is not a block directory", bdir)
+	}
+	meta, err := metadata.Read(bdir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read meta")
+	}
+	if meta.ULID != id {
+		return nil, errors.Errorf("meta of block %s has ID %s", id, meta.ULID)
+	}
+	if meta.MinTime >= meta.MaxTime {
+		return nil, errors.Errorf("invalid time range [%d, %d) of block %s", meta.MinTime, meta.MaxTime, id)
+	}
+	if meta.Thanos.Downsample.Resolution != 0 {
+		return nil, errors.Errorf("block %s is downsampled; only raw blocks can be imported", id)
+	}
+
+	stats, err := GatherIndexIssueStats(logger, filepath.Join(bdir, IndexFilename), meta.MinTime, meta.MaxTime)
+	if err != nil {
+		return nil, errors.Wrap(err, "gather index issues")
+	}
+	if err := stats.CriticalErr(); err != nil {
+		return nil, errors.Wrapf(err, "block %s has critical index issues", id)
+	}
+	if err := stats.PrometheusIssue5372Err(); err != nil {
+		return nil, errors.Wrapf(err, "block %s has index issues", id)
+	}
+	tombs, _, err := tombstones.ReadTombstones(bdir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read tombstones")
+	}
+
+	staged := filepath.Join(workDir, id.String())
+	if err := os.RemoveAll(staged); err != nil {
+		return nil, errors.Wrap(err, "clean staging dir")
+	}
+	defer func() {
+		if rerr := os.RemoveAll(staged); rerr != nil {
+			level.Warn(logger).Log("msg", "failed to remove staging dir", "dir", staged, "err", rerr)
+		}
+	}()
+	if err := linkBlock(bdir, staged); err != nil {
+		return nil, errors.Wrap(err, "stage block")
+	}
+	if stats.UnsortedIndexErr() != nil || stats.DuplicateSeriesErr() != nil {
+		if _, err := NormalizeIndex(logger, staged); err != nil {
+			return nil, errors.Wrap(err, "normalize index")
+		}
+	}
+
+	dirs := []string{staged}
+	if ranges := splitRanges(meta.MinTime, meta.MaxTime, conf.SplitRange); len(ranges) > 1 || tombs.Total() > 0 {
+		dirs, err = rewriteImported(ctx, logger, staged, workDir, &meta.BlockMeta, ranges)
+		if err != nil {
+			return nil, errors.Wrap(err, "rewrite block")
+		}
+		defer func() {
+			for _, dir := range dirs {
+				if rerr := os.RemoveAll(dir); rerr != nil {
+					level.Warn(logger).Log("msg", "failed to remove rewritten block dir", "dir", dir, "err", rerr)
+				}
+			}
+		}()
+	}
+
+	ids := make([]ulid.ULID, 0, len(dirs))
+	for _, dir := range dirs {
+		m, err := metadata.InjectThanos(logger, dir, metadata.Thanos{
+			Labels:     conf.Labels,
+			Downsample: metadata.ThanosDownsample{Resolution: 0},
+			Source:     metadata.ImportSource,
+		}, nil)
+		if err != nil {
+			return ids, errors.Wrap(err, "inject thanos meta")
+		}
+		if err := Upload(ctx, logger, bkt, dir, opts...); err != nil {
+			return ids, errors.Wrapf(err, "upload block %s", m.ULID)
+		}
+		level.Info(logger).Log("msg", "imported block", "block", m.ULID, "source", id, "mint", m.MinTime, "maxt", m.MaxTime)
+		ids = append(ids, m.ULID)
+	}
+	return ids, nil
+}
+
+// splitRanges returns time ranges of the block within aligned ranges of the given size, or the whole block time range
+// if size is zero.
+func splitRanges(mint, maxt, size int64) [][2]int64 {
+	if size <= 0 {
+		return [][2]int64{{mint, maxt}}
+	}
+	var ranges [][2]int64
+	for start := mint; start < maxt; {
+		end := (start/size + 1) * size
+		if start < 0 && start%size != 0 {
+			end -= size
+		}
+		if end > maxt {
+			end = maxt
+		}
+		ranges = append(ranges, [2]int64{start, end})
+		start = end
+	}
+	return ranges
+}
+
+// rewriteImported writes a block for each of the given time ranges of the block in the given directory into dest,
+// applying its tombstones, and returns their directories. Ranges without samples are skipped.
+func rewriteImported(ctx context.Context, logger log.Logger, bdir, dest string, parent *tsdb.BlockMeta, ranges [][2]int64) (dirs []string, err error) {
+	b, err := tsdb.OpenBlock(logger, bdir, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "open block")
+	}
+	defer runutil.CloseWithErrCapture(&err, b, "close imported block")
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, nil, logger, []int64{parent.MaxTime - parent.MinTime}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create compactor")
+	}
+	for _, r := range ranges {
+		id, err := comp.Write(dest, b, r[0], r[1], parent)
+		if err != nil {
+			return dirs, errors.Wrapf(err, "write block of range [%d, %d)", r[0], r[1])
+		}
+		if id == (ulid.ULID{}) {
+			continue
+		}
+		dirs = append(dirs, filepath.Join(dest, id.String()))
+	}
+	return dirs, nil
+}
+
+// linkBlock hard links files of the block in src to dst, copying them if they cannot be linked, e.g. because dst is
+// on another file system.
+func linkBlock(src, dst string) error {
+	if err := os.MkdirAll(filepath.Join(dst, ChunksDirname), os.ModePerm); err != nil {
+		return errors.Wrap(err, "create chunks dir")
+	}
+	fis, err := ioutil.ReadDir(filepath.Join(src, ChunksDirname))
+	if err != nil {
+		return errors.Wrap(err, "read chunks dir")
+	}
+	files := []string{MetaFilename, IndexFilename}
+	for _, fi := range fis {
+		files = append(files, filepath.Join(ChunksDirname, fi.Name()))
+	}
+	if _, err := os.Stat(filepath.Join(src, tombstones.TombstonesFilename)); err == nil {
+		files = append(files, tombstones.TombstonesFilename)
+	}
+
+	for _, fn := range files {
+		if err := os.Link(filepath.Join(src, fn), filepath.Join(dst, fn)); err == nil {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, fn), filepath.Join(dst, fn)); err != nil {
+			return errors.Wrapf(err, "copy file %s", fn)
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) (err error) {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer runutil.CloseWithErrCapture(&err, r, "close source file")
+
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer runutil.CloseWithErrCapture(&err, w, "close destination file")
+
+	_, err = io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,108 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestImportBlock(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-import")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+	workDir := filepath.Join(tmpDir, "work")
+	testutil.Ok(t, os.MkdirAll(workDir, os.ModePerm))
+
+	series := []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+		{{Name: "b", Value: "1"}},
+	}
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, series, 300, 0, 3000, labels.Labels{{Name: "ext1", Value: "val1"}}, 0)
+	testutil.Ok(t, err)
+	bdir := filepath.Join(tmpDir, id.String())
+	orig, err := metadata.Read(bdir)
+	testutil.Ok(t, err)
+
+	extLabels := map[string]string{"cluster": "imported"}
+
+	t.Run("whole block", func(t *testing.T) {
+		bkt := objstore.NewInMemBucket()
+		ids, err := ImportBlock(ctx, logger, bkt, bdir, workDir, ImportConfig{Labels: extLabels})
+		testutil.Ok(t, err)
+		testutil.Equals(t, []ulid.ULID{id}, ids)
+
+		m, err := DownloadMeta(ctx, logger, bkt, id)
+		testutil.Ok(t, err)
+		testutil.Equals(t, extLabels, m.Thanos.Labels)
+		testutil.Equals(t, metadata.ImportSource, m.Thanos.Source)
+		testutil.Equals(t, orig.Stats, m.Stats)
+
+		// Importing the same block again is a no-op.
+		ids, err = ImportBlock(ctx, logger, bkt, bdir, workDir, ImportConfig{Labels: extLabels})
+		testutil.Ok(t, err)
+		testutil.Equals(t, []ulid.ULID{id}, ids)
+	})
+
+	t.Run("split block", func(t *testing.T) {
+		bkt := objstore.NewInMemBucket()
+		ids, err := ImportBlock(ctx, logger, bkt, bdir, workDir, ImportConfig{Labels: extLabels, SplitRange: 1000})
+		testutil.Ok(t, err)
+		testutil.Equals(t, 3, len(ids))
+
+		var samples uint64
+		for i, bid := range ids {
+			m, err := DownloadMeta(ctx, logger, bkt, bid)
+			testutil.Ok(t, err)
+			testutil.Equals(t, int64(i)*1000, m.MinTime)
+			testutil.Equals(t, int64(i+1)*1000, m.MaxTime)
+			testutil.Equals(t, extLabels, m.Thanos.Labels)
+			testutil.Equals(t, metadata.ImportSource, m.Thanos.Source)
+			testutil.Equals(t, 1, len(m.Compaction.Parents))
+			testutil.Equals(t, id, m.Compaction.Parents[0].ULID)
+			samples += m.Stats.NumSamples
+		}
+		testutil.Equals(t, orig.Stats.NumSamples, samples)
+	})
+
+	// Source block is never modified.
+	m, err := metadata.Read(bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, orig, m)
+	// Staged and rewritten blocks are removed.
+	fis, err := ioutil.ReadDir(workDir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(fis))
+
+	t.Run("invalid", func(t *testing.T) {
+		bkt := objstore.NewInMemBucket()
+		_, err := ImportBlock(ctx, logger, bkt, bdir, workDir, ImportConfig{})
+		testutil.NotOk(t, err)
+
+		downsampled, err := e2eutil.CreateBlock(ctx, tmpDir, series, 10, 0, 3000, labels.Labels{{Name: "ext1", Value: "val1"}}, 300000)
+		testutil.Ok(t, err)
+		_, err = ImportBlock(ctx, logger, bkt, filepath.Join(tmpDir, downsampled.String()), workDir, ImportConfig{Labels: extLabels})
+		testutil.NotOk(t, err)
+
+		_, err = ImportBlock(ctx, logger, bkt, workDir, workDir, ImportConfig{Labels: extLabels})
+		testutil.NotOk(t, err)
+		testutil.Equals(t, 0, len(bkt.Objects()))
+	})
+}
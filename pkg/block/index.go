@@ -60,6 +60,34 @@ type Stats struct {
 	// OutOfOrderLabels represents the number of postings that contained out
 	// of order labels, a bug present in Prometheus 2.8.0 and below.
 	OutOfOrderLabels int
+
+	// UnsortedSymbols represents the number of symbols that are not greater than the previous one in the symbol table.
+	// Prometheus writes sorted and unique symbols, but some third-party TSDB writers do not.
+	UnsortedSymbols int
+	// UnsortedSeries represents the number of series from the all postings list whose labels are lower than labels of
+	// the previous series.
+	UnsortedSeries int
+	// DuplicateSeries represents the number of series from the all postings list with the same labels as the previous
+	// series, which upstream bugs of some TSDB writers produce.
+	DuplicateSeries int
+}
+
+// DuplicateSeriesErr returns error if stats indicates series with the same labels. Such blocks can be fixed with
+// MergeDuplicateSeries, or with NormalizeIndex if chunks of the duplicates do not overlap.
+func (i Stats) DuplicateSeriesErr() error {
+	if i.DuplicateSeries > 0 {
+		return errors.Errorf("index contains %d series with the same labels as the previous series", i.DuplicateSeries)
+	}
+	return nil
+}
+
+// UnsortedIndexErr returns error if stats indicates symbols or series violating the sort order assumed by compaction.
+// Such blocks can be fixed with NormalizeIndex.
+func (i Stats) UnsortedIndexErr() error {
+	if i.UnsortedSymbols > 0 || i.UnsortedSeries > 0 {
+		return errors.Errorf("index contains %d unsorted symbols and %d unsorted series", i.UnsortedSymbols, i.UnsortedSeries)
+	}
+	return nil
 }
 
 // PrometheusIssue5372Err returns an error if the Stats object indicates
@@ -128,6 +156,14 @@ func (i Stats) AnyErr() error {
 		errMsg = append(errMsg, err.Error())
 	}
 
+	if err := i.UnsortedIndexErr(); err != nil {
+		errMsg = append(errMsg, err.Error())
+	}
+
+	if err := i.DuplicateSeriesErr(); err != nil {
+		errMsg = append(errMsg, err.Error())
+	}
+
 	if len(errMsg) > 0 {
 		return errors.New(strings.Join(errMsg, ", "))
 	}
@@ -140,12 +176,23 @@ func (i Stats) AnyErr() error {
 // It considers https://github.com/prometheus/tsdb/issues/347 as something that Thanos can handle.
 // See Stats.Issue347OutsideChunks for details.
 func GatherIndexIssueStats(logger log.Logger, fn string, minTime int64, maxTime int64) (stats Stats, err error) {
-	r, err := index.NewFileReader(fn)
+	r, err := openIndexReader(fn)
 	if err != nil {
 		return stats, errors.Wrap(err, "open index file")
 	}
 	defer runutil.CloseWithErrCapture(&err, r, "gather index issue file reader")
 
+	symbols := r.Symbols()
+	for prev, first := "", true; symbols.Next(); first = false {
+		if !first && symbols.At() <= prev {
+			stats.UnsortedSymbols++
+		}
+		prev = symbols.At()
+	}
+	if symbols.Err() != nil {
+		return stats, errors.Wrap(symbols.Err(), "iterate symbols")
+	}
+
 	p, err := r.Postings(index.AllPostingsKey())
 	if err != nil {
 		return stats, errors.Wrap(err, "get all postings")
@@ -169,8 +216,13 @@ func GatherIndexIssueStats(logger log.Logger, fn string, minTime int64, maxTime
 		if len(lset) == 0 {
 			return stats, errors.Errorf("empty label set detected for series %d", id)
 		}
-		if lastLset != nil && labels.Compare(lastLset, lset) >= 0 {
-			return stats, errors.Errorf("series %v out of order; previous %v", lset, lastLset)
+		if lastLset != nil {
+			switch c := labels.Compare(lastLset, lset); {
+			case c == 0:
+				stats.DuplicateSeries++
+			case c > 0:
+				stats.UnsortedSeries++
+			}
 		}
 		l0 := lset[0]
 		for _, l := range lset[1:] {
@@ -188,9 +240,8 @@ func GatherIndexIssueStats(logger log.Logger, fn string, minTime int64, maxTime
 			return stats, errors.Errorf("empty chunks for series %d", id)
 		}
 
-		ooo := 0
 		// Per chunk in series.
-		for i, c := range chks {
+		for _, c := range chks {
 			// Chunk vs the block ranges.
 			if c.MinTime < minTime || c.MaxTime > maxTime {
 				stats.OutsideChunks++
@@ -200,28 +251,10 @@ func GatherIndexIssueStats(logger log.Logger, fn string, minTime int64, maxTime
 					stats.Issue347OutsideChunks++
 				}
 			}
-
-			if i == 0 {
-				continue
-			}
-
-			c0 := chks[i-1]
-
-			// Chunk order within block.
-			if c.MinTime > c0.MaxTime {
-				continue
-			}
-
-			if c.MinTime == c0.MinTime && c.MaxTime == c0.MaxTime {
-				// TODO(bplotka): Calc and check checksum from chunks itself.
-				// The chunks can overlap 1:1 in time, but does not have same data.
-				// We assume same data for simplicity, but it can be a symptom of error.
-				stats.DuplicatedChunks++
-				continue
-			}
-			// Chunks partly overlaps or out of order.
-			ooo++
 		}
+
+		ooo, duplicated := outOfOrderChunks(chks)
+		stats.DuplicatedChunks += duplicated
 		if ooo > 0 {
 			stats.OutOfOrderSeries++
 			stats.OutOfOrderChunks += ooo
@@ -234,6 +267,96 @@ func GatherIndexIssueStats(logger log.Logger, fn string, minTime int64, maxTime
 	return stats, nil
 }
 
+// outOfOrderChunks returns number of chunks that partly overlap or are out of order with the previous chunk as well as
+// number of chunks with exactly the same time range as the previous chunk (potential duplicates).
+func outOfOrderChunks(chks []chunks.Meta) (ooo int, duplicated int) {
+	for i := 1; i < len(chks); i++ {
+		c, c0 := chks[i], chks[i-1]
+
+		// Chunk order within block.
+		if c.MinTime > c0.MaxTime {
+			continue
+		}
+
+		if c.MinTime == c0.MinTime && c.MaxTime == c0.MaxTime {
+			// TODO(bplotka): Calc and check checksum from chunks itself.
+			// The chunks can overlap 1:1 in time, but does not have same data.
+			// We assume same data for simplicity, but it can be a symptom of error.
+			duplicated++
+			continue
+		}
+		// Chunks partly overlaps or out of order.
+		ooo++
+	}
+	return ooo, duplicated
+}
+
+// OutOfOrderSeriesReport describes series that were dropped from a block because of out-of-order chunks.
+type OutOfOrderSeriesReport struct {
+	// Series is the number of dropped series.
+	Series int `json:"series"`
+	// Chunks is the number of out-of-order chunks across all dropped series.
+	Chunks int `json:"chunks"`
+	// Examples contains up to MaxOutOfOrderSeriesExamples label sets of dropped series.
+	Examples []labels.Labels `json:"examples"`
+}
+
+// MaxOutOfOrderSeriesExamples is the maximum number of example series recorded in OutOfOrderSeriesReport.
+const MaxOutOfOrderSeriesExamples = 10
+
+// DropOutOfOrderSeries rewrites the block in the given directory in place, skipping series that have out-of-order chunks.
+// Block ID and compaction metadata stay the same, only the index, chunks and stats are rewritten.
+// It is a no-op if no series has out-of-order chunks.
+func DropOutOfOrderSeries(logger log.Logger, bdir string) (report OutOfOrderSeriesReport, err error) {
+	_, err = rewriteInPlace(logger, bdir, func(indexr tsdb.IndexReader, chunkr tsdb.ChunkReader, indexw tsdb.IndexWriter, chunkw tsdb.ChunkWriter, meta *metadata.Meta) (bool, error) {
+		symbols := indexr.Symbols()
+		for symbols.Next() {
+			if err := indexw.AddSymbol(symbols.At()); err != nil {
+				return false, errors.Wrap(err, "add symbol")
+			}
+		}
+		if symbols.Err() != nil {
+			return false, errors.Wrap(symbols.Err(), "next symbol")
+		}
+
+		all, err := indexr.Postings(index.AllPostingsKey())
+		if err != nil {
+			return false, errors.Wrap(err, "postings")
+		}
+		all = indexr.SortedPostings(all)
+
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+			i    = uint64(0)
+		)
+		for all.Next() {
+			if err := indexr.Series(all.At(), &lset, &chks); err != nil {
+				return false, errors.Wrap(err, "series")
+			}
+
+			if ooo, _ := outOfOrderChunks(chks); ooo > 0 {
+				report.Series++
+				report.Chunks += ooo
+				if len(report.Examples) < MaxOutOfOrderSeriesExamples {
+					report.Examples = append(report.Examples, lset.Copy())
+				}
+				continue
+			}
+
+			if err := writeSeries(indexw, chunkr, chunkw, meta, i, lset, chks); err != nil {
+				return false, err
+			}
+			i++
+		}
+		if all.Err() != nil {
+			return false, errors.Wrap(all.Err(), "iterate series")
+		}
+		return report.Series > 0, nil
+	})
+	return report, err
+}
+
 type ignoreFnType func(mint, maxt int64, prev *chunks.Meta, curr *chunks.Meta) (bool, error)
 
 // Repair open the block with given id in dir and creates a new one with fixed data.
@@ -297,7 +420,8 @@ func Repair(logger log.Logger, dir string, id ulid.ULID, source metadata.SourceT
 	resmeta := *meta
 	resmeta.ULID = resid
 	resmeta.Stats = tsdb.BlockStats{} // Reset stats.
-	resmeta.Thanos.Source = source    // Update source.
+	resmeta.Thanos.Provenance = meta.Thanos.IngestionSources()
+	resmeta.Thanos.Source = source // Update source.
 
 	if err := rewrite(logger, indexr, chunkr, indexw, chunkw, &resmeta, ignoreChkFns); err != nil {
 		return resid, errors.Wrap(err, "rewrite block")
@@ -13,6 +13,7 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/prometheus/tsdb/chunks"
 	"github.com/prometheus/prometheus/tsdb/index"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
@@ -85,3 +86,74 @@ func TestRewrite(t *testing.T) {
 	}
 
 }
+
+func TestDropOutOfOrderSeries(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-drop-ooo-series")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	chunk := func(mint, maxt int64) chunks.Meta {
+		c := chunkenc.NewXORChunk()
+		app, err := c.Appender()
+		testutil.Ok(t, err)
+		app.Append(mint, 1)
+		app.Append(maxt, 2)
+		return chunks.Meta{MinTime: mint, MaxTime: maxt, Chunk: c}
+	}
+
+	m := &metadata.Meta{
+		BlockMeta: tsdb.BlockMeta{ULID: ULID(1), MinTime: 0, MaxTime: 1000, Version: metadata.MetaVersion1},
+		Thanos:    metadata.Thanos{Labels: map[string]string{"ext": "1"}},
+	}
+	bdir := filepath.Join(tmpDir, m.ULID.String())
+	testutil.Ok(t, os.MkdirAll(bdir, os.ModePerm))
+
+	iw, err := index.NewWriter(ctx, filepath.Join(bdir, IndexFilename))
+	testutil.Ok(t, err)
+	cw, err := chunks.NewWriter(filepath.Join(bdir, ChunksDirname))
+	testutil.Ok(t, err)
+
+	for _, s := range []string{"1", "2", "3", "a"} {
+		testutil.Ok(t, iw.AddSymbol(s))
+	}
+	series := []struct {
+		lset labels.Labels
+		chks []chunks.Meta
+	}{
+		{lset: labels.FromStrings("a", "1"), chks: []chunks.Meta{chunk(0, 100), chunk(101, 200)}},
+		{lset: labels.FromStrings("a", "2"), chks: []chunks.Meta{chunk(0, 100), chunk(50, 200), chunk(150, 300)}},
+		{lset: labels.FromStrings("a", "3"), chks: []chunks.Meta{chunk(0, 100), chunk(0, 100)}},
+	}
+	for i, s := range series {
+		testutil.Ok(t, cw.WriteChunks(s.chks...))
+		testutil.Ok(t, iw.AddSeries(uint64(i), s.lset, s.chks...))
+	}
+	testutil.Ok(t, iw.Close())
+	testutil.Ok(t, cw.Close())
+	testutil.Ok(t, metadata.Write(log.NewNopLogger(), bdir, m))
+
+	report, err := DropOutOfOrderSeries(log.NewNopLogger(), bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, report.Series)
+	testutil.Equals(t, 2, report.Chunks)
+	testutil.Equals(t, []labels.Labels{labels.FromStrings("a", "2")}, report.Examples)
+
+	stats, err := GatherIndexIssueStats(log.NewNopLogger(), filepath.Join(bdir, IndexFilename), m.MinTime, m.MaxTime)
+	testutil.Ok(t, err)
+	testutil.Ok(t, stats.CriticalErr())
+	testutil.Equals(t, 2, stats.TotalSeries)
+
+	newMeta, err := metadata.Read(bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, m.ULID, newMeta.ULID)
+	testutil.Equals(t, uint64(2), newMeta.Stats.NumSeries)
+	testutil.Equals(t, uint64(4), newMeta.Stats.NumChunks)
+	testutil.Equals(t, uint64(8), newMeta.Stats.NumSamples)
+
+	// Second run is a no-op.
+	report, err = DropOutOfOrderSeries(log.NewNopLogger(), bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, report.Series)
+}
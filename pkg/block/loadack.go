@@ -0,0 +1,42 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// UploadLoadAck acknowledges that the store gateway with the given ID loaded the given blocks, replacing its previous
+// acknowledgement.
+func UploadLoadAck(ctx context.Context, bkt objstore.Bucket, id string, blocks []ulid.ULID) error {
+	ack := metadata.LoadAck{
+		ID:        id,
+		UpdatedAt: time.Now().Unix(),
+		Blocks:    append([]ulid.ULID{}, blocks...),
+		Version:   metadata.LoadAckVersion1,
+	}
+	sort.Slice(ack.Blocks, func(i, j int) bool {
+		return ack.Blocks[i].Compare(ack.Blocks[j]) < 0
+	})
+	b, err := json.Marshal(ack)
+	if err != nil {
+		return errors.Wrap(err, "json encode load ack")
+	}
+	name := path.Join(metadata.LoadAcksDir, id+".json")
+	if err := bkt.Upload(ctx, name, bytes.NewBuffer(b)); err != nil {
+		return errors.Wrapf(err, "upload file %s to bucket", name)
+	}
+	return nil
+}
@@ -0,0 +1,512 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"container/heap"
+	"context"
+	"crypto/rand"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/prometheus/prometheus/tsdb/tombstones"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// maxMergedChunkSamples is the maximum number of samples of chunks re-encoded while merging blocks, the same as of
+// chunks cut by the TSDB head.
+const maxMergedChunkSamples = 120
+
+// MergeStats counts chunks of source blocks by the way they made it into the merged block.
+type MergeStats struct {
+	// CopiedChunks did not overlap with any other chunk of the same series, so they were copied verbatim.
+	CopiedChunks int
+	// ReencodedChunks overlapped with other chunks of the same series, so their samples were merged and re-encoded.
+	ReencodedChunks int
+}
+
+// MergeBlocks merges the blocks in the given directories into a new block within dest directory and returns its ID.
+// Unlike TSDB compaction, which re-encodes whole overlapping chunks into a single one, merging works at the level of
+// chunks: chunks not overlapping with any other chunk of the same series are copied verbatim and only samples of
+// overlapping ones are merged, deduplicated by timestamp and re-encoded. Meta of the new block is computed the same way
+// as by TSDB compaction.
+// Source blocks must not have tombstones, which holds for blocks downloaded from object storage. Only XOR encoded chunks
+// can be re-encoded. An empty ULID is returned and nothing is written if the merged block would have no samples.
+// Chunks are obtained from the given pool and returned to it once written. If pool is nil, a new one is used.
+func MergeBlocks(logger log.Logger, dest string, dirs []string, pool chunkenc.Pool) (_ ulid.ULID, stats MergeStats, err error) {
+	return MergeBlocksWith(logger, dest, dirs, pool, DedupChunks)
+}
+
+// ChunksMerger merges loaded chunks of a single series, sorted by min time and overlapping in time, into new chunks
+// not overlapping with each other.
+type ChunksMerger func(chks []chunks.Meta) ([]chunks.Meta, error)
+
+// MergeBlocksWith merges blocks like MergeBlocks, but overlapping chunks are merged by the given merger, e.g. to merge
+// chunks of encodings other than XOR.
+func MergeBlocksWith(logger log.Logger, dest string, dirs []string, pool chunkenc.Pool, merge ChunksMerger) (_ ulid.ULID, stats MergeStats, err error) {
+	if pool == nil {
+		pool = chunkenc.NewPool()
+	}
+	var (
+		metas   []tsdb.BlockMeta
+		indexrs []tsdb.IndexReader
+		chunkrs []tsdb.ChunkReader
+	)
+	for _, d := range dirs {
+		b, err := tsdb.OpenBlock(logger, d, pool)
+		if err != nil {
+			return ulid.ULID{}, stats, errors.Wrapf(err, "open block %s", d)
+		}
+		defer runutil.CloseWithErrCapture(&err, b, "merge block reader")
+
+		tr, err := b.Tombstones()
+		if err != nil {
+			return ulid.ULID{}, stats, errors.Wrapf(err, "open tombstones of block %s", d)
+		}
+		total := tr.Total()
+		if err := tr.Close(); err != nil {
+			return ulid.ULID{}, stats, errors.Wrapf(err, "close tombstones of block %s", d)
+		}
+		if total > 0 {
+			return ulid.ULID{}, stats, errors.Errorf("block %s has tombstones", d)
+		}
+		indexr, err := b.Index()
+		if err != nil {
+			return ulid.ULID{}, stats, errors.Wrapf(err, "open index of block %s", d)
+		}
+		defer runutil.CloseWithErrCapture(&err, indexr, "merge index reader")
+
+		chunkr, err := b.Chunks()
+		if err != nil {
+			return ulid.ULID{}, stats, errors.Wrapf(err, "open chunks of block %s", d)
+		}
+		defer runutil.CloseWithErrCapture(&err, chunkr, "merge chunk reader")
+
+		metas = append(metas, b.Meta())
+		indexrs = append(indexrs, indexr)
+		chunkrs = append(chunkrs, chunkr)
+	}
+
+	id := ulid.MustNew(ulid.Now(), rand.Reader)
+	meta := &metadata.Meta{BlockMeta: mergedBlockMeta(id, metas)}
+	meta.Version = metadata.MetaVersion1
+
+	tmpdir := filepath.Join(dest, id.String()+".tmp")
+	if err := os.RemoveAll(tmpdir); err != nil {
+		return ulid.ULID{}, stats, errors.Wrap(err, "clean merge dir")
+	}
+	defer func() {
+		if rerr := os.RemoveAll(tmpdir); rerr != nil && err == nil {
+			err = errors.Wrap(rerr, "remove merge dir")
+		}
+	}()
+
+	stats, err = mergeTo(tmpdir, indexrs, chunkrs, meta, pool, merge)
+	if err != nil {
+		return ulid.ULID{}, stats, err
+	}
+	if meta.Stats.NumSamples == 0 {
+		return ulid.ULID{}, stats, nil
+	}
+
+	if err := metadata.Write(logger, tmpdir, meta); err != nil {
+		return ulid.ULID{}, stats, errors.Wrap(err, "write meta file")
+	}
+	if _, err := tombstones.WriteFile(logger, tmpdir, tombstones.NewMemTombstones()); err != nil {
+		return ulid.ULID{}, stats, errors.Wrap(err, "write tombstones")
+	}
+	if err := os.Rename(tmpdir, filepath.Join(dest, id.String())); err != nil {
+		return ulid.ULID{}, stats, errors.Wrap(err, "rename merged block dir")
+	}
+	return id, stats, nil
+}
+
+// mergedBlockMeta returns meta of the block merged from blocks with given metas.
+func mergedBlockMeta(id ulid.ULID, metas []tsdb.BlockMeta) tsdb.BlockMeta {
+	res := tsdb.BlockMeta{ULID: id, MinTime: math.MaxInt64, MaxTime: math.MinInt64}
+	sources := map[ulid.ULID]struct{}{}
+	for _, m := range metas {
+		if m.MinTime < res.MinTime {
+			res.MinTime = m.MinTime
+		}
+		if m.MaxTime > res.MaxTime {
+			res.MaxTime = m.MaxTime
+		}
+		if m.Compaction.Level > res.Compaction.Level {
+			res.Compaction.Level = m.Compaction.Level
+		}
+		for _, s := range m.Compaction.Sources {
+			sources[s] = struct{}{}
+		}
+		res.Compaction.Parents = append(res.Compaction.Parents, tsdb.BlockDesc{ULID: m.ULID, MinTime: m.MinTime, MaxTime: m.MaxTime})
+	}
+	res.Compaction.Level++
+	for s := range sources {
+		res.Compaction.Sources = append(res.Compaction.Sources, s)
+	}
+	sort.Slice(res.Compaction.Sources, func(i, j int) bool {
+		return res.Compaction.Sources[i].Compare(res.Compaction.Sources[j]) < 0
+	})
+	return res
+}
+
+func mergeTo(dir string, indexrs []tsdb.IndexReader, chunkrs []tsdb.ChunkReader, meta *metadata.Meta, pool chunkenc.Pool, merge ChunksMerger) (stats MergeStats, err error) {
+	chunkw, err := chunks.NewWriter(filepath.Join(dir, ChunksDirname))
+	if err != nil {
+		return stats, errors.Wrap(err, "open chunk writer")
+	}
+	defer runutil.CloseWithErrCapture(&err, chunkw, "merge chunk writer")
+
+	indexw, err := index.NewWriter(context.TODO(), filepath.Join(dir, IndexFilename))
+	if err != nil {
+		return stats, errors.Wrap(err, "open index writer")
+	}
+	defer runutil.CloseWithErrCapture(&err, indexw, "merge index writer")
+
+	if err := addMergedSymbols(indexw, indexrs); err != nil {
+		return stats, err
+	}
+
+	cursors := make([]*seriesCursor, 0, len(indexrs))
+	for i, indexr := range indexrs {
+		all, err := indexr.Postings(index.AllPostingsKey())
+		if err != nil {
+			return stats, errors.Wrap(err, "postings")
+		}
+		c := &seriesCursor{indexr: indexr, chunkr: chunkrs[i], postings: indexr.SortedPostings(all)}
+		if err := c.next(); err != nil {
+			return stats, err
+		}
+		cursors = append(cursors, c)
+	}
+
+	for ref := uint64(0); ; {
+		// Series of all indexes are sorted by labels, so the series with the lowest labels is the next one to write.
+		var lset labels.Labels
+		for _, c := range cursors {
+			if c.lset != nil && (lset == nil || labels.Compare(c.lset, lset) < 0) {
+				lset = c.lset
+			}
+		}
+		if lset == nil {
+			return stats, nil
+		}
+
+		var chks []sourceChunk
+		for _, c := range cursors {
+			if c.lset == nil || !labels.Equal(c.lset, lset) {
+				continue
+			}
+			for _, chk := range c.chks {
+				chks = append(chks, sourceChunk{Meta: chk, chunkr: c.chunkr})
+			}
+			if err := c.next(); err != nil {
+				return stats, err
+			}
+		}
+
+		merged, err := mergeChunks(chks, merge, &stats)
+		if err != nil {
+			return stats, errors.Wrapf(err, "merge chunks of series %v", lset)
+		}
+		if len(merged) == 0 {
+			continue
+		}
+		if err := writeSeries(indexw, nil, chunkw, meta, ref, lset, merged); err != nil {
+			return stats, err
+		}
+		for _, chk := range merged {
+			if err := pool.Put(chk.Chunk); err != nil {
+				return stats, errors.Wrap(err, "put chunk")
+			}
+		}
+		ref++
+	}
+}
+
+// addMergedSymbols adds union of symbols of all given indexes to the index, in sorted order. Symbols of each index are
+// sorted, so they are merged by a k-way merge of their iterators, as TSDB compactor does for compactions on disk, which
+// keeps memory flat however many unique symbols the indexes have.
+func addMergedSymbols(indexw tsdb.IndexWriter, indexrs []tsdb.IndexReader) error {
+	h := make(symbolsHeap, 0, len(indexrs))
+	for i, indexr := range indexrs {
+		c := &symbolsCursor{it: indexr.Symbols(), index: i}
+		ok, err := c.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h = append(h, c)
+		}
+	}
+	heap.Init(&h)
+
+	var last string
+	for added := false; len(h) > 0; {
+		c := h[0]
+		if sym := c.it.At(); !added || sym != last {
+			if err := indexw.AddSymbol(sym); err != nil {
+				return errors.Wrap(err, "add symbol")
+			}
+			last, added = sym, true
+		}
+		ok, err := c.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&h, 0)
+			continue
+		}
+		heap.Pop(&h)
+	}
+	return nil
+}
+
+// symbolsCursor iterates symbols of a single index, verifying they are sorted.
+type symbolsCursor struct {
+	it    index.StringIter
+	index int
+
+	prev    string
+	started bool
+}
+
+// next advances the cursor and returns false once all symbols have been read.
+func (c *symbolsCursor) next() (bool, error) {
+	if c.started {
+		c.prev = c.it.At()
+	}
+	if !c.it.Next() {
+		return false, errors.Wrapf(c.it.Err(), "iterate symbols of index %d", c.index)
+	}
+	if c.started && c.it.At() <= c.prev {
+		return false, errors.Errorf("symbols of index %d not sorted: %q after %q", c.index, c.it.At(), c.prev)
+	}
+	c.started = true
+	return true, nil
+}
+
+// symbolsHeap is a min-heap of cursors by their current symbol.
+type symbolsHeap []*symbolsCursor
+
+func (h symbolsHeap) Len() int            { return len(h) }
+func (h symbolsHeap) Less(i, j int) bool  { return h[i].it.At() < h[j].it.At() }
+func (h symbolsHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *symbolsHeap) Push(x interface{}) { *h = append(*h, x.(*symbolsCursor)) }
+
+func (h *symbolsHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	c := old[n-1]
+	*h = old[:n-1]
+	return c
+}
+
+// seriesCursor iterates series of a single block in labels order. Labels are nil once all series have been read.
+type seriesCursor struct {
+	indexr   tsdb.IndexReader
+	chunkr   tsdb.ChunkReader
+	postings index.Postings
+
+	lset labels.Labels
+	chks []chunks.Meta
+}
+
+func (c *seriesCursor) next() error {
+	c.lset, c.chks = nil, nil
+	if !c.postings.Next() {
+		return errors.Wrap(c.postings.Err(), "iterate series")
+	}
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	if err := c.indexr.Series(c.postings.At(), &lset, &chks); err != nil {
+		return errors.Wrap(err, "series")
+	}
+	c.lset, c.chks = lset, chks
+	return nil
+}
+
+type sourceChunk struct {
+	chunks.Meta
+	chunkr tsdb.ChunkReader
+}
+
+// mergeChunks returns loaded chunks of a series merged from the given source chunks. Chunks not overlapping with any
+// other one are returned as they are, each run of overlapping chunks is merged by the given merger.
+func mergeChunks(chks []sourceChunk, merge ChunksMerger, stats *MergeStats) ([]chunks.Meta, error) {
+	sort.SliceStable(chks, func(i, j int) bool {
+		return chks[i].MinTime < chks[j].MinTime
+	})
+
+	var res []chunks.Meta
+	for i := 0; i < len(chks); {
+		j, maxt := i+1, chks[i].MaxTime
+		for ; j < len(chks) && chks[j].MinTime <= maxt; j++ {
+			if chks[j].MaxTime > maxt {
+				maxt = chks[j].MaxTime
+			}
+		}
+
+		run := make([]chunks.Meta, 0, j-i)
+		for _, c := range chks[i:j] {
+			chk, err := c.chunkr.Chunk(c.Ref)
+			if err != nil {
+				return nil, errors.Wrap(err, "chunk read")
+			}
+			run = append(run, chunks.Meta{MinTime: c.MinTime, MaxTime: c.MaxTime, Chunk: chk})
+		}
+		if j == i+1 {
+			res = append(res, run[0])
+			stats.CopiedChunks++
+			i = j
+			continue
+		}
+
+		merged, err := merge(run)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, merged...)
+		stats.ReencodedChunks += j - i
+		i = j
+	}
+	return res, nil
+}
+
+type sample struct {
+	t int64
+	v float64
+}
+
+// DedupChunks is a ChunksMerger merging samples of the given chunks, keeping the first sample of each timestamp, and
+// encoding them into new chunks. It is the merger of MergeBlocks and merges like TSDB compaction does.
+func DedupChunks(chks []chunks.Meta) ([]chunks.Meta, error) {
+	var samples []sample
+	if err := iterateChunks(chks, func(_ int, t int64, v float64) {
+		samples = append(samples, sample{t: t, v: v})
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].t < samples[j].t
+	})
+	return encodeSamples(samples)
+}
+
+// ConcatChunks is a ChunksMerger concatenating the given chunks in order. Samples of each chunk are taken only after
+// the last sample taken from the chunks before, so earlier chunks win where chunks overlap, and samples of different
+// chunks are never interleaved.
+func ConcatChunks(chks []chunks.Meta) ([]chunks.Meta, error) {
+	var samples []sample
+	if err := iterateChunks(chks, func(_ int, t int64, v float64) {
+		if len(samples) > 0 && t <= samples[len(samples)-1].t {
+			return
+		}
+		samples = append(samples, sample{t: t, v: v})
+	}); err != nil {
+		return nil, err
+	}
+	return encodeSamples(samples)
+}
+
+// CounterChunks is a ChunksMerger merging samples of the given chunks of a counter like DedupChunks, but a sample lower
+// than the one before is dropped if that one was taken from another chunk, unless the sample is lower than the one
+// before in its own chunk too. Interleaving samples of replicas of a counter does not produce counter resets that
+// neither replica observed this way, e.g. as one replica scraped a value slightly older than the other.
+func CounterChunks(chks []chunks.Meta) ([]chunks.Meta, error) {
+	type sourceSample struct {
+		sample
+		src int
+	}
+	var all []sourceSample
+	if err := iterateChunks(chks, func(src int, t int64, v float64) {
+		all = append(all, sourceSample{sample: sample{t: t, v: v}, src: src})
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].t < all[j].t
+	})
+
+	var (
+		samples = make([]sample, 0, len(all))
+		lastSrc int
+		prev    = map[int]float64{}
+	)
+	for _, s := range all {
+		prevOfSrc, seen := prev[s.src]
+		prev[s.src] = s.v
+		if len(samples) > 0 {
+			last := samples[len(samples)-1]
+			if s.t == last.t {
+				continue
+			}
+			if s.v < last.v && s.src != lastSrc && (!seen || s.v >= prevOfSrc) {
+				continue
+			}
+		}
+		samples = append(samples, s.sample)
+		lastSrc = s.src
+	}
+	return encodeSamples(samples)
+}
+
+// iterateChunks calls f with the index of the chunk and each sample of the given XOR encoded chunks, chunk by chunk.
+func iterateChunks(chks []chunks.Meta, f func(src int, t int64, v float64)) error {
+	for i, c := range chks {
+		if c.Chunk.Encoding() != chunkenc.EncXOR {
+			return errors.Errorf("unsupported chunk encoding %v", c.Chunk.Encoding())
+		}
+		it := c.Chunk.Iterator(nil)
+		for it.Next() {
+			t, v := it.At()
+			f(i, t, v)
+		}
+		if it.Err() != nil {
+			return errors.Wrap(it.Err(), "iterate chunk")
+		}
+	}
+	return nil
+}
+
+// encodeSamples encodes the given samples sorted by timestamp into new chunks, keeping the first sample of each
+// timestamp.
+func encodeSamples(samples []sample) ([]chunks.Meta, error) {
+	var (
+		res []chunks.Meta
+		app chunkenc.Appender
+	)
+	for i, s := range samples {
+		if i > 0 && s.t == samples[i-1].t {
+			continue
+		}
+		if len(res) == 0 || res[len(res)-1].Chunk.NumSamples() >= maxMergedChunkSamples {
+			chk := chunkenc.NewXORChunk()
+			var err error
+			app, err = chk.Appender()
+			if err != nil {
+				return nil, errors.Wrap(err, "chunk appender")
+			}
+			res = append(res, chunks.Meta{MinTime: s.t, Chunk: chk})
+		}
+		app.Append(s.t, s.v)
+		res[len(res)-1].MaxTime = s.t
+	}
+	return res, nil
+}
@@ -0,0 +1,180 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestMergeBlocks(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-merge-blocks")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	// Samples are 9ms apart, so 44 samples of series a=2 share timestamps in both blocks.
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+	}, 100, 0, 1000, labels.Labels{{Name: "ext", Value: "1"}}, 0)
+	testutil.Ok(t, err)
+	b2, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.FromStrings("a", "2"),
+		labels.FromStrings("a", "3"),
+	}, 100, 504, 1504, labels.Labels{{Name: "ext", Value: "1"}}, 0)
+	testutil.Ok(t, err)
+
+	id, stats, err := MergeBlocks(log.NewNopLogger(), tmpDir, []string{filepath.Join(tmpDir, b1.String()), filepath.Join(tmpDir, b2.String())}, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, MergeStats{CopiedChunks: 2, ReencodedChunks: 2}, stats)
+
+	bdir := filepath.Join(tmpDir, id.String())
+	m, err := metadata.Read(bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(0), m.MinTime)
+	testutil.Equals(t, int64(1504), m.MaxTime)
+	testutil.Equals(t, 2, m.Compaction.Level)
+	testutil.Equals(t, 2, len(m.Compaction.Parents))
+	expSources := []ulid.ULID{b1, b2}
+	if b2.Compare(b1) < 0 {
+		expSources = []ulid.ULID{b2, b1}
+	}
+	testutil.Equals(t, expSources, m.Compaction.Sources)
+	testutil.Equals(t, uint64(3), m.Stats.NumSeries)
+	testutil.Equals(t, uint64(4), m.Stats.NumChunks)
+	testutil.Equals(t, uint64(100+156+100), m.Stats.NumSamples)
+
+	ir, err := index.NewFileReader(filepath.Join(bdir, IndexFilename))
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, ir.Close()) }()
+
+	all, err := ir.Postings(index.AllPostingsKey())
+	testutil.Ok(t, err)
+	var (
+		got       []labels.Labels
+		gotChunks [][]chunks.Meta
+	)
+	for all.Next() {
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
+		testutil.Ok(t, ir.Series(all.At(), &lset, &chks))
+		got = append(got, lset)
+		gotChunks = append(gotChunks, chks)
+	}
+	testutil.Ok(t, all.Err())
+	testutil.Equals(t, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+		labels.FromStrings("a", "3"),
+	}, got)
+
+	// Overlapping chunks of a=2 are re-encoded into chunks of at most 120 samples.
+	testutil.Equals(t, 2, len(gotChunks[1]))
+	testutil.Equals(t, int64(0), gotChunks[1][0].MinTime)
+	testutil.Equals(t, int64(119*9), gotChunks[1][0].MaxTime)
+	testutil.Equals(t, int64(120*9), gotChunks[1][1].MinTime)
+	testutil.Equals(t, int64(1395), gotChunks[1][1].MaxTime)
+}
+
+func TestChunksMergers(t *testing.T) {
+	chunk := func(samples ...sample) chunks.Meta {
+		c := chunkenc.NewXORChunk()
+		app, err := c.Appender()
+		testutil.Ok(t, err)
+		for _, s := range samples {
+			app.Append(s.t, s.v)
+		}
+		return chunks.Meta{MinTime: samples[0].t, MaxTime: samples[len(samples)-1].t, Chunk: c}
+	}
+	samplesOf := func(chks []chunks.Meta) []sample {
+		var res []sample
+		testutil.Ok(t, iterateChunks(chks, func(_ int, t int64, v float64) {
+			res = append(res, sample{t: t, v: v})
+		}))
+		return res
+	}
+	// Replicas of a counter, with replica B scraping a stale value at 25 and resetting the counter at 50.
+	replicaA := chunk(sample{10, 1}, sample{20, 2}, sample{30, 3}, sample{40, 4})
+	replicaB := chunk(sample{15, 1}, sample{25, 1}, sample{35, 3}, sample{50, 0}, sample{60, 1})
+
+	for _, tcase := range []struct {
+		name     string
+		merge    ChunksMerger
+		expected []sample
+	}{
+		{
+			name:     "concat",
+			merge:    ConcatChunks,
+			expected: []sample{{10, 1}, {20, 2}, {30, 3}, {40, 4}, {50, 0}, {60, 1}},
+		},
+		{
+			name:     "dedup",
+			merge:    DedupChunks,
+			expected: []sample{{10, 1}, {15, 1}, {20, 2}, {25, 1}, {30, 3}, {35, 3}, {40, 4}, {50, 0}, {60, 1}},
+		},
+		{
+			name:     "counter",
+			merge:    CounterChunks,
+			expected: []sample{{10, 1}, {15, 1}, {20, 2}, {30, 3}, {35, 3}, {40, 4}, {50, 0}, {60, 1}},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			merged, err := tcase.merge([]chunks.Meta{replicaA, replicaB})
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, samplesOf(merged))
+		})
+	}
+}
+
+type symbolsIndexReader struct {
+	tsdb.IndexReader
+	symbols []string
+}
+
+func (r symbolsIndexReader) Symbols() index.StringIter { return index.NewStringListIter(r.symbols) }
+
+type symbolsIndexWriter struct {
+	tsdb.IndexWriter
+	symbols []string
+}
+
+func (w *symbolsIndexWriter) AddSymbol(sym string) error {
+	w.symbols = append(w.symbols, sym)
+	return nil
+}
+
+func TestAddMergedSymbols(t *testing.T) {
+	w := &symbolsIndexWriter{}
+	testutil.Ok(t, addMergedSymbols(w, []tsdb.IndexReader{
+		symbolsIndexReader{symbols: []string{"a", "c", "e"}},
+		symbolsIndexReader{},
+		symbolsIndexReader{symbols: []string{"b", "c", "f"}},
+		symbolsIndexReader{symbols: []string{"a", "f", "g"}},
+	}))
+	testutil.Equals(t, []string{"a", "b", "c", "e", "f", "g"}, w.symbols)
+
+	testutil.NotOk(t, addMergedSymbols(&symbolsIndexWriter{}, []tsdb.IndexReader{
+		symbolsIndexReader{symbols: []string{"a", "c"}},
+		symbolsIndexReader{symbols: []string{"d", "b"}},
+	}))
+}
@@ -0,0 +1,142 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"path"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// CompressedMetaFilename is the name of zstd compressed copy of meta.json. It is uploaded next to meta.json, which stays
+// the marker of a complete block upload, and is preferred by readers that opted in to reduce transfer of block syncs.
+const CompressedMetaFilename = MetaFilename + ".zst"
+
+type uploadOptions struct {
+	compressedMeta  bool
+	debugMetaPrefix string
+	uploadedChunks  map[string]struct{}
+	fileHashes      bool
+	collisionCheck  bool
+}
+
+// UploadOption overrides behavior of Upload.
+type UploadOption interface {
+	apply(*uploadOptions)
+}
+
+type uploadOptionFunc func(*uploadOptions)
+
+func (f uploadOptionFunc) apply(o *uploadOptions) {
+	f(o)
+}
+
+func applyUploadOptions(opts []UploadOption) uploadOptions {
+	o := uploadOptions{}
+	for _, opt := range opts {
+		opt.apply(&o)
+	}
+	return o
+}
+
+// WithCompressedMeta makes Upload upload zstd compressed copy of meta.json as meta.json.zst, and the debug meta in
+// compressed form only.
+func WithCompressedMeta(enabled bool) UploadOption {
+	return uploadOptionFunc(func(o *uploadOptions) {
+		o.compressedMeta = enabled
+	})
+}
+
+// WithDebugMetaPrefix makes Upload copy meta.json to the debug meta under the given prefix instead of DebugMetas.
+func WithDebugMetaPrefix(prefix string) UploadOption {
+	return uploadOptionFunc(func(o *uploadOptions) {
+		o.debugMetaPrefix = prefix
+	})
+}
+
+// WithUploadedChunks makes Upload skip the given chunk segments, already uploaded e.g. by PipelinedUpload. They may be
+// missing in the local block directory.
+func WithUploadedChunks(names []string) UploadOption {
+	return uploadOptionFunc(func(o *uploadOptions) {
+		o.uploadedChunks = make(map[string]struct{}, len(names))
+		for _, n := range names {
+			o.uploadedChunks[n] = struct{}{}
+		}
+	})
+}
+
+// WithFileHashes makes Upload list files of the block in meta.json with SHA-256 hashes of their content, not only their
+// sizes, so readers can verify content of downloaded files. See metadata.File.
+func WithFileHashes(enabled bool) UploadOption {
+	return uploadOptionFunc(func(o *uploadOptions) {
+		o.fileHashes = enabled
+	})
+}
+
+// WithCollisionCheck makes Upload refuse a block whose ID is taken by a different block in the bucket with
+// ErrULIDCollision, before anything is uploaded. It costs an existence check of meta.json per upload, and its download if
+// it exists.
+func WithCollisionCheck() UploadOption {
+	return uploadOptionFunc(func(o *uploadOptions) {
+		o.collisionCheck = true
+	})
+}
+
+func compressMeta(b []byte) ([]byte, error) {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, errors.Wrap(err, "create zstd encoder")
+	}
+	defer enc.Close()
+
+	return enc.EncodeAll(b, nil), nil
+}
+
+func decompressMeta(b []byte) ([]byte, error) {
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, errors.Wrap(err, "create zstd decoder")
+	}
+	defer dec.Close()
+
+	return dec.DecodeAll(b, nil)
+}
+
+// uploadCompressed uploads zstd compressed given content to the given object.
+func uploadCompressed(ctx context.Context, bkt objstore.Bucket, content []byte, dst string) error {
+	c, err := compressMeta(content)
+	if err != nil {
+		return err
+	}
+	if err := bkt.Upload(ctx, dst, bytes.NewReader(c)); err != nil {
+		return errors.Wrapf(err, "upload %s", dst)
+	}
+	return nil
+}
+
+// uploadCompressedMetaIfExists replaces meta.json.zst of the block with compressed given content, if the block has one,
+// so it never gets out of sync with meta.json.
+func uploadCompressedMetaIfExists(ctx context.Context, bkt objstore.Bucket, dir string, meta []byte) error {
+	compressedMetaFile := path.Join(dir, CompressedMetaFilename)
+	exists, err := bkt.Exists(ctx, compressedMetaFile)
+	if err != nil {
+		return errors.Wrapf(err, "check exists %s in bucket", compressedMetaFile)
+	}
+	if !exists {
+		return nil
+	}
+	c, err := compressMeta(meta)
+	if err != nil {
+		return err
+	}
+	if err := bkt.Upload(ctx, compressedMetaFile, bytes.NewReader(c)); err != nil {
+		return errors.Wrapf(err, "upload %s", compressedMetaFile)
+	}
+	return nil
+}
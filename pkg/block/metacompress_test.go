@@ -0,0 +1,75 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestCompressedMeta(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-compressed-meta")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String()), WithCompressedMeta(true)))
+
+	objs := bkt.Objects()
+	testutil.Assert(t, len(objs[path.Join(id.String(), CompressedMetaFilename)]) > 0, "expected compressed meta")
+	testutil.Assert(t, len(objs[path.Join(id.String(), MetaFilename)]) > 0, "expected meta")
+	testutil.Assert(t, len(objs[path.Join(DebugMetas, id.String()+".json.zst")]) > 0, "expected compressed debug meta")
+	_, ok := objs[path.Join(DebugMetas, id.String()+".json")]
+	testutil.Assert(t, !ok, "expected no uncompressed debug meta")
+
+	c, err := decompressMeta(objs[path.Join(id.String(), CompressedMetaFilename)])
+	testutil.Ok(t, err)
+	testutil.Equals(t, objs[path.Join(id.String(), MetaFilename)], c)
+
+	// Compressed meta is preferred, so a broken meta.json is not read at all.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), MetaFilename), bytes.NewBufferString("{")))
+	fetcher, err := NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(bkt), "", nil)
+	testutil.Ok(t, err)
+	fetcher.ReadCompressedMetas()
+	m, err := fetcher.loadMeta(ctx, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]string{"ext1": "val1"}, m.Thanos.Labels)
+
+	// Updated meta is updated in both forms.
+	m.Thanos.Labels = map[string]string{"ext1": "val2"}
+	testutil.Ok(t, UploadMeta(ctx, bkt, *m))
+	fetcher, err = NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(bkt), "", nil)
+	testutil.Ok(t, err)
+	fetcher.ReadCompressedMetas()
+	m, err = fetcher.loadMeta(ctx, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]string{"ext1": "val2"}, m.Thanos.Labels)
+
+	// Blocks without compressed meta are read as usual.
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(id.String(), CompressedMetaFilename)))
+	fetcher, err = NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(bkt), "", nil)
+	testutil.Ok(t, err)
+	fetcher.ReadCompressedMetas()
+	m, err = fetcher.loadMeta(ctx, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]string{"ext1": "val2"}, m.Thanos.Labels)
+}
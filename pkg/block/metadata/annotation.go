@@ -0,0 +1,143 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"regexp"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// RetentionAnnotationsDir is the directory in the root of the bucket holding retention annotations, one <name>.json
+	// file per annotation.
+	RetentionAnnotationsDir = "retention-annotations"
+
+	// RetentionAnnotationVersion1 is the version of retention annotation file supported by Thanos.
+	RetentionAnnotationVersion1 = 1
+)
+
+var annotationNameRE = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// RetentionAnnotation preserves data from deletion by retention, e.g. data of an incident kept for its post-mortem.
+// Blocks created from annotated blocks or overlapping annotated time ranges are preserved as a whole.
+type RetentionAnnotation struct {
+	// Name identifies the annotation, e.g. incident-2024-05.
+	Name string `json:"name"`
+
+	// Description is a human readable reason of preservation.
+	Description string `json:"description,omitempty"`
+
+	// CreatedAt is a unix timestamp of when the annotation was created.
+	CreatedAt int64 `json:"created_at"`
+
+	// Blocks are preserved blocks. Blocks compacted or downsampled from them are preserved as well.
+	Blocks []ulid.ULID `json:"blocks,omitempty"`
+
+	// Ranges preserve blocks by their external labels and time range.
+	Ranges []AnnotatedRange `json:"ranges,omitempty"`
+
+	// Version of the file.
+	Version int `json:"version"`
+}
+
+// AnnotatedRange preserves blocks whose external labels match the matchers and whose time range overlaps with the
+// range.
+type AnnotatedRange struct {
+	// Matchers is a selector of external labels, e.g. {cluster="eu-1"}. Empty matches all blocks.
+	Matchers string `json:"matchers,omitempty"`
+
+	// MinTime and MaxTime are the inclusive time range in milliseconds.
+	MinTime int64 `json:"min_time"`
+	MaxTime int64 `json:"max_time"`
+}
+
+// ParseMatchers parses the selector of external labels of the range.
+func (r AnnotatedRange) ParseMatchers() ([]*labels.Matcher, error) {
+	if r.Matchers == "" {
+		return nil, nil
+	}
+	return parser.ParseMetricSelector(r.Matchers)
+}
+
+// ValidateRetentionAnnotationName returns an error if the given name cannot name a retention annotation file.
+func ValidateRetentionAnnotationName(name string) error {
+	if !annotationNameRE.MatchString(name) {
+		return errors.Errorf("invalid annotation name %q: must match %s", name, annotationNameRE)
+	}
+	return nil
+}
+
+// Validate returns an error if the annotation cannot be stored or evaluated.
+func (a *RetentionAnnotation) Validate() error {
+	if err := ValidateRetentionAnnotationName(a.Name); err != nil {
+		return err
+	}
+	if len(a.Blocks) == 0 && len(a.Ranges) == 0 {
+		return errors.Errorf("annotation %s preserves no blocks nor ranges", a.Name)
+	}
+	for _, r := range a.Ranges {
+		if r.MinTime > r.MaxTime {
+			return errors.Errorf("annotation %s: invalid time range [%d, %d]", a.Name, r.MinTime, r.MaxTime)
+		}
+		if _, err := r.ParseMatchers(); err != nil {
+			return errors.Wrapf(err, "annotation %s: parse matchers %q", a.Name, r.Matchers)
+		}
+	}
+	return nil
+}
+
+// RetentionAnnotationFile returns the name of the file of the annotation with the given name in the bucket.
+func RetentionAnnotationFile(name string) string {
+	return path.Join(RetentionAnnotationsDir, name+".json")
+}
+
+// ReadRetentionAnnotations reads all retention annotations from RetentionAnnotationsDir. Unlike other files, invalid
+// annotations fail the read, as skipping them would let retention delete data meant to be preserved.
+func ReadRetentionAnnotations(ctx context.Context, bkt objstore.BucketReader, logger log.Logger) ([]*RetentionAnnotation, error) {
+	var annotations []*RetentionAnnotation
+	if err := bkt.Iter(ctx, RetentionAnnotationsDir, func(name string) error {
+		if path.Ext(name) != ".json" {
+			return nil
+		}
+		r, err := bkt.Get(ctx, name)
+		if err != nil {
+			if bkt.IsObjNotFoundErr(err) {
+				return nil
+			}
+			return errors.Wrapf(err, "get file: %s", name)
+		}
+		defer runutil.CloseWithLogOnErr(logger, r, "close bkt retention annotation reader")
+
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return errors.Wrapf(err, "read file: %s", name)
+		}
+		a := RetentionAnnotation{}
+		if err := json.Unmarshal(content, &a); err != nil {
+			return errors.Wrapf(err, "unmarshal file: %s", name)
+		}
+		if a.Version != RetentionAnnotationVersion1 {
+			return errors.Errorf("unexpected retention annotation file %s version %d", name, a.Version)
+		}
+		if err := a.Validate(); err != nil {
+			return errors.Wrapf(err, "file: %s", name)
+		}
+		annotations = append(annotations, &a)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "list retention annotations")
+	}
+	return annotations, nil
+}
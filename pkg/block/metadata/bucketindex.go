@@ -0,0 +1,87 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// BucketIndexFilename is the known json filename of the bucket index, stored in the root of the bucket. It lists
+	// all blocks in the bucket, so readers do not need to list the whole bucket.
+	BucketIndexFilename = "bucket-index.json"
+
+	// BucketIndexVersion1 is the version of bucket index file supported by Thanos.
+	BucketIndexVersion1 = 1
+)
+
+// ErrorBucketIndexNotFound is the error when bucket-index.json file is not found.
+var ErrorBucketIndexNotFound = errors.New("bucket-index.json not found")
+
+// ErrorUnmarshalBucketIndex is the error when unmarshalling bucket-index.json file.
+var ErrorUnmarshalBucketIndex = errors.New("unmarshal bucket-index.json")
+
+// BucketIndex is a list of all blocks with meta.json in the bucket together with their deletion marks, as seen by the
+// last update of the index.
+type BucketIndex struct {
+	// UpdatedAt is a unix timestamp of when the index was updated.
+	UpdatedAt int64 `json:"updated_at"`
+
+	// Blocks are metas of all blocks in the bucket, including blocks marked for deletion.
+	Blocks []Meta `json:"blocks"`
+
+	// DeletionMarks are deletion marks of blocks marked for deletion.
+	DeletionMarks []DeletionMark `json:"deletion_marks"`
+
+	// Version of the file.
+	Version int `json:"version"`
+}
+
+// Updated returns time of the last update of the index.
+func (i *BucketIndex) Updated() time.Time {
+	return time.Unix(i.UpdatedAt, 0)
+}
+
+// IsStale returns true if the index was not updated in the given duration before now. Stale index is likely not
+// updated anymore, so it should not be relied on.
+func (i *BucketIndex) IsStale(now time.Time, maxStaleness time.Duration) bool {
+	return now.Sub(i.Updated()) > maxStaleness
+}
+
+// ReadBucketIndex reads the bucket index from bucket-index.json in the root of the bucket.
+func ReadBucketIndex(ctx context.Context, bkt objstore.InstrumentedBucketReader, logger log.Logger) (*BucketIndex, error) {
+	r, err := bkt.ReaderWithExpectedErrs(bkt.IsObjNotFoundErr).Get(ctx, BucketIndexFilename)
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return nil, ErrorBucketIndexNotFound
+		}
+		return nil, errors.Wrapf(err, "get file: %s", BucketIndexFilename)
+	}
+
+	defer runutil.CloseWithLogOnErr(logger, r, "close bkt bucket-index reader")
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read file: %s", BucketIndexFilename)
+	}
+
+	idx := BucketIndex{}
+	if err := json.Unmarshal(content, &idx); err != nil {
+		return nil, errors.Wrapf(ErrorUnmarshalBucketIndex, "file: %s; err: %v", BucketIndexFilename, err.Error())
+	}
+
+	if idx.Version != BucketIndexVersion1 {
+		return nil, errors.Errorf("unexpected bucket-index file version %d", idx.Version)
+	}
+
+	return &idx, nil
+}
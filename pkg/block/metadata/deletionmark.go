@@ -32,6 +32,18 @@ var ErrorDeletionMarkNotFound = errors.New("deletion-mark.json not found")
 // or the deletion-mark.json file is not a valid json file.
 var ErrorUnmarshalDeletionMark = errors.New("unmarshal deletion-mark.json")
 
+// DeletionReason describes why the block was marked for deletion.
+type DeletionReason string
+
+const (
+	// EmptyCompactionResultDeletionReason is set for source blocks of a compaction that yielded no samples, e.g. because all
+	// their series were deleted. Such blocks are marked for deletion without uploading any compacted block.
+	EmptyCompactionResultDeletionReason DeletionReason = "empty-compaction-result"
+	// KeepLastBlocksDeletionReason is set for blocks deleted by a retention rule keeping only a number of the newest
+	// blocks of their compaction group.
+	KeepLastBlocksDeletionReason DeletionReason = "keep-last-blocks"
+)
+
 // DeletionMark stores block id and when block was marked for deletion.
 type DeletionMark struct {
 	// ID of the tsdb block.
@@ -40,6 +52,9 @@ type DeletionMark struct {
 	// DeletionTime is a unix timestamp of when the block was marked to be deleted.
 	DeletionTime int64 `json:"deletion_time"`
 
+	// Reason is set if the block was marked for deletion for a reason other than the usual one (e.g. being compacted).
+	Reason DeletionReason `json:"reason,omitempty"`
+
 	// Version of the file.
 	Version int `json:"version"`
 }
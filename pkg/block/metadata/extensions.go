@@ -0,0 +1,52 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"sort"
+	"strings"
+)
+
+// ExtensionValueSeparator separates values of an extension of a block created from blocks with distinct values of it.
+const ExtensionValueSeparator = ","
+
+// ExtensionValues returns values of the given extension of the block, split by ExtensionValueSeparator.
+func (m Thanos) ExtensionValues(key string) []string {
+	v, ok := m.Extensions[key]
+	if !ok || v == "" {
+		return nil
+	}
+	return strings.Split(v, ExtensionValueSeparator)
+}
+
+// MergeExtensions returns extensions of a block created from the given blocks: every extension of any of them, with
+// sorted, unique values of all of them joined by ExtensionValueSeparator, so that e.g. owners of all source blocks own
+// the created block. Merging is idempotent, so extensions survive any number of compactions. Nil is returned if none of
+// the blocks has extensions.
+func MergeExtensions(metas ...Thanos) map[string]string {
+	uniq := map[string]map[string]struct{}{}
+	for _, m := range metas {
+		for key := range m.Extensions {
+			if _, ok := uniq[key]; !ok {
+				uniq[key] = map[string]struct{}{}
+			}
+			for _, v := range m.ExtensionValues(key) {
+				uniq[key][v] = struct{}{}
+			}
+		}
+	}
+	if len(uniq) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(uniq))
+	for key, values := range uniq {
+		vs := make([]string, 0, len(values))
+		for v := range values {
+			vs = append(vs, v)
+		}
+		sort.Strings(vs)
+		res[key] = strings.Join(vs, ExtensionValueSeparator)
+	}
+	return res
+}
@@ -0,0 +1,31 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestMergeExtensions(t *testing.T) {
+	a := Thanos{Extensions: map[string]string{"team": "storage", "classification": "internal"}}
+	b := Thanos{Extensions: map[string]string{"team": "query,storage"}}
+	c := Thanos{}
+
+	merged := MergeExtensions(a, b, c)
+	testutil.Equals(t, map[string]string{"team": "query,storage", "classification": "internal"}, merged)
+	testutil.Equals(t, []string{"query", "storage"}, Thanos{Extensions: merged}.ExtensionValues("team"))
+	// Merging merged extensions again changes nothing.
+	testutil.Equals(t, merged, MergeExtensions(Thanos{Extensions: merged}, a))
+	testutil.Equals(t, map[string]string(nil), MergeExtensions(c))
+
+	// Extensions survive a round trip of meta.json.
+	b1, err := json.Marshal(Meta{Thanos: Thanos{Extensions: merged}})
+	testutil.Ok(t, err)
+	var m Meta
+	testutil.Ok(t, json.Unmarshal(b1, &m))
+	testutil.Equals(t, merged, m.Thanos.Extensions)
+}
@@ -0,0 +1,33 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+// File describes a file of a block listed in its meta.json. Readers use it to size the block without listing its objects,
+// e.g. for planning of disk space, and to verify downloaded files.
+type File struct {
+	// RelPath is the path of the file relative to the block directory, with slash separators, e.g. chunks/000001.
+	RelPath   string `json:"rel_path"`
+	SizeBytes int64  `json:"size_bytes"`
+	// Hash is the hex encoded SHA-256 hash of the content of the file, if computed, see block.WithFileHashes.
+	Hash string `json:"hash,omitempty"`
+}
+
+// FilesSize returns the total size of files listed in the meta, or zero if they are not listed.
+func (m Thanos) FilesSize() int64 {
+	var size int64
+	for _, f := range m.Files {
+		size += f.SizeBytes
+	}
+	return size
+}
+
+// File returns the listed file of the given path relative to the block directory, if any.
+func (m Thanos) File(relPath string) (File, bool) {
+	for _, f := range m.Files {
+		if f.RelPath == relPath {
+			return f, true
+		}
+	}
+	return File{}, false
+}
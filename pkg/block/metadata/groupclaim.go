@@ -0,0 +1,92 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// GroupClaimsDir is the directory in the root of the bucket holding claims of compaction groups, one per group.
+	// A compactor claims a group before compacting it, so compactors sharing work on the bucket never compact the same
+	// group at the same time.
+	GroupClaimsDir = "compactor-claims"
+
+	// GroupClaimVersion1 is the version of group claim files supported by Thanos.
+	GroupClaimVersion1 = 1
+)
+
+// ErrorGroupClaimNotFound is the error when the claim file of a group is not found.
+var ErrorGroupClaimNotFound = errors.New("group claim not found")
+
+// ErrorUnmarshalGroupClaim is the error when unmarshalling a group claim file.
+var ErrorUnmarshalGroupClaim = errors.New("unmarshal group claim")
+
+// GroupClaim stores which compactor claimed compaction of a group and until when.
+type GroupClaim struct {
+	// Group is the key of the claimed compaction group.
+	Group string `json:"group"`
+
+	// Holder is the identity of the compactor holding the claim, e.g. its creator ID.
+	Holder string `json:"holder"`
+
+	// ClaimTime is a unix timestamp of when the group was claimed.
+	ClaimTime int64 `json:"claim_time"`
+
+	// ExpiryTime is a unix timestamp of when the claim expires, so the group can be claimed by other compactors even if
+	// the holder never released it.
+	ExpiryTime int64 `json:"expiry_time"`
+
+	// Version of the file.
+	Version int `json:"version"`
+}
+
+// Active returns true if the claim has not expired at the given time.
+func (c *GroupClaim) Active(now time.Time) bool {
+	return now.Before(time.Unix(c.ExpiryTime, 0))
+}
+
+// GroupClaimFile returns the path of the claim file of the group with the given key.
+func GroupClaimFile(group string) string {
+	return path.Join(GroupClaimsDir, group+".json")
+}
+
+// ReadGroupClaim reads the claim of the group with the given key from GroupClaimsDir.
+func ReadGroupClaim(ctx context.Context, bkt objstore.InstrumentedBucketReader, logger log.Logger, group string) (*GroupClaim, error) {
+	fn := GroupClaimFile(group)
+	r, err := bkt.ReaderWithExpectedErrs(bkt.IsObjNotFoundErr).Get(ctx, fn)
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return nil, ErrorGroupClaimNotFound
+		}
+		return nil, errors.Wrapf(err, "get file: %s", fn)
+	}
+
+	defer runutil.CloseWithLogOnErr(logger, r, "close bkt group claim reader")
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read file: %s", fn)
+	}
+
+	claim := GroupClaim{}
+	if err := json.Unmarshal(content, &claim); err != nil {
+		return nil, errors.Wrapf(ErrorUnmarshalGroupClaim, "file: %s; err: %v", fn, err.Error())
+	}
+
+	if claim.Version != GroupClaimVersion1 {
+		return nil, errors.Errorf("unexpected group claim file version %d", claim.Version)
+	}
+
+	return &claim, nil
+}
@@ -0,0 +1,88 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// CompactorStatusDir is the directory in the root of the bucket holding status files of compactors, in a directory
+	// per compactor instance.
+	CompactorStatusDir = "compactor-status"
+	// HaltStatusFilename is the known json filename of the halt status of a compactor instance. It exists while the
+	// compactor is halted, so halts can be discovered without scraping logs.
+	HaltStatusFilename = "halt.json"
+
+	// HaltStatusVersion1 is the version of halt status files supported by Thanos.
+	HaltStatusVersion1 = 1
+)
+
+// ErrorHaltStatusNotFound is the error when the halt status file of a compactor is not found.
+var ErrorHaltStatusNotFound = errors.New("halt status not found")
+
+// ErrorUnmarshalHaltStatus is the error when unmarshalling a halt status file.
+var ErrorUnmarshalHaltStatus = errors.New("unmarshal halt status")
+
+// HaltStatus describes why a compactor halted.
+type HaltStatus struct {
+	// Instance is the identity of the halted compactor, e.g. its creator ID.
+	Instance string `json:"instance"`
+
+	// Reason is the error the compactor halted on.
+	Reason string `json:"reason"`
+
+	// Blocks are IDs of blocks mentioned by the error, e.g. source blocks of the failed compaction.
+	Blocks []ulid.ULID `json:"blocks,omitempty"`
+
+	// HaltTime is a unix timestamp of when the compactor halted.
+	HaltTime int64 `json:"halt_time"`
+
+	// Version of the file.
+	Version int `json:"version"`
+}
+
+// HaltStatusFile returns the path of the halt status file of the compactor with the given identity.
+func HaltStatusFile(instance string) string {
+	return path.Join(CompactorStatusDir, instance, HaltStatusFilename)
+}
+
+// ReadHaltStatus reads the halt status of the compactor with the given identity from CompactorStatusDir.
+func ReadHaltStatus(ctx context.Context, bkt objstore.InstrumentedBucketReader, logger log.Logger, instance string) (*HaltStatus, error) {
+	fn := HaltStatusFile(instance)
+	r, err := bkt.ReaderWithExpectedErrs(bkt.IsObjNotFoundErr).Get(ctx, fn)
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return nil, ErrorHaltStatusNotFound
+		}
+		return nil, errors.Wrapf(err, "get file: %s", fn)
+	}
+
+	defer runutil.CloseWithLogOnErr(logger, r, "close bkt halt status reader")
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read file: %s", fn)
+	}
+
+	status := HaltStatus{}
+	if err := json.Unmarshal(content, &status); err != nil {
+		return nil, errors.Wrapf(ErrorUnmarshalHaltStatus, "file: %s; err: %v", fn, err.Error())
+	}
+
+	if status.Version != HaltStatusVersion1 {
+		return nil, errors.Errorf("unexpected halt status file version %d", status.Version)
+	}
+
+	return &status, nil
+}
@@ -0,0 +1,78 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// HoldMarkFilename is the known json filename to store details about when and why block was placed under hold.
+	// Blocks under hold (e.g. legal hold) must not be compacted, deleted nor removed by retention.
+	HoldMarkFilename = "hold-mark.json"
+
+	// HoldMarkVersion1 is the version of hold-mark file supported by Thanos.
+	HoldMarkVersion1 = 1
+)
+
+// ErrorHoldMarkNotFound is the error when hold-mark.json file is not found.
+var ErrorHoldMarkNotFound = errors.New("hold-mark.json not found")
+
+// ErrorUnmarshalHoldMark is the error when unmarshalling hold-mark.json file.
+var ErrorUnmarshalHoldMark = errors.New("unmarshal hold-mark.json")
+
+// HoldMark stores block id, when and why the block was placed under hold.
+type HoldMark struct {
+	// ID of the tsdb block.
+	ID ulid.ULID `json:"id"`
+
+	// HoldTime is a unix timestamp of when the block was placed under hold.
+	HoldTime int64 `json:"hold_time"`
+
+	// Reason is a human readable reason of the hold.
+	Reason string `json:"reason,omitempty"`
+
+	// Version of the file.
+	Version int `json:"version"`
+}
+
+// ReadHoldMark reads the given hold mark file from <dir>/hold-mark.json in bucket.
+func ReadHoldMark(ctx context.Context, bkt objstore.InstrumentedBucketReader, logger log.Logger, dir string) (*HoldMark, error) {
+	holdMarkFile := path.Join(dir, HoldMarkFilename)
+
+	r, err := bkt.ReaderWithExpectedErrs(bkt.IsObjNotFoundErr).Get(ctx, holdMarkFile)
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return nil, ErrorHoldMarkNotFound
+		}
+		return nil, errors.Wrapf(err, "get file: %s", holdMarkFile)
+	}
+
+	defer runutil.CloseWithLogOnErr(logger, r, "close bkt hold-mark reader")
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read file: %s", holdMarkFile)
+	}
+
+	holdMark := HoldMark{}
+	if err := json.Unmarshal(content, &holdMark); err != nil {
+		return nil, errors.Wrapf(ErrorUnmarshalHoldMark, "file: %s; err: %v", holdMarkFile, err.Error())
+	}
+
+	if holdMark.Version != HoldMarkVersion1 {
+		return nil, errors.Errorf("unexpected hold-mark file version %d", holdMark.Version)
+	}
+
+	return &holdMark, nil
+}
@@ -0,0 +1,55 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestReadHoldMark(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+
+	{
+		_, err := ReadHoldMark(ctx, bkt, nil, ulid.MustNew(uint64(1), nil).String())
+		testutil.NotOk(t, err)
+		testutil.Equals(t, ErrorHoldMarkNotFound, err)
+	}
+	{
+		id := ulid.MustNew(uint64(2), nil)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), HoldMarkFilename), bytes.NewBufferString("not a valid hold-mark.json")))
+		_, err := ReadHoldMark(ctx, bkt, nil, id.String())
+		testutil.NotOk(t, err)
+		testutil.Equals(t, ErrorUnmarshalHoldMark, errors.Cause(err))
+	}
+	{
+		id := ulid.MustNew(uint64(3), nil)
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&HoldMark{ID: id, HoldTime: time.Now().Unix(), Version: 2}))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), HoldMarkFilename), &buf))
+		_, err := ReadHoldMark(ctx, bkt, nil, id.String())
+		testutil.NotOk(t, err)
+		testutil.Equals(t, "unexpected hold-mark file version 2", err.Error())
+	}
+	{
+		id := ulid.MustNew(uint64(4), nil)
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&HoldMark{ID: id, HoldTime: 123, Reason: "case 42", Version: HoldMarkVersion1}))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), HoldMarkFilename), &buf))
+		m, err := ReadHoldMark(ctx, bkt, nil, id.String())
+		testutil.Ok(t, err)
+		testutil.Equals(t, &HoldMark{ID: id, HoldTime: 123, Reason: "case 42", Version: HoldMarkVersion1}, m)
+	}
+}
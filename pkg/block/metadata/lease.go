@@ -0,0 +1,80 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// CompactorLeaseFilename is the known json filename of the compactor lease, stored in the root of the bucket. It is
+	// renewed by the compactor holding it, so other compactors can tell the bucket is being compacted.
+	CompactorLeaseFilename = "compactor-lease.json"
+
+	// CompactorLeaseVersion1 is the version of compactor lease file supported by Thanos.
+	CompactorLeaseVersion1 = 1
+)
+
+// ErrorCompactorLeaseNotFound is the error when compactor-lease.json file is not found.
+var ErrorCompactorLeaseNotFound = errors.New("compactor-lease.json not found")
+
+// ErrorUnmarshalCompactorLease is the error when unmarshalling compactor-lease.json file.
+var ErrorUnmarshalCompactorLease = errors.New("unmarshal compactor-lease.json")
+
+// CompactorLease stores who holds the lease of compacting the bucket and until when.
+type CompactorLease struct {
+	// Holder is the identity of the compactor holding the lease, e.g. its creator ID.
+	Holder string `json:"holder"`
+
+	// RenewTime is a unix timestamp of when the lease was renewed.
+	RenewTime int64 `json:"renew_time"`
+
+	// ExpiryTime is a unix timestamp of when the lease expires unless renewed.
+	ExpiryTime int64 `json:"expiry_time"`
+
+	// Version of the file.
+	Version int `json:"version"`
+}
+
+// Active returns true if the lease has not expired at the given time.
+func (l *CompactorLease) Active(now time.Time) bool {
+	return now.Before(time.Unix(l.ExpiryTime, 0))
+}
+
+// ReadCompactorLease reads the compactor lease from compactor-lease.json in the root of the bucket.
+func ReadCompactorLease(ctx context.Context, bkt objstore.InstrumentedBucketReader, logger log.Logger) (*CompactorLease, error) {
+	r, err := bkt.ReaderWithExpectedErrs(bkt.IsObjNotFoundErr).Get(ctx, CompactorLeaseFilename)
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return nil, ErrorCompactorLeaseNotFound
+		}
+		return nil, errors.Wrapf(err, "get file: %s", CompactorLeaseFilename)
+	}
+
+	defer runutil.CloseWithLogOnErr(logger, r, "close bkt compactor-lease reader")
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read file: %s", CompactorLeaseFilename)
+	}
+
+	lease := CompactorLease{}
+	if err := json.Unmarshal(content, &lease); err != nil {
+		return nil, errors.Wrapf(ErrorUnmarshalCompactorLease, "file: %s; err: %v", CompactorLeaseFilename, err.Error())
+	}
+
+	if lease.Version != CompactorLeaseVersion1 {
+		return nil, errors.Errorf("unexpected compactor-lease file version %d", lease.Version)
+	}
+
+	return &lease, nil
+}
@@ -0,0 +1,170 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"sort"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// ErrorBlockNotFound is the error when the block to build lineage of is unknown.
+var ErrorBlockNotFound = errors.New("block not found")
+
+// LineageEdgeKind describes how a block was created from its parent.
+type LineageEdgeKind string
+
+const (
+	// CompactionEdge links a source block of a compaction with the compacted block.
+	CompactionEdge LineageEdgeKind = "compaction"
+	// DownsamplingEdge links a block with the block downsampled from it.
+	DownsamplingEdge LineageEdgeKind = "downsampling"
+)
+
+// LineageNode describes a block of a lineage. Blocks that are no longer in the bucket are described only by what their
+// children recorded about them: their ID and time range.
+type LineageNode struct {
+	ULID    ulid.ULID `json:"ulid"`
+	MinTime int64     `json:"minTime"`
+	MaxTime int64     `json:"maxTime"`
+
+	// InBucket is true if meta of the block was found, so the fields below are known.
+	InBucket   bool       `json:"inBucket"`
+	Level      int        `json:"level,omitempty"`
+	Resolution int64      `json:"resolution"`
+	Source     SourceType `json:"source,omitempty"`
+}
+
+// LineageEdge links a block with a block directly created from it.
+type LineageEdge struct {
+	Parent ulid.ULID       `json:"parent"`
+	Child  ulid.ULID       `json:"child"`
+	Kind   LineageEdgeKind `json:"kind"`
+}
+
+// Lineage is the DAG of all known ancestors of a block, i.e. blocks it was compacted or downsampled from, transitively.
+type Lineage struct {
+	// Block is the ID of the block the lineage was built for.
+	Block ulid.ULID `json:"block"`
+	// Nodes are the block and all its known ancestors, sorted by ID.
+	Nodes []LineageNode `json:"nodes"`
+	// Edges link each node with its parents, sorted by child and parent.
+	Edges []LineageEdge `json:"edges"`
+	// Sources are IDs of the level 1 blocks the data of the block came from, even if the intermediate blocks are unknown.
+	Sources []ulid.ULID `json:"sources"`
+}
+
+// BlockLineage walks parents recorded in compaction metadata of the block with the given ID across the given metas and
+// returns the DAG of all its ancestors. Downsampled blocks keep the compaction metadata of the block they were
+// downsampled from, so that block is found as the one with the same labels and sources and the closest lower resolution.
+// Walking stops at blocks whose meta is not given, e.g. because they were deleted after compaction.
+func BlockLineage(id ulid.ULID, metas map[ulid.ULID]*Meta) (*Lineage, error) {
+	m, ok := metas[id]
+	if !ok {
+		return nil, errors.Wrapf(ErrorBlockNotFound, "block %s", id)
+	}
+
+	l := &Lineage{Block: id, Edges: []LineageEdge{}, Sources: append([]ulid.ULID(nil), m.Compaction.Sources...)}
+	nodes := map[ulid.ULID]LineageNode{}
+	addMeta := func(m *Meta) {
+		nodes[m.ULID] = LineageNode{
+			ULID:       m.ULID,
+			MinTime:    m.MinTime,
+			MaxTime:    m.MaxTime,
+			InBucket:   true,
+			Level:      m.Compaction.Level,
+			Resolution: m.Thanos.Downsample.Resolution,
+			Source:     m.Thanos.Source,
+		}
+	}
+
+	addMeta(m)
+	queue := []*Meta{m}
+	for len(queue) > 0 {
+		m, queue = queue[0], queue[1:]
+
+		if origin := downsamplingOrigin(m, metas); origin != nil {
+			l.Edges = append(l.Edges, LineageEdge{Parent: origin.ULID, Child: m.ULID, Kind: DownsamplingEdge})
+			if _, ok := nodes[origin.ULID]; !ok {
+				addMeta(origin)
+				queue = append(queue, origin)
+			}
+			// Parents recorded in the downsampled block are parents of its origin.
+			continue
+		}
+
+		for _, p := range m.Compaction.Parents {
+			// Guard against broken metas listing the block as its own parent.
+			if p.ULID == m.ULID {
+				continue
+			}
+			l.Edges = append(l.Edges, LineageEdge{Parent: p.ULID, Child: m.ULID, Kind: CompactionEdge})
+			if _, ok := nodes[p.ULID]; ok {
+				continue
+			}
+			if pm, ok := metas[p.ULID]; ok {
+				addMeta(pm)
+				queue = append(queue, pm)
+				continue
+			}
+			nodes[p.ULID] = LineageNode{ULID: p.ULID, MinTime: p.MinTime, MaxTime: p.MaxTime}
+		}
+	}
+
+	l.Nodes = make([]LineageNode, 0, len(nodes))
+	for _, n := range nodes {
+		l.Nodes = append(l.Nodes, n)
+	}
+	sort.Slice(l.Nodes, func(i, j int) bool { return l.Nodes[i].ULID.Compare(l.Nodes[j].ULID) < 0 })
+	sort.Slice(l.Edges, func(i, j int) bool {
+		if c := l.Edges[i].Child.Compare(l.Edges[j].Child); c != 0 {
+			return c < 0
+		}
+		return l.Edges[i].Parent.Compare(l.Edges[j].Parent) < 0
+	})
+	sort.Slice(l.Sources, func(i, j int) bool { return l.Sources[i].Compare(l.Sources[j]) < 0 })
+	return l, nil
+}
+
+// downsamplingOrigin returns meta of the block the given block was downsampled from, or nil if it is not a downsampled
+// block or its origin is unknown.
+func downsamplingOrigin(m *Meta, metas map[ulid.ULID]*Meta) *Meta {
+	if m.Thanos.Downsample.Resolution == 0 {
+		return nil
+	}
+	lset := labels.FromMap(m.Thanos.Labels)
+
+	var origin *Meta
+	for _, o := range metas {
+		if o.Thanos.Downsample.Resolution >= m.Thanos.Downsample.Resolution {
+			continue
+		}
+		if origin != nil && o.Thanos.Downsample.Resolution <= origin.Thanos.Downsample.Resolution {
+			continue
+		}
+		if !sameSources(o.Compaction.Sources, m.Compaction.Sources) || !labels.Equal(labels.FromMap(o.Thanos.Labels), lset) {
+			continue
+		}
+		origin = o
+	}
+	return origin
+}
+
+func sameSources(a, b []ulid.ULID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	uniq := make(map[ulid.ULID]struct{}, len(a))
+	for _, id := range a {
+		uniq[id] = struct{}{}
+	}
+	for _, id := range b {
+		if _, ok := uniq[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestBlockLineage(t *testing.T) {
+	var (
+		a, b, c = ulid.MustNew(1, nil), ulid.MustNew(2, nil), ulid.MustNew(3, nil)
+		d, e    = ulid.MustNew(4, nil), ulid.MustNew(5, nil)
+		e5m     = ulid.MustNew(6, nil)
+		other   = ulid.MustNew(7, nil)
+	)
+	lset := map[string]string{"cluster": "a"}
+	meta := func(id ulid.ULID, minTime, maxTime int64, level int, res int64, sources []ulid.ULID, parents ...tsdb.BlockDesc) *Meta {
+		return &Meta{
+			BlockMeta: tsdb.BlockMeta{
+				ULID:    id,
+				MinTime: minTime,
+				MaxTime: maxTime,
+				Compaction: tsdb.BlockMetaCompaction{
+					Level:   level,
+					Sources: sources,
+					Parents: parents,
+				},
+			},
+			Thanos: Thanos{Labels: lset, Downsample: ThanosDownsample{Resolution: res}, Source: SidecarSource},
+		}
+	}
+
+	// Block a was already deleted after compaction into d. Block e5m is downsampled from e, so it carries e's compaction.
+	metas := map[ulid.ULID]*Meta{
+		b:     meta(b, 10, 20, 1, 0, []ulid.ULID{b}),
+		c:     meta(c, 20, 30, 1, 0, []ulid.ULID{c}),
+		d:     meta(d, 0, 20, 2, 0, []ulid.ULID{a, b}, tsdb.BlockDesc{ULID: a, MinTime: 0, MaxTime: 10}, tsdb.BlockDesc{ULID: b, MinTime: 10, MaxTime: 20}),
+		e:     meta(e, 0, 30, 3, 0, []ulid.ULID{a, b, c}, tsdb.BlockDesc{ULID: d, MinTime: 0, MaxTime: 20}, tsdb.BlockDesc{ULID: c, MinTime: 20, MaxTime: 30}),
+		e5m:   meta(e5m, 0, 30, 3, 300000, []ulid.ULID{c, a, b}, tsdb.BlockDesc{ULID: d, MinTime: 0, MaxTime: 20}, tsdb.BlockDesc{ULID: c, MinTime: 20, MaxTime: 30}),
+		other: meta(other, 30, 40, 1, 0, []ulid.ULID{other}),
+	}
+	metas[d].Thanos.Source = CompactorSource
+	metas[e].Thanos.Source = CompactorSource
+	metas[e5m].Thanos.Source = CompactorSource
+
+	l, err := BlockLineage(e5m, metas)
+	testutil.Ok(t, err)
+	testutil.Equals(t, &Lineage{
+		Block: e5m,
+		Nodes: []LineageNode{
+			{ULID: a, MinTime: 0, MaxTime: 10},
+			{ULID: b, MinTime: 10, MaxTime: 20, InBucket: true, Level: 1, Source: SidecarSource},
+			{ULID: c, MinTime: 20, MaxTime: 30, InBucket: true, Level: 1, Source: SidecarSource},
+			{ULID: d, MinTime: 0, MaxTime: 20, InBucket: true, Level: 2, Source: CompactorSource},
+			{ULID: e, MinTime: 0, MaxTime: 30, InBucket: true, Level: 3, Source: CompactorSource},
+			{ULID: e5m, MinTime: 0, MaxTime: 30, InBucket: true, Level: 3, Resolution: 300000, Source: CompactorSource},
+		},
+		Edges: []LineageEdge{
+			{Parent: a, Child: d, Kind: CompactionEdge},
+			{Parent: b, Child: d, Kind: CompactionEdge},
+			{Parent: c, Child: e, Kind: CompactionEdge},
+			{Parent: d, Child: e, Kind: CompactionEdge},
+			{Parent: e, Child: e5m, Kind: DownsamplingEdge},
+		},
+		Sources: []ulid.ULID{a, b, c},
+	}, l)
+
+	// Without its origin, parents of a downsampled block are the ones it inherited.
+	delete(metas, e)
+	l, err = BlockLineage(e5m, metas)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []LineageEdge{
+		{Parent: a, Child: d, Kind: CompactionEdge},
+		{Parent: b, Child: d, Kind: CompactionEdge},
+		{Parent: c, Child: e5m, Kind: CompactionEdge},
+		{Parent: d, Child: e5m, Kind: CompactionEdge},
+	}, l.Edges)
+
+	l, err = BlockLineage(other, metas)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(l.Nodes))
+	testutil.Equals(t, 0, len(l.Edges))
+
+	_, err = BlockLineage(a, metas)
+	testutil.Equals(t, ErrorBlockNotFound, errors.Cause(err))
+}
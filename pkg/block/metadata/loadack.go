@@ -0,0 +1,81 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// LoadAcksDir is the directory in the root of the bucket holding load acknowledgements of store gateways, one
+	// <id>.json file per store gateway.
+	LoadAcksDir = "store-acks"
+
+	// LoadAckVersion1 is the version of load acknowledgement file supported by Thanos.
+	LoadAckVersion1 = 1
+)
+
+// LoadAck acknowledges blocks loaded by a store gateway as of its last sync, so the compactor can tell when a compacted
+// block replaces its sources in all store gateways.
+type LoadAck struct {
+	// ID is the identifier of the store gateway, unique among store gateways of the bucket.
+	ID string `json:"id"`
+
+	// UpdatedAt is a unix timestamp of the sync the acknowledgement was written after.
+	UpdatedAt int64 `json:"updated_at"`
+
+	// Blocks are all blocks loaded by the store gateway.
+	Blocks []ulid.ULID `json:"blocks"`
+
+	// Version of the file.
+	Version int `json:"version"`
+}
+
+// Updated returns time of the sync the acknowledgement was written after.
+func (a *LoadAck) Updated() time.Time {
+	return time.Unix(a.UpdatedAt, 0)
+}
+
+// ReadLoadAcks reads load acknowledgements of all store gateways from LoadAcksDir. Acknowledgements that cannot be
+// parsed are skipped, as store gateways overwrite them on the next sync.
+func ReadLoadAcks(ctx context.Context, bkt objstore.BucketReader, logger log.Logger) ([]*LoadAck, error) {
+	var acks []*LoadAck
+	if err := bkt.Iter(ctx, LoadAcksDir, func(name string) error {
+		if path.Ext(name) != ".json" {
+			return nil
+		}
+		r, err := bkt.Get(ctx, name)
+		if err != nil {
+			if bkt.IsObjNotFoundErr(err) {
+				return nil
+			}
+			return errors.Wrapf(err, "get file: %s", name)
+		}
+		defer runutil.CloseWithLogOnErr(logger, r, "close bkt load ack reader")
+
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return errors.Wrapf(err, "read file: %s", name)
+		}
+		ack := LoadAck{}
+		if err := json.Unmarshal(content, &ack); err != nil || ack.Version != LoadAckVersion1 {
+			return nil
+		}
+		acks = append(acks, &ack)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "list load acks")
+	}
+	return acks, nil
+}
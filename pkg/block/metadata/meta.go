@@ -10,7 +10,7 @@ package metadata
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"io"
 	"os"
 	"path/filepath"
 
@@ -32,6 +32,7 @@ const (
 	RulerSource           SourceType = "ruler"
 	BucketRepairSource    SourceType = "bucket.repair"
 	TestSource            SourceType = "test"
+	ImportSource          SourceType = "import"
 )
 
 const (
@@ -42,6 +43,9 @@ const (
 const (
 	// MetaVersion is a enumeration of meta versions supported by Thanos.
 	MetaVersion1 = iota + 1
+
+	// MetaVersionLatest is the latest meta version known to this version of Thanos.
+	MetaVersionLatest = MetaVersion1
 )
 
 // Meta describes the a block's meta. It wraps the known TSDB meta structure and
@@ -50,6 +54,10 @@ type Meta struct {
 	tsdb.BlockMeta
 
 	Thanos Thanos `json:"thanos"`
+
+	// unknownFields are top level fields of meta.json unknown to this version of Thanos, e.g. added by a newer meta
+	// version. They are kept, so they are not lost when the meta is written back.
+	unknownFields map[string]json.RawMessage
 }
 
 // Thanos holds block meta information specific to Thanos.
@@ -59,6 +67,21 @@ type Thanos struct {
 
 	// Source is a real upload source of the block.
 	Source SourceType `json:"source"`
+
+	// Provenance lists sorted ingestion paths which contributed data to the block, when it was derived from other
+	// blocks, e.g. by compaction. See IngestionSources.
+	Provenance []SourceType `json:"provenance,omitempty"`
+
+	// Extensions are custom fields of the block, e.g. team ownership or data classification, propagated to blocks created
+	// from it. See MergeExtensions.
+	Extensions map[string]string `json:"extensions,omitempty"`
+
+	// Files lists files of the block but meta.json with their sizes, and optionally hashes, as uploaded. It is set by
+	// block.Upload, see File.
+	Files []File `json:"files,omitempty"`
+
+	// unknownFields are fields of the Thanos section of meta.json unknown to this version of Thanos.
+	unknownFields map[string]json.RawMessage
 }
 
 type ThanosDownsample struct {
@@ -97,10 +120,7 @@ func Write(logger log.Logger, dir string, meta *Meta) error {
 		return err
 	}
 
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "\t")
-
-	if err := enc.Encode(meta); err != nil {
+	if err := Encode(f, meta); err != nil {
 		runutil.CloseWithLogOnErr(logger, f, "close meta")
 		return err
 	}
@@ -110,6 +130,13 @@ func Write(logger log.Logger, dir string, meta *Meta) error {
 	return renameFile(logger, tmp, path)
 }
 
+// Encode writes the given meta in the format of meta.json files written by Write.
+func Encode(w io.Writer, meta *Meta) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(meta)
+}
+
 func renameFile(logger log.Logger, from, to string) error {
 	if err := os.RemoveAll(to); err != nil {
 		return err
@@ -131,19 +158,7 @@ func renameFile(logger log.Logger, from, to string) error {
 	return pdir.Close()
 }
 
-// Read reads the given meta from <dir>/meta.json.
+// Read reads the given meta from <dir>/meta.json. Only metas of versions known to this version of Thanos are accepted.
 func Read(dir string) (*Meta, error) {
-	b, err := ioutil.ReadFile(filepath.Join(dir, MetaFilename))
-	if err != nil {
-		return nil, err
-	}
-	var m Meta
-
-	if err := json.Unmarshal(b, &m); err != nil {
-		return nil, err
-	}
-	if m.Version != MetaVersion1 {
-		return nil, errors.Errorf("unexpected meta file version %d", m.Version)
-	}
-	return &m, nil
+	return ReadMaxVersion(dir, MetaVersionLatest)
 }
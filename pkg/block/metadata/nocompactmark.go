@@ -0,0 +1,90 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// NoCompactMarkFilename is the known json filename to store details about why block is excluded from compaction.
+	// Blocks marked for no compaction are still queried, removed by retention and garbage collected.
+	NoCompactMarkFilename = "no-compact-mark.json"
+
+	// NoCompactMarkVersion1 is the version of no-compact-mark file supported by Thanos.
+	NoCompactMarkVersion1 = 1
+)
+
+// NoCompactReason is a reason for a block to be excluded from compaction.
+type NoCompactReason string
+
+const (
+	// TerminalNoCompactReason is the reason of blocks which can never be compacted, as no other block of their group can
+	// ever be compacted with them.
+	TerminalNoCompactReason NoCompactReason = "terminal"
+)
+
+// ErrorNoCompactMarkNotFound is the error when no-compact-mark.json file is not found.
+var ErrorNoCompactMarkNotFound = errors.New("no-compact-mark.json not found")
+
+// ErrorUnmarshalNoCompactMark is the error when unmarshalling no-compact-mark.json file.
+var ErrorUnmarshalNoCompactMark = errors.New("unmarshal no-compact-mark.json")
+
+// NoCompactMark stores block id, when and why the block was excluded from compaction.
+type NoCompactMark struct {
+	// ID of the tsdb block.
+	ID ulid.ULID `json:"id"`
+
+	// NoCompactTime is a unix timestamp of when the block was marked for no compaction.
+	NoCompactTime int64 `json:"no_compact_time"`
+
+	// Reason is the reason of the mark.
+	Reason NoCompactReason `json:"reason"`
+
+	// Details is a human readable explanation of the reason.
+	Details string `json:"details,omitempty"`
+
+	// Version of the file.
+	Version int `json:"version"`
+}
+
+// ReadNoCompactMark reads the given no-compact mark file from <dir>/no-compact-mark.json in bucket.
+func ReadNoCompactMark(ctx context.Context, bkt objstore.InstrumentedBucketReader, logger log.Logger, dir string) (*NoCompactMark, error) {
+	noCompactMarkFile := path.Join(dir, NoCompactMarkFilename)
+
+	r, err := bkt.ReaderWithExpectedErrs(bkt.IsObjNotFoundErr).Get(ctx, noCompactMarkFile)
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return nil, ErrorNoCompactMarkNotFound
+		}
+		return nil, errors.Wrapf(err, "get file: %s", noCompactMarkFile)
+	}
+
+	defer runutil.CloseWithLogOnErr(logger, r, "close bkt no-compact-mark reader")
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read file: %s", noCompactMarkFile)
+	}
+
+	noCompactMark := NoCompactMark{}
+	if err := json.Unmarshal(content, &noCompactMark); err != nil {
+		return nil, errors.Wrapf(ErrorUnmarshalNoCompactMark, "file: %s; err: %v", noCompactMarkFile, err.Error())
+	}
+
+	if noCompactMark.Version != NoCompactMarkVersion1 {
+		return nil, errors.Errorf("unexpected no-compact-mark file version %d", noCompactMark.Version)
+	}
+
+	return &noCompactMark, nil
+}
@@ -0,0 +1,89 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// PendingCommitsDir is the directory in the root of the bucket holding pending commits of blocks uploaded together,
+	// one json file per commit named by its ID. Blocks of a pending commit must not be read, even if they have meta.json,
+	// as some of the other blocks of the commit may be missing yet.
+	PendingCommitsDir = "pending-commits"
+
+	// PendingCommitVersion1 is the version of pending commit file supported by Thanos.
+	PendingCommitVersion1 = 1
+)
+
+// ErrorUnmarshalPendingCommit is the error when unmarshalling a pending commit file.
+var ErrorUnmarshalPendingCommit = errors.New("unmarshal pending commit")
+
+// PendingCommit stores blocks uploaded together, e.g. all output blocks of a single compaction, until all of them are
+// uploaded.
+type PendingCommit struct {
+	// ID of the commit.
+	ID ulid.ULID `json:"id"`
+
+	// Group is the key of the compaction group of the blocks, if any.
+	Group string `json:"group,omitempty"`
+
+	// Blocks are IDs of the blocks of the commit, sorted.
+	Blocks []ulid.ULID `json:"blocks"`
+
+	// Version of the file.
+	Version int `json:"version"`
+}
+
+// PendingCommitFile returns the name of the file of the pending commit with the given ID in the bucket.
+func PendingCommitFile(id ulid.ULID) string {
+	return path.Join(PendingCommitsDir, id.String()+".json")
+}
+
+// ReadPendingCommits reads all pending commits in PendingCommitsDir of the bucket. Commits removed while being read are
+// skipped, as they are not pending anymore.
+func ReadPendingCommits(ctx context.Context, bkt objstore.InstrumentedBucketReader, logger log.Logger) ([]PendingCommit, error) {
+	var res []PendingCommit
+	err := bkt.Iter(ctx, PendingCommitsDir, func(name string) error {
+		if !strings.HasSuffix(name, ".json") {
+			return nil
+		}
+		r, err := bkt.ReaderWithExpectedErrs(bkt.IsObjNotFoundErr).Get(ctx, name)
+		if err != nil {
+			if bkt.IsObjNotFoundErr(err) {
+				return nil
+			}
+			return errors.Wrapf(err, "get file: %s", name)
+		}
+		defer runutil.CloseWithLogOnErr(logger, r, "close bkt pending commit reader")
+
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return errors.Wrapf(err, "read file: %s", name)
+		}
+		commit := PendingCommit{}
+		if err := json.Unmarshal(content, &commit); err != nil {
+			return errors.Wrapf(ErrorUnmarshalPendingCommit, "file: %s; err: %v", name, err.Error())
+		}
+		if commit.Version != PendingCommitVersion1 {
+			return errors.Errorf("unexpected pending commit file %s version %d", name, commit.Version)
+		}
+		res = append(res, commit)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "iter %s", PendingCommitsDir)
+	}
+	return res, nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// PendingDeletionsFilename is the known json filename to store deletion intents of series in the block which are
+	// not yet applied. Until the compactor rewrites the block, readers of the block can use them to mask deleted data.
+	PendingDeletionsFilename = "pending-deletions.json"
+
+	// PendingDeletionsVersion1 is the version of pending-deletions file supported by Thanos.
+	PendingDeletionsVersion1 = 1
+)
+
+// ErrorPendingDeletionsNotFound is the error when pending-deletions.json file is not found.
+var ErrorPendingDeletionsNotFound = errors.New("pending-deletions.json not found")
+
+// ErrorUnmarshalPendingDeletions is the error when unmarshalling pending-deletions.json file.
+var ErrorUnmarshalPendingDeletions = errors.New("unmarshal pending-deletions.json")
+
+// DeletionIntent describes samples requested to be deleted from the block.
+type DeletionIntent struct {
+	// Matchers is a series selector, e.g. {job="foo"}, of series the samples are deleted from.
+	Matchers string `json:"matchers"`
+
+	// MinTime and MaxTime are the inclusive time range in milliseconds of the deleted samples.
+	MinTime int64 `json:"min_time"`
+	MaxTime int64 `json:"max_time"`
+
+	// RequestTime is a unix timestamp of when the deletion was requested.
+	RequestTime int64 `json:"request_time"`
+
+	// Reason is a human readable reason of the deletion.
+	Reason string `json:"reason,omitempty"`
+}
+
+// ParseMatchers parses the series selector of the intent.
+func (i DeletionIntent) ParseMatchers() ([]*labels.Matcher, error) {
+	return parser.ParseMetricSelector(i.Matchers)
+}
+
+// Masks returns true if sample of the series with given labels and timestamp is deleted by the intent.
+func (i DeletionIntent) Masks(matchers []*labels.Matcher, lset labels.Labels, t int64) bool {
+	if t < i.MinTime || t > i.MaxTime {
+		return false
+	}
+	for _, m := range matchers {
+		if !m.Matches(lset.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// PendingDeletions stores block id and deletion intents not yet applied to the block.
+type PendingDeletions struct {
+	// ID of the tsdb block.
+	ID ulid.ULID `json:"id"`
+
+	// Intents are deletions in the order they were requested.
+	Intents []DeletionIntent `json:"intents"`
+
+	// Version of the file.
+	Version int `json:"version"`
+}
+
+// ReadPendingDeletions reads the given pending deletions file from <dir>/pending-deletions.json in bucket.
+func ReadPendingDeletions(ctx context.Context, bkt objstore.InstrumentedBucketReader, logger log.Logger, dir string) (*PendingDeletions, error) {
+	pendingDeletionsFile := path.Join(dir, PendingDeletionsFilename)
+
+	r, err := bkt.ReaderWithExpectedErrs(bkt.IsObjNotFoundErr).Get(ctx, pendingDeletionsFile)
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return nil, ErrorPendingDeletionsNotFound
+		}
+		return nil, errors.Wrapf(err, "get file: %s", pendingDeletionsFile)
+	}
+
+	defer runutil.CloseWithLogOnErr(logger, r, "close bkt pending-deletions reader")
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read file: %s", pendingDeletionsFile)
+	}
+
+	pendingDeletions := PendingDeletions{}
+	if err := json.Unmarshal(content, &pendingDeletions); err != nil {
+		return nil, errors.Wrapf(ErrorUnmarshalPendingDeletions, "file: %s; err: %v", pendingDeletionsFile, err.Error())
+	}
+
+	if pendingDeletions.Version != PendingDeletionsVersion1 {
+		return nil, errors.Errorf("unexpected pending-deletions file version %d", pendingDeletions.Version)
+	}
+
+	return &pendingDeletions, nil
+}
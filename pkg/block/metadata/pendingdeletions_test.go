@@ -0,0 +1,76 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestReadPendingDeletions(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+
+	{
+		_, err := ReadPendingDeletions(ctx, bkt, nil, ulid.MustNew(uint64(1), nil).String())
+		testutil.NotOk(t, err)
+		testutil.Equals(t, ErrorPendingDeletionsNotFound, err)
+	}
+	{
+		id := ulid.MustNew(uint64(2), nil)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), PendingDeletionsFilename), bytes.NewBufferString("not a valid pending-deletions.json")))
+		_, err := ReadPendingDeletions(ctx, bkt, nil, id.String())
+		testutil.NotOk(t, err)
+		testutil.Equals(t, ErrorUnmarshalPendingDeletions, errors.Cause(err))
+	}
+	{
+		id := ulid.MustNew(uint64(3), nil)
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&PendingDeletions{ID: id, Version: 2}))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), PendingDeletionsFilename), &buf))
+		_, err := ReadPendingDeletions(ctx, bkt, nil, id.String())
+		testutil.NotOk(t, err)
+		testutil.Equals(t, "unexpected pending-deletions file version 2", err.Error())
+	}
+	{
+		id := ulid.MustNew(uint64(4), nil)
+		expected := &PendingDeletions{
+			ID:      id,
+			Intents: []DeletionIntent{{Matchers: `{job="foo"}`, MinTime: 10, MaxTime: 20, RequestTime: 123, Reason: "GDPR"}},
+			Version: PendingDeletionsVersion1,
+		}
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(expected))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), PendingDeletionsFilename), &buf))
+		p, err := ReadPendingDeletions(ctx, bkt, nil, id.String())
+		testutil.Ok(t, err)
+		testutil.Equals(t, expected, p)
+	}
+}
+
+func TestDeletionIntent_Masks(t *testing.T) {
+	i := DeletionIntent{Matchers: `{job="foo", instance=~"a|b"}`, MinTime: 10, MaxTime: 20}
+	matchers, err := i.ParseMatchers()
+	testutil.Ok(t, err)
+
+	lset := labels.FromStrings("job", "foo", "instance", "a")
+	testutil.Assert(t, i.Masks(matchers, lset, 10))
+	testutil.Assert(t, i.Masks(matchers, lset, 20))
+	testutil.Assert(t, !i.Masks(matchers, lset, 21))
+	testutil.Assert(t, !i.Masks(matchers, labels.FromStrings("job", "foo", "instance", "c"), 15))
+	testutil.Assert(t, !i.Masks(matchers, labels.FromStrings("instance", "a"), 15))
+
+	_, err = DeletionIntent{Matchers: "{"}.ParseMatchers()
+	testutil.NotOk(t, err)
+}
@@ -0,0 +1,16 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import "github.com/oklog/ulid"
+
+// ReaderPinsPath is the HTTP path store gateways serve ReaderPins under.
+const ReaderPinsPath = "/api/v1/pinned-blocks"
+
+// ReaderPins lists blocks pinned by a reader, i.e. read by its queries in flight, so the compactor can defer deleting
+// them until queries are done.
+type ReaderPins struct {
+	// Blocks are all blocks pinned by the reader.
+	Blocks []ulid.ULID `json:"blocks"`
+}
@@ -0,0 +1,82 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"sort"
+
+	"github.com/oklog/ulid"
+)
+
+// IsDerivedSource returns true if blocks uploaded by the given source are created from other blocks (e.g. compacted,
+// downsampled or repaired) instead of being ingested.
+func IsDerivedSource(s SourceType) bool {
+	switch s {
+	case CompactorSource, CompactorRepairSource, BucketRepairSource:
+		return true
+	}
+	return false
+}
+
+// IngestionSources returns sorted ingestion paths (e.g. sidecar, receive or ruler) that contributed data to the block.
+// For blocks created before provenance was tracked it falls back to Source, if it's not a derived one. Nil is returned
+// if ingestion paths are unknown.
+func (m Thanos) IngestionSources() []SourceType {
+	if len(m.Provenance) > 0 {
+		return m.Provenance
+	}
+	if m.Source == UnknownSource || IsDerivedSource(m.Source) {
+		return nil
+	}
+	return []SourceType{m.Source}
+}
+
+// HasIngestionSource returns true if the given ingestion path contributed data to the block.
+func (m Thanos) HasIngestionSource(s SourceType) bool {
+	for _, src := range m.IngestionSources() {
+		if src == s {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeProvenance returns sorted, unique ingestion paths of all given blocks, to be used as provenance of a block created
+// from them.
+func MergeProvenance(metas ...Thanos) []SourceType {
+	uniq := map[SourceType]struct{}{}
+	for _, m := range metas {
+		for _, src := range m.IngestionSources() {
+			uniq[src] = struct{}{}
+		}
+	}
+	if len(uniq) == 0 {
+		return nil
+	}
+	res := make([]SourceType, 0, len(uniq))
+	for src := range uniq {
+		res = append(res, src)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// BlocksByIngestionSource returns sorted IDs of given blocks grouped by ingestion paths that contributed data to them.
+// Blocks with unknown ingestion paths are grouped under UnknownSource.
+func BlocksByIngestionSource(metas map[ulid.ULID]*Meta) map[SourceType][]ulid.ULID {
+	res := map[SourceType][]ulid.ULID{}
+	for id, m := range metas {
+		srcs := m.Thanos.IngestionSources()
+		if len(srcs) == 0 {
+			srcs = []SourceType{UnknownSource}
+		}
+		for _, src := range srcs {
+			res[src] = append(res[src], id)
+		}
+	}
+	for _, ids := range res {
+		sort.Slice(ids, func(i, j int) bool { return ids[i].Compare(ids[j]) < 0 })
+	}
+	return res
+}
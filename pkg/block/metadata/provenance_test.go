@@ -0,0 +1,39 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"testing"
+
+	"github.com/oklog/ulid"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestProvenance(t *testing.T) {
+	sidecar := Thanos{Source: SidecarSource}
+	receive := Thanos{Source: ReceiveSource}
+	legacyCompacted := Thanos{Source: CompactorSource}
+	compacted := Thanos{Source: CompactorSource, Provenance: []SourceType{RulerSource, SidecarSource}}
+
+	testutil.Equals(t, []SourceType{SidecarSource}, sidecar.IngestionSources())
+	testutil.Equals(t, []SourceType(nil), legacyCompacted.IngestionSources())
+	testutil.Equals(t, []SourceType(nil), Thanos{}.IngestionSources())
+	testutil.Assert(t, compacted.HasIngestionSource(RulerSource), "expected ruler provenance")
+	testutil.Assert(t, !compacted.HasIngestionSource(CompactorSource), "compactor is not an ingestion source")
+
+	testutil.Equals(t, []SourceType{ReceiveSource, RulerSource, SidecarSource}, MergeProvenance(sidecar, receive, legacyCompacted, compacted))
+	testutil.Equals(t, []SourceType(nil), MergeProvenance(legacyCompacted))
+
+	id1, id2, id3 := ulid.MustNew(1, nil), ulid.MustNew(2, nil), ulid.MustNew(3, nil)
+	testutil.Equals(t, map[SourceType][]ulid.ULID{
+		SidecarSource: {id1, id3},
+		RulerSource:   {id3},
+		UnknownSource: {id2},
+	}, BlocksByIngestionSource(map[ulid.ULID]*Meta{
+		id1: {Thanos: sidecar},
+		id2: {Thanos: legacyCompacted},
+		id3: {Thanos: compacted},
+	}))
+}
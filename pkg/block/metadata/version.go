@@ -0,0 +1,177 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// Metas may be written by Thanos versions both older and newer than the reading one, e.g. during a rolling upgrade of
+// sidecars and compactors. Readers can accept metas of versions newer than MetaVersionLatest with ReadMaxVersion or
+// Parse. Such metas are parsed by the fields known to this version of Thanos, while unknown fields are kept and written
+// back as they were, so a meta rewritten by an older Thanos version, e.g. when migrating its external labels, is not
+// corrupted for the newer ones. Writers can convert metas to the version expected by their readers with WriteVersion.
+
+// ReadMaxVersion reads the given meta from <dir>/meta.json, accepting metas of versions up to maxVersion.
+func ReadMaxVersion(dir string, maxVersion int) (*Meta, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, MetaFilename))
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b, maxVersion)
+}
+
+// Parse parses the meta.json content, accepting metas of versions up to maxVersion. The version of the parsed meta is
+// the one found in the content. Fields unknown to this version of Thanos are kept.
+func Parse(b []byte, maxVersion int) (*Meta, error) {
+	var m Meta
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	if m.Version < MetaVersion1 || m.Version > maxVersion {
+		return nil, errors.Errorf("unexpected meta file version %d", m.Version)
+	}
+	return &m, nil
+}
+
+// WriteVersion writes the given meta converted to the given version into <dir>/meta.json.
+func WriteVersion(logger log.Logger, dir string, meta *Meta, version int) error {
+	converted, err := meta.ConvertTo(version)
+	if err != nil {
+		return err
+	}
+	return Write(logger, dir, converted)
+}
+
+// ConvertTo returns a copy of the meta converted to the given version, which has to be known to this version of Thanos.
+// Meta downgraded from a version newer than MetaVersionLatest loses all fields unknown to this version of Thanos, as
+// their meaning in the older version is not defined.
+func (m *Meta) ConvertTo(version int) (*Meta, error) {
+	if version < MetaVersion1 || version > MetaVersionLatest {
+		return nil, errors.Errorf("cannot convert meta of block %s to unknown version %d", m.ULID, version)
+	}
+
+	res := *m
+	if version < m.Version {
+		res.unknownFields = nil
+		res.Thanos.unknownFields = nil
+	}
+	// No conversion of fields is needed between versions known so far.
+	res.Version = version
+	return &res, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler, keeping fields unknown to this version of Thanos.
+func (m *Meta) UnmarshalJSON(b []byte) error {
+	type plain Meta
+	if err := json.Unmarshal(b, (*plain)(m)); err != nil {
+		return err
+	}
+	unknown, err := unknownJSONFields(b, reflect.TypeOf(plain{}))
+	if err != nil {
+		return err
+	}
+	m.unknownFields = unknown
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, writing back fields unknown to this version of Thanos.
+func (m Meta) MarshalJSON() ([]byte, error) {
+	type plain Meta
+	return marshalWithUnknownFields(plain(m), m.unknownFields)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, keeping fields unknown to this version of Thanos.
+func (m *Thanos) UnmarshalJSON(b []byte) error {
+	type plain Thanos
+	if err := json.Unmarshal(b, (*plain)(m)); err != nil {
+		return err
+	}
+	unknown, err := unknownJSONFields(b, reflect.TypeOf(plain{}))
+	if err != nil {
+		return err
+	}
+	m.unknownFields = unknown
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, writing back fields unknown to this version of Thanos.
+func (m Thanos) MarshalJSON() ([]byte, error) {
+	type plain Thanos
+	return marshalWithUnknownFields(plain(m), m.unknownFields)
+}
+
+// unknownJSONFields returns fields of the given JSON object which are not decoded into the struct of the given type.
+func unknownJSONFields(b []byte, t reflect.Type) (map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	known := knownJSONFields(t)
+	for name := range fields {
+		// Field names are matched case-insensitively by encoding/json.
+		if _, ok := known[strings.ToLower(name)]; ok {
+			delete(fields, name)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+// knownJSONFields returns lower cased names of JSON fields of the struct of the given type, including fields of embedded
+// structs.
+func knownJSONFields(t reflect.Type) map[string]struct{} {
+	res := map[string]struct{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for n := range knownJSONFields(f.Type) {
+				res[n] = struct{}{}
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			// Unexported field.
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		res[strings.ToLower(name)] = struct{}{}
+	}
+	return res
+}
+
+// marshalWithUnknownFields marshals v, which has to marshal into a JSON object, with the given unknown fields added.
+func marshalWithUnknownFields(v interface{}, unknown map[string]json.RawMessage) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil || len(unknown) == 0 {
+		return b, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range unknown {
+		if _, ok := fields[name]; !ok {
+			fields[name] = value
+		}
+	}
+	return json.Marshal(fields)
+}
@@ -0,0 +1,113 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestParse_Versions(t *testing.T) {
+	id := ulid.MustNew(1, nil)
+	futureMeta := []byte(`{
+	"ulid": "` + id.String() + `",
+	"minTime": 0,
+	"maxTime": 1000,
+	"stats": {},
+	"compaction": {"level": 1},
+	"version": 2,
+	"futureTop": {"a": 1},
+	"thanos": {
+		"labels": {"ext": "1"},
+		"downsample": {"resolution": 0},
+		"source": "sidecar",
+		"futureThanos": "x"
+	}
+}`)
+
+	_, err := Parse(futureMeta, MetaVersionLatest)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, "unexpected meta file version 2", err.Error())
+
+	_, err = Parse([]byte(`{"version": 0}`), MetaVersionLatest)
+	testutil.NotOk(t, err)
+
+	m, err := Parse(futureMeta, 2)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, m.Version)
+	testutil.Equals(t, id, m.ULID)
+	testutil.Equals(t, int64(1000), m.MaxTime)
+	testutil.Equals(t, map[string]string{"ext": "1"}, m.Thanos.Labels)
+	testutil.Equals(t, SidecarSource, m.Thanos.Source)
+
+	// Unknown fields are kept on round trip.
+	b, err := json.Marshal(m)
+	testutil.Ok(t, err)
+	var fields map[string]json.RawMessage
+	testutil.Ok(t, json.Unmarshal(b, &fields))
+	testutil.Equals(t, `{"a":1}`, string(fields["futureTop"]))
+	var thanosFields map[string]json.RawMessage
+	testutil.Ok(t, json.Unmarshal(fields["thanos"], &thanosFields))
+	testutil.Equals(t, `"x"`, string(thanosFields["futureThanos"]))
+
+	again, err := Parse(b, 2)
+	testutil.Ok(t, err)
+	b2, err := json.Marshal(again)
+	testutil.Ok(t, err)
+	testutil.Equals(t, string(b), string(b2))
+
+	// Downgrade drops fields unknown to the target version.
+	downgraded, err := m.ConvertTo(MetaVersion1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, MetaVersion1, downgraded.Version)
+	testutil.Equals(t, 2, m.Version)
+	b, err = json.Marshal(downgraded)
+	testutil.Ok(t, err)
+	fields = nil
+	testutil.Ok(t, json.Unmarshal(b, &fields))
+	_, ok := fields["futureTop"]
+	testutil.Assert(t, !ok, "unknown field kept after downgrade")
+	testutil.Assert(t, downgraded.Thanos.unknownFields == nil, "unknown Thanos fields kept after downgrade")
+
+	_, err = m.ConvertTo(MetaVersionLatest + 1)
+	testutil.NotOk(t, err)
+}
+
+func TestWriteVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-meta-version")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	m := &Meta{Thanos: Thanos{Labels: map[string]string{"ext": "1"}, Source: TestSource}}
+	m.ULID = ulid.MustNew(1, nil)
+	m.Version = 2
+	m.unknownFields = map[string]json.RawMessage{"futureTop": json.RawMessage(`true`)}
+
+	testutil.Ok(t, Write(log.NewNopLogger(), dir, m))
+	_, err = Read(dir)
+	testutil.NotOk(t, err)
+	got, err := ReadMaxVersion(dir, 2)
+	testutil.Ok(t, err)
+	testutil.Equals(t, m, got)
+
+	testutil.Ok(t, WriteVersion(log.NewNopLogger(), dir, m, MetaVersion1))
+	got, err = Read(dir)
+	testutil.Ok(t, err)
+	exp := *m
+	exp.Version = MetaVersion1
+	exp.unknownFields = nil
+	testutil.Equals(t, &exp, got)
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, json.Valid(b), "invalid meta.json written")
+}
@@ -0,0 +1,175 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// MetaStore mirrors metas of blocks in the bucket in a database, so readers can load them without listing the bucket.
+// The bucket stays the source of truth: the compactor updates the store when it uploads blocks and periodically
+// reconciles it with the bucket (see ReconcileMetaStore). Implementations have to be go-routine safe.
+type MetaStore interface {
+	// Metas returns all stored metas and the time of the last reconciliation with the bucket, zero if there was none.
+	Metas(ctx context.Context) (map[ulid.ULID]*metadata.Meta, time.Time, error)
+	// Put stores the given metas, replacing stored metas of the same blocks.
+	Put(ctx context.Context, metas ...*metadata.Meta) error
+	// Delete removes metas of the given blocks. Blocks which are not stored are ignored.
+	Delete(ctx context.Context, ids ...ulid.ULID) error
+	// MarkReconciled records the time the store was last reconciled with the bucket.
+	MarkReconciled(ctx context.Context, t time.Time) error
+	// Close releases resources of the store.
+	Close() error
+}
+
+// InMemMetaStore is a MetaStore keeping metas in memory, e.g. for tests.
+type InMemMetaStore struct {
+	mtx        sync.Mutex
+	metas      map[ulid.ULID]*metadata.Meta
+	reconciled time.Time
+}
+
+// NewInMemMetaStore returns an empty InMemMetaStore.
+func NewInMemMetaStore() *InMemMetaStore {
+	return &InMemMetaStore{metas: map[ulid.ULID]*metadata.Meta{}}
+}
+
+// Metas implements MetaStore.
+func (s *InMemMetaStore) Metas(context.Context) (map[ulid.ULID]*metadata.Meta, time.Time, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	res := make(map[ulid.ULID]*metadata.Meta, len(s.metas))
+	for id, m := range s.metas {
+		c := *m
+		res[id] = &c
+	}
+	return res, s.reconciled, nil
+}
+
+// Put implements MetaStore.
+func (s *InMemMetaStore) Put(_ context.Context, metas ...*metadata.Meta) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, m := range metas {
+		c := *m
+		s.metas[m.ULID] = &c
+	}
+	return nil
+}
+
+// Delete implements MetaStore.
+func (s *InMemMetaStore) Delete(_ context.Context, ids ...ulid.ULID) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, id := range ids {
+		delete(s.metas, id)
+	}
+	return nil
+}
+
+// MarkReconciled implements MetaStore.
+func (s *InMemMetaStore) MarkReconciled(_ context.Context, t time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.reconciled = t
+	return nil
+}
+
+// Close implements MetaStore.
+func (s *InMemMetaStore) Close() error { return nil }
+
+// MetaStoreDrift lists blocks on which the metadata store and the bucket disagreed before reconciliation.
+type MetaStoreDrift struct {
+	// Missing are blocks in the bucket not known to the store.
+	Missing []ulid.ULID
+	// Outdated are blocks whose stored meta differs from meta.json in the bucket.
+	Outdated []ulid.ULID
+	// Unknown are stored blocks no longer in the bucket.
+	Unknown []ulid.ULID
+}
+
+// Len returns the number of drifted blocks.
+func (d MetaStoreDrift) Len() int {
+	return len(d.Missing) + len(d.Outdated) + len(d.Unknown)
+}
+
+// ReconcileMetaStore makes the metadata store mirror metas returned by the given fetcher, returning blocks that had
+// drifted. As with UpdateBucketIndex, the fetcher should not filter out any blocks readers of the store might need, and
+// the store is not reconciled if the fetcher returns incomplete view.
+func ReconcileMetaStore(ctx context.Context, logger log.Logger, store MetaStore, fetcher MetadataFetcher) (MetaStoreDrift, error) {
+	metas, _, err := fetcher.Fetch(ctx)
+	if err != nil {
+		return MetaStoreDrift{}, errors.Wrap(err, "fetch metas")
+	}
+	stored, _, err := store.Metas(ctx)
+	if err != nil {
+		return MetaStoreDrift{}, errors.Wrap(err, "read metadata store")
+	}
+
+	var (
+		drift MetaStoreDrift
+		puts  []*metadata.Meta
+	)
+	for id, m := range metas {
+		s, ok := stored[id]
+		if !ok {
+			drift.Missing = append(drift.Missing, id)
+			puts = append(puts, m)
+			continue
+		}
+		if !sameMeta(s, m) {
+			drift.Outdated = append(drift.Outdated, id)
+			puts = append(puts, m)
+		}
+	}
+	for id := range stored {
+		if _, ok := metas[id]; !ok {
+			drift.Unknown = append(drift.Unknown, id)
+		}
+	}
+	for _, ids := range [][]ulid.ULID{drift.Missing, drift.Outdated, drift.Unknown} {
+		sort.Slice(ids, func(i, j int) bool { return ids[i].Compare(ids[j]) < 0 })
+	}
+
+	if len(puts) > 0 {
+		if err := store.Put(ctx, puts...); err != nil {
+			return MetaStoreDrift{}, errors.Wrap(err, "put metas")
+		}
+	}
+	if len(drift.Unknown) > 0 {
+		if err := store.Delete(ctx, drift.Unknown...); err != nil {
+			return MetaStoreDrift{}, errors.Wrap(err, "delete metas")
+		}
+	}
+	if err := store.MarkReconciled(ctx, time.Now()); err != nil {
+		return MetaStoreDrift{}, errors.Wrap(err, "mark reconciled")
+	}
+	if drift.Len() > 0 {
+		level.Warn(logger).Log("msg", "metadata store drifted from the bucket; reconciled", "missing", len(drift.Missing), "outdated", len(drift.Outdated), "unknown", len(drift.Unknown))
+	}
+	return drift, nil
+}
+
+// sameMeta compares metas by their JSON encoding, as stores keep metas encoded and omitted empty fields decode as nil.
+func sameMeta(a, b *metadata.Meta) bool {
+	ab, aerr := json.Marshal(a)
+	bb, berr := json.Marshal(b)
+	return aerr == nil && berr == nil && bytes.Equal(ab, bb)
+}
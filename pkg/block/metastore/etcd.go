@@ -0,0 +1,192 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metastore
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"go.etcd.io/etcd/clientv3"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	thanoshttp "github.com/thanos-io/thanos/pkg/http"
+)
+
+const (
+	etcdBlocksKey     = "blocks/"
+	etcdReconciledKey = "reconciled"
+
+	// etcdBatchSize bounds number of keys read by one request and of operations in one transaction, which etcd limits
+	// to 128 by default.
+	etcdBatchSize = 100
+)
+
+// EtcdConfig configures the etcd metadata store.
+type EtcdConfig struct {
+	Endpoints []string `yaml:"endpoints"`
+	// Prefix of all keys of the store, so a single etcd cluster can hold metadata of multiple buckets.
+	Prefix      string               `yaml:"prefix"`
+	DialTimeout model.Duration       `yaml:"dial_timeout"`
+	Username    string               `yaml:"username"`
+	Password    string               `yaml:"password"`
+	TLSConfig   thanoshttp.TLSConfig `yaml:"tls_config"`
+	EnableTLS   bool                 `yaml:"enable_tls"`
+}
+
+// DefaultEtcdConfig is the default etcd store configuration.
+var DefaultEtcdConfig = EtcdConfig{
+	Prefix:      "thanos/",
+	DialTimeout: model.Duration(5 * time.Second),
+}
+
+// EtcdStore is a block.MetaStore keeping metas in etcd, a key per block.
+type EtcdStore struct {
+	logger log.Logger
+	client *clientv3.Client
+	prefix string
+}
+
+// NewEtcdStore returns EtcdStore connected to the cluster from the given YAML configuration.
+func NewEtcdStore(logger log.Logger, conf []byte) (*EtcdStore, error) {
+	c := DefaultEtcdConfig
+	if err := yaml.UnmarshalStrict(conf, &c); err != nil {
+		return nil, errors.Wrap(err, "parsing etcd config YAML")
+	}
+	if len(c.Endpoints) == 0 {
+		return nil, errors.New("no etcd endpoints configured")
+	}
+
+	cfg := clientv3.Config{
+		Endpoints:   c.Endpoints,
+		DialTimeout: time.Duration(c.DialTimeout),
+		Username:    c.Username,
+		Password:    c.Password,
+	}
+	if c.EnableTLS {
+		tlsConfig, err := config.NewTLSConfig(&config.TLSConfig{
+			CAFile:             c.TLSConfig.CAFile,
+			CertFile:           c.TLSConfig.CertFile,
+			KeyFile:            c.TLSConfig.KeyFile,
+			ServerName:         c.TLSConfig.ServerName,
+			InsecureSkipVerify: c.TLSConfig.InsecureSkipVerify,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "create etcd TLS config")
+		}
+		cfg.TLS = tlsConfig
+	}
+	client, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "create etcd client")
+	}
+	return &EtcdStore{logger: logger, client: client, prefix: c.Prefix}, nil
+}
+
+// Metas implements block.MetaStore.
+func (s *EtcdStore) Metas(ctx context.Context) (map[ulid.ULID]*metadata.Meta, time.Time, error) {
+	var reconciled time.Time
+	resp, err := s.client.Get(ctx, s.prefix+etcdReconciledKey)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "get reconciliation time")
+	}
+	if len(resp.Kvs) > 0 {
+		ts, err := strconv.ParseInt(string(resp.Kvs[0].Value), 10, 64)
+		if err != nil {
+			return nil, time.Time{}, errors.Wrap(err, "parse reconciliation time")
+		}
+		reconciled = time.Unix(ts, 0)
+	}
+
+	var (
+		metas = map[ulid.ULID]*metadata.Meta{}
+		start = s.prefix + etcdBlocksKey
+		end   = clientv3.GetPrefixRangeEnd(start)
+		// All pages are read from the revision of the first one, so the result is a consistent snapshot.
+		rev int64
+	)
+	for {
+		opts := []clientv3.OpOption{clientv3.WithRange(end), clientv3.WithLimit(etcdBatchSize)}
+		if rev > 0 {
+			opts = append(opts, clientv3.WithRev(rev))
+		}
+		resp, err := s.client.Get(ctx, start, opts...)
+		if err != nil {
+			return nil, time.Time{}, errors.Wrap(err, "get metas")
+		}
+		rev = resp.Header.Revision
+		for _, kv := range resp.Kvs {
+			m := &metadata.Meta{}
+			if err := json.Unmarshal(kv.Value, m); err != nil {
+				return nil, time.Time{}, errors.Wrapf(err, "unmarshal meta of key %s", kv.Key)
+			}
+			metas[m.ULID] = m
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return metas, reconciled, nil
+		}
+		start = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// Put implements block.MetaStore.
+func (s *EtcdStore) Put(ctx context.Context, metas ...*metadata.Meta) error {
+	ops := make([]clientv3.Op, 0, len(metas))
+	for _, m := range metas {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return errors.Wrapf(err, "marshal meta of block %s", m.ULID)
+		}
+		ops = append(ops, clientv3.OpPut(s.blockKey(m.ULID), string(b)))
+	}
+	return s.commit(ctx, ops)
+}
+
+// Delete implements block.MetaStore.
+func (s *EtcdStore) Delete(ctx context.Context, ids ...ulid.ULID) error {
+	ops := make([]clientv3.Op, 0, len(ids))
+	for _, id := range ids {
+		ops = append(ops, clientv3.OpDelete(s.blockKey(id)))
+	}
+	return s.commit(ctx, ops)
+}
+
+// MarkReconciled implements block.MetaStore.
+func (s *EtcdStore) MarkReconciled(ctx context.Context, t time.Time) error {
+	if _, err := s.client.Put(ctx, s.prefix+etcdReconciledKey, strconv.FormatInt(t.Unix(), 10)); err != nil {
+		return errors.Wrap(err, "put reconciliation time")
+	}
+	return nil
+}
+
+// Close implements block.MetaStore.
+func (s *EtcdStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *EtcdStore) blockKey(id ulid.ULID) string {
+	return s.prefix + etcdBlocksKey + id.String()
+}
+
+// commit applies the given operations in transactions of at most etcdBatchSize operations.
+func (s *EtcdStore) commit(ctx context.Context, ops []clientv3.Op) error {
+	for len(ops) > 0 {
+		n := etcdBatchSize
+		if n > len(ops) {
+			n = len(ops)
+		}
+		if _, err := s.client.Txn(ctx).Then(ops[:n]...).Commit(); err != nil {
+			return errors.Wrap(err, "commit etcd transaction")
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+// Package metastore implements databases mirroring metas of blocks in the bucket (see block.MetaStore).
+package metastore
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/block"
+)
+
+type MetaStoreProvider string
+
+const (
+	ETCD MetaStoreProvider = "ETCD"
+)
+
+// MetaStoreConfig specifies the metadata store config.
+type MetaStoreConfig struct {
+	Type   MetaStoreProvider `yaml:"type"`
+	Config interface{}       `yaml:"config"`
+}
+
+// NewMetaStore initializes and returns new metadata store.
+// NOTE: confContentYaml can contain secrets.
+func NewMetaStore(logger log.Logger, confContentYaml []byte) (block.MetaStore, error) {
+	level.Info(logger).Log("msg", "loading metadata store configuration")
+	storeConf := &MetaStoreConfig{}
+	if err := yaml.UnmarshalStrict(confContentYaml, storeConf); err != nil {
+		return nil, errors.Wrap(err, "parsing config YAML file")
+	}
+
+	backendConfig, err := yaml.Marshal(storeConf.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal content of metadata store configuration")
+	}
+
+	var store block.MetaStore
+	switch strings.ToUpper(string(storeConf.Type)) {
+	case string(ETCD):
+		store, err = NewEtcdStore(logger, backendConfig)
+	default:
+		return nil, errors.Errorf("metadata store with type %s is not supported", storeConf.Type)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("create %s metadata store", storeConf.Type))
+	}
+	return store, nil
+}
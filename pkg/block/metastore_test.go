@@ -0,0 +1,86 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestReconcileMetaStore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+	upload := func(i int, level int) {
+		var meta metadata.Meta
+		meta.Version = 1
+		meta.ULID = ULID(i)
+		meta.Compaction.Level = level
+
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&meta))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(meta.ULID.String(), metadata.MetaFilename), &buf))
+	}
+	for i := 1; i <= 3; i++ {
+		upload(i, 1)
+	}
+
+	store := NewInMemMetaStore()
+	b, err := NewBaseFetcher(log.NewNopLogger(), 20, bkt, "", nil)
+	testutil.Ok(t, err)
+	b.UseMetaStore(store, time.Hour)
+
+	// Store which was never reconciled is not used.
+	metas, _, err := b.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	compareSliceWithMapKeys(t, metas, ULIDs(1, 2, 3))
+
+	fetcher, err := NewMetaFetcher(log.NewNopLogger(), 20, bkt, "", nil, nil, nil)
+	testutil.Ok(t, err)
+	drift, err := ReconcileMetaStore(ctx, log.NewNopLogger(), store, fetcher)
+	testutil.Ok(t, err)
+	testutil.Equals(t, MetaStoreDrift{Missing: ULIDs(1, 2, 3)}, drift)
+
+	// Reconciled store is used instead of the bucket, so new blocks are not visible until stored.
+	upload(4, 1)
+	metas, _, err = b.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	compareSliceWithMapKeys(t, metas, ULIDs(1, 2, 3))
+
+	// Drift is detected and fixed.
+	upload(2, 2)
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(ULID(3).String(), metadata.MetaFilename)))
+	// Fetchers cache loaded metas, so only a new one sees the rewritten meta.
+	fetcher, err = NewMetaFetcher(log.NewNopLogger(), 20, bkt, "", nil, nil, nil)
+	testutil.Ok(t, err)
+	drift, err = ReconcileMetaStore(ctx, log.NewNopLogger(), store, fetcher)
+	testutil.Ok(t, err)
+	testutil.Equals(t, MetaStoreDrift{Missing: ULIDs(4), Outdated: ULIDs(2), Unknown: ULIDs(3)}, drift)
+
+	drift, err = ReconcileMetaStore(ctx, log.NewNopLogger(), store, fetcher)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, drift.Len())
+	metas, _, err = b.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	compareSliceWithMapKeys(t, metas, ULIDs(1, 2, 4))
+	testutil.Equals(t, 2, metas[ULID(2)].Compaction.Level)
+
+	// Stale store is not used.
+	testutil.Ok(t, store.MarkReconciled(ctx, time.Now().Add(-2*time.Hour)))
+	testutil.Ok(t, store.Delete(ctx, ULID(1)))
+	metas, _, err = b.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	compareSliceWithMapKeys(t, metas, ULIDs(1, 2, 4))
+}
@@ -0,0 +1,359 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// MigrationManifestFilename is the name of the manifest MigrateBucket uploads into the root of the destination
+	// bucket once all blocks and other objects are migrated.
+	MigrationManifestFilename = "migration-manifest.json"
+
+	// MigrationManifestVersion1 is the version of the migration manifest supported by Thanos.
+	MigrationManifestVersion1 = 1
+)
+
+// MigratedBlock describes a block copied by MigrateBucket.
+type MigratedBlock struct {
+	ID ulid.ULID `json:"id"`
+	// Objects is the number of objects of the block, including its markers.
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+	// Markers are names of objects of the block other than its index, chunks and meta, e.g. its deletion mark,
+	// relative to the block directory.
+	Markers []string `json:"markers,omitempty"`
+}
+
+// MigrationManifest describes the outcome of MigrateBucket, telling whether the destination bucket is ready for the
+// cut-over: the destination holds everything the source held at StartedAt, except the blocks listed as vanished or
+// partial.
+type MigrationManifest struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	// Blocks are all blocks copied, sorted by ID.
+	Blocks []MigratedBlock `json:"blocks"`
+	// Objects are names of copied objects outside of block directories, e.g. retention annotations, sorted.
+	Objects []string `json:"objects,omitempty"`
+	// Vanished are blocks deleted from the source bucket before they could be copied.
+	Vanished []ulid.ULID `json:"vanished,omitempty"`
+	// Partial are block directories without meta.json in the source bucket, e.g. still being uploaded or deleted, which
+	// were not copied.
+	Partial []ulid.ULID `json:"partial,omitempty"`
+	// BucketIndexRebuilt is true if the bucket index of the source bucket was replaced by one of the copied blocks.
+	BucketIndexRebuilt bool `json:"bucket_index_rebuilt"`
+
+	// Version of the file.
+	Version int `json:"version"`
+}
+
+// MigrateBucket copies all blocks, their markers and other objects of the source bucket into the destination bucket,
+// verifying the size of every copy, and uploads MigrationManifest into the root of the destination once done. Objects
+// already in the destination with the same size are not copied again, so interrupted migrations can be resumed and
+// migrations repeated to catch up with the source before the cut-over.
+//
+// The source bucket is only read, so it can be used by other components meanwhile, e.g. by a compactor in dry-run
+// mode. Files of a block are copied before its meta.json, so the destination never shows partial blocks with meta.json.
+// Objects refer to blocks by their IDs only, which stay the same; the bucket index lists blocks of the source at the
+// time of its last update though, so it is rebuilt from the copied blocks instead of being copied as it is.
+func MigrateBucket(ctx context.Context, logger log.Logger, src objstore.BucketReader, dst objstore.Bucket, concurrency int) (*MigrationManifest, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	m := &MigrationManifest{StartedAt: time.Now(), Version: MigrationManifestVersion1}
+
+	var (
+		blocks    []ulid.ULID
+		hasIndex  bool
+		otherDirs []string
+		others    []string
+	)
+	if err := src.Iter(ctx, "", func(name string) error {
+		if id, ok := IsBlockDir(name); ok {
+			blocks = append(blocks, id)
+			return nil
+		}
+		switch {
+		case name == metadata.BucketIndexFilename:
+			hasIndex = true
+		case name == MigrationManifestFilename:
+			// Manifest of the migration of the source bucket itself.
+		case strings.HasSuffix(name, objstore.DirDelim):
+			otherDirs = append(otherDirs, name)
+		default:
+			others = append(others, name)
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "list source bucket")
+	}
+	for _, dir := range otherDirs {
+		if err := listDirRec(ctx, src, dir, func(name string) {
+			others = append(others, name)
+		}); err != nil {
+			return nil, errors.Wrapf(err, "list %s in source bucket", dir)
+		}
+	}
+
+	var (
+		mtx   sync.Mutex
+		metas []metadata.Meta
+		marks []metadata.DeletionMark
+	)
+	ch := make(chan ulid.ULID)
+	eg, ectx := errgroup.WithContext(ctx)
+	for i := 0; i < concurrency; i++ {
+		eg.Go(func() error {
+			for id := range ch {
+				res, err := migrateBlock(ectx, logger, src, dst, id)
+				if err != nil {
+					return errors.Wrapf(err, "migrate block %s", id)
+				}
+
+				mtx.Lock()
+				switch {
+				case res.vanished:
+					m.Vanished = append(m.Vanished, id)
+				case res.partial:
+					m.Partial = append(m.Partial, id)
+				default:
+					m.Blocks = append(m.Blocks, res.block)
+					metas = append(metas, res.meta)
+					if res.mark != nil {
+						marks = append(marks, *res.mark)
+					}
+				}
+				mtx.Unlock()
+			}
+			return nil
+		})
+	}
+	eg.Go(func() error {
+		defer close(ch)
+		for _, id := range blocks {
+			select {
+			case <-ectx.Done():
+				return ectx.Err()
+			case ch <- id:
+			}
+		}
+		return nil
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	for _, name := range others {
+		copied, _, err := migrateObject(ctx, logger, src, dst, name)
+		if err != nil {
+			return nil, err
+		}
+		if copied {
+			m.Objects = append(m.Objects, name)
+		}
+	}
+
+	if hasIndex {
+		sort.Slice(metas, func(i, j int) bool { return metas[i].ULID.Compare(metas[j].ULID) < 0 })
+		sort.Slice(marks, func(i, j int) bool { return marks[i].ID.Compare(marks[j].ID) < 0 })
+		if err := UploadBucketIndex(ctx, dst, metadata.BucketIndex{
+			UpdatedAt:     time.Now().Unix(),
+			Blocks:        metas,
+			DeletionMarks: marks,
+			Version:       metadata.BucketIndexVersion1,
+		}); err != nil {
+			return nil, errors.Wrap(err, "rebuild bucket index")
+		}
+		m.BucketIndexRebuilt = true
+	}
+
+	sort.Slice(m.Blocks, func(i, j int) bool { return m.Blocks[i].ID.Compare(m.Blocks[j].ID) < 0 })
+	sort.Slice(m.Vanished, func(i, j int) bool { return m.Vanished[i].Compare(m.Vanished[j]) < 0 })
+	sort.Slice(m.Partial, func(i, j int) bool { return m.Partial[i].Compare(m.Partial[j]) < 0 })
+	sort.Strings(m.Objects)
+	m.FinishedAt = time.Now()
+
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return nil, errors.Wrap(err, "encode migration manifest")
+	}
+	if err := dst.Upload(ctx, MigrationManifestFilename, bytes.NewReader(b)); err != nil {
+		return nil, errors.Wrapf(err, "upload %s", MigrationManifestFilename)
+	}
+	level.Info(logger).Log("msg", "migrated bucket", "blocks", len(m.Blocks), "objects", len(m.Objects), "vanished", len(m.Vanished),
+		"partial", len(m.Partial), "duration", m.FinishedAt.Sub(m.StartedAt))
+	return m, nil
+}
+
+type blockMigration struct {
+	block    MigratedBlock
+	meta     metadata.Meta
+	mark     *metadata.DeletionMark
+	vanished bool
+	partial  bool
+}
+
+// migrateBlock copies all objects of the block with the given ID, meta.json and its compressed copy last.
+func migrateBlock(ctx context.Context, logger log.Logger, src objstore.BucketReader, dst objstore.Bucket, id ulid.ULID) (blockMigration, error) {
+	res := blockMigration{block: MigratedBlock{ID: id}}
+
+	metaFile := path.Join(id.String(), MetaFilename)
+	metaContent, err := getObject(ctx, logger, src, metaFile)
+	if src.IsObjNotFoundErr(errors.Cause(err)) {
+		res.partial = true
+		return res, nil
+	}
+	if err != nil {
+		return res, err
+	}
+	if err := json.Unmarshal(metaContent, &res.meta); err != nil {
+		return res, errors.Wrapf(err, "unmarshal %s", metaFile)
+	}
+
+	var names []string
+	if err := listDirRec(ctx, src, id.String()+objstore.DirDelim, func(name string) {
+		names = append(names, name)
+	}); err != nil {
+		return res, errors.Wrap(err, "list block")
+	}
+	// Metas go last, so the block is complete in the destination once it has them.
+	sort.SliceStable(names, func(i, j int) bool {
+		return !isMetaFile(names[i]) && isMetaFile(names[j])
+	})
+
+	for _, name := range names {
+		rel := strings.TrimPrefix(name, id.String()+objstore.DirDelim)
+		if name == metaFile {
+			if err := uploadVerified(ctx, logger, dst, name, metaContent); err != nil {
+				return res, err
+			}
+			res.block.Objects++
+			res.block.Bytes += int64(len(metaContent))
+			continue
+		}
+		copied, size, err := migrateObject(ctx, logger, src, dst, name)
+		if err != nil {
+			return res, err
+		}
+		if !copied {
+			// Deleted meanwhile; the whole block is gone, unless it was only a marker.
+			if ok, err := src.Exists(ctx, metaFile); err != nil {
+				return res, errors.Wrapf(err, "check existence of %s", metaFile)
+			} else if !ok {
+				res.vanished = true
+				return res, nil
+			}
+			continue
+		}
+		res.block.Objects++
+		res.block.Bytes += size
+		if rel != IndexFilename && !strings.HasPrefix(rel, ChunksDirname+objstore.DirDelim) && !isMetaFile(name) {
+			res.block.Markers = append(res.block.Markers, rel)
+		}
+		if rel == metadata.DeletionMarkFilename {
+			mark, err := metadata.ReadDeletionMark(ctx, objstore.WithNoopInstr(dst), logger, id.String())
+			if err != nil {
+				level.Warn(logger).Log("msg", "failed to read migrated deletion mark; not including it in the bucket index", "block", id, "err", err)
+				continue
+			}
+			res.mark = mark
+		}
+	}
+	return res, nil
+}
+
+func isMetaFile(name string) bool {
+	return path.Base(name) == MetaFilename || path.Base(name) == CompressedMetaFilename
+}
+
+// migrateObject copies the given object from the source into the destination bucket, unless the destination already has
+// it with the same size, and verifies the size of the copy. It returns false if the object is not in the source anymore.
+func migrateObject(ctx context.Context, logger log.Logger, src objstore.BucketReader, dst objstore.Bucket, name string) (bool, int64, error) {
+	attrs, err := src.Attributes(ctx, name)
+	if src.IsObjNotFoundErr(errors.Cause(err)) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, errors.Wrapf(err, "attributes of %s in source bucket", name)
+	}
+	if dstAttrs, err := dst.Attributes(ctx, name); err == nil && dstAttrs.Size == attrs.Size {
+		return true, attrs.Size, nil
+	} else if err != nil && !dst.IsObjNotFoundErr(errors.Cause(err)) {
+		return false, 0, errors.Wrapf(err, "attributes of %s in destination bucket", name)
+	}
+
+	r, err := src.Get(ctx, name)
+	if src.IsObjNotFoundErr(errors.Cause(err)) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, errors.Wrapf(err, "get %s from source bucket", name)
+	}
+	defer runutil.CloseWithLogOnErr(logger, r, "source object reader")
+
+	if err := dst.Upload(ctx, name, r); err != nil {
+		return false, 0, errors.Wrapf(err, "upload %s to destination bucket", name)
+	}
+	copied, err := dst.Attributes(ctx, name)
+	if err != nil {
+		return false, 0, errors.Wrapf(err, "attributes of copied %s", name)
+	}
+	if copied.Size != attrs.Size {
+		return false, 0, errors.Errorf("verify %s: copied %d bytes, expected %d", name, copied.Size, attrs.Size)
+	}
+	return true, attrs.Size, nil
+}
+
+// uploadVerified uploads the given content and verifies it is in the destination bucket as it is.
+func uploadVerified(ctx context.Context, logger log.Logger, dst objstore.Bucket, name string, content []byte) error {
+	if err := dst.Upload(ctx, name, bytes.NewReader(content)); err != nil {
+		return errors.Wrapf(err, "upload %s to destination bucket", name)
+	}
+	rc, err := dst.Get(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "get copied %s", name)
+	}
+	defer runutil.CloseWithLogOnErr(logger, rc, "copied object reader")
+	copied, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return errors.Wrapf(err, "read copied %s", name)
+	}
+	if !bytes.Equal(copied, content) {
+		return errors.Errorf("verify %s: copied content differs from the source", name)
+	}
+	return nil
+}
+
+func getObject(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, name string) ([]byte, error) {
+	rc, err := bkt.Get(ctx, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get %s", name)
+	}
+	defer runutil.CloseWithLogOnErr(logger, rc, "object reader")
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", name)
+	}
+	return b, nil
+}
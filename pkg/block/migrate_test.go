@@ -0,0 +1,89 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestMigrateBucket(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	tmpDir, err := ioutil.TempDir("", "test-migrate-bucket")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	src := objstore.NewInMemBucket()
+	var ids []ulid.ULID
+	for i := 0; i < 3; i++ {
+		id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{{{Name: "a", Value: "1"}}}, 10, int64(i)*1000, int64(i+1)*1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+		testutil.Ok(t, err)
+		testutil.Ok(t, Upload(ctx, logger, src, filepath.Join(tmpDir, id.String())))
+		ids = append(ids, id)
+	}
+	markedID := ids[0]
+	testutil.Ok(t, MarkForDeletion(ctx, logger, src, markedID, prometheus.NewCounter(prometheus.CounterOpts{})))
+	testutil.Ok(t, src.Upload(ctx, path.Join(metadata.RetentionAnnotationsDir, "keep.json"), strings.NewReader("{}")))
+	testutil.Ok(t, src.Upload(ctx, metadata.BucketIndexFilename, strings.NewReader("{}")))
+	// Partial block without meta.json.
+	testutil.Ok(t, src.Upload(ctx, "01EQ1A4K4M4Q2V0QZ1VJ5Y6M3D/index", strings.NewReader("partial")))
+
+	dst := objstore.NewInMemBucket()
+	m, err := MigrateBucket(ctx, logger, src, dst, 2)
+	testutil.Ok(t, err)
+
+	testutil.Equals(t, 3, len(m.Blocks))
+	testutil.Equals(t, 1, len(m.Partial))
+	// Debug metas of the blocks and the retention annotation.
+	testutil.Equals(t, 4, len(m.Objects))
+	testutil.Equals(t, path.Join(metadata.RetentionAnnotationsDir, "keep.json"), m.Objects[3])
+	testutil.Assert(t, m.BucketIndexRebuilt, "bucket index not rebuilt")
+	for _, b := range m.Blocks {
+		if b.ID == markedID {
+			testutil.Equals(t, []string{metadata.DeletionMarkFilename}, b.Markers)
+		} else {
+			testutil.Equals(t, 0, len(b.Markers))
+		}
+	}
+	// Everything but the partial block, the bucket index and the manifest is copied as it is.
+	for name, content := range src.Objects() {
+		if strings.HasPrefix(name, "01EQ1A4K4M4Q2V0QZ1VJ5Y6M3D") || name == metadata.BucketIndexFilename {
+			continue
+		}
+		testutil.Assert(t, bytes.Equal(content, dst.Objects()[name]), "object %s not copied", name)
+	}
+	idx, err := metadata.ReadBucketIndex(ctx, objstore.WithNoopInstr(dst), logger)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(idx.Blocks))
+	testutil.Equals(t, 1, len(idx.DeletionMarks))
+	testutil.Equals(t, markedID, idx.DeletionMarks[0].ID)
+	ok, err := dst.Exists(ctx, MigrationManifestFilename)
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "manifest not uploaded")
+
+	// Repeated migrations do not fail on objects already copied.
+	m, err = MigrateBucket(ctx, logger, src, dst, 1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(m.Blocks))
+}
@@ -0,0 +1,124 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// UploadMulti uploads blocks from the given block dirs together, e.g. all output blocks of a compaction plan, so that
+// readers filtering blocks with PendingCommitFilter never observe some of them without the others. It verifies the
+// blocks as Upload does and uploads a pending commit listing all of them into metadata.PendingCommitsDir first. Then
+// files of the blocks but meta.json are uploaded with the given concurrency and meta.json files one after another in
+// order of block IDs. The blocks are committed by removing the pending commit once all meta.json files are uploaded.
+// On error, all blocks and the pending commit are cleaned up. Commits whose cleanup failed are left to
+// compact.BestEffortCleanAbortedCommits. A single block is uploaded with Upload. WithUploadedChunks is not supported.
+func UploadMulti(ctx context.Context, logger log.Logger, bkt objstore.Bucket, group string, bdirs []string, concurrency int, opts ...UploadOption) error {
+	if len(bdirs) == 1 {
+		return Upload(ctx, logger, bkt, bdirs[0], opts...)
+	}
+	o := applyUploadOptions(opts)
+	if len(o.uploadedChunks) > 0 {
+		return errors.New("uploaded chunks are not supported for multiple blocks")
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	uploads := make([]*blockUpload, 0, len(bdirs))
+	for _, bdir := range bdirs {
+		u, err := prepareUpload(ctx, logger, bkt, bdir, o)
+		if err != nil {
+			return errors.Wrapf(err, "prepare upload of %s", bdir)
+		}
+		uploads = append(uploads, u)
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].id.Compare(uploads[j].id) < 0
+	})
+
+	commit := metadata.PendingCommit{
+		ID:      ulid.MustNew(ulid.Now(), rand.Reader),
+		Group:   group,
+		Blocks:  make([]ulid.ULID, 0, len(uploads)),
+		Version: metadata.PendingCommitVersion1,
+	}
+	for _, u := range uploads {
+		commit.Blocks = append(commit.Blocks, u.id)
+	}
+	content, err := json.Marshal(commit)
+	if err != nil {
+		return errors.Wrap(err, "json encode pending commit")
+	}
+	commitFile := metadata.PendingCommitFile(commit.ID)
+	if err := bkt.Upload(ctx, commitFile, bytes.NewReader(content)); err != nil {
+		return errors.Wrapf(err, "upload file %s to bucket", commitFile)
+	}
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, concurrency)
+	for _, u := range uploads {
+		u := u
+		eg.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-egCtx.Done():
+				return egCtx.Err()
+			}
+			defer func() { <-sem }()
+			return errors.Wrapf(u.uploadData(egCtx, logger, bkt, o), "upload block %s", u.id)
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return abortCommit(logger, bkt, commit, err)
+	}
+
+	// Readers hide all blocks of the commit until it is removed, so the order only makes partial commits predictable.
+	for _, u := range uploads {
+		if err := u.commit(ctx, logger, bkt); err != nil {
+			return abortCommit(logger, bkt, commit, errors.Wrapf(err, "commit block %s", u.id))
+		}
+	}
+	if err := bkt.Delete(ctx, commitFile); err != nil {
+		return errors.Wrapf(err, "remove pending commit %s; blocks stay hidden until the commit is cleaned up", commitFile)
+	}
+	level.Info(logger).Log("msg", "committed blocks uploaded together", "commit", commit.ID, "blocks", len(commit.Blocks))
+	return nil
+}
+
+// abortCommit cleans up all blocks of the given pending commit, then the commit itself, returning the given error.
+func abortCommit(logger log.Logger, bkt objstore.Bucket, commit metadata.PendingCommit, err error) error {
+	if cleanErr := CleanPendingCommit(context.Background(), logger, bkt, commit); cleanErr != nil {
+		return errors.Wrapf(err, "failed to clean blocks of pending commit %s after upload issue: %s", commit.ID, cleanErr)
+	}
+	return err
+}
+
+// CleanPendingCommit deletes all blocks of the given pending commit and then the commit itself. Blocks of the commit
+// are never read, so they are deleted right away.
+func CleanPendingCommit(ctx context.Context, logger log.Logger, bkt objstore.Bucket, commit metadata.PendingCommit) error {
+	for _, id := range commit.Blocks {
+		if err := Delete(ctx, logger, bkt, id); err != nil {
+			return errors.Wrapf(err, "delete block %s", id)
+		}
+	}
+	commitFile := metadata.PendingCommitFile(commit.ID)
+	if err := bkt.Delete(ctx, commitFile); err != nil && !bkt.IsObjNotFoundErr(err) {
+		return errors.Wrapf(err, "delete %s", commitFile)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+// failingUploadBucket fails uploads of objects with the given suffix.
+type failingUploadBucket struct {
+	objstore.Bucket
+	suffix string
+}
+
+func (b failingUploadBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if strings.HasSuffix(name, b.suffix) {
+		return errors.Errorf("upload of %s failed", name)
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestUploadMulti(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	tmpDir, err := ioutil.TempDir("", "test-upload-multi")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	ext := labels.Labels{{Name: "ext1", Value: "val1"}}
+	var bdirs []string
+	for i := 0; i < 3; i++ {
+		id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{{{Name: "a", Value: "1"}}}, 100, int64(i)*1000, int64(i+1)*1000, ext, 0)
+		testutil.Ok(t, err)
+		bdirs = append(bdirs, filepath.Join(tmpDir, id.String()))
+	}
+	blocksIn := func(bkt *objstore.InMemBucket) map[string]bool {
+		res := map[string]bool{}
+		for name := range bkt.Objects() {
+			dir := strings.Split(name, "/")[0]
+			if _, err := ulid.Parse(dir); err == nil {
+				res[dir] = res[dir] || strings.HasSuffix(name, MetaFilename)
+			}
+		}
+		return res
+	}
+
+	t.Run("committed", func(t *testing.T) {
+		bkt := objstore.NewInMemBucket()
+		testutil.Ok(t, UploadMulti(ctx, logger, bkt, "group", bdirs, 2))
+
+		blocks := blocksIn(bkt)
+		testutil.Equals(t, len(bdirs), len(blocks))
+		for _, bdir := range bdirs {
+			testutil.Assert(t, blocks[filepath.Base(bdir)], "missing meta.json of block %s", bdir)
+		}
+		commits, err := metadata.ReadPendingCommits(ctx, objstore.WithNoopInstr(bkt), logger)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0, len(commits))
+	})
+	t.Run("aborted", func(t *testing.T) {
+		inmem := objstore.NewInMemBucket()
+		bkt := failingUploadBucket{Bucket: inmem, suffix: path.Join(filepath.Base(bdirs[1]), IndexFilename)}
+		testutil.NotOk(t, UploadMulti(ctx, logger, bkt, "group", bdirs, 2))
+
+		testutil.Equals(t, map[string]bool{}, blocksIn(inmem))
+		commits, err := metadata.ReadPendingCommits(ctx, objstore.WithNoopInstr(inmem), logger)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0, len(commits))
+	})
+}
+
+func TestPendingCommitFilter_Filter(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	testutil.Ok(t, bkt.Upload(ctx, metadata.PendingCommitFile(ULID(10)), strings.NewReader(`{"id":"`+ULID(10).String()+`","blocks":["`+ULID(1).String()+`","`+ULID(2).String()+`"],"version":1}`)))
+
+	f := NewPendingCommitFilter(log.NewNopLogger(), objstore.WithNoopInstr(bkt))
+	input := map[ulid.ULID]*metadata.Meta{
+		ULID(1): {},
+		ULID(3): {},
+	}
+
+	m := newTestFetcherMetrics()
+	testutil.Ok(t, f.Filter(ctx, input, m.synced))
+	testutil.Equals(t, map[ulid.ULID]*metadata.Meta{ULID(3): {}}, input)
+	testutil.Equals(t, 1, len(f.PendingCommits()))
+	testutil.Equals(t, []ulid.ULID{ULID(1), ULID(2)}, f.PendingCommits()[0].Blocks)
+}
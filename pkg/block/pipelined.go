@@ -0,0 +1,185 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// tmpForCreationSuffix is the suffix of the directory TSDB compactor writes a block into before renaming it to the ID of
+// the block.
+const tmpForCreationSuffix = ".tmp-for-creation"
+
+// PipelinedUpload uploads chunk segments of a block while TSDB compactor writes it into a directory, overlapping the
+// compaction with the upload and cutting the period the whole block takes space on the local disk. Segments are written
+// one after another, so a segment is complete once the next one exists. Complete segments are uploaded and removed from
+// the local disk; the last segment, the index and meta.json are left to Upload with WithUploadedChunks, which uploads
+// meta.json last as usual. Objects uploaded by PipelinedUpload are left for the caller to clean up if the block is not
+// uploaded in the end.
+type PipelinedUpload struct {
+	logger   log.Logger
+	bkt      objstore.Bucket
+	dir      string
+	newID    func(ulid.ULID) (ulid.ULID, error)
+	interval time.Duration
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// Written by the watching go-routine only, read by Stop once it is done.
+	tmpID    ulid.ULID
+	id       ulid.ULID
+	uploaded []string
+	bytes    int64
+	err      error
+}
+
+// StartPipelinedUpload starts watching the given directory for a block written by TSDB compactor in the given interval,
+// uploading its complete chunk segments. The block is uploaded with the ID returned by newID for the ID given by TSDB,
+// e.g. to embed the creator fingerprint; newID is called once the block directory appears. Stop must be called once
+// the compaction finishes.
+func StartPipelinedUpload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, dir string, interval time.Duration, newID func(ulid.ULID) (ulid.ULID, error)) *PipelinedUpload {
+	ctx, cancel := context.WithCancel(ctx)
+	u := &PipelinedUpload{
+		logger:   logger,
+		bkt:      bkt,
+		dir:      dir,
+		newID:    newID,
+		interval: interval,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go u.run(ctx)
+	return u
+}
+
+func (u *PipelinedUpload) run(ctx context.Context) {
+	defer close(u.done)
+
+	t := time.NewTicker(u.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := u.poll(ctx); err != nil {
+			if ctx.Err() == nil {
+				u.err = err
+			}
+			return
+		}
+	}
+}
+
+// poll uploads chunk segments completed since the last poll.
+func (u *PipelinedUpload) poll(ctx context.Context) error {
+	if u.tmpID == (ulid.ULID{}) {
+		id, ok, err := u.findBlock()
+		if err != nil || !ok {
+			return err
+		}
+		newID, err := u.newID(id)
+		if err != nil {
+			return errors.Wrap(err, "new ID of pipelined block")
+		}
+		// Chunks are uploaded before Upload could detect a collision, so make sure they do not overwrite a foreign block.
+		exists, err := u.bkt.Exists(ctx, path.Join(newID.String(), MetaFilename))
+		if err != nil {
+			return errors.Wrapf(err, "check existence of block %s", newID)
+		}
+		if exists {
+			return errors.Wrapf(ErrULIDCollision, "block %s created by %s already exists in bucket", newID, FingerprintOf(newID))
+		}
+		u.tmpID, u.id = id, newID
+	}
+
+	chunksDir := filepath.Join(u.dir, u.tmpID.String()+tmpForCreationSuffix, ChunksDirname)
+	files, err := ioutil.ReadDir(chunksDir)
+	if os.IsNotExist(err) {
+		// Not created yet, or the block is complete and renamed already.
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "read chunks dir %s", chunksDir)
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if !f.IsDir() {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	// The last segment may still be written.
+	for i := 0; i < len(names)-1; i++ {
+		if err := u.upload(ctx, chunksDir, names[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findBlock returns TSDB ID of the block being written into the directory, if any.
+func (u *PipelinedUpload) findBlock() (ulid.ULID, bool, error) {
+	files, err := ioutil.ReadDir(u.dir)
+	if err != nil {
+		return ulid.ULID{}, false, errors.Wrapf(err, "read dir %s", u.dir)
+	}
+	for _, f := range files {
+		if !f.IsDir() || !strings.HasSuffix(f.Name(), tmpForCreationSuffix) {
+			continue
+		}
+		id, err := ulid.Parse(strings.TrimSuffix(f.Name(), tmpForCreationSuffix))
+		if err != nil {
+			continue
+		}
+		return id, true, nil
+	}
+	return ulid.ULID{}, false, nil
+}
+
+// upload uploads the given complete chunk segment and removes it from the local disk.
+func (u *PipelinedUpload) upload(ctx context.Context, chunksDir, name string) error {
+	src := filepath.Join(chunksDir, name)
+	fi, err := os.Stat(src)
+	if err != nil {
+		return errors.Wrapf(err, "stat chunk segment %s", src)
+	}
+	if err := objstore.UploadFile(ctx, u.logger, u.bkt, src, path.Join(u.id.String(), ChunksDirname, name)); err != nil {
+		return errors.Wrapf(err, "upload chunk segment %s", name)
+	}
+	if err := os.Remove(src); err != nil {
+		return errors.Wrapf(err, "remove uploaded chunk segment %s", src)
+	}
+
+	u.uploaded = append(u.uploaded, name)
+	u.bytes += fi.Size()
+	level.Debug(u.logger).Log("msg", "uploaded chunk segment of block being compacted", "block", u.id, "segment", name)
+	return nil
+}
+
+// Stop stops watching, canceling the upload in progress, if any, whose segment is left to Upload. It returns the ID of
+// the block in the bucket, zero if no block was written, names and total size of the uploaded chunk segments, and the
+// error of the upload, if any.
+func (u *PipelinedUpload) Stop() (id ulid.ULID, uploaded []string, bytes int64, err error) {
+	u.cancel()
+	<-u.done
+	return u.id, u.uploaded, u.bytes, u.err
+}
@@ -0,0 +1,72 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestPipelinedUpload(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-pipelined-upload")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+
+	// Pretend TSDB compactor is still writing the block, with the second segment in progress.
+	tmpBlockDir := filepath.Join(tmpDir, id.String()+tmpForCreationSuffix)
+	testutil.Ok(t, os.Rename(filepath.Join(tmpDir, id.String()), tmpBlockDir))
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(tmpBlockDir, ChunksDirname, "000002"), []byte("in progress"), 0600))
+
+	bkt := objstore.NewInMemBucket()
+	u := StartPipelinedUpload(ctx, log.NewNopLogger(), bkt, tmpDir, 10*time.Millisecond, func(id ulid.ULID) (ulid.ULID, error) { return id, nil })
+
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	testutil.Ok(t, runutil.Retry(10*time.Millisecond, tctx.Done(), func() error {
+		if _, err := os.Stat(filepath.Join(tmpBlockDir, ChunksDirname, "000001")); !os.IsNotExist(err) {
+			return errors.New("segment not uploaded yet")
+		}
+		return nil
+	}))
+	testutil.Ok(t, os.Rename(tmpBlockDir, filepath.Join(tmpDir, id.String())))
+
+	gotID, uploaded, bytes, err := u.Stop()
+	testutil.Ok(t, err)
+	testutil.Equals(t, id, gotID)
+	testutil.Equals(t, []string{"000001"}, uploaded)
+	testutil.Assert(t, bytes > 0, "no bytes uploaded")
+	testutil.Equals(t, 1, len(bkt.Objects()))
+
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(tmpDir, id.String()), WithUploadedChunks(uploaded)))
+	for _, name := range []string{path.Join(ChunksDirname, "000001"), path.Join(ChunksDirname, "000002"), IndexFilename, MetaFilename} {
+		ok, err := bkt.Exists(ctx, path.Join(id.String(), name))
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "%s not uploaded", name)
+	}
+}
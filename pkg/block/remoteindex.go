@@ -0,0 +1,111 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"path"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// remoteIndexTOCLen is the size of the TOC at the end of an index file: six table offsets followed by their checksum.
+const remoteIndexTOCLen = 6*8 + crc32.Size
+
+// RemoteIndexStats describes the index of a block in object storage, as read by InspectRemoteIndex.
+type RemoteIndexStats struct {
+	// Size is the size of the index file.
+	Size int64 `json:"size"`
+	// Version is the index format version.
+	Version int `json:"version"`
+	// Symbols is the number of symbols of the index.
+	Symbols int `json:"symbols"`
+
+	// SymbolsBytes, SeriesBytes and PostingsBytes are sizes of the symbols table, of the series and of postings of the
+	// index. PostingsBytes includes label indices and the offset tables.
+	SymbolsBytes  int64 `json:"symbolsBytes"`
+	SeriesBytes   int64 `json:"seriesBytes"`
+	PostingsBytes int64 `json:"postingsBytes"`
+}
+
+// InspectRemoteIndex reads the header, the TOC and the head of the symbols table of the index of the given block in
+// object storage using range requests of a few bytes, so that sizes of index tables are known without downloading the
+// index, e.g. to estimate compactions before their sources are downloaded.
+func InspectRemoteIndex(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID) (RemoteIndexStats, error) {
+	fn := path.Join(id.String(), IndexFilename)
+	attrs, err := bkt.Attributes(ctx, fn)
+	if err != nil {
+		return RemoteIndexStats{}, errors.Wrapf(err, "get object attributes of %s", fn)
+	}
+	if attrs.Size < index.HeaderLen+remoteIndexTOCLen {
+		return RemoteIndexStats{}, errors.Errorf("index %s of %d bytes is too small to hold header and TOC", fn, attrs.Size)
+	}
+	s := RemoteIndexStats{Size: attrs.Size}
+
+	b, err := getRange(ctx, bkt, fn, 0, index.HeaderLen)
+	if err != nil {
+		return RemoteIndexStats{}, errors.Wrap(err, "get header")
+	}
+	if m := binary.BigEndian.Uint32(b[0:4]); m != index.MagicIndex {
+		return RemoteIndexStats{}, errors.Errorf("invalid magic number %x of %s", m, fn)
+	}
+	s.Version = int(b[4])
+	if s.Version != index.FormatV1 && s.Version != index.FormatV2 {
+		return RemoteIndexStats{}, errors.Errorf("unsupported index file version %d of %s", s.Version, fn)
+	}
+
+	b, err = getRange(ctx, bkt, fn, attrs.Size-remoteIndexTOCLen, remoteIndexTOCLen)
+	if err != nil {
+		return RemoteIndexStats{}, errors.Wrap(err, "get TOC")
+	}
+	toc, err := index.NewTOCFromByteSlice(byteSlice(b))
+	if err != nil {
+		return RemoteIndexStats{}, errors.Wrapf(err, "read TOC of %s", fn)
+	}
+	tocStart := uint64(attrs.Size - remoteIndexTOCLen)
+	if toc.Symbols > toc.Series || toc.Series > toc.LabelIndices || toc.LabelIndices > toc.Postings ||
+		toc.Postings > toc.LabelIndicesTable || toc.LabelIndicesTable > toc.PostingsTable || toc.PostingsTable > tocStart {
+		return RemoteIndexStats{}, errors.Errorf("TOC of %s holds table offsets out of order", fn)
+	}
+	s.SymbolsBytes = int64(toc.Series - toc.Symbols)
+	s.SeriesBytes = int64(toc.LabelIndices - toc.Series)
+	s.PostingsBytes = int64(tocStart - toc.LabelIndices)
+
+	// The symbols table starts with its length and the number of symbols, in both index versions.
+	if s.SymbolsBytes < 8 {
+		return RemoteIndexStats{}, errors.Errorf("symbols table of %s of %d bytes is too small", fn, s.SymbolsBytes)
+	}
+	b, err = getRange(ctx, bkt, fn, int64(toc.Symbols), 8)
+	if err != nil {
+		return RemoteIndexStats{}, errors.Wrap(err, "get symbols table head")
+	}
+	s.Symbols = int(binary.BigEndian.Uint32(b[4:8]))
+	return s, nil
+}
+
+// getRange returns length bytes of the given object starting at off.
+func getRange(ctx context.Context, bkt objstore.BucketReader, name string, off, length int64) (_ []byte, err error) {
+	rc, err := bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get range of %s", name)
+	}
+	defer runutil.CloseWithErrCapture(&err, rc, "close range reader")
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read range of %s", name)
+	}
+	if int64(len(b)) != length {
+		return nil, errors.Errorf("got %d bytes instead of %d of range at %d of %s", len(b), length, off, name)
+	}
+	return b, nil
+}
@@ -0,0 +1,70 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestInspectRemoteIndex(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-remote-index")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	b, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+		labels.FromStrings("a", "3", "b", "1"),
+	}, 100, 0, 1000, labels.Labels{{Name: "ext", Value: "1"}}, 124)
+	testutil.Ok(t, err)
+
+	fn := filepath.Join(tmpDir, b.String(), IndexFilename)
+	content, err := ioutil.ReadFile(fn)
+	testutil.Ok(t, err)
+
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, objstore.UploadFile(ctx, log.NewNopLogger(), bkt, fn, path.Join(b.String(), IndexFilename)))
+
+	s, err := InspectRemoteIndex(ctx, bkt, b)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(len(content)), s.Size)
+	testutil.Equals(t, index.FormatV2, s.Version)
+	// Symbols "1", "2", "3", "a" and "b". External labels are not part of the index.
+	testutil.Equals(t, 5, s.Symbols)
+	testutil.Equals(t, s.Size, index.HeaderLen+s.SymbolsBytes+s.SeriesBytes+s.PostingsBytes+remoteIndexTOCLen)
+	testutil.Assert(t, s.SeriesBytes > 0 && s.PostingsBytes > 0, "empty tables: %+v", s)
+
+	t.Run("missing index", func(t *testing.T) {
+		_, err := InspectRemoteIndex(ctx, bkt, ulid.MustNew(1, nil))
+		testutil.NotOk(t, err)
+		testutil.Assert(t, bkt.IsObjNotFoundErr(errors.Cause(err)), "not a not found error: %v", err)
+	})
+	t.Run("corrupted TOC", func(t *testing.T) {
+		corrupted := append([]byte{}, content...)
+		corrupted[len(corrupted)-remoteIndexTOCLen] ^= 0xff
+		id := ulid.MustNew(2, nil)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), IndexFilename), bytes.NewReader(corrupted)))
+
+		_, err := InspectRemoteIndex(ctx, bkt, id)
+		testutil.NotOk(t, err)
+	})
+}
@@ -0,0 +1,530 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/prometheus/prometheus/tsdb/tombstones"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// rewriteFn writes the new version of the block using given readers and writers. Meta stats are reset before the call
+// and have to be updated by the function. It returns false if the block does not need to be changed.
+type rewriteFn func(indexr tsdb.IndexReader, chunkr tsdb.ChunkReader, indexw tsdb.IndexWriter, chunkw tsdb.ChunkWriter, meta *metadata.Meta) (bool, error)
+
+// rewriteInPlace rewrites index and chunks of the block in the given directory using given function.
+// Block ID and compaction metadata stay the same.
+func rewriteInPlace(logger log.Logger, bdir string, fn rewriteFn) (changed bool, err error) {
+	meta, err := metadata.Read(bdir)
+	if err != nil {
+		return false, errors.Wrap(err, "read meta file")
+	}
+
+	resdir := bdir + ".rewrite"
+	if err := os.RemoveAll(resdir); err != nil {
+		return false, errors.Wrap(err, "clean rewrite dir")
+	}
+	defer func() {
+		if rerr := os.RemoveAll(resdir); rerr != nil {
+			level.Warn(logger).Log("msg", "failed to remove rewrite dir", "dir", resdir, "err", rerr)
+		}
+	}()
+
+	resmeta := *meta
+	resmeta.Stats = tsdb.BlockStats{}
+	changed, err = rewriteTo(logger, bdir, resdir, &resmeta, fn)
+	if err != nil {
+		return false, errors.Wrap(err, "rewrite block")
+	}
+	if !changed {
+		return false, nil
+	}
+
+	for _, name := range []string{IndexFilename, ChunksDirname} {
+		if err := os.RemoveAll(filepath.Join(bdir, name)); err != nil {
+			return false, errors.Wrapf(err, "remove old %s", name)
+		}
+		if err := os.Rename(filepath.Join(resdir, name), filepath.Join(bdir, name)); err != nil {
+			return false, errors.Wrapf(err, "replace %s", name)
+		}
+	}
+	if err := metadata.Write(logger, bdir, &resmeta); err != nil {
+		return false, errors.Wrap(err, "write meta file")
+	}
+	return true, nil
+}
+
+func rewriteTo(logger log.Logger, bdir string, resdir string, meta *metadata.Meta, fn rewriteFn) (_ bool, err error) {
+	// Index is opened directly instead of opening the whole block, so that indexes with unsorted symbols can be read.
+	indexr, err := openIndexReader(filepath.Join(bdir, IndexFilename))
+	if err != nil {
+		return false, errors.Wrap(err, "open index")
+	}
+	defer runutil.CloseWithErrCapture(&err, indexr, "rewrite index reader")
+
+	chunkr, err := chunks.NewDirReader(filepath.Join(bdir, ChunksDirname), nil)
+	if err != nil {
+		return false, errors.Wrap(err, "open chunks")
+	}
+	defer runutil.CloseWithErrCapture(&err, chunkr, "rewrite chunk reader")
+
+	chunkw, err := chunks.NewWriter(filepath.Join(resdir, ChunksDirname))
+	if err != nil {
+		return false, errors.Wrap(err, "open chunk writer")
+	}
+	defer runutil.CloseWithErrCapture(&err, chunkw, "rewrite chunk writer")
+
+	indexw, err := index.NewWriter(context.TODO(), filepath.Join(resdir, IndexFilename))
+	if err != nil {
+		return false, errors.Wrap(err, "open index writer")
+	}
+	defer runutil.CloseWithErrCapture(&err, indexw, "rewrite index writer")
+
+	return fn(indexr, chunkr, indexw, chunkw, meta)
+}
+
+// writeSeries loads data of the given chunks, unless already loaded, writes them and adds the series to the index,
+// updating meta stats.
+func writeSeries(indexw tsdb.IndexWriter, chunkr tsdb.ChunkReader, chunkw tsdb.ChunkWriter, meta *metadata.Meta, ref uint64, lset labels.Labels, chks []chunks.Meta) (err error) {
+	for j, c := range chks {
+		if c.Chunk != nil {
+			continue
+		}
+		chks[j].Chunk, err = chunkr.Chunk(c.Ref)
+		if err != nil {
+			return errors.Wrap(err, "chunk read")
+		}
+	}
+	if err := chunkw.WriteChunks(chks...); err != nil {
+		return errors.Wrap(err, "write chunks")
+	}
+	if err := indexw.AddSeries(ref, lset, chks...); err != nil {
+		return errors.Wrap(err, "add series")
+	}
+
+	meta.Stats.NumChunks += uint64(len(chks))
+	meta.Stats.NumSeries++
+	for _, chk := range chks {
+		meta.Stats.NumSamples += uint64(chk.Chunk.NumSamples())
+	}
+	return nil
+}
+
+// RelabelSeries rewrites the block in the given directory in place, replacing labels of every series with the result
+// of the given function. Series for which the function returns empty labels are dropped. Series that end up with the
+// same labels are merged; it is an error if their chunks overlap.
+// It returns number of modified series and is a no-op if no series was modified.
+func RelabelSeries(logger log.Logger, bdir string, relabelFn func(labels.Labels) labels.Labels) (modified int, err error) {
+	_, err = rewriteInPlace(logger, bdir, func(indexr tsdb.IndexReader, chunkr tsdb.ChunkReader, indexw tsdb.IndexWriter, chunkw tsdb.ChunkWriter, meta *metadata.Meta) (bool, error) {
+		all, err := indexr.Postings(index.AllPostingsKey())
+		if err != nil {
+			return false, errors.Wrap(err, "postings")
+		}
+		all = indexr.SortedPostings(all)
+
+		var series []seriesRepair
+		for all.Next() {
+			var (
+				lset labels.Labels
+				chks []chunks.Meta
+			)
+			if err := indexr.Series(all.At(), &lset, &chks); err != nil {
+				return false, errors.Wrap(err, "series")
+			}
+
+			newLset := relabelFn(lset.Copy())
+			if !labels.Equal(lset, newLset) {
+				modified++
+			}
+			if len(newLset) == 0 {
+				continue
+			}
+			series = append(series, seriesRepair{lset: newLset, chks: chks})
+		}
+		if all.Err() != nil {
+			return false, errors.Wrap(all.Err(), "iterate series")
+		}
+		if modified == 0 {
+			return false, nil
+		}
+
+		sort.SliceStable(series, func(i, j int) bool {
+			return labels.Compare(series[i].lset, series[j].lset) < 0
+		})
+
+		// Merge series with the same labels.
+		merged := series[:0]
+		for _, s := range series {
+			if len(merged) > 0 && labels.Equal(merged[len(merged)-1].lset, s.lset) {
+				last := &merged[len(merged)-1]
+				last.chks = append(last.chks, s.chks...)
+				sort.Slice(last.chks, func(i, j int) bool {
+					return last.chks[i].MinTime < last.chks[j].MinTime
+				})
+				if ooo, duplicated := outOfOrderChunks(last.chks); ooo > 0 || duplicated > 0 {
+					return false, errors.Errorf("relabelling merged multiple series into %v with overlapping chunks", s.lset)
+				}
+				continue
+			}
+			merged = append(merged, s)
+		}
+
+		if err := addSymbols(indexw, merged); err != nil {
+			return false, err
+		}
+		for i, s := range merged {
+			if err := writeSeries(indexw, chunkr, chunkw, meta, uint64(i), s.lset, s.chks); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	return modified, err
+}
+
+// NormalizeIndex rewrites the block in the given directory in place, so that its index fulfills the sort order
+// invariants assumed by compaction: labels of each series are sorted by name, series are sorted by labels and symbols
+// are sorted and unique. Series that end up with the same labels are merged; it is an error if their chunks overlap.
+// It returns number of series that were out of order or had out of order labels, and is a no-op if the index is already
+// normalized.
+func NormalizeIndex(logger log.Logger, bdir string) (normalized int, err error) {
+	_, err = rewriteInPlace(logger, bdir, func(indexr tsdb.IndexReader, chunkr tsdb.ChunkReader, indexw tsdb.IndexWriter, chunkw tsdb.ChunkWriter, meta *metadata.Meta) (bool, error) {
+		unsortedSymbols := false
+		symbols := indexr.Symbols()
+		for prev, first := "", true; symbols.Next(); first = false {
+			if !first && symbols.At() <= prev {
+				unsortedSymbols = true
+			}
+			prev = symbols.At()
+		}
+		if symbols.Err() != nil {
+			return false, errors.Wrap(symbols.Err(), "iterate symbols")
+		}
+
+		// Postings are not sorted by series labels if symbols or series are not sorted, so they are not sorted here either.
+		all, err := indexr.Postings(index.AllPostingsKey())
+		if err != nil {
+			return false, errors.Wrap(err, "postings")
+		}
+
+		var series []seriesRepair
+		for all.Next() {
+			var (
+				lset labels.Labels
+				chks []chunks.Meta
+			)
+			if err := indexr.Series(all.At(), &lset, &chks); err != nil {
+				return false, errors.Wrap(err, "series")
+			}
+
+			unsorted := !sort.IsSorted(lset)
+			if unsorted {
+				sort.Sort(lset)
+			}
+			if len(series) > 0 && labels.Compare(series[len(series)-1].lset, lset) >= 0 {
+				unsorted = true
+			}
+			if unsorted {
+				normalized++
+			}
+			series = append(series, seriesRepair{lset: lset, chks: chks})
+		}
+		if all.Err() != nil {
+			return false, errors.Wrap(all.Err(), "iterate series")
+		}
+		if normalized == 0 && !unsortedSymbols {
+			return false, nil
+		}
+
+		sort.SliceStable(series, func(i, j int) bool {
+			return labels.Compare(series[i].lset, series[j].lset) < 0
+		})
+
+		// Merge series with the same labels.
+		merged := series[:0]
+		for _, s := range series {
+			if len(merged) > 0 && labels.Equal(merged[len(merged)-1].lset, s.lset) {
+				last := &merged[len(merged)-1]
+				last.chks = append(last.chks, s.chks...)
+				sort.Slice(last.chks, func(i, j int) bool {
+					return last.chks[i].MinTime < last.chks[j].MinTime
+				})
+				if ooo, duplicated := outOfOrderChunks(last.chks); ooo > 0 || duplicated > 0 {
+					return false, errors.Errorf("normalizing merged multiple series into %v with overlapping chunks", s.lset)
+				}
+				continue
+			}
+			merged = append(merged, s)
+		}
+
+		if err := addSymbols(indexw, merged); err != nil {
+			return false, err
+		}
+		for i, s := range merged {
+			if err := writeSeries(indexw, chunkr, chunkw, meta, uint64(i), s.lset, s.chks); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	return normalized, err
+}
+
+// MergeDuplicateSeries rewrites the block in the given directory in place, merging series with the same labels, which
+// upstream bugs of some TSDB writers produce, into a single series. Unlike NormalizeIndex, chunks of the duplicates may
+// overlap: overlapping chunks are merged and deduplicated by timestamp like by MergeBlocks, so only XOR encoded chunks
+// can overlap. Series are sorted by labels as well.
+// It returns number of series merged into another one and is a no-op if there are no duplicate series.
+func MergeDuplicateSeries(logger log.Logger, bdir string) (merged int, err error) {
+	_, err = rewriteInPlace(logger, bdir, func(indexr tsdb.IndexReader, chunkr tsdb.ChunkReader, indexw tsdb.IndexWriter, chunkw tsdb.ChunkWriter, meta *metadata.Meta) (bool, error) {
+		all, err := indexr.Postings(index.AllPostingsKey())
+		if err != nil {
+			return false, errors.Wrap(err, "postings")
+		}
+
+		var series []seriesRepair
+		for all.Next() {
+			var (
+				lset labels.Labels
+				chks []chunks.Meta
+			)
+			if err := indexr.Series(all.At(), &lset, &chks); err != nil {
+				return false, errors.Wrap(err, "series")
+			}
+			series = append(series, seriesRepair{lset: lset, chks: chks})
+		}
+		if all.Err() != nil {
+			return false, errors.Wrap(all.Err(), "iterate series")
+		}
+
+		sort.SliceStable(series, func(i, j int) bool {
+			return labels.Compare(series[i].lset, series[j].lset) < 0
+		})
+		var (
+			res   = series[:0]
+			stats MergeStats
+		)
+		for i := 0; i < len(series); {
+			j := i + 1
+			for j < len(series) && labels.Equal(series[i].lset, series[j].lset) {
+				j++
+			}
+			if j == i+1 {
+				res = append(res, series[i])
+				i = j
+				continue
+			}
+
+			var chks []sourceChunk
+			for _, s := range series[i:j] {
+				for _, c := range s.chks {
+					chks = append(chks, sourceChunk{Meta: c, chunkr: chunkr})
+				}
+			}
+			mergedChks, err := mergeChunks(chks, DedupChunks, &stats)
+			if err != nil {
+				return false, errors.Wrapf(err, "merge chunks of duplicate series %v", series[i].lset)
+			}
+			merged += j - i - 1
+			res = append(res, seriesRepair{lset: series[i].lset, chks: mergedChks})
+			i = j
+		}
+		if merged == 0 {
+			return false, nil
+		}
+
+		if err := addSymbols(indexw, res); err != nil {
+			return false, err
+		}
+		for i, s := range res {
+			if err := writeSeries(indexw, chunkr, chunkw, meta, uint64(i), s.lset, s.chks); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	return merged, err
+}
+
+// addSymbols adds all label names and values of given series to the index, in sorted order.
+func addSymbols(indexw tsdb.IndexWriter, series []seriesRepair) error {
+	symbols := map[string]struct{}{}
+	for _, s := range series {
+		for _, l := range s.lset {
+			symbols[l.Name] = struct{}{}
+			symbols[l.Value] = struct{}{}
+		}
+	}
+	sortedSymbols := make([]string, 0, len(symbols))
+	for sym := range symbols {
+		sortedSymbols = append(sortedSymbols, sym)
+	}
+	sort.Strings(sortedSymbols)
+	for _, sym := range sortedSymbols {
+		if err := indexw.AddSymbol(sym); err != nil {
+			return errors.Wrap(err, "add symbol")
+		}
+	}
+	return nil
+}
+
+// DeleteSamples rewrites the raw block in the given directory in place, removing samples of series matching any of the
+// given deletion intents within the intent's time range. Series left without samples are dropped.
+// It returns number of modified series and is a no-op if no series was modified.
+func DeleteSamples(logger log.Logger, bdir string, intents []metadata.DeletionIntent) (modified int, err error) {
+	matchers := make([][]*labels.Matcher, 0, len(intents))
+	for _, i := range intents {
+		ms, err := i.ParseMatchers()
+		if err != nil {
+			return 0, errors.Wrapf(err, "parse matchers %q", i.Matchers)
+		}
+		matchers = append(matchers, ms)
+	}
+
+	_, err = rewriteInPlace(logger, bdir, func(indexr tsdb.IndexReader, chunkr tsdb.ChunkReader, indexw tsdb.IndexWriter, chunkw tsdb.ChunkWriter, meta *metadata.Meta) (bool, error) {
+		if meta.Thanos.Downsample.Resolution != 0 {
+			return false, errors.Errorf("deleting samples from downsampled block %s is not supported", meta.ULID)
+		}
+
+		all, err := indexr.Postings(index.AllPostingsKey())
+		if err != nil {
+			return false, errors.Wrap(err, "postings")
+		}
+		all = indexr.SortedPostings(all)
+
+		var series []seriesRepair
+		for all.Next() {
+			var (
+				lset labels.Labels
+				chks []chunks.Meta
+			)
+			if err := indexr.Series(all.At(), &lset, &chks); err != nil {
+				return false, errors.Wrap(err, "series")
+			}
+
+			var deleted tombstones.Intervals
+			for i, intent := range intents {
+				if labelsMatch(matchers[i], lset) {
+					deleted = deleted.Add(tombstones.Interval{Mint: intent.MinTime, Maxt: intent.MaxTime})
+				}
+			}
+			if len(deleted) == 0 {
+				series = append(series, seriesRepair{lset: lset, chks: chks})
+				continue
+			}
+			newChks, changed, err := deleteChunkSamples(chunkr, chks, deleted)
+			if err != nil {
+				return false, errors.Wrapf(err, "delete samples of series %v", lset)
+			}
+			if changed {
+				modified++
+			}
+			if len(newChks) == 0 {
+				continue
+			}
+			series = append(series, seriesRepair{lset: lset, chks: newChks})
+		}
+		if all.Err() != nil {
+			return false, errors.Wrap(all.Err(), "iterate series")
+		}
+		if modified == 0 {
+			return false, nil
+		}
+
+		if err := addSymbols(indexw, series); err != nil {
+			return false, err
+		}
+		for i, s := range series {
+			if err := writeSeries(indexw, chunkr, chunkw, meta, uint64(i), s.lset, s.chks); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	return modified, err
+}
+
+// deleteChunkSamples returns given chunks without samples within the deleted intervals. Chunks that lost only some of
+// their samples are re-encoded in memory, untouched ones are returned as they are.
+func deleteChunkSamples(chunkr tsdb.ChunkReader, chks []chunks.Meta, deleted tombstones.Intervals) (_ []chunks.Meta, changed bool, err error) {
+	res := make([]chunks.Meta, 0, len(chks))
+	for _, c := range chks {
+		r := tombstones.Interval{Mint: c.MinTime, Maxt: c.MaxTime}
+		if !overlaps(deleted, r) {
+			res = append(res, c)
+			continue
+		}
+		changed = true
+		if r.IsSubrange(deleted) {
+			continue
+		}
+
+		chk, err := chunkr.Chunk(c.Ref)
+		if err != nil {
+			return nil, false, errors.Wrap(err, "chunk read")
+		}
+		if chk.Encoding() != chunkenc.EncXOR {
+			return nil, false, errors.Errorf("unsupported chunk encoding %v", chk.Encoding())
+		}
+
+		newChk := chunkenc.NewXORChunk()
+		app, err := newChk.Appender()
+		if err != nil {
+			return nil, false, errors.Wrap(err, "chunk appender")
+		}
+		newMeta := chunks.Meta{MinTime: math.MaxInt64, MaxTime: math.MinInt64, Chunk: newChk}
+		it := chk.Iterator(nil)
+		for it.Next() {
+			t, v := it.At()
+			if (tombstones.Interval{Mint: t, Maxt: t}).IsSubrange(deleted) {
+				continue
+			}
+			app.Append(t, v)
+			if t < newMeta.MinTime {
+				newMeta.MinTime = t
+			}
+			newMeta.MaxTime = t
+		}
+		if it.Err() != nil {
+			return nil, false, errors.Wrap(it.Err(), "iterate chunk")
+		}
+		if newChk.NumSamples() > 0 {
+			res = append(res, newMeta)
+		}
+	}
+	return res, changed, nil
+}
+
+func labelsMatch(matchers []*labels.Matcher, lset labels.Labels) bool {
+	for _, m := range matchers {
+		if !m.Matches(lset.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func overlaps(in tombstones.Intervals, r tombstones.Interval) bool {
+	for _, i := range in {
+		if i.Mint <= r.Maxt && r.Mint <= i.Maxt {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,309 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestRelabelSeries(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-relabel-series")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	b, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+		labels.FromStrings("a", "3", "old", "x"),
+	}, 100, 0, 1000, labels.Labels{{Name: "ext", Value: "1"}}, 124)
+	testutil.Ok(t, err)
+	bdir := filepath.Join(tmpDir, b.String())
+
+	relabelFn := func(lset labels.Labels) labels.Labels {
+		if lset.Get("a") == "2" {
+			return nil
+		}
+		lb := labels.NewBuilder(lset)
+		if v := lset.Get("old"); v != "" {
+			lb.Del("old")
+			lb.Set("new", v)
+		}
+		return lb.Labels()
+	}
+
+	modified, err := RelabelSeries(log.NewNopLogger(), bdir, relabelFn)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, modified)
+
+	ir, err := index.NewFileReader(filepath.Join(bdir, IndexFilename))
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, ir.Close()) }()
+
+	all, err := ir.Postings(index.AllPostingsKey())
+	testutil.Ok(t, err)
+	var got []labels.Labels
+	for all.Next() {
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
+		testutil.Ok(t, ir.Series(all.At(), &lset, &chks))
+		testutil.Assert(t, len(chks) > 0, "expected chunks for series %v", lset)
+		got = append(got, lset)
+	}
+	testutil.Ok(t, all.Err())
+	testutil.Equals(t, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "3", "new", "x"),
+	}, got)
+
+	m, err := metadata.Read(bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, b, m.ULID)
+	testutil.Equals(t, uint64(2), m.Stats.NumSeries)
+	testutil.Equals(t, uint64(200), m.Stats.NumSamples)
+
+	// Applying the same function again should not modify anything.
+	modified, err = RelabelSeries(log.NewNopLogger(), bdir, relabelFn)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, modified)
+}
+
+func TestDeleteSamples(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-delete-samples")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	b, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+		labels.FromStrings("a", "3"),
+	}, 100, 0, 1000, labels.Labels{{Name: "ext", Value: "1"}}, 0)
+	testutil.Ok(t, err)
+	bdir := filepath.Join(tmpDir, b.String())
+
+	intents := []metadata.DeletionIntent{
+		{Matchers: `{a="2"}`, MinTime: 0, MaxTime: 499},
+		{Matchers: `{a=~"3|4"}`, MinTime: 0, MaxTime: 1000},
+	}
+	modified, err := DeleteSamples(log.NewNopLogger(), bdir, intents)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, modified)
+
+	ir, err := index.NewFileReader(filepath.Join(bdir, IndexFilename))
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, ir.Close()) }()
+
+	all, err := ir.Postings(index.AllPostingsKey())
+	testutil.Ok(t, err)
+	var got []labels.Labels
+	for all.Next() {
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
+		testutil.Ok(t, ir.Series(all.At(), &lset, &chks))
+		if lset.Get("a") == "2" {
+			testutil.Assert(t, chks[0].MinTime > 499, "expected no samples before 500, got chunk starting at %d", chks[0].MinTime)
+		}
+		got = append(got, lset)
+	}
+	testutil.Ok(t, all.Err())
+	testutil.Equals(t, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+	}, got)
+
+	m, err := metadata.Read(bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, uint64(2), m.Stats.NumSeries)
+	// Samples are 9ms apart, so 56 samples of a="2" were deleted.
+	testutil.Equals(t, uint64(144), m.Stats.NumSamples)
+
+	// Applying the same intents again should not modify anything.
+	modified, err = DeleteSamples(log.NewNopLogger(), bdir, intents)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, modified)
+}
+
+// swapSymbols swaps two symbols of the same length in the symbol table of the given index file, so that the symbol table
+// and series referencing those symbols are no longer sorted, as written by some third-party TSDB writers.
+func swapSymbols(t *testing.T, fn, a, b string) {
+	testutil.Equals(t, len(a), len(b))
+
+	buf, err := ioutil.ReadFile(fn)
+	testutil.Ok(t, err)
+
+	// Symbol table offset is the first entry of the TOC at the end of the file.
+	toc := buf[len(buf)-(6*8+4):]
+	off := binary.BigEndian.Uint64(toc)
+	l := binary.BigEndian.Uint32(buf[off:])
+	content := buf[off+4 : off+4+uint64(l)]
+
+	entryA, entryB := append([]byte{byte(len(a))}, a...), append([]byte{byte(len(b))}, b...)
+	ia, ib := bytes.Index(content, entryA), bytes.Index(content, entryB)
+	testutil.Assert(t, ia >= 0 && ib >= 0, "symbols %q and %q not found", a, b)
+	copy(content[ia:], entryB)
+	copy(content[ib:], entryA)
+	binary.BigEndian.PutUint32(buf[off+4+uint64(l):], crc32.Checksum(content, castagnoli))
+
+	testutil.Ok(t, ioutil.WriteFile(fn, buf, os.ModePerm))
+}
+
+func TestNormalizeIndex(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-normalize-index")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	b, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.FromStrings("a", "x"),
+		labels.FromStrings("a", "x", "b", "x"),
+		labels.FromStrings("b", "x"),
+	}, 100, 0, 1000, labels.Labels{{Name: "ext", Value: "1"}}, 0)
+	testutil.Ok(t, err)
+	bdir := filepath.Join(tmpDir, b.String())
+	fn := filepath.Join(bdir, IndexFilename)
+
+	// Well formed block should not be modified.
+	normalized, err := NormalizeIndex(log.NewNopLogger(), bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, normalized)
+
+	// Series now read as {b="x"}, {b="x", a="x"} and {a="x"}.
+	swapSymbols(t, fn, "a", "b")
+	stats, err := GatherIndexIssueStats(log.NewNopLogger(), fn, 0, 1000)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, stats.UnsortedSymbols)
+	testutil.Equals(t, 1, stats.UnsortedSeries)
+	testutil.Equals(t, 1, stats.OutOfOrderLabels)
+	testutil.NotOk(t, stats.UnsortedIndexErr())
+
+	normalized, err = NormalizeIndex(log.NewNopLogger(), bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, normalized)
+
+	stats, err = GatherIndexIssueStats(log.NewNopLogger(), fn, 0, 1000)
+	testutil.Ok(t, err)
+	testutil.Ok(t, stats.AnyErr())
+
+	ir, err := index.NewFileReader(fn)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, ir.Close()) }()
+
+	all, err := ir.Postings(index.AllPostingsKey())
+	testutil.Ok(t, err)
+	var got []labels.Labels
+	for all.Next() {
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
+		testutil.Ok(t, ir.Series(all.At(), &lset, &chks))
+		testutil.Assert(t, len(chks) > 0, "expected chunks for series %v", lset)
+		got = append(got, lset)
+	}
+	testutil.Ok(t, all.Err())
+	testutil.Equals(t, []labels.Labels{
+		labels.FromStrings("a", "x"),
+		labels.FromStrings("a", "x", "b", "x"),
+		labels.FromStrings("b", "x"),
+	}, got)
+
+	m, err := metadata.Read(bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, b, m.ULID)
+	testutil.Equals(t, uint64(3), m.Stats.NumSeries)
+	testutil.Equals(t, uint64(300), m.Stats.NumSamples)
+}
+
+// renameSymbol overwrites the given symbol in the symbol table of the index with the given one of the same length, so
+// series referencing either symbol read the same, as written by some buggy TSDB writers.
+func renameSymbol(t *testing.T, fn, from, to string) {
+	testutil.Equals(t, len(from), len(to))
+
+	buf, err := ioutil.ReadFile(fn)
+	testutil.Ok(t, err)
+
+	toc := buf[len(buf)-(6*8+4):]
+	off := binary.BigEndian.Uint64(toc)
+	l := binary.BigEndian.Uint32(buf[off:])
+	content := buf[off+4 : off+4+uint64(l)]
+
+	i := bytes.Index(content, append([]byte{byte(len(from))}, from...))
+	testutil.Assert(t, i >= 0, "symbol %q not found", from)
+	copy(content[i+1:], to)
+	binary.BigEndian.PutUint32(buf[off+4+uint64(l):], crc32.Checksum(content, castagnoli))
+
+	testutil.Ok(t, ioutil.WriteFile(fn, buf, os.ModePerm))
+}
+
+func TestMergeDuplicateSeries(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-merge-duplicate-series")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	b, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.FromStrings("a", "x"),
+		labels.FromStrings("a", "y"),
+		labels.FromStrings("b", "z"),
+	}, 100, 0, 1000, labels.Labels{{Name: "ext", Value: "1"}}, 0)
+	testutil.Ok(t, err)
+	bdir := filepath.Join(tmpDir, b.String())
+	fn := filepath.Join(bdir, IndexFilename)
+
+	// Well formed block should not be modified.
+	merged, err := MergeDuplicateSeries(log.NewNopLogger(), bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, merged)
+
+	// Series now read as {a="x"}, {a="x"} and {b="z"}, with overlapping chunks.
+	renameSymbol(t, fn, "y", "x")
+	stats, err := GatherIndexIssueStats(log.NewNopLogger(), fn, 0, 1000)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, stats.DuplicateSeries)
+	testutil.Equals(t, 0, stats.UnsortedSeries)
+	testutil.NotOk(t, stats.DuplicateSeriesErr())
+
+	// Overlapping chunks of duplicates cannot be merged by normalization.
+	_, err = NormalizeIndex(log.NewNopLogger(), bdir)
+	testutil.NotOk(t, err)
+
+	merged, err = MergeDuplicateSeries(log.NewNopLogger(), bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, merged)
+
+	stats, err = GatherIndexIssueStats(log.NewNopLogger(), fn, 0, 1000)
+	testutil.Ok(t, err)
+	testutil.Ok(t, stats.AnyErr())
+
+	m, err := metadata.Read(bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, b, m.ULID)
+	testutil.Equals(t, uint64(2), m.Stats.NumSeries)
+	// Samples of duplicates are deduplicated by timestamp.
+	testutil.Equals(t, uint64(200), m.Stats.NumSamples)
+}
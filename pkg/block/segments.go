@@ -0,0 +1,324 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	tsdberrors "github.com/prometheus/prometheus/tsdb/errors"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// ChunkSegmentsReport describes chunk segment files of a block that chunks referenced by its index cannot be read from.
+type ChunkSegmentsReport struct {
+	// Missing are names of referenced chunk segment files not in the chunks directory of the block, sorted.
+	Missing []string
+	// Truncated are names of chunk segment files shorter than ends of chunks referenced in them, or than the segment
+	// header, sorted.
+	Truncated []string
+	// Series is the number of series with at least one unreadable chunk, and Chunks the number of such chunks.
+	Series int
+	Chunks int
+}
+
+// OK returns true if all chunks referenced by the index of the block can be read.
+func (r ChunkSegmentsReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Truncated) == 0
+}
+
+// Err returns an error describing unreadable chunk segments, or nil if there are none.
+func (r ChunkSegmentsReport) Err() error {
+	if r.OK() {
+		return nil
+	}
+	return errors.Errorf("%d series with %d chunks in missing chunk segments %v or truncated chunk segments %v", r.Series, r.Chunks, r.Missing, r.Truncated)
+}
+
+// segmentFileName returns the name of the chunk segment file TSDB chunk references with the given segment index point
+// to. TSDB numbers segments of a block sequentially starting from 1 and the chunk reader addresses them by their
+// position, so a missing segment makes all following segments unreadable too.
+func segmentFileName(seq uint64) string {
+	return fmt.Sprintf("%0.6d", seq+1)
+}
+
+// segmentSizes returns sizes of chunk segment files in the given chunks directory by file name. Segments of a block may
+// be of different sizes, e.g. written by TSDB with different segment size settings, so sizes are never assumed.
+func segmentSizes(chunksDir string) (map[string]int64, error) {
+	files, err := ioutil.ReadDir(chunksDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read chunks dir %s", chunksDir)
+	}
+	res := make(map[string]int64, len(files))
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if _, err := strconv.ParseUint(f.Name(), 10, 64); err != nil {
+			continue
+		}
+		res[f.Name()] = f.Size()
+	}
+	return res, nil
+}
+
+// segmentsChecker accumulates ChunkSegmentsReport of series of a single block. Segments are opened on first read of a
+// chunk length in them and have to be closed by Close.
+type segmentsChecker struct {
+	chunksDir string
+	sizes     map[string]int64
+	files     map[string]*os.File
+	missing   map[string]struct{}
+	truncated map[string]struct{}
+	report    ChunkSegmentsReport
+}
+
+func newSegmentsChecker(chunksDir string, sizes map[string]int64) *segmentsChecker {
+	return &segmentsChecker{
+		chunksDir: chunksDir,
+		sizes:     sizes,
+		files:     map[string]*os.File{},
+		missing:   map[string]struct{}{},
+		truncated: map[string]struct{}{},
+	}
+}
+
+// check returns true if all given chunks of a series can be read, recording the ones that cannot in the report. A chunk
+// can be read if its length field, encoding, data and checksum all fit in its segment.
+func (c *segmentsChecker) check(chks []chunks.Meta) (bool, error) {
+	bad := 0
+	for _, chk := range chks {
+		name := segmentFileName(chk.Ref >> 32)
+		size, ok := c.sizes[name]
+		if !ok {
+			c.missing[name] = struct{}{}
+			bad++
+			continue
+		}
+		// Like TSDB chunk reader, require room for the longest length field even if the actual one is shorter.
+		offset := int64(uint32(chk.Ref))
+		if size < chunks.SegmentHeaderSize || offset+chunks.MaxChunkLengthFieldSize > size {
+			c.truncated[name] = struct{}{}
+			bad++
+			continue
+		}
+		end, err := c.chunkEnd(name, offset)
+		if err != nil {
+			return false, err
+		}
+		if end < 0 || end > size {
+			c.truncated[name] = struct{}{}
+			bad++
+		}
+	}
+	if bad == 0 {
+		return true, nil
+	}
+	c.report.Series++
+	c.report.Chunks += bad
+	return false, nil
+}
+
+// chunkEnd returns the offset past the checksum of the chunk at the given offset of the given segment, decoding its
+// length field, or -1 if the length field is malformed.
+func (c *segmentsChecker) chunkEnd(name string, offset int64) (int64, error) {
+	f, ok := c.files[name]
+	if !ok {
+		var err error
+		if f, err = os.Open(filepath.Join(c.chunksDir, name)); err != nil {
+			return 0, errors.Wrapf(err, "open chunk segment %s", name)
+		}
+		c.files[name] = f
+	}
+	b := make([]byte, chunks.MaxChunkLengthFieldSize)
+	if _, err := f.ReadAt(b, offset); err != nil {
+		return 0, errors.Wrapf(err, "read chunk length at %d of chunk segment %s", offset, name)
+	}
+	length, n := binary.Uvarint(b)
+	if n <= 0 {
+		return -1, nil
+	}
+	return offset + int64(n) + chunks.ChunkEncodingSize + int64(length) + crc32.Size, nil
+}
+
+// Close closes all segments opened by check.
+func (c *segmentsChecker) Close() error {
+	var errs tsdberrors.MultiError
+	for name, f := range c.files {
+		if err := f.Close(); err != nil {
+			errs.Add(errors.Wrapf(err, "close chunk segment %s", name))
+		}
+	}
+	c.files = map[string]*os.File{}
+	return errs.Err()
+}
+
+func (c *segmentsChecker) done() ChunkSegmentsReport {
+	for name := range c.missing {
+		c.report.Missing = append(c.report.Missing, name)
+	}
+	for name := range c.truncated {
+		c.report.Truncated = append(c.report.Truncated, name)
+	}
+	sort.Strings(c.report.Missing)
+	sort.Strings(c.report.Truncated)
+	return c.report
+}
+
+// CheckChunkSegments checks that all chunks referenced by the index of the block in the given directory are in chunk
+// segment files of the block, e.g. after download, without opening the chunks, which fails deep inside TSDB readers
+// for missing or truncated segments.
+func CheckChunkSegments(bdir string) (_ ChunkSegmentsReport, err error) {
+	sizes, err := segmentSizes(filepath.Join(bdir, ChunksDirname))
+	if err != nil {
+		return ChunkSegmentsReport{}, err
+	}
+
+	indexr, err := openIndexReader(filepath.Join(bdir, IndexFilename))
+	if err != nil {
+		return ChunkSegmentsReport{}, errors.Wrap(err, "open index")
+	}
+	defer runutil.CloseWithErrCapture(&err, indexr, "index reader")
+
+	all, err := indexr.Postings(index.AllPostingsKey())
+	if err != nil {
+		return ChunkSegmentsReport{}, errors.Wrap(err, "postings")
+	}
+	c := newSegmentsChecker(filepath.Join(bdir, ChunksDirname), sizes)
+	defer runutil.CloseWithErrCapture(&err, c, "chunk segments")
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	for all.Next() {
+		if err := indexr.Series(all.At(), &lset, &chks); err != nil {
+			return ChunkSegmentsReport{}, errors.Wrap(err, "series")
+		}
+		if _, err := c.check(chks); err != nil {
+			return ChunkSegmentsReport{}, err
+		}
+	}
+	if all.Err() != nil {
+		return ChunkSegmentsReport{}, errors.Wrap(all.Err(), "iterate series")
+	}
+	return c.done(), nil
+}
+
+// DropSeriesWithMissingChunks rewrites the block in the given directory in place, skipping series with chunks in
+// missing or truncated chunk segment files, as reported by CheckChunkSegments. Missing segments and segments without a
+// complete header are replaced by empty segments first, so that the remaining segments can be read by their position.
+// Block ID and compaction metadata stay the same. It is a no-op if all chunks can be read.
+func DropSeriesWithMissingChunks(logger log.Logger, bdir string) (ChunkSegmentsReport, error) {
+	report, err := CheckChunkSegments(bdir)
+	if err != nil || report.OK() {
+		return report, err
+	}
+
+	chunksDir := filepath.Join(bdir, ChunksDirname)
+	sizes, err := segmentSizes(chunksDir)
+	if err != nil {
+		return report, err
+	}
+	for _, name := range append(append([]string{}, report.Missing...), report.Truncated...) {
+		if size, ok := sizes[name]; ok && size >= chunks.SegmentHeaderSize {
+			continue
+		}
+		if err := writeEmptySegment(filepath.Join(chunksDir, name)); err != nil {
+			return report, err
+		}
+	}
+	// Segments before the highest missing one may be missing even though no chunk is referenced in them.
+	for _, name := range report.Missing {
+		seq, _ := strconv.ParseUint(name, 10, 64)
+		for s := uint64(0); s+1 < seq; s++ {
+			if _, ok := sizes[segmentFileName(s)]; ok {
+				continue
+			}
+			if err := writeEmptySegment(filepath.Join(chunksDir, segmentFileName(s))); err != nil {
+				return report, err
+			}
+			sizes[segmentFileName(s)] = chunks.SegmentHeaderSize
+		}
+	}
+
+	_, err = rewriteInPlace(logger, bdir, func(indexr tsdb.IndexReader, chunkr tsdb.ChunkReader, indexw tsdb.IndexWriter, chunkw tsdb.ChunkWriter, meta *metadata.Meta) (bool, error) {
+		symbols := indexr.Symbols()
+		for symbols.Next() {
+			if err := indexw.AddSymbol(symbols.At()); err != nil {
+				return false, errors.Wrap(err, "add symbol")
+			}
+		}
+		if symbols.Err() != nil {
+			return false, errors.Wrap(symbols.Err(), "next symbol")
+		}
+
+		all, err := indexr.Postings(index.AllPostingsKey())
+		if err != nil {
+			return false, errors.Wrap(err, "postings")
+		}
+		all = indexr.SortedPostings(all)
+
+		// Sizes are taken before empty segments were written, so chunks referenced in them are unreadable.
+		c := newSegmentsChecker(chunksDir, sizes)
+		defer runutil.CloseWithLogOnErr(logger, c, "chunk segments")
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+			i    = uint64(0)
+		)
+		for all.Next() {
+			if err := indexr.Series(all.At(), &lset, &chks); err != nil {
+				return false, errors.Wrap(err, "series")
+			}
+			ok, err := c.check(chks)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				continue
+			}
+			if err := writeSeries(indexw, chunkr, chunkw, meta, i, lset, chks); err != nil {
+				return false, err
+			}
+			i++
+		}
+		if all.Err() != nil {
+			return false, errors.Wrap(all.Err(), "iterate series")
+		}
+		return true, nil
+	})
+	if err != nil {
+		return report, err
+	}
+	level.Warn(logger).Log("msg", "dropped series with chunks in missing or truncated chunk segments", "block", filepath.Base(bdir),
+		"series", report.Series, "chunks", report.Chunks, "missing", fmt.Sprintf("%v", report.Missing), "truncated", fmt.Sprintf("%v", report.Truncated))
+	return report, nil
+}
+
+// writeEmptySegment writes a chunk segment file holding just the segment header.
+func writeEmptySegment(fn string) error {
+	b := make([]byte, chunks.SegmentHeaderSize)
+	binary.BigEndian.PutUint32(b, chunks.MagicChunks)
+	// Chunk format version 1, the only one TSDB reads.
+	b[chunks.MagicChunksSize] = 1
+	if err := ioutil.WriteFile(fn, b, os.ModePerm); err != nil {
+		return errors.Wrapf(err, "write empty chunk segment %s", fn)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestCheckAndDropSeriesWithMissingChunks(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	tmpDir, err := ioutil.TempDir("", "test-missing-chunks")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	b, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+		labels.FromStrings("a", "3"),
+	}, 100, 0, 1000, labels.Labels{{Name: "ext", Value: "1"}}, 124)
+	testutil.Ok(t, err)
+	bdir := filepath.Join(tmpDir, b.String())
+
+	// Write chunks of every series into a segment of its own, as TSDB does for segments of a tiny size.
+	_, err = rewriteInPlace(logger, bdir, func(indexr tsdb.IndexReader, chunkr tsdb.ChunkReader, indexw tsdb.IndexWriter, _ tsdb.ChunkWriter, meta *metadata.Meta) (_ bool, err error) {
+		chunkw, err := chunks.NewWriterWithSegSize(filepath.Join(bdir+".rewrite", ChunksDirname), 1)
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, chunkw.Close()) }()
+
+		symbols := indexr.Symbols()
+		for symbols.Next() {
+			testutil.Ok(t, indexw.AddSymbol(symbols.At()))
+		}
+		all, err := indexr.Postings(index.AllPostingsKey())
+		testutil.Ok(t, err)
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+			i    = uint64(0)
+		)
+		for all.Next() {
+			testutil.Ok(t, indexr.Series(all.At(), &lset, &chks))
+			testutil.Ok(t, writeSeries(indexw, chunkr, chunkw, meta, i, lset, chks))
+			i++
+		}
+		return true, all.Err()
+	})
+	testutil.Ok(t, err)
+
+	report, err := CheckChunkSegments(bdir)
+	testutil.Ok(t, err)
+	testutil.Assert(t, report.OK(), "unexpected report %+v", report)
+	testutil.Ok(t, report.Err())
+
+	chunksDir := filepath.Join(bdir, ChunksDirname)
+	testutil.Ok(t, os.Remove(filepath.Join(chunksDir, "000002")))
+	// Segment holding the length field of its chunk, but not all of its data.
+	fi, err := os.Stat(filepath.Join(chunksDir, "000003"))
+	testutil.Ok(t, err)
+	testutil.Ok(t, os.Truncate(filepath.Join(chunksDir, "000003"), fi.Size()-10))
+
+	report, err = CheckChunkSegments(bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, ChunkSegmentsReport{Missing: []string{"000002"}, Truncated: []string{"000003"}, Series: 2, Chunks: 2}, report)
+	testutil.NotOk(t, report.Err())
+
+	dropped, err := DropSeriesWithMissingChunks(logger, bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, report, dropped)
+
+	report, err = CheckChunkSegments(bdir)
+	testutil.Ok(t, err)
+	testutil.Assert(t, report.OK(), "unexpected report %+v", report)
+
+	meta, err := metadata.Read(bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, b, meta.ULID)
+	testutil.Equals(t, uint64(1), meta.Stats.NumSeries)
+	testutil.Equals(t, uint64(100), meta.Stats.NumSamples)
+
+	// The remaining series is readable by TSDB.
+	blk, err := tsdb.OpenBlock(logger, bdir, nil)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, blk.Close()) }()
+	q, err := tsdb.NewBlockQuerier(blk, 0, 1000)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, q.Close()) }()
+	set := q.Select(false, nil, labels.MustNewMatcher(labels.MatchRegexp, "a", ".+"))
+	testutil.Assert(t, set.Next(), "expected a series")
+	testutil.Equals(t, labels.FromStrings("a", "1"), set.At().Labels())
+	samples := 0
+	for it := set.At().Iterator(); it.Next(); {
+		samples++
+	}
+	testutil.Equals(t, 100, samples)
+	testutil.Assert(t, !set.Next(), "expected a single series")
+	testutil.Ok(t, set.Err())
+}
+
+// Blocks whose chunks can all be read are left as they are.
+func TestDropSeriesWithMissingChunks_NoMissingChunks(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-missing-chunks")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	b, err := e2eutil.CreateBlock(context.Background(), tmpDir, []labels.Labels{labels.FromStrings("a", "1")}, 100, 0, 1000, labels.Labels{{Name: "ext", Value: "1"}}, 124)
+	testutil.Ok(t, err)
+	bdir := filepath.Join(tmpDir, b.String())
+	before, err := ioutil.ReadFile(filepath.Join(bdir, IndexFilename))
+	testutil.Ok(t, err)
+
+	report, err := DropSeriesWithMissingChunks(log.NewNopLogger(), bdir)
+	testutil.Ok(t, err)
+	testutil.Assert(t, report.OK(), "unexpected report %+v", report)
+	after, err := ioutil.ReadFile(filepath.Join(bdir, IndexFilename))
+	testutil.Ok(t, err)
+	testutil.Equals(t, before, after)
+}
@@ -0,0 +1,214 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"path"
+	"path/filepath"
+
+	"github.com/cespare/xxhash"
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// SeriesFilterFilename is the name of the series filter of a block, uploaded next to its index.
+	SeriesFilterFilename = "series-filter"
+
+	// SeriesFilterVersion1 is the first version of the series filter format.
+	SeriesFilterVersion1 = 1
+
+	seriesFilterMagic = 0x5E41E5F1
+	// seriesFilterHeaderLen is the length of the magic number, version, number of hash functions and number of bits.
+	seriesFilterHeaderLen = 4 + 1 + 1 + 8
+	maxSeriesFilterHashes = 32
+)
+
+// ErrSeriesFilterNotFound is returned by ReadSeriesFilter if the block has no series filter.
+var ErrSeriesFilterNotFound = errors.New("series filter not found")
+
+// SeriesFilter is a bloom filter of the label pairs of all series of a block, so readers can skip blocks without any
+// series matching the equality matchers of a selective query, without reading the index of the block. It never
+// reports a label pair of the block missing, but may report label pairs present that are not.
+//
+// The series filter file holds, with integers in big endian: the 4 byte magic number, the 1 byte version, the 1 byte
+// number of hash functions k, the 8 byte number of bits m, the bitset of m/8 bytes and the 4 byte CRC32 Castagnoli
+// checksum of everything before it. Bit i of the bitset is bit i%8 of its byte i/8. The label pair name=value is in the
+// filter if bits (h1 + j*h2) % m are set for each j < k, with h1 and h2 the lower and upper 32 bits of xxhash of name,
+// 0xff and value.
+type SeriesFilter struct {
+	hashes uint8
+	bits   []byte
+}
+
+// NewSeriesFilter returns empty SeriesFilter sized for the given number of label pairs with the given false positive
+// rate.
+func NewSeriesFilter(pairs int, falsePositiveRate float64) *SeriesFilter {
+	if pairs < 1 {
+		pairs = 1
+	}
+	m := math.Ceil(-float64(pairs) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(pairs) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	if k > maxSeriesFilterHashes {
+		k = maxSeriesFilterHashes
+	}
+	return &SeriesFilter{hashes: uint8(k), bits: make([]byte, (int(m)+7)/8)}
+}
+
+func seriesFilterHash(name, value string) (uint32, uint32) {
+	d := xxhash.New()
+	_, _ = d.Write([]byte(name))
+	_, _ = d.Write([]byte{0xff})
+	_, _ = d.Write([]byte(value))
+	h := d.Sum64()
+	return uint32(h), uint32(h >> 32)
+}
+
+// Add adds the label pair to the filter.
+func (f *SeriesFilter) Add(name, value string) {
+	h1, h2 := seriesFilterHash(name, value)
+	m := uint64(len(f.bits)) * 8
+	for j := uint64(0); j < uint64(f.hashes); j++ {
+		i := (uint64(h1) + j*uint64(h2)) % m
+		f.bits[i/8] |= 1 << (i % 8)
+	}
+}
+
+// MayContain returns false if no series of the block has the given label pair.
+func (f *SeriesFilter) MayContain(name, value string) bool {
+	h1, h2 := seriesFilterHash(name, value)
+	m := uint64(len(f.bits)) * 8
+	for j := uint64(0); j < uint64(f.hashes); j++ {
+		i := (uint64(h1) + j*uint64(h2)) % m
+		if f.bits[i/8]&(1<<(i%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// MayMatch returns false if no series of the block can match all the given matchers. Only equality matchers of
+// non-empty values are checked, as other matchers may match series without any label pair known upfront.
+func (f *SeriesFilter) MayMatch(matchers ...*labels.Matcher) bool {
+	for _, m := range matchers {
+		if m.Type == labels.MatchEqual && m.Value != "" && !f.MayContain(m.Name, m.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// MarshalBinary encodes the filter in the series filter format.
+func (f *SeriesFilter) MarshalBinary() ([]byte, error) {
+	b := make([]byte, seriesFilterHeaderLen, seriesFilterHeaderLen+len(f.bits)+4)
+	binary.BigEndian.PutUint32(b[0:4], seriesFilterMagic)
+	b[4] = SeriesFilterVersion1
+	b[5] = f.hashes
+	binary.BigEndian.PutUint64(b[6:14], uint64(len(f.bits))*8)
+	b = append(b, f.bits...)
+	sum := crc32.Checksum(b, castagnoli)
+	return append(b, byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum)), nil
+}
+
+// DecodeSeriesFilter decodes a filter in the series filter format.
+func DecodeSeriesFilter(b []byte) (*SeriesFilter, error) {
+	if len(b) < seriesFilterHeaderLen+4 {
+		return nil, errors.Errorf("series filter of %d bytes is too short", len(b))
+	}
+	if binary.BigEndian.Uint32(b[0:4]) != seriesFilterMagic {
+		return nil, errors.New("invalid magic number of series filter")
+	}
+	if b[4] != SeriesFilterVersion1 {
+		return nil, errors.Errorf("unsupported series filter version %d", b[4])
+	}
+	body, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.Checksum(body, castagnoli) != sum {
+		return nil, errors.New("series filter checksum mismatch")
+	}
+	hashes, bits := b[5], binary.BigEndian.Uint64(b[6:14])
+	if hashes == 0 || hashes > maxSeriesFilterHashes {
+		return nil, errors.Errorf("invalid number of hashes %d of series filter", hashes)
+	}
+	bitset := body[seriesFilterHeaderLen:]
+	if bits == 0 || bits != uint64(len(bitset))*8 {
+		return nil, errors.Errorf("series filter of %d bits has bitset of %d bytes", bits, len(bitset))
+	}
+	return &SeriesFilter{hashes: hashes, bits: append([]byte(nil), bitset...)}, nil
+}
+
+// WriteSeriesFilter writes the series filter of all label pairs of the index of the block in the given directory, with
+// the given false positive rate, into SeriesFilterFilename of the directory. Upload uploads it next to the index.
+func WriteSeriesFilter(bdir string, falsePositiveRate float64) (_ *SeriesFilter, err error) {
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, errors.Errorf("false positive rate of series filter has to be within (0, 1), got %v", falsePositiveRate)
+	}
+	ir, err := index.NewFileReader(filepath.Join(bdir, IndexFilename))
+	if err != nil {
+		return nil, errors.Wrap(err, "open index")
+	}
+	defer runutil.CloseWithErrCapture(&err, ir, "close index reader")
+
+	names, err := ir.LabelNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "label names")
+	}
+	values := make(map[string][]string, len(names))
+	pairs := 0
+	for _, n := range names {
+		vs, err := ir.LabelValues(n)
+		if err != nil {
+			return nil, errors.Wrapf(err, "label values of %s", n)
+		}
+		values[n] = vs
+		pairs += len(vs)
+	}
+
+	f := NewSeriesFilter(pairs, falsePositiveRate)
+	for _, n := range names {
+		for _, v := range values[n] {
+			f.Add(n, v)
+		}
+	}
+	b, err := f.MarshalBinary()
+	if err != nil {
+		return nil, errors.Wrap(err, "encode series filter")
+	}
+	if err := ioutil.WriteFile(filepath.Join(bdir, SeriesFilterFilename), b, 0666); err != nil {
+		return nil, errors.Wrap(err, "write series filter")
+	}
+	return f, nil
+}
+
+// ReadSeriesFilter reads the series filter of the block with the given ID from the bucket. It returns
+// ErrSeriesFilterNotFound if the block has none, e.g. because it was not compacted with series filters enabled.
+func ReadSeriesFilter(ctx context.Context, logger log.Logger, bkt objstore.InstrumentedBucketReader, id ulid.ULID) (*SeriesFilter, error) {
+	r, err := bkt.ReaderWithExpectedErrs(bkt.IsObjNotFoundErr).Get(ctx, path.Join(id.String(), SeriesFilterFilename))
+	if bkt.IsObjNotFoundErr(err) {
+		return nil, ErrSeriesFilterNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "get series filter of %s", id)
+	}
+	defer runutil.CloseWithLogOnErr(logger, r, "close series filter reader")
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read series filter of %s", id)
+	}
+	return DecodeSeriesFilter(b)
+}
@@ -0,0 +1,78 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestSeriesFilter(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "series-filter")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	var series []labels.Labels
+	for i := 0; i < 100; i++ {
+		series = append(series, labels.FromStrings("job", fmt.Sprintf("job-%d", i%10), "instance", fmt.Sprintf("instance-%d", i)))
+	}
+	id, err := e2eutil.CreateBlock(ctx, tmpDir, series, 10, 0, 1000, labels.Labels{{Name: "ext", Value: "1"}}, 0)
+	testutil.Ok(t, err)
+	bdir := filepath.Join(tmpDir, id.String())
+
+	_, err = WriteSeriesFilter(bdir, 1)
+	testutil.NotOk(t, err)
+	f, err := WriteSeriesFilter(bdir, 0.001)
+	testutil.Ok(t, err)
+
+	for _, s := range series {
+		for _, l := range s {
+			testutil.Assert(t, f.MayContain(l.Name, l.Value), "label pair %s=%s missing in filter", l.Name, l.Value)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if f.MayContain("instance", fmt.Sprintf("other-%d", i)) {
+			falsePositives++
+		}
+	}
+	testutil.Assert(t, falsePositives < 10, "too many false positives: %d", falsePositives)
+
+	testutil.Assert(t, f.MayMatch(labels.MustNewMatcher(labels.MatchEqual, "job", "job-3"), labels.MustNewMatcher(labels.MatchRegexp, "instance", "other.*")))
+	testutil.Assert(t, f.MayMatch(labels.MustNewMatcher(labels.MatchEqual, "job", "")))
+	testutil.Assert(t, !f.MayMatch(labels.MustNewMatcher(labels.MatchEqual, "job", "job-3"), labels.MustNewMatcher(labels.MatchEqual, "job", "job-missing")))
+
+	// Filter is uploaded next to the index and read back.
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, bdir))
+	read, err := ReadSeriesFilter(ctx, log.NewNopLogger(), bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, f, read)
+
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(id.String(), SeriesFilterFilename)))
+	_, err = ReadSeriesFilter(ctx, log.NewNopLogger(), bkt, id)
+	testutil.Equals(t, ErrSeriesFilterNotFound, err)
+
+	// Corruptions are detected.
+	b, err := f.MarshalBinary()
+	testutil.Ok(t, err)
+	b[seriesFilterHeaderLen] ^= 0xff
+	_, err = DecodeSeriesFilter(b)
+	testutil.NotOk(t, err)
+	_, err = DecodeSeriesFilter(b[:seriesFilterHeaderLen])
+	testutil.NotOk(t, err)
+}
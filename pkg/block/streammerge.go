@@ -0,0 +1,291 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/prometheus/prometheus/tsdb/tombstones"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// DownloadIndex downloads meta.json and index of the block with the given ID into dst, without its chunks, e.g. to be
+// merged by StreamMerge.
+func DownloadIndex(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, dst string, opts ...objstore.DownloadOption) error {
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		return errors.Wrap(err, "create dir")
+	}
+	for _, fn := range []string{MetaFilename, IndexFilename} {
+		if err := objstore.DownloadFile(ctx, logger, bkt, path.Join(id.String(), fn), filepath.Join(dst, fn), opts...); err != nil {
+			return errors.Wrapf(err, "download %s", fn)
+		}
+	}
+	return nil
+}
+
+// StreamMerge merges blocks not overlapping in time, of which only meta.json and index are in the given directories
+// (see DownloadIndex), into a new block within dest directory and returns its ID and the size of its chunks. Unlike
+// compaction of downloaded blocks, it needs local disk space only for the indexes: the time range of each source block
+// is a window whose chunk segments are streamed from object storage straight into chunk segments of the new block in
+// object storage, window by window, or copied within object storage if the bucket supports server side copy (see
+// objstore.Copier). Chunks are never re-encoded, so the merged index just refers to the chunks at their
+// new place. Only meta.json and index of the new block are left in dest to be uploaded, together with an empty chunks
+// directory and tombstones, so the block can be finalized and uploaded the same way as compacted blocks.
+// Uploaded chunks are deleted if merge fails. An empty ULID is returned and nothing is uploaded if the merged block
+// would have no samples. ID of the new block is created with the given entropy, or random one if nil.
+func StreamMerge(ctx context.Context, logger log.Logger, bkt objstore.Bucket, dest string, dirs []string, entropy io.Reader) (_ ulid.ULID, chunkBytes int64, err error) {
+	var (
+		metas   []tsdb.BlockMeta
+		indexrs []tsdb.IndexReader
+		samples uint64
+	)
+	for _, d := range dirs {
+		m, err := metadata.Read(d)
+		if err != nil {
+			return ulid.ULID{}, 0, errors.Wrapf(err, "read meta of %s", d)
+		}
+		metas = append(metas, m.BlockMeta)
+		samples += m.Stats.NumSamples
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].MinTime < metas[j].MinTime })
+	for i := 1; i < len(metas); i++ {
+		if metas[i].MinTime < metas[i-1].MaxTime {
+			return ulid.ULID{}, 0, errors.Errorf("blocks %s and %s overlap", metas[i-1].ULID, metas[i].ULID)
+		}
+	}
+	if samples == 0 {
+		return ulid.ULID{}, 0, nil
+	}
+
+	// Segments of each source keep their order, following segments of preceding sources.
+	segments := make([][]string, len(metas))
+	firstSegment := make([]uint64, len(metas))
+	var total uint64
+	for i, m := range metas {
+		if segments[i], err = chunkSegments(ctx, bkt, m.ULID); err != nil {
+			return ulid.ULID{}, 0, err
+		}
+		firstSegment[i] = total
+		total += uint64(len(segments[i]))
+
+		r, err := index.NewFileReader(filepath.Join(dirOf(dirs, m.ULID), IndexFilename))
+		if err != nil {
+			return ulid.ULID{}, 0, errors.Wrapf(err, "open index of block %s", m.ULID)
+		}
+		defer runutil.CloseWithErrCapture(&err, r, "stream merge index reader")
+		indexrs = append(indexrs, r)
+	}
+
+	if entropy == nil {
+		entropy = rand.Reader
+	}
+	id, err := ulid.New(ulid.Now(), entropy)
+	if err != nil {
+		return ulid.ULID{}, 0, errors.Wrap(err, "new ULID")
+	}
+	meta := &metadata.Meta{BlockMeta: mergedBlockMeta(id, metas)}
+	meta.Version = metadata.MetaVersion1
+	meta.Stats.NumSamples = samples
+
+	tmpdir := filepath.Join(dest, id.String()+".tmp")
+	if err := os.RemoveAll(tmpdir); err != nil {
+		return ulid.ULID{}, 0, errors.Wrap(err, "clean merge dir")
+	}
+	defer func() {
+		if rerr := os.RemoveAll(tmpdir); rerr != nil && err == nil {
+			err = errors.Wrap(rerr, "remove merge dir")
+		}
+	}()
+	if err := os.MkdirAll(filepath.Join(tmpdir, ChunksDirname), os.ModePerm); err != nil {
+		return ulid.ULID{}, 0, errors.Wrap(err, "create chunks dir")
+	}
+	if err := mergeIndexes(ctx, filepath.Join(tmpdir, IndexFilename), indexrs, firstSegment, meta); err != nil {
+		return ulid.ULID{}, 0, errors.Wrap(err, "merge indexes")
+	}
+
+	// Chunks are streamed before Upload could detect a collision, so make sure they do not overwrite a foreign block.
+	exists, err := bkt.Exists(ctx, path.Join(id.String(), MetaFilename))
+	if err != nil {
+		return ulid.ULID{}, 0, errors.Wrapf(err, "check existence of block %s", id)
+	}
+	if exists {
+		return ulid.ULID{}, 0, errors.Wrapf(ErrULIDCollision, "block %s created by %s already exists in bucket", id, FingerprintOf(id))
+	}
+
+	var seq int
+	for i, m := range metas {
+		for _, s := range segments[i] {
+			seq++
+			n, err := copyObject(ctx, bkt, s, path.Join(id.String(), ChunksDirname, fmt.Sprintf("%0.6d", seq)))
+			if err != nil {
+				return ulid.ULID{}, chunkBytes, cleanUp(logger, bkt, id, errors.Wrapf(err, "stream chunks of block %s", m.ULID))
+			}
+			chunkBytes += n
+		}
+		level.Debug(logger).Log("msg", "streamed chunks of source block", "block", m.ULID, "new", id, "segments", len(segments[i]))
+	}
+
+	if err := metadata.Write(logger, tmpdir, meta); err != nil {
+		return ulid.ULID{}, chunkBytes, cleanUp(logger, bkt, id, errors.Wrap(err, "write meta file"))
+	}
+	if _, err := tombstones.WriteFile(logger, tmpdir, tombstones.NewMemTombstones()); err != nil {
+		return ulid.ULID{}, chunkBytes, cleanUp(logger, bkt, id, errors.Wrap(err, "write tombstones"))
+	}
+	if err := os.Rename(tmpdir, filepath.Join(dest, id.String())); err != nil {
+		return ulid.ULID{}, chunkBytes, cleanUp(logger, bkt, id, errors.Wrap(err, "rename merged block dir"))
+	}
+	return id, chunkBytes, nil
+}
+
+// mergeIndexes writes index of series of all given indexes, whose chunks are moved to segments following the given first
+// segment of each index.
+func mergeIndexes(ctx context.Context, fn string, indexrs []tsdb.IndexReader, firstSegment []uint64, meta *metadata.Meta) (err error) {
+	indexw, err := index.NewWriter(ctx, fn)
+	if err != nil {
+		return errors.Wrap(err, "open index writer")
+	}
+	defer runutil.CloseWithErrCapture(&err, indexw, "stream merge index writer")
+
+	if err := addMergedSymbols(indexw, indexrs); err != nil {
+		return err
+	}
+
+	cursors := make([]*seriesCursor, 0, len(indexrs))
+	for _, indexr := range indexrs {
+		all, err := indexr.Postings(index.AllPostingsKey())
+		if err != nil {
+			return errors.Wrap(err, "postings")
+		}
+		c := &seriesCursor{indexr: indexr, postings: indexr.SortedPostings(all)}
+		if err := c.next(); err != nil {
+			return err
+		}
+		cursors = append(cursors, c)
+	}
+
+	for ref := uint64(0); ; ref++ {
+		var lset labels.Labels
+		for _, c := range cursors {
+			if c.lset != nil && (lset == nil || labels.Compare(c.lset, lset) < 0) {
+				lset = c.lset
+			}
+		}
+		if lset == nil {
+			return nil
+		}
+
+		// Indexes are ordered by time and do not overlap, so their chunks are in order as well.
+		var chks []chunks.Meta
+		for i, c := range cursors {
+			if c.lset == nil || !labels.Equal(c.lset, lset) {
+				continue
+			}
+			for _, chk := range c.chks {
+				chk.Ref = (firstSegment[i]+chk.Ref>>32)<<32 | chk.Ref&0xffffffff
+				chks = append(chks, chk)
+			}
+			if err := c.next(); err != nil {
+				return err
+			}
+		}
+		if err := indexw.AddSeries(ref, lset, chks...); err != nil {
+			return errors.Wrap(err, "add series")
+		}
+		meta.Stats.NumSeries++
+		meta.Stats.NumChunks += uint64(len(chks))
+	}
+}
+
+// chunkSegments returns object names of chunk segments of the block, in order.
+func chunkSegments(ctx context.Context, bkt objstore.Bucket, id ulid.ULID) ([]string, error) {
+	type segment struct {
+		name string
+		seq  uint64
+	}
+	var segments []segment
+	if err := bkt.Iter(ctx, path.Join(id.String(), ChunksDirname)+objstore.DirDelim, func(name string) error {
+		seq, err := strconv.ParseUint(path.Base(name), 10, 64)
+		if err != nil {
+			return nil
+		}
+		segments = append(segments, segment{name: name, seq: seq})
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "list chunk segments of block %s", id)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].seq < segments[j].seq })
+
+	res := make([]string, 0, len(segments))
+	for _, s := range segments {
+		res = append(res, s.name)
+	}
+	return res, nil
+}
+
+// copyObject copies the object src into the object dst and returns its size. Buckets supporting server side copy copy it
+// without streaming it through the client.
+func copyObject(ctx context.Context, bkt objstore.Bucket, src, dst string) (_ int64, err error) {
+	if objstore.SupportsServerSideCopy(bkt) {
+		if err := objstore.Copy(ctx, bkt, src, dst); err != nil {
+			return 0, errors.Wrapf(err, "copy %s to %s", src, dst)
+		}
+		attrs, err := bkt.Attributes(ctx, dst)
+		if err != nil {
+			return 0, errors.Wrapf(err, "attributes of %s", dst)
+		}
+		return attrs.Size, nil
+	}
+
+	rc, err := bkt.Get(ctx, src)
+	if err != nil {
+		return 0, errors.Wrapf(err, "get %s", src)
+	}
+	defer runutil.CloseWithErrCapture(&err, rc, "source object")
+
+	r := &countingReader{r: rc}
+	if err := bkt.Upload(ctx, dst, r); err != nil {
+		return r.n, errors.Wrapf(err, "upload %s", dst)
+	}
+	return r.n, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// dirOf returns the directory of the block with the given ID among the given directories.
+func dirOf(dirs []string, id ulid.ULID) string {
+	for _, d := range dirs {
+		if filepath.Base(d) == id.String() {
+			return d
+		}
+	}
+	return filepath.Join(filepath.Dir(dirs[0]), id.String())
+}
@@ -0,0 +1,134 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestStreamMerge(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.NewInMemBucket()
+
+	tmpDir, err := ioutil.TempDir("", "test-stream-merge")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	extLset := labels.Labels{{Name: "ext", Value: "1"}}
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+	}, 500, 0, 1000, extLset, 0)
+	testutil.Ok(t, err)
+	b2, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.FromStrings("a", "2"),
+		labels.FromStrings("a", "3"),
+	}, 500, 1000, 2000, extLset, 0)
+	testutil.Ok(t, err)
+
+	var dirs []string
+	for _, id := range []ulid.ULID{b2, b1} {
+		testutil.Ok(t, Upload(ctx, logger, bkt, filepath.Join(tmpDir, id.String())))
+		dir := filepath.Join(tmpDir, "indexes", id.String())
+		testutil.Ok(t, DownloadIndex(ctx, logger, bkt, id, dir))
+		_, err := os.Stat(filepath.Join(dir, ChunksDirname))
+		testutil.Assert(t, os.IsNotExist(err), "chunks downloaded")
+		dirs = append(dirs, dir)
+	}
+
+	dest := filepath.Join(tmpDir, "merged")
+	fp := NewFingerprint("compactor-1")
+	id, chunkBytes, err := StreamMerge(ctx, logger, bkt, dest, dirs, fp.Entropy())
+	testutil.Ok(t, err)
+	testutil.Assert(t, chunkBytes > 0, "no chunks streamed")
+	testutil.Equals(t, fp, FingerprintOf(id))
+
+	bdir := filepath.Join(dest, id.String())
+	m, err := metadata.Read(bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(0), m.MinTime)
+	testutil.Equals(t, int64(2000), m.MaxTime)
+	testutil.Equals(t, 2, len(m.Compaction.Parents))
+	testutil.Equals(t, uint64(3), m.Stats.NumSeries)
+	// Chunks of at most 120 samples are streamed as they are.
+	testutil.Equals(t, uint64(4*5), m.Stats.NumChunks)
+	testutil.Equals(t, uint64(4*500), m.Stats.NumSamples)
+
+	// Upload the merged index next to the streamed chunks and read the block back from the bucket.
+	_, err = metadata.InjectThanos(logger, bdir, metadata.Thanos{Labels: extLset.Map()}, nil)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, logger, bkt, bdir))
+	downloaded := filepath.Join(tmpDir, "downloaded", id.String())
+	testutil.Ok(t, Download(ctx, logger, bkt, id, downloaded))
+
+	b, err := tsdb.OpenBlock(logger, downloaded, chunkenc.NewPool())
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, b.Close()) }()
+	ir, err := b.Index()
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, ir.Close()) }()
+	cr, err := b.Chunks()
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, cr.Close()) }()
+
+	all, err := ir.Postings(index.AllPostingsKey())
+	testutil.Ok(t, err)
+	samples := map[string]int{}
+	for all.Next() {
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
+		testutil.Ok(t, ir.Series(all.At(), &lset, &chks))
+		for _, chk := range chks {
+			c, err := cr.Chunk(chk.Ref)
+			testutil.Ok(t, err)
+			it := c.Iterator(nil)
+			for it.Next() {
+				ts, _ := it.At()
+				testutil.Assert(t, ts >= chk.MinTime && ts <= chk.MaxTime, "sample %d of %s outside of its chunk", ts, lset)
+				samples[lset.String()]++
+			}
+			testutil.Ok(t, it.Err())
+		}
+	}
+	testutil.Ok(t, all.Err())
+	testutil.Equals(t, map[string]int{`{a="1"}`: 500, `{a="2"}`: 1000, `{a="3"}`: 500}, samples)
+}
+
+func TestStreamMerge_Overlapping(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	tmpDir, err := ioutil.TempDir("", "test-stream-merge-overlapping")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	var dirs []string
+	for _, mint := range []int64{0, 500} {
+		id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{labels.FromStrings("a", "1")}, 100, mint, mint+1000, labels.Labels{{Name: "ext", Value: "1"}}, 0)
+		testutil.Ok(t, err)
+		dirs = append(dirs, filepath.Join(tmpDir, id.String()))
+	}
+	_, _, err = StreamMerge(ctx, logger, objstore.NewInMemBucket(), tmpDir, dirs, nil)
+	testutil.NotOk(t, err)
+}
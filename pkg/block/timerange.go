@@ -0,0 +1,100 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// IndexTimeRangeReport describes time ranges of chunks of an index compared with the time range of the meta of its block.
+// Chunks outside of the time range because of https://github.com/prometheus/tsdb/issues/347 are not taken into account,
+// as they are repaired explicitly before compaction.
+type IndexTimeRangeReport struct {
+	// MetaMinTime and MetaMaxTime are the time range of the meta the index is compared with.
+	MetaMinTime, MetaMaxTime int64
+	// Series is the number of checked series.
+	Series int
+	// Sampled is true if only a sample of series was checked.
+	Sampled bool
+	// Chunks is the number of checked chunks.
+	Chunks int
+	// OutsideChunks is the number of checked chunks not within the time range of the meta.
+	OutsideChunks int
+	// MinTime and MaxTime are the time range of checked chunks; MaxTime is exclusive, like the one of the meta.
+	MinTime, MaxTime int64
+}
+
+// OK returns true if all checked chunks are within the time range of the meta.
+func (r IndexTimeRangeReport) OK() bool {
+	return r.OutsideChunks == 0
+}
+
+// Err returns error if any checked chunk is not within the time range of the meta.
+func (r IndexTimeRangeReport) Err() error {
+	if r.OK() {
+		return nil
+	}
+	return errors.Errorf("%d of %d checked chunks outside of meta time range [%d, %d), chunks span [%d, %d)",
+		r.OutsideChunks, r.Chunks, r.MetaMinTime, r.MetaMaxTime, r.MinTime, r.MaxTime)
+}
+
+// CheckIndexTimeRange compares time ranges of chunks of the given index file with the given time range of the meta of its
+// block. With sampleEvery greater than one, only every sampleEvery-th series is checked, which is enough to catch metas of
+// blocks written with bogus time ranges, but not to tell the time range of all chunks.
+func CheckIndexTimeRange(fn string, minTime, maxTime int64, sampleEvery int) (report IndexTimeRangeReport, err error) {
+	if sampleEvery < 1 {
+		sampleEvery = 1
+	}
+	report = IndexTimeRangeReport{MetaMinTime: minTime, MetaMaxTime: maxTime, Sampled: sampleEvery > 1}
+
+	r, err := openIndexReader(fn)
+	if err != nil {
+		return report, errors.Wrap(err, "open index file")
+	}
+	defer runutil.CloseWithErrCapture(&err, r, "check index time range file reader")
+
+	p, err := r.Postings(index.AllPostingsKey())
+	if err != nil {
+		return report, errors.Wrap(err, "get all postings")
+	}
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	for i := 0; p.Next(); i++ {
+		if i%sampleEvery != 0 {
+			continue
+		}
+		if err := r.Series(p.At(), &lset, &chks); err != nil {
+			return report, errors.Wrap(err, "read series")
+		}
+		report.Series++
+
+		for _, c := range chks {
+			// Issue347 outsiders start at the end of the block and are removed by its repair.
+			if c.MinTime == maxTime && c.MaxTime > maxTime {
+				continue
+			}
+			if report.Chunks == 0 || c.MinTime < report.MinTime {
+				report.MinTime = c.MinTime
+			}
+			if report.Chunks == 0 || c.MaxTime+1 > report.MaxTime {
+				report.MaxTime = c.MaxTime + 1
+			}
+			report.Chunks++
+			if c.MinTime < minTime || c.MaxTime > maxTime {
+				report.OutsideChunks++
+			}
+		}
+	}
+	if p.Err() != nil {
+		return report, errors.Wrap(p.Err(), "walk postings")
+	}
+	return report, nil
+}
@@ -0,0 +1,92 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// Fingerprint identifies the creator of blocks by the leading bytes of entropy of their ULIDs. ULIDs created by
+// different instances within the same millisecond differ in their fingerprints, leaving collisions only to ULIDs created
+// by the same instance, whose remaining 48 bits of entropy are random.
+type Fingerprint [4]byte
+
+// NewFingerprint returns the fingerprint of the given instance, e.g. its hostname.
+func NewFingerprint(instance string) Fingerprint {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(instance))
+
+	var f Fingerprint
+	binary.BigEndian.PutUint32(f[:], h.Sum32())
+	return f
+}
+
+// FingerprintOf returns the fingerprint embedded in the given ULID. It is random for ULIDs not created with
+// Fingerprint.Entropy.
+func FingerprintOf(id ulid.ULID) Fingerprint {
+	var f Fingerprint
+	copy(f[:], id.Entropy())
+	return f
+}
+
+func (f Fingerprint) String() string {
+	return hex.EncodeToString(f[:])
+}
+
+// Entropy returns a go-routine safe entropy source of ULIDs embedding the fingerprint.
+func (f Fingerprint) Entropy() io.Reader {
+	return fingerprintEntropy(f)
+}
+
+type fingerprintEntropy Fingerprint
+
+func (e fingerprintEntropy) Read(p []byte) (int, error) {
+	n := copy(p, e[:])
+	if _, err := rand.Read(p[n:]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Reidentify gives the block in dir with the given ID a new ID of the same time created with the given entropy. It
+// renames the block directory and updates its meta.json, returning the new ID.
+func Reidentify(logger log.Logger, dir string, id ulid.ULID, entropy io.Reader) (ulid.ULID, error) {
+	newID, err := ulid.New(id.Time(), entropy)
+	if err != nil {
+		return ulid.ULID{}, errors.Wrap(err, "new ULID")
+	}
+	if err := ReidentifyAs(logger, dir, id, newID); err != nil {
+		return ulid.ULID{}, err
+	}
+	return newID, nil
+}
+
+// ReidentifyAs gives the block in dir with the given ID the given new ID, like Reidentify.
+func ReidentifyAs(logger log.Logger, dir string, id, newID ulid.ULID) error {
+	bdir := filepath.Join(dir, id.String())
+	meta, err := metadata.Read(bdir)
+	if err != nil {
+		return errors.Wrapf(err, "read meta of block %s", id)
+	}
+	meta.ULID = newID
+	if err := metadata.Write(logger, bdir, meta); err != nil {
+		return errors.Wrapf(err, "write meta of block %s", newID)
+	}
+	if err := os.Rename(bdir, filepath.Join(dir, newID.String())); err != nil {
+		return errors.Wrapf(err, "rename block dir %s", id)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestFingerprint(t *testing.T) {
+	f1, f2 := NewFingerprint("compactor-1"), NewFingerprint("compactor-2")
+	testutil.Equals(t, f1, NewFingerprint("compactor-1"))
+	testutil.Assert(t, f1 != f2, "fingerprints of different instances are equal")
+
+	seen := map[ulid.ULID]struct{}{}
+	for i := 0; i < 100; i++ {
+		id := ulid.MustNew(1000, f1.Entropy())
+		testutil.Equals(t, f1, FingerprintOf(id))
+		testutil.Equals(t, uint64(1000), id.Time())
+
+		_, ok := seen[id]
+		testutil.Assert(t, !ok, "duplicated ULID %s", id)
+		seen[id] = struct{}{}
+	}
+}
+
+func TestReidentify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-reidentify")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	id := ulid.MustNew(1000, nil)
+	testutil.Ok(t, os.MkdirAll(filepath.Join(dir, id.String()), os.ModePerm))
+	testutil.Ok(t, metadata.Write(log.NewNopLogger(), filepath.Join(dir, id.String()), &metadata.Meta{
+		BlockMeta: tsdb.BlockMeta{Version: 1, ULID: id, MinTime: 0, MaxTime: 1000},
+	}))
+
+	f := NewFingerprint("compactor-1")
+	newID, err := Reidentify(log.NewNopLogger(), dir, id, f.Entropy())
+	testutil.Ok(t, err)
+	testutil.Equals(t, id.Time(), newID.Time())
+	testutil.Equals(t, f, FingerprintOf(newID))
+
+	m, err := metadata.Read(filepath.Join(dir, newID.String()))
+	testutil.Ok(t, err)
+	testutil.Equals(t, newID, m.ULID)
+	_, err = os.Stat(filepath.Join(dir, id.String()))
+	testutil.Assert(t, os.IsNotExist(err), "old block dir still exists")
+}
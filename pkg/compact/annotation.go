@@ -0,0 +1,261 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// retentionAnnotationsRefreshInterval is how long retention annotations are reused between evaluations, so applying
+// retention to many blocks does not read all annotations for every block.
+const retentionAnnotationsRefreshInterval = 30 * time.Second
+
+// RetentionAnnotationStatus is a retention annotation with blocks it preserved from the last retention.
+type RetentionAnnotationStatus struct {
+	metadata.RetentionAnnotation
+
+	PreservedBlocks []ulid.ULID `json:"preservedBlocks"`
+	// PreservedBytes is the size of preserved blocks, estimated from their metas.
+	PreservedBytes int64 `json:"preservedBytes"`
+}
+
+// RetentionAnnotationPolicy is a DeletionPolicy keeping blocks preserved by any retention annotation in the bucket (see
+// metadata.RetentionAnnotation) from deletion by retention, including retention rules. Other deletions, e.g. of sources
+// of compactions, are allowed, as data of such blocks stays in the blocks they were merged into, which are preserved in
+// turn. Go-routine safe.
+type RetentionAnnotationPolicy struct {
+	logger log.Logger
+	bkt    objstore.Bucket
+	now    func() time.Time
+
+	mtx         sync.Mutex
+	annotations []*compiledAnnotation
+	read        time.Time
+	// preserved are blocks denied deletion by retention when last evaluated, with their estimated size.
+	preserved map[ulid.ULID]preservedBlock
+
+	preservedBlocks *prometheus.GaugeVec
+	preservedBytes  *prometheus.GaugeVec
+}
+
+type preservedBlock struct {
+	annotations []string
+	bytes       int64
+}
+
+type compiledAnnotation struct {
+	*metadata.RetentionAnnotation
+
+	// sources are annotated blocks and their sources, if their metas are still in the bucket.
+	sources  map[ulid.ULID]struct{}
+	matchers [][]*labels.Matcher
+}
+
+// NewRetentionAnnotationPolicy returns RetentionAnnotationPolicy reading annotations from the given bucket.
+func NewRetentionAnnotationPolicy(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket) *RetentionAnnotationPolicy {
+	return &RetentionAnnotationPolicy{
+		logger:    logger,
+		bkt:       bkt,
+		now:       time.Now,
+		preserved: map[ulid.ULID]preservedBlock{},
+		preservedBlocks: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_retention_annotation_preserved_blocks",
+			Help: "Number of blocks past their retention kept because of the retention annotation, as of their last retention evaluation.",
+		}, []string{"annotation"}),
+		preservedBytes: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_retention_annotation_preserved_bytes",
+			Help: "Size of blocks past their retention kept because of the retention annotation, estimated from their metas.",
+		}, []string{"annotation"}),
+	}
+}
+
+// AllowDeletion implements DeletionPolicy.
+func (p *RetentionAnnotationPolicy) AllowDeletion(ctx context.Context, meta *metadata.Meta, reason metadata.DeletionReason) (bool, error) {
+	if reason != RetentionDeletionReason && reason != metadata.KeepLastBlocksDeletionReason {
+		return true, nil
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if err := p.refresh(ctx); err != nil {
+		return false, err
+	}
+	var names []string
+	lset := labels.FromMap(meta.Thanos.Labels)
+	for _, a := range p.annotations {
+		if a.preserves(meta, lset) {
+			names = append(names, a.Name)
+		}
+	}
+	if len(names) == 0 {
+		delete(p.preserved, meta.ULID)
+		p.updateMetrics()
+		return true, nil
+	}
+	p.preserved[meta.ULID] = preservedBlock{
+		annotations: names,
+		bytes:       estimatedBlockBytes(meta.Stats.NumSamples, meta.Stats.NumSeries, meta.Stats.NumChunks),
+	}
+	p.updateMetrics()
+	level.Debug(p.logger).Log("msg", "retention annotations preserve block past its retention", "block", meta.ULID, "annotations", len(names))
+	return false, nil
+}
+
+// Annotations returns all retention annotations, sorted by name.
+func (p *RetentionAnnotationPolicy) Annotations(ctx context.Context) ([]RetentionAnnotationStatus, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if err := p.refresh(ctx); err != nil {
+		return nil, err
+	}
+	res := make([]RetentionAnnotationStatus, 0, len(p.annotations))
+	for _, a := range p.annotations {
+		s := RetentionAnnotationStatus{RetentionAnnotation: *a.RetentionAnnotation, PreservedBlocks: []ulid.ULID{}}
+		for id, b := range p.preserved {
+			if contains(b.annotations, a.Name) {
+				s.PreservedBlocks = append(s.PreservedBlocks, id)
+				s.PreservedBytes += b.bytes
+			}
+		}
+		sort.Slice(s.PreservedBlocks, func(i, j int) bool {
+			return s.PreservedBlocks[i].Compare(s.PreservedBlocks[j]) < 0
+		})
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// Add uploads the given annotation, replacing an annotation of the same name. It applies to the next evaluation.
+func (p *RetentionAnnotationPolicy) Add(ctx context.Context, a metadata.RetentionAnnotation) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.read = time.Time{}
+	return block.UploadRetentionAnnotation(ctx, p.bkt, a)
+}
+
+// Remove deletes the annotation with the given name, so blocks it preserved are deleted by the next retention, unless
+// other annotations preserve them.
+func (p *RetentionAnnotationPolicy) Remove(ctx context.Context, name string) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.read = time.Time{}
+	return block.DeleteRetentionAnnotation(ctx, p.bkt, name)
+}
+
+// refresh reads retention annotations if they were not read recently.
+func (p *RetentionAnnotationPolicy) refresh(ctx context.Context) error {
+	if !p.read.IsZero() && p.now().Sub(p.read) < retentionAnnotationsRefreshInterval {
+		return nil
+	}
+	annotations, err := metadata.ReadRetentionAnnotations(ctx, p.bkt, p.logger)
+	if err != nil {
+		return errors.Wrap(err, "read retention annotations")
+	}
+	sort.Slice(annotations, func(i, j int) bool {
+		return annotations[i].Name < annotations[j].Name
+	})
+
+	compiled := make([]*compiledAnnotation, 0, len(annotations))
+	for _, a := range annotations {
+		c := &compiledAnnotation{RetentionAnnotation: a, sources: map[ulid.ULID]struct{}{}}
+		for _, id := range a.Blocks {
+			c.sources[id] = struct{}{}
+			m, err := block.DownloadMeta(ctx, p.logger, p.bkt, id)
+			if err != nil {
+				if p.bkt.IsObjNotFoundErr(errors.Cause(err)) {
+					continue
+				}
+				return errors.Wrapf(err, "download meta of block %s annotated by %s", id, a.Name)
+			}
+			for _, s := range m.Compaction.Sources {
+				c.sources[s] = struct{}{}
+			}
+		}
+		for _, r := range a.Ranges {
+			// Validated on read.
+			ms, _ := r.ParseMatchers()
+			c.matchers = append(c.matchers, ms)
+		}
+		compiled = append(compiled, c)
+	}
+	p.annotations, p.read = compiled, p.now()
+	p.updateMetrics()
+	return nil
+}
+
+// updateMetrics exposes preserved blocks of the current annotations.
+func (p *RetentionAnnotationPolicy) updateMetrics() {
+	p.preservedBlocks.Reset()
+	p.preservedBytes.Reset()
+	for _, a := range p.annotations {
+		p.preservedBlocks.WithLabelValues(a.Name)
+		p.preservedBytes.WithLabelValues(a.Name)
+	}
+	for _, b := range p.preserved {
+		for _, name := range b.annotations {
+			p.preservedBlocks.WithLabelValues(name).Inc()
+			p.preservedBytes.WithLabelValues(name).Add(float64(b.bytes))
+		}
+	}
+}
+
+// preserves returns true if the annotation preserves the block with the given meta and external labels: the block holds
+// data of an annotated block or overlaps with an annotated range.
+func (a *compiledAnnotation) preserves(meta *metadata.Meta, lset labels.Labels) bool {
+	if _, ok := a.sources[meta.ULID]; ok {
+		return true
+	}
+	for _, s := range meta.Compaction.Sources {
+		if _, ok := a.sources[s]; ok {
+			return true
+		}
+	}
+	for i, r := range a.Ranges {
+		// Block's MaxTime is exclusive, while the range is inclusive.
+		if meta.MinTime > r.MaxTime || meta.MaxTime <= r.MinTime {
+			continue
+		}
+		if matchesAll(a.matchers[i], lset) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAll(matchers []*labels.Matcher, lset labels.Labels) bool {
+	for _, m := range matchers {
+		if !m.Matches(lset.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestRetentionAnnotationPolicy(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+
+	newMeta := func(ms uint64, mint, maxt int64, cluster string, sources ...ulid.ULID) *metadata.Meta {
+		id := ulid.MustNew(ms, nil)
+		m := &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: id, MinTime: mint, MaxTime: maxt, Compaction: tsdb.BlockMetaCompaction{Sources: append([]ulid.ULID{id}, sources...)},
+				Stats: tsdb.BlockStats{NumSamples: 1000, NumSeries: 10, NumChunks: 10}},
+			Thanos: metadata.Thanos{Labels: map[string]string{"cluster": cluster}},
+		}
+		b, err := json.Marshal(m)
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), block.MetaFilename), bytes.NewReader(b)))
+		return m
+	}
+	var (
+		annotated = newMeta(1000, 0, 100, "eu-1")
+		other     = newMeta(1500, 100, 200, "eu-1")
+		compacted = newMeta(2000, 0, 200, "eu-1", annotated.ULID, other.ULID)
+		inRange   = newMeta(2500, 1000, 2000, "us-1")
+		otherLset = newMeta(3000, 1000, 2000, "eu-1")
+	)
+
+	reg := prometheus.NewRegistry()
+	p := NewRetentionAnnotationPolicy(log.NewNopLogger(), reg, bkt)
+	allow := func(m *metadata.Meta, reason metadata.DeletionReason) bool {
+		ok, err := p.AllowDeletion(ctx, m, reason)
+		testutil.Ok(t, err)
+		return ok
+	}
+
+	// Without annotations, all blocks may be deleted.
+	testutil.Assert(t, allow(annotated, RetentionDeletionReason))
+
+	testutil.NotOk(t, p.Add(ctx, metadata.RetentionAnnotation{Name: "../escape", Blocks: []ulid.ULID{annotated.ULID}}))
+	testutil.NotOk(t, p.Add(ctx, metadata.RetentionAnnotation{Name: "empty"}))
+	testutil.Ok(t, p.Add(ctx, metadata.RetentionAnnotation{Name: "incident-1", Blocks: []ulid.ULID{compacted.ULID}}))
+	testutil.Ok(t, p.Add(ctx, metadata.RetentionAnnotation{Name: "incident-2", Ranges: []metadata.AnnotatedRange{
+		{Matchers: `{cluster="us-1"}`, MinTime: 1500, MaxTime: 1600},
+	}}))
+
+	// Sources of annotated blocks and blocks compacted from them are preserved.
+	testutil.Assert(t, !allow(annotated, RetentionDeletionReason))
+	testutil.Assert(t, !allow(other, RetentionDeletionReason))
+	testutil.Assert(t, !allow(compacted, RetentionDeletionReason))
+	testutil.Assert(t, !allow(inRange, RetentionDeletionReason))
+	testutil.Assert(t, allow(otherLset, RetentionDeletionReason))
+	// Other deletions keep the data in the blocks it was merged into.
+	testutil.Assert(t, allow(annotated, CompactedDeletionReason))
+
+	testutil.Equals(t, 3.0, promtest.ToFloat64(p.preservedBlocks.WithLabelValues("incident-1")))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(p.preservedBlocks.WithLabelValues("incident-2")))
+	testutil.Equals(t, float64(3*estimatedBlockBytes(1000, 10, 10)), promtest.ToFloat64(p.preservedBytes.WithLabelValues("incident-1")))
+
+	annotations, err := p.Annotations(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(annotations))
+	testutil.Equals(t, "incident-1", annotations[0].Name)
+	testutil.Equals(t, []ulid.ULID{annotated.ULID, other.ULID, compacted.ULID}, annotations[0].PreservedBlocks)
+	testutil.Equals(t, []ulid.ULID{inRange.ULID}, annotations[1].PreservedBlocks)
+
+	// Blocks are deleted once their annotation is removed.
+	testutil.Ok(t, p.Remove(ctx, "incident-2"))
+	testutil.Equals(t, block.ErrRetentionAnnotationNotFound, errors.Cause(p.Remove(ctx, "incident-2")))
+	testutil.Assert(t, allow(inRange, RetentionDeletionReason))
+	testutil.Equals(t, 1, promtest.CollectAndCount(p.preservedBlocks))
+}
@@ -0,0 +1,54 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// AppendCompactionMetrics exposes compactions done in append mode, see WithAppendCompaction.
+type AppendCompactionMetrics struct {
+	appends *prometheus.CounterVec
+}
+
+// NewAppendCompactionMetrics returns AppendCompactionMetrics registered in the given registerer.
+func NewAppendCompactionMetrics(reg prometheus.Registerer) *AppendCompactionMetrics {
+	return &AppendCompactionMetrics{
+		appends: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_group_append_compactions_total",
+			Help: "Total number of compactions of the group appending small blocks to a large one, without rewriting chunks of the large block.",
+		}, []string{"group_id"}),
+	}
+}
+
+// appendBase returns the block of the given plan that the other blocks are appended to in append mode: the block with
+// at least minRatio times as many samples as all other blocks together, which all start at or after its end. Returns
+// nil if there is no such block.
+func appendBase(metas []*metadata.Meta, minRatio float64) *metadata.Meta {
+	if minRatio <= 0 || len(metas) < 2 {
+		return nil
+	}
+	var (
+		base  *metadata.Meta
+		total uint64
+	)
+	for _, m := range metas {
+		total += m.Stats.NumSamples
+		if base == nil || m.Stats.NumSamples > base.Stats.NumSamples {
+			base = m
+		}
+	}
+	for _, m := range metas {
+		if m != base && m.MinTime < base.MaxTime {
+			return nil
+		}
+	}
+	if rest := total - base.Stats.NumSamples; float64(base.Stats.NumSamples) < minRatio*float64(rest) {
+		return nil
+	}
+	return base
+}
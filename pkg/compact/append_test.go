@@ -0,0 +1,30 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestAppendBase(t *testing.T) {
+	meta := func(id uint64, mint, maxt int64, samples uint64) *metadata.Meta {
+		return &metadata.Meta{BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(id, nil), MinTime: mint, MaxTime: maxt, Stats: tsdb.BlockStats{NumSamples: samples}}}
+	}
+	large := meta(1, 0, 100, 1000)
+	small1, small2 := meta(2, 100, 110, 40), meta(3, 110, 120, 60)
+
+	testutil.Equals(t, large, appendBase([]*metadata.Meta{small2, large, small1}, 10))
+	// Small blocks outgrew the ratio.
+	testutil.Assert(t, appendBase([]*metadata.Meta{large, small1, small2}, 11) == nil, "expected no append base")
+	// Blocks before the large one are not appended.
+	testutil.Assert(t, appendBase([]*metadata.Meta{meta(4, -10, 0, 10), large}, 10) == nil, "expected no append base")
+	testutil.Assert(t, appendBase([]*metadata.Meta{large, small1}, 0) == nil, "expected append mode disabled")
+	testutil.Assert(t, appendBase([]*metadata.Meta{large}, 10) == nil, "expected no append base of single block")
+}
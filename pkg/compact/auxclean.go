@@ -0,0 +1,178 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+const (
+	auxKindDebugMeta = "debug_meta"
+	auxKindMarker    = "marker"
+)
+
+// markerFilenames are names of marker files stored in block directories next to block files.
+var markerFilenames = map[string]struct{}{
+	metadata.DeletionMarkFilename:     {},
+	metadata.HoldMarkFilename:         {},
+	metadata.PendingDeletionsFilename: {},
+}
+
+// AuxiliaryCleaner deletes orphaned auxiliary objects, which otherwise accumulate in the bucket forever and inflate
+// listing costs: debug metas of blocks that no longer exist and markers left in directories of blocks that no longer
+// exist, e.g. because their deletion was interrupted.
+type AuxiliaryCleaner struct {
+	logger           log.Logger
+	bkt              objstore.Bucket
+	debugMetas       *block.DebugMetaReader
+	debugMetasMaxAge time.Duration
+	orphanedMarkers  bool
+	dryRun           bool
+
+	orphaned *prometheus.GaugeVec
+	deleted  *prometheus.CounterVec
+	failures *prometheus.CounterVec
+}
+
+// NewAuxiliaryCleaner returns AuxiliaryCleaner deleting debug metas under the given prefix (see block.NewDebugMetaReader)
+// of missing blocks created more than debugMetasMaxAge ago, if debugMetasMaxAge is non-zero, and orphaned markers, if orphanedMarkers is true. In dry run mode orphaned
+// objects are only logged and counted.
+func NewAuxiliaryCleaner(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket, debugMetasPrefix string, debugMetasMaxAge time.Duration, orphanedMarkers bool, dryRun bool) *AuxiliaryCleaner {
+	c := &AuxiliaryCleaner{
+		logger:           logger,
+		bkt:              bkt,
+		debugMetas:       block.NewDebugMetaReader(bkt, debugMetasPrefix),
+		debugMetasMaxAge: debugMetasMaxAge,
+		orphanedMarkers:  orphanedMarkers,
+		dryRun:           dryRun,
+		orphaned: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_orphaned_auxiliary_objects",
+			Help: "Number of orphaned auxiliary objects found by the last cleanup, by kind.",
+		}, []string{"kind"}),
+		deleted: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_orphaned_auxiliary_objects_deleted_total",
+			Help: "Total number of orphaned auxiliary objects deleted, by kind.",
+		}, []string{"kind"}),
+		failures: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_orphaned_auxiliary_objects_deletion_failures_total",
+			Help: "Total number of failed deletions of orphaned auxiliary objects, by kind.",
+		}, []string{"kind"}),
+	}
+	for _, kind := range []string{auxKindDebugMeta, auxKindMarker} {
+		c.orphaned.WithLabelValues(kind)
+		c.deleted.WithLabelValues(kind)
+		c.failures.WithLabelValues(kind)
+	}
+	return c
+}
+
+// Clean deletes orphaned auxiliary objects. Orphaned markers are looked for only in directories of the given partial
+// blocks, i.e. blocks without meta.json, as reported by fetcher. Failed deletions are retried by the next cleanup.
+func (c *AuxiliaryCleaner) Clean(ctx context.Context, partial map[ulid.ULID]error) error {
+	level.Info(c.logger).Log("msg", "started cleaning of orphaned auxiliary objects", "dry_run", c.dryRun)
+
+	if c.debugMetasMaxAge > 0 {
+		orphaned, err := c.orphanedDebugMetas(ctx)
+		if err != nil {
+			return errors.Wrap(err, "find orphaned debug metas")
+		}
+		c.delete(ctx, auxKindDebugMeta, orphaned)
+	}
+	if c.orphanedMarkers {
+		orphaned, err := c.orphanedMarkerFiles(ctx, partial)
+		if err != nil {
+			return errors.Wrap(err, "find orphaned markers")
+		}
+		c.delete(ctx, auxKindMarker, orphaned)
+	}
+
+	level.Info(c.logger).Log("msg", "cleaning of orphaned auxiliary objects done")
+	return nil
+}
+
+// orphanedDebugMetas returns names of debug metas of blocks without directory in the bucket, created more than
+// debugMetasMaxAge ago.
+func (c *AuxiliaryCleaner) orphanedDebugMetas(ctx context.Context) ([]string, error) {
+	blocks := map[ulid.ULID]struct{}{}
+	if err := c.bkt.Iter(ctx, "", func(name string) error {
+		if id, ok := block.IsBlockDir(name); ok {
+			blocks[id] = struct{}{}
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "list blocks")
+	}
+
+	var orphaned []string
+	if err := c.debugMetas.Iter(ctx, func(id ulid.ULID, name string) error {
+		if _, ok := blocks[id]; ok {
+			return nil
+		}
+		if time.Since(ulid.Time(id.Time())) <= c.debugMetasMaxAge {
+			return nil
+		}
+		orphaned = append(orphaned, name)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "list debug metas")
+	}
+	return orphaned, nil
+}
+
+// orphanedMarkerFiles returns names of markers in directories of the given partial blocks that contain nothing but
+// markers.
+func (c *AuxiliaryCleaner) orphanedMarkerFiles(ctx context.Context, partial map[ulid.ULID]error) ([]string, error) {
+	var orphaned []string
+	for id := range partial {
+		var (
+			markers    []string
+			onlyMarker = true
+		)
+		if err := c.bkt.Iter(ctx, id.String(), func(name string) error {
+			if _, ok := markerFilenames[path.Base(name)]; ok && !strings.HasSuffix(name, objstore.DirDelim) {
+				markers = append(markers, name)
+				return nil
+			}
+			onlyMarker = false
+			return nil
+		}); err != nil {
+			return nil, errors.Wrapf(err, "list block %s", id)
+		}
+		if onlyMarker {
+			orphaned = append(orphaned, markers...)
+		}
+	}
+	return orphaned, nil
+}
+
+func (c *AuxiliaryCleaner) delete(ctx context.Context, kind string, names []string) {
+	c.orphaned.WithLabelValues(kind).Set(float64(len(names)))
+	for _, name := range names {
+		if c.dryRun {
+			level.Info(c.logger).Log("msg", "dry run: would delete orphaned auxiliary object", "kind", kind, "object", name)
+			continue
+		}
+		if err := c.bkt.Delete(ctx, name); err != nil {
+			c.failures.WithLabelValues(kind).Inc()
+			level.Warn(c.logger).Log("msg", "failed to delete orphaned auxiliary object; will retry in next cleanup", "kind", kind, "object", name, "err", err)
+			continue
+		}
+		c.deleted.WithLabelValues(kind).Inc()
+		level.Info(c.logger).Log("msg", "deleted orphaned auxiliary object", "kind", kind, "object", name)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestAuxiliaryCleaner(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	old := ulid.Timestamp(time.Now().Add(-48 * time.Hour))
+	var (
+		existing      = ulid.MustNew(old, nil)
+		deleted       = ulid.MustNew(old+1, nil)
+		deletedZstd   = ulid.MustNew(old+2, nil)
+		deletedRecent = ulid.MustNew(ulid.Now(), nil)
+		orphanMarker  = ulid.MustNew(old+3, nil)
+		partialMarker = ulid.MustNew(old+4, nil)
+	)
+	for _, name := range []string{
+		path.Join(existing.String(), metadata.MetaFilename),
+		path.Join(block.DebugMetas, existing.String()+".json"),
+		path.Join(block.DebugMetas, deleted.String()+".json"),
+		path.Join(block.DebugMetas, deletedZstd.String()+".json.zst"),
+		path.Join(block.DebugMetas, deletedRecent.String()+".json"),
+		path.Join(orphanMarker.String(), metadata.DeletionMarkFilename),
+		path.Join(orphanMarker.String(), metadata.HoldMarkFilename),
+		path.Join(partialMarker.String(), metadata.DeletionMarkFilename),
+		path.Join(partialMarker.String(), block.ChunksDirname, "000001"),
+	} {
+		testutil.Ok(t, bkt.Upload(ctx, name, strings.NewReader("{}")))
+	}
+	partial := map[ulid.ULID]error{orphanMarker: nil, partialMarker: nil}
+	objects := func() int { return len(bkt.Objects()) }
+
+	// Dry run only counts orphaned objects.
+	c := NewAuxiliaryCleaner(log.NewNopLogger(), prometheus.NewRegistry(), bkt, "", 24*time.Hour, true, true)
+	testutil.Ok(t, c.Clean(ctx, partial))
+	testutil.Equals(t, 9, objects())
+	testutil.Equals(t, 2.0, promtest.ToFloat64(c.orphaned.WithLabelValues(auxKindDebugMeta)))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(c.orphaned.WithLabelValues(auxKindMarker)))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(c.deleted.WithLabelValues(auxKindMarker)))
+
+	c = NewAuxiliaryCleaner(log.NewNopLogger(), prometheus.NewRegistry(), bkt, "", 24*time.Hour, true, false)
+	testutil.Ok(t, c.Clean(ctx, partial))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(c.deleted.WithLabelValues(auxKindDebugMeta)))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(c.deleted.WithLabelValues(auxKindMarker)))
+
+	testutil.Equals(t, 5, objects())
+	for _, name := range []string{
+		path.Join(block.DebugMetas, deleted.String()+".json"),
+		path.Join(block.DebugMetas, deletedZstd.String()+".json.zst"),
+		path.Join(orphanMarker.String(), metadata.DeletionMarkFilename),
+		path.Join(orphanMarker.String(), metadata.HoldMarkFilename),
+	} {
+		_, ok := bkt.Objects()[name]
+		testutil.Assert(t, !ok, "expected %s to be deleted", name)
+	}
+}
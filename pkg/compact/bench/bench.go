@@ -0,0 +1,278 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+// Package bench measures end-to-end throughput of BucketCompactor against synthetic blocks, so changes of the planner,
+// grouping or concurrency can be evaluated objectively. Results are comparable between runs of the same Config.
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+// Config describes synthetic blocks to generate and how to compact them.
+type Config struct {
+	// Groups is the number of compaction groups, each with distinct external labels.
+	Groups int `json:"groups"`
+	// BlocksPerGroup is the number of consecutive, non-overlapping blocks generated for each group.
+	BlocksPerGroup int `json:"blocks_per_group"`
+	// Series is the number of series in each block.
+	Series int `json:"series"`
+	// SamplesPerSeries is the number of samples of each series in each block.
+	SamplesPerSeries int `json:"samples_per_series"`
+	// Churn is the fraction of series replaced by new ones between consecutive blocks of a group, from 0 to 1.
+	Churn float64 `json:"churn"`
+	// BlockDuration is the time range of each generated block. Compaction ranges are 4x, 16x and 64x of it.
+	BlockDuration time.Duration `json:"block_duration"`
+	// Concurrency is the BucketCompactor concurrency.
+	Concurrency int `json:"concurrency"`
+}
+
+// DefaultConfig returns a small Config suitable for regression testing.
+func DefaultConfig() Config {
+	return Config{
+		Groups:           2,
+		BlocksPerGroup:   17,
+		Series:           100,
+		SamplesPerSeries: 120,
+		Churn:            0.1,
+		BlockDuration:    2 * time.Hour,
+		Concurrency:      1,
+	}
+}
+
+// Validate returns an error if the config is invalid.
+func (c Config) Validate() error {
+	if c.Groups < 1 || c.BlocksPerGroup < 1 || c.Series < 1 || c.SamplesPerSeries < 1 {
+		return errors.New("groups, blocks per group, series and samples per series must be positive")
+	}
+	if c.Churn < 0 || c.Churn > 1 {
+		return errors.Errorf("churn must be between 0 and 1, got %v", c.Churn)
+	}
+	if c.BlockDuration < time.Millisecond*time.Duration(c.SamplesPerSeries+1) {
+		return errors.Errorf("block duration %v is too short for %d samples per series", c.BlockDuration, c.SamplesPerSeries)
+	}
+	if c.Concurrency < 1 {
+		return errors.Errorf("concurrency must be positive, got %d", c.Concurrency)
+	}
+	return nil
+}
+
+// Result is the outcome of a single benchmark run.
+type Result struct {
+	Config Config `json:"config"`
+
+	// GenerateSeconds is the time it took to generate and upload the synthetic blocks.
+	GenerateSeconds float64 `json:"generate_seconds"`
+	// CompactSeconds is the wall time of the compaction run, including syncs and uploads.
+	CompactSeconds float64 `json:"compact_seconds"`
+
+	InputBlocks  int   `json:"input_blocks"`
+	InputBytes   int64 `json:"input_bytes"`
+	InputSamples int64 `json:"input_samples"`
+	// CompactedBlocks is the number of input blocks marked for deletion after being compacted.
+	CompactedBlocks int `json:"compacted_blocks"`
+	// CompactedBytes is the total size of objects of compacted input blocks.
+	CompactedBytes int64 `json:"compacted_bytes"`
+	// Compactions is the number of blocks created by the compactor, including ones compacted further within the run.
+	Compactions int `json:"compactions"`
+	// OutputBlocks and OutputBytes describe blocks created by the compactor and not compacted further.
+	OutputBlocks int   `json:"output_blocks"`
+	OutputBytes  int64 `json:"output_bytes"`
+
+	// BytesPerSecond is CompactedBytes divided by CompactSeconds.
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	// SamplesPerSecond is the number of samples in compacted blocks divided by CompactSeconds.
+	SamplesPerSecond float64 `json:"samples_per_second"`
+
+	// Allocs and AllocBytes are the number and total size of heap allocations of the process during compaction.
+	Allocs     uint64 `json:"allocs"`
+	AllocBytes uint64 `json:"alloc_bytes"`
+}
+
+// WriteJSON writes the result as indented JSON.
+func (r Result) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(r)
+}
+
+// Generate creates synthetic blocks described by the config and uploads them to the bucket. Local files are created in
+// the given directory and removed afterwards.
+func Generate(ctx context.Context, logger log.Logger, bkt objstore.Bucket, dir string, cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	prepareDir, err := ioutil.TempDir(dir, "bench-prepare")
+	if err != nil {
+		return errors.Wrap(err, "create prepare dir")
+	}
+	defer os.RemoveAll(prepareDir)
+
+	blockMillis := cfg.BlockDuration.Milliseconds()
+	churned := int(float64(cfg.Series) * cfg.Churn)
+	for g := 0; g < cfg.Groups; g++ {
+		extLset := labels.FromStrings("bench_group", fmt.Sprintf("%d", g))
+		for b := 0; b < cfg.BlocksPerGroup; b++ {
+			id, err := e2eutil.CreateBlock(ctx, prepareDir, series(b*churned, cfg.Series), cfg.SamplesPerSeries, int64(b)*blockMillis, int64(b+1)*blockMillis, extLset, 0)
+			if err != nil {
+				return errors.Wrapf(err, "create block %d of group %d", b, g)
+			}
+			bdir := filepath.Join(prepareDir, id.String())
+			if err := block.Upload(ctx, logger, bkt, bdir); err != nil {
+				return errors.Wrapf(err, "upload block %s", id)
+			}
+			if err := os.RemoveAll(bdir); err != nil {
+				return errors.Wrapf(err, "remove block dir %s", bdir)
+			}
+		}
+	}
+	return nil
+}
+
+// series returns n series with consecutive IDs starting from the given one.
+func series(from, n int) []labels.Labels {
+	res := make([]labels.Labels, 0, n)
+	for i := from; i < from+n; i++ {
+		res = append(res, labels.FromStrings("__name__", "bench_metric", "series", fmt.Sprintf("%d", i)))
+	}
+	return res
+}
+
+// Run generates synthetic blocks described by the config in an in-memory bucket, compacts them with a BucketCompactor
+// until there is nothing left to compact, and returns the measurements. Work files are created in the given directory.
+func Run(ctx context.Context, logger log.Logger, dir string, cfg Config) (*Result, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	res := &Result{Config: cfg}
+	bkt := objstore.NewInMemBucket()
+
+	begin := time.Now()
+	if err := Generate(ctx, logger, bkt, dir, cfg); err != nil {
+		return nil, errors.Wrap(err, "generate blocks")
+	}
+	res.GenerateSeconds = time.Since(begin).Seconds()
+
+	inputs := blockSizes(bkt)
+	res.InputBlocks = len(inputs)
+	for _, size := range inputs {
+		res.InputBytes += size
+	}
+	res.InputSamples = int64(res.InputBlocks) * int64(cfg.Series) * int64(cfg.SamplesPerSeries)
+
+	bComp, err := newBucketCompactor(ctx, logger, bkt, dir, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	begin = time.Now()
+	if err := bComp.Compact(ctx); err != nil {
+		return nil, errors.Wrap(err, "compact")
+	}
+	res.CompactSeconds = time.Since(begin).Seconds()
+	runtime.ReadMemStats(&after)
+	res.Allocs = after.Mallocs - before.Mallocs
+	res.AllocBytes = after.TotalAlloc - before.TotalAlloc
+
+	objs := bkt.Objects()
+	var compactedSamples int64
+	for id, size := range blockSizes(bkt) {
+		_, marked := objs[path.Join(id.String(), metadata.DeletionMarkFilename)]
+		if _, ok := inputs[id]; !ok {
+			res.Compactions++
+			if !marked {
+				res.OutputBlocks++
+				res.OutputBytes += size
+			}
+			continue
+		}
+		if marked {
+			res.CompactedBlocks++
+			res.CompactedBytes += size
+			compactedSamples += int64(cfg.Series) * int64(cfg.SamplesPerSeries)
+		}
+	}
+	if res.CompactSeconds > 0 {
+		res.BytesPerSecond = float64(res.CompactedBytes) / res.CompactSeconds
+		res.SamplesPerSecond = float64(compactedSamples) / res.CompactSeconds
+	}
+	return res, nil
+}
+
+func newBucketCompactor(ctx context.Context, logger log.Logger, bkt objstore.Bucket, dir string, cfg Config) (*compact.BucketCompactor, error) {
+	reg := prometheus.NewRegistry()
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, objstore.WithNoopInstr(bkt), 48*time.Hour)
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	metaFetcher, err := block.NewMetaFetcher(logger, 32, objstore.WithNoopInstr(bkt), "", reg, []block.MetadataFilter{
+		ignoreDeletionMarkFilter,
+		duplicateBlocksFilter,
+	}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create meta fetcher")
+	}
+
+	blocksMarkedForDeletion := promauto.With(reg).NewCounter(prometheus.CounterOpts{Name: "bench_blocks_marked_for_deletion_total"})
+	garbageCollectedBlocks := promauto.With(reg).NewCounter(prometheus.CounterOpts{Name: "bench_garbage_collected_blocks_total"})
+	sy, err := compact.NewSyncer(logger, reg, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "create syncer")
+	}
+
+	d := cfg.BlockDuration.Milliseconds()
+	comp, err := tsdb.NewLeveledCompactor(ctx, reg, logger, []int64{d, 4 * d, 16 * d, 64 * d}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create compactor")
+	}
+
+	grouper := compact.NewDefaultGrouper(logger, bkt, false, false, reg, blocksMarkedForDeletion, garbageCollectedBlocks)
+	bComp, err := compact.NewBucketCompactor(logger, sy, grouper, comp, filepath.Join(dir, "compact"), bkt, cfg.Concurrency)
+	if err != nil {
+		return nil, errors.Wrap(err, "create bucket compactor")
+	}
+	return bComp, nil
+}
+
+// blockSizes returns total size of objects of each block in the in-memory bucket.
+func blockSizes(bkt *objstore.InMemBucket) map[ulid.ULID]int64 {
+	sizes := map[ulid.ULID]int64{}
+	for name, content := range bkt.Objects() {
+		id, err := ulid.Parse(strings.SplitN(name, objstore.DirDelim, 2)[0])
+		if err != nil {
+			continue
+		}
+		sizes[id] += int64(len(content))
+	}
+	return sizes
+}
@@ -0,0 +1,62 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package bench
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compact-bench")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	cfg := DefaultConfig()
+	res, err := Run(context.Background(), log.NewNopLogger(), dir, cfg)
+	testutil.Ok(t, err)
+
+	testutil.Equals(t, cfg.Groups*cfg.BlocksPerGroup, res.InputBlocks)
+	// The most recent block of each group is left alone. The remaining 16 blocks are compacted into four 4x blocks,
+	// which are compacted into a single 16x block.
+	testutil.Equals(t, res.InputBlocks-cfg.Groups, res.CompactedBlocks)
+	testutil.Equals(t, 5*cfg.Groups, res.Compactions)
+	testutil.Equals(t, cfg.Groups, res.OutputBlocks)
+	testutil.Assert(t, res.CompactedBytes > 0 && res.OutputBytes > 0, "unexpected bytes %d %d", res.CompactedBytes, res.OutputBytes)
+	testutil.Assert(t, res.SamplesPerSecond > 0 && res.Allocs > 0, "expected throughput and allocations to be measured")
+
+	var buf bytes.Buffer
+	testutil.Ok(t, res.WriteJSON(&buf))
+	var decoded Result
+	testutil.Ok(t, json.Unmarshal(buf.Bytes(), &decoded))
+	testutil.Equals(t, *res, decoded)
+
+	cfg.Churn = 2
+	_, err = Run(context.Background(), nil, dir, cfg)
+	testutil.NotOk(t, err)
+}
+
+func BenchmarkBucketCompactor(b *testing.B) {
+	dir, err := ioutil.TempDir("", "compact-bench")
+	testutil.Ok(b, err)
+	defer func() { testutil.Ok(b, os.RemoveAll(dir)) }()
+
+	cfg := DefaultConfig()
+	cfg.Series = 1000
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := Run(context.Background(), log.NewNopLogger(), dir, cfg)
+		testutil.Ok(b, err)
+		b.ReportMetric(res.SamplesPerSecond, "samples/s")
+	}
+}
@@ -5,13 +5,17 @@ package compact
 
 import (
 	"context"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/objstore"
 )
 
@@ -21,39 +25,209 @@ type BlocksCleaner struct {
 	ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter
 	bkt                      objstore.Bucket
 	deleteDelay              time.Duration
+	concurrency              int
 	blocksCleaned            prometheus.Counter
 	blockCleanupFailures     prometheus.Counter
+	budget                   DeletionBudget
+	budgetMetrics            *deletionBudgetMetrics
+	opts                     blocksCleanerOptions
+	pinsMetrics              *readerPinsMetrics
+
+	mtx sync.Mutex
+}
+
+// NewBlocksCleaner creates a new BlocksCleaner deleting up to the given number of blocks concurrently.
+func NewBlocksCleaner(logger log.Logger, bkt objstore.Bucket, ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter, deleteDelay time.Duration, concurrency int, blocksCleaned prometheus.Counter, blockCleanupFailures prometheus.Counter) *BlocksCleaner {
+	return NewBlocksCleanerWithBudget(logger, nil, bkt, ignoreDeletionMarkFilter, deleteDelay, concurrency, DeletionBudget{}, blocksCleaned, blockCleanupFailures)
 }
 
-// NewBlocksCleaner creates a new BlocksCleaner.
-func NewBlocksCleaner(logger log.Logger, bkt objstore.Bucket, ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter, deleteDelay time.Duration, blocksCleaned prometheus.Counter, blockCleanupFailures prometheus.Counter) *BlocksCleaner {
+// NewBlocksCleanerWithBudget creates a new BlocksCleaner deleting at most the given budget of blocks per call of
+// DeleteMarkedBlocks. Blocks over budget stay marked and are deleted by the next calls.
+func NewBlocksCleanerWithBudget(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket, ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter, deleteDelay time.Duration, concurrency int, budget DeletionBudget, blocksCleaned prometheus.Counter, blockCleanupFailures prometheus.Counter, opts ...BlocksCleanerOption) *BlocksCleaner {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	o := blocksCleanerOptions{}
+	for _, opt := range opts {
+		opt.apply(&o)
+	}
+	var pinsMetrics *readerPinsMetrics
+	if o.readers != nil {
+		pinsMetrics = newReaderPinsMetrics(reg)
+	}
 	return &BlocksCleaner{
 		logger:                   logger,
 		ignoreDeletionMarkFilter: ignoreDeletionMarkFilter,
 		bkt:                      bkt,
 		deleteDelay:              deleteDelay,
+		concurrency:              concurrency,
 		blocksCleaned:            blocksCleaned,
 		blockCleanupFailures:     blockCleanupFailures,
+		budget:                   budget,
+		budgetMetrics:            newDeletionBudgetMetrics(reg),
+		opts:                     o,
+		pinsMetrics:              pinsMetrics,
+	}
+}
+
+// SetDeleteDelay sets the delay blocks are deleted after they were marked for deletion, applied from the next call of
+// DeleteMarkedBlocks on.
+func (s *BlocksCleaner) SetDeleteDelay(deleteDelay time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.deleteDelay = deleteDelay
+}
+
+// SetConcurrency sets the number of blocks deleted concurrently, applied from the next call of DeleteMarkedBlocks on.
+func (s *BlocksCleaner) SetConcurrency(concurrency int) {
+	if concurrency < 1 {
+		concurrency = 1
 	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.concurrency = concurrency
 }
 
 // DeleteMarkedBlocks uses ignoreDeletionMarkFilter to gather the blocks that are marked for deletion and deletes those
-// if older than given deleteDelay.
+// if older than given deleteDelay, within the deletion budget. It stops at the first failed deletion, once blocks being
+// deleted are done.
 func (s *BlocksCleaner) DeleteMarkedBlocks(ctx context.Context) error {
 	level.Info(s.logger).Log("msg", "started cleaning of blocks marked for deletion")
 
-	deletionMarkMap := s.ignoreDeletionMarkFilter.DeletionMarkBlocks()
-	for _, deletionMark := range deletionMarkMap {
-		if time.Since(time.Unix(deletionMark.DeletionTime, 0)).Seconds() > s.deleteDelay.Seconds() {
-			if err := block.Delete(ctx, s.logger, s.bkt, deletionMark.ID); err != nil {
-				s.blockCleanupFailures.Inc()
-				return errors.Wrap(err, "delete block")
+	s.mtx.Lock()
+	deleteDelay, concurrency := s.deleteDelay, s.concurrency
+	s.mtx.Unlock()
+
+	var (
+		wg       sync.WaitGroup
+		ch       = make(chan ulid.ULID)
+		errOnce  sync.Once
+		firstErr error
+		errCh    = make(chan struct{})
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ch {
+				if err := block.Delete(ctx, s.logger, s.bkt, id); err != nil {
+					if errors.Cause(err) == block.ErrBlockUnderHold {
+						level.Info(s.logger).Log("msg", "not deleting block marked for deletion, as it is under hold", "block", id)
+						continue
+					}
+					s.blockCleanupFailures.Inc()
+					errOnce.Do(func() {
+						firstErr = errors.Wrap(err, "delete block")
+						close(errCh)
+					})
+					continue
+				}
+				s.blocksCleaned.Inc()
+				level.Info(s.logger).Log("msg", "deleted block marked for deletion", "block", id)
 			}
-			s.blocksCleaned.Inc()
-			level.Info(s.logger).Log("msg", "deleted block marked for deletion", "block", deletionMark.ID)
+		}()
+	}
+
+	var due []*metadata.DeletionMark
+	for _, deletionMark := range s.ignoreDeletionMarkFilter.DeletionMarkBlocks() {
+		if s.ignoreDeletionMarkFilter.IsExempt(deletionMark.ID) {
+			continue
+		}
+		if time.Since(time.Unix(deletionMark.DeletionTime, 0)).Seconds() > deleteDelay.Seconds() {
+			due = append(due, deletionMark)
 		}
 	}
+	// Blocks marked the longest ago are deleted first, so blocks over budget are deleted by the next calls in order.
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].DeletionTime != due[j].DeletionTime {
+			return due[i].DeletionTime < due[j].DeletionTime
+		}
+		return due[i].ID.Compare(due[j].ID) < 0
+	})
+	due = s.deferPinned(ctx, due, deleteDelay)
+
+	var (
+		queued   int
+		spent    deletionSpend
+		sizeErr  error
+		overSize bool
+	)
+queue:
+	for _, deletionMark := range due {
+		var size int64
+		if s.budget.MaxBytes > 0 {
+			if size, sizeErr = objectsSize(ctx, s.bkt, deletionMark.ID.String()); sizeErr != nil {
+				sizeErr = errors.Wrapf(sizeErr, "size of block %s", deletionMark.ID)
+				break
+			}
+		}
+		if !s.budget.allows(spent, size) {
+			overSize = true
+			break
+		}
+		select {
+		case ch <- deletionMark.ID:
+			queued++
+			spent.blocks++
+			spent.bytes += size
+		case <-errCh:
+			break queue
+		}
+	}
+	close(ch)
+	wg.Wait()
+
+	backlog := len(due) - queued
+	s.budgetMetrics.backlog.Set(float64(backlog))
+	if firstErr != nil {
+		return firstErr
+	}
+	if sizeErr != nil {
+		return sizeErr
+	}
+	if overSize {
+		s.budgetMetrics.exhausted.Inc()
+		level.Info(s.logger).Log("msg", "deletion budget of this cycle exhausted, deleting remaining blocks in next cycles",
+			"deleted_blocks", spent.blocks, "deleted_bytes", spent.bytes, "backlog_blocks", backlog)
+	}
 
 	level.Info(s.logger).Log("msg", "cleaning of blocks marked for deletion done")
 	return nil
 }
+
+// deferPinned returns the given blocks due for deletion without those pinned by readers, unless the maximum deferral
+// elapsed since they were due.
+func (s *BlocksCleaner) deferPinned(ctx context.Context, due []*metadata.DeletionMark, deleteDelay time.Duration) []*metadata.DeletionMark {
+	if s.opts.readers == nil || len(due) == 0 {
+		return due
+	}
+	pinned, err := s.opts.readers.PinnedBlocks(ctx)
+	if err != nil {
+		s.pinsMetrics.failures.Inc()
+		level.Warn(s.logger).Log("msg", "failed to list blocks pinned by readers; deferring deletion of all blocks", "err", err)
+	}
+
+	var (
+		res      = due[:0]
+		deferred int
+	)
+	for _, m := range due {
+		if _, ok := pinned[m.ID]; !ok && err == nil {
+			res = append(res, m)
+			continue
+		}
+		dueSince := time.Unix(m.DeletionTime, 0).Add(deleteDelay)
+		if time.Since(dueSince) < s.opts.maxDeferral {
+			deferred++
+			continue
+		}
+		s.pinsMetrics.deferralExpired.Inc()
+		level.Warn(s.logger).Log("msg", "deleting block pinned by readers, as its deletion was deferred for the maximum deferral", "block", m.ID)
+		res = append(res, m)
+	}
+	s.pinsMetrics.deferred.Set(float64(deferred))
+	if deferred > 0 {
+		level.Info(s.logger).Log("msg", "deferred deletion of blocks pinned by readers", "blocks", deferred)
+	}
+	return res
+}
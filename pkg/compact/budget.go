@@ -0,0 +1,113 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// GroupErrorBudget tracks consecutive compaction failures of each group. Once a group fails the given number of times in
+// a row, it is skipped for the cool-down period, so a single persistently failing group does not fail every compaction
+// run. After the cool-down the group is compacted again; a failure puts it right back to cool-down, while a success
+// resets its budget. Go-routine safe.
+type GroupErrorBudget struct {
+	logger      log.Logger
+	maxFailures int
+	coolDown    time.Duration
+	now         func() time.Time
+
+	mtx      sync.Mutex
+	failures map[string]int
+	until    map[string]time.Time
+
+	consecutiveFailures *prometheus.GaugeVec
+	coolingDown         *prometheus.GaugeVec
+	coolDowns           *prometheus.CounterVec
+	skipped             *prometheus.CounterVec
+}
+
+// NewGroupErrorBudget returns GroupErrorBudget cooling down groups for the given period once they fail maxFailures
+// times in a row.
+func NewGroupErrorBudget(logger log.Logger, reg prometheus.Registerer, maxFailures int, coolDown time.Duration) *GroupErrorBudget {
+	return &GroupErrorBudget{
+		logger:      logger,
+		maxFailures: maxFailures,
+		coolDown:    coolDown,
+		now:         time.Now,
+		failures:    map[string]int{},
+		until:       map[string]time.Time{},
+		consecutiveFailures: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_group_consecutive_failures",
+			Help: "Number of consecutive failed compactions of the group.",
+		}, []string{"group_id"}),
+		coolingDown: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_group_cooling_down",
+			Help: "Set to 1 while the group is skipped by compaction after too many consecutive failures, 0 otherwise.",
+		}, []string{"group_id"}),
+		coolDowns: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_group_cool_downs_total",
+			Help: "Total number of times the group was put to cool-down after too many consecutive failures.",
+		}, []string{"group_id"}),
+		skipped: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_group_cool_down_skips_total",
+			Help: "Total number of compaction iterations that skipped the group because it was cooling down.",
+		}, []string{"group_id"}),
+	}
+}
+
+// filter returns the given groups without groups that are cooling down, keeping their order.
+func (b *GroupErrorBudget) filter(groups []*Group) []*Group {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := b.now()
+	res := groups[:0]
+	for _, g := range groups {
+		if until, ok := b.until[g.Key()]; ok {
+			if now.Before(until) {
+				level.Debug(b.logger).Log("msg", "skipping compaction of group cooling down after consecutive failures", "group_id", g.ID(), "until", until)
+				b.skipped.WithLabelValues(g.ID()).Inc()
+				continue
+			}
+			// Failures are kept, so the group goes back to cool-down right away if it fails again.
+			delete(b.until, g.Key())
+			b.coolingDown.WithLabelValues(g.ID()).Set(0)
+		}
+		res = append(res, g)
+	}
+	return res
+}
+
+// observe records the outcome of a compaction of the group with the given key.
+func (b *GroupErrorBudget) observe(key string, err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	id := GroupID(key)
+	if err == nil {
+		delete(b.failures, key)
+		delete(b.until, key)
+		b.consecutiveFailures.WithLabelValues(id).Set(0)
+		b.coolingDown.WithLabelValues(id).Set(0)
+		return
+	}
+
+	b.failures[key]++
+	b.consecutiveFailures.WithLabelValues(id).Set(float64(b.failures[key]))
+	if b.failures[key] < b.maxFailures {
+		return
+	}
+	until := b.now().Add(b.coolDown)
+	b.until[key] = until
+	b.coolingDown.WithLabelValues(id).Set(1)
+	b.coolDowns.WithLabelValues(id).Inc()
+	level.Warn(b.logger).Log("msg", "group failed too many times in a row; skipping its compaction until cool-down ends",
+		"group_id", id, "consecutive_failures", b.failures[key], "until", until, "err", err)
+}
@@ -0,0 +1,65 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestGroupErrorBudget(t *testing.T) {
+	now := time.Now()
+	b := NewGroupErrorBudget(log.NewNopLogger(), prometheus.NewRegistry(), 2, time.Hour)
+	b.now = func() time.Time { return now }
+
+	failing, healthy := &Group{key: "0@1", id: GroupID("0@1")}, &Group{key: "0@2", id: GroupID("0@2")}
+	keys := func(groups []*Group) []string {
+		var res []string
+		for _, g := range groups {
+			res = append(res, g.Key())
+		}
+		return res
+	}
+	errCompaction := errors.New("compaction failed")
+
+	// Failures within the budget do not skip the group, and a success resets it.
+	b.observe(failing.Key(), errCompaction)
+	b.observe(failing.Key(), nil)
+	b.observe(failing.Key(), errCompaction)
+	testutil.Equals(t, []string{"0@1", "0@2"}, keys(b.filter([]*Group{failing, healthy})))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.consecutiveFailures.WithLabelValues(failing.ID())))
+
+	// Exhausting the budget skips the group until the cool-down ends.
+	b.observe(failing.Key(), errCompaction)
+	b.observe(healthy.Key(), nil)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.coolingDown.WithLabelValues(failing.ID())))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.coolDowns.WithLabelValues(failing.ID())))
+	testutil.Equals(t, []string{"0@2"}, keys(b.filter([]*Group{failing, healthy})))
+	now = now.Add(59 * time.Minute)
+	testutil.Equals(t, []string{"0@2"}, keys(b.filter([]*Group{failing, healthy})))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(b.skipped.WithLabelValues(failing.ID())))
+
+	// Once the cool-down ends the group is compacted again, and goes right back to cool-down on the next failure.
+	now = now.Add(time.Minute)
+	testutil.Equals(t, []string{"0@1", "0@2"}, keys(b.filter([]*Group{failing, healthy})))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(b.coolingDown.WithLabelValues(failing.ID())))
+	b.observe(failing.Key(), errCompaction)
+	testutil.Equals(t, 3.0, promtest.ToFloat64(b.consecutiveFailures.WithLabelValues(failing.ID())))
+	testutil.Equals(t, []string{"0@2"}, keys(b.filter([]*Group{failing, healthy})))
+
+	// Success after the cool-down resets the budget.
+	now = now.Add(time.Hour)
+	testutil.Equals(t, []string{"0@1", "0@2"}, keys(b.filter([]*Group{failing, healthy})))
+	b.observe(failing.Key(), nil)
+	b.observe(failing.Key(), errCompaction)
+	testutil.Equals(t, []string{"0@1", "0@2"}, keys(b.filter([]*Group{failing, healthy})))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(b.coolingDown.WithLabelValues(failing.ID())))
+}
@@ -0,0 +1,238 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"math"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// churnStatsTopLabels is the number of label names with the highest value entropy kept in ChurnStats.
+const churnStatsTopLabels = 10
+
+// LabelEntropy describes how evenly series of a block are spread over values of a single label name.
+type LabelEntropy struct {
+	Name string `json:"name"`
+	// Values is the number of distinct values of the label name.
+	Values int `json:"values"`
+	// Bits is the Shannon entropy of the distribution of series over the label values. It is close to log2 of Values
+	// for labels with a unique value per series, e.g. pod or request IDs, and 0 for labels of a single value.
+	Bits float64 `json:"bits"`
+}
+
+// ChurnStats describes series churn of the most recent compaction of a group, computed from indexes of its source
+// blocks and the compacted block.
+type ChurnStats struct {
+	Time    time.Time `json:"time"`
+	Block   ulid.ULID `json:"block"`
+	Sources int       `json:"sources"`
+	// Series is the number of series of the compacted block.
+	Series uint64 `json:"series"`
+	// SingleSourceSeries is the number of series of the compacted block present in only one of the source blocks.
+	// A high share of them means series come and go between blocks, which makes the compacted index grow with every
+	// source block instead of deduplicating series.
+	SingleSourceSeries uint64 `json:"singleSourceSeries"`
+	// Labels are the label names of the compacted block with the highest value entropy, highest first.
+	Labels []LabelEntropy `json:"labels"`
+}
+
+// ChurnStatsTracker computes ChurnStats of compactions, keeping the most recent ones per group key and exposing them as
+// metrics. Go-routine safe.
+type ChurnStatsTracker struct {
+	logger log.Logger
+
+	mtx   sync.Mutex
+	stats map[string]ChurnStats
+
+	singleSourceRatio *prometheus.GaugeVec
+	maxEntropy        *prometheus.GaugeVec
+	failures          prometheus.Counter
+}
+
+// NewChurnStatsTracker returns ChurnStatsTracker registered in the given registerer.
+func NewChurnStatsTracker(logger log.Logger, reg prometheus.Registerer) *ChurnStatsTracker {
+	return &ChurnStatsTracker{
+		logger: logger,
+		stats:  map[string]ChurnStats{},
+		singleSourceRatio: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_group_single_source_series_ratio",
+			Help: "Share of series of the last block compacted by the group present in only one of its source blocks.",
+		}, []string{"group_id"}),
+		maxEntropy: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_group_max_label_value_entropy_bits",
+			Help: "Highest entropy of the distribution of series over values of a label name of the last block compacted by the group.",
+		}, []string{"group_id"}),
+		failures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_churn_stats_failures_total",
+			Help: "Total number of failures to compute churn statistics of compactions.",
+		}),
+	}
+}
+
+// Stats returns the most recent ChurnStats by group key.
+func (t *ChurnStatsTracker) Stats() map[string]ChurnStats {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	res := make(map[string]ChurnStats, len(t.stats))
+	for k, v := range t.stats {
+		res[k] = v
+	}
+	return res
+}
+
+// observe computes ChurnStats of the compaction of the group with the given key of the given source block directories
+// into the given block directory. Failures are logged and counted, not returned. It is a no-op if t is nil.
+func (t *ChurnStatsTracker) observe(group string, sources []string, bdir string) {
+	if t == nil {
+		return
+	}
+	s, err := computeChurnStats(sources, bdir)
+	if err != nil {
+		t.failures.Inc()
+		level.Warn(t.logger).Log("msg", "failed to compute churn statistics", "group_id", GroupID(group), "block", bdir, "err", err)
+		return
+	}
+
+	t.mtx.Lock()
+	t.stats[group] = s
+	t.mtx.Unlock()
+
+	ratio := 0.0
+	if s.Series > 0 {
+		ratio = float64(s.SingleSourceSeries) / float64(s.Series)
+	}
+	t.singleSourceRatio.WithLabelValues(GroupID(group)).Set(ratio)
+	maxBits := 0.0
+	if len(s.Labels) > 0 {
+		maxBits = s.Labels[0].Bits
+	}
+	t.maxEntropy.WithLabelValues(GroupID(group)).Set(maxBits)
+}
+
+func computeChurnStats(sources []string, bdir string) (ChurnStats, error) {
+	id, err := ulid.Parse(filepath.Base(bdir))
+	if err != nil {
+		return ChurnStats{}, errors.Wrapf(err, "block dir %s", bdir)
+	}
+	s := ChurnStats{Time: time.Now(), Block: id, Sources: len(sources)}
+
+	// Number of source blocks of each series, by hash of its labels.
+	occurrences := map[uint64]int{}
+	for _, src := range sources {
+		if err := forEachSeries(filepath.Join(src, block.IndexFilename), func(lset labels.Labels) {
+			occurrences[lset.Hash()]++
+		}); err != nil {
+			return ChurnStats{}, err
+		}
+	}
+
+	fn := filepath.Join(bdir, block.IndexFilename)
+	if err := forEachSeries(fn, func(lset labels.Labels) {
+		s.Series++
+		if occurrences[lset.Hash()] == 1 {
+			s.SingleSourceSeries++
+		}
+	}); err != nil {
+		return ChurnStats{}, err
+	}
+
+	if s.Labels, err = labelEntropies(fn); err != nil {
+		return ChurnStats{}, err
+	}
+	return s, nil
+}
+
+// forEachSeries calls f with labels of every series of the given index file.
+func forEachSeries(fn string, f func(labels.Labels)) (err error) {
+	r, err := index.NewFileReader(fn)
+	if err != nil {
+		return errors.Wrapf(err, "open index file %s", fn)
+	}
+	defer runutil.CloseWithErrCapture(&err, r, "index reader")
+
+	p, err := r.Postings(index.AllPostingsKey())
+	if err != nil {
+		return errors.Wrap(err, "get all postings")
+	}
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	for p.Next() {
+		if err := r.Series(p.At(), &lset, &chks); err != nil {
+			return errors.Wrap(err, "read series")
+		}
+		f(lset)
+	}
+	return errors.Wrap(p.Err(), "iterate postings")
+}
+
+// labelEntropies returns churnStatsTopLabels label names of the given index file with the highest value entropy.
+func labelEntropies(fn string) (_ []LabelEntropy, err error) {
+	r, err := index.NewFileReader(fn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open index file %s", fn)
+	}
+	defer runutil.CloseWithErrCapture(&err, r, "index reader")
+
+	names, err := r.LabelNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "label names")
+	}
+	res := make([]LabelEntropy, 0, len(names))
+	for _, name := range names {
+		values, err := r.LabelValues(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "label values of %s", name)
+		}
+		counts := make([]float64, 0, len(values))
+		total := 0.0
+		for _, v := range values {
+			p, err := r.Postings(name, v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "postings of %s=%q", name, v)
+			}
+			n := 0.0
+			for p.Next() {
+				n++
+			}
+			if p.Err() != nil {
+				return nil, errors.Wrapf(p.Err(), "iterate postings of %s=%q", name, v)
+			}
+			counts = append(counts, n)
+			total += n
+		}
+		e := LabelEntropy{Name: name, Values: len(values)}
+		for _, n := range counts {
+			if n > 0 {
+				e.Bits -= n / total * math.Log2(n/total)
+			}
+		}
+		res = append(res, e)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Bits > res[j].Bits
+	})
+	if len(res) > churnStatsTopLabels {
+		res = res[:churnStatsTopLabels]
+	}
+	return res, nil
+}
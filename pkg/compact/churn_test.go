@@ -0,0 +1,61 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestChurnStatsTracker(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "churn-stats")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	createBlock := func(series ...labels.Labels) string {
+		id, err := e2eutil.CreateBlock(ctx, dir, series, 10, 0, 1000, labels.Labels{{Name: "ext", Value: "1"}}, 0)
+		testutil.Ok(t, err)
+		return filepath.Join(dir, id.String())
+	}
+	a1 := labels.FromStrings("a", "1", "job", "x")
+	a2 := labels.FromStrings("a", "2", "job", "x")
+	a3 := labels.FromStrings("a", "3", "job", "x")
+	src1 := createBlock(a1, a2)
+	src2 := createBlock(a2, a3)
+	out := createBlock(a1, a2, a3)
+
+	tr := NewChurnStatsTracker(log.NewNopLogger(), prometheus.NewRegistry())
+	tr.observe("0@1", []string{src1, src2}, out)
+	tr.observe("0@2", nil, filepath.Join(dir, "not-a-block"))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(tr.failures))
+
+	stats := tr.Stats()
+	testutil.Equals(t, 1, len(stats))
+	s := stats["0@1"]
+	testutil.Equals(t, filepath.Base(out), s.Block.String())
+	testutil.Equals(t, 2, s.Sources)
+	testutil.Equals(t, uint64(3), s.Series)
+	testutil.Equals(t, uint64(2), s.SingleSourceSeries)
+	testutil.Equals(t, 2, len(s.Labels))
+	testutil.Equals(t, LabelEntropy{Name: "job", Values: 1}, s.Labels[1])
+	testutil.Equals(t, "a", s.Labels[0].Name)
+	testutil.Equals(t, 3, s.Labels[0].Values)
+	testutil.Assert(t, math.Abs(s.Labels[0].Bits-math.Log2(3)) < 1e-9, "unexpected entropy %v", s.Labels[0].Bits)
+	testutil.Equals(t, 2.0/3, promtest.ToFloat64(tr.singleSourceRatio.WithLabelValues(GroupID("0@1"))))
+	testutil.Equals(t, s.Labels[0].Bits, promtest.ToFloat64(tr.maxEntropy.WithLabelValues(GroupID("0@1"))))
+}
@@ -0,0 +1,133 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// ErrGroupClaimLost is returned by GroupClaims.Verify if the claim of the group is no longer held by the compactor, e.g.
+// because it expired and was taken over by another compactor.
+var ErrGroupClaimLost = errors.New("group claim lost to another compactor")
+
+// GroupClaims claims compaction groups for a single compactor through claim files in metadata.GroupClaimsDir, so that
+// compactors sharing work on a bucket never compact the same group at the same time.
+type GroupClaims struct {
+	logger log.Logger
+	bkt    objstore.InstrumentedBucket
+	holder string
+	ttl    time.Duration
+
+	contended prometheus.Counter
+	conflicts prometheus.Counter
+}
+
+// NewGroupClaims returns GroupClaims of the compactor with the given identity, claiming groups for the given TTL. The
+// TTL has to be longer than compactions of a group take, as claims are not renewed during compaction.
+func NewGroupClaims(logger log.Logger, reg prometheus.Registerer, bkt objstore.InstrumentedBucket, holder string, ttl time.Duration) *GroupClaims {
+	return &GroupClaims{
+		logger: logger,
+		bkt:    bkt,
+		holder: holder,
+		ttl:    ttl,
+		contended: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_group_claims_contended_total",
+			Help: "Total number of groups not compacted because another compactor held or won their claim.",
+		}),
+		conflicts: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_group_claim_conflicts_total",
+			Help: "Total number of compactions whose source blocks were not marked for deletion because the group claim was lost.",
+		}),
+	}
+}
+
+// Claim claims the group with the given key, unless another compactor holds an active claim of it. Expired claims of
+// other compactors are taken over. It returns false if the group is claimed by another compactor.
+func (c *GroupClaims) Claim(ctx context.Context, group string) (bool, error) {
+	now := time.Now()
+	claim, err := metadata.ReadGroupClaim(ctx, c.bkt, c.logger, group)
+	switch {
+	case err == metadata.ErrorGroupClaimNotFound:
+	case err != nil:
+		return false, errors.Wrapf(err, "read claim of group %s", group)
+	case claim.Holder != c.holder && claim.Active(now):
+		c.contended.Inc()
+		return false, nil
+	default:
+		// Expired or our own claim; replaced by a new one.
+		if err := c.bkt.Delete(ctx, metadata.GroupClaimFile(group)); err != nil && !c.bkt.IsObjNotFoundErr(err) {
+			return false, errors.Wrapf(err, "delete stale claim of group %s", group)
+		}
+	}
+
+	b, err := json.Marshal(metadata.GroupClaim{
+		Group:      group,
+		Holder:     c.holder,
+		ClaimTime:  now.Unix(),
+		ExpiryTime: now.Add(c.ttl).Unix(),
+		Version:    metadata.GroupClaimVersion1,
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "json encode group claim")
+	}
+	err = objstore.UploadIfNotExists(ctx, c.bkt, metadata.GroupClaimFile(group), b)
+	if errors.Cause(err) == objstore.ErrObjectExists {
+		// Another compactor claimed the group first.
+		c.contended.Inc()
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "upload claim of group %s", group)
+	}
+	level.Debug(c.logger).Log("msg", "claimed group", "group_id", GroupID(group), "holder", c.holder, "ttl", c.ttl)
+	return true, nil
+}
+
+// Verify returns ErrGroupClaimLost if the claim of the group with the given key is not held by the compactor anymore.
+// An expired claim is still held if no other compactor took it over. It has to be called right before source blocks
+// are marked for deletion, as another compactor holding the claim may compact them too.
+func (c *GroupClaims) Verify(ctx context.Context, group string) error {
+	claim, err := metadata.ReadGroupClaim(ctx, c.bkt, c.logger, group)
+	if err == metadata.ErrorGroupClaimNotFound {
+		c.conflicts.Inc()
+		return errors.Wrapf(ErrGroupClaimLost, "claim of group %s was released", group)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "read claim of group %s", group)
+	}
+	if claim.Holder != c.holder {
+		c.conflicts.Inc()
+		return errors.Wrapf(ErrGroupClaimLost, "group %s is claimed by %s", group, claim.Holder)
+	}
+	return nil
+}
+
+// Release deletes the claim of the group with the given key, if it is held by the compactor.
+func (c *GroupClaims) Release(ctx context.Context, group string) {
+	claim, err := metadata.ReadGroupClaim(ctx, c.bkt, c.logger, group)
+	if err == metadata.ErrorGroupClaimNotFound {
+		return
+	}
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "failed to read group claim to release it; it expires on its own", "group_id", GroupID(group), "err", err)
+		return
+	}
+	if claim.Holder != c.holder {
+		return
+	}
+	if err := c.bkt.Delete(ctx, metadata.GroupClaimFile(group)); err != nil && !c.bkt.IsObjNotFoundErr(err) {
+		level.Warn(c.logger).Log("msg", "failed to release group claim; it expires on its own", "group_id", GroupID(group), "err", err)
+	}
+}
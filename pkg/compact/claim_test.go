@@ -0,0 +1,62 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestGroupClaims(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+
+	a := NewGroupClaims(logger, prometheus.NewRegistry(), bkt, "a", time.Hour)
+	b := NewGroupClaims(logger, prometheus.NewRegistry(), bkt, "b", time.Hour)
+
+	claimed, err := a.Claim(ctx, "0@1")
+	testutil.Ok(t, err)
+	testutil.Assert(t, claimed, "group not claimed")
+	// Claims are renewed by their holder, but not taken over while active.
+	claimed, err = a.Claim(ctx, "0@1")
+	testutil.Ok(t, err)
+	testutil.Assert(t, claimed, "group not claimed again")
+	claimed, err = b.Claim(ctx, "0@1")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !claimed, "active claim taken over")
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.contended))
+	testutil.Ok(t, a.Verify(ctx, "0@1"))
+	testutil.Equals(t, ErrGroupClaimLost, errors.Cause(b.Verify(ctx, "0@1")))
+
+	// Claims of other holders are not released.
+	b.Release(ctx, "0@1")
+	testutil.Ok(t, a.Verify(ctx, "0@1"))
+	a.Release(ctx, "0@1")
+	_, err = metadata.ReadGroupClaim(ctx, bkt, logger, "0@1")
+	testutil.Equals(t, metadata.ErrorGroupClaimNotFound, err)
+	testutil.Equals(t, ErrGroupClaimLost, errors.Cause(a.Verify(ctx, "0@1")))
+
+	// Expired claims are taken over, and their former holder fails verification.
+	expiring := NewGroupClaims(logger, prometheus.NewRegistry(), bkt, "a", -time.Second)
+	claimed, err = expiring.Claim(ctx, "0@2")
+	testutil.Ok(t, err)
+	testutil.Assert(t, claimed, "group not claimed")
+	testutil.Ok(t, expiring.Verify(ctx, "0@2"))
+	claimed, err = b.Claim(ctx, "0@2")
+	testutil.Ok(t, err)
+	testutil.Assert(t, claimed, "expired claim not taken over")
+	testutil.Equals(t, ErrGroupClaimLost, errors.Cause(expiring.Verify(ctx, "0@2")))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(expiring.conflicts))
+}
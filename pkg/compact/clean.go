@@ -12,6 +12,7 @@ import (
 	"github.com/oklog/ulid"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/objstore"
 )
 
@@ -59,3 +60,29 @@ func BestEffortCleanAbortedPartialUploads(
 	}
 	level.Info(logger).Log("msg", "cleaning of aborted partial uploads done")
 }
+
+// BestEffortCleanAbortedCommits deletes blocks of the given pending commits, and the commits themselves, once commits
+// are older than PartialUploadThresholdAge, as their upload is assumed aborted then.
+func BestEffortCleanAbortedCommits(
+	ctx context.Context,
+	logger log.Logger,
+	commits []metadata.PendingCommit,
+	bkt objstore.Bucket,
+	blockCleanups prometheus.Counter,
+	blockCleanupFailures prometheus.Counter,
+) {
+	for _, c := range commits {
+		if ulid.Now()-c.ID.Time() <= uint64(PartialUploadThresholdAge/time.Millisecond) {
+			// Minimum delay has not expired, ignore for now.
+			continue
+		}
+		level.Info(logger).Log("msg", "found aborted commit of blocks uploaded together; deleting its blocks", "commit", c.ID, "group", c.Group, "blocks", len(c.Blocks))
+		if err := block.CleanPendingCommit(ctx, logger, bkt, c); err != nil {
+			blockCleanupFailures.Inc()
+			level.Warn(logger).Log("msg", "failed to delete aborted commit; will retry in next iteration", "commit", c.ID, "thresholdAge", PartialUploadThresholdAge, "err", err)
+			continue
+		}
+		blockCleanups.Add(float64(len(c.Blocks)))
+		level.Info(logger).Log("msg", "deleted aborted commit", "commit", c.ID, "thresholdAge", PartialUploadThresholdAge)
+	}
+}
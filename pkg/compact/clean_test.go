@@ -81,3 +81,54 @@ func TestBestEffortCleanAbortedPartialUploads(t *testing.T) {
 	testutil.Ok(t, err)
 	testutil.Equals(t, true, exists)
 }
+
+func TestBlocksCleaner_DeleteMarkedBlocks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+	logger := log.NewNopLogger()
+
+	var ids []ulid.ULID
+	for i := 0; i < 6; i++ {
+		id := ulid.MustNew(uint64(i+1), nil)
+		ids = append(ids, id)
+
+		var meta metadata.Meta
+		meta.Version = 1
+		meta.ULID = id
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&meta))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.MetaFilename), &buf))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), "chunks", "000001"), bytes.NewReader([]byte{0, 1, 2, 3})))
+	}
+	// The first four blocks were marked long ago, the fifth one recently and the last one is not marked.
+	for i, id := range ids[:5] {
+		deletionTime := time.Now().Add(-48 * time.Hour)
+		if i == 4 {
+			deletionTime = time.Now()
+		}
+		mark, err := json.Marshal(metadata.DeletionMark{ID: id, DeletionTime: deletionTime.Unix(), Version: metadata.DeletionMarkVersion1})
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.DeletionMarkFilename), bytes.NewReader(mark)))
+	}
+
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, bkt, 0)
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, []block.MetadataFilter{ignoreDeletionMarkFilter}, nil)
+	testutil.Ok(t, err)
+	_, _, err = metaFetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+
+	blocksCleaned := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	blockCleanupFailures := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	cleaner := NewBlocksCleaner(logger, bkt, ignoreDeletionMarkFilter, 24*time.Hour, 3, blocksCleaned, blockCleanupFailures)
+	testutil.Ok(t, cleaner.DeleteMarkedBlocks(ctx))
+	testutil.Equals(t, 4.0, promtest.ToFloat64(blocksCleaned))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(blockCleanupFailures))
+
+	for i, id := range ids {
+		exists, err := bkt.Exists(ctx, path.Join(id.String(), metadata.MetaFilename))
+		testutil.Ok(t, err)
+		testutil.Equals(t, i >= 4, exists, "block %d", i)
+	}
+}
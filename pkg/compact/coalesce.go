@@ -0,0 +1,145 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// CoalesceConfig configures coalescing of tiny blocks by CoalescingCompactor.
+type CoalesceConfig struct {
+	// MaxBlockBytes and MaxBlockSeries make blocks with estimated size or number of series below them tiny. Zero disables
+	// the respective limit.
+	MaxBlockBytes  int64
+	MaxBlockSeries uint64
+	// MinBlocks is the minimum number of tiny blocks within a window worth coalescing.
+	MinBlocks int
+	// Window is the size in milliseconds of aligned time windows tiny blocks are coalesced within, so coalesced blocks
+	// never cross boundaries of compaction ranges. It should be one of the compaction ranges.
+	Window int64
+}
+
+// CoalescingCompactor is a tsdb.Compactor which plans coalescing of tiny blocks before leveled compaction. As soon as
+// a window of the compaction range holds enough tiny blocks, e.g. produced by many receivers, they are compacted into a
+// single block, regardless of whether the leveled planner would compact the window yet. Compaction of non overlapping
+// blocks copies chunks without re-encoding them, so it is cheap, and it keeps the number of blocks to plan, sync and
+// query low. Otherwise planning and compaction are done by the wrapped compactor.
+type CoalescingCompactor struct {
+	tsdb.Compactor
+
+	logger log.Logger
+	conf   CoalesceConfig
+
+	plans     prometheus.Counter
+	coalesced prometheus.Counter
+}
+
+// NewCoalescingCompactor returns CoalescingCompactor wrapping the given compactor.
+func NewCoalescingCompactor(logger log.Logger, reg prometheus.Registerer, comp tsdb.Compactor, conf CoalesceConfig) *CoalescingCompactor {
+	return &CoalescingCompactor{
+		Compactor: comp,
+		logger:    logger,
+		conf:      conf,
+		plans: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_coalesce_plans_total",
+			Help: "Total number of planned compactions coalescing tiny blocks.",
+		}),
+		coalesced: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_coalesced_blocks_total",
+			Help: "Total number of tiny blocks in planned compactions coalescing them.",
+		}),
+	}
+}
+
+// Plan returns tiny blocks of the window with most of them, if there are at least CoalesceConfig.MinBlocks of them.
+// Otherwise the wrapped compactor plans.
+func (c *CoalescingCompactor) Plan(dir string) ([]string, error) {
+	plan, err := c.planCoalesce(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(plan) == 0 {
+		return c.Compactor.Plan(dir)
+	}
+	c.plans.Inc()
+	c.coalesced.Add(float64(len(plan)))
+	level.Info(c.logger).Log("msg", "planned coalescing of tiny blocks", "blocks", len(plan))
+	return plan, nil
+}
+
+func (c *CoalescingCompactor) planCoalesce(dir string) ([]string, error) {
+	if c.conf.MinBlocks < 2 || c.conf.Window <= 0 {
+		return nil, nil
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read planning dir")
+	}
+
+	windows := map[int64][]*metadata.Meta{}
+	for _, fi := range fis {
+		if _, err := ulid.Parse(fi.Name()); err != nil || !fi.IsDir() {
+			continue
+		}
+		m, err := metadata.Read(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "read meta of %s", fi.Name())
+		}
+		if m.Compaction.Failed || !c.tiny(m) {
+			continue
+		}
+		w := m.MinTime / c.conf.Window
+		if m.MinTime < 0 {
+			w--
+		}
+		// Blocks crossing the window boundary are left to the leveled planner.
+		if m.MaxTime > (w+1)*c.conf.Window {
+			continue
+		}
+		windows[w] = append(windows[w], m)
+	}
+
+	var (
+		best  []*metadata.Meta
+		bestW int64
+	)
+	for w, metas := range windows {
+		if len(metas) < c.conf.MinBlocks || len(metas) < len(best) {
+			continue
+		}
+		// Ties are broken by the oldest window, so planning is deterministic.
+		if len(metas) == len(best) && w > bestW {
+			continue
+		}
+		best, bestW = metas, w
+	}
+	sort.Slice(best, func(i, j int) bool {
+		return best[i].MinTime < best[j].MinTime
+	})
+	plan := make([]string, 0, len(best))
+	for _, m := range best {
+		plan = append(plan, filepath.Join(dir, m.ULID.String()))
+	}
+	return plan, nil
+}
+
+// tiny returns true if the block is below any of the configured limits.
+func (c *CoalescingCompactor) tiny(m *metadata.Meta) bool {
+	if c.conf.MaxBlockSeries > 0 && m.Stats.NumSeries < c.conf.MaxBlockSeries {
+		return true
+	}
+	return c.conf.MaxBlockBytes > 0 && estimatedBlockBytes(m.Stats.NumSamples, m.Stats.NumSeries, m.Stats.NumChunks) < c.conf.MaxBlockBytes
+}
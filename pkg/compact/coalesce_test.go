@@ -0,0 +1,85 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+type planFunc func(dir string) ([]string, error)
+
+type planCompactor struct {
+	tsdb.Compactor
+	plan planFunc
+}
+
+func (c planCompactor) Plan(dir string) ([]string, error) {
+	return c.plan(dir)
+}
+
+func TestCoalescingCompactor_Plan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-coalesce")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	write := func(id uint64, minTime, maxTime int64, series uint64) string {
+		m := &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{
+				ULID:    ulid.MustNew(id, nil),
+				MinTime: minTime,
+				MaxTime: maxTime,
+				Stats:   tsdb.BlockStats{NumSeries: series, NumSamples: series * 120, NumChunks: series},
+				Version: 1,
+			},
+			Thanos: metadata.Thanos{Labels: map[string]string{"a": "1"}},
+		}
+		bdir := filepath.Join(dir, m.ULID.String())
+		testutil.Ok(t, os.MkdirAll(bdir, os.ModePerm))
+		testutil.Ok(t, metadata.Write(log.NewNopLogger(), bdir, m))
+		return bdir
+	}
+
+	leveled := []string{"leveled"}
+	c := NewCoalescingCompactor(log.NewNopLogger(), prometheus.NewRegistry(), planCompactor{plan: func(string) ([]string, error) {
+		return leveled, nil
+	}}, CoalesceConfig{MaxBlockSeries: 100, MinBlocks: 3, Window: 100})
+
+	// Not enough tiny blocks within any window.
+	w0a := write(1, 0, 20, 10)
+	write(2, 20, 40, 1000)
+	w0c := write(3, 40, 60, 10)
+	write(4, 90, 110, 10)
+	w1a := write(5, 100, 120, 10)
+	w1b := write(6, 120, 140, 10)
+	plan, err := c.Plan(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, leveled, plan)
+
+	// Both windows have enough tiny blocks, the oldest one is coalesced first.
+	w0d := write(7, 60, 80, 10)
+	w1c := write(8, 140, 160, 10)
+	plan, err = c.Plan(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{w0a, w0c, w0d}, plan)
+
+	// The window with most tiny blocks is coalesced first.
+	w1d := write(9, 160, 180, 10)
+	plan, err = c.Plan(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{w1a, w1b, w1c, w1d}, plan)
+	testutil.Equals(t, 2.0, promtest.ToFloat64(c.plans))
+	testutil.Equals(t, 7.0, promtest.ToFloat64(c.coalesced))
+}
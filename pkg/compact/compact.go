@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"sync"
@@ -20,8 +21,11 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/tsdb"
 	terrors "github.com/prometheus/prometheus/tsdb/errors"
+	"go.uber.org/atomic"
 
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
@@ -39,31 +43,60 @@ const (
 
 // Syncer synchronizes block metas from a bucket into a local directory.
 // It sorts them into compaction groups based on equal label sets.
+// Results of each sync are kept as a MetaSnapshot, shared by all consumers until the next sync.
 type Syncer struct {
 	logger                   log.Logger
 	reg                      prometheus.Registerer
 	bkt                      objstore.Bucket
 	fetcher                  block.MetadataFetcher
 	mtx                      sync.Mutex
-	blocks                   map[ulid.ULID]*metadata.Meta
-	partial                  map[ulid.ULID]error
+	snapshot                 *MetaSnapshot
 	blockSyncConcurrency     int
-	metrics                  *syncerMetrics
+	metrics                  *SyncerMetrics
 	duplicateBlocksFilter    *block.DeduplicateFilter
 	ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter
+	groupSizes               *groupSizeAccounter
+	labelNormalizer          *block.LabelNormalizer
+	timePartition            *block.TimePartitionOwnershipFilter
+	deletionGate             *DeletionGate
+	duplicatesGrace          time.Duration
+	coverage                 *CoverageVerifier
+	strictGC                 bool
+	gcMaxStaleness           time.Duration
+	gcProgress               *gcProgress
+	inventory                *objstore.InventoryReader
+
+	// dryRun makes the Syncer log changes of the bucket instead of doing them. It is set by BucketCompactor.
+	dryRun bool
 }
 
-type syncerMetrics struct {
+// SyncerMetrics are metrics of Syncer. They can be created once and shared by multiple Syncers with
+// NewSyncerWithMetrics, e.g. by Syncers recreated on configuration reload, which would otherwise register the same
+// metrics again. Metrics of multiple Syncers working side by side in a single process have to be registered in
+// registerers telling them apart, e.g. by prometheus.WrapRegistererWith.
+type SyncerMetrics struct {
+	// Metrics of group size accounting are registered once a Syncer enables it.
+	reg            prometheus.Registerer
+	groupSizesOnce sync.Once
+	groupSizes     *groupSizeMetrics
+
 	garbageCollectedBlocks    prometheus.Counter
 	garbageCollections        prometheus.Counter
 	garbageCollectionFailures prometheus.Counter
 	garbageCollectionDuration prometheus.Histogram
 	blocksMarkedForDeletion   prometheus.Counter
+	labelsMigratedBlocks      prometheus.Counter
+	garbageVerifySkips        *prometheus.CounterVec
+	gcProgress                *gcProgressMetrics
+	pendingBlocks             prometheus.Gauge
 }
 
-func newSyncerMetrics(reg prometheus.Registerer, blocksMarkedForDeletion prometheus.Counter, garbageCollectedBlocks prometheus.Counter) *syncerMetrics {
-	var m syncerMetrics
+// NewSyncerMetrics returns SyncerMetrics registered in the given registerer. The given counters of blocks marked for
+// deletion and garbage collected blocks are shared with the DefaultGrouper, so they are created by the caller.
+func NewSyncerMetrics(reg prometheus.Registerer, blocksMarkedForDeletion prometheus.Counter, garbageCollectedBlocks prometheus.Counter) *SyncerMetrics {
+	var m SyncerMetrics
 
+	m.reg = reg
 	m.garbageCollectedBlocks = garbageCollectedBlocks
 	m.garbageCollections = promauto.With(reg).NewCounter(prometheus.CounterOpts{
 		Name: "thanos_compact_garbage_collection_total",
@@ -80,26 +113,67 @@ func newSyncerMetrics(reg prometheus.Registerer, blocksMarkedForDeletion prometh
 	})
 
 	m.blocksMarkedForDeletion = blocksMarkedForDeletion
+	m.labelsMigratedBlocks = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_compact_labels_migrated_blocks_total",
+		Help: "Total number of blocks whose meta.json was rewritten with normalized external labels.",
+	})
+	m.garbageVerifySkips = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_compact_garbage_collection_verification_skips_total",
+		Help: "Total number of outdated blocks not marked for deletion, because the bucket no longer matched the synced view, by reason.",
+	}, []string{"reason"})
+	m.gcProgress = newGCProgressMetrics(reg)
+	m.pendingBlocks = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_compact_pending_blocks",
+		Help: "Number of blocks whose meta.json failed to load on the last sync. Groups they may belong to are not compacted.",
+	})
 
 	return &m
 }
 
+// groupSizeMetrics returns metrics of group size accounting, registering them on first use.
+func (m *SyncerMetrics) groupSizeMetrics() *groupSizeMetrics {
+	m.groupSizesOnce.Do(func() {
+		m.groupSizes = newGroupSizeMetrics(m.reg)
+	})
+	return m.groupSizes
+}
+
 // NewMetaSyncer returns a new Syncer for the given Bucket and directory.
 // Blocks must be at least as old as the sync delay for being considered.
-func NewSyncer(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket, fetcher block.MetadataFetcher, duplicateBlocksFilter *block.DeduplicateFilter, ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter, blocksMarkedForDeletion prometheus.Counter, garbageCollectedBlocks prometheus.Counter, blockSyncConcurrency int) (*Syncer, error) {
+func NewSyncer(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket, fetcher block.MetadataFetcher, duplicateBlocksFilter *block.DeduplicateFilter, ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter, blocksMarkedForDeletion prometheus.Counter, garbageCollectedBlocks prometheus.Counter, blockSyncConcurrency int, opts ...SyncerOption) (*Syncer, error) {
+	return NewSyncerWithMetrics(logger, NewSyncerMetrics(reg, blocksMarkedForDeletion, garbageCollectedBlocks), bkt, fetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blockSyncConcurrency, opts...)
+}
+
+// NewSyncerWithMetrics returns a new Syncer like NewSyncer, with the given pre-built metrics.
+func NewSyncerWithMetrics(logger log.Logger, metrics *SyncerMetrics, bkt objstore.Bucket, fetcher block.MetadataFetcher, duplicateBlocksFilter *block.DeduplicateFilter, ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter, blockSyncConcurrency int, opts ...SyncerOption) (*Syncer, error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
+	o := applySyncerOptions(opts)
+	var groupSizes *groupSizeAccounter
+	if o.groupSizeAccounting {
+		groupSizes = newGroupSizeAccounter(metrics.groupSizeMetrics(), bkt, o.inventory, blockSyncConcurrency)
+	}
 	return &Syncer{
 		logger:                   logger,
-		reg:                      reg,
+		reg:                      metrics.reg,
 		bkt:                      bkt,
 		fetcher:                  fetcher,
-		blocks:                   map[ulid.ULID]*metadata.Meta{},
-		metrics:                  newSyncerMetrics(reg, blocksMarkedForDeletion, garbageCollectedBlocks),
+		snapshot:                 emptyMetaSnapshot(),
+		metrics:                  metrics,
 		duplicateBlocksFilter:    duplicateBlocksFilter,
 		ignoreDeletionMarkFilter: ignoreDeletionMarkFilter,
 		blockSyncConcurrency:     blockSyncConcurrency,
+		groupSizes:               groupSizes,
+		labelNormalizer:          o.labelNormalizer,
+		timePartition:            o.timePartition,
+		deletionGate:             o.deletionGate,
+		duplicatesGrace:          o.duplicatesGrace,
+		coverage:                 o.coverage,
+		strictGC:                 o.strictGC,
+		gcMaxStaleness:           o.gcMaxStaleness,
+		gcProgress:               newGCProgress(metrics.gcProgress),
+		inventory:                o.inventory,
 	}, nil
 }
 
@@ -119,85 +193,357 @@ func UntilNextDownsampling(m *metadata.Meta) (time.Duration, error) {
 	}
 }
 
-// SyncMetas synchronizes local state of block metas with what we have in the bucket.
+// SyncMetas synchronizes local state of block metas with what we have in the bucket, replacing the current snapshot.
 func (s *Syncer) SyncMetas(ctx context.Context) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
+	return s.syncMetas(ctx)
+}
+
+func (s *Syncer) syncMetas(ctx context.Context) error {
+	syncTime := time.Now()
 	metas, partial, err := s.fetcher.Fetch(ctx)
 	if err != nil {
 		return retry(err)
 	}
-	s.blocks = metas
-	s.partial = partial
+	if s.timePartition != nil {
+		// Blocks are already filtered by the fetcher, but partial blocks have no time range to filter by.
+		if !s.timePartition.Contains(timestamp.FromTime(time.Now())) {
+			partial = map[ulid.ULID]error{}
+		}
+	}
+	// Blocks whose meta.json failed to load keep their metas from previous syncs, so groups they belong to are known.
+	pending := map[ulid.ULID]error{}
+	if f, ok := s.fetcher.(interface{ Pending() map[ulid.ULID]error }); ok {
+		pending = f.Pending()
+	}
+	pendingMetas := make(map[ulid.ULID]*metadata.Meta, len(pending))
+	for id := range pending {
+		if m, ok := s.snapshot.Metas[id]; ok {
+			pendingMetas[id] = m
+		} else if m, ok := s.snapshot.PendingMetas[id]; ok {
+			pendingMetas[id] = m
+		}
+	}
+	s.metrics.pendingBlocks.Set(float64(len(pending)))
+
+	// Capture state of filters computed by this fetch, so the snapshot stays consistent when the filters are
+	// reused by the next fetch. The deduplicate filter reuses its slice of IDs, so it has to be copied.
+	s.snapshot = &MetaSnapshot{
+		Version:       s.snapshot.Version + 1,
+		SyncTime:      syncTime,
+		Metas:         metas,
+		Partial:       partial,
+		DeletionMarks: s.ignoreDeletionMarkFilter.DeletionMarkBlocks(),
+		DuplicateIDs:  append([]ulid.ULID(nil), s.duplicateBlocksFilter.DuplicateIDs()...),
+		Pending:       pending,
+		PendingMetas:  pendingMetas,
+	}
+
+	if s.inventory != nil {
+		// Objects missing in the loaded report are requested from the bucket, so failing to load a newer one is not fatal.
+		if err := s.inventory.Sync(ctx); err != nil {
+			level.Warn(s.logger).Log("msg", "failed to load inventory report; using the loaded one", "err", err)
+		}
+	}
+	if s.groupSizes != nil {
+		// Group sizes are informational only; the previous snapshot is kept rather than failing the sync.
+		if err := s.groupSizes.update(ctx, metas); err != nil {
+			level.Warn(s.logger).Log("msg", "failed to compute group sizes; keeping previous ones", "err", err)
+		}
+	}
+	if s.labelNormalizer != nil {
+		if err := s.migrateLabels(ctx); err != nil {
+			return retry(errors.Wrap(err, "migrate external labels"))
+		}
+	}
 	return nil
 }
 
-// Partial returns partial blocks since last sync.
-func (s *Syncer) Partial() map[ulid.ULID]error {
+// migrateLabels persists external labels normalized during the last sync in meta.json of the affected blocks.
+func (s *Syncer) migrateLabels(ctx context.Context) error {
+	for _, id := range s.labelNormalizer.NormalizedBlocks() {
+		if _, ok := s.snapshot.Metas[id]; !ok {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// Normalize raw meta from the bucket, as the synced one might have been modified by other modifiers as well.
+		meta, err := block.DownloadMeta(ctx, s.logger, s.bkt, id)
+		if err != nil {
+			return err
+		}
+		lset, changed := s.labelNormalizer.Normalize(meta.Thanos.Labels)
+		if !changed {
+			continue
+		}
+		if s.dryRun {
+			level.Info(s.logger).Log("msg", "dry run: would rewrite meta.json with normalized external labels", "block", id, "labels", labels.FromMap(lset))
+			continue
+		}
+		meta.Thanos.Labels = lset
+		if err := block.UploadMeta(ctx, s.bkt, meta); err != nil {
+			return err
+		}
+		level.Info(s.logger).Log("msg", "rewrote meta.json with normalized external labels", "block", id, "labels", labels.FromMap(lset))
+		s.metrics.labelsMigratedBlocks.Inc()
+	}
+	return nil
+}
+
+// GroupSizes returns total sizes of compaction groups computed on the last two syncs.
+// Both snapshots are empty unless the Syncer was created with WithGroupSizeAccounting.
+func (s *Syncer) GroupSizes() (current GroupSizeSnapshot, previous GroupSizeSnapshot) {
+	if s.groupSizes == nil {
+		return GroupSizeSnapshot{}, GroupSizeSnapshot{}
+	}
+	return s.groupSizes.snapshots()
+}
+
+// Snapshot returns the current snapshot, i.e. the last sync including changes done by garbage collection since then.
+// The returned snapshot must not be modified.
+func (s *Syncer) Snapshot() *MetaSnapshot {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	return s.partial
+	return s.snapshot
+}
+
+// Partial returns partial blocks since last sync.
+func (s *Syncer) Partial() map[ulid.ULID]error {
+	return s.Snapshot().Partial
 }
 
 // Metas returns loaded metadata blocks since last sync.
 func (s *Syncer) Metas() map[ulid.ULID]*metadata.Meta {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
+	return s.Snapshot().Metas
+}
 
-	return s.blocks
+// Pending returns blocks whose meta.json failed to load on the last sync, if the fetcher allows partial results.
+func (s *Syncer) Pending() map[ulid.ULID]error {
+	return s.Snapshot().Pending
 }
 
 // GarbageCollect marks blocks for deletion from bucket if their data is available as part of a
 // block with a higher compaction level.
-// Call to SyncMetas function is required to populate duplicateIDs in duplicateBlocksFilter.
+// Call to SyncMetas function is required to populate duplicate blocks of the snapshot.
 func (s *Syncer) GarbageCollect(ctx context.Context) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
 	begin := time.Now()
 
+	if s.gcMaxStaleness > 0 && time.Since(s.snapshot.SyncTime) > s.gcMaxStaleness {
+		level.Info(s.logger).Log("msg", "metas are too stale for garbage collection; syncing", "synced", s.snapshot.SyncTime, "max_staleness", s.gcMaxStaleness)
+		if err := s.syncMetas(ctx); err != nil {
+			s.metrics.garbageCollectionFailures.Inc()
+			return err
+		}
+	}
+
 	// Ignore filter exists before deduplicate filter.
-	deletionMarkMap := s.ignoreDeletionMarkFilter.DeletionMarkBlocks()
-	duplicateIDs := s.duplicateBlocksFilter.DuplicateIDs()
+	deletionMarkMap := s.snapshot.DeletionMarks
+	duplicateIDs := s.snapshot.DuplicateIDs
 
 	// GarbageIDs contains the duplicateIDs, since these blocks can be replaced with other blocks.
 	// We also remove ids present in deletionMarkMap since these blocks are already marked for deletion.
 	garbageIDs := []ulid.ULID{}
+	replacements := s.replacements()
+	uploaded := map[ulid.ULID]time.Time{}
 	for _, id := range duplicateIDs {
 		if _, exists := deletionMarkMap[id]; exists {
 			continue
 		}
+		if s.ignoreDeletionMarkFilter.IsExempt(id) {
+			level.Info(s.logger).Log("msg", "not marking outdated block for deletion, as it is exempt from deletion", "block", id)
+			continue
+		}
+		if r, ok := replacements[id]; ok && s.duplicatesGrace > 0 {
+			within, err := s.withinDuplicatesGrace(ctx, r, uploaded)
+			if err != nil {
+				s.metrics.garbageCollectionFailures.Inc()
+				return retry(err)
+			}
+			if within {
+				level.Debug(s.logger).Log("msg", "not marking outdated block for deletion, as its replacement is within grace period", "block", id, "replacement", r)
+				continue
+			}
+		}
 		garbageIDs = append(garbageIDs, id)
 	}
 
-	for _, id := range garbageIDs {
+	if s.coverage != nil {
+		// Verified once the snapshot no longer has the collected blocks.
+		defer func() { s.coverage.verify(s.snapshot.Metas) }()
+	}
+
+	// Immediately update our in-memory state with all blocks marked so far, so no further call to SyncMetas
+	// is needed after running garbage collection.
+	var marked []ulid.ULID
+	defer func() {
+		if len(marked) > 0 {
+			s.snapshot = s.snapshot.withDeleted(s.snapshot.Version+1, time.Now(), marked...)
+		}
+	}()
+
+	// Candidates are processed in order, so an interrupted garbage collection is resumed by the next one.
+	garbageIDs = s.gcProgress.order(DuplicateDeletionReason, garbageIDs)
+	for i, id := range garbageIDs {
+		if i > 0 {
+			s.gcProgress.processed(DuplicateDeletionReason, garbageIDs[i-1], len(garbageIDs)-i)
+		}
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
 
+		if s.dryRun {
+			// Blocks are still dropped from the snapshot, so the rest of the dry run sees the bucket as after a real run.
+			level.Info(s.logger).Log("msg", "dry run: would mark outdated block for deletion", "block", id)
+			marked = append(marked, id)
+			continue
+		}
+
+		if s.deletionGate != nil {
+			meta, err := block.DownloadMeta(ctx, s.logger, s.bkt, id)
+			if err != nil {
+				s.metrics.garbageCollectionFailures.Inc()
+				return retry(errors.Wrapf(err, "download meta of outdated block %s", id))
+			}
+			ok, err := s.deletionGate.allow(ctx, &meta, DuplicateDeletionReason)
+			if err != nil {
+				s.metrics.garbageCollectionFailures.Inc()
+				return retry(err)
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		if s.strictGC {
+			r, hasReplacement := replacements[id]
+			reason, err := s.verifyGarbage(ctx, id, r, hasReplacement)
+			if err != nil {
+				s.metrics.garbageCollectionFailures.Inc()
+				return retry(errors.Wrapf(err, "verify outdated block %s", id))
+			}
+			if reason != "" {
+				level.Info(s.logger).Log("msg", "not marking outdated block for deletion, as the bucket changed since the sync", "block", id, "reason", reason)
+				s.metrics.garbageVerifySkips.WithLabelValues(reason).Inc()
+				continue
+			}
+		}
+
 		// Spawn a new context so we always mark a block for deletion in full on shutdown.
 		delCtx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 
 		level.Info(s.logger).Log("msg", "marking outdated block for deletion", "block", id)
 		err := block.MarkForDeletion(delCtx, s.logger, s.bkt, id, s.metrics.blocksMarkedForDeletion)
 		cancel()
+		if errors.Cause(err) == block.ErrBlockUnderHold {
+			// Held blocks are filtered out after deduplication, so outdated ones are found here too.
+			level.Info(s.logger).Log("msg", "not marking outdated block for deletion, as it is under hold", "block", id)
+			continue
+		}
 		if err != nil {
 			s.metrics.garbageCollectionFailures.Inc()
 			return retry(errors.Wrapf(err, "mark block %s for deletion", id))
 		}
 
-		// Immediately update our in-memory state so no further call to SyncMetas is needed
-		// after running garbage collection.
-		delete(s.blocks, id)
+		marked = append(marked, id)
 		s.metrics.garbageCollectedBlocks.Inc()
 	}
+	s.gcProgress.completed(DuplicateDeletionReason)
 	s.metrics.garbageCollections.Inc()
 	s.metrics.garbageCollectionDuration.Observe(time.Since(begin).Seconds())
 	return nil
 }
 
+// withinDuplicatesGrace returns true if the given block replacing outdated ones was uploaded within the duplicates grace
+// period, as told by the modification time of its meta.json, which is uploaded last. Modification times are cached in the
+// given map. A rewritten meta.json, e.g. by label migration, restarts the grace period.
+func (s *Syncer) withinDuplicatesGrace(ctx context.Context, replacement ulid.ULID, uploaded map[ulid.ULID]time.Time) (bool, error) {
+	// Blocks are uploaded after the time encoded in their ULID, so their meta.json is checked only once it passed.
+	if time.Since(ulid.Time(replacement.Time())) < s.duplicatesGrace {
+		return true, nil
+	}
+	t, ok := uploaded[replacement]
+	if !ok {
+		attrs, err := s.bkt.Attributes(ctx, path.Join(replacement.String(), block.MetaFilename))
+		if err != nil {
+			return false, errors.Wrapf(err, "get attributes of meta.json of block %s", replacement)
+		}
+		t = attrs.LastModified
+		uploaded[replacement] = t
+	}
+	return time.Since(t) < s.duplicatesGrace, nil
+}
+
+// verifyGarbage re-checks in the bucket, with existence checks only, that the given outdated block can still be marked
+// for deletion, as the synced view might be stale: the block replacing it has to exist and must not be marked for
+// deletion, while the outdated block itself has to exist and must not be marked yet. It returns the reason for not
+// marking the block, empty if the block can be marked.
+func (s *Syncer) verifyGarbage(ctx context.Context, id, replacement ulid.ULID, hasReplacement bool) (string, error) {
+	checks := []existenceCheck{
+		{name: path.Join(id.String(), metadata.DeletionMarkFilename), exists: false, reason: "already-marked"},
+		{name: path.Join(id.String(), block.MetaFilename), exists: true, reason: "block-missing"},
+	}
+	if hasReplacement {
+		checks = append(checks,
+			existenceCheck{name: path.Join(replacement.String(), block.MetaFilename), exists: true, reason: "replacement-missing"},
+			existenceCheck{name: path.Join(replacement.String(), metadata.DeletionMarkFilename), exists: false, reason: "replacement-marked"},
+		)
+	}
+	for _, c := range checks {
+		// Objects listed by the inventory report existed when it was taken. Deleting a block listed takes the delete delay
+		// after marking it, which is not shorter than the max age of reports, so its deletion mark would still be found.
+		var exists bool
+		if s.inventory != nil {
+			_, exists = s.inventory.Size(c.name)
+		}
+		if !exists {
+			var err error
+			if exists, err = s.bkt.Exists(ctx, c.name); err != nil {
+				return "", errors.Wrapf(err, "check exists %s", c.name)
+			}
+		}
+		if exists != c.exists {
+			return c.reason, nil
+		}
+	}
+	return "", nil
+}
+
+// existenceCheck expects the object with the given name to exist or not, failing with the given reason otherwise.
+type existenceCheck struct {
+	name   string
+	exists bool
+	reason string
+}
+
+// replacements maps outdated blocks found by the last sync to the kept blocks replacing them.
+func (s *Syncer) replacements() map[ulid.ULID]ulid.ULID {
+	if s.duplicateBlocksFilter == nil {
+		return nil
+	}
+	res := map[ulid.ULID]ulid.ULID{}
+	var walk func(n *block.Node, replacement ulid.ULID)
+	walk = func(n *block.Node, replacement ulid.ULID) {
+		for _, c := range n.Children {
+			res[c.ULID] = replacement
+			walk(c, replacement)
+		}
+	}
+	for _, root := range s.duplicateBlocksFilter.Roots() {
+		for _, kept := range root.Children {
+			walk(kept, kept.ULID)
+		}
+	}
+	return res
+}
+
 // Grouper is responsible to group all known blocks into sub groups which are safe to be
 // compacted concurrently.
 type Grouper interface {
@@ -223,55 +569,89 @@ type DefaultGrouper struct {
 	logger                   log.Logger
 	acceptMalformedIndex     bool
 	enableVerticalCompaction bool
-	compactions              *prometheus.CounterVec
-	compactionRunsStarted    *prometheus.CounterVec
-	compactionRunsCompleted  *prometheus.CounterVec
-	compactionFailures       *prometheus.CounterVec
-	verticalCompactions      *prometheus.CounterVec
-	garbageCollectedBlocks   prometheus.Counter
-	blocksMarkedForDeletion  prometheus.Counter
+	metrics                  *DefaultGrouperMetrics
+	groupOpts                []GroupOption
 }
 
-// NewDefaultGrouper makes a new DefaultGrouper.
-func NewDefaultGrouper(
-	logger log.Logger,
-	bkt objstore.Bucket,
-	acceptMalformedIndex bool,
-	enableVerticalCompaction bool,
-	reg prometheus.Registerer,
-	blocksMarkedForDeletion prometheus.Counter,
-	garbageCollectedBlocks prometheus.Counter,
-) *DefaultGrouper {
-	return &DefaultGrouper{
-		bkt:                      bkt,
-		logger:                   logger,
-		acceptMalformedIndex:     acceptMalformedIndex,
-		enableVerticalCompaction: enableVerticalCompaction,
+// DefaultGrouperMetrics are per group metrics of groups created by DefaultGrouper. They can be created once and shared
+// by multiple groupers with NewDefaultGrouperWithMetrics, the same way as SyncerMetrics.
+type DefaultGrouperMetrics struct {
+	compactions             *prometheus.CounterVec
+	compactionRunsStarted   *prometheus.CounterVec
+	compactionRunsCompleted *prometheus.CounterVec
+	compactionFailures      *prometheus.CounterVec
+	verticalCompactions     *prometheus.CounterVec
+	emptyCompactions        *prometheus.CounterVec
+	garbageCollectedBlocks  prometheus.Counter
+	blocksMarkedForDeletion prometheus.Counter
+}
+
+// NewDefaultGrouperMetrics returns DefaultGrouperMetrics registered in the given registerer. The given counters of
+// blocks marked for deletion and garbage collected blocks are shared with the Syncer, so they are created by the caller.
+func NewDefaultGrouperMetrics(reg prometheus.Registerer, blocksMarkedForDeletion prometheus.Counter, garbageCollectedBlocks prometheus.Counter) *DefaultGrouperMetrics {
+	return &DefaultGrouperMetrics{
 		compactions: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
 			Name: "thanos_compact_group_compactions_total",
 			Help: "Total number of group compaction attempts that resulted in a new block.",
-		}, []string{"group"}),
+		}, []string{"group_id"}),
 		compactionRunsStarted: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
 			Name: "thanos_compact_group_compaction_runs_started_total",
 			Help: "Total number of group compaction attempts.",
-		}, []string{"group"}),
+		}, []string{"group_id"}),
 		compactionRunsCompleted: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
 			Name: "thanos_compact_group_compaction_runs_completed_total",
 			Help: "Total number of group completed compaction runs. This also includes compactor group runs that resulted with no compaction.",
-		}, []string{"group"}),
+		}, []string{"group_id"}),
 		compactionFailures: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
 			Name: "thanos_compact_group_compactions_failures_total",
 			Help: "Total number of failed group compactions.",
-		}, []string{"group"}),
+		}, []string{"group_id"}),
 		verticalCompactions: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
 			Name: "thanos_compact_group_vertical_compactions_total",
 			Help: "Total number of group compaction attempts that resulted in a new block based on overlapping blocks.",
-		}, []string{"group"}),
+		}, []string{"group_id"}),
+		emptyCompactions: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_group_empty_compactions_total",
+			Help: "Total number of group compaction attempts that yielded no samples. Their source blocks were marked for deletion without uploading a new block.",
+		}, []string{"group_id"}),
 		garbageCollectedBlocks:  garbageCollectedBlocks,
 		blocksMarkedForDeletion: blocksMarkedForDeletion,
 	}
 }
 
+// NewDefaultGrouper makes a new DefaultGrouper. Given options are applied to all created groups.
+func NewDefaultGrouper(
+	logger log.Logger,
+	bkt objstore.Bucket,
+	acceptMalformedIndex bool,
+	enableVerticalCompaction bool,
+	reg prometheus.Registerer,
+	blocksMarkedForDeletion prometheus.Counter,
+	garbageCollectedBlocks prometheus.Counter,
+	opts ...GroupOption,
+) *DefaultGrouper {
+	return NewDefaultGrouperWithMetrics(logger, bkt, acceptMalformedIndex, enableVerticalCompaction, NewDefaultGrouperMetrics(reg, blocksMarkedForDeletion, garbageCollectedBlocks), opts...)
+}
+
+// NewDefaultGrouperWithMetrics makes a new DefaultGrouper like NewDefaultGrouper, with the given pre-built metrics.
+func NewDefaultGrouperWithMetrics(
+	logger log.Logger,
+	bkt objstore.Bucket,
+	acceptMalformedIndex bool,
+	enableVerticalCompaction bool,
+	metrics *DefaultGrouperMetrics,
+	opts ...GroupOption,
+) *DefaultGrouper {
+	return &DefaultGrouper{
+		bkt:                      bkt,
+		logger:                   logger,
+		acceptMalformedIndex:     acceptMalformedIndex,
+		enableVerticalCompaction: enableVerticalCompaction,
+		metrics:                  metrics,
+		groupOpts:                opts,
+	}
+}
+
 // Groups returns the compaction groups for all blocks currently known to the syncer.
 // It creates all groups from the scratch on every call.
 func (g *DefaultGrouper) Groups(blocks map[ulid.ULID]*metadata.Meta) (res []*Group, err error) {
@@ -280,25 +660,9 @@ func (g *DefaultGrouper) Groups(blocks map[ulid.ULID]*metadata.Meta) (res []*Gro
 		groupKey := DefaultGroupKey(m.Thanos)
 		group, ok := groups[groupKey]
 		if !ok {
-			lbls := labels.FromMap(m.Thanos.Labels)
-			group, err = NewGroup(
-				log.With(g.logger, "group", fmt.Sprintf("%d@%v", m.Thanos.Downsample.Resolution, lbls.String()), "groupKey", groupKey),
-				g.bkt,
-				groupKey,
-				lbls,
-				m.Thanos.Downsample.Resolution,
-				g.acceptMalformedIndex,
-				g.enableVerticalCompaction,
-				g.compactions.WithLabelValues(groupKey),
-				g.compactionRunsStarted.WithLabelValues(groupKey),
-				g.compactionRunsCompleted.WithLabelValues(groupKey),
-				g.compactionFailures.WithLabelValues(groupKey),
-				g.verticalCompactions.WithLabelValues(groupKey),
-				g.garbageCollectedBlocks,
-				g.blocksMarkedForDeletion,
-			)
+			group, err = g.newGroup(groupKey, groupKey, m)
 			if err != nil {
-				return nil, errors.Wrap(err, "create compaction group")
+				return nil, err
 			}
 			groups[groupKey] = group
 			res = append(res, group)
@@ -313,25 +677,82 @@ func (g *DefaultGrouper) Groups(blocks map[ulid.ULID]*metadata.Meta) (res []*Gro
 	return res, nil
 }
 
+// newGroup returns a new empty group with the given key, of the labels and resolution of the given block. Metrics of the
+// group are labeled with the given metrics key.
+func (g *DefaultGrouper) newGroup(groupKey, metricsKey string, m *metadata.Meta) (*Group, error) {
+	lbls := labels.FromMap(m.Thanos.Labels)
+	group, err := NewGroup(
+		log.With(g.logger, "group", fmt.Sprintf("%d@%v", m.Thanos.Downsample.Resolution, lbls.String()), "group_id", GroupID(groupKey)),
+		g.bkt,
+		groupKey,
+		lbls,
+		m.Thanos.Downsample.Resolution,
+		g.acceptMalformedIndex,
+		g.enableVerticalCompaction,
+		GroupMetrics{
+			Compactions:             g.metrics.compactions.WithLabelValues(GroupID(metricsKey)),
+			CompactionRunsStarted:   g.metrics.compactionRunsStarted.WithLabelValues(GroupID(metricsKey)),
+			CompactionRunsCompleted: g.metrics.compactionRunsCompleted.WithLabelValues(GroupID(metricsKey)),
+			CompactionFailures:      g.metrics.compactionFailures.WithLabelValues(GroupID(metricsKey)),
+			VerticalCompactions:     g.metrics.verticalCompactions.WithLabelValues(GroupID(metricsKey)),
+			GarbageCollectedBlocks:  g.metrics.garbageCollectedBlocks,
+			BlocksMarkedForDeletion: g.metrics.blocksMarkedForDeletion,
+			EmptyCompactions:        g.metrics.emptyCompactions.WithLabelValues(GroupID(metricsKey)),
+		},
+		g.groupOpts...,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "create compaction group")
+	}
+	return group, nil
+}
+
 // Group captures a set of blocks that have the same origin labels and downsampling resolution.
 // Those blocks generally contain the same series and can thus efficiently be compacted.
 type Group struct {
-	logger                      log.Logger
-	bkt                         objstore.Bucket
-	key                         string
-	labels                      labels.Labels
-	resolution                  int64
-	mtx                         sync.Mutex
-	blocks                      map[ulid.ULID]*metadata.Meta
-	acceptMalformedIndex        bool
-	enableVerticalCompaction    bool
-	compactions                 prometheus.Counter
-	compactionRunsStarted       prometheus.Counter
-	compactionRunsCompleted     prometheus.Counter
-	compactionFailures          prometheus.Counter
-	verticalCompactions         prometheus.Counter
-	groupGarbageCollectedBlocks prometheus.Counter
-	blocksMarkedForDeletion     prometheus.Counter
+	logger                   log.Logger
+	bkt                      objstore.Bucket
+	key                      string
+	id                       string
+	labels                   labels.Labels
+	resolution               int64
+	mtx                      sync.Mutex
+	blocks                   map[ulid.ULID]*metadata.Meta
+	acceptMalformedIndex     bool
+	enableVerticalCompaction bool
+	metrics                  GroupMetrics
+	opts                     groupOptions
+
+	outOfOrderSeriesReports map[ulid.ULID]block.OutOfOrderSeriesReport
+	stats                   groupRunStats
+
+	// planObserver is called with the estimate of every planned compaction. It is set by BucketCompactor.
+	planObserver func(PlanEstimate)
+	// claims, if set, are verified to still hold the claim of the group before source blocks are marked for deletion. It
+	// is set by BucketCompactor with work stealing.
+	claims *GroupClaims
+	// stolenNoCompactMarks, if set, holds no-compact marks of blocks of other shards, which are skipped in planning. It is
+	// set on groups stolen by WorkStealer.
+	stolenNoCompactMarks *block.NoCompactMarkFilter
+	// planHorizon, if non-zero, is the time past all blocks of the group from which no more blocks come into the group. It
+	// is set by TimeBucketGrouper for groups of closed time buckets.
+	planHorizon int64
+	// stages, if set, bounds and retries stages of compactions of the group. It is set by BucketCompactor.
+	stages *stageRunner
+}
+
+// GroupMetrics are counters updated by a compaction group. DefaultGrouper labels the per group ones with the group ID
+// and shares the counters of deleted blocks among all groups.
+type GroupMetrics struct {
+	Compactions             prometheus.Counter
+	CompactionRunsStarted   prometheus.Counter
+	CompactionRunsCompleted prometheus.Counter
+	CompactionFailures      prometheus.Counter
+	VerticalCompactions     prometheus.Counter
+	GarbageCollectedBlocks  prometheus.Counter
+	BlocksMarkedForDeletion prometheus.Counter
+	// EmptyCompactions counts compactions which yielded no samples, so no block was uploaded.
+	EmptyCompactions prometheus.Counter
 }
 
 // NewGroup returns a new compaction group.
@@ -343,33 +764,25 @@ func NewGroup(
 	resolution int64,
 	acceptMalformedIndex bool,
 	enableVerticalCompaction bool,
-	compactions prometheus.Counter,
-	compactionRunsStarted prometheus.Counter,
-	compactionRunsCompleted prometheus.Counter,
-	compactionFailures prometheus.Counter,
-	verticalCompactions prometheus.Counter,
-	groupGarbageCollectedBlocks prometheus.Counter,
-	blocksMarkedForDeletion prometheus.Counter,
+	metrics GroupMetrics,
+	opts ...GroupOption,
 ) (*Group, error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
 	g := &Group{
-		logger:                      logger,
-		bkt:                         bkt,
-		key:                         key,
-		labels:                      lset,
-		resolution:                  resolution,
-		blocks:                      map[ulid.ULID]*metadata.Meta{},
-		acceptMalformedIndex:        acceptMalformedIndex,
-		enableVerticalCompaction:    enableVerticalCompaction,
-		compactions:                 compactions,
-		compactionRunsStarted:       compactionRunsStarted,
-		compactionRunsCompleted:     compactionRunsCompleted,
-		compactionFailures:          compactionFailures,
-		verticalCompactions:         verticalCompactions,
-		groupGarbageCollectedBlocks: groupGarbageCollectedBlocks,
-		blocksMarkedForDeletion:     blocksMarkedForDeletion,
+		logger:                   logger,
+		bkt:                      bkt,
+		key:                      key,
+		id:                       GroupID(key),
+		labels:                   lset,
+		resolution:               resolution,
+		blocks:                   map[ulid.ULID]*metadata.Meta{},
+		acceptMalformedIndex:     acceptMalformedIndex,
+		enableVerticalCompaction: enableVerticalCompaction,
+		metrics:                  metrics,
+		opts:                     applyGroupOptions(opts),
+		outOfOrderSeriesReports:  map[ulid.ULID]block.OutOfOrderSeriesReport{},
 	}
 	return g, nil
 }
@@ -379,6 +792,11 @@ func (cg *Group) Key() string {
 	return cg.key
 }
 
+// ID returns the short ID of the group, see GroupID.
+func (cg *Group) ID() string {
+	return cg.id
+}
+
 // Add the block with the given meta to the group.
 func (cg *Group) Add(meta *metadata.Meta) error {
 	cg.mtx.Lock()
@@ -446,10 +864,31 @@ func (cg *Group) Resolution() int64 {
 	return cg.resolution
 }
 
+// OutOfOrderSeriesReports returns series with out-of-order chunks dropped from the group's source blocks, by block ID.
+// It is populated only if the group was created with WithSkipOutOfOrderSeries.
+func (cg *Group) OutOfOrderSeriesReports() map[ulid.ULID]block.OutOfOrderSeriesReport {
+	cg.mtx.Lock()
+	defer cg.mtx.Unlock()
+
+	res := make(map[ulid.ULID]block.OutOfOrderSeriesReport, len(cg.outOfOrderSeriesReports))
+	for id, r := range cg.outOfOrderSeriesReports {
+		res[id] = r
+	}
+	return res
+}
+
+// runStats returns the work done by the group since it was created.
+func (cg *Group) runStats() groupRunStats {
+	cg.mtx.Lock()
+	defer cg.mtx.Unlock()
+
+	return cg.stats
+}
+
 // Compact plans and runs a single compaction against the group. The compacted result
 // is uploaded into the bucket the blocks were retrieved from.
 func (cg *Group) Compact(ctx context.Context, dir string, comp tsdb.Compactor) (shouldRerun bool, compID ulid.ULID, rerr error) {
-	cg.compactionRunsStarted.Inc()
+	cg.metrics.CompactionRunsStarted.Inc()
 
 	subDir := filepath.Join(dir, cg.Key())
 
@@ -471,96 +910,13 @@ func (cg *Group) Compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 
 	shouldRerun, compID, err := cg.compact(ctx, subDir, comp)
 	if err != nil {
-		cg.compactionFailures.Inc()
+		cg.metrics.CompactionFailures.Inc()
 		return false, ulid.ULID{}, err
 	}
-	cg.compactionRunsCompleted.Inc()
+	cg.metrics.CompactionRunsCompleted.Inc()
 	return shouldRerun, compID, nil
 }
 
-// Issue347Error is a type wrapper for errors that should invoke repair process for broken block.
-type Issue347Error struct {
-	err error
-
-	id ulid.ULID
-}
-
-func issue347Error(err error, brokenBlock ulid.ULID) Issue347Error {
-	return Issue347Error{err: err, id: brokenBlock}
-}
-
-func (e Issue347Error) Error() string {
-	return e.err.Error()
-}
-
-// IsIssue347Error returns true if the base error is a Issue347Error.
-func IsIssue347Error(err error) bool {
-	_, ok := errors.Cause(err).(Issue347Error)
-	return ok
-}
-
-// HaltError is a type wrapper for errors that should halt any further progress on compactions.
-type HaltError struct {
-	err error
-}
-
-func halt(err error) HaltError {
-	return HaltError{err: err}
-}
-
-func (e HaltError) Error() string {
-	return e.err.Error()
-}
-
-// IsHaltError returns true if the base error is a HaltError.
-// If a multierror is passed, any halt error will return true.
-func IsHaltError(err error) bool {
-	if multiErr, ok := errors.Cause(err).(terrors.MultiError); ok {
-		for _, err := range multiErr {
-			if _, ok := errors.Cause(err).(HaltError); ok {
-				return true
-			}
-		}
-		return false
-	}
-
-	_, ok := errors.Cause(err).(HaltError)
-	return ok
-}
-
-// RetryError is a type wrapper for errors that should trigger warning log and retry whole compaction loop, but aborting
-// current compaction further progress.
-type RetryError struct {
-	err error
-}
-
-func retry(err error) error {
-	if IsHaltError(err) {
-		return err
-	}
-	return RetryError{err: err}
-}
-
-func (e RetryError) Error() string {
-	return e.err.Error()
-}
-
-// IsRetryError returns true if the base error is a RetryError.
-// If a multierror is passed, all errors must be retriable.
-func IsRetryError(err error) bool {
-	if multiErr, ok := errors.Cause(err).(terrors.MultiError); ok {
-		for _, err := range multiErr {
-			if _, ok := errors.Cause(err).(RetryError); !ok {
-				return false
-			}
-		}
-		return true
-	}
-
-	_, ok := errors.Cause(err).(RetryError)
-	return ok
-}
-
 func (cg *Group) areBlocksOverlapping(include *metadata.Meta, excludeDirs ...string) error {
 	var (
 		metas   []tsdb.BlockMeta
@@ -596,9 +952,10 @@ func (cg *Group) areBlocksOverlapping(include *metadata.Meta, excludeDirs ...str
 }
 
 // RepairIssue347 repairs the https://github.com/prometheus/tsdb/issues/347 issue when having issue347Error.
-func RepairIssue347(ctx context.Context, logger log.Logger, bkt objstore.Bucket, blocksMarkedForDeletion prometheus.Counter, issue347Err error) error {
-	ie, ok := errors.Cause(issue347Err).(Issue347Error)
-	if !ok {
+// The broken block is not repaired if the given, optional DeletionGate denies its deletion.
+func RepairIssue347(ctx context.Context, logger log.Logger, bkt objstore.Bucket, blocksMarkedForDeletion prometheus.Counter, gate *DeletionGate, issue347Err error) error {
+	var ie Issue347Error
+	if !errors.As(issue347Err, &ie) {
 		return errors.Errorf("Given error is not an issue347 error: %v", issue347Err)
 	}
 
@@ -625,6 +982,15 @@ func RepairIssue347(ctx context.Context, logger log.Logger, bkt objstore.Bucket,
 		return errors.Wrapf(err, "read meta from %s", bdir)
 	}
 
+	// The repaired block overlaps the broken one, so there is no point in repairing a block which cannot be deleted.
+	ok, err := gate.allow(ctx, meta, RepairedDeletionReason)
+	if err != nil {
+		return retry(err)
+	}
+	if !ok {
+		return errors.Errorf("deletion policy denied deletion of broken block %s; not repairing it", ie.id)
+	}
+
 	resid, err := block.Repair(logger, tmpdir, ie.id, metadata.CompactorRepairSource, block.IgnoreIssue347OutsideChunk)
 	if err != nil {
 		return errors.Wrapf(err, "repair failed for block %s", ie.id)
@@ -637,7 +1003,7 @@ func RepairIssue347(ctx context.Context, logger log.Logger, bkt objstore.Bucket,
 
 	level.Info(logger).Log("msg", "uploading repaired block", "newID", resid)
 	if err = block.Upload(ctx, logger, bkt, filepath.Join(tmpdir, resid.String())); err != nil {
-		return retry(errors.Wrapf(err, "upload of %s failed", resid))
+		return retry(partialUpload(errors.Wrapf(err, "upload of %s failed", resid), resid))
 	}
 
 	level.Info(logger).Log("msg", "deleting broken block", "id", ie.id)
@@ -657,45 +1023,269 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 	cg.mtx.Lock()
 	defer cg.mtx.Unlock()
 
-	// Check for overlapped blocks.
-	overlappingBlocks := false
-	if err := cg.areBlocksOverlapping(nil); err != nil {
-		// TODO(bwplotka): It would really nice if we could still check for other overlaps than replica. In fact this should be checked
-		// in syncer itself. Otherwise with vertical compaction enabled we will sacrifice this important check.
-		if !cg.enableVerticalCompaction {
-			return false, ulid.ULID{}, halt(errors.Wrap(err, "pre compaction overlap check"))
-		}
-
-		overlappingBlocks = true
-	}
-
-	// Planning a compaction works purely based on the meta.json files in our future group's dir.
-	// So we first dump all our memory block metas into the directory.
-	for _, meta := range cg.blocks {
-		bdir := filepath.Join(dir, meta.ULID.String())
-		if err := os.MkdirAll(bdir, 0777); err != nil {
-			return false, ulid.ULID{}, errors.Wrap(err, "create planning block dir")
-		}
-		if err := metadata.Write(cg.logger, bdir, meta); err != nil {
-			return false, ulid.ULID{}, errors.Wrap(err, "write planning meta file")
-		}
+	if err := cg.markTerminalBlocks(ctx); err != nil {
+		return false, ulid.ULID{}, errors.Wrap(err, "mark terminal blocks")
 	}
-
-	// Plan against the written meta.json files.
-	plan, err := comp.Plan(dir)
+	plan, overlappingBlocks, err := cg.plan(dir, comp)
 	if err != nil {
-		return false, ulid.ULID{}, errors.Wrap(err, "plan compaction")
+		return false, ulid.ULID{}, err
 	}
 	if len(plan) == 0 {
 		// Nothing to do.
 		return false, ulid.ULID{}, nil
 	}
 
-	level.Info(cg.logger).Log("msg", "compaction available and planned; downloading blocks", "plan", fmt.Sprintf("%v", plan))
-
-	// Due to #183 we verify that none of the blocks in the plan have overlapping sources.
-	// This is one potential source of how we could end up with duplicated chunks.
-	uniqueSources := map[ulid.ULID]struct{}{}
+	parts := splitPlan(plan, cg.opts.maxBlocksPerCompaction)
+	if len(parts) > 1 {
+		level.Info(cg.logger).Log("msg", "compaction plan exceeds maximum number of blocks per compaction; splitting it",
+			"blocks", len(plan), "max", cg.opts.maxBlocksPerCompaction, "parts", len(parts))
+	}
+	for i, part := range parts {
+		rerun, id, err := cg.compactPlan(ctx, dir, comp, part, overlappingBlocks)
+		if err != nil {
+			return false, ulid.ULID{}, err
+		}
+		shouldRerun = shouldRerun || rerun
+		if id == (ulid.ULID{}) {
+			continue
+		}
+		compID = id
+
+		// Result was already uploaded; free the disk space for the remaining parts.
+		if i < len(parts)-1 {
+			if err := os.RemoveAll(filepath.Join(dir, id.String())); err != nil {
+				return false, ulid.ULID{}, errors.Wrapf(err, "remove compacted block dir %s", id)
+			}
+		}
+	}
+	return shouldRerun, compID, nil
+}
+
+// DryRun plans a single compaction against the group, like Compact does, and logs the compaction it would run, without
+// downloading, compacting, uploading or marking any block.
+func (cg *Group) DryRun(ctx context.Context, dir string, comp tsdb.Compactor) error {
+	cg.mtx.Lock()
+	defer cg.mtx.Unlock()
+
+	subDir := filepath.Join(dir, cg.Key())
+	defer func() {
+		if err := os.RemoveAll(subDir); err != nil {
+			level.Error(cg.logger).Log("msg", "failed to remove compaction group work directory", "path", subDir, "err", err)
+		}
+	}()
+	if err := os.RemoveAll(subDir); err != nil {
+		return errors.Wrap(err, "clean compaction group dir")
+	}
+	if err := os.MkdirAll(subDir, 0777); err != nil {
+		return errors.Wrap(err, "create compaction group dir")
+	}
+
+	plan, overlappingBlocks, err := cg.plan(subDir, comp)
+	if err != nil {
+		return err
+	}
+	if len(plan) == 0 {
+		level.Info(cg.logger).Log("msg", "dry run: nothing to compact")
+		return nil
+	}
+	for _, part := range splitPlan(plan, cg.opts.maxBlocksPerCompaction) {
+		ids := make([]string, 0, len(part))
+		for _, pdir := range part {
+			ids = append(ids, filepath.Base(pdir))
+		}
+		e := cg.estimatePlan(ctx, subDir, part)
+		level.Info(cg.logger).Log("msg", "dry run: would compact blocks, upload the result and mark the source blocks for deletion",
+			"blocks", fmt.Sprintf("%v", ids), "vertical", overlappingBlocks, "estimated_output_bytes", e.OutputBytes, "estimated_output_series", e.OutputSeries)
+	}
+	return nil
+}
+
+// plan returns the next compaction plan of the group, planned by the given compactor against metas of the group's blocks
+// written into dir, and whether the group's blocks overlap.
+func (cg *Group) plan(dir string, comp tsdb.Compactor) (plan []string, overlappingBlocks bool, err error) {
+	// Check for overlapped blocks.
+	if err := cg.areBlocksOverlapping(nil); err != nil {
+		// TODO(bwplotka): It would really nice if we could still check for other overlaps than replica. In fact this should be checked
+		// in syncer itself. Otherwise with vertical compaction enabled we will sacrifice this important check.
+		if !cg.enableVerticalCompaction {
+			return nil, false, halt(errors.Wrap(err, "pre compaction overlap check"))
+		}
+
+		overlappingBlocks = true
+	}
+
+	// Planning a compaction works purely based on the meta.json files in our future group's dir.
+	// So we first dump all our memory block metas into the directory. TSDB reads only metas of the latest known version,
+	// so metas of newer versions are downgraded. Blocks marked for no compaction and blocks of a fresh range still
+	// receiving uploads are left out.
+	fresh := cg.freshBlocks(time.Now())
+	for _, meta := range cg.blocks {
+		if cg.noCompact(meta.ULID) {
+			continue
+		}
+		if _, ok := fresh[meta.ULID]; ok {
+			continue
+		}
+		bdir := filepath.Join(dir, meta.ULID.String())
+		if err := os.MkdirAll(bdir, 0777); err != nil {
+			return nil, false, errors.Wrap(err, "create planning block dir")
+		}
+		if err := metadata.WriteVersion(cg.logger, bdir, meta, metadata.MetaVersionLatest); err != nil {
+			return nil, false, errors.Wrap(err, "write planning meta file")
+		}
+	}
+
+	// The planner leaves the most recent block out of non-vertical compactions, as more blocks may still come next to it.
+	// No more blocks come into a closed time bucket, so the placeholder of a block past the bucket makes its most recent
+	// block compactable too.
+	var placeholder string
+	if cg.planHorizon > 0 && len(cg.blocks) > 0 {
+		var meta metadata.Meta
+		for _, m := range cg.blocks {
+			meta = *m
+			break
+		}
+		meta.ULID = ulid.MustNew(uint64(cg.planHorizon), nil)
+		meta.MinTime, meta.MaxTime = cg.planHorizon, cg.planHorizon+1
+		meta.Compaction = tsdb.BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{meta.ULID}}
+		meta.Stats = tsdb.BlockStats{}
+		placeholder = filepath.Join(dir, meta.ULID.String())
+		if err := os.MkdirAll(placeholder, 0777); err != nil {
+			return nil, false, errors.Wrap(err, "create planning placeholder dir")
+		}
+		if err := metadata.WriteVersion(cg.logger, placeholder, &meta, metadata.MetaVersionLatest); err != nil {
+			return nil, false, errors.Wrap(err, "write planning placeholder meta file")
+		}
+	}
+
+	// Plan against the written meta.json files.
+	plan, err = comp.Plan(dir)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "plan compaction")
+	}
+	if placeholder != "" {
+		if err := os.RemoveAll(placeholder); err != nil {
+			return nil, false, errors.Wrap(err, "remove planning placeholder dir")
+		}
+		for i, p := range plan {
+			if p == placeholder {
+				plan = append(plan[:i], plan[i+1:]...)
+				break
+			}
+		}
+	}
+	return plan, overlappingBlocks, nil
+}
+
+// splitPlan splits given plan into consecutive parts of at most max blocks, balancing their sizes. Zero or negative max
+// means no limit, and max of 1 is treated as 2. A trailing single block part, which is possible only for max of 2, is
+// omitted as compacting it alone would be a no-op; such block is picked up again by the next planning cycle.
+func splitPlan(plan []string, max int) [][]string {
+	if max <= 0 || len(plan) <= max {
+		return [][]string{plan}
+	}
+	if max < 2 {
+		max = 2
+	}
+	numParts := (len(plan) + max - 1) / max
+	parts := make([][]string, 0, numParts)
+	for i := 0; i < numParts; i++ {
+		n := len(plan) / (numParts - i)
+		if len(plan)%(numParts-i) != 0 {
+			n++
+		}
+		if n < 2 {
+			break
+		}
+		parts = append(parts, plan[:n])
+		plan = plan[n:]
+	}
+	return parts
+}
+
+// errExternalMergeUnsupported is returned by compactPlanWith if a source block has to be rewritten on disk, which its
+// index alone does not allow.
+var errExternalMergeUnsupported = errors.New("source block cannot be merged externally")
+
+// compactPlan downloads and verifies blocks of given plan, compacts them, uploads the result and marks the source blocks
+// for deletion. Plans estimated to exceed free space of dir are merged externally, if enabled by WithExternalMerge, and so
+// are plans appending small blocks to a large one, if enabled by WithAppendCompaction.
+func (cg *Group) compactPlan(ctx context.Context, dir string, comp tsdb.Compactor, plan []string, overlappingBlocks bool) (shouldRerun bool, compID ulid.ULID, err error) {
+	e := cg.estimatePlan(ctx, dir, plan)
+
+	external, appending := false, false
+	if cg.opts.externalMerge && !overlappingBlocks && len(cg.opts.seriesRelabelConfig) == 0 {
+		free, err := freeBytes(dir)
+		external = err == nil && uint64(e.DiskBytes()) > free
+	}
+	if !external && cg.opts.appendMinRatio > 0 && !overlappingBlocks && len(cg.opts.seriesRelabelConfig) == 0 {
+		if base := appendBase(cg.planMetas(plan), cg.opts.appendMinRatio); base != nil {
+			level.Info(cg.logger).Log("msg", "appending blocks to large block without rewriting its chunks", "block", base.ULID, "plan", fmt.Sprintf("%v", plan))
+			external, appending = true, true
+		}
+	}
+	shouldRerun, compID, err = cg.compactPlanWith(ctx, dir, comp, plan, overlappingBlocks, external)
+	if errors.Cause(err) != errExternalMergeUnsupported {
+		if err == nil && appending && cg.opts.appendMetrics != nil {
+			cg.opts.appendMetrics.appends.WithLabelValues(cg.id).Inc()
+		}
+		return shouldRerun, compID, err
+	}
+	level.Warn(cg.logger).Log("msg", "plan cannot be merged externally; compacting it on disk", "plan", fmt.Sprintf("%v", plan), "err", err)
+	return cg.compactPlanWith(ctx, dir, comp, plan, overlappingBlocks, false)
+}
+
+// pipelinedUploadInterval is the interval in which chunk segments of compacted blocks are checked for pipelined upload.
+const pipelinedUploadInterval = time.Second
+
+// newBlockID returns the ID of the block compacted by TSDB compactor with the given ID, embedding the creator fingerprint
+// if set by WithCreatorFingerprint.
+func (cg *Group) newBlockID(id ulid.ULID) (ulid.ULID, error) {
+	if cg.opts.ulidEntropy == nil {
+		return id, nil
+	}
+	return ulid.New(id.Time(), cg.opts.ulidEntropy)
+}
+
+// compactPlanWith compacts the plan as described by compactPlan. If external is true, only indexes of the source blocks
+// are downloaded and merged with block.StreamMerge; errExternalMergeUnsupported is returned before anything is
+// uploaded, if that is not possible.
+func (cg *Group) compactPlanWith(ctx context.Context, dir string, comp tsdb.Compactor, plan []string, overlappingBlocks, external bool) (shouldRerun bool, compID ulid.ULID, err error) {
+	level.Info(cg.logger).Log("msg", "compaction available and planned; downloading blocks", "plan", fmt.Sprintf("%v", plan), "external", external)
+
+	usage := cg.opts.resourceUsage.track(cg.id, &cg.stats)
+	defer usage.end()
+
+	// Due to #183 we verify that none of the blocks in the plan have overlapping sources.
+	// This is one potential source of how we could end up with duplicated chunks.
+	uniqueSources := map[ulid.ULID]struct{}{}
+
+	// Deletion intents that cannot be applied during this compaction and have to be carried over to the compacted block.
+	var carriedIntents []metadata.DeletionIntent
+
+	// Metas of source blocks, to track provenance and extensions of the compacted block.
+	sourceMetas := make([]metadata.Thanos, 0, len(plan))
+	sourceBlockMetas := make([]*metadata.Meta, 0, len(plan))
+
+	// Sizes and samples of the source blocks and the compacted block, including chunks streamed by external merge.
+	var totals compactionTotals
+
+	// Chunk segments of the compacted block uploaded while it was written, if enabled by WithPipelinedUpload. They are
+	// deleted from the bucket if the compaction fails before the block upload starts, which cleans up after itself.
+	var (
+		pipelinedID     ulid.ULID
+		pipelinedChunks []string
+		pipelinedBytes  int64
+		uploadStarted   bool
+	)
+	defer func() {
+		if err == nil || len(pipelinedChunks) == 0 || uploadStarted {
+			return
+		}
+		if derr := block.Delete(context.Background(), cg.logger, cg.bkt, pipelinedID); derr != nil {
+			level.Warn(cg.logger).Log("msg", "failed to delete chunks of failed pipelined upload; they are left to partial block cleanup", "block", pipelinedID, "err", derr)
+		}
+	}()
 
 	// Once we have a plan we need to download the actual data.
 	begin := time.Now()
@@ -721,15 +1311,90 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 		if meta.ULID.Compare(id) != 0 {
 			return false, ulid.ULID{}, errors.Errorf("mismatch between meta %s and dir %s", meta.ULID, id)
 		}
+		sourceMetas = append(sourceMetas, meta.Thanos)
+		sourceBlockMetas = append(sourceBlockMetas, meta)
 
-		if err := block.Download(ctx, cg.logger, cg.bkt, id, pdir); err != nil {
-			return false, ulid.ULID{}, retry(errors.Wrapf(err, "download block %s", id))
+		download := func() error {
+			downloadFn := block.Download
+			if external {
+				downloadFn = block.DownloadIndex
+			}
+			if err := cg.stages.run(ctx, StageDownload, IsRetryError, func(ctx context.Context) error {
+				if err := downloadFn(ctx, cg.logger, cg.bkt, id, pdir, cg.opts.downloadOpts...); err != nil {
+					return retry(errors.Wrapf(err, "download block %s", id))
+				}
+				if err := block.VerifyFiles(pdir, cg.downloadedFiles(meta, external), cg.opts.fileHashes); err != nil {
+					return retry(errors.Wrapf(err, "verify downloaded block %s", id))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if orig, ok := cg.blocks[id]; ok && orig.Version > metadata.MetaVersionLatest {
+				// Downloaded meta.json is of a version unknown to TSDB; replace it with the downgraded one used for planning.
+				if err := metadata.Write(cg.logger, pdir, meta); err != nil {
+					return errors.Wrapf(err, "write downgraded meta of block %s", id)
+				}
+			}
+			return nil
+		}
+		if err := download(); err != nil {
+			return false, ulid.ULID{}, err
+		}
+		// Chunks of blocks merged externally are not downloaded, they are streamed from the bucket instead.
+		if !external {
+			if err := cg.handleMissingChunks(ctx, id, pdir, download); err != nil {
+				return false, ulid.ULID{}, err
+			}
+		}
+		size, err := dirSize(pdir)
+		if err != nil {
+			return false, ulid.ULID{}, errors.Wrapf(err, "size of block %s", pdir)
 		}
+		cg.stats.bytesIn += size
+		totals.bytesIn += size
+		totals.samplesIn += meta.Stats.NumSamples
 
 		// Ensure all input blocks are valid.
-		stats, err := block.GatherIndexIssueStats(cg.logger, filepath.Join(pdir, block.IndexFilename), meta.MinTime, meta.MaxTime)
+		gather := func() (block.Stats, error) {
+			stats, err := block.GatherIndexIssueStats(cg.logger, filepath.Join(pdir, block.IndexFilename), meta.MinTime, meta.MaxTime)
+			return stats, errors.Wrapf(err, "gather index issues for block %s", pdir)
+		}
+		stats, err := gather()
 		if err != nil {
-			return false, ulid.ULID{}, errors.Wrapf(err, "gather index issues for block %s", pdir)
+			return false, ulid.ULID{}, err
+		}
+
+		if external && (cg.opts.indexNormalization != nil && needsNormalization(stats) || cg.needsDuplicateSeriesMerge(stats) ||
+			cg.opts.skipOutOfOrderSeries && stats.OutOfOrderSeries > 0) {
+			return false, ulid.ULID{}, errors.Wrapf(errExternalMergeUnsupported, "block %s needs to be rewritten", id)
+		}
+		if stats, err = cg.mergeDuplicateSeries(id, pdir, stats, gather); err != nil {
+			return false, ulid.ULID{}, err
+		}
+		if stats, err = cg.normalizeIndex(id, pdir, stats, gather); err != nil {
+			return false, ulid.ULID{}, err
+		}
+		if err := stats.UnsortedIndexErr(); err != nil {
+			return false, ulid.ULID{}, errors.Wrapf(err, "block id %s, try running with --compact.normalize-index", id)
+		}
+		if err := stats.DuplicateSeriesErr(); err != nil {
+			return false, ulid.ULID{}, errors.Wrapf(err, "block id %s, try running with --compact.merge-duplicate-series", id)
+		}
+
+		if cg.opts.skipOutOfOrderSeries && stats.OutOfOrderSeries > 0 {
+			report, err := block.DropOutOfOrderSeries(cg.logger, pdir)
+			if err != nil {
+				return false, ulid.ULID{}, errors.Wrapf(err, "drop out-of-order series from block %s", pdir)
+			}
+			cg.outOfOrderSeriesReports[id] = report
+			level.Warn(cg.logger).Log("msg", "dropped series with out-of-order chunks from block", "block", id,
+				"series", report.Series, "chunks", report.Chunks, "examples", fmt.Sprintf("%v", report.Examples))
+
+			// Gather stats again to make sure there are no other issues left.
+			if stats, err = gather(); err != nil {
+				return false, ulid.ULID{}, err
+			}
 		}
 
 		if err := stats.CriticalErr(); err != nil {
@@ -742,38 +1407,134 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 
 		if err := stats.PrometheusIssue5372Err(); !cg.acceptMalformedIndex && err != nil {
 			return false, ulid.ULID{}, errors.Wrapf(err,
-				"block id %s, try running with --debug.accept-malformed-index", id)
+				"block id %s, try running with --debug.accept-malformed-index or --compact.normalize-index", id)
+		}
+
+		if len(cg.opts.seriesRelabelConfig) > 0 {
+			modified, err := block.RelabelSeries(cg.logger, pdir, func(lset labels.Labels) labels.Labels {
+				return relabel.Process(lset, cg.opts.seriesRelabelConfig...)
+			})
+			if err != nil {
+				return false, ulid.ULID{}, errors.Wrapf(err, "relabel series of block %s", pdir)
+			}
+			if modified > 0 {
+				level.Info(cg.logger).Log("msg", "relabelled series of block", "block", id, "modified", modified)
+			}
+		}
+
+		if err := cg.handleExternalLabelCollisions(id, pdir, external); err != nil {
+			return false, ulid.ULID{}, err
+		}
+
+		pending, err := metadata.ReadPendingDeletions(ctx, objstore.WithNoopInstr(cg.bkt), cg.logger, id.String())
+		switch {
+		case errors.Cause(err) == metadata.ErrorPendingDeletionsNotFound:
+		case err != nil:
+			return false, ulid.ULID{}, retry(errors.Wrapf(err, "read pending deletions of block %s", id))
+		case cg.resolution != 0:
+			// Samples of downsampled chunks cannot be deleted selectively, keep masking them in the compacted block.
+			carriedIntents = append(carriedIntents, pending.Intents...)
+		case external:
+			return false, ulid.ULID{}, errors.Wrapf(errExternalMergeUnsupported, "block %s has pending deletions", id)
+		default:
+			modified, err := block.DeleteSamples(cg.logger, pdir, pending.Intents)
+			if err != nil {
+				return false, ulid.ULID{}, errors.Wrapf(err, "apply pending deletions to block %s", pdir)
+			}
+			level.Info(cg.logger).Log("msg", "applied pending deletions to block", "block", id, "intents", len(pending.Intents), "modified", modified)
 		}
 	}
 	level.Info(cg.logger).Log("msg", "downloaded and verified blocks; compacting blocks", "plan", fmt.Sprintf("%v", plan), "duration", time.Since(begin))
 
 	begin = time.Now()
 
-	compID, err = comp.Compact(dir, plan, nil)
-	if err != nil {
-		return false, ulid.ULID{}, halt(errors.Wrapf(err, "compact blocks %v", plan))
+	if external {
+		var streamed int64
+		compID, streamed, err = block.StreamMerge(ctx, cg.logger, cg.bkt, dir, plan, cg.opts.ulidEntropy)
+		if errors.Cause(err) == block.ErrULIDCollision {
+			return false, ulid.ULID{}, halt(errors.Wrapf(err, "merge blocks %v externally", plan))
+		}
+		if err != nil {
+			return false, ulid.ULID{}, retry(errors.Wrapf(err, "merge blocks %v externally", plan))
+		}
+		// Streamed chunks pass through the compactor, so they count as both downloaded and uploaded, unless the bucket
+		// copied them on its own.
+		if !objstore.SupportsServerSideCopy(cg.bkt) {
+			cg.stats.bytesIn += streamed
+			cg.stats.bytesOut += streamed
+		}
+		totals.bytesIn += streamed
+		totals.bytesOut += streamed
+	} else {
+		var pipe *block.PipelinedUpload
+		if cg.opts.pipelinedUpload {
+			pipe = block.StartPipelinedUpload(ctx, cg.logger, cg.bkt, dir, pipelinedUploadInterval, cg.newBlockID)
+		}
+		compID, err = cg.stages.compact(func() (ulid.ULID, error) {
+			return comp.Compact(dir, plan, nil)
+		})
+		var pipeErr error
+		if pipe != nil {
+			pipelinedID, pipelinedChunks, pipelinedBytes, pipeErr = pipe.Stop()
+		}
+		if err != nil {
+			return false, ulid.ULID{}, halt(errors.Wrapf(err, "compact blocks %v", plan))
+		}
+		if pipeErr != nil {
+			if errors.Cause(pipeErr) == block.ErrULIDCollision {
+				return false, ulid.ULID{}, halt(errors.Wrapf(pipeErr, "pipelined upload of blocks %v", plan))
+			}
+			return false, ulid.ULID{}, retry(errors.Wrapf(pipeErr, "pipelined upload of blocks %v", plan))
+		}
+		switch {
+		case compID == (ulid.ULID{}):
+		case pipelinedID != (ulid.ULID{}):
+			// Chunks are uploaded under the ID picked once TSDB compactor started writing the block.
+			if pipelinedID != compID {
+				if err := block.ReidentifyAs(cg.logger, dir, compID, pipelinedID); err != nil {
+					return false, ulid.ULID{}, errors.Wrap(err, "reidentify compacted block")
+				}
+				compID = pipelinedID
+			}
+		case cg.opts.ulidEntropy != nil:
+			// TSDB compactor creates random IDs; give the block an ID embedding the creator fingerprint instead.
+			if compID, err = block.Reidentify(cg.logger, dir, compID, cg.opts.ulidEntropy); err != nil {
+				return false, ulid.ULID{}, errors.Wrap(err, "reidentify compacted block")
+			}
+		}
 	}
 	if compID == (ulid.ULID{}) {
-		// Prometheus compactor found that the compacted block would have no samples.
-		level.Info(cg.logger).Log("msg", "compacted block would have no samples, deleting source blocks", "blocks", fmt.Sprintf("%v", plan))
-		for _, block := range plan {
-			meta, err := metadata.Read(block)
+		// Prometheus compactor found that the compacted block would have no samples, e.g. because all series of the
+		// source blocks were deleted. None of the source blocks holds any data to keep, so there is nothing to upload
+		// and all of them can go, the same way as sources of a regular compaction.
+		cg.metrics.EmptyCompactions.Inc()
+		level.Info(cg.logger).Log("msg", "compacted block would have no samples; marking source blocks for deletion without upload",
+			"blocks", fmt.Sprintf("%v", plan), "duration", time.Since(begin))
+		if err := cg.verifyClaim(ctx); err != nil {
+			return false, ulid.ULID{}, err
+		}
+		deleted := make([]ulid.ULID, 0, len(plan))
+		for _, b := range plan {
+			id, marked, err := cg.deleteBlock(ctx, b, metadata.EmptyCompactionResultDeletionReason)
 			if err != nil {
-				level.Warn(cg.logger).Log("msg", "failed to read meta for block", "block", block)
-				continue
+				cg.notifyDeleted(ctx, deleted)
+				return false, ulid.ULID{}, retry(errors.Wrapf(err, "mark source block of empty compaction for deletion from bucket"))
 			}
-			if meta.Stats.NumSamples == 0 {
-				if err := cg.deleteBlock(block); err != nil {
-					level.Warn(cg.logger).Log("msg", "failed to mark for deletion an empty block found during compaction", "block", block)
-				}
+			if !marked {
+				continue
 			}
+			deleted = append(deleted, id)
+			cg.metrics.GarbageCollectedBlocks.Inc()
 		}
-		// Even though this block was empty, there may be more work to do.
-		return true, ulid.ULID{}, nil
+		cg.notifyDeleted(ctx, deleted)
+		// Even though this block was empty, there may be more work to do. Unless deletion of some source blocks was
+		// denied, as the same compaction would be planned again right away.
+		return len(deleted) == len(plan), ulid.ULID{}, nil
 	}
-	cg.compactions.Inc()
+	cg.metrics.Compactions.Inc()
+	cg.stats.compactions++
 	if overlappingBlocks {
-		cg.verticalCompactions.Inc()
+		cg.metrics.VerticalCompactions.Inc()
 	}
 	level.Info(cg.logger).Log("msg", "compacted blocks", "new", compID,
 		"blocks", fmt.Sprintf("%v", plan), "duration", time.Since(begin), "overlapping_blocks", overlappingBlocks)
@@ -781,10 +1542,16 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 	bdir := filepath.Join(dir, compID.String())
 	index := filepath.Join(bdir, block.IndexFilename)
 
+	extensions, err := cg.enrichMeta(sourceBlockMetas)
+	if err != nil {
+		return false, ulid.ULID{}, err
+	}
 	newMeta, err := metadata.InjectThanos(cg.logger, bdir, metadata.Thanos{
 		Labels:     cg.labels.Map(),
 		Downsample: metadata.ThanosDownsample{Resolution: cg.resolution},
 		Source:     metadata.CompactorSource,
+		Provenance: metadata.MergeProvenance(sourceMetas...),
+		Extensions: extensions,
 	}, nil)
 	if err != nil {
 		return false, ulid.ULID{}, errors.Wrapf(err, "failed to finalize the block %s", bdir)
@@ -807,44 +1574,155 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 		}
 	}
 
+	if err := cg.checkOutput(ctx, plan, newMeta, overlappingBlocks); err != nil {
+		return false, ulid.ULID{}, err
+	}
+
+	if cg.opts.seriesFilterFPRate > 0 {
+		filterBegin := time.Now()
+		if _, err := block.WriteSeriesFilter(bdir, cg.opts.seriesFilterFPRate); err != nil {
+			return false, ulid.ULID{}, errors.Wrapf(err, "write series filter of %s", compID)
+		}
+		level.Debug(cg.logger).Log("msg", "wrote series filter", "result_block", compID, "duration", time.Since(filterBegin))
+	}
+
 	begin = time.Now()
 
-	if err := block.Upload(ctx, cg.logger, cg.bkt, bdir); err != nil {
-		return false, ulid.ULID{}, retry(errors.Wrapf(err, "upload of %s failed", compID))
+	if len(carriedIntents) > 0 {
+		// Upload before the block, so it's never visible without the intents.
+		if err := block.UploadPendingDeletions(ctx, cg.bkt, metadata.PendingDeletions{
+			ID:      compID,
+			Intents: carriedIntents,
+			Version: metadata.PendingDeletionsVersion1,
+		}); err != nil {
+			return false, ulid.ULID{}, retry(errors.Wrapf(err, "carry over pending deletions to %s", compID))
+		}
+	}
+
+	usage.observeDisk(dir)
+	size, err := dirSize(bdir)
+	if err != nil {
+		return false, ulid.ULID{}, errors.Wrapf(err, "size of block %s", bdir)
+	}
+	size += pipelinedBytes
+	uploadStarted = true
+	// Failed uploads clean up after themselves, which includes chunks uploaded while the block was written, so only
+	// uploads of whole blocks can be retried.
+	uploadRetriable := func(err error) bool {
+		return len(pipelinedChunks) == 0 && errors.Cause(err) != block.ErrULIDCollision
 	}
+	if err := cg.stages.run(ctx, StageUpload, uploadRetriable, func(ctx context.Context) error {
+		return block.Upload(ctx, cg.logger, cg.bkt, bdir, block.WithCompressedMeta(cg.opts.compressedMeta), block.WithDebugMetaPrefix(cg.opts.debugMetaPrefix),
+			block.WithUploadedChunks(pipelinedChunks), block.WithFileHashes(cg.opts.fileHashes), block.WithCollisionCheck())
+	}); err != nil {
+		if errors.Cause(err) == block.ErrULIDCollision {
+			// Nothing was uploaded; the block in the bucket is not ours to clean up or overwrite.
+			return false, ulid.ULID{}, halt(errors.Wrapf(err, "upload of %s failed", compID))
+		}
+		return false, ulid.ULID{}, retry(partialUpload(errors.Wrapf(err, "upload of %s failed", compID), compID))
+	}
+	cg.stats.bytesOut += size
 	level.Info(cg.logger).Log("msg", "uploaded block", "result_block", compID, "duration", time.Since(begin))
 
+	totals.bytesOut += size
+	totals.samplesOut = newMeta.Stats.NumSamples
+	cg.opts.compactionRatios.observe(cg.id, cg.resolution, totals)
+	cg.opts.churnStats.observe(cg.key, plan, bdir)
+	if totals.inflated() {
+		level.Warn(cg.logger).Log("msg", "compacted block is larger than its source blocks", "result_block", compID,
+			"input_bytes", totals.bytesIn, "output_bytes", totals.bytesOut, "input_samples", totals.samplesIn, "output_samples", totals.samplesOut)
+	}
+	cg.notifyAdded(ctx, newMeta)
+
+	// Another compactor which took over the claim may be compacting the same blocks; the block with the same sources
+	// uploaded by either of them is filtered as a duplicate, as long as the sources are not deleted.
+	if err := cg.verifyClaim(ctx); err != nil {
+		return false, ulid.ULID{}, err
+	}
+
 	// Mark for deletion the blocks we just compacted from the group and bucket so they do not get included
 	// into the next planning cycle.
 	// Eventually the block we just uploaded should get synced into the group again (including sync-delay).
+	deleted := make([]ulid.ULID, 0, len(plan))
 	for _, b := range plan {
-		if err := cg.deleteBlock(b); err != nil {
+		id, marked, err := cg.deleteBlock(ctx, b, "")
+		if err != nil {
+			cg.notifyDeleted(ctx, deleted)
 			return false, ulid.ULID{}, retry(errors.Wrapf(err, "mark old block for deletion from bucket"))
 		}
-		cg.groupGarbageCollectedBlocks.Inc()
+		if !marked {
+			continue
+		}
+		deleted = append(deleted, id)
+		cg.metrics.GarbageCollectedBlocks.Inc()
 	}
+	cg.notifyDeleted(ctx, deleted)
 
 	return true, compID, nil
 }
 
-func (cg *Group) deleteBlock(b string) error {
+// deleteBlock removes the local copy of the given source block and marks it for deletion in the bucket with the given,
+// optional reason. It returns ID of the block and whether it was marked, as the group's DeletionGate may deny it, sources
+// of compactions are not marked within the compacted sources grace period and blocks placed under hold since the sync
+// are not marked at all.
+func (cg *Group) deleteBlock(ctx context.Context, b string, reason metadata.DeletionReason) (ulid.ULID, bool, error) {
 	id, err := ulid.Parse(filepath.Base(b))
 	if err != nil {
-		return errors.Wrapf(err, "plan dir %s", b)
+		return id, false, errors.Wrapf(err, "plan dir %s", b)
+	}
+
+	meta, ok := cg.blocks[id]
+	if !ok {
+		if meta, err = metadata.Read(b); err != nil {
+			return id, false, errors.Wrapf(err, "read meta of old block %s", id)
+		}
 	}
 
 	if err := os.RemoveAll(b); err != nil {
-		return errors.Wrapf(err, "remove old block dir %s", id)
+		return id, false, errors.Wrapf(err, "remove old block dir %s", id)
+	}
+
+	policyReason := reason
+	if policyReason == "" {
+		policyReason = CompactedDeletionReason
+	}
+	if reason == "" && cg.opts.sourcesGracePeriod > 0 {
+		level.Info(cg.logger).Log("msg", "keeping compacted block for grace period; it is left to garbage collection", "old_block", id, "grace_period", cg.opts.sourcesGracePeriod)
+		return id, false, nil
+	}
+	if ok, err := cg.opts.deletionGate.allow(ctx, meta, policyReason); err != nil || !ok {
+		return id, false, err
 	}
 
 	// Spawn a new context so we always mark a block for deletion in full on shutdown.
 	delCtx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
 	level.Info(cg.logger).Log("msg", "marking compacted block for deletion", "old_block", id)
-	if err := block.MarkForDeletion(delCtx, cg.logger, cg.bkt, id, cg.blocksMarkedForDeletion); err != nil {
-		return errors.Wrapf(err, "mark block %s for deletion from bucket", id)
+	err = block.MarkForDeletionWithReason(delCtx, cg.logger, cg.bkt, id, reason, cg.metrics.BlocksMarkedForDeletion)
+	if errors.Cause(err) == block.ErrBlockUnderHold {
+		level.Info(cg.logger).Log("msg", "not marking compacted block for deletion, as it is under hold", "old_block", id)
+		return id, false, nil
 	}
-	return nil
+	if err != nil {
+		return id, false, errors.Wrapf(err, "mark block %s for deletion from bucket", id)
+	}
+	cg.stats.blocksMarkedForDeletion++
+	return id, true, nil
+}
+
+// downloadedFiles returns files listed in the given meta of a source block which are downloaded for compaction: only its
+// index if merged externally. Chunk segments are left to checks of missing chunks, if configured, which handle
+// missing and truncated segments of the bucket instead of failing every download.
+func (cg *Group) downloadedFiles(meta *metadata.Meta, external bool) []metadata.File {
+	files := make([]metadata.File, 0, len(meta.Thanos.Files))
+	for _, f := range meta.Thanos.Files {
+		isChunk := path.Dir(f.RelPath) == block.ChunksDirname
+		if external && f.RelPath != block.IndexFilename || isChunk && cg.opts.missingChunks != "" {
+			continue
+		}
+		files = append(files, f)
+	}
+	return files
 }
 
 // BucketCompactor compacts blocks in a bucket.
@@ -853,9 +1731,30 @@ type BucketCompactor struct {
 	sy          *Syncer
 	grouper     Grouper
 	comp        tsdb.Compactor
-	compactDir  string
+	compactDirs *workDirs
 	bkt         objstore.Bucket
-	concurrency int
+	concurrency atomic.Int64
+	status      *statusTracker
+	summary     *runSummaryRecorder
+	jobs        *jobTracker
+	onDemand    *onDemandTracker
+	heat        HeatProvider
+	dryRun      bool
+	backlogSLO  *BacklogSLO
+	memGovernor *MemoryGovernor
+	errBudget   *GroupErrorBudget
+	sizeClasses *SizeClassLimiter
+	profiles    *ProfileCapturer
+	slowGroup   time.Duration
+	profHalts   bool
+	skipGC      bool
+	stealing    *WorkStealer
+	deadline    *CycleDeadline
+	stages      *stageRunner
+	groups      *GroupDirectory
+
+	// runMtx serializes regular and on-demand compaction runs.
+	runMtx sync.Mutex
 }
 
 // NewBucketCompactor creates a new bucket compactor.
@@ -867,52 +1766,216 @@ func NewBucketCompactor(
 	compactDir string,
 	bkt objstore.Bucket,
 	concurrency int,
+	opts ...BucketCompactorOption,
 ) (*BucketCompactor, error) {
 	if concurrency <= 0 {
 		return nil, errors.Errorf("invalid concurrency level (%d), concurrency level must be > 0", concurrency)
 	}
-	return &BucketCompactor{
+	o := applyBucketCompactorOptions(opts)
+	compactDirs := []string{compactDir}
+	if len(o.compactDirs) > 0 {
+		compactDirs = o.compactDirs
+	}
+	heat := o.heat
+	if heat == nil {
+		heat = NoopHeatProvider{}
+	}
+	var stages *stageRunner
+	if o.stages != nil {
+		if err := o.stages.Validate(); err != nil {
+			return nil, errors.Wrap(err, "invalid stage policies")
+		}
+		stages = newStageRunner(logger, o.reg, *o.stages)
+	}
+	// Dry run covers changes done by the Syncer as part of the compaction cycle as well.
+	sy.dryRun = o.dryRun
+	c := &BucketCompactor{
 		logger:      logger,
 		sy:          sy,
 		grouper:     grouper,
 		comp:        comp,
-		compactDir:  compactDir,
+		compactDirs: newWorkDirs(logger, o.reg, compactDirs),
 		bkt:         bkt,
-		concurrency: concurrency,
-	}, nil
+		status:      newStatusTracker(),
+		summary:     newRunSummaryRecorder(logger, o.reg),
+		jobs:        newJobTracker(),
+		onDemand:    newOnDemandTracker(),
+		heat:        heat,
+		dryRun:      o.dryRun,
+		backlogSLO:  o.backlogSLO,
+		memGovernor: o.memGovernor,
+		errBudget:   o.errBudget,
+		sizeClasses: o.sizeClasses,
+		profiles:    o.profiles,
+		slowGroup:   o.slowGroup,
+		profHalts:   o.profHalts,
+		skipGC:      o.skipGC,
+		stealing:    o.stealing,
+		deadline:    o.deadline,
+		stages:      stages,
+		groups:      NewGroupDirectory(),
+	}
+	c.concurrency.Store(int64(concurrency))
+	return c, nil
+}
+
+// Status returns the summary of the past compaction runs, including per group outcomes, halt state, recent on-demand
+// compaction jobs and blocks whose meta.json failed to load on the last sync.
+func (c *BucketCompactor) Status() Status {
+	s := c.status.get()
+	s.OnDemandJobs = c.onDemand.list()
+	for id, err := range c.sy.Pending() {
+		s.PendingBlocks = append(s.PendingBlocks, PendingBlock{ID: id, Error: err.Error()})
+	}
+	sort.Slice(s.PendingBlocks, func(i, j int) bool { return s.PendingBlocks[i].ID.Compare(s.PendingBlocks[j].ID) < 0 })
+	return s
+}
+
+// skipPending returns the given groups without those which may contain blocks whose meta.json failed to load on the
+// last sync.
+func (c *BucketCompactor) skipPending(groups []*Group) []*Group {
+	snapshot := c.sy.Snapshot()
+	if len(snapshot.Pending) == 0 {
+		return groups
+	}
+	res := make([]*Group, 0, len(groups))
+	for _, g := range groups {
+		if snapshot.mayContainPending(g) {
+			level.Warn(c.logger).Log("msg", "skipping compaction of group which may contain blocks whose meta.json failed to load", "group", g.Key(), "pending", len(snapshot.Pending))
+			continue
+		}
+		res = append(res, g)
+	}
+	return res
+}
+
+// CoverageReport returns the last coverage report of the Syncer, if it verifies coverage.
+func (c *BucketCompactor) CoverageReport() (CoverageReport, bool) {
+	if c.sy.coverage == nil {
+		return CoverageReport{}, false
+	}
+	return c.sy.coverage.Report(), true
+}
+
+// SubscribeJobEvents returns channel receiving events of compaction jobs from now on, until unsubscribe is called.
+// The channel is closed once unsubscribed, also when the subscriber does not keep up with events.
+func (c *BucketCompactor) SubscribeJobEvents() (events <-chan JobEvent, unsubscribe func()) {
+	return c.jobs.subscribe()
+}
+
+// SetConcurrency sets the number of groups compacted concurrently, applied from the next compaction iteration on.
+func (c *BucketCompactor) SetConcurrency(concurrency int) error {
+	if concurrency <= 0 {
+		return errors.Errorf("invalid concurrency level (%d), concurrency level must be > 0", concurrency)
+	}
+	c.concurrency.Store(int64(concurrency))
+	return nil
+}
+
+// Groups returns all groups seen by compaction runs, sorted by ID.
+func (c *BucketCompactor) Groups() []GroupInfo {
+	return c.groups.List()
+}
+
+// ResolveGroup returns the group of the given short ID, if seen by compaction runs, see GroupID.
+func (c *BucketCompactor) ResolveGroup(id string) (GroupInfo, bool) {
+	return c.groups.Resolve(id)
+}
+
+// Queue returns groups of the ongoing compaction iteration that are running or waiting to be compacted, in the order
+// they are picked up.
+func (c *BucketCompactor) Queue() []QueuedGroup {
+	return c.jobs.queued()
+}
+
+// Prioritize makes the group with the given key compacted before other groups, starting with the next compaction
+// iteration, until it has nothing left to compact or its compaction fails.
+func (c *BucketCompactor) Prioritize(groupKey string) {
+	c.jobs.prioritize(groupKey)
 }
 
 // Compact runs compaction over bucket.
+// Compaction finishes with an iteration that compacted nothing, so once Compact succeeds, the snapshot of its Syncer is
+// up to date and can be reused (e.g. by downsampling and retention) without syncing metas again.
 func (c *BucketCompactor) Compact(ctx context.Context) (rerr error) {
+	c.runMtx.Lock()
+	defer c.runMtx.Unlock()
+
+	c.status.runStarted()
+	c.summary.runStarted()
+	defer func() {
+		c.status.setLastRunSummary(c.summary.runFinished(rerr))
+		c.status.runFinished(rerr)
+	}()
 	defer func() {
 		if IsHaltError(rerr) {
 			return
 		}
-		if err := os.RemoveAll(c.compactDir); err != nil {
-			level.Error(c.logger).Log("msg", "failed to remove compaction work directory", "path", c.compactDir, "err", err)
+		if err := c.compactDirs.removeAll(); err != nil {
+			level.Error(c.logger).Log("msg", "failed to remove compaction work directory", "err", err)
 		}
 	}()
 
+	// Keys of groups of blocks synced by the Syncer, which are never stolen from other shards.
+	own := map[string]struct{}{}
+
+	// With a deadline, no group compactions are started once its soft deadline passes, and compactions still running
+	// are cancelled once its hard deadline passes, if any.
+	var (
+		softDeadline <-chan time.Time
+		softExceeded bool
+		cycleCtx     = ctx
+	)
+	if c.deadline != nil {
+		var cancel context.CancelFunc
+		softDeadline, cycleCtx, cancel = c.deadline.start(ctx)
+		defer cancel()
+	}
+	deadlineExceeded := func() bool {
+		select {
+		case <-softDeadline:
+			softExceeded = true
+		default:
+		}
+		return softExceeded
+	}
+
 	// Loop over bucket and compact until there's no work left.
-	for {
+	for iteration := 0; ; iteration++ {
 		var (
 			wg                     sync.WaitGroup
-			workCtx, workCtxCancel = context.WithCancel(ctx)
+			workCtx, workCtxCancel = context.WithCancel(cycleCtx)
 			groupChan              = make(chan *Group)
-			errChan                = make(chan error, c.concurrency)
+			concurrency            = int(c.concurrency.Load())
+			errChan                = make(chan error, concurrency)
 			finishedAllGroups      = true
 			mtx                    sync.Mutex
+			// Keys of groups whose compaction was cancelled by the hard deadline, and of groups not started as the soft
+			// deadline passed, carried over to the next cycle in this order.
+			interrupted, carried []string
 		)
 		defer workCtxCancel()
+		// interrupt carries the given group over to the next cycle and returns true, if it failed because the hard
+		// deadline passed.
+		interrupt := func(g *Group) bool {
+			if c.deadline == nil || ctx.Err() != nil || cycleCtx.Err() == nil {
+				return false
+			}
+			mtx.Lock()
+			interrupted = append(interrupted, g.Key())
+			mtx.Unlock()
+			return true
+		}
 
 		// Set up workers who will compact the groups when the groups are ready.
 		// They will compact available groups until they encounter an error, after which they will stop.
-		for i := 0; i < c.concurrency; i++ {
+		for i := 0; i < concurrency; i++ {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
 				for g := range groupChan {
-					shouldRerunGroup, _, err := g.Compact(workCtx, c.compactDir, c.comp)
+					_, shouldRerunGroup, _, err := c.compactGroup(workCtx, g)
+					c.sizeClasses.release(g)
 					if err == nil {
 						if shouldRerunGroup {
 							mtx.Lock()
@@ -921,58 +1984,113 @@ func (c *BucketCompactor) Compact(ctx context.Context) (rerr error) {
 						}
 						continue
 					}
-
-					if IsIssue347Error(err) {
-						if err := RepairIssue347(workCtx, c.logger, c.bkt, c.sy.metrics.blocksMarkedForDeletion, err); err == nil {
-							mtx.Lock()
-							finishedAllGroups = false
-							mtx.Unlock()
-							continue
-						}
+					if interrupt(g) {
+						continue
 					}
-					errChan <- errors.Wrapf(err, "group %s", g.Key())
+					errChan <- err
 					return
 				}
 			}()
 		}
 
 		// Clean up the compaction temporary directory at the beginning of every compaction loop.
-		if err := os.RemoveAll(c.compactDir); err != nil {
+		if err := c.compactDirs.removeAll(); err != nil {
 			return errors.Wrap(err, "clean up the compaction temporary directory")
 		}
 
+		c.summary.update(func(s *RunSummary) { s.Iterations++ })
+
 		level.Info(c.logger).Log("msg", "start sync of metas")
-		if err := c.sy.SyncMetas(ctx); err != nil {
+		begin := time.Now()
+		err := c.sy.SyncMetas(ctx)
+		c.summary.update(func(s *RunSummary) { s.SyncDuration += time.Since(begin) })
+		if err != nil {
 			return errors.Wrap(err, "sync")
 		}
 
-		level.Info(c.logger).Log("msg", "start of GC")
-		// Blocks that were compacted are garbage collected after each Compaction.
-		// However if compactor crashes we need to resolve those on startup.
-		if err := c.sy.GarbageCollect(ctx); err != nil {
-			return errors.Wrap(err, "garbage")
+		if !c.skipGC {
+			level.Info(c.logger).Log("msg", "start of GC")
+			// Blocks that were compacted are garbage collected after each Compaction.
+			// However if compactor crashes we need to resolve those on startup.
+			begin, synced := time.Now(), len(c.sy.Metas())
+			err = c.sy.GarbageCollect(ctx)
+			// Syncer forgets blocks as soon as they are marked for deletion.
+			collected := synced - len(c.sy.Metas())
+			c.summary.update(func(s *RunSummary) {
+				s.GarbageCollectDuration += time.Since(begin)
+				s.BlocksMarkedForDeletion += collected
+			})
+			if err != nil {
+				return errors.Wrap(err, "garbage")
+			}
+		}
+
+		if iteration == 0 && c.backlogSLO != nil {
+			c.backlogSLO.observeBacklog(time.Now(), c.sy.Metas())
 		}
 
 		groups, err := c.grouper.Groups(c.sy.Metas())
 		if err != nil {
 			return errors.Wrap(err, "build compaction groups")
 		}
+		c.groups.add(groups...)
+		c.status.groupsBuilt(groups)
+		for _, g := range groups {
+			own[g.Key()] = struct{}{}
+		}
+		groups = c.skipPending(groups)
+		// Hot groups go first, though groups prioritized through the jobs API still go before them.
+		if c.errBudget != nil {
+			groups = c.errBudget.filter(groups)
+		}
+		sortByHeat(ctx, c.logger, c.heat, groups)
+		if c.deadline != nil {
+			groups = c.deadline.prioritize(groups)
+		}
+		groups = c.jobs.enqueue(groups)
 
 		level.Info(c.logger).Log("msg", "start of compactions")
+		begin = time.Now()
 
 		// Send all groups found during this pass to the compaction workers.
 		var groupErrs terrors.MultiError
 	groupLoop:
-		for _, g := range groups {
+		for pending := groups; len(pending) > 0; {
+			if deadlineExceeded() {
+				for _, g := range pending {
+					carried = append(carried, g.Key())
+				}
+				break
+			}
+			var g *Group
+			if g, pending = c.sizeClasses.take(pending); g == nil {
+				// All remaining groups are of size classes at their concurrency limits.
+				select {
+				case groupErr := <-errChan:
+					groupErrs.Add(groupErr)
+					break groupLoop
+				case <-c.sizeClasses.wait():
+				case <-softDeadline:
+					softExceeded = true
+				}
+				continue
+			}
 			select {
 			case groupErr := <-errChan:
+				c.sizeClasses.release(g)
 				groupErrs.Add(groupErr)
 				break groupLoop
 			case groupChan <- g:
+			case <-softDeadline:
+				softExceeded = true
+				c.sizeClasses.release(g)
+				pending = append([]*Group{g}, pending...)
 			}
 		}
 		close(groupChan)
 		wg.Wait()
+		c.jobs.iterationFinished()
+		c.summary.update(func(s *RunSummary) { s.CompactDuration += time.Since(begin) })
 
 		// Collect any other error reported by the workers, or any error reported
 		// while we were waiting for the last batch of groups to run the compaction.
@@ -982,14 +2100,99 @@ func (c *BucketCompactor) Compact(ctx context.Context) (rerr error) {
 		}
 
 		workCtxCancel()
+		if c.deadline != nil && deadlineExceeded() {
+			keys := append(interrupted, carried...)
+			c.deadline.observeExceeded(cycleCtx.Err() != nil && ctx.Err() == nil, len(keys))
+			if err := c.deadline.carryOver(keys); err != nil {
+				groupErrs.Add(errors.Wrap(err, "carry over groups"))
+			}
+			if len(groupErrs) > 0 {
+				return groupErrs
+			}
+			// The cycle ends here, but its Syncer snapshot is kept up to date, as after any successful cycle.
+			if err := c.sy.SyncMetas(ctx); err != nil {
+				return errors.Wrap(err, "sync")
+			}
+			return nil
+		}
 		if len(groupErrs) > 0 {
 			return groupErrs
 		}
+		if c.deadline != nil {
+			// All groups were attended to within the deadline.
+			if err := c.deadline.carryOver(nil); err != nil {
+				return errors.Wrap(err, "clear groups carried over")
+			}
+		}
 
 		if finishedAllGroups {
 			break
 		}
 	}
 	level.Info(c.logger).Log("msg", "compaction iterations done")
-	return nil
+	return c.steal(ctx, own)
+}
+
+// compactGroup claims the given group and compacts it once, updating jobs, status and run summary with the result. It
+// returns false for claimed, without compacting the group, if another compactor holds its claim. Returned errors are
+// wrapped with the group key.
+func (c *BucketCompactor) compactGroup(ctx context.Context, g *Group) (claimed, shouldRerun bool, compID ulid.ULID, err error) {
+	claimed, err = c.claimGroup(ctx, g)
+	if err != nil {
+		return false, false, ulid.ULID{}, errors.Wrapf(err, "claim group %s", g.Key())
+	}
+	if !claimed {
+		level.Info(c.logger).Log("msg", "group is claimed by another compactor; skipping it", "group_id", g.ID())
+		return false, false, ulid.ULID{}, nil
+	}
+	release := func() {}
+	if c.memGovernor != nil {
+		if release, err = c.memGovernor.acquire(ctx); err != nil {
+			c.releaseGroup(ctx, g)
+			return true, false, ulid.ULID{}, errors.Wrapf(err, "group %s", g.Key())
+		}
+	}
+	key := g.Key()
+	prof := c.profileGroup(ctx, key)
+	g.stages = c.stages
+	g.planObserver = func(e PlanEstimate) {
+		c.jobs.planned(key, e)
+		prof.planned(e)
+	}
+	c.jobs.started(key)
+	dir, releaseDir := c.compactDirs.pick(g.estimatedDiskBytes())
+	if c.dryRun {
+		err = g.DryRun(ctx, dir, c.comp)
+	} else {
+		shouldRerun, compID, err = g.Compact(ctx, dir, c.comp)
+	}
+	releaseDir()
+	release()
+	c.releaseGroup(ctx, g)
+	if errors.Cause(err) == ErrGroupClaimLost {
+		level.Warn(c.logger).Log("msg", "lost claim of group; its source blocks were not marked for deletion", "group_id", g.ID(), "err", err)
+		err = nil
+	}
+	c.jobs.finished(key, shouldRerun, compID, err)
+	c.status.groupFinished(key, err)
+	c.status.outOfOrderSeriesDropped(key, g.OutOfOrderSeriesReports())
+	stats := g.runStats()
+	c.summary.update(func(s *RunSummary) { s.addGroup(stats) })
+	if c.backlogSLO != nil {
+		c.backlogSLO.observeCompacted(time.Now(), g.Resolution(), stats.blocksMarkedForDeletion)
+	}
+	if err != nil && IsIssue347Error(err) {
+		if rerr := RepairIssue347(ctx, c.logger, c.bkt, c.sy.metrics.blocksMarkedForDeletion, c.sy.deletionGate, err); rerr == nil {
+			err = nil
+			shouldRerun = true
+		}
+	}
+	prof.finished(err)
+	if c.errBudget != nil && ctx.Err() == nil {
+		c.errBudget.observe(key, err)
+	}
+	if err != nil {
+		return true, shouldRerun, compID, errors.Wrapf(err, "group %s", key)
+	}
+	return true, shouldRerun, compID, nil
 }
@@ -25,6 +25,7 @@ import (
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/model"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/objtesting"
 	"github.com/thanos-io/thanos/pkg/testutil"
@@ -103,8 +104,23 @@ func TestSyncer_GarbageCollect_e2e(t *testing.T) {
 
 		// Do one initial synchronization with the bucket.
 		testutil.Ok(t, sy.SyncMetas(ctx))
+		synced := sy.Snapshot()
 		testutil.Ok(t, sy.GarbageCollect(ctx))
 
+		// Garbage collection derives a new snapshot, leaving the synced one intact.
+		collected := sy.Snapshot()
+		testutil.Equals(t, uint64(1), synced.Version)
+		testutil.Equals(t, uint64(2), collected.Version)
+		testutil.Equals(t, synced.SyncTime, collected.SyncTime)
+		testutil.Equals(t, synced.Metas, collected.Metas)
+		testutil.Equals(t, 11, len(synced.DuplicateIDs))
+		testutil.Equals(t, 0, len(synced.DeletionMarks))
+		testutil.Equals(t, 11, len(collected.DeletionMarks))
+		for _, id := range synced.DuplicateIDs {
+			_, ok := collected.DeletionMarks[id]
+			testutil.Assert(t, ok, "expected deletion mark of garbage collected block %s", id)
+		}
+
 		var rem []ulid.ULID
 		err = bkt.Iter(ctx, "", func(n string) error {
 			id := ulid.MustParse(n[:len(n)-1])
@@ -130,6 +146,7 @@ func TestSyncer_GarbageCollect_e2e(t *testing.T) {
 
 		// After another sync the changes should also be reflected in the local groups.
 		testutil.Ok(t, sy.SyncMetas(ctx))
+		testutil.Equals(t, uint64(3), sy.Snapshot().Version)
 		testutil.Ok(t, sy.GarbageCollect(ctx))
 
 		// Only the level 3 block, the last source block in both resolutions should be left.
@@ -144,6 +161,179 @@ func TestSyncer_GarbageCollect_e2e(t *testing.T) {
 	})
 }
 
+func TestSyncer_GarbageCollect_DuplicatesGracePeriod(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+
+	newMeta := func(id ulid.ULID, sources ...ulid.ULID) *metadata.Meta {
+		m := &metadata.Meta{}
+		m.Version = 1
+		m.ULID = id
+		m.Compaction.Level = 1
+		m.Compaction.Sources = []ulid.ULID{id}
+		if len(sources) > 0 {
+			m.Compaction.Level = 2
+			m.Compaction.Sources = sources
+		}
+		return m
+	}
+	now := ulid.Timestamp(time.Now())
+	var src []ulid.ULID
+	for i := uint64(1); i <= 6; i++ {
+		src = append(src, ulid.MustNew(i, nil))
+	}
+	// Recently compacted block is within grace period, and so is the block whose slow compaction started before it, as
+	// its meta.json was uploaded recently. The old one is not.
+	recent := ulid.MustNew(now, nil)
+	slow := ulid.MustNew(now-uint64(2*time.Hour/time.Millisecond), nil)
+	old := ulid.MustNew(now-uint64(2*time.Hour/time.Millisecond)+1, nil)
+
+	for _, m := range []*metadata.Meta{
+		newMeta(src[0]), newMeta(src[1]), newMeta(src[2]), newMeta(src[3]), newMeta(src[4]), newMeta(src[5]),
+		newMeta(recent, src[:2]...), newMeta(slow, src[2:4]...), newMeta(old, src[4:]...),
+	} {
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(m))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(m.ULID.String(), metadata.MetaFilename), &buf))
+	}
+	uploadedBkt := modifiedTimeBucket{InstrumentedBucket: bkt, modified: map[string]time.Time{
+		path.Join(old.String(), metadata.MetaFilename): time.Now().Add(-2 * time.Hour),
+	}}
+
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, []block.MetadataFilter{duplicateBlocksFilter}, nil)
+	testutil.Ok(t, err)
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	garbageCollectedBlocks := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(nil, nil, 48*time.Hour)
+	sy, err := NewSyncer(nil, nil, uploadedBkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks, 1, WithDuplicatesGracePeriod(time.Hour))
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, sy.SyncMetas(ctx))
+	testutil.Ok(t, sy.GarbageCollect(ctx))
+
+	for i, id := range src {
+		exists, err := bkt.Exists(ctx, path.Join(id.String(), metadata.DeletionMarkFilename))
+		testutil.Ok(t, err)
+		testutil.Equals(t, i >= 4, exists)
+	}
+	testutil.Equals(t, 2.0, promtest.ToFloat64(garbageCollectedBlocks))
+}
+
+// modifiedTimeBucket overrides modification times of the given objects.
+type modifiedTimeBucket struct {
+	objstore.InstrumentedBucket
+	modified map[string]time.Time
+}
+
+func (b modifiedTimeBucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	attrs, err := b.InstrumentedBucket.Attributes(ctx, name)
+	if t, ok := b.modified[name]; ok {
+		attrs.LastModified = t
+	}
+	return attrs, err
+}
+
+func TestSyncer_SyncMetas_FaultyBucket(t *testing.T) {
+	ctx := context.Background()
+	faulty := objtesting.NewFaultyBucket(objstore.NewInMemBucket(), objtesting.FaultConfig{ListingDelay: time.Hour})
+	bkt := objstore.WithNoopInstr(faulty)
+
+	var meta metadata.Meta
+	meta.Version = 1
+	meta.ULID = ulid.MustNew(1, nil)
+	var buf bytes.Buffer
+	testutil.Ok(t, json.NewEncoder(&buf).Encode(&meta))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(meta.ULID.String(), metadata.MetaFilename), &buf))
+
+	newSyncer := func(bkt objstore.InstrumentedBucket) *Syncer {
+		metaFetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, nil, nil)
+		testutil.Ok(t, err)
+		sy, err := NewSyncer(nil, nil, bkt, metaFetcher, block.NewDeduplicateFilter(), block.NewIgnoreDeletionMarkFilter(nil, nil, 48*time.Hour),
+			promauto.With(nil).NewCounter(prometheus.CounterOpts{}), promauto.With(nil).NewCounter(prometheus.CounterOpts{}), 1)
+		testutil.Ok(t, err)
+		return sy
+	}
+
+	// The new block is not listed until the listing catches up.
+	sy := newSyncer(bkt)
+	testutil.Ok(t, sy.SyncMetas(ctx))
+	testutil.Equals(t, 0, len(sy.Snapshot().Metas))
+	faulty.Settle()
+	testutil.Ok(t, sy.SyncMetas(ctx))
+	testutil.Equals(t, 1, len(sy.Snapshot().Metas))
+
+	// Failed listings are retried.
+	failing := objtesting.NewFaultyBucket(faulty, objtesting.FaultConfig{ErrorRate: 1, Ops: []string{objstore.OpIter}})
+	err := newSyncer(objstore.WithNoopInstr(failing)).SyncMetas(ctx)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, IsRetryError(err), "expected retry error, got %v", err)
+	testutil.Equals(t, 1, failing.Injected(objstore.OpIter))
+}
+
+func TestSyncer_GarbageCollect_Strict(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+
+	src := make([]ulid.ULID, 6)
+	metas := make([]*metadata.Meta, 0, 9)
+	for i := range src {
+		src[i] = ulid.MustNew(uint64(i+1), nil)
+		m := &metadata.Meta{}
+		m.Version = 1
+		m.ULID = src[i]
+		m.Compaction.Level = 1
+		m.Compaction.Sources = []ulid.ULID{src[i]}
+		metas = append(metas, m)
+	}
+	compacted := []ulid.ULID{ulid.MustNew(10, nil), ulid.MustNew(11, nil), ulid.MustNew(12, nil)}
+	for i, id := range compacted {
+		m := &metadata.Meta{}
+		m.Version = 1
+		m.ULID = id
+		m.Compaction.Level = 2
+		m.Compaction.Sources = src[2*i : 2*i+2]
+		metas = append(metas, m)
+	}
+	for _, m := range metas {
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(m))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(m.ULID.String(), metadata.MetaFilename), &buf))
+	}
+
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, []block.MetadataFilter{duplicateBlocksFilter}, nil)
+	testutil.Ok(t, err)
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	garbageCollectedBlocks := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(nil, nil, 48*time.Hour)
+	sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks, 1, WithStrictGarbageCollection(time.Hour))
+	testutil.Ok(t, err)
+	testutil.Ok(t, sy.SyncMetas(ctx))
+
+	// The bucket changes after the sync: the first compacted block is deleted, the second one is marked for deletion and
+	// one source of the third one is already marked.
+	testutil.Ok(t, block.Delete(ctx, log.NewNopLogger(), bkt, compacted[0]))
+	testutil.Ok(t, block.MarkForDeletion(ctx, log.NewNopLogger(), bkt, compacted[1], blocksMarkedForDeletion))
+	testutil.Ok(t, block.MarkForDeletion(ctx, log.NewNopLogger(), bkt, src[4], blocksMarkedForDeletion))
+	testutil.Ok(t, sy.GarbageCollect(ctx))
+
+	for i, id := range src {
+		exists, err := bkt.Exists(ctx, path.Join(id.String(), metadata.DeletionMarkFilename))
+		testutil.Ok(t, err)
+		testutil.Equals(t, i >= 4, exists)
+	}
+	testutil.Equals(t, 1.0, promtest.ToFloat64(garbageCollectedBlocks))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(sy.metrics.garbageVerifySkips.WithLabelValues("replacement-missing")))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(sy.metrics.garbageVerifySkips.WithLabelValues("replacement-marked")))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(sy.metrics.garbageVerifySkips.WithLabelValues("already-marked")))
+
+	// Stale view is synced before garbage collection.
+	sy.snapshot.SyncTime = time.Now().Add(-2 * time.Hour)
+	testutil.Ok(t, sy.GarbageCollect(ctx))
+	testutil.Assert(t, time.Since(sy.snapshot.SyncTime) < time.Hour, "stale view was not synced")
+}
+
 func MetricCount(c prometheus.Collector) int {
 	var (
 		mCount int
@@ -195,19 +385,22 @@ func TestGroup_Compact_e2e(t *testing.T) {
 		comp, err := tsdb.NewLeveledCompactor(ctx, reg, logger, []int64{1000, 3000}, nil)
 		testutil.Ok(t, err)
 
-		grouper := NewDefaultGrouper(logger, bkt, false, false, reg, blocksMarkedForDeletion, garbageCollectedBlocks)
-		bComp, err := NewBucketCompactor(logger, sy, grouper, comp, dir, bkt, 2)
+		fingerprint := block.NewFingerprint("compactor-1")
+		grouper := NewDefaultGrouper(logger, bkt, false, false, reg, blocksMarkedForDeletion, garbageCollectedBlocks, WithCreatorFingerprint(fingerprint))
+		bComp, err := NewBucketCompactor(logger, sy, grouper, comp, dir, bkt, 2, WithRegisterer(reg))
 		testutil.Ok(t, err)
 
 		// Compaction on empty should not fail.
 		testutil.Ok(t, bComp.Compact(ctx))
+		testutil.Equals(t, 1, bComp.Status().LastRunSummary.Iterations)
+		testutil.Equals(t, 0, bComp.Status().LastRunSummary.Groups)
 		testutil.Equals(t, 0.0, promtest.ToFloat64(sy.metrics.garbageCollectedBlocks))
 		testutil.Equals(t, 0.0, promtest.ToFloat64(sy.metrics.blocksMarkedForDeletion))
 		testutil.Equals(t, 0.0, promtest.ToFloat64(sy.metrics.garbageCollectionFailures))
-		testutil.Equals(t, 0, MetricCount(grouper.compactions))
-		testutil.Equals(t, 0, MetricCount(grouper.compactionRunsStarted))
-		testutil.Equals(t, 0, MetricCount(grouper.compactionRunsCompleted))
-		testutil.Equals(t, 0, MetricCount(grouper.compactionFailures))
+		testutil.Equals(t, 0, MetricCount(grouper.metrics.compactions))
+		testutil.Equals(t, 0, MetricCount(grouper.metrics.compactionRunsStarted))
+		testutil.Equals(t, 0, MetricCount(grouper.metrics.compactionRunsCompleted))
+		testutil.Equals(t, 0, MetricCount(grouper.metrics.compactionFailures))
 
 		_, err = os.Stat(dir)
 		testutil.Assert(t, os.IsNotExist(err), "dir %s should be remove after compaction.", dir)
@@ -293,28 +486,39 @@ func TestGroup_Compact_e2e(t *testing.T) {
 		testutil.Equals(t, 5.0, promtest.ToFloat64(sy.metrics.garbageCollectedBlocks))
 		testutil.Equals(t, 5.0, promtest.ToFloat64(sy.metrics.blocksMarkedForDeletion))
 		testutil.Equals(t, 0.0, promtest.ToFloat64(sy.metrics.garbageCollectionFailures))
-		testutil.Equals(t, 4, MetricCount(grouper.compactions))
-		testutil.Equals(t, 1.0, promtest.ToFloat64(grouper.compactions.WithLabelValues(DefaultGroupKey(metas[0].Thanos))))
-		testutil.Equals(t, 1.0, promtest.ToFloat64(grouper.compactions.WithLabelValues(DefaultGroupKey(metas[7].Thanos))))
-		testutil.Equals(t, 0.0, promtest.ToFloat64(grouper.compactions.WithLabelValues(DefaultGroupKey(metas[4].Thanos))))
-		testutil.Equals(t, 0.0, promtest.ToFloat64(grouper.compactions.WithLabelValues(DefaultGroupKey(metas[5].Thanos))))
-		testutil.Equals(t, 4, MetricCount(grouper.compactionRunsStarted))
-		testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.compactionRunsStarted.WithLabelValues(DefaultGroupKey(metas[0].Thanos))))
-		testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.compactionRunsStarted.WithLabelValues(DefaultGroupKey(metas[7].Thanos))))
+		testutil.Equals(t, 4, MetricCount(grouper.metrics.compactions))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(grouper.metrics.compactions.WithLabelValues(GroupID(DefaultGroupKey(metas[0].Thanos)))))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(grouper.metrics.compactions.WithLabelValues(GroupID(DefaultGroupKey(metas[7].Thanos)))))
+		testutil.Equals(t, 0.0, promtest.ToFloat64(grouper.metrics.compactions.WithLabelValues(GroupID(DefaultGroupKey(metas[4].Thanos)))))
+		testutil.Equals(t, 0.0, promtest.ToFloat64(grouper.metrics.compactions.WithLabelValues(GroupID(DefaultGroupKey(metas[5].Thanos)))))
+		testutil.Equals(t, 4, MetricCount(grouper.metrics.compactionRunsStarted))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.metrics.compactionRunsStarted.WithLabelValues(GroupID(DefaultGroupKey(metas[0].Thanos)))))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.metrics.compactionRunsStarted.WithLabelValues(GroupID(DefaultGroupKey(metas[7].Thanos)))))
 		// TODO(bwplotka): Looks like we do some unnecessary loops. Not a major problem but investigate.
-		testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.compactionRunsStarted.WithLabelValues(DefaultGroupKey(metas[4].Thanos))))
-		testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.compactionRunsStarted.WithLabelValues(DefaultGroupKey(metas[5].Thanos))))
-		testutil.Equals(t, 4, MetricCount(grouper.compactionRunsCompleted))
-		testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.compactionRunsCompleted.WithLabelValues(DefaultGroupKey(metas[0].Thanos))))
-		testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.compactionRunsCompleted.WithLabelValues(DefaultGroupKey(metas[7].Thanos))))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.metrics.compactionRunsStarted.WithLabelValues(GroupID(DefaultGroupKey(metas[4].Thanos)))))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.metrics.compactionRunsStarted.WithLabelValues(GroupID(DefaultGroupKey(metas[5].Thanos)))))
+		testutil.Equals(t, 4, MetricCount(grouper.metrics.compactionRunsCompleted))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.metrics.compactionRunsCompleted.WithLabelValues(GroupID(DefaultGroupKey(metas[0].Thanos)))))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.metrics.compactionRunsCompleted.WithLabelValues(GroupID(DefaultGroupKey(metas[7].Thanos)))))
 		// TODO(bwplotka): Looks like we do some unnecessary loops. Not a major problem but investigate.
-		testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.compactionRunsCompleted.WithLabelValues(DefaultGroupKey(metas[4].Thanos))))
-		testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.compactionRunsCompleted.WithLabelValues(DefaultGroupKey(metas[5].Thanos))))
-		testutil.Equals(t, 4, MetricCount(grouper.compactionFailures))
-		testutil.Equals(t, 0.0, promtest.ToFloat64(grouper.compactionFailures.WithLabelValues(DefaultGroupKey(metas[0].Thanos))))
-		testutil.Equals(t, 0.0, promtest.ToFloat64(grouper.compactionFailures.WithLabelValues(DefaultGroupKey(metas[7].Thanos))))
-		testutil.Equals(t, 0.0, promtest.ToFloat64(grouper.compactionFailures.WithLabelValues(DefaultGroupKey(metas[4].Thanos))))
-		testutil.Equals(t, 0.0, promtest.ToFloat64(grouper.compactionFailures.WithLabelValues(DefaultGroupKey(metas[5].Thanos))))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.metrics.compactionRunsCompleted.WithLabelValues(GroupID(DefaultGroupKey(metas[4].Thanos)))))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.metrics.compactionRunsCompleted.WithLabelValues(GroupID(DefaultGroupKey(metas[5].Thanos)))))
+		testutil.Equals(t, 4, MetricCount(grouper.metrics.compactionFailures))
+		testutil.Equals(t, 0.0, promtest.ToFloat64(grouper.metrics.compactionFailures.WithLabelValues(GroupID(DefaultGroupKey(metas[0].Thanos)))))
+		testutil.Equals(t, 0.0, promtest.ToFloat64(grouper.metrics.compactionFailures.WithLabelValues(GroupID(DefaultGroupKey(metas[7].Thanos)))))
+		testutil.Equals(t, 0.0, promtest.ToFloat64(grouper.metrics.compactionFailures.WithLabelValues(GroupID(DefaultGroupKey(metas[4].Thanos)))))
+		testutil.Equals(t, 0.0, promtest.ToFloat64(grouper.metrics.compactionFailures.WithLabelValues(GroupID(DefaultGroupKey(metas[5].Thanos)))))
+
+		summary := bComp.Status().LastRunSummary
+		testutil.Equals(t, 2, summary.Iterations)
+		testutil.Equals(t, 8, summary.Groups)
+		testutil.Equals(t, 2, summary.Compactions)
+		testutil.Equals(t, 5, summary.BlocksMarkedForDeletion)
+		testutil.Assert(t, summary.BytesIn > 0 && summary.BytesOut > 0, "expected bytes in and out to be accounted, got %d %d", summary.BytesIn, summary.BytesOut)
+		testutil.Assert(t, summary.Duration >= summary.SyncDuration+summary.GarbageCollectDuration+summary.CompactDuration, "stage durations exceed run duration")
+		testutil.Equals(t, 2.0, promtest.ToFloat64(bComp.summary.compactions))
+		testutil.Equals(t, float64(summary.BytesIn), promtest.ToFloat64(bComp.summary.bytesIn))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(bComp.summary.success))
 
 		_, err = os.Stat(dir)
 		testutil.Assert(t, os.IsNotExist(err), "dir %s should be remove after compaction.", dir)
@@ -364,10 +568,13 @@ func TestGroup_Compact_e2e(t *testing.T) {
 			testutil.Equals(t, uint64(2*4*100), meta.Stats.NumSamples) // Only 2 times 4*100 because one block was empty.
 			testutil.Equals(t, 2, meta.Compaction.Level)
 			testutil.Equals(t, []ulid.ULID{metas[0].ULID, metas[1].ULID, metas[2].ULID}, meta.Compaction.Sources)
+			testutil.Equals(t, fingerprint, block.FingerprintOf(meta.ULID))
 
 			// Check thanos meta.
 			testutil.Assert(t, labels.Equal(extLabels, labels.FromMap(meta.Thanos.Labels)), "ext labels does not match")
 			testutil.Equals(t, int64(124), meta.Thanos.Downsample.Resolution)
+			testutil.Equals(t, metadata.CompactorSource, meta.Thanos.Source)
+			testutil.Equals(t, []metadata.SourceType{metadata.TestSource}, meta.Thanos.Provenance)
 		}
 		{
 			meta, ok := others[defaultGroupKey(124, extLabels2)]
@@ -521,3 +728,616 @@ func listBlocksMarkedForDeletion(ctx context.Context, bkt objstore.Bucket) ([]ul
 	})
 	return rem, err
 }
+
+func TestSyncer_LabelNormalizationMigration_e2e(t *testing.T) {
+	objtesting.ForeachStore(t, func(t *testing.T, bkt objstore.Bucket) {
+		ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+		defer cancel()
+
+		var ids []ulid.ULID
+		for i, lset := range []map[string]string{
+			{"cluster": "eu1", "replica": "a"},
+			{"Cluster": "EU1", "replica": "a"},
+		} {
+			var m metadata.Meta
+			m.Version = 1
+			m.ULID = ulid.MustNew(uint64(i), nil)
+			m.Compaction.Sources = []ulid.ULID{m.ULID}
+			m.Compaction.Level = 1
+			m.Thanos.Labels = lset
+
+			var buf bytes.Buffer
+			testutil.Ok(t, json.NewEncoder(&buf).Encode(&m))
+			testutil.Ok(t, bkt.Upload(ctx, path.Join(m.ULID.String(), metadata.MetaFilename), &buf))
+			ids = append(ids, m.ULID)
+		}
+
+		normalizer := block.NewLabelNormalizer(nil, []string{"cluster"})
+		duplicateBlocksFilter := block.NewDeduplicateFilter()
+		metaFetcher, err := block.NewMetaFetcher(nil, 32, objstore.WithNoopInstr(bkt), "", nil, []block.MetadataFilter{
+			duplicateBlocksFilter,
+		}, []block.MetadataModifier{normalizer, block.NewReplicaLabelRemover(log.NewNopLogger(), []string{"replica"})})
+		testutil.Ok(t, err)
+
+		blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+		garbageCollectedBlocks := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+		ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(nil, nil, 48*time.Hour)
+		sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks, 1, WithLabelNormalizationMigration(normalizer))
+		testutil.Ok(t, err)
+		testutil.Ok(t, sy.SyncMetas(ctx))
+
+		metas := sy.Metas()
+		testutil.Equals(t, DefaultGroupKey(metas[ids[0]].Thanos), DefaultGroupKey(metas[ids[1]].Thanos))
+
+		// Only normalized labels are persisted, labels removed by other modifiers are kept as they are.
+		m, err := block.DownloadMeta(ctx, nil, bkt, ids[1])
+		testutil.Ok(t, err)
+		testutil.Equals(t, map[string]string{"cluster": "eu1", "replica": "a"}, m.Thanos.Labels)
+		testutil.Equals(t, 1.0, promtest.ToFloat64(sy.metrics.labelsMigratedBlocks))
+	})
+}
+
+func TestSyncer_TimePartition_e2e(t *testing.T) {
+	objtesting.ForeachStore(t, func(t *testing.T, bkt objstore.Bucket) {
+		ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+		defer cancel()
+
+		upload := func(i uint64, mint, maxt int64, sources ...ulid.ULID) ulid.ULID {
+			var m metadata.Meta
+			m.Version = 1
+			m.ULID = ulid.MustNew(i, nil)
+			m.MinTime, m.MaxTime = mint, maxt
+			m.Compaction.Sources = append(sources, m.ULID)
+			m.Compaction.Level = len(m.Compaction.Sources)
+			m.Thanos.Labels = map[string]string{"a": "1"}
+
+			var buf bytes.Buffer
+			testutil.Ok(t, json.NewEncoder(&buf).Encode(&m))
+			testutil.Ok(t, bkt.Upload(ctx, path.Join(m.ULID.String(), metadata.MetaFilename), &buf))
+			return m.ULID
+		}
+		b1 := upload(1, 0, 500)
+		b2 := upload(2, 500, 1000)
+		b3 := upload(3, 1000, 2000)
+		// Compacted from b1 and b2, so both are garbage collected by the partition owning them.
+		b4 := upload(4, 0, 1000, b1, b2)
+		partial := ulid.MustNew(5, nil)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(partial.String(), block.IndexFilename), bytes.NewReader(nil)))
+
+		newSyncer := func(mint, maxt time.Time) *Syncer {
+			partition := block.NewTimePartitionOwnershipFilter(model.TimeOrDurationValue{Time: &mint}, model.TimeOrDurationValue{Time: &maxt})
+			ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(nil, objstore.WithNoopInstr(bkt), 48*time.Hour)
+			duplicateBlocksFilter := block.NewDeduplicateFilter()
+			metaFetcher, err := block.NewMetaFetcher(nil, 32, objstore.WithNoopInstr(bkt), "", nil, []block.MetadataFilter{
+				partition,
+				ignoreDeletionMarkFilter,
+				duplicateBlocksFilter,
+			}, nil)
+			testutil.Ok(t, err)
+
+			blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+			garbageCollectedBlocks := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+			sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks, 1, WithTimePartition(partition))
+			testutil.Ok(t, err)
+			return sy
+		}
+		historical := newSyncer(time.Unix(0, 0), time.Unix(1, 0))
+		recent := newSyncer(time.Unix(1, 0), time.Now().Add(time.Hour))
+
+		testutil.Ok(t, recent.SyncMetas(ctx))
+		testutil.Ok(t, recent.GarbageCollect(ctx))
+		testutil.Equals(t, []ulid.ULID{b3}, sortedIDs(recent.Metas()))
+		testutil.Equals(t, 0.0, promtest.ToFloat64(recent.metrics.garbageCollectedBlocks))
+		_, ok := recent.Partial()[partial]
+		testutil.Assert(t, ok, "partial block should be reported by the partition containing current time")
+
+		testutil.Ok(t, historical.SyncMetas(ctx))
+		testutil.Ok(t, historical.GarbageCollect(ctx))
+		testutil.Equals(t, []ulid.ULID{b4}, sortedIDs(historical.Metas()))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(historical.metrics.garbageCollectedBlocks))
+		testutil.Equals(t, 0, len(historical.Partial()))
+
+		for _, id := range []ulid.ULID{b1, b2} {
+			ok, err := bkt.Exists(ctx, path.Join(id.String(), metadata.DeletionMarkFilename))
+			testutil.Ok(t, err)
+			testutil.Assert(t, ok, "block %s should be marked for deletion", id)
+		}
+	})
+}
+
+func sortedIDs(metas map[ulid.ULID]*metadata.Meta) []ulid.ULID {
+	var ids []ulid.ULID
+	for id := range metas {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Compare(ids[j]) < 0 })
+	return ids
+}
+
+func TestGroup_Compact_EmptyResult_e2e(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test-compact-empty")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+	bkt := objstore.NewInMemBucket()
+	extLset := labels.Labels{{Name: "e1", Value: "1"}}
+	series := []labels.Labels{{{Name: "a", Value: "1"}}, {{Name: "a", Value: "2"}}}
+	metas := createAndUpload(t, bkt, []blockgenSpec{
+		{numSamples: 100, mint: 0, maxt: 1000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 1000, maxt: 2000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 2000, maxt: 3000, extLset: extLset, series: series},
+		// Due to TSDB compaction delay (not compacting fresh block), we need one more block to be pushed to trigger compaction.
+		{numSamples: 100, mint: 3000, maxt: 4000, extLset: extLset, series: series},
+	})
+	// Delete all samples of blocks to be compacted.
+	for _, m := range metas[:3] {
+		testutil.Ok(t, block.AddDeletionIntent(ctx, logger, bkt, m.ULID, metadata.DeletionIntent{Matchers: `{a=~".+"}`, MinTime: m.MinTime, MaxTime: m.MaxTime}))
+	}
+
+	reg := prometheus.NewRegistry()
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, objstore.WithNoopInstr(bkt), 48*time.Hour)
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, objstore.WithNoopInstr(bkt), "", nil, []block.MetadataFilter{
+		ignoreDeletionMarkFilter,
+		duplicateBlocksFilter,
+	}, nil)
+	testutil.Ok(t, err)
+
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	garbageCollectedBlocks := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks, 5)
+	testutil.Ok(t, err)
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, reg, logger, []int64{1000, 3000}, nil)
+	testutil.Ok(t, err)
+
+	grouper := NewDefaultGrouper(logger, bkt, false, false, reg, blocksMarkedForDeletion, garbageCollectedBlocks)
+	bComp, err := NewBucketCompactor(logger, sy, grouper, comp, dir, bkt, 1)
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, bComp.Compact(ctx))
+	groupKey := DefaultGroupKey(metas[0].Thanos)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(grouper.metrics.emptyCompactions.WithLabelValues(GroupID(groupKey))))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(grouper.metrics.compactions.WithLabelValues(GroupID(groupKey))))
+	testutil.Equals(t, 3.0, promtest.ToFloat64(blocksMarkedForDeletion))
+
+	// All sources are marked for deletion with a dedicated reason and no new block is uploaded.
+	blocks := map[ulid.ULID]*metadata.Meta{}
+	testutil.Ok(t, bkt.Iter(ctx, "", func(n string) error {
+		if id, ok := block.IsBlockDir(n); ok {
+			blocks[id] = nil
+		}
+		return nil
+	}))
+	testutil.Equals(t, sortedIDs(map[ulid.ULID]*metadata.Meta{metas[0].ULID: metas[0], metas[1].ULID: metas[1], metas[2].ULID: metas[2], metas[3].ULID: metas[3]}), sortedIDs(blocks))
+
+	for _, m := range metas[:3] {
+		mark, err := metadata.ReadDeletionMark(ctx, objstore.WithNoopInstr(bkt), logger, m.ULID.String())
+		testutil.Ok(t, err)
+		testutil.Equals(t, metadata.EmptyCompactionResultDeletionReason, mark.Reason)
+	}
+	_, err = metadata.ReadDeletionMark(ctx, objstore.WithNoopInstr(bkt), logger, metas[3].ULID.String())
+	testutil.Equals(t, metadata.ErrorDeletionMarkNotFound, err)
+}
+
+func TestBucketCompactor_DryRun_e2e(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test-compact-dry-run")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+	bkt := objstore.NewInMemBucket()
+	extLset := labels.Labels{{Name: "e1", Value: "1"}}
+	series := []labels.Labels{{{Name: "a", Value: "1"}}, {{Name: "a", Value: "2"}}}
+	metas := createAndUpload(t, bkt, []blockgenSpec{
+		{numSamples: 100, mint: 0, maxt: 1000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 1000, maxt: 2000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 2000, maxt: 3000, extLset: extLset, series: series},
+		// Due to TSDB compaction delay (not compacting fresh block), we need one more block to be pushed to trigger compaction.
+		{numSamples: 100, mint: 3000, maxt: 4000, extLset: extLset, series: series},
+	})
+	// Block with the same sources as another one is garbage collected.
+	duplicate := *metas[3]
+	duplicate.ULID = ulid.MustNew(uint64(time.Now().Unix()*1000)+1000, nil)
+	duplicate.Compaction.Level = 1
+	var buf bytes.Buffer
+	testutil.Ok(t, json.NewEncoder(&buf).Encode(&duplicate))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(duplicate.ULID.String(), metadata.MetaFilename), &buf))
+	metas[3].Compaction.Level = 2
+	testutil.Ok(t, block.UploadMeta(ctx, bkt, *metas[3]))
+
+	objects := func() map[string][]byte {
+		res := map[string][]byte{}
+		for n, b := range bkt.Objects() {
+			res[n] = append([]byte(nil), b...)
+		}
+		return res
+	}
+	before := objects()
+
+	reg := prometheus.NewRegistry()
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, objstore.WithNoopInstr(bkt), 48*time.Hour)
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, objstore.WithNoopInstr(bkt), "", nil, []block.MetadataFilter{
+		ignoreDeletionMarkFilter,
+		duplicateBlocksFilter,
+	}, nil)
+	testutil.Ok(t, err)
+
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	garbageCollectedBlocks := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	sy, err := NewSyncer(logger, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks, 5)
+	testutil.Ok(t, err)
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, reg, logger, []int64{1000, 3000}, nil)
+	testutil.Ok(t, err)
+
+	grouper := NewDefaultGrouper(logger, bkt, false, false, reg, blocksMarkedForDeletion, garbageCollectedBlocks)
+	bComp, err := NewBucketCompactor(logger, sy, grouper, comp, dir, bkt, 1, WithDryRun(true))
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, bComp.Compact(ctx))
+	testutil.Equals(t, before, objects())
+	testutil.Equals(t, 0.0, promtest.ToFloat64(blocksMarkedForDeletion))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(grouper.metrics.compactionRunsStarted.WithLabelValues(GroupID(DefaultGroupKey(metas[0].Thanos)))))
+
+	// Garbage collected block is in the snapshot as if it was marked.
+	_, ok := sy.Snapshot().Metas[duplicate.ULID]
+	testutil.Assert(t, !ok, "expected duplicate block to be dropped from the snapshot")
+	_, ok = sy.Snapshot().DeletionMarks[duplicate.ULID]
+	testutil.Assert(t, ok, "expected duplicate block to be marked in the snapshot")
+}
+
+type recordingBlockNotifier struct {
+	added   []ulid.ULID
+	deleted []ulid.ULID
+}
+
+func (n *recordingBlockNotifier) NotifyAdded(_ context.Context, meta *metadata.Meta) error {
+	n.added = append(n.added, meta.ULID)
+	return nil
+}
+
+func (n *recordingBlockNotifier) NotifyDeleted(_ context.Context, ids []ulid.ULID) error {
+	n.deleted = append(n.deleted, ids...)
+	return nil
+}
+
+func TestGroup_Compact_BlockNotifier_e2e(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test-compact-notifier")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+	bkt := objstore.NewInMemBucket()
+	extLset := labels.Labels{{Name: "e1", Value: "1"}}
+	series := []labels.Labels{{{Name: "a", Value: "1"}}, {{Name: "a", Value: "2"}}}
+	metas := createAndUpload(t, bkt, []blockgenSpec{
+		{numSamples: 100, mint: 0, maxt: 1000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 1000, maxt: 2000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 2000, maxt: 3000, extLset: extLset, series: series},
+		// Due to TSDB compaction delay (not compacting fresh block), we need one more block to be pushed to trigger compaction.
+		{numSamples: 100, mint: 3000, maxt: 4000, extLset: extLset, series: series},
+	})
+
+	reg := prometheus.NewRegistry()
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, objstore.WithNoopInstr(bkt), 48*time.Hour)
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, objstore.WithNoopInstr(bkt), "", nil, []block.MetadataFilter{
+		ignoreDeletionMarkFilter,
+		duplicateBlocksFilter,
+	}, nil)
+	testutil.Ok(t, err)
+
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	garbageCollectedBlocks := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks, 5)
+	testutil.Ok(t, err)
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, reg, logger, []int64{1000, 3000}, nil)
+	testutil.Ok(t, err)
+
+	notifier := &recordingBlockNotifier{}
+	grouper := NewDefaultGrouper(logger, bkt, false, false, reg, blocksMarkedForDeletion, garbageCollectedBlocks, WithBlockNotifier(notifier))
+	bComp, err := NewBucketCompactor(logger, sy, grouper, comp, dir, bkt, 1)
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, bComp.Compact(ctx))
+	testutil.Equals(t, 1, len(notifier.added))
+	testutil.Equals(t, []ulid.ULID{metas[0].ULID, metas[1].ULID, metas[2].ULID}, notifier.deleted)
+
+	meta, err := block.DownloadMeta(ctx, logger, bkt, notifier.added[0])
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{metas[0].ULID, metas[1].ULID, metas[2].ULID}, meta.Compaction.Sources)
+	for _, id := range notifier.deleted {
+		_, err := metadata.ReadDeletionMark(ctx, objstore.WithNoopInstr(bkt), logger, id.String())
+		testutil.Ok(t, err)
+	}
+}
+
+func TestGroup_Compact_Append_e2e(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test-compact-append")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+	bkt := objstore.NewInMemBucket()
+	extLset := labels.Labels{{Name: "e1", Value: "1"}}
+	series := []labels.Labels{{{Name: "a", Value: "1"}}, {{Name: "a", Value: "2"}}}
+	metas := createAndUpload(t, bkt, []blockgenSpec{
+		{numSamples: 100, mint: 0, maxt: 1000, extLset: extLset, series: series},
+		{numSamples: 5, mint: 1000, maxt: 2000, extLset: extLset, series: series},
+		{numSamples: 5, mint: 2000, maxt: 3000, extLset: extLset, series: series},
+		// Due to TSDB compaction delay (not compacting fresh block), we need one more block to be pushed to trigger compaction.
+		{numSamples: 5, mint: 3000, maxt: 4000, extLset: extLset, series: series},
+	})
+
+	reg := prometheus.NewRegistry()
+	comp, err := tsdb.NewLeveledCompactor(ctx, reg, logger, []int64{1000, 3000}, nil)
+	testutil.Ok(t, err)
+
+	appendMetrics := NewAppendCompactionMetrics(reg)
+	g, err := NewGroup(logger, bkt, DefaultGroupKey(metas[0].Thanos), extLset, 0, false, false, GroupMetrics{
+		Compactions:             promauto.With(nil).NewCounter(prometheus.CounterOpts{}),
+		CompactionRunsStarted:   promauto.With(nil).NewCounter(prometheus.CounterOpts{}),
+		CompactionRunsCompleted: promauto.With(nil).NewCounter(prometheus.CounterOpts{}),
+		CompactionFailures:      promauto.With(nil).NewCounter(prometheus.CounterOpts{}),
+		VerticalCompactions:     promauto.With(nil).NewCounter(prometheus.CounterOpts{}),
+		GarbageCollectedBlocks:  promauto.With(nil).NewCounter(prometheus.CounterOpts{}),
+		BlocksMarkedForDeletion: promauto.With(nil).NewCounter(prometheus.CounterOpts{}),
+		EmptyCompactions:        promauto.With(nil).NewCounter(prometheus.CounterOpts{}),
+	}, WithAppendCompaction(5, appendMetrics))
+	testutil.Ok(t, err)
+	for _, m := range metas {
+		testutil.Ok(t, g.Add(m))
+	}
+
+	_, id, err := g.Compact(ctx, dir, comp)
+	testutil.Ok(t, err)
+	testutil.Assert(t, id != ulid.ULID{}, "expected compacted block")
+	testutil.Equals(t, 1.0, promtest.ToFloat64(appendMetrics.appends.WithLabelValues(g.ID())))
+
+	meta, err := block.DownloadMeta(ctx, logger, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{metas[0].ULID, metas[1].ULID, metas[2].ULID}, meta.Compaction.Sources)
+	testutil.Equals(t, metas[0].Stats.NumSamples+metas[1].Stats.NumSamples+metas[2].Stats.NumSamples, meta.Stats.NumSamples)
+
+	// Chunks of the large block are reused as they are, so its chunk segment is found unchanged in the new block.
+	objects := bkt.Objects()
+	large := objects[path.Join(metas[0].ULID.String(), block.ChunksDirname, "000001")]
+	testutil.Assert(t, len(large) > 0, "expected chunks of the large block")
+	testutil.Assert(t, bytes.HasPrefix(objects[path.Join(id.String(), block.ChunksDirname, "000001")], large), "expected chunks of the large block to be reused")
+}
+
+// stealOtherShard runs a compaction of a compactor owning the shard of blocks with e1="1" label, which has nothing to
+// compact, so a group of other shards is stolen. Metas of all shards are fetched with the given filters. Failures of
+// stolen groups do not fail the compaction.
+func stealOtherShard(ctx context.Context, t *testing.T, logger log.Logger, bkt objstore.Bucket, filters []block.MetadataFilter, marks *block.NoCompactMarkFilter) *WorkStealer {
+	dir, err := ioutil.TempDir("", "test-compact-steal")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	relabelConfig, err := block.ParseRelabelConfig([]byte(`
+- action: keep
+  source_labels: ["e1"]
+  regex: "1"
+`))
+	testutil.Ok(t, err)
+
+	reg := prometheus.NewRegistry()
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, objstore.WithNoopInstr(bkt), 48*time.Hour)
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, objstore.WithNoopInstr(bkt), "", nil, []block.MetadataFilter{
+		block.NewLabelShardedMetaFilter(relabelConfig),
+		ignoreDeletionMarkFilter,
+		duplicateBlocksFilter,
+	}, nil)
+	testutil.Ok(t, err)
+	allShardsFetcher, err := block.NewMetaFetcher(nil, 32, objstore.WithNoopInstr(bkt), "", nil, append(filters,
+		block.NewIgnoreDeletionMarkFilter(logger, objstore.WithNoopInstr(bkt), 48*time.Hour),
+		block.NewDeduplicateFilter(),
+	), nil)
+	testutil.Ok(t, err)
+
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	garbageCollectedBlocks := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks, 5)
+	testutil.Ok(t, err)
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, reg, logger, []int64{1000, 3000}, nil)
+	testutil.Ok(t, err)
+
+	claims := NewGroupClaims(logger, reg, objstore.WithNoopInstr(bkt), "a", time.Hour)
+	stealer := NewWorkStealer(logger, reg, claims, allShardsFetcher, marks, 0, 1)
+	grouper := NewDefaultGrouper(logger, bkt, false, false, reg, blocksMarkedForDeletion, garbageCollectedBlocks)
+	bComp, err := NewBucketCompactor(logger, sy, grouper, comp, dir, bkt, 1, WithWorkStealing(stealer))
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, bComp.Compact(ctx))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(stealer.stolen))
+	return stealer
+}
+
+// compactedSources returns sources of blocks in the bucket which are not among the given ones.
+func compactedSources(ctx context.Context, t *testing.T, logger log.Logger, bkt objstore.Bucket, metas []*metadata.Meta) [][]ulid.ULID {
+	known := map[ulid.ULID]struct{}{}
+	for _, m := range metas {
+		known[m.ULID] = struct{}{}
+	}
+	var res [][]ulid.ULID
+	testutil.Ok(t, bkt.Iter(ctx, "", func(n string) error {
+		id, ok := block.IsBlockDir(n)
+		if !ok {
+			return nil
+		}
+		if _, ok := known[id]; ok {
+			return nil
+		}
+		meta, err := block.DownloadMeta(ctx, logger, bkt, id)
+		if err != nil {
+			return err
+		}
+		res = append(res, meta.Compaction.Sources)
+		return nil
+	}))
+	return res
+}
+
+func TestBucketCompactor_Steal_NoCompactMarks_e2e(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+	bkt := objstore.NewInMemBucket()
+	extLset := labels.Labels{{Name: "e1", Value: "2"}}
+	series := []labels.Labels{{{Name: "a", Value: "1"}}, {{Name: "a", Value: "2"}}}
+	metas := createAndUpload(t, bkt, []blockgenSpec{
+		{numSamples: 100, mint: 0, maxt: 1000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 1000, maxt: 2000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 2000, maxt: 3000, extLset: extLset, series: series},
+		// Due to TSDB compaction delay (not compacting fresh block), we need more blocks to be pushed to trigger compaction.
+		{numSamples: 100, mint: 3000, maxt: 4000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 4000, maxt: 5000, extLset: extLset, series: series},
+	})
+	// The owner of the group leaves the marked block out of planning, and so does the compactor stealing the group.
+	testutil.Ok(t, block.MarkForNoCompact(ctx, logger, bkt, metas[2].ULID, metadata.NoCompactReason("manual"), "", promauto.With(nil).NewCounter(prometheus.CounterOpts{})))
+
+	marks := block.NewNoCompactMarkFilter(logger, objstore.WithNoopInstr(bkt))
+	stealOtherShard(ctx, t, logger, bkt, []block.MetadataFilter{marks}, marks)
+
+	testutil.Equals(t, [][]ulid.ULID{{metas[0].ULID, metas[1].ULID}}, compactedSources(ctx, t, logger, bkt, metas))
+	_, err := metadata.ReadDeletionMark(ctx, objstore.WithNoopInstr(bkt), logger, metas[2].ULID.String())
+	testutil.Equals(t, metadata.ErrorDeletionMarkNotFound, err)
+}
+
+func TestBucketCompactor_Steal_TimeRangeSkip_e2e(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test-compact-steal-time-range")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+	bkt := objstore.NewInMemBucket()
+	extLset := labels.Labels{{Name: "e1", Value: "2"}}
+	series := []labels.Labels{{{Name: "a", Value: "1"}}, {{Name: "a", Value: "2"}}}
+	metas := createAndUpload(t, bkt, []blockgenSpec{
+		{numSamples: 100, mint: 0, maxt: 1000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 1000, maxt: 2000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 2000, maxt: 3000, extLset: extLset, series: series},
+		// Due to TSDB compaction delay (not compacting fresh block), we need more blocks to be pushed to trigger compaction.
+		{numSamples: 100, mint: 3000, maxt: 4000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 4000, maxt: 5000, extLset: extLset, series: series},
+	})
+	// Chunks outside of the time range of the meta are skipped by the owner of the group, and so by the compactor
+	// stealing the group.
+	metas[2].MaxTime = 2500
+	testutil.Ok(t, block.UploadMeta(ctx, bkt, *metas[2]))
+
+	f, err := NewTimeRangeFilter(logger, nil, bkt, dir, TimeRangeSkip, 1, nil, nil, false)
+	testutil.Ok(t, err)
+	stealOtherShard(ctx, t, logger, bkt, []block.MetadataFilter{f.ForAllShards()}, nil)
+
+	testutil.Equals(t, [][]ulid.ULID{{metas[0].ULID, metas[1].ULID}}, compactedSources(ctx, t, logger, bkt, metas))
+	_, err = metadata.ReadDeletionMark(ctx, objstore.WithNoopInstr(bkt), logger, metas[2].ULID.String())
+	testutil.Equals(t, metadata.ErrorDeletionMarkNotFound, err)
+}
+
+func TestBucketCompactor_Steal_Failure_e2e(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+	bkt := objstore.NewInMemBucket()
+	extLset := labels.Labels{{Name: "e1", Value: "2"}}
+	series := []labels.Labels{{{Name: "a", Value: "1"}}, {{Name: "a", Value: "2"}}}
+	metas := createAndUpload(t, bkt, []blockgenSpec{
+		{numSamples: 100, mint: 0, maxt: 1000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 1000, maxt: 2000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 2000, maxt: 3000, extLset: extLset, series: series},
+		// Due to TSDB compaction delay (not compacting fresh block), we need more blocks to be pushed to trigger compaction.
+		{numSamples: 100, mint: 3000, maxt: 4000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 4000, maxt: 5000, extLset: extLset, series: series},
+	})
+	// Source block of the stolen group cannot be downloaded, so its compaction fails, which is left to its owner.
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(metas[0].ULID.String(), block.IndexFilename)))
+
+	stealer := stealOtherShard(ctx, t, logger, bkt, nil, nil)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(stealer.stolenFailures))
+	testutil.Equals(t, 0, len(compactedSources(ctx, t, logger, bkt, metas)))
+}
+
+func TestBucketCompactor_CompactOnDemand_Claimed_e2e(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test-compact-on-demand-claimed")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+	bkt := objstore.NewInMemBucket()
+	extLset := labels.Labels{{Name: "e1", Value: "1"}}
+	series := []labels.Labels{{{Name: "a", Value: "1"}}, {{Name: "a", Value: "2"}}}
+	metas := createAndUpload(t, bkt, []blockgenSpec{
+		{numSamples: 100, mint: 0, maxt: 1000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 1000, maxt: 2000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 2000, maxt: 3000, extLset: extLset, series: series},
+		// Due to TSDB compaction delay (not compacting fresh block), we need more blocks to be pushed to trigger compaction.
+		{numSamples: 100, mint: 3000, maxt: 4000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 4000, maxt: 5000, extLset: extLset, series: series},
+	})
+
+	reg := prometheus.NewRegistry()
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, objstore.WithNoopInstr(bkt), 48*time.Hour)
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, objstore.WithNoopInstr(bkt), "", nil, []block.MetadataFilter{
+		ignoreDeletionMarkFilter,
+		duplicateBlocksFilter,
+	}, nil)
+	testutil.Ok(t, err)
+
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	garbageCollectedBlocks := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks, 5)
+	testutil.Ok(t, err)
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, reg, logger, []int64{1000, 3000}, nil)
+	testutil.Ok(t, err)
+
+	// Another replica compacts the group, so the on-demand compaction must not compact it as well.
+	group := DefaultGroupKey(metas[0].Thanos)
+	claimed, err := NewGroupClaims(logger, nil, objstore.WithNoopInstr(bkt), "b", time.Hour).Claim(ctx, group)
+	testutil.Ok(t, err)
+	testutil.Assert(t, claimed, "expected group to be claimed")
+
+	claims := NewGroupClaims(logger, reg, objstore.WithNoopInstr(bkt), "a", time.Hour)
+	stealer := NewWorkStealer(logger, reg, claims, metaFetcher, nil, 0, 1)
+	grouper := NewDefaultGrouper(logger, bkt, false, false, reg, blocksMarkedForDeletion, garbageCollectedBlocks)
+	bComp, err := NewBucketCompactor(logger, sy, grouper, comp, dir, bkt, 1, WithWorkStealing(stealer))
+	testutil.Ok(t, err)
+
+	j, err := bComp.RequestCompaction(OnDemandRequest{Group: group})
+	testutil.Ok(t, err)
+	testutil.Ok(t, bComp.CompactOnDemand(ctx))
+
+	j, ok := bComp.OnDemandJob(j.ID)
+	testutil.Assert(t, ok, "expected job to be known")
+	testutil.Equals(t, OnDemandJobFailed, j.State)
+	testutil.Equals(t, fmt.Sprintf("group %s is claimed by another compactor", group), j.Error)
+	testutil.Equals(t, 0, len(compactedSources(ctx, t, logger, bkt, metas)))
+}
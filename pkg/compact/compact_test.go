@@ -4,11 +4,27 @@
 package compact
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
 	"testing"
 
+	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
 
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
 	terrors "github.com/prometheus/prometheus/tsdb/errors"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
@@ -73,6 +89,54 @@ func TestRetryError(t *testing.T) {
 	testutil.Assert(t, IsHaltError(err), "not a halt error. Retry should not hide halt error")
 }
 
+func TestClassify(t *testing.T) {
+	id := ulid.MustNew(1, nil)
+	for _, tcase := range []struct {
+		err      error
+		expected ErrorClass
+	}{
+		{err: nil, expected: ErrorClassUnknown},
+		{err: errors.New("test"), expected: ErrorClassUnknown},
+		{err: issue347Error(errors.New("test"), id), expected: ErrorClassUnknown},
+		{err: errors.Wrap(halt(errors.New("test")), "something"), expected: ErrorClassHalt},
+		{err: fmt.Errorf("something: %w", halt(errors.New("test"))), expected: ErrorClassHalt},
+		{err: NewHaltError(NewRetryError(errors.New("test"))), expected: ErrorClassHalt},
+		{err: terrors.MultiError{retry(errors.New("test")), halt(errors.New("test"))}, expected: ErrorClassHalt},
+		{err: fmt.Errorf("something: %w", retry(errors.New("test"))), expected: ErrorClassRetry},
+		{err: terrors.MultiError{retry(errors.New("test")), errors.New("test")}, expected: ErrorClassUnknown},
+		{err: errors.Wrap(retry(partialUpload(errors.New("test"), id)), "something"), expected: ErrorClassRetry},
+	} {
+		if ok := t.Run(fmt.Sprintf("%v", tcase.err), func(t *testing.T) {
+			testutil.Equals(t, tcase.expected, Classify(tcase.err))
+		}); !ok {
+			return
+		}
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	id := ulid.MustNew(1, nil)
+	cause := errors.New("test")
+
+	err := errors.Wrap(retry(partialUpload(cause, id)), "something")
+	testutil.Assert(t, IsPartialUploadError(err), "not a partial upload error")
+	var pe PartialUploadError
+	testutil.Assert(t, errors.As(err, &pe), "partial upload error not found")
+	testutil.Equals(t, id, pe.BlockID())
+	testutil.Assert(t, errors.Is(err, cause), "partial upload error does not wrap the cause")
+
+	err = fmt.Errorf("something: %w", issue347Error(cause, id))
+	testutil.Assert(t, IsIssue347Error(err), "not an issue347 error")
+	var ie Issue347Error
+	testutil.Assert(t, errors.As(err, &ie), "issue347 error not found")
+	testutil.Equals(t, id, ie.BlockID())
+	testutil.Assert(t, errors.Is(err, cause), "issue347 error does not wrap the cause")
+
+	testutil.Assert(t, errors.Is(halt(cause), cause), "halt error does not wrap the cause")
+	testutil.Assert(t, errors.Is(retry(cause), cause), "retry error does not wrap the cause")
+	testutil.Assert(t, !IsPartialUploadError(retry(cause)), "partial upload error")
+}
+
 func TestGroupKey(t *testing.T) {
 	for _, tcase := range []struct {
 		input    metadata.Thanos
@@ -111,3 +175,200 @@ func TestGroupKey(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitPlan(t *testing.T) {
+	plan := []string{"1", "2", "3", "4", "5", "6", "7"}
+	for _, tcase := range []struct {
+		max      int
+		expected [][]string
+	}{
+		{max: 0, expected: [][]string{plan}},
+		{max: 7, expected: [][]string{plan}},
+		{max: 4, expected: [][]string{{"1", "2", "3", "4"}, {"5", "6", "7"}}},
+		{max: 3, expected: [][]string{{"1", "2", "3"}, {"4", "5"}, {"6", "7"}}},
+		{max: 2, expected: [][]string{{"1", "2"}, {"3", "4"}, {"5", "6"}}},
+		// Parts of single blocks would never be compacted.
+		{max: 1, expected: [][]string{{"1", "2"}, {"3", "4"}, {"5", "6"}}},
+	} {
+		if ok := t.Run("", func(t *testing.T) {
+			testutil.Equals(t, tcase.expected, splitPlan(plan, tcase.max))
+		}); !ok {
+			return
+		}
+	}
+
+	for max, expected := range map[int]int{0: 0, 1: 2, -1: 2, 3: 3} {
+		testutil.Equals(t, expected, applyGroupOptions([]GroupOption{WithMaxBlocksPerCompaction(max)}).maxBlocksPerCompaction)
+	}
+}
+
+func TestSharedMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	blocksMarkedForDeletion := prometheus.NewCounter(prometheus.CounterOpts{})
+	garbageCollectedBlocks := prometheus.NewCounter(prometheus.CounterOpts{})
+	bkt := objstore.NewInMemBucket()
+
+	// Recreating components with the same metrics does not register them again.
+	sm := NewSyncerMetrics(reg, blocksMarkedForDeletion, garbageCollectedBlocks)
+	gm := NewDefaultGrouperMetrics(reg, blocksMarkedForDeletion, garbageCollectedBlocks)
+	for i := 0; i < 2; i++ {
+		sy, err := NewSyncerWithMetrics(nil, sm, bkt, nil, nil, nil, 1, WithGroupSizeAccounting(true))
+		testutil.Ok(t, err)
+		testutil.Assert(t, sy.metrics == sm, "metrics not shared")
+
+		g := NewDefaultGrouperWithMetrics(nil, bkt, false, false, gm)
+		groups, err := g.Groups(map[ulid.ULID]*metadata.Meta{ulid.MustNew(1, nil): {
+			BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(1, nil), MinTime: 0, MaxTime: 1000},
+			Thanos:    metadata.Thanos{Labels: map[string]string{"a": "1"}},
+		}})
+		testutil.Ok(t, err)
+		groups[0].metrics.CompactionRunsStarted.Inc()
+	}
+	testutil.Equals(t, 2.0, promtest.ToFloat64(gm.compactionRunsStarted.WithLabelValues(GroupID(DefaultGroupKey(metadata.Thanos{Labels: map[string]string{"a": "1"}})))))
+}
+
+type pendingFetcher struct {
+	metas   map[ulid.ULID]*metadata.Meta
+	pending map[ulid.ULID]error
+}
+
+func (f *pendingFetcher) Fetch(context.Context) (map[ulid.ULID]*metadata.Meta, map[ulid.ULID]error, error) {
+	metas := make(map[ulid.ULID]*metadata.Meta, len(f.metas))
+	for id, m := range f.metas {
+		if _, ok := f.pending[id]; !ok {
+			metas[id] = m
+		}
+	}
+	return metas, nil, nil
+}
+
+func (f *pendingFetcher) UpdateOnChange(func([]metadata.Meta, error)) {}
+
+func (f *pendingFetcher) Pending() map[ulid.ULID]error { return f.pending }
+
+func TestSyncer_Pending(t *testing.T) {
+	ctx := context.Background()
+	meta := func(id ulid.ULID, lset map[string]string) *metadata.Meta {
+		m := &metadata.Meta{Thanos: metadata.Thanos{Labels: lset}}
+		m.ULID = id
+		return m
+	}
+	a, b := ulid.MustNew(1, nil), ulid.MustNew(2, nil)
+	f := &pendingFetcher{metas: map[ulid.ULID]*metadata.Meta{
+		a: meta(a, map[string]string{"a": "1"}),
+		b: meta(b, map[string]string{"a": "2"}),
+	}}
+	sy, err := NewSyncer(nil, nil, objstore.NewInMemBucket(), f, block.NewDeduplicateFilter(), block.NewIgnoreDeletionMarkFilter(nil, nil, 0), nil, nil, 1)
+	testutil.Ok(t, err)
+
+	groupOf := func(lset map[string]string) *Group {
+		g, err := NewGroup(nil, nil, "", labels.FromMap(lset), 0, false, false, GroupMetrics{})
+		testutil.Ok(t, err)
+		return g
+	}
+	g1, g2 := groupOf(map[string]string{"a": "1"}), groupOf(map[string]string{"a": "2"})
+
+	testutil.Ok(t, sy.SyncMetas(ctx))
+	testutil.Equals(t, 0, len(sy.Pending()))
+	testutil.Assert(t, !sy.Snapshot().mayContainPending(g1), "no pending blocks")
+
+	// Blocks synced before keep their groups while pending, also over multiple syncs.
+	f.pending = map[ulid.ULID]error{a: errors.New("unreadable")}
+	for i := 0; i < 2; i++ {
+		testutil.Ok(t, sy.SyncMetas(ctx))
+		testutil.Equals(t, f.pending, sy.Pending())
+		testutil.Assert(t, sy.Snapshot().mayContainPending(g1), "group of pending block")
+		testutil.Assert(t, !sy.Snapshot().mayContainPending(g2), "other group")
+		testutil.Equals(t, 1.0, promtest.ToFloat64(sy.metrics.pendingBlocks))
+	}
+
+	// Groups of blocks never synced are unknown.
+	c := ulid.MustNew(3, nil)
+	f.pending[c] = errors.New("unreadable")
+	testutil.Ok(t, sy.SyncMetas(ctx))
+	testutil.Assert(t, sy.Snapshot().mayContainPending(g2), "unknown group of pending block")
+}
+
+func TestSyncer_HeldBlocks(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+	logger := log.NewNopLogger()
+
+	upload := func(id ulid.ULID, level int, sources ...ulid.ULID) {
+		m := metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{Version: 1, ULID: id, MinTime: 0, MaxTime: 1000, Compaction: tsdb.BlockMetaCompaction{Level: level, Sources: sources}},
+			Thanos:    metadata.Thanos{Labels: map[string]string{"a": "1"}, Source: metadata.TestSource},
+		}
+		b, err := json.Marshal(&m)
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.MetaFilename), bytes.NewReader(b)))
+	}
+	s1, s2, compacted, other := ulid.MustNew(1, nil), ulid.MustNew(2, nil), ulid.MustNew(3, nil), ulid.MustNew(4, nil)
+	upload(s1, 1, s1)
+	upload(s2, 1, s2)
+	upload(compacted, 2, s1, s2)
+	upload(other, 1, other)
+	testutil.Ok(t, block.PlaceHold(ctx, logger, bkt, compacted, "legal hold"))
+	testutil.Ok(t, block.PlaceHold(ctx, logger, bkt, s2, "legal hold"))
+
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, bkt, 0)
+	fetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, []block.MetadataFilter{
+		ignoreDeletionMarkFilter,
+		duplicateBlocksFilter,
+		block.NewHoldMarkFilter(logger, bkt),
+	}, nil)
+	testutil.Ok(t, err)
+	sy, err := NewSyncer(logger, nil, bkt, fetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, prometheus.NewCounter(prometheus.CounterOpts{}), prometheus.NewCounter(prometheus.CounterOpts{}), 1)
+	testutil.Ok(t, err)
+
+	// The held compacted block still replaces its sources, so they are not compacted again, while it is not compacted
+	// itself.
+	testutil.Ok(t, sy.SyncMetas(ctx))
+	testutil.Equals(t, map[ulid.ULID]*metadata.Meta{other: sy.Metas()[other]}, sy.Metas())
+	testutil.Equals(t, []ulid.ULID{s1, s2}, sy.Snapshot().DuplicateIDs)
+
+	// Sources are garbage collected, except the one under hold.
+	testutil.Ok(t, sy.GarbageCollect(ctx))
+	_, err = metadata.ReadDeletionMark(ctx, bkt, logger, s1.String())
+	testutil.Ok(t, err)
+	_, err = metadata.ReadDeletionMark(ctx, bkt, logger, s2.String())
+	testutil.Equals(t, metadata.ErrorDeletionMarkNotFound, err)
+	_, err = metadata.ReadDeletionMark(ctx, bkt, logger, compacted.String())
+	testutil.Equals(t, metadata.ErrorDeletionMarkNotFound, err)
+}
+
+func TestGroup_DeleteBlock_Held(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+	logger := log.NewNopLogger()
+
+	dir, err := ioutil.TempDir("", "test-group-delete-held")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	id := ulid.MustNew(1, nil)
+	m := &metadata.Meta{
+		BlockMeta: tsdb.BlockMeta{Version: 1, ULID: id, MinTime: 0, MaxTime: 1000, Compaction: tsdb.BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{id}}},
+		Thanos:    metadata.Thanos{Labels: map[string]string{"a": "1"}, Source: metadata.TestSource},
+	}
+	b, err := json.Marshal(m)
+	testutil.Ok(t, err)
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.MetaFilename), bytes.NewReader(b)))
+	testutil.Ok(t, os.MkdirAll(filepath.Join(dir, id.String()), os.ModePerm))
+
+	g, err := NewGroup(logger, bkt, "", labels.FromMap(m.Thanos.Labels), 0, false, false, GroupMetrics{
+		BlocksMarkedForDeletion: prometheus.NewCounter(prometheus.CounterOpts{}),
+	})
+	testutil.Ok(t, err)
+	testutil.Ok(t, g.Add(m))
+
+	// The source is placed under hold after the sync, once its compaction is uploaded, which does not fail the compaction.
+	testutil.Ok(t, block.PlaceHold(ctx, logger, bkt, id, "legal hold"))
+	got, marked, err := g.deleteBlock(ctx, filepath.Join(dir, id.String()), "")
+	testutil.Ok(t, err)
+	testutil.Equals(t, id, got)
+	testutil.Assert(t, !marked, "expected held block not to be marked for deletion")
+	_, err = metadata.ReadDeletionMark(ctx, bkt, logger, id.String())
+	testutil.Equals(t, metadata.ErrorDeletionMarkNotFound, err)
+}
@@ -0,0 +1,212 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+)
+
+// CoverageGap is a time range of a group without raw data, where some downsampled resolutions are missing as well.
+type CoverageGap struct {
+	MinTime int64 `json:"minTime"`
+	MaxTime int64 `json:"maxTime"`
+	// Missing are downsampled resolutions not covering the range.
+	Missing []int64 `json:"missing"`
+	// Lost is true if no resolution covers the range, so it can never be queried.
+	Lost bool `json:"lost"`
+}
+
+// GroupCoverage lists coverage gaps of blocks with the same external labels, across all resolutions.
+type GroupCoverage struct {
+	// Key is the hash of the labels, as in DefaultGroupKey of their groups.
+	Key    string        `json:"key"`
+	Labels labels.Labels `json:"labels"`
+	Gaps   []CoverageGap `json:"gaps"`
+}
+
+// CoverageReport lists groups whose raw data was deleted, e.g. by retention, without being fully covered by
+// downsampled blocks.
+type CoverageReport struct {
+	Time   time.Time       `json:"time"`
+	Groups []GroupCoverage `json:"groups"`
+}
+
+// VerifyCoverage returns coverage gaps found in the given metas. Time ranges between the oldest and the newest block of
+// the labels which are not covered by raw blocks must be covered by both 5m and 1h downsampled blocks; others are gaps.
+func VerifyCoverage(metas map[ulid.ULID]*metadata.Meta) []GroupCoverage {
+	byLabels := map[uint64][]*metadata.Meta{}
+	for _, m := range metas {
+		h := labels.FromMap(m.Thanos.Labels).Hash()
+		byLabels[h] = append(byLabels[h], m)
+	}
+
+	var res []GroupCoverage
+	for h, ms := range byLabels {
+		if gaps := coverageGaps(ms); len(gaps) > 0 {
+			res = append(res, GroupCoverage{
+				Key:    fmt.Sprintf("%v", h),
+				Labels: labels.FromMap(ms[0].Thanos.Labels),
+				Gaps:   gaps,
+			})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key < res[j].Key
+	})
+	return res
+}
+
+func coverageGaps(metas []*metadata.Meta) []CoverageGap {
+	ranges := map[int64][][2]int64{}
+	var bounds []int64
+	for _, m := range metas {
+		res := m.Thanos.Downsample.Resolution
+		ranges[res] = append(ranges[res], [2]int64{m.MinTime, m.MaxTime})
+		bounds = append(bounds, m.MinTime, m.MaxTime)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	for res := range ranges {
+		ranges[res] = mergeRanges(ranges[res])
+	}
+	covered := func(res, t int64) bool {
+		rs := ranges[res]
+		i := sort.Search(len(rs), func(i int) bool { return rs[i][1] > t })
+		return i < len(rs) && rs[i][0] <= t
+	}
+
+	var gaps []CoverageGap
+	for i := 1; i < len(bounds); i++ {
+		mint, maxt := bounds[i-1], bounds[i]
+		if mint == maxt || covered(downsample.ResLevel0, mint) {
+			continue
+		}
+		var missing []int64
+		for _, res := range []int64{downsample.ResLevel1, downsample.ResLevel2} {
+			if !covered(res, mint) {
+				missing = append(missing, res)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		// Adjacent ranges missing the same resolutions are reported as one gap.
+		if n := len(gaps); n > 0 && gaps[n-1].MaxTime == mint && len(gaps[n-1].Missing) == len(missing) && gaps[n-1].Missing[0] == missing[0] {
+			gaps[n-1].MaxTime = maxt
+			continue
+		}
+		gaps = append(gaps, CoverageGap{MinTime: mint, MaxTime: maxt, Missing: missing, Lost: len(missing) == 2})
+	}
+	return gaps
+}
+
+// mergeRanges returns the given time ranges sorted with overlapping and adjacent ranges merged.
+func mergeRanges(rs [][2]int64) [][2]int64 {
+	sort.Slice(rs, func(i, j int) bool { return rs[i][0] < rs[j][0] })
+	res := rs[:0]
+	for _, r := range rs {
+		if n := len(res); n > 0 && r[0] <= res[n-1][1] {
+			if r[1] > res[n-1][1] {
+				res[n-1][1] = r[1]
+			}
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// CoverageVerifier verifies coverage of the synced blocks with VerifyCoverage after each garbage collection, keeping the
+// last report and exposing the total duration of gaps as metrics. Go-routine safe.
+type CoverageVerifier struct {
+	logger log.Logger
+
+	mtx    sync.Mutex
+	report CoverageReport
+
+	gapHours  *prometheus.GaugeVec
+	lostHours prometheus.Gauge
+}
+
+// NewCoverageVerifier returns CoverageVerifier.
+func NewCoverageVerifier(logger log.Logger, reg prometheus.Registerer) *CoverageVerifier {
+	v := &CoverageVerifier{
+		logger: logger,
+		gapHours: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_coverage_gap_hours",
+			Help: "Total hours of time ranges of all groups without raw data that are not covered by blocks of the resolution, as of the last garbage collection.",
+		}, []string{"resolution"}),
+		lostHours: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_coverage_lost_hours",
+			Help: "Total hours of time ranges of all groups not covered by blocks of any resolution, as of the last garbage collection.",
+		}),
+	}
+	for _, res := range []int64{downsample.ResLevel1, downsample.ResLevel2} {
+		v.gapHours.WithLabelValues(strconv.FormatInt(res, 10))
+	}
+	return v
+}
+
+// Report returns the last coverage report.
+func (v *CoverageVerifier) Report() CoverageReport {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	return v.report
+}
+
+func (v *CoverageVerifier) verify(metas map[ulid.ULID]*metadata.Meta) {
+	groups := VerifyCoverage(metas)
+
+	hours := map[int64]float64{downsample.ResLevel1: 0, downsample.ResLevel2: 0}
+	var lost float64
+	for _, g := range groups {
+		for _, gap := range g.Gaps {
+			h := time.Duration(gap.MaxTime-gap.MinTime) * time.Millisecond
+			for _, res := range gap.Missing {
+				hours[res] += h.Hours()
+			}
+			if gap.Lost {
+				lost += h.Hours()
+			}
+		}
+	}
+	for res, h := range hours {
+		v.gapHours.WithLabelValues(strconv.FormatInt(res, 10)).Set(h)
+	}
+	v.lostHours.Set(lost)
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	// Log only once the coverage changes, as it is verified on every garbage collection.
+	if len(groups) > 0 && (len(groups) != len(v.report.Groups) || lost != lostHours(v.report.Groups)) {
+		level.Warn(v.logger).Log("msg", "found time ranges without raw data not covered by downsampled blocks", "groups", len(groups), "lost_hours", lost)
+	}
+	v.report = CoverageReport{Time: time.Now(), Groups: groups}
+}
+
+func lostHours(groups []GroupCoverage) (res float64) {
+	for _, g := range groups {
+		for _, gap := range g.Gaps {
+			if gap.Lost {
+				res += (time.Duration(gap.MaxTime-gap.MinTime) * time.Millisecond).Hours()
+			}
+		}
+	}
+	return res
+}
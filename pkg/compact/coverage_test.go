@@ -0,0 +1,59 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestVerifyCoverage(t *testing.T) {
+	const hour = int64(60 * 60 * 1000)
+
+	metas := map[ulid.ULID]*metadata.Meta{}
+	add := func(lbl string, res, mint, maxt int64) {
+		id := ulid.MustNew(uint64(len(metas)), nil)
+		metas[id] = &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: id, MinTime: mint * hour, MaxTime: maxt * hour},
+			Thanos:    metadata.Thanos{Labels: map[string]string{"a": lbl}, Downsample: metadata.ThanosDownsample{Resolution: res}},
+		}
+	}
+	// Group "1": raw data of [0, 20) is gone; 5m covers [0, 10), 1h covers [0, 5) and [8, 10), [15, 20) is lost.
+	add("1", downsample.ResLevel0, 20, 30)
+	add("1", downsample.ResLevel1, 0, 10)
+	add("1", downsample.ResLevel2, 0, 5)
+	add("1", downsample.ResLevel2, 8, 10)
+	add("1", downsample.ResLevel2, 15, 18)
+	add("1", downsample.ResLevel1, 15, 18)
+	// Group "2" is fully covered by raw and downsampled blocks.
+	add("2", downsample.ResLevel0, 10, 30)
+	add("2", downsample.ResLevel1, 0, 20)
+	add("2", downsample.ResLevel2, 0, 20)
+
+	groups := VerifyCoverage(metas)
+	testutil.Equals(t, 1, len(groups))
+	testutil.Equals(t, labels.FromStrings("a", "1"), groups[0].Labels)
+	testutil.Equals(t, []CoverageGap{
+		{MinTime: 5 * hour, MaxTime: 8 * hour, Missing: []int64{downsample.ResLevel2}},
+		{MinTime: 10 * hour, MaxTime: 15 * hour, Missing: []int64{downsample.ResLevel1, downsample.ResLevel2}, Lost: true},
+		{MinTime: 18 * hour, MaxTime: 20 * hour, Missing: []int64{downsample.ResLevel1, downsample.ResLevel2}, Lost: true},
+	}, groups[0].Gaps)
+
+	v := NewCoverageVerifier(log.NewNopLogger(), prometheus.NewRegistry())
+	v.verify(metas)
+	testutil.Equals(t, groups, v.Report().Groups)
+	testutil.Equals(t, 7.0, promtest.ToFloat64(v.lostHours))
+	testutil.Equals(t, 7.0, promtest.ToFloat64(v.gapHours.WithLabelValues("300000")))
+	testutil.Equals(t, 10.0, promtest.ToFloat64(v.gapHours.WithLabelValues("3600000")))
+}
@@ -0,0 +1,17 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+//go:build !linux
+// +build !linux
+
+package compact
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func threadCPUTime() (time.Duration, error) {
+	return 0, errors.New("per thread CPU time is supported only on linux")
+}
@@ -0,0 +1,187 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// CarryOverFilename is the name of the file in the data directory of the compactor holding groups carried over to the
+// next compaction cycle by CycleDeadline.
+const CarryOverFilename = "carry-over.json"
+
+// carryOver is the content of CarryOverFilename.
+type carryOver struct {
+	// Groups are keys of groups carried over, in the order they are compacted by the next cycle.
+	Groups []string `json:"groups"`
+	// Time is the unix time the groups were carried over at.
+	Time int64 `json:"time"`
+}
+
+// CycleDeadline bounds the duration of compaction cycles, i.e. BucketCompactor.Compact calls. Once the soft deadline of
+// a cycle passes, no more groups are started, and the groups left are carried over to the next cycle, in the order they
+// would have been compacted in. Once the hard deadline passes, running compactions are cancelled and their groups are
+// carried over first. Each cycle compacts groups carried over before all others, so every group is compacted within a
+// bounded number of cycles, however many groups the bucket has. Groups carried over are persisted in a file, so they
+// survive restarts of the compactor.
+type CycleDeadline struct {
+	logger log.Logger
+	soft   time.Duration
+	hard   time.Duration
+	file   string
+
+	mtx   sync.Mutex
+	queue []string
+
+	carriedOver prometheus.Gauge
+	exceeded    *prometheus.CounterVec
+}
+
+// NewCycleDeadline returns CycleDeadline with the given soft and, if non-zero, hard deadline, persisting groups carried
+// over in CarryOverFilename of the given directory. Groups carried over by the last cycle before a restart are read from
+// it.
+func NewCycleDeadline(logger log.Logger, reg prometheus.Registerer, soft, hard time.Duration, dir string) (*CycleDeadline, error) {
+	if soft <= 0 {
+		return nil, errors.Errorf("soft deadline has to be positive, got %v", soft)
+	}
+	if hard != 0 && hard < soft {
+		return nil, errors.Errorf("hard deadline %v is before soft deadline %v", hard, soft)
+	}
+	d := &CycleDeadline{
+		logger: logger,
+		soft:   soft,
+		hard:   hard,
+		file:   filepath.Join(dir, CarryOverFilename),
+		carriedOver: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_cycle_carried_over_groups",
+			Help: "Number of groups carried over to the next compaction cycle, as the last cycle exceeded its deadline.",
+		}),
+		exceeded: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_cycle_deadline_exceeded_total",
+			Help: "Total number of compaction cycles that exceeded their soft or hard deadline.",
+		}, []string{"deadline"}),
+	}
+
+	b, err := ioutil.ReadFile(d.file)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read groups carried over")
+	}
+	var c carryOver
+	if err := json.Unmarshal(b, &c); err != nil {
+		// The queue only orders groups, so a corrupted one is rebuilt by the next cycle.
+		level.Warn(logger).Log("msg", "ignoring corrupted file of groups carried over", "file", d.file, "err", err)
+		return d, nil
+	}
+	d.queue = c.Groups
+	d.carriedOver.Set(float64(len(d.queue)))
+	return d, nil
+}
+
+// CarriedOver returns keys of groups carried over to the next cycle, in the order they are compacted.
+func (d *CycleDeadline) CarriedOver() []string {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	return append([]string(nil), d.queue...)
+}
+
+// start returns the channel receiving once the soft deadline of a cycle started now passes, and the context of its
+// compactions, cancelled once its hard deadline passes.
+func (d *CycleDeadline) start(ctx context.Context) (<-chan time.Time, context.Context, context.CancelFunc) {
+	soft := time.After(d.soft)
+	if d.hard == 0 {
+		cctx, cancel := context.WithCancel(ctx)
+		return soft, cctx, cancel
+	}
+	cctx, cancel := context.WithTimeout(ctx, d.hard)
+	return soft, cctx, cancel
+}
+
+// prioritize returns the given groups with groups carried over first, in the order they were carried over, followed by
+// the other groups in the given order.
+func (d *CycleDeadline) prioritize(groups []*Group) []*Group {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if len(d.queue) == 0 {
+		return groups
+	}
+	byKey := make(map[string]*Group, len(groups))
+	for _, g := range groups {
+		byKey[g.Key()] = g
+	}
+	res := make([]*Group, 0, len(groups))
+	queued := make(map[string]struct{}, len(d.queue))
+	for _, key := range d.queue {
+		if g, ok := byKey[key]; ok {
+			res = append(res, g)
+			queued[key] = struct{}{}
+		}
+	}
+	for _, g := range groups {
+		if _, ok := queued[g.Key()]; !ok {
+			res = append(res, g)
+		}
+	}
+	return res
+}
+
+// carryOver persists the given keys of groups as carried over to the next cycle, replacing groups carried over before.
+// No keys mean the cycle attended to all groups.
+func (d *CycleDeadline) carryOver(keys []string) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if len(keys) == 0 {
+		d.queue = nil
+		d.carriedOver.Set(0)
+		if err := os.Remove(d.file); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove groups carried over")
+		}
+		return nil
+	}
+
+	b, err := json.Marshal(carryOver{Groups: keys, Time: time.Now().Unix()})
+	if err != nil {
+		return errors.Wrap(err, "json encode groups carried over")
+	}
+	if err := os.MkdirAll(filepath.Dir(d.file), 0750); err != nil {
+		return errors.Wrap(err, "create directory of groups carried over")
+	}
+	tmp := d.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0640); err != nil {
+		return errors.Wrap(err, "write groups carried over")
+	}
+	if err := os.Rename(tmp, d.file); err != nil {
+		return errors.Wrap(err, "rename file of groups carried over")
+	}
+	d.queue = keys
+	d.carriedOver.Set(float64(len(keys)))
+	return nil
+}
+
+// observeExceeded records that a cycle exceeded its soft deadline, and its hard deadline too, if given.
+func (d *CycleDeadline) observeExceeded(hard bool, carried int) {
+	d.exceeded.WithLabelValues("soft").Inc()
+	if hard {
+		d.exceeded.WithLabelValues("hard").Inc()
+	}
+	level.Warn(d.logger).Log("msg", "compaction cycle exceeded its deadline; carrying groups left over to the next cycle",
+		"soft_deadline", d.soft, "hard_deadline", d.hard, "hard_deadline_exceeded", hard, "carried_over_groups", carried)
+}
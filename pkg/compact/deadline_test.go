@@ -0,0 +1,66 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestCycleDeadline_CarryOver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cycle-deadline")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var groups []*Group
+	for _, key := range []string{"0@1", "0@2", "0@3", "0@4"} {
+		g, err := NewGroup(nil, nil, key, labels.FromStrings("a", key), 0, false, false, GroupMetrics{})
+		testutil.Ok(t, err)
+		groups = append(groups, g)
+	}
+	keys := func(groups []*Group) (res []string) {
+		for _, g := range groups {
+			res = append(res, g.Key())
+		}
+		return res
+	}
+
+	_, err = NewCycleDeadline(log.NewNopLogger(), nil, 0, time.Hour, dir)
+	testutil.NotOk(t, err)
+	_, err = NewCycleDeadline(log.NewNopLogger(), nil, time.Hour, time.Minute, dir)
+	testutil.NotOk(t, err)
+
+	d, err := NewCycleDeadline(log.NewNopLogger(), nil, time.Hour, 0, dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, keys(groups), keys(d.prioritize(groups)))
+
+	// Groups carried over go first, in their order, also after a restart. Groups gone since are ignored.
+	testutil.Ok(t, d.carryOver([]string{"0@4", "0@5", "0@2"}))
+	testutil.Equals(t, []string{"0@4", "0@2", "0@1", "0@3"}, keys(d.prioritize(groups)))
+
+	d, err = NewCycleDeadline(log.NewNopLogger(), nil, time.Hour, 0, dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"0@4", "0@5", "0@2"}, d.CarriedOver())
+	testutil.Equals(t, []string{"0@4", "0@2", "0@1", "0@3"}, keys(d.prioritize(groups)))
+
+	// A cycle attending to all groups clears them.
+	testutil.Ok(t, d.carryOver(nil))
+	testutil.Equals(t, keys(groups), keys(d.prioritize(groups)))
+	_, err = os.Stat(filepath.Join(dir, CarryOverFilename))
+	testutil.Assert(t, os.IsNotExist(err), "expected file of groups carried over to be removed, got %v", err)
+
+	// Corrupted files are ignored.
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(dir, CarryOverFilename), []byte("{"), 0640))
+	d, err = NewCycleDeadline(log.NewNopLogger(), nil, time.Hour, 0, dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(d.CarriedOver()))
+}
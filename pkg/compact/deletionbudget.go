@@ -0,0 +1,61 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DeletionBudget caps physical deletions of blocks marked for deletion per cleanup cycle, spreading mass deletions, e.g.
+// after retention was shortened, over several cycles instead of triggering early deletion fees and throttling of object
+// storage providers. Zero values mean no limit. At least one block is deleted per cycle, even if larger than MaxBytes.
+type DeletionBudget struct {
+	MaxBlocks int
+	MaxBytes  int64
+}
+
+// Validate returns error if the budget is negative.
+func (b DeletionBudget) Validate() error {
+	if b.MaxBlocks < 0 || b.MaxBytes < 0 {
+		return errors.Errorf("deletion budget must not be negative, got %d blocks and %d bytes", b.MaxBlocks, b.MaxBytes)
+	}
+	return nil
+}
+
+// deletionSpend is the part of the budget spent in a cycle.
+type deletionSpend struct {
+	blocks int
+	bytes  int64
+}
+
+// allows returns true if a block of the given size can be deleted after spending the given part of the budget.
+func (b DeletionBudget) allows(spent deletionSpend, size int64) bool {
+	if spent.blocks == 0 {
+		return true
+	}
+	if b.MaxBlocks > 0 && spent.blocks >= b.MaxBlocks {
+		return false
+	}
+	return b.MaxBytes <= 0 || spent.bytes+size <= b.MaxBytes
+}
+
+type deletionBudgetMetrics struct {
+	backlog   prometheus.Gauge
+	exhausted prometheus.Counter
+}
+
+func newDeletionBudgetMetrics(reg prometheus.Registerer) *deletionBudgetMetrics {
+	return &deletionBudgetMetrics{
+		backlog: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_deletion_backlog_blocks",
+			Help: "Number of blocks due for deletion left for next cleanup cycles by the last one.",
+		}),
+		exhausted: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_deletion_budget_exhausted_total",
+			Help: "Total number of cleanup cycles leaving blocks due for deletion over the deletion budget for next cycles.",
+		}),
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestDeletionBudget_Allows(t *testing.T) {
+	b := DeletionBudget{MaxBlocks: 2, MaxBytes: 100}
+	testutil.Assert(t, b.allows(deletionSpend{}, 1000), "expected first block deleted even if over budget")
+	testutil.Assert(t, b.allows(deletionSpend{blocks: 1, bytes: 50}, 50), "expected block within budget")
+	testutil.Assert(t, !b.allows(deletionSpend{blocks: 1, bytes: 50}, 51), "expected block over bytes budget")
+	testutil.Assert(t, !b.allows(deletionSpend{blocks: 2, bytes: 2}, 1), "expected block over blocks budget")
+	testutil.Assert(t, DeletionBudget{}.allows(deletionSpend{blocks: 1000, bytes: 1 << 40}, 1<<40), "expected no limit")
+
+	testutil.Ok(t, b.Validate())
+	testutil.NotOk(t, DeletionBudget{MaxBlocks: -1}.Validate())
+}
+
+func TestBlocksCleaner_DeletionBudget(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+	logger := log.NewNopLogger()
+
+	// Blocks are marked in reverse order of their IDs, so the last block is marked the longest ago.
+	var ids []ulid.ULID
+	for i := 0; i < 4; i++ {
+		id := ulid.MustNew(uint64(i+1), nil)
+		ids = append(ids, id)
+
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&metadata.Meta{BlockMeta: tsdb.BlockMeta{ULID: id, Version: 1}}))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.MetaFilename), &buf))
+		mark, err := json.Marshal(metadata.DeletionMark{ID: id, DeletionTime: time.Now().Add(-48*time.Hour - time.Duration(i)*time.Minute).Unix(), Version: metadata.DeletionMarkVersion1})
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.DeletionMarkFilename), bytes.NewReader(mark)))
+	}
+
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, bkt, 0)
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, []block.MetadataFilter{ignoreDeletionMarkFilter}, nil)
+	testutil.Ok(t, err)
+	blocksCleaned := prometheus.NewCounter(prometheus.CounterOpts{})
+	cleaner := NewBlocksCleanerWithBudget(logger, prometheus.NewRegistry(), bkt, ignoreDeletionMarkFilter, 24*time.Hour, 2, DeletionBudget{MaxBlocks: 3, MaxBytes: 1000}, blocksCleaned, prometheus.NewCounter(prometheus.CounterOpts{}))
+
+	exists := func() (res []bool) {
+		for _, id := range ids {
+			ok, err := bkt.Exists(ctx, path.Join(id.String(), metadata.MetaFilename))
+			testutil.Ok(t, err)
+			res = append(res, ok)
+		}
+		return res
+	}
+
+	_, _, err = metaFetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Ok(t, cleaner.DeleteMarkedBlocks(ctx))
+	testutil.Equals(t, 3.0, promtest.ToFloat64(blocksCleaned))
+	testutil.Equals(t, []bool{true, false, false, false}, exists())
+	testutil.Equals(t, 1.0, promtest.ToFloat64(cleaner.budgetMetrics.backlog))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(cleaner.budgetMetrics.exhausted))
+
+	// The block over budget spills over to the next cycle.
+	_, _, err = metaFetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Ok(t, cleaner.DeleteMarkedBlocks(ctx))
+	testutil.Equals(t, 4.0, promtest.ToFloat64(blocksCleaned))
+	testutil.Equals(t, []bool{false, false, false, false}, exists())
+	testutil.Equals(t, 0.0, promtest.ToFloat64(cleaner.budgetMetrics.backlog))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(cleaner.budgetMetrics.exhausted))
+}
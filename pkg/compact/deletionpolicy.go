@@ -0,0 +1,155 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// Reasons of deletions evaluated by DeletionPolicy, in addition to metadata.EmptyCompactionResultDeletionReason and
+// metadata.KeepLastBlocksDeletionReason. They are not recorded in deletion marks.
+const (
+	// CompactedDeletionReason is given for source blocks of a compaction, once the compacted block is uploaded.
+	CompactedDeletionReason metadata.DeletionReason = "compacted"
+	// DuplicateDeletionReason is given for blocks garbage collected because their data is part of other blocks.
+	DuplicateDeletionReason metadata.DeletionReason = "duplicate"
+	// RetentionDeletionReason is given for blocks older than the retention of their resolution.
+	RetentionDeletionReason metadata.DeletionReason = "retention"
+	// RepairedDeletionReason is given for broken blocks, once their repaired copy is uploaded.
+	RepairedDeletionReason metadata.DeletionReason = "repaired"
+)
+
+// DeletionPolicy decides whether blocks may be marked for deletion, e.g. by evaluating compliance rules in an external
+// policy engine, so that organizations can veto deletions of blocks without forking the compactor.
+type DeletionPolicy interface {
+	// AllowDeletion returns true if the block with the given meta may be marked for deletion for the given reason.
+	AllowDeletion(ctx context.Context, meta *metadata.Meta, reason metadata.DeletionReason) (bool, error)
+}
+
+// DeletionPolicies returns DeletionPolicy allowing deletions allowed by all given policies, evaluated in order.
+func DeletionPolicies(policies ...DeletionPolicy) DeletionPolicy {
+	return deletionPolicies(policies)
+}
+
+type deletionPolicies []DeletionPolicy
+
+func (ps deletionPolicies) AllowDeletion(ctx context.Context, meta *metadata.Meta, reason metadata.DeletionReason) (bool, error) {
+	for _, p := range ps {
+		if ok, err := p.AllowDeletion(ctx, meta, reason); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// DeletionGate asks a DeletionPolicy before blocks are marked for deletion. Denied blocks are kept in the bucket and
+// counted by reason. A nil DeletionGate allows all deletions.
+type DeletionGate struct {
+	logger log.Logger
+	policy DeletionPolicy
+
+	denied   *prometheus.CounterVec
+	failures prometheus.Counter
+}
+
+// NewDeletionGate returns DeletionGate evaluating the given policy.
+func NewDeletionGate(logger log.Logger, reg prometheus.Registerer, policy DeletionPolicy) *DeletionGate {
+	return &DeletionGate{
+		logger: logger,
+		policy: policy,
+		denied: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_deletion_policy_denied_total",
+			Help: "Total number of deletions of blocks denied by the deletion policy.",
+		}, []string{"reason"}),
+		failures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_deletion_policy_evaluation_failures_total",
+			Help: "Total number of failed evaluations of the deletion policy.",
+		}),
+	}
+}
+
+// allow returns true if the block with the given meta may be marked for deletion for the given reason. Blocks are never
+// deleted if the policy cannot be evaluated; the error is returned instead.
+func (g *DeletionGate) allow(ctx context.Context, meta *metadata.Meta, reason metadata.DeletionReason) (bool, error) {
+	if g == nil {
+		return true, nil
+	}
+	ok, err := g.policy.AllowDeletion(ctx, meta, reason)
+	if err != nil {
+		g.failures.Inc()
+		return false, errors.Wrapf(err, "evaluate deletion policy for block %s", meta.ULID)
+	}
+	if !ok {
+		g.denied.WithLabelValues(string(reason)).Inc()
+		level.Warn(g.logger).Log("msg", "deletion policy denied marking block for deletion; keeping it", "block", meta.ULID, "reason", reason)
+	}
+	return ok, nil
+}
+
+// HTTPDeletionPolicy evaluates deletions using the data API of Open Policy Agent, or any service speaking the same
+// protocol: the block meta and the deletion reason are POSTed as {"input": {"meta": ..., "reason": ...}} and the
+// deletion is allowed only if the response is {"result": true}. An undefined result denies the deletion.
+type HTTPDeletionPolicy struct {
+	logger log.Logger
+	url    string
+	client *http.Client
+}
+
+// NewHTTPDeletionPolicy returns HTTPDeletionPolicy querying the given URL, e.g.
+// http://localhost:8181/v1/data/thanos/compact/allow_deletion, with the given timeout per evaluation.
+func NewHTTPDeletionPolicy(logger log.Logger, url string, timeout time.Duration) *HTTPDeletionPolicy {
+	return &HTTPDeletionPolicy{logger: logger, url: url, client: &http.Client{Timeout: timeout}}
+}
+
+type deletionPolicyInput struct {
+	Meta   *metadata.Meta          `json:"meta"`
+	Reason metadata.DeletionReason `json:"reason"`
+}
+
+// AllowDeletion implements DeletionPolicy.
+func (p *HTTPDeletionPolicy) AllowDeletion(ctx context.Context, meta *metadata.Meta, reason metadata.DeletionReason) (bool, error) {
+	b, err := json.Marshal(struct {
+		Input deletionPolicyInput `json:"input"`
+	}{Input: deletionPolicyInput{Meta: meta, Reason: reason}})
+	if err != nil {
+		return false, errors.Wrap(err, "json encode policy input")
+	}
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(b))
+	if err != nil {
+		return false, errors.Wrap(err, "create policy request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, errors.Wrapf(err, "query policy %s", p.url)
+	}
+	defer runutil.ExhaustCloseWithLogOnErr(p.logger, resp.Body, "policy response body")
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return false, errors.Errorf("query policy %s: unexpected status %s: %s", p.url, resp.Status, bytes.TrimSpace(body))
+	}
+	var res struct {
+		Result *bool `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return false, errors.Wrap(err, "decode policy response")
+	}
+	return res.Result != nil && *res.Result, nil
+}
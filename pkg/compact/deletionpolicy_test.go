@@ -0,0 +1,92 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestDeletionGate_HTTPDeletionPolicy(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	var (
+		allowed = ulid.MustNew(1, nil)
+		denied  = ulid.MustNew(2, nil)
+		failing = ulid.MustNew(3, nil)
+	)
+	// Policy keeps blocks with the "legal_hold" external label and fails evaluation of the failing block.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input deletionPolicyInput `json:"input"`
+		}
+		testutil.Ok(t, json.NewDecoder(r.Body).Decode(&req))
+		testutil.Equals(t, RetentionDeletionReason, req.Input.Reason)
+
+		switch {
+		case req.Input.Meta.ULID == failing:
+			http.Error(w, "policy unavailable", http.StatusServiceUnavailable)
+		case req.Input.Meta.Thanos.Labels["legal_hold"] != "":
+			_, _ = w.Write([]byte(`{"result": false}`))
+		default:
+			_, _ = w.Write([]byte(`{"result": true}`))
+		}
+	}))
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	gate := NewDeletionGate(log.NewNopLogger(), reg, NewHTTPDeletionPolicy(log.NewNopLogger(), srv.URL, time.Minute))
+
+	metas := map[ulid.ULID]*metadata.Meta{}
+	for id, lset := range map[ulid.ULID]map[string]string{
+		allowed: {"cluster": "a"},
+		denied:  {"cluster": "a", "legal_hold": "case-1"},
+	} {
+		metas[id] = &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: id, MinTime: 0, MaxTime: 1000},
+			Thanos:    metadata.Thanos{Labels: lset},
+		}
+	}
+	retention := map[ResolutionLevel]time.Duration{ResolutionLevelRaw: time.Hour}
+	testutil.Ok(t, ApplyRetentionPolicyByResolution(ctx, log.NewNopLogger(), bkt, metas, retention, prometheus.NewCounter(prometheus.CounterOpts{Name: "marked"}), gate))
+
+	for id, wantMarked := range map[ulid.ULID]bool{allowed: true, denied: false} {
+		exists, err := bkt.Exists(ctx, path.Join(id.String(), metadata.DeletionMarkFilename))
+		testutil.Ok(t, err)
+		testutil.Equals(t, wantMarked, exists, "block %s", id)
+	}
+	testutil.Equals(t, 1.0, promtest.ToFloat64(gate.denied.WithLabelValues(string(RetentionDeletionReason))))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(gate.failures))
+
+	// Blocks are kept if the policy cannot be evaluated.
+	metas = map[ulid.ULID]*metadata.Meta{failing: {BlockMeta: tsdb.BlockMeta{ULID: failing, MinTime: 0, MaxTime: 1000}}}
+	testutil.NotOk(t, ApplyRetentionPolicyByResolution(ctx, log.NewNopLogger(), bkt, metas, retention, prometheus.NewCounter(prometheus.CounterOpts{Name: "marked"}), gate))
+	exists, err := bkt.Exists(ctx, path.Join(failing.String(), metadata.DeletionMarkFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, !exists, "block failing evaluation must not be marked for deletion")
+	testutil.Equals(t, 1.0, promtest.ToFloat64(gate.failures))
+}
+
+func TestDeletionGate_Nil(t *testing.T) {
+	var gate *DeletionGate
+	ok, err := gate.allow(context.Background(), &metadata.Meta{}, CompactedDeletionReason)
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "nil gate must allow all deletions")
+}
@@ -4,6 +4,7 @@
 package downsample
 
 import (
+	"context"
 	"math"
 	"math/rand"
 	"os"
@@ -44,6 +45,20 @@ func Downsample(
 	b tsdb.BlockReader,
 	dir string,
 	resolution int64,
+) (id ulid.ULID, err error) {
+	// Generate new block id.
+	uid := ulid.MustNew(ulid.Now(), rand.New(rand.NewSource(time.Now().UnixNano())))
+	return downsample(context.Background(), logger, origMeta, b, dir, resolution, uid)
+}
+
+func downsample(
+	ctx context.Context,
+	logger log.Logger,
+	origMeta *metadata.Meta,
+	b tsdb.BlockReader,
+	dir string,
+	resolution int64,
+	uid ulid.ULID,
 ) (id ulid.ULID, err error) {
 	if origMeta.Thanos.Downsample.Resolution >= resolution {
 		return id, errors.New("target resolution not lower than existing one")
@@ -61,9 +76,6 @@ func Downsample(
 	}
 	defer runutil.CloseWithErrCapture(&err, chunkr, "downsample chunk reader")
 
-	// Generate new block id.
-	uid := ulid.MustNew(ulid.Now(), rand.New(rand.NewSource(time.Now().UnixNano())))
-
 	// Create block directory to populate with chunks, meta and index files into.
 	blockDir := filepath.Join(dir, uid.String())
 	if err := os.MkdirAll(blockDir, 0777); err != nil {
@@ -106,6 +118,9 @@ func Downsample(
 		reuseIt    chunkenc.Iterator
 	)
 	for postings.Next() {
+		if ctx.Err() != nil {
+			return id, ctx.Err()
+		}
 		lset = lset[:0]
 		chks = chks[:0]
 		all = all[:0]
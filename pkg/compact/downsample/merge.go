@@ -0,0 +1,240 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package downsample
+
+import (
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+)
+
+// aggrWindow holds count, sum, min and max aggregates of a single source chunk within a single downsampling window.
+type aggrWindow struct {
+	t   int64 // Timestamp of the last aggregate of the source chunk within the window.
+	v   [AggrCounter]float64
+	set [AggrCounter]bool
+}
+
+func (w *aggrWindow) add(at AggrType, t int64, v float64) {
+	if t > w.t {
+		w.t = t
+	}
+	if !w.set[at] {
+		w.v[at], w.set[at] = v, true
+		return
+	}
+	// A source chunk has multiple aggregates within a window if the chunk was cut in its middle.
+	switch at {
+	case AggrCount, AggrSum:
+		w.v[at] += v
+	case AggrMin:
+		w.v[at] = math.Min(w.v[at], v)
+	case AggrMax:
+		w.v[at] = math.Max(w.v[at], v)
+	}
+}
+
+// aggrMerge selects how mergeAggrChunks merges aggregates of overlapping chunks.
+type aggrMerge int
+
+const (
+	aggrMergeConcat aggrMerge = iota
+	aggrMergeDedup
+	aggrMergeCounter
+)
+
+// MergeAggrChunks merges overlapping aggregate chunks of the same series and the given resolution, e.g. of replicas of
+// the same data, sorted by min time, into a single aggregate chunk.
+// Within each downsampling window, the count, sum, min and max aggregates are all taken from the source chunk that
+// aggregated the most samples in the window, so they stay consistent with each other and samples of overlapping chunks
+// are never counted twice. Counters of all chunks are deduplicated in time, applying counter resets between them as
+// queries do, so the first and last raw values needed to detect resets are retained.
+func MergeAggrChunks(chks []chunks.Meta, resolution int64) ([]chunks.Meta, error) {
+	return mergeAggrChunks(chks, resolution, aggrMergeCounter)
+}
+
+// DedupAggrChunks merges overlapping aggregate chunks like MergeAggrChunks, but counters of all chunks are only
+// deduplicated by timestamp, keeping the value of the first chunk, without applying counter resets between them.
+func DedupAggrChunks(chks []chunks.Meta, resolution int64) ([]chunks.Meta, error) {
+	return mergeAggrChunks(chks, resolution, aggrMergeDedup)
+}
+
+// ConcatAggrChunks merges overlapping aggregate chunks like MergeAggrChunks, but concatenates them in order: windows and
+// counters of each chunk are taken only after the last ones taken from the chunks before, so earlier chunks win where
+// chunks overlap.
+func ConcatAggrChunks(chks []chunks.Meta, resolution int64) ([]chunks.Meta, error) {
+	return mergeAggrChunks(chks, resolution, aggrMergeConcat)
+}
+
+func mergeAggrChunks(chks []chunks.Meta, resolution int64, how aggrMerge) ([]chunks.Meta, error) {
+	var (
+		picked   = map[int64]*aggrWindow{}
+		lastEnd  = int64(math.MinInt64)
+		counters = make([]chunkenc.Iterator, 0, len(chks))
+	)
+	for _, c := range chks {
+		ac, ok := c.Chunk.(*AggrChunk)
+		if !ok {
+			return nil, errors.Errorf("expected downsampled chunk (*downsample.AggrChunk) got %T instead", c.Chunk)
+		}
+
+		windows := map[int64]*aggrWindow{}
+		for at := AggrCount; at < AggrCounter; at++ {
+			chk, err := ac.Get(at)
+			if err == ErrAggrNotExist {
+				continue
+			} else if err != nil {
+				return nil, errors.Wrapf(err, "get %s aggregate", at)
+			}
+			it := chk.Iterator(nil)
+			for it.Next() {
+				t, v := it.At()
+				end := currentWindow(t, resolution)
+				w, ok := windows[end]
+				if !ok {
+					w = &aggrWindow{t: t}
+					windows[end] = w
+				}
+				w.add(at, t, v)
+			}
+			if it.Err() != nil {
+				return nil, errors.Wrapf(it.Err(), "iterate %s aggregate", at)
+			}
+		}
+		chunkEnd := lastEnd
+		for end, w := range windows {
+			if how == aggrMergeConcat {
+				if end > lastEnd {
+					picked[end] = w
+				}
+				if end > chunkEnd {
+					chunkEnd = end
+				}
+				continue
+			}
+			// Ties are won by earlier chunks.
+			if p, ok := picked[end]; !ok || w.v[AggrCount] > p.v[AggrCount] {
+				picked[end] = w
+			}
+		}
+		lastEnd = chunkEnd
+
+		chk, err := ac.Get(AggrCounter)
+		if err == ErrAggrNotExist {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrap(err, "get counter aggregate")
+		}
+		counters = append(counters, chk.Iterator(nil))
+	}
+
+	ends := make([]int64, 0, len(picked))
+	for end := range picked {
+		ends = append(ends, end)
+	}
+	sort.Slice(ends, func(i, j int) bool { return ends[i] < ends[j] })
+
+	var (
+		res  [5]chunkenc.Chunk
+		apps [5]chunkenc.Appender
+		mint = int64(math.MaxInt64)
+		maxt = int64(math.MinInt64)
+		add  = func(at AggrType, t int64, v float64) {
+			if res[at] == nil {
+				res[at] = chunkenc.NewXORChunk()
+				apps[at], _ = res[at].Appender()
+			}
+			apps[at].Append(t, v)
+			// As for chunks written by downsampling, the time range is the one of the windows, not of raw counter values.
+			if at == AggrCounter {
+				return
+			}
+			if t < mint {
+				mint = t
+			}
+			if t > maxt {
+				maxt = t
+			}
+		}
+	)
+	for _, end := range ends {
+		w := picked[end]
+		for at := AggrCount; at < AggrCounter; at++ {
+			if w.set[at] {
+				add(at, w.t, w.v[at])
+			}
+		}
+	}
+
+	switch {
+	case len(counters) == 0:
+	case how == aggrMergeCounter:
+		it := NewApplyCounterResetsIterator(counters...)
+		for it.Next() {
+			t, v := it.At()
+			add(AggrCounter, t, v)
+		}
+		if it.Err() != nil {
+			return nil, errors.Wrap(it.Err(), "iterate counter aggregates")
+		}
+		if it.total > 0 {
+			// Retain last raw value; see ApplyCounterResetsSeriesIterator.
+			add(AggrCounter, it.lastT, it.lastV)
+		}
+	default:
+		type sourceSample struct {
+			sample
+			src int
+		}
+		var (
+			samples []sourceSample
+			lastT   = int64(math.MinInt64)
+		)
+		for src, it := range counters {
+			chunkLastT := lastT
+			for it.Next() {
+				t, v := it.At()
+				if how == aggrMergeConcat && t <= lastT {
+					continue
+				}
+				samples = append(samples, sourceSample{sample: sample{t: t, v: v}, src: src})
+				if t > chunkLastT {
+					chunkLastT = t
+				}
+			}
+			if it.Err() != nil {
+				return nil, errors.Wrap(it.Err(), "iterate counter aggregates")
+			}
+			lastT = chunkLastT
+		}
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].t < samples[j].t })
+		for i, smpl := range samples {
+			// Counter aggregates end with the last raw value at the time of their last sample, so only ties between
+			// chunks are deduplicated.
+			if i > 0 && smpl.t == samples[i-1].t && smpl.src != samples[i-1].src {
+				continue
+			}
+			add(AggrCounter, smpl.t, smpl.v)
+		}
+	}
+
+	if mint > maxt {
+		if res[AggrCounter] == nil {
+			return nil, nil
+		}
+		// Counters only, as of the source chunks.
+		for _, c := range chks {
+			if c.MinTime < mint {
+				mint = c.MinTime
+			}
+			if c.MaxTime > maxt {
+				maxt = c.MaxTime
+			}
+		}
+	}
+	return []chunks.Meta{{MinTime: mint, MaxTime: maxt, Chunk: EncodeAggrChunk(res)}}, nil
+}
@@ -0,0 +1,99 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package downsample
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/tsdb/chunks"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestMergeAggrChunks(t *testing.T) {
+	// Replicas scraping the same counter, one minute apart, overlapping between 10m and 20m.
+	raw := func(from, to int64) []sample {
+		var res []sample
+		for m := from; m <= to; m++ {
+			res = append(res, sample{t: m * 60 * 1000, v: float64(m)})
+		}
+		return res
+	}
+	replicaA := downsampleRaw(raw(0, 20), ResLevel1)
+	replicaB := downsampleRaw(raw(10, 30), ResLevel1)
+	testutil.Equals(t, 1, len(replicaA))
+	testutil.Equals(t, 1, len(replicaB))
+
+	merged, err := MergeAggrChunks([]chunks.Meta{replicaA[0], replicaB[0]}, ResLevel1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(merged))
+
+	// Aggregates of each window are those of the union of both replicas.
+	expected := downsampleRaw(raw(0, 30), ResLevel1)
+	testutil.Equals(t, expected[0].MinTime, merged[0].MinTime)
+	testutil.Equals(t, expected[0].MaxTime, merged[0].MaxTime)
+	for _, at := range []AggrType{AggrCount, AggrSum, AggrMin, AggrMax} {
+		testutil.Equals(t, aggrSamples(t, expected[0], at), aggrSamples(t, merged[0], at), "aggregate %s", at)
+	}
+
+	// Counters are deduplicated in time, retaining the last raw value of the merged chunk.
+	testutil.Equals(t, []sample{
+		{0, 0}, {299999, 4}, {599999, 9}, {899999, 14}, {1199999, 19}, {1200000, 20},
+		{1499999, 24}, {1799999, 29}, {1800000, 30}, {1800000, 30},
+	}, aggrSamples(t, merged[0], AggrCounter))
+
+	_, err = MergeAggrChunks([]chunks.Meta{{Chunk: replicaA[0].Chunk}, {Chunk: nil}}, ResLevel1)
+	testutil.NotOk(t, err)
+}
+
+func TestConcatAndDedupAggrChunks(t *testing.T) {
+	raw := func(from, to int64, offset float64) []sample {
+		var res []sample
+		for m := from; m <= to; m++ {
+			res = append(res, sample{t: m * 60 * 1000, v: float64(m) + offset})
+		}
+		return res
+	}
+	// Replica B lags replica A by one, overlapping between 10m and 20m.
+	replicaA := downsampleRaw(raw(0, 20, 0), ResLevel1)
+	replicaB := downsampleRaw(raw(10, 30, -1), ResLevel1)
+
+	// Windows and counters of replica A win where both overlap.
+	merged, err := ConcatAggrChunks([]chunks.Meta{replicaA[0], replicaB[0]}, ResLevel1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(merged))
+	testutil.Equals(t, []sample{{299999, 5}, {599999, 5}, {899999, 5}, {1199999, 5}, {1200000, 1}, {1799999, 5}, {1800000, 1}},
+		aggrSamples(t, merged[0], AggrCount))
+	testutil.Equals(t, []sample{
+		{0, 0}, {299999, 4}, {599999, 9}, {899999, 14}, {1199999, 19}, {1200000, 20}, {1200000, 20},
+		{1499999, 23}, {1799999, 28}, {1800000, 29}, {1800000, 29},
+	}, aggrSamples(t, merged[0], AggrCounter))
+
+	// Windows are picked like by MergeAggrChunks, but counters are interleaved without applying resets between them, with
+	// replica A winning ties.
+	merged, err = DedupAggrChunks([]chunks.Meta{replicaA[0], replicaB[0]}, ResLevel1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(merged))
+	expected, err := MergeAggrChunks([]chunks.Meta{replicaA[0], replicaB[0]}, ResLevel1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, aggrSamples(t, expected[0], AggrCount), aggrSamples(t, merged[0], AggrCount))
+	testutil.Equals(t, []sample{
+		{0, 0}, {299999, 4}, {599999, 9}, {600000, 9}, {899999, 14}, {1199999, 19}, {1200000, 20}, {1200000, 20},
+		{1499999, 23}, {1799999, 28}, {1800000, 29}, {1800000, 29},
+	}, aggrSamples(t, merged[0], AggrCounter))
+}
+
+func aggrSamples(t *testing.T, chk chunks.Meta, at AggrType) []sample {
+	c, err := chk.Chunk.(*AggrChunk).Get(at)
+	testutil.Ok(t, err)
+
+	var res []sample
+	it := c.Iterator(nil)
+	for it.Next() {
+		ts, v := it.At()
+		res = append(res, sample{t: ts, v: v})
+	}
+	testutil.Ok(t, it.Err())
+	return res
+}
@@ -202,6 +202,7 @@ func (w *streamedBlockWriter) syncDir() (err error) {
 // writeMetaFile writes meta file.
 func (w *streamedBlockWriter) writeMetaFile() error {
 	w.meta.Version = metadata.MetaVersion1
+	w.meta.Thanos.Provenance = w.meta.Thanos.IngestionSources()
 	w.meta.Thanos.Source = metadata.CompactorSource
 	w.meta.Stats.NumChunks = w.totalChunks
 	w.meta.Stats.NumSamples = w.totalSamples
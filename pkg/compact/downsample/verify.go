@@ -0,0 +1,304 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package downsample
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	tsdberrors "github.com/prometheus/prometheus/tsdb/errors"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// DownsampleBlock downsamples the block in the given local directory to the given resolution, writes the result next to
+// it, i.e. into the parent directory, and verifies the result with VerifyDownsampled. Unlike Downsample, ID of the result
+// is derived from the ID of the source block and the resolution, so downsampling the same block always gives the same
+// block. It is meant for tools and tests working on local blocks.
+func DownsampleBlock(ctx context.Context, logger log.Logger, bdir string, resolution int64) (id ulid.ULID, err error) {
+	meta, err := metadata.Read(bdir)
+	if err != nil {
+		return id, errors.Wrapf(err, "read meta of %s", bdir)
+	}
+
+	b, err := tsdb.OpenBlock(logger, bdir, poolFor(meta.Thanos.Downsample.Resolution))
+	if err != nil {
+		return id, errors.Wrapf(err, "open block %s", bdir)
+	}
+	defer runutil.CloseWithErrCapture(&err, b, "downsample source block")
+
+	dir := filepath.Dir(bdir)
+	id, err = downsample(ctx, logger, meta, b, dir, resolution, downsampledID(meta.ULID, resolution))
+	if err != nil {
+		return id, errors.Wrapf(err, "downsample block %s to resolution %d", meta.ULID, resolution)
+	}
+	if err := VerifyDownsampled(bdir, filepath.Join(dir, id.String())); err != nil {
+		return id, errors.Wrapf(err, "verify block %s downsampled from %s", id, meta.ULID)
+	}
+	return id, nil
+}
+
+// downsampledID returns ID of the block downsampled from the given block to the given resolution. It has the time of the
+// given ID and entropy derived from both.
+func downsampledID(from ulid.ULID, resolution int64) ulid.ULID {
+	var res [8]byte
+	binary.BigEndian.PutUint64(res[:], uint64(resolution))
+	h := sha256.New()
+	_, _ = h.Write(from[:])
+	_, _ = h.Write(res[:])
+	return ulid.MustNew(from.Time(), bytes.NewReader(h.Sum(nil)))
+}
+
+func poolFor(resolution int64) chunkenc.Pool {
+	if resolution == ResLevel0 {
+		return chunkenc.NewPool()
+	}
+	return NewPool()
+}
+
+// VerifyDownsampled verifies that the block in dir is a valid downsampling of the block in origDir. It checks that every
+// series of the source block with samples is present in the downsampled one, that all its chunks are aggregate chunks
+// ordered and within the time range of samples of the source series, with sum, min and max aggregates of the same number
+// of samples as the count one, and that the total count of samples aggregated by them equals the count of samples of the
+// source series.
+func VerifyDownsampled(origDir, dir string) (err error) {
+	origMeta, err := metadata.Read(origDir)
+	if err != nil {
+		return errors.Wrapf(err, "read meta of %s", origDir)
+	}
+	meta, err := metadata.Read(dir)
+	if err != nil {
+		return errors.Wrapf(err, "read meta of %s", dir)
+	}
+	if meta.Thanos.Downsample.Resolution <= origMeta.Thanos.Downsample.Resolution {
+		return errors.Errorf("resolution %d of downsampled block not lower than %d of the source block", meta.Thanos.Downsample.Resolution, origMeta.Thanos.Downsample.Resolution)
+	}
+	if meta.MinTime != origMeta.MinTime || meta.MaxTime != origMeta.MaxTime {
+		return errors.Errorf("time range [%d, %d) of downsampled block differs from [%d, %d) of the source block", meta.MinTime, meta.MaxTime, origMeta.MinTime, origMeta.MaxTime)
+	}
+
+	orig, err := openSeries(origDir, origMeta.Thanos.Downsample.Resolution)
+	if err != nil {
+		return err
+	}
+	defer runutil.CloseWithErrCapture(&err, orig, "verify source block")
+	res, err := openSeries(dir, meta.Thanos.Downsample.Resolution)
+	if err != nil {
+		return err
+	}
+	defer runutil.CloseWithErrCapture(&err, res, "verify downsampled block")
+
+	var buf []sample
+	if err := res.next(); err != nil {
+		return err
+	}
+	for {
+		if err := orig.next(); err != nil {
+			return err
+		}
+		if orig.lset == nil {
+			break
+		}
+		samples, mint, maxt, err := countSamples(orig, origMeta.Thanos.Downsample.Resolution, &buf)
+		if err != nil {
+			return errors.Wrapf(err, "count samples of source series %v", orig.lset)
+		}
+		if samples == 0 {
+			if res.lset != nil && labels.Equal(res.lset, orig.lset) {
+				return errors.Errorf("series %v without samples downsampled", orig.lset)
+			}
+			continue
+		}
+		if res.lset == nil || !labels.Equal(res.lset, orig.lset) {
+			return errors.Errorf("series %v missing in downsampled block", orig.lset)
+		}
+		if err := verifyAggrChunks(res, mint, maxt, samples, &buf); err != nil {
+			return errors.Wrapf(err, "series %v", res.lset)
+		}
+		if err := res.next(); err != nil {
+			return err
+		}
+	}
+	if res.lset != nil {
+		return errors.Errorf("series %v of downsampled block missing in the source block", res.lset)
+	}
+	return nil
+}
+
+// countSamples returns the count of samples in chunks of the current series, as aggregated by downsampling, and time
+// range of the counted samples.
+func countSamples(s *seriesReader, resolution int64, buf *[]sample) (count float64, mint, maxt int64, err error) {
+	first := true
+	for _, c := range s.chks {
+		*buf = (*buf)[:0]
+		if resolution == ResLevel0 {
+			if err := expandChunkIterator(c.Chunk.Iterator(nil), buf); err != nil {
+				return 0, 0, 0, err
+			}
+			count += float64(len(*buf))
+		} else {
+			ac, ok := c.Chunk.(*AggrChunk)
+			if !ok {
+				return 0, 0, 0, errors.Errorf("expected downsampled chunk, got %T", c.Chunk)
+			}
+			cnt, err := ac.Get(AggrCount)
+			if err != nil {
+				return 0, 0, 0, errors.Wrap(err, "get count aggregate")
+			}
+			if err := expandChunkIterator(cnt.Iterator(nil), buf); err != nil {
+				return 0, 0, 0, err
+			}
+			for _, smpl := range *buf {
+				count += smpl.v
+			}
+		}
+		if len(*buf) == 0 {
+			continue
+		}
+		if first || (*buf)[0].t < mint {
+			mint = (*buf)[0].t
+		}
+		if first || (*buf)[len(*buf)-1].t > maxt {
+			maxt = (*buf)[len(*buf)-1].t
+		}
+		first = false
+	}
+	return count, mint, maxt, nil
+}
+
+// verifyAggrChunks verifies aggregate chunks of the current series against the time range and count of samples of the
+// source series.
+func verifyAggrChunks(s *seriesReader, mint, maxt int64, samples float64, buf *[]sample) error {
+	var count float64
+	for i, c := range s.chks {
+		if c.MinTime > c.MaxTime {
+			return errors.Errorf("chunk %d has invalid time range [%d, %d]", i, c.MinTime, c.MaxTime)
+		}
+		if i > 0 && c.MinTime <= s.chks[i-1].MaxTime {
+			return errors.Errorf("chunk %d overlaps with the previous one or is out of order", i)
+		}
+		if c.MinTime < mint || c.MaxTime > maxt {
+			return errors.Errorf("chunk %d time range [%d, %d] outside of source samples time range [%d, %d]", i, c.MinTime, c.MaxTime, mint, maxt)
+		}
+		ac, ok := c.Chunk.(*AggrChunk)
+		if !ok {
+			return errors.Errorf("expected downsampled chunk, got %T", c.Chunk)
+		}
+
+		cnt, err := ac.Get(AggrCount)
+		if err != nil {
+			return errors.Wrapf(err, "chunk %d: get count aggregate", i)
+		}
+		*buf = (*buf)[:0]
+		if err := expandChunkIterator(cnt.Iterator(nil), buf); err != nil {
+			return err
+		}
+		if len(*buf) == 0 {
+			return errors.Errorf("chunk %d has no samples", i)
+		}
+		if (*buf)[0].t < c.MinTime || (*buf)[len(*buf)-1].t > c.MaxTime {
+			return errors.Errorf("chunk %d count aggregate outside of its time range [%d, %d]", i, c.MinTime, c.MaxTime)
+		}
+		for _, smpl := range *buf {
+			count += smpl.v
+		}
+
+		for _, at := range []AggrType{AggrSum, AggrMin, AggrMax} {
+			chk, err := ac.Get(at)
+			if err == ErrAggrNotExist {
+				continue
+			}
+			if err != nil {
+				return errors.Wrapf(err, "chunk %d: get %s aggregate", i, at)
+			}
+			if chk.NumSamples() != len(*buf) {
+				return errors.Errorf("chunk %d: %d samples of %s aggregate, expected %d as of count aggregate", i, chk.NumSamples(), at, len(*buf))
+			}
+		}
+		// Counter aggregate retains the first and the last raw values in addition to one sample per window.
+		if chk, err := ac.Get(AggrCounter); err == nil {
+			if chk.NumSamples() < 2 {
+				return errors.Errorf("chunk %d: counter aggregate has %d samples, expected at least 2", i, chk.NumSamples())
+			}
+		} else if err != ErrAggrNotExist {
+			return errors.Wrapf(err, "chunk %d: get counter aggregate", i)
+		}
+	}
+	if count != samples {
+		return errors.Errorf("downsampled chunks aggregate %v samples, expected %v", count, samples)
+	}
+	return nil
+}
+
+// seriesReader iterates series of a local block together with their chunks.
+type seriesReader struct {
+	b        *tsdb.Block
+	indexr   tsdb.IndexReader
+	chunkr   tsdb.ChunkReader
+	postings index.Postings
+
+	lset labels.Labels
+	chks []chunks.Meta
+}
+
+func openSeries(dir string, resolution int64) (*seriesReader, error) {
+	b, err := tsdb.OpenBlock(nil, dir, poolFor(resolution))
+	if err != nil {
+		return nil, errors.Wrapf(err, "open block %s", dir)
+	}
+	s := &seriesReader{b: b}
+	if s.indexr, err = b.Index(); err != nil {
+		runutil.CloseWithLogOnErr(log.NewNopLogger(), b, "block")
+		return nil, errors.Wrapf(err, "open index of %s", dir)
+	}
+	if s.chunkr, err = b.Chunks(); err != nil {
+		runutil.CloseWithLogOnErr(log.NewNopLogger(), s.indexr, "index reader")
+		runutil.CloseWithLogOnErr(log.NewNopLogger(), b, "block")
+		return nil, errors.Wrapf(err, "open chunks of %s", dir)
+	}
+	if s.postings, err = s.indexr.Postings(index.AllPostingsKey()); err != nil {
+		_ = s.Close()
+		return nil, errors.Wrapf(err, "postings of %s", dir)
+	}
+	return s, nil
+}
+
+// next moves to the next series and loads its chunks. Labels are nil once all series were read.
+func (s *seriesReader) next() error {
+	s.lset, s.chks = nil, nil
+	if !s.postings.Next() {
+		return errors.Wrap(s.postings.Err(), "iterate postings")
+	}
+	if err := s.indexr.Series(s.postings.At(), &s.lset, &s.chks); err != nil {
+		return errors.Wrapf(err, "get series %d", s.postings.At())
+	}
+	for i, c := range s.chks {
+		chk, err := s.chunkr.Chunk(c.Ref)
+		if err != nil {
+			return errors.Wrapf(err, "get chunk %d of series %v", c.Ref, s.lset)
+		}
+		s.chks[i].Chunk = chk
+	}
+	return nil
+}
+
+func (s *seriesReader) Close() error {
+	var merr tsdberrors.MultiError
+	merr.Add(s.chunkr.Close())
+	merr.Add(s.indexr.Close())
+	merr.Add(s.b.Close())
+	return merr.Err()
+}
@@ -0,0 +1,73 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package downsample
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestDownsampleBlock(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	dir, err := ioutil.TempDir("", "test-downsample-block")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	series := []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "2"), labels.FromStrings("a", "3")}
+	extLset := labels.FromStrings("ext", "1")
+	// 4 hours of samples every 30 seconds.
+	raw, err := e2eutil.CreateBlock(ctx, dir, series, 480, 0, 4*60*60*1000, extLset, 0)
+	testutil.Ok(t, err)
+	other, err := e2eutil.CreateBlock(ctx, dir, series, 100, 0, 4*60*60*1000, extLset, 0)
+	testutil.Ok(t, err)
+	rawDir := filepath.Join(dir, raw.String())
+
+	id5m, err := DownsampleBlock(ctx, logger, rawDir, ResLevel1)
+	testutil.Ok(t, err)
+	dir5m := filepath.Join(dir, id5m.String())
+	meta, err := metadata.Read(dir5m)
+	testutil.Ok(t, err)
+	testutil.Equals(t, ResLevel1, meta.Thanos.Downsample.Resolution)
+	testutil.Equals(t, uint64(3), meta.Stats.NumSeries)
+
+	id1h, err := DownsampleBlock(ctx, logger, dir5m, ResLevel2)
+	testutil.Ok(t, err)
+	testutil.Ok(t, VerifyDownsampled(rawDir, filepath.Join(dir, id1h.String())))
+
+	// Downsampling is deterministic.
+	index5m, err := ioutil.ReadFile(filepath.Join(dir5m, block.IndexFilename))
+	testutil.Ok(t, err)
+	testutil.Ok(t, os.RemoveAll(dir5m))
+	again, err := DownsampleBlock(ctx, logger, rawDir, ResLevel1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, id5m, again)
+	againIndex, err := ioutil.ReadFile(filepath.Join(dir5m, block.IndexFilename))
+	testutil.Ok(t, err)
+	testutil.Equals(t, index5m, againIndex)
+
+	// Downsampled block of other source is detected.
+	testutil.NotOk(t, VerifyDownsampled(filepath.Join(dir, other.String()), dir5m))
+	testutil.NotOk(t, VerifyDownsampled(rawDir, rawDir))
+
+	_, err = DownsampleBlock(ctx, logger, dir5m, ResLevel1)
+	testutil.NotOk(t, err)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = DownsampleBlock(canceled, logger, filepath.Join(dir, other.String()), ResLevel1)
+	testutil.NotOk(t, err)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// MetaEnricher adds custom extensions, e.g. team ownership or data classification, to Thanos metas of compacted blocks,
+// derived from metas of their source blocks.
+type MetaEnricher interface {
+	// Enrich modifies extensions of the block compacted from the given source blocks. The given extensions are merged
+	// from the sources by metadata.MergeExtensions, so they already carry extensions of the sources.
+	Enrich(sources []*metadata.Meta, extensions map[string]string) error
+}
+
+// MetaEnricherFunc is a function implementing MetaEnricher.
+type MetaEnricherFunc func(sources []*metadata.Meta, extensions map[string]string) error
+
+// Enrich implements MetaEnricher.
+func (f MetaEnricherFunc) Enrich(sources []*metadata.Meta, extensions map[string]string) error {
+	return f(sources, extensions)
+}
+
+// NewLabelExtensionEnricher returns a MetaEnricher setting extensions from external labels of the source blocks, given
+// as a mapping of extension names to label names. Values of the label are merged with the propagated values of the
+// extension, the same way as by metadata.MergeExtensions. Extensions of sources without the label are left as they are.
+func NewLabelExtensionEnricher(labelsByExtension map[string]string) MetaEnricher {
+	return MetaEnricherFunc(func(sources []*metadata.Meta, extensions map[string]string) error {
+		for ext, name := range labelsByExtension {
+			metas := []metadata.Thanos{{Extensions: map[string]string{ext: extensions[ext]}}}
+			found := false
+			for _, m := range sources {
+				if v, ok := m.Thanos.Labels[name]; ok {
+					metas = append(metas, metadata.Thanos{Extensions: map[string]string{ext: v}})
+					found = true
+				}
+			}
+			if !found {
+				continue
+			}
+			extensions[ext] = metadata.MergeExtensions(metas...)[ext]
+		}
+		return nil
+	})
+}
+
+// enrichMeta returns extensions of the block compacted from the given source blocks: extensions merged from them,
+// modified by enrichers set by WithMetaEnrichers in order.
+func (cg *Group) enrichMeta(sources []*metadata.Meta) (map[string]string, error) {
+	thanos := make([]metadata.Thanos, 0, len(sources))
+	for _, m := range sources {
+		thanos = append(thanos, m.Thanos)
+	}
+	extensions := metadata.MergeExtensions(thanos...)
+	if len(cg.opts.metaEnrichers) == 0 {
+		return extensions, nil
+	}
+	if extensions == nil {
+		extensions = map[string]string{}
+	}
+	for _, e := range cg.opts.metaEnrichers {
+		if err := e.Enrich(sources, extensions); err != nil {
+			return nil, errors.Wrap(err, "enrich meta of compacted block")
+		}
+	}
+	if len(extensions) == 0 {
+		return nil, nil
+	}
+	return extensions, nil
+}
@@ -0,0 +1,51 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestGroup_EnrichMeta(t *testing.T) {
+	sources := []*metadata.Meta{
+		{Thanos: metadata.Thanos{Labels: map[string]string{"tenant": "a"}, Extensions: map[string]string{"team": "storage"}}},
+		{Thanos: metadata.Thanos{Labels: map[string]string{"tenant": "a"}, Extensions: map[string]string{"team": "query", "classification": "internal"}}},
+	}
+
+	t.Run("propagated without enrichers", func(t *testing.T) {
+		cg := &Group{opts: applyGroupOptions(nil)}
+		ext, err := cg.enrichMeta(sources)
+		testutil.Ok(t, err)
+		testutil.Equals(t, map[string]string{"team": "query,storage", "classification": "internal"}, ext)
+
+		ext, err = cg.enrichMeta([]*metadata.Meta{{}})
+		testutil.Ok(t, err)
+		testutil.Equals(t, map[string]string(nil), ext)
+	})
+	t.Run("enrichers applied in order", func(t *testing.T) {
+		cg := &Group{opts: applyGroupOptions([]GroupOption{WithMetaEnrichers(
+			NewLabelExtensionEnricher(map[string]string{"owner": "tenant", "team": "missing"}),
+			MetaEnricherFunc(func(sources []*metadata.Meta, ext map[string]string) error {
+				ext["owner"] += "-reviewed"
+				delete(ext, "classification")
+				return nil
+			}),
+		)})}
+		ext, err := cg.enrichMeta(sources)
+		testutil.Ok(t, err)
+		testutil.Equals(t, map[string]string{"team": "query,storage", "owner": "a-reviewed"}, ext)
+	})
+	t.Run("failing enricher", func(t *testing.T) {
+		cg := &Group{opts: applyGroupOptions([]GroupOption{WithMetaEnrichers(MetaEnricherFunc(func([]*metadata.Meta, map[string]string) error {
+			return errors.New("no owner")
+		}))})}
+		_, err := cg.enrichMeta(sources)
+		testutil.NotOk(t, err)
+	})
+}
@@ -0,0 +1,201 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	terrors "github.com/prometheus/prometheus/tsdb/errors"
+)
+
+// ErrorClass tells how the caller of the compactor should react to an error returned by it.
+type ErrorClass int
+
+const (
+	// ErrorClassUnknown is the class of errors with no classification. They should end the compactor.
+	ErrorClassUnknown ErrorClass = iota
+	// ErrorClassRetry is the class of transient errors, e.g. bucket connection issues. Compaction loop can be retried.
+	ErrorClassRetry
+	// ErrorClassHalt is the class of errors signalling a critical bug or a broken block, which need an investigation
+	// before any further progress on compactions.
+	ErrorClassHalt
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassRetry:
+		return "retry"
+	case ErrorClassHalt:
+		return "halt"
+	default:
+		return "unknown"
+	}
+}
+
+// Classify returns the class of the given error returned by the compactor. Halt errors take precedence over retry
+// errors, so an error is classified as ErrorClassRetry only if IsRetryError holds and IsHaltError does not.
+// Errors are unwrapped by both github.com/pkg/errors and standard library conventions, so errors wrapped by the caller
+// are classified the same.
+func Classify(err error) ErrorClass {
+	if err == nil {
+		return ErrorClassUnknown
+	}
+	if IsHaltError(err) {
+		return ErrorClassHalt
+	}
+	if IsRetryError(err) {
+		return ErrorClassRetry
+	}
+	return ErrorClassUnknown
+}
+
+// Issue347Error is a type wrapper for errors that should invoke repair process for broken block.
+type Issue347Error struct {
+	err error
+
+	id ulid.ULID
+}
+
+func issue347Error(err error, brokenBlock ulid.ULID) Issue347Error {
+	return Issue347Error{err: err, id: brokenBlock}
+}
+
+func (e Issue347Error) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e Issue347Error) Unwrap() error {
+	return e.err
+}
+
+// BlockID returns ID of the broken block.
+func (e Issue347Error) BlockID() ulid.ULID {
+	return e.id
+}
+
+// IsIssue347Error returns true if the error or any error it wraps is a Issue347Error.
+func IsIssue347Error(err error) bool {
+	var ie Issue347Error
+	return errors.As(err, &ie)
+}
+
+// HaltError is a type wrapper for errors that should halt any further progress on compactions.
+type HaltError struct {
+	err error
+}
+
+// NewHaltError returns the given error wrapped as HaltError. It allows embedders, e.g. custom compactors or planners,
+// to signal errors that need an investigation.
+func NewHaltError(err error) HaltError {
+	return halt(err)
+}
+
+func halt(err error) HaltError {
+	return HaltError{err: err}
+}
+
+func (e HaltError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e HaltError) Unwrap() error {
+	return e.err
+}
+
+// IsHaltError returns true if the error or any error it wraps is a HaltError.
+// If a multierror is passed, any halt error will return true.
+func IsHaltError(err error) bool {
+	var multiErr terrors.MultiError
+	if errors.As(err, &multiErr) {
+		for _, err := range multiErr {
+			if IsHaltError(err) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var he HaltError
+	return errors.As(err, &he)
+}
+
+// RetryError is a type wrapper for errors that should trigger warning log and retry whole compaction loop, but aborting
+// current compaction further progress.
+type RetryError struct {
+	err error
+}
+
+// NewRetryError returns the given error wrapped as RetryError, unless it is already a halt error, which is returned
+// as is.
+func NewRetryError(err error) error {
+	return retry(err)
+}
+
+func retry(err error) error {
+	if IsHaltError(err) {
+		return err
+	}
+	return RetryError{err: err}
+}
+
+func (e RetryError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e RetryError) Unwrap() error {
+	return e.err
+}
+
+// IsRetryError returns true if the error or any error it wraps is a RetryError.
+// If a multierror is passed, all errors must be retriable.
+func IsRetryError(err error) bool {
+	var multiErr terrors.MultiError
+	if errors.As(err, &multiErr) {
+		for _, err := range multiErr {
+			if !IsRetryError(err) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var re RetryError
+	return errors.As(err, &re)
+}
+
+// PartialUploadError is a type wrapper for errors of block uploads that failed after some of the block files might have
+// been uploaded. The block has no meta.json in the bucket then, so it is a partial block, deleted by the compactor once
+// it is older than the consistency delay. It is wrapped by RetryError.
+type PartialUploadError struct {
+	err error
+
+	id ulid.ULID
+}
+
+func partialUpload(err error, id ulid.ULID) PartialUploadError {
+	return PartialUploadError{err: err, id: id}
+}
+
+func (e PartialUploadError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e PartialUploadError) Unwrap() error {
+	return e.err
+}
+
+// BlockID returns ID of the block which might have been partially uploaded.
+func (e PartialUploadError) BlockID() ulid.ULID {
+	return e.id
+}
+
+// IsPartialUploadError returns true if the error or any error it wraps is a PartialUploadError.
+func IsPartialUploadError(err error) bool {
+	var pe PartialUploadError
+	return errors.As(err, &pe)
+}
@@ -0,0 +1,233 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+const (
+	// estimatedBytesPerSample is a conservative size of a sample in XOR encoded chunks, which usually take 1-2 bytes.
+	estimatedBytesPerSample = 2
+	// estimatedIndexBytesPerSeries and estimatedIndexBytesPerChunk approximate the index size taken by labels and
+	// postings of a series and by a reference of a chunk in its series entry.
+	estimatedIndexBytesPerSeries = 256
+	estimatedIndexBytesPerChunk  = 16
+)
+
+// PlanEstimate is an estimate of the compaction of a plan, computed from metas of its source blocks before any of them
+// is downloaded.
+type PlanEstimate struct {
+	Blocks []ulid.ULID `json:"blocks"`
+
+	// InputBytes is the estimated size of the source blocks, downloaded before compaction. It is exact for sources
+	// listing their files in their metas.
+	InputBytes int64 `json:"inputBytes"`
+	// OutputBytes is the estimated size of the compacted block.
+	OutputBytes int64 `json:"outputBytes"`
+
+	// OutputSeries is the estimated number of series of the compacted block, assuming sources of the same time range
+	// share their series, and sources of distinct time ranges share as many series as the smaller of them has.
+	OutputSeries uint64 `json:"outputSeries"`
+	// OutputSeriesUpperBound is the number of series of the compacted block if sources shared no series at all.
+	OutputSeriesUpperBound uint64 `json:"outputSeriesUpperBound"`
+	// OutputSamples and OutputChunks are estimated assuming samples of time ranges overlapped by multiple sources, e.g.
+	// replicas merged by vertical compaction, are duplicates.
+	OutputSamples uint64 `json:"outputSamples"`
+	OutputChunks  uint64 `json:"outputChunks"`
+
+	// InspectedIndexes is the number of source blocks whose index sizes were read from object storage, rather than
+	// estimated from their stats.
+	InspectedIndexes int `json:"inspectedIndexes,omitempty"`
+}
+
+// DiskBytes returns the estimated disk space needed to compact the plan: its downloaded sources and the compacted block.
+func (e PlanEstimate) DiskBytes() int64 {
+	return e.InputBytes + e.OutputBytes
+}
+
+// EstimatePlan estimates the compaction of the given source blocks from their metas.
+func EstimatePlan(metas []*metadata.Meta) PlanEstimate {
+	return EstimatePlanWithIndexes(metas, nil)
+}
+
+// EstimatePlanWithIndexes estimates the compaction of the given source blocks from their metas and the given stats of
+// their indexes, as returned by block.InspectRemoteIndex. Sizes of indexes of sources with stats are taken as they are,
+// and the index of the compacted block is estimated from the largest symbols table and the index bytes per series of
+// those sources. Sources without stats are estimated from their metas only: from sizes of their files, if listed in
+// their metas (see metadata.File), or from their stats otherwise.
+func EstimatePlanWithIndexes(metas []*metadata.Meta, indexes map[ulid.ULID]block.RemoteIndexStats) PlanEstimate {
+	sorted := make([]*metadata.Meta, len(metas))
+	copy(sorted, metas)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].MinTime != sorted[j].MinTime {
+			return sorted[i].MinTime < sorted[j].MinTime
+		}
+		return sorted[i].ULID.Compare(sorted[j].ULID) < 0
+	})
+
+	e := PlanEstimate{Blocks: make([]ulid.ULID, 0, len(sorted))}
+	var (
+		coveredUntil = int64(-1 << 63)
+		rangeSeries  uint64
+
+		inspectedSeries     uint64
+		inspectedIndexBytes int64
+		maxSymbolsBytes     int64
+	)
+	for _, m := range sorted {
+		e.Blocks = append(e.Blocks, m.ULID)
+		if s, ok := indexes[m.ULID]; ok {
+			e.InspectedIndexes++
+			e.InputBytes += int64(m.Stats.NumSamples*estimatedBytesPerSample) + s.Size
+			inspectedSeries += m.Stats.NumSeries
+			inspectedIndexBytes += s.SeriesBytes + s.PostingsBytes
+			if s.SymbolsBytes > maxSymbolsBytes {
+				maxSymbolsBytes = s.SymbolsBytes
+			}
+		} else if size := m.Thanos.FilesSize(); size > 0 {
+			e.InputBytes += size
+		} else {
+			e.InputBytes += estimatedBlockBytes(m.Stats.NumSamples, m.Stats.NumSeries, m.Stats.NumChunks)
+		}
+		e.OutputSeriesUpperBound += m.Stats.NumSeries
+
+		// Part of the block's time range already covered by previous blocks is assumed to hold duplicated samples.
+		overlaps := coveredUntil > m.MinTime
+		unique := 1.0
+		if d := m.MaxTime - m.MinTime; d > 0 && overlaps {
+			unique = 0
+			if coveredUntil < m.MaxTime {
+				unique = float64(m.MaxTime-coveredUntil) / float64(d)
+			}
+		}
+		e.OutputSamples += uint64(float64(m.Stats.NumSamples) * unique)
+		e.OutputChunks += uint64(float64(m.Stats.NumChunks) * unique)
+
+		// Overlapping blocks are assumed to share series, so the largest of them counts. Series of consecutive time
+		// ranges mostly repeat too, so only series above the previous range's count are added.
+		switch {
+		case overlaps && m.Stats.NumSeries > rangeSeries:
+			e.OutputSeries += m.Stats.NumSeries - rangeSeries
+			rangeSeries = m.Stats.NumSeries
+		case !overlaps:
+			if m.Stats.NumSeries > rangeSeries {
+				e.OutputSeries += m.Stats.NumSeries - rangeSeries
+			}
+			rangeSeries = m.Stats.NumSeries
+		}
+		if m.MaxTime > coveredUntil {
+			coveredUntil = m.MaxTime
+		}
+	}
+	e.OutputBytes = estimatedBlockBytes(e.OutputSamples, e.OutputSeries, e.OutputChunks)
+	if inspectedSeries > 0 {
+		e.OutputBytes = int64(e.OutputSamples*estimatedBytesPerSample) + maxSymbolsBytes +
+			int64(float64(e.OutputSeries)*float64(inspectedIndexBytes)/float64(inspectedSeries))
+	}
+	return e
+}
+
+func estimatedBlockBytes(samples, series, chunks uint64) int64 {
+	return int64(samples*estimatedBytesPerSample + series*estimatedIndexBytesPerSeries + chunks*estimatedIndexBytesPerChunk)
+}
+
+// PlanEstimateMetrics exposes estimates of the last planned compaction of each group.
+type PlanEstimateMetrics struct {
+	outputBytes  *prometheus.GaugeVec
+	outputSeries *prometheus.GaugeVec
+	diskBytes    *prometheus.GaugeVec
+}
+
+// NewPlanEstimateMetrics returns PlanEstimateMetrics registered in the given registerer.
+func NewPlanEstimateMetrics(reg prometheus.Registerer) *PlanEstimateMetrics {
+	return &PlanEstimateMetrics{
+		outputBytes: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_group_plan_estimated_output_bytes",
+			Help: "Estimated size of the block compacted by the last planned compaction of the group.",
+		}, []string{"group_id"}),
+		outputSeries: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_group_plan_estimated_output_series",
+			Help: "Estimated number of series of the block compacted by the last planned compaction of the group.",
+		}, []string{"group_id"}),
+		diskBytes: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_group_plan_estimated_disk_bytes",
+			Help: "Estimated disk space needed by the last planned compaction of the group, for its source blocks and the compacted block.",
+		}, []string{"group_id"}),
+	}
+}
+
+// estimatedDiskBytes returns the estimated disk space needed to compact all blocks of the group at once, which bounds
+// the disk space needed by any of its plans.
+func (cg *Group) estimatedDiskBytes() uint64 {
+	cg.mtx.Lock()
+	metas := make([]*metadata.Meta, 0, len(cg.blocks))
+	for _, m := range cg.blocks {
+		metas = append(metas, m)
+	}
+	cg.mtx.Unlock()
+	return uint64(EstimatePlan(metas).DiskBytes())
+}
+
+// planMetas returns metas of source blocks of the given plan known to the group.
+func (cg *Group) planMetas(plan []string) []*metadata.Meta {
+	metas := make([]*metadata.Meta, 0, len(plan))
+	for _, pdir := range plan {
+		id, err := ulid.Parse(filepath.Base(pdir))
+		if err != nil {
+			continue
+		}
+		if m, ok := cg.blocks[id]; ok {
+			metas = append(metas, m)
+		}
+	}
+	return metas
+}
+
+// estimatePlan estimates compaction of the given plan, records it and warns if the estimated disk usage exceeds free
+// space of the given work directory. Indexes of the sources are inspected in object storage if enabled by
+// WithIndexInspection.
+func (cg *Group) estimatePlan(ctx context.Context, dir string, plan []string) PlanEstimate {
+	metas := cg.planMetas(plan)
+	var indexes map[ulid.ULID]block.RemoteIndexStats
+	if cg.opts.inspectIndexes {
+		indexes = make(map[ulid.ULID]block.RemoteIndexStats, len(metas))
+		for _, m := range metas {
+			s, err := block.InspectRemoteIndex(ctx, cg.bkt, m.ULID)
+			if err != nil {
+				level.Warn(cg.logger).Log("msg", "failed to inspect index of source block; estimating it from meta", "block", m.ULID, "err", err)
+				continue
+			}
+			indexes[m.ULID] = s
+		}
+	}
+	e := EstimatePlanWithIndexes(metas, indexes)
+
+	if m := cg.opts.planEstimates; m != nil {
+		m.outputBytes.WithLabelValues(cg.id).Set(float64(e.OutputBytes))
+		m.outputSeries.WithLabelValues(cg.id).Set(float64(e.OutputSeries))
+		m.diskBytes.WithLabelValues(cg.id).Set(float64(e.DiskBytes()))
+	}
+	if cg.planObserver != nil {
+		cg.planObserver(e)
+	}
+
+	level.Info(cg.logger).Log("msg", "estimated compaction of plan", "blocks", len(e.Blocks), "input_bytes", e.InputBytes,
+		"output_bytes", e.OutputBytes, "output_series", e.OutputSeries, "output_series_upper_bound", e.OutputSeriesUpperBound, "inspected_indexes", e.InspectedIndexes)
+	if free, err := freeBytes(dir); err == nil && uint64(e.DiskBytes()) > free {
+		level.Warn(cg.logger).Log("msg", "estimated disk usage of compaction exceeds free space of the work directory; compaction may fail",
+			"dir", dir, "estimated_bytes", e.DiskBytes(), "free_bytes", free)
+	}
+	return e
+}
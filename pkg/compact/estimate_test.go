@@ -0,0 +1,110 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestEstimatePlan(t *testing.T) {
+	newMeta := func(id uint64, minTime, maxTime int64, samples, series, chunks uint64) *metadata.Meta {
+		return &metadata.Meta{BlockMeta: tsdb.BlockMeta{
+			ULID:    ulid.MustNew(id, nil),
+			MinTime: minTime,
+			MaxTime: maxTime,
+			Stats:   tsdb.BlockStats{NumSamples: samples, NumSeries: series, NumChunks: chunks},
+		}}
+	}
+
+	for _, tcase := range []struct {
+		name     string
+		metas    []*metadata.Meta
+		expected PlanEstimate
+	}{
+		{
+			name:     "no blocks",
+			expected: PlanEstimate{Blocks: []ulid.ULID{}},
+		},
+		{
+			name:  "consecutive blocks",
+			metas: []*metadata.Meta{newMeta(2, 100, 200, 2000, 15, 30), newMeta(1, 0, 100, 1000, 10, 20)},
+			expected: PlanEstimate{
+				Blocks:                 []ulid.ULID{ulid.MustNew(1, nil), ulid.MustNew(2, nil)},
+				InputBytes:             4880 + 8320,
+				OutputBytes:            3000*2 + 15*256 + 50*16,
+				OutputSeries:           15,
+				OutputSeriesUpperBound: 25,
+				OutputSamples:          3000,
+				OutputChunks:           50,
+			},
+		},
+		{
+			name:  "replicas of the same time range",
+			metas: []*metadata.Meta{newMeta(1, 0, 100, 1000, 10, 20), newMeta(2, 0, 100, 1200, 12, 24)},
+			expected: PlanEstimate{
+				Blocks:                 []ulid.ULID{ulid.MustNew(1, nil), ulid.MustNew(2, nil)},
+				InputBytes:             4880 + 5856,
+				OutputBytes:            1000*2 + 12*256 + 20*16,
+				OutputSeries:           12,
+				OutputSeriesUpperBound: 22,
+				OutputSamples:          1000,
+				OutputChunks:           20,
+			},
+		},
+		{
+			name:  "partially overlapping blocks",
+			metas: []*metadata.Meta{newMeta(1, 0, 100, 1000, 10, 10), newMeta(2, 50, 150, 1000, 10, 10)},
+			expected: PlanEstimate{
+				Blocks:                 []ulid.ULID{ulid.MustNew(1, nil), ulid.MustNew(2, nil)},
+				InputBytes:             2 * 4720,
+				OutputBytes:            1500*2 + 10*256 + 15*16,
+				OutputSeries:           10,
+				OutputSeriesUpperBound: 20,
+				OutputSamples:          1500,
+				OutputChunks:           15,
+			},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			e := EstimatePlan(tcase.metas)
+			testutil.Equals(t, tcase.expected, e)
+			testutil.Equals(t, e.InputBytes+e.OutputBytes, e.DiskBytes())
+		})
+	}
+
+	t.Run("inspected indexes", func(t *testing.T) {
+		metas := []*metadata.Meta{newMeta(1, 0, 100, 1000, 10, 20), newMeta(2, 100, 200, 2000, 15, 30), newMeta(3, 200, 300, 1000, 10, 20)}
+		e := EstimatePlanWithIndexes(metas, map[ulid.ULID]block.RemoteIndexStats{
+			ulid.MustNew(1, nil): {Size: 2000, SymbolsBytes: 100, SeriesBytes: 1500, PostingsBytes: 300},
+			ulid.MustNew(2, nil): {Size: 3000, SymbolsBytes: 200, SeriesBytes: 2200, PostingsBytes: 400},
+		})
+		testutil.Equals(t, PlanEstimate{
+			Blocks: []ulid.ULID{ulid.MustNew(1, nil), ulid.MustNew(2, nil), ulid.MustNew(3, nil)},
+			// The third source is estimated from its meta.
+			InputBytes: 1000*2 + 2000 + 2000*2 + 3000 + 4880,
+			// 4400 index bytes of 25 inspected series, for 15 series of the compacted block.
+			OutputBytes:            4000*2 + 200 + 15*4400/25,
+			OutputSeries:           15,
+			OutputSeriesUpperBound: 35,
+			OutputSamples:          4000,
+			OutputChunks:           70,
+			InspectedIndexes:       2,
+		}, e)
+	})
+
+	t.Run("listed files", func(t *testing.T) {
+		listed := newMeta(1, 0, 100, 1000, 10, 20)
+		listed.Thanos.Files = []metadata.File{{RelPath: "chunks/000001", SizeBytes: 1500}, {RelPath: "index", SizeBytes: 700}}
+		e := EstimatePlan([]*metadata.Meta{listed, newMeta(2, 100, 200, 1000, 10, 20)})
+		// Sizes of listed files are taken as they are, the other source is estimated from its meta.
+		testutil.Equals(t, int64(1500+700+4880), e.InputBytes)
+	})
+}
@@ -0,0 +1,176 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// ExternalLabelCollisionAction is what group compaction does with series of source blocks having labels of the same
+// names as external labels of the group. Such series are ambiguous at query time, where external labels are added to
+// them.
+type ExternalLabelCollisionAction string
+
+const (
+	// ExternalLabelCollisionWarn logs and counts colliding series, compacting them as they are.
+	ExternalLabelCollisionWarn ExternalLabelCollisionAction = "warn"
+	// ExternalLabelCollisionDrop drops the colliding labels from series, leaving the external labels.
+	ExternalLabelCollisionDrop ExternalLabelCollisionAction = "drop"
+	// ExternalLabelCollisionRename keeps both by prefixing names of the colliding labels of series with "exported_",
+	// the same way as Prometheus does for scraped labels colliding with target labels.
+	ExternalLabelCollisionRename ExternalLabelCollisionAction = "rename"
+	// ExternalLabelCollisionHalt halts the compactor, so collisions can be fixed in the bucket first.
+	ExternalLabelCollisionHalt ExternalLabelCollisionAction = "halt"
+)
+
+// ExternalLabelCollisionActions are all valid values of ExternalLabelCollisionAction.
+var ExternalLabelCollisionActions = []string{
+	string(ExternalLabelCollisionWarn),
+	string(ExternalLabelCollisionDrop),
+	string(ExternalLabelCollisionRename),
+	string(ExternalLabelCollisionHalt),
+}
+
+// ExternalLabelCollisionMetrics counts series of source blocks whose labels collide with external labels of their group.
+type ExternalLabelCollisionMetrics struct {
+	blocks prometheus.Counter
+	series *prometheus.CounterVec
+}
+
+// NewExternalLabelCollisionMetrics returns ExternalLabelCollisionMetrics registered in the given registerer.
+func NewExternalLabelCollisionMetrics(reg prometheus.Registerer) *ExternalLabelCollisionMetrics {
+	return &ExternalLabelCollisionMetrics{
+		blocks: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_external_label_collision_blocks_total",
+			Help: "Total number of source blocks with series whose labels collide with external labels of their group.",
+		}),
+		series: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_external_label_collision_series_total",
+			Help: "Total number of series of source blocks with a label colliding with an external label of their group, by label name.",
+		}, []string{"label"}),
+	}
+}
+
+// handleExternalLabelCollisions detects series of the downloaded source block in the given directory with labels
+// colliding with external labels of the group, handling them as configured by WithExternalLabelCollisions. For blocks
+// merged externally, errExternalMergeUnsupported is returned if series have to be rewritten.
+func (cg *Group) handleExternalLabelCollisions(id ulid.ULID, bdir string, external bool) error {
+	if cg.opts.extLabelCollisions == "" || len(cg.labels) == 0 {
+		return nil
+	}
+	collisions, err := externalLabelCollisions(filepath.Join(bdir, block.IndexFilename), cg.labels)
+	if err != nil {
+		return errors.Wrapf(err, "detect external label collisions of block %s", id)
+	}
+	if len(collisions) == 0 {
+		return nil
+	}
+
+	cg.opts.extLabelMetrics.blocks.Inc()
+	for name, n := range collisions {
+		cg.opts.extLabelMetrics.series.WithLabelValues(name).Add(float64(n))
+	}
+	action := cg.opts.extLabelCollisions
+	level.Warn(cg.logger).Log("msg", "series labels collide with external labels", "block", id, "collisions", fmt.Sprintf("%v", collisions), "action", action)
+
+	var relabelFn func(labels.Labels) labels.Labels
+	switch action {
+	case ExternalLabelCollisionDrop:
+		relabelFn = func(lset labels.Labels) labels.Labels {
+			res := lset[:0]
+			for _, l := range lset {
+				if !cg.labels.Has(l.Name) {
+					res = append(res, l)
+				}
+			}
+			return res
+		}
+	case ExternalLabelCollisionRename:
+		relabelFn = func(lset labels.Labels) labels.Labels {
+			return exportCollidingLabels(lset, cg.labels)
+		}
+	case ExternalLabelCollisionHalt:
+		return halt(errors.Errorf("block %s has series with labels colliding with external labels %s: %v", id, cg.labels, collisions))
+	default:
+		return nil
+	}
+
+	if external {
+		return errors.Wrapf(errExternalMergeUnsupported, "block %s has series with labels colliding with external labels", id)
+	}
+	modified, err := block.RelabelSeries(cg.logger, bdir, relabelFn)
+	if err != nil {
+		return errors.Wrapf(err, "%s colliding labels of block %s", action, bdir)
+	}
+	level.Info(cg.logger).Log("msg", "rewrote series with labels colliding with external labels", "block", id, "action", action, "modified", modified)
+	return nil
+}
+
+// externalLabelCollisions returns numbers of series of the given index file having a label of the same name as one of
+// the given external labels, by label name.
+func externalLabelCollisions(fn string, ext labels.Labels) (_ map[string]int, err error) {
+	r, err := index.NewFileReader(fn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open index file %s", fn)
+	}
+	defer runutil.CloseWithErrCapture(&err, r, "index reader")
+
+	names, err := r.LabelNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "label names")
+	}
+	res := map[string]int{}
+	for _, name := range names {
+		if !ext.Has(name) {
+			continue
+		}
+		values, err := r.LabelValues(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "label values of %s", name)
+		}
+		p, err := r.Postings(name, values...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "postings of %s", name)
+		}
+		n := 0
+		for p.Next() {
+			n++
+		}
+		if p.Err() != nil {
+			return nil, errors.Wrapf(p.Err(), "iterate postings of %s", name)
+		}
+		if n > 0 {
+			res[name] = n
+		}
+	}
+	return res, nil
+}
+
+// exportCollidingLabels prefixes names of labels colliding with the given external labels with "exported_", repeatedly
+// until they collide with neither the external labels nor other labels of the series.
+func exportCollidingLabels(lset, ext labels.Labels) labels.Labels {
+	res := make(labels.Labels, 0, len(lset))
+	for _, l := range lset {
+		name := l.Name
+		for ext.Has(name) || name != l.Name && lset.Has(name) {
+			name = "exported_" + name
+		}
+		res = append(res, labels.Label{Name: name, Value: l.Value})
+	}
+	sort.Sort(res)
+	return res
+}
@@ -0,0 +1,103 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestExportCollidingLabels(t *testing.T) {
+	ext := labels.FromStrings("cluster", "a")
+	testutil.Equals(t, labels.FromStrings("exported_cluster", "b", "job", "x"), exportCollidingLabels(labels.FromStrings("cluster", "b", "job", "x"), ext))
+	testutil.Equals(t, labels.FromStrings("exported_cluster", "c", "exported_exported_cluster", "b"),
+		exportCollidingLabels(labels.FromStrings("cluster", "b", "exported_cluster", "c"), ext))
+	testutil.Equals(t, labels.FromStrings("job", "x"), exportCollidingLabels(labels.FromStrings("job", "x"), ext))
+}
+
+func TestGroup_HandleExternalLabelCollisions(t *testing.T) {
+	ctx := context.Background()
+	ext := labels.FromStrings("cluster", "a")
+
+	for _, tcase := range []struct {
+		action   ExternalLabelCollisionAction
+		expected []labels.Labels
+		halt     bool
+	}{
+		{
+			action:   ExternalLabelCollisionWarn,
+			expected: []labels.Labels{labels.FromStrings("cluster", "b", "job", "x"), labels.FromStrings("job", "y")},
+		},
+		{
+			action:   ExternalLabelCollisionDrop,
+			expected: []labels.Labels{labels.FromStrings("job", "x"), labels.FromStrings("job", "y")},
+		},
+		{
+			action:   ExternalLabelCollisionRename,
+			expected: []labels.Labels{labels.FromStrings("exported_cluster", "b", "job", "x"), labels.FromStrings("job", "y")},
+		},
+		{
+			action: ExternalLabelCollisionHalt,
+			halt:   true,
+		},
+	} {
+		t.Run(string(tcase.action), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "ext-label-collisions")
+			testutil.Ok(t, err)
+			defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+			id, err := e2eutil.CreateBlock(ctx, dir, []labels.Labels{
+				labels.FromStrings("cluster", "b", "job", "x"),
+				labels.FromStrings("job", "y"),
+			}, 10, 0, 1000, ext, 0)
+			testutil.Ok(t, err)
+
+			m := NewExternalLabelCollisionMetrics(prometheus.NewRegistry())
+			g, err := NewGroup(nil, nil, "0@1", ext, 0, false, false, GroupMetrics{}, WithExternalLabelCollisions(tcase.action, m))
+			testutil.Ok(t, err)
+
+			bdir := filepath.Join(dir, id.String())
+			err = g.handleExternalLabelCollisions(id, bdir, false)
+			testutil.Equals(t, 1.0, promtest.ToFloat64(m.series.WithLabelValues("cluster")))
+			if tcase.halt {
+				testutil.NotOk(t, err)
+				testutil.Assert(t, IsHaltError(err), "expected halt error, got %v", err)
+				return
+			}
+			testutil.Ok(t, err)
+
+			var got []labels.Labels
+			testutil.Ok(t, forEachSeries(filepath.Join(bdir, "index"), func(lset labels.Labels) {
+				got = append(got, lset.Copy())
+			}))
+			testutil.Equals(t, tcase.expected, got)
+
+			// Rewritten series do not collide anymore, others are left as they are.
+			testutil.Ok(t, g.handleExternalLabelCollisions(id, bdir, true))
+		})
+	}
+
+	// Blocks needing a rewrite cannot be merged externally.
+	dir, err := ioutil.TempDir("", "ext-label-collisions")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+	id, err := e2eutil.CreateBlock(ctx, dir, []labels.Labels{labels.FromStrings("cluster", "b")}, 10, 0, 1000, ext, 0)
+	testutil.Ok(t, err)
+	g, err := NewGroup(nil, nil, "0@1", ext, 0, false, false, GroupMetrics{},
+		WithExternalLabelCollisions(ExternalLabelCollisionDrop, NewExternalLabelCollisionMetrics(nil)))
+	testutil.Ok(t, err)
+	err = g.handleExternalLabelCollisions(id, filepath.Join(dir, id.String()), true)
+	testutil.Equals(t, errExternalMergeUnsupported, errors.Cause(err))
+}
@@ -0,0 +1,10 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import "github.com/pkg/errors"
+
+func freeBytes(string) (uint64, error) {
+	return 0, errors.New("not supported on windows")
+}
@@ -0,0 +1,72 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// FreshRangeMetrics counts blocks left out of compaction planning by WithFreshRangeGuard.
+type FreshRangeMetrics struct {
+	held *prometheus.GaugeVec
+}
+
+// NewFreshRangeMetrics returns FreshRangeMetrics registered in the given registerer.
+func NewFreshRangeMetrics(reg prometheus.Registerer) *FreshRangeMetrics {
+	return &FreshRangeMetrics{
+		held: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_group_fresh_range_held_blocks",
+			Help: "Number of blocks in the fresh range of the group left out of the last compaction planning, as blocks were still uploaded into it.",
+		}, []string{"group_id"}),
+	}
+}
+
+// freshBlocks returns blocks of the group within the fresh range at the end of the group's time range, if any block of
+// the range was created within the quiescence period before now, so they are left out of planning until no more blocks
+// come into the range. It returns nil unless enabled by WithFreshRangeGuard.
+func (cg *Group) freshBlocks(now time.Time) map[ulid.ULID]struct{} {
+	if cg.opts.freshRange <= 0 {
+		return nil
+	}
+	var maxt int64
+	first := true
+	for _, m := range cg.blocks {
+		if cg.noCompact(m.ULID) {
+			continue
+		}
+		if first || m.MaxTime > maxt {
+			maxt, first = m.MaxTime, false
+		}
+	}
+	start := maxt - int64(cg.opts.freshRange/time.Millisecond)
+
+	var (
+		fresh  = map[ulid.ULID]struct{}{}
+		newest uint64
+	)
+	for _, m := range cg.blocks {
+		if cg.noCompact(m.ULID) || m.MaxTime <= start {
+			continue
+		}
+		fresh[m.ULID] = struct{}{}
+		if m.ULID.Time() > newest {
+			newest = m.ULID.Time()
+		}
+	}
+	if len(fresh) == 0 || now.Sub(ulid.Time(newest)) >= cg.opts.freshQuiescence {
+		fresh = nil
+	} else {
+		level.Debug(cg.logger).Log("msg", "leaving fresh range of group out of planning until uploads into it quiesce", "group_id", cg.id,
+			"blocks", len(fresh), "fresh_range", cg.opts.freshRange, "newest_block", ulid.Time(newest), "quiescence", cg.opts.freshQuiescence)
+	}
+	if cg.opts.freshRangeMetrics != nil {
+		cg.opts.freshRangeMetrics.held.WithLabelValues(cg.id).Set(float64(len(fresh)))
+	}
+	return fresh
+}
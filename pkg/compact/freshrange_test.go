@@ -0,0 +1,55 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestGroup_FreshBlocks(t *testing.T) {
+	const hour = int64(time.Hour / time.Millisecond)
+	now := timestamp.Time(100 * hour)
+	newMeta := func(created time.Time, mint, maxt int64) *metadata.Meta {
+		return &metadata.Meta{BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(ulid.Timestamp(created), nil), MinTime: mint, MaxTime: maxt}}
+	}
+	old := newMeta(now.Add(-10*time.Hour), 80*hour, 82*hour)
+	settled := newMeta(now.Add(-2*time.Hour), 96*hour, 98*hour)
+	late := newMeta(now.Add(-10*time.Minute), 94*hour, 96*hour)
+
+	m := NewFreshRangeMetrics(prometheus.NewRegistry())
+	g := &Group{
+		logger: log.NewNopLogger(),
+		key:    "0@1",
+		id:     GroupID("0@1"),
+		blocks: map[ulid.ULID]*metadata.Meta{old.ULID: old, settled.ULID: settled},
+		opts:   groupOptions{freshRange: 6 * time.Hour, freshQuiescence: 30 * time.Minute, freshRangeMetrics: m},
+	}
+
+	// No block was created recently within the last 6h of the group.
+	testutil.Equals(t, 0, len(g.freshBlocks(now)))
+
+	// A late block comes into the fresh range, so the whole range is held back.
+	g.blocks[late.ULID] = late
+	testutil.Equals(t, map[ulid.ULID]struct{}{settled.ULID: {}, late.ULID: {}}, g.freshBlocks(now))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(m.held.WithLabelValues(GroupID("0@1"))))
+
+	// Uploads quiesced.
+	testutil.Equals(t, 0, len(g.freshBlocks(now.Add(30*time.Minute))))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(m.held.WithLabelValues(GroupID("0@1"))))
+
+	// Disabled.
+	g.opts.freshRange = 0
+	testutil.Equals(t, 0, len(g.freshBlocks(now)))
+}
@@ -0,0 +1,119 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// GCResumePoint is where garbage collection of blocks for a deletion reason resumes after an interrupted cycle.
+type GCResumePoint struct {
+	// Last is the last candidate processed by the interrupted cycle.
+	Last ulid.ULID
+	// Remaining is the number of candidates the interrupted cycle did not process.
+	Remaining int
+}
+
+// gcProgressMetrics are metrics of gcProgress, shared by Syncers like the rest of SyncerMetrics.
+type gcProgressMetrics struct {
+	resumePoint *prometheus.GaugeVec
+	remaining   *prometheus.GaugeVec
+	resumed     *prometheus.CounterVec
+}
+
+func newGCProgressMetrics(reg prometheus.Registerer) *gcProgressMetrics {
+	return &gcProgressMetrics{
+		resumePoint: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_garbage_collection_resume_point_timestamp_seconds",
+			Help: "Creation time of the last block processed by an interrupted garbage collection, which the next one resumes after, by reason. Zero if the last garbage collection completed.",
+		}, []string{"reason"}),
+		remaining: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_garbage_collection_candidates_remaining",
+			Help: "Number of candidate blocks left to process by the running or interrupted garbage collection, by reason.",
+		}, []string{"reason"}),
+		resumed: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_garbage_collection_resumed_total",
+			Help: "Total number of garbage collections resuming an interrupted one, by reason.",
+		}, []string{"reason"}),
+	}
+}
+
+// gcProgress records which candidates of garbage collection were processed, so a cycle interrupted by cancellation or
+// a failure is resumed by the next cycle after the last processed candidate, instead of starting over with candidates
+// that were processed already, e.g. verified and skipped.
+type gcProgress struct {
+	metrics *gcProgressMetrics
+
+	mtx    sync.Mutex
+	points map[metadata.DeletionReason]GCResumePoint
+}
+
+func newGCProgress(m *gcProgressMetrics) *gcProgress {
+	return &gcProgress{metrics: m, points: map[metadata.DeletionReason]GCResumePoint{}}
+}
+
+// order returns the given candidates in the order to process them for the given reason: sorted by ULID, starting after
+// the resume point of an interrupted cycle, if any, and wrapping around to the candidates processed by it.
+func (p *gcProgress) order(reason metadata.DeletionReason, ids []ulid.ULID) []ulid.ULID {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	sorted := append([]ulid.ULID(nil), ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Compare(sorted[j]) < 0 })
+	p.metrics.remaining.WithLabelValues(string(reason)).Set(float64(len(sorted)))
+
+	point, ok := p.points[reason]
+	if !ok {
+		return sorted
+	}
+	p.metrics.resumed.WithLabelValues(string(reason)).Inc()
+	i := sort.Search(len(sorted), func(i int) bool { return sorted[i].Compare(point.Last) > 0 })
+	return append(sorted[i:], sorted[:i]...)
+}
+
+// processed records that the given candidate was processed for the given reason, with the given number of candidates
+// left.
+func (p *gcProgress) processed(reason metadata.DeletionReason, id ulid.ULID, remaining int) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.points[reason] = GCResumePoint{Last: id, Remaining: remaining}
+	p.metrics.resumePoint.WithLabelValues(string(reason)).Set(float64(id.Time()) / 1000)
+	p.metrics.remaining.WithLabelValues(string(reason)).Set(float64(remaining))
+}
+
+// completed records that all candidates were processed for the given reason, so the next cycle starts over.
+func (p *gcProgress) completed(reason metadata.DeletionReason) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	delete(p.points, reason)
+	p.metrics.resumePoint.WithLabelValues(string(reason)).Set(0)
+	p.metrics.remaining.WithLabelValues(string(reason)).Set(0)
+}
+
+// resumePoints returns resume points of all interrupted reasons.
+func (p *gcProgress) resumePoints() map[metadata.DeletionReason]GCResumePoint {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	res := make(map[metadata.DeletionReason]GCResumePoint, len(p.points))
+	for r, point := range p.points {
+		res[r] = point
+	}
+	return res
+}
+
+// GCResumePoints returns where the next garbage collection resumes, by deletion reason, for reasons whose last garbage
+// collection was interrupted.
+func (s *Syncer) GCResumePoints() map[metadata.DeletionReason]GCResumePoint {
+	return s.gcProgress.resumePoints()
+}
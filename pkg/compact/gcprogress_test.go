@@ -0,0 +1,39 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestGCProgress(t *testing.T) {
+	m := newGCProgressMetrics(prometheus.NewRegistry())
+	p := newGCProgress(m)
+
+	a, b, c, d := ulid.MustNew(1000, nil), ulid.MustNew(2000, nil), ulid.MustNew(3000, nil), ulid.MustNew(4000, nil)
+	testutil.Equals(t, []ulid.ULID{a, b, c}, p.order(DuplicateDeletionReason, []ulid.ULID{c, a, b}))
+	testutil.Equals(t, 3.0, promtest.ToFloat64(m.remaining.WithLabelValues(string(DuplicateDeletionReason))))
+
+	// Interrupted after processing a and b.
+	p.processed(DuplicateDeletionReason, a, 2)
+	p.processed(DuplicateDeletionReason, b, 1)
+	testutil.Equals(t, GCResumePoint{Last: b, Remaining: 1}, p.resumePoints()[DuplicateDeletionReason])
+	testutil.Equals(t, 2.0, promtest.ToFloat64(m.resumePoint.WithLabelValues(string(DuplicateDeletionReason))))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.remaining.WithLabelValues(string(DuplicateDeletionReason))))
+
+	// Resumed after b, with a marked meanwhile and d new.
+	testutil.Equals(t, []ulid.ULID{c, d, b}, p.order(DuplicateDeletionReason, []ulid.ULID{d, b, c}))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.resumed.WithLabelValues(string(DuplicateDeletionReason))))
+
+	p.completed(DuplicateDeletionReason)
+	testutil.Equals(t, 0, len(p.resumePoints()))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(m.resumePoint.WithLabelValues(string(DuplicateDeletionReason))))
+	testutil.Equals(t, []ulid.ULID{b, c, d}, p.order(DuplicateDeletionReason, []ulid.ULID{d, b, c}))
+}
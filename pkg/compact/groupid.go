@@ -0,0 +1,80 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// groupIDLength is the number of hex digits of IDs of groups.
+const groupIDLength = 12
+
+// GroupID returns the short ID of the group with the given key. It is derived from the key only, so it is the same across
+// restarts and compactors. Groups are labeled with their ID in metrics and logs, instead of their keys, which grow with
+// the labels of the group, and IDs are resolved to groups by GroupDirectory.
+func GroupID(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])[:groupIDLength]
+}
+
+// GroupInfo describes the group of the given ID.
+type GroupInfo struct {
+	ID         string        `json:"id"`
+	Key        string        `json:"key"`
+	Labels     labels.Labels `json:"labels"`
+	Resolution int64         `json:"resolution"`
+}
+
+// GroupDirectory resolves IDs of groups seen by BucketCompactor, including IDs of the default keys of their labels and
+// resolution (see DefaultGroupKey), which label metrics of groups split further, e.g. by TimeBucketGrouper.
+// Go-routine safe.
+type GroupDirectory struct {
+	mtx    sync.Mutex
+	groups map[string]GroupInfo
+}
+
+// NewGroupDirectory returns an empty GroupDirectory.
+func NewGroupDirectory() *GroupDirectory {
+	return &GroupDirectory{groups: map[string]GroupInfo{}}
+}
+
+// add records the given groups.
+func (d *GroupDirectory) add(groups ...*Group) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	for _, g := range groups {
+		for _, key := range []string{g.Key(), defaultGroupKey(g.Resolution(), g.Labels())} {
+			id := GroupID(key)
+			d.groups[id] = GroupInfo{ID: id, Key: key, Labels: g.Labels(), Resolution: g.Resolution()}
+		}
+	}
+}
+
+// Resolve returns the group of the given ID, if seen.
+func (d *GroupDirectory) Resolve(id string) (GroupInfo, bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	g, ok := d.groups[id]
+	return g, ok
+}
+
+// List returns all groups seen, sorted by ID.
+func (d *GroupDirectory) List() []GroupInfo {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	res := make([]GroupInfo, 0, len(d.groups))
+	for _, g := range d.groups {
+		res = append(res, g)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
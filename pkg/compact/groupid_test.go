@@ -0,0 +1,41 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestGroupID(t *testing.T) {
+	id := GroupID("0@17241709254077376921")
+	testutil.Equals(t, groupIDLength, len(id))
+	testutil.Equals(t, id, GroupID("0@17241709254077376921"))
+	testutil.Assert(t, id != GroupID("1000@17241709254077376921"), "expected different IDs of different keys")
+}
+
+func TestGroupDirectory(t *testing.T) {
+	lset := labels.FromStrings("a", "1")
+	g, err := NewGroup(nil, nil, defaultGroupKey(0, lset)+"@0", lset, 0, false, false, GroupMetrics{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, GroupID(g.Key()), g.ID())
+
+	d := NewGroupDirectory()
+	_, ok := d.Resolve(g.ID())
+	testutil.Assert(t, !ok, "expected unknown group")
+
+	d.add(g)
+	got, ok := d.Resolve(g.ID())
+	testutil.Assert(t, ok, "expected group resolved")
+	testutil.Equals(t, GroupInfo{ID: g.ID(), Key: g.Key(), Labels: lset, Resolution: 0}, got)
+
+	// Groups split by time bucket are resolved by the ID of the key of their labels as well.
+	got, ok = d.Resolve(GroupID(defaultGroupKey(0, lset)))
+	testutil.Assert(t, ok, "expected group of labels resolved")
+	testutil.Equals(t, defaultGroupKey(0, lset), got.Key)
+	testutil.Equals(t, 2, len(d.List()))
+}
@@ -0,0 +1,191 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	terrors "github.com/prometheus/prometheus/tsdb/errors"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// GroupSizeSnapshot captures total size in bytes of all objects of blocks in each compaction group at a given time.
+type GroupSizeSnapshot struct {
+	Time time.Time
+	// Bytes maps group key (see DefaultGroupKey) to the total size of its blocks' objects.
+	Bytes map[string]int64
+}
+
+type groupSizeMetrics struct {
+	sizeBytes  *prometheus.GaugeVec
+	growthRate *prometheus.GaugeVec
+}
+
+func newGroupSizeMetrics(reg prometheus.Registerer) *groupSizeMetrics {
+	return &groupSizeMetrics{
+		sizeBytes: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_group_size_bytes",
+			Help: "Total size in bytes of objects of all blocks in the compaction group, as seen on last sync.",
+		}, []string{"group_id"}),
+		growthRate: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_group_size_growth_bytes_per_second",
+			Help: "Change of the compaction group size in bytes per second between the last two syncs.",
+		}, []string{"group_id"}),
+	}
+}
+
+// groupSizeAccounter computes sizes of compaction groups on every sync. Blocks are immutable, so the size of each block
+// is computed only once and cached for as long as the block is present in the bucket, unless it turned out zero. Sizes of blocks listed by the
+// inventory report with their meta.json, which is uploaded last, are taken from the report instead of the bucket.
+type groupSizeAccounter struct {
+	bkt         objstore.Bucket
+	inventory   *objstore.InventoryReader
+	concurrency int
+	metrics     *groupSizeMetrics
+
+	mtx        sync.Mutex
+	blockSizes map[ulid.ULID]int64
+	current    GroupSizeSnapshot
+	previous   GroupSizeSnapshot
+}
+
+func newGroupSizeAccounter(m *groupSizeMetrics, bkt objstore.Bucket, inventory *objstore.InventoryReader, concurrency int) *groupSizeAccounter {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &groupSizeAccounter{
+		bkt:         bkt,
+		inventory:   inventory,
+		concurrency: concurrency,
+		metrics:     m,
+		blockSizes:  map[ulid.ULID]int64{},
+	}
+}
+
+// update computes sizes of groups of given blocks, rotates the snapshots and updates metrics. On error, the snapshots
+// and metrics are kept as they were.
+func (a *groupSizeAccounter) update(ctx context.Context, metas map[ulid.ULID]*metadata.Meta) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	blockSizes := make(map[ulid.ULID]int64, len(metas))
+	var (
+		wg   sync.WaitGroup
+		ch   = make(chan ulid.ULID, a.concurrency)
+		mtx  sync.Mutex
+		errs terrors.MultiError
+	)
+	for i := 0; i < a.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for id := range ch {
+				size, err := objectsSize(ctx, a.bkt, id.String())
+				mtx.Lock()
+				if err != nil {
+					errs.Add(errors.Wrapf(err, "get size of block %s", id))
+				} else {
+					blockSizes[id] = size
+				}
+				mtx.Unlock()
+			}
+		}()
+	}
+	for id := range metas {
+		size, ok := a.blockSizes[id]
+		if !ok && a.inventory != nil {
+			if _, listed := a.inventory.Size(path.Join(id.String(), metadata.MetaFilename)); listed {
+				size, ok = a.inventory.DirSize(id.String())
+			}
+		}
+		if ok {
+			mtx.Lock()
+			blockSizes[id] = size
+			mtx.Unlock()
+			continue
+		}
+		ch <- id
+	}
+	close(ch)
+	wg.Wait()
+
+	// Sizes of blocks that failed or were still empty, e.g. missing in the bucket, are computed again by next updates.
+	cached := make(map[ulid.ULID]int64, len(blockSizes))
+	for id, size := range blockSizes {
+		if size > 0 {
+			cached[id] = size
+		}
+	}
+	a.blockSizes = cached
+	if err := errs.Err(); err != nil {
+		return err
+	}
+
+	snapshot := GroupSizeSnapshot{Time: time.Now(), Bytes: map[string]int64{}}
+	for id, m := range metas {
+		snapshot.Bytes[DefaultGroupKey(m.Thanos)] += blockSizes[id]
+	}
+
+	for group := range a.current.Bytes {
+		if _, ok := snapshot.Bytes[group]; !ok {
+			a.metrics.sizeBytes.DeleteLabelValues(GroupID(group))
+			a.metrics.growthRate.DeleteLabelValues(GroupID(group))
+		}
+	}
+	elapsed := snapshot.Time.Sub(a.current.Time).Seconds()
+	for group, size := range snapshot.Bytes {
+		a.metrics.sizeBytes.WithLabelValues(GroupID(group)).Set(float64(size))
+
+		// Growth rate is known only from the second snapshot on. Groups missing in the previous snapshot grew from zero.
+		if !a.current.Time.IsZero() && elapsed > 0 {
+			a.metrics.growthRate.WithLabelValues(GroupID(group)).Set(float64(size-a.current.Bytes[group]) / elapsed)
+		}
+	}
+	a.previous, a.current = a.current, snapshot
+	return nil
+}
+
+func (a *groupSizeAccounter) snapshots() (current GroupSizeSnapshot, previous GroupSizeSnapshot) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	return copySnapshot(a.current), copySnapshot(a.previous)
+}
+
+func copySnapshot(s GroupSizeSnapshot) GroupSizeSnapshot {
+	c := GroupSizeSnapshot{Time: s.Time, Bytes: make(map[string]int64, len(s.Bytes))}
+	for k, v := range s.Bytes {
+		c.Bytes[k] = v
+	}
+	return c
+}
+
+// objectsSize returns total size of all objects under given directory, recursively.
+func objectsSize(ctx context.Context, bkt objstore.Bucket, dir string) (size int64, err error) {
+	err = bkt.Iter(ctx, dir, func(name string) error {
+		if strings.HasSuffix(name, objstore.DirDelim) {
+			s, err := objectsSize(ctx, bkt, name)
+			size += s
+			return err
+		}
+		attrs, err := bkt.Attributes(ctx, name)
+		if err != nil {
+			return errors.Wrapf(err, "attributes of %s", name)
+		}
+		size += attrs.Size
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,110 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestGroupSizeAccounter(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	upload := func(id ulid.ULID, name string, size int) {
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), name), bytes.NewReader(make([]byte, size))))
+	}
+	meta := func(id ulid.ULID, lbls map[string]string) *metadata.Meta {
+		m := &metadata.Meta{Thanos: metadata.Thanos{Labels: lbls}}
+		m.ULID = id
+		return m
+	}
+
+	id1, id2, id3 := ulid.MustNew(1, nil), ulid.MustNew(2, nil), ulid.MustNew(3, nil)
+	upload(id1, "meta.json", 10)
+	upload(id1, "index", 100)
+	upload(id1, "chunks/000001", 1000)
+	upload(id2, "index", 50)
+	upload(id3, "index", 7)
+
+	metas := map[ulid.ULID]*metadata.Meta{
+		id1: meta(id1, map[string]string{"a": "1"}),
+		id2: meta(id2, map[string]string{"a": "1"}),
+		id3: meta(id3, map[string]string{"a": "2"}),
+	}
+	g1, g2 := DefaultGroupKey(metas[id1].Thanos), DefaultGroupKey(metas[id3].Thanos)
+
+	reg := prometheus.NewRegistry()
+	a := newGroupSizeAccounter(newGroupSizeMetrics(reg), bkt, nil, 2)
+	testutil.Ok(t, a.update(ctx, metas))
+
+	cur, prev := a.snapshots()
+	testutil.Equals(t, map[string]int64{g1: 1160, g2: 7}, cur.Bytes)
+	testutil.Equals(t, 0, len(prev.Bytes))
+	testutil.Equals(t, 1160.0, promtest.ToFloat64(a.metrics.sizeBytes.WithLabelValues(GroupID(g1))))
+
+	// Sizes of known blocks are cached, so changing their objects has no effect.
+	upload(id1, "index", 1)
+	id4 := ulid.MustNew(4, nil)
+	upload(id4, "index", 40)
+	metas[id4] = meta(id4, map[string]string{"a": "1"})
+	delete(metas, id3)
+	testutil.Ok(t, a.update(ctx, metas))
+
+	cur, prev = a.snapshots()
+	testutil.Equals(t, map[string]int64{g1: 1200}, cur.Bytes)
+	testutil.Equals(t, map[string]int64{g1: 1160, g2: 7}, prev.Bytes)
+	testutil.Assert(t, promtest.ToFloat64(a.metrics.growthRate.WithLabelValues(GroupID(g1))) > 0, "expected positive growth rate")
+	testutil.Equals(t, 1, promtest.CollectAndCount(a.metrics.sizeBytes))
+
+	// Blocks missing in the bucket are not cached with zero size, so they count once their objects appear.
+	id5 := ulid.MustNew(5, nil)
+	metas[id5] = meta(id5, map[string]string{"a": "1"})
+	testutil.Ok(t, a.update(ctx, metas))
+	cur, _ = a.snapshots()
+	testutil.Equals(t, map[string]int64{g1: 1200}, cur.Bytes)
+	upload(id5, "index", 5)
+	testutil.Ok(t, a.update(ctx, metas))
+	cur, _ = a.snapshots()
+	testutil.Equals(t, map[string]int64{g1: 1205}, cur.Bytes)
+}
+
+func TestGroupSizeAccounter_Inventory(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	id1, id2 := ulid.MustNew(1, nil), ulid.MustNew(2, nil)
+	report := fmt.Sprintf("name,size\n%s/meta.json,10\n%s/chunks/000001,1000\n%s/index,1\n", id1, id1, id2)
+	testutil.Ok(t, bkt.Upload(ctx, "inv/cfg_0_0.csv", strings.NewReader(report)))
+	manifest := fmt.Sprintf(`{"snapshot_time": %q, "report_shards_file_names": ["cfg_0_0.csv"]}`, time.Now().Format(time.RFC3339))
+	testutil.Ok(t, bkt.Upload(ctx, "inv/cfg_0_manifest.json", strings.NewReader(manifest)))
+	// Blocks listed without meta.json might have been partially uploaded when the report was taken.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id2.String(), "index"), bytes.NewReader(make([]byte, 50))))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id2.String(), "meta.json"), bytes.NewReader(make([]byte, 5))))
+
+	inv, err := objstore.NewInventoryReader(log.NewNopLogger(), nil, bkt, "inv", objstore.InventoryFormatGCS, time.Hour)
+	testutil.Ok(t, err)
+	testutil.Ok(t, inv.Sync(ctx))
+
+	m := &metadata.Meta{Thanos: metadata.Thanos{Labels: map[string]string{"a": "1"}}}
+	a := newGroupSizeAccounter(newGroupSizeMetrics(prometheus.NewRegistry()), bkt, inv, 2)
+	testutil.Ok(t, a.update(ctx, map[ulid.ULID]*metadata.Meta{id1: m, id2: m}))
+
+	cur, _ := a.snapshots()
+	testutil.Equals(t, map[string]int64{DefaultGroupKey(m.Thanos): 1065}, cur.Bytes)
+}
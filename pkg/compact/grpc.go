@@ -0,0 +1,95 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thanos-io/thanos/pkg/compact/compactpb"
+)
+
+var _ compactpb.CompactorServer = &GRPCServer{}
+
+// GRPCServer implements the gRPC Compactor API on top of BucketCompactor.
+type GRPCServer struct {
+	compactor *BucketCompactor
+}
+
+// NewGRPCServer returns new GRPCServer exposing compaction jobs of the given BucketCompactor.
+func NewGRPCServer(compactor *BucketCompactor) *GRPCServer {
+	return &GRPCServer{compactor: compactor}
+}
+
+// Events streams compaction job events until the stream is canceled. The stream is ended with ResourceExhausted
+// error if the client does not keep up with events.
+func (s *GRPCServer) Events(_ *compactpb.EventsRequest, srv compactpb.Compactor_EventsServer) error {
+	events, unsubscribe := s.compactor.SubscribeJobEvents()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-srv.Context().Done():
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "client does not keep up with compaction job events")
+			}
+			if err := srv.Send(jobEventToProto(e)); err != nil {
+				return errors.Wrap(err, "send compaction job event")
+			}
+		}
+	}
+}
+
+// Queue returns groups of the ongoing compaction iteration.
+func (s *GRPCServer) Queue(context.Context, *compactpb.QueueRequest) (*compactpb.QueueResponse, error) {
+	queue := s.compactor.Queue()
+	resp := &compactpb.QueueResponse{Groups: make([]compactpb.QueuedGroup, 0, len(queue))}
+	for _, g := range queue {
+		resp.Groups = append(resp.Groups, compactpb.QueuedGroup{
+			Group:       g.Key,
+			Labels:      g.Labels.String(),
+			Resolution:  g.Resolution,
+			Blocks:      int64(g.Blocks),
+			Running:     g.Running,
+			Prioritized: g.Prioritized,
+		})
+	}
+	return resp, nil
+}
+
+// Prioritize requests the given group to be compacted before other groups.
+func (s *GRPCServer) Prioritize(_ context.Context, r *compactpb.PrioritizeRequest) (*compactpb.PrioritizeResponse, error) {
+	if r.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "group key is required")
+	}
+	s.compactor.Prioritize(r.Group)
+	return &compactpb.PrioritizeResponse{}, nil
+}
+
+func jobEventToProto(e JobEvent) *compactpb.Event {
+	res := &compactpb.Event{
+		Group:     e.Group,
+		Timestamp: timestamp.FromTime(e.Time),
+	}
+	switch e.Type {
+	case JobStarted:
+		res.Type = compactpb.Event_STARTED
+	case JobFinished:
+		res.Type = compactpb.Event_FINISHED
+		if e.ResultBlock != (ulid.ULID{}) {
+			res.ResultBlock = e.ResultBlock.String()
+		}
+	case JobFailed:
+		res.Type = compactpb.Event_FAILED
+		res.Error = e.Err.Error()
+	}
+	return res
+}
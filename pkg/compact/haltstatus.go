@@ -0,0 +1,72 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"regexp"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// ulidRe matches strings that may be ULIDs, in Crockford's base32.
+var ulidRe = regexp.MustCompile(`[0-7][0-9A-HJKMNP-TV-Z]{25}`)
+
+// HaltBlocks returns IDs of blocks mentioned by the given error, e.g. source blocks of the compaction that failed or
+// the broken block, in the order they are mentioned.
+func HaltBlocks(err error) []ulid.ULID {
+	var (
+		res  []ulid.ULID
+		seen = map[ulid.ULID]struct{}{}
+	)
+	for _, s := range ulidRe.FindAllString(err.Error(), -1) {
+		id, perr := ulid.ParseStrict(s)
+		if perr != nil {
+			continue
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		res = append(res, id)
+	}
+	return res
+}
+
+// WriteHaltStatus writes the halt status of the compactor with the given identity, halted on the given error, into
+// metadata.CompactorStatusDir of the bucket, replacing any status written before.
+func WriteHaltStatus(ctx context.Context, bkt objstore.Bucket, instance string, haltErr error, now time.Time) error {
+	b, err := json.Marshal(metadata.HaltStatus{
+		Instance: instance,
+		Reason:   haltErr.Error(),
+		Blocks:   HaltBlocks(haltErr),
+		HaltTime: now.Unix(),
+		Version:  metadata.HaltStatusVersion1,
+	})
+	if err != nil {
+		return errors.Wrap(err, "json encode halt status")
+	}
+	fn := metadata.HaltStatusFile(instance)
+	if err := bkt.Upload(ctx, fn, bytes.NewReader(b)); err != nil {
+		return errors.Wrapf(err, "upload %s", fn)
+	}
+	return nil
+}
+
+// ClearHaltStatus deletes the halt status of the compactor with the given identity, if any, e.g. once the compactor
+// recovered from a halt.
+func ClearHaltStatus(ctx context.Context, bkt objstore.Bucket, instance string) error {
+	fn := metadata.HaltStatusFile(instance)
+	if err := bkt.Delete(ctx, fn); err != nil && !bkt.IsObjNotFoundErr(err) {
+		return errors.Wrapf(err, "delete %s", fn)
+	}
+	return nil
+}
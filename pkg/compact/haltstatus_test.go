@@ -0,0 +1,49 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestHaltStatus(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+
+	a, b := ulid.MustNew(1, nil), ulid.MustNew(2, nil)
+	haltErr := halt(errors.Errorf("overlapping sources detected for plan [/data/compact/0@1/%s /data/compact/0@1/%s %s]", a, b, a))
+	testutil.Equals(t, []ulid.ULID{a, b}, HaltBlocks(haltErr))
+
+	_, err := metadata.ReadHaltStatus(ctx, bkt, logger, "compactor-0")
+	testutil.Equals(t, metadata.ErrorHaltStatusNotFound, err)
+
+	now := time.Unix(1000, 0)
+	testutil.Ok(t, WriteHaltStatus(ctx, bkt, "compactor-0", haltErr, now))
+	status, err := metadata.ReadHaltStatus(ctx, bkt, logger, "compactor-0")
+	testutil.Ok(t, err)
+	testutil.Equals(t, metadata.HaltStatus{
+		Instance: "compactor-0",
+		Reason:   haltErr.Error(),
+		Blocks:   []ulid.ULID{a, b},
+		HaltTime: 1000,
+		Version:  metadata.HaltStatusVersion1,
+	}, *status)
+
+	testutil.Ok(t, ClearHaltStatus(ctx, bkt, "compactor-0"))
+	_, err = metadata.ReadHaltStatus(ctx, bkt, logger, "compactor-0")
+	testutil.Equals(t, metadata.ErrorHaltStatusNotFound, err)
+	// Clearing is idempotent.
+	testutil.Ok(t, ClearHaltStatus(ctx, bkt, "compactor-0"))
+}
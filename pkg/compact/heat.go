@@ -0,0 +1,46 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// HeatProvider scores compaction groups by how hot they are for queries, e.g. based on query statistics of store
+// gateways. Hot groups are compacted first, so benefits of compaction are visible to queries sooner.
+type HeatProvider interface {
+	// Heat returns scores of the given group keys. The higher the score, the sooner the group is compacted. Groups
+	// missing in the result are scored 0.
+	Heat(ctx context.Context, groupKeys []string) (map[string]float64, error)
+}
+
+// NoopHeatProvider scores all groups the same, so they are compacted in the order returned by the Grouper.
+type NoopHeatProvider struct{}
+
+// Heat implements HeatProvider.
+func (NoopHeatProvider) Heat(context.Context, []string) (map[string]float64, error) { return nil, nil }
+
+// sortByHeat orders the given groups from the hottest one, keeping the order of groups with the same score. Heat is
+// best effort, so the groups are left as they are if scoring fails.
+func sortByHeat(ctx context.Context, logger log.Logger, p HeatProvider, groups []*Group) {
+	keys := make([]string, 0, len(groups))
+	for _, g := range groups {
+		keys = append(keys, g.Key())
+	}
+	heat, err := p.Heat(ctx, keys)
+	if err != nil {
+		level.Warn(logger).Log("msg", "failed to score compaction groups by heat; compacting them in default order", "err", err)
+		return
+	}
+	if len(heat) == 0 {
+		return
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return heat[groups[i].Key()] > heat[groups[j].Key()]
+	})
+}
@@ -0,0 +1,67 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+type heatProviderFunc func(ctx context.Context, groupKeys []string) (map[string]float64, error)
+
+func (f heatProviderFunc) Heat(ctx context.Context, groupKeys []string) (map[string]float64, error) {
+	return f(ctx, groupKeys)
+}
+
+func TestSortByHeat(t *testing.T) {
+	newGroups := func() []*Group {
+		var groups []*Group
+		for _, key := range []string{"0@1", "0@2", "0@3", "0@4"} {
+			g, err := NewGroup(nil, nil, key, labels.FromStrings("a", key), 0, false, false, GroupMetrics{})
+			testutil.Ok(t, err)
+			groups = append(groups, g)
+		}
+		return groups
+	}
+	keys := func(groups []*Group) (res []string) {
+		for _, g := range groups {
+			res = append(res, g.Key())
+		}
+		return res
+	}
+	ctx := context.Background()
+
+	groups := newGroups()
+	sortByHeat(ctx, log.NewNopLogger(), NoopHeatProvider{}, groups)
+	testutil.Equals(t, []string{"0@1", "0@2", "0@3", "0@4"}, keys(groups))
+
+	var gotKeys []string
+	sortByHeat(ctx, log.NewNopLogger(), heatProviderFunc(func(_ context.Context, groupKeys []string) (map[string]float64, error) {
+		gotKeys = groupKeys
+		return map[string]float64{"0@2": 1, "0@3": 5, "0@4": 1}, nil
+	}), groups)
+	testutil.Equals(t, []string{"0@1", "0@2", "0@3", "0@4"}, gotKeys)
+	testutil.Equals(t, []string{"0@3", "0@2", "0@4", "0@1"}, keys(groups))
+
+	// Failed scoring keeps the order.
+	groups = newGroups()
+	sortByHeat(ctx, log.NewNopLogger(), heatProviderFunc(func(context.Context, []string) (map[string]float64, error) {
+		return map[string]float64{"0@4": 1}, errors.New("unavailable")
+	}), groups)
+	testutil.Equals(t, []string{"0@1", "0@2", "0@3", "0@4"}, keys(groups))
+
+	// Groups prioritized through the jobs API still go before hot ones.
+	tr := newJobTracker()
+	tr.prioritize("0@1")
+	sortByHeat(ctx, log.NewNopLogger(), heatProviderFunc(func(context.Context, []string) (map[string]float64, error) {
+		return map[string]float64{"0@4": 1}, nil
+	}), groups)
+	testutil.Equals(t, []string{"0@1", "0@4", "0@2", "0@3"}, keys(tr.enqueue(groups)))
+}
@@ -0,0 +1,204 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// jobEventsBufferSize is the number of job events buffered for each subscriber. Subscribers not keeping up are
+// unsubscribed, as their view of compaction jobs would otherwise be incomplete.
+const jobEventsBufferSize = 256
+
+// JobEventType is a type of compaction job event.
+type JobEventType int
+
+const (
+	// JobStarted is emitted when a worker picks up a group for compaction.
+	JobStarted JobEventType = iota
+	// JobFinished is emitted when a group compaction succeeds, including compactions which had nothing to do.
+	JobFinished
+	// JobFailed is emitted when a group compaction fails.
+	JobFailed
+)
+
+// JobEvent describes a change of state of a group compaction job.
+type JobEvent struct {
+	Type  JobEventType
+	Group string
+	Time  time.Time
+	// Err is set for JobFailed events.
+	Err error
+	// ResultBlock is the last block created by the job, if any. Set for JobFinished events.
+	ResultBlock ulid.ULID
+}
+
+// QueuedGroup describes a group of the ongoing compaction iteration that is running or waiting to be compacted.
+type QueuedGroup struct {
+	ID          string        `json:"id"`
+	Key         string        `json:"key"`
+	Labels      labels.Labels `json:"labels"`
+	Resolution  int64         `json:"resolution"`
+	Blocks      int           `json:"blocks"`
+	Running     bool          `json:"running"`
+	Prioritized bool          `json:"prioritized"`
+	// Plan is the estimate of the compaction planned by the running group, once planned.
+	Plan *PlanEstimate `json:"plan,omitempty"`
+}
+
+// jobTracker tracks compaction jobs of the ongoing compaction iteration and broadcasts their events to subscribers.
+// Go-routine safe.
+type jobTracker struct {
+	mtx         sync.Mutex
+	queue       []QueuedGroup
+	priorities  map[string]struct{}
+	subscribers map[chan JobEvent]struct{}
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{
+		priorities:  map[string]struct{}{},
+		subscribers: map[chan JobEvent]struct{}{},
+	}
+}
+
+// prioritize requests the group with the given key to be compacted before other groups until it has nothing left to
+// compact or it fails.
+func (t *jobTracker) prioritize(key string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.priorities[key] = struct{}{}
+}
+
+// enqueue orders given groups of a new compaction iteration, prioritized ones first, and records them as queued.
+func (t *jobTracker) enqueue(groups []*Group) []*Group {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	res := make([]*Group, len(groups))
+	copy(res, groups)
+	sort.SliceStable(res, func(i, j int) bool {
+		_, pi := t.priorities[res[i].Key()]
+		_, pj := t.priorities[res[j].Key()]
+		return pi && !pj
+	})
+
+	t.queue = t.queue[:0]
+	for _, g := range res {
+		_, prioritized := t.priorities[g.Key()]
+		t.queue = append(t.queue, QueuedGroup{
+			ID:          g.ID(),
+			Key:         g.Key(),
+			Labels:      g.Labels(),
+			Resolution:  g.Resolution(),
+			Blocks:      len(g.IDs()),
+			Prioritized: prioritized,
+		})
+	}
+	return res
+}
+
+func (t *jobTracker) started(key string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for i := range t.queue {
+		if t.queue[i].Key == key {
+			t.queue[i].Running = true
+			break
+		}
+	}
+	t.broadcast(JobEvent{Type: JobStarted, Group: key, Time: time.Now()})
+}
+
+func (t *jobTracker) planned(key string, e PlanEstimate) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for i := range t.queue {
+		if t.queue[i].Key == key {
+			t.queue[i].Plan = &e
+			break
+		}
+	}
+}
+
+func (t *jobTracker) finished(key string, shouldRerun bool, compID ulid.ULID, err error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for i := range t.queue {
+		if t.queue[i].Key == key {
+			t.queue = append(t.queue[:i], t.queue[i+1:]...)
+			break
+		}
+	}
+
+	if err != nil {
+		delete(t.priorities, key)
+		t.broadcast(JobEvent{Type: JobFailed, Group: key, Time: time.Now(), Err: err})
+		return
+	}
+	if !shouldRerun {
+		delete(t.priorities, key)
+	}
+	t.broadcast(JobEvent{Type: JobFinished, Group: key, Time: time.Now(), ResultBlock: compID})
+}
+
+// iterationFinished drops groups that were never picked up, e.g. because of an error of another group.
+func (t *jobTracker) iterationFinished() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.queue = t.queue[:0]
+}
+
+func (t *jobTracker) queued() []QueuedGroup {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	res := make([]QueuedGroup, len(t.queue))
+	copy(res, t.queue)
+	return res
+}
+
+// subscribe returns channel receiving all job events from now on until unsubscribe is called. The channel is closed
+// once unsubscribed, also when the subscriber does not keep up with events.
+func (t *jobTracker) subscribe() (events <-chan JobEvent, unsubscribe func()) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	ch := make(chan JobEvent, jobEventsBufferSize)
+	t.subscribers[ch] = struct{}{}
+	return ch, func() {
+		t.mtx.Lock()
+		defer t.mtx.Unlock()
+
+		t.unsubscribe(ch)
+	}
+}
+
+func (t *jobTracker) unsubscribe(ch chan JobEvent) {
+	if _, ok := t.subscribers[ch]; !ok {
+		return
+	}
+	delete(t.subscribers, ch)
+	close(ch)
+}
+
+func (t *jobTracker) broadcast(e JobEvent) {
+	for ch := range t.subscribers {
+		select {
+		case ch <- e:
+		default:
+			t.unsubscribe(ch)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestJobTracker(t *testing.T) {
+	var groups []*Group
+	for _, key := range []string{"0@1", "0@2", "0@3"} {
+		g, err := NewGroup(nil, nil, key, labels.FromStrings("a", key), 0, false, false, GroupMetrics{})
+		testutil.Ok(t, err)
+		groups = append(groups, g)
+	}
+	keys := func(groups []*Group) (res []string) {
+		for _, g := range groups {
+			res = append(res, g.Key())
+		}
+		return res
+	}
+
+	tr := newJobTracker()
+	events, unsubscribe := tr.subscribe()
+	defer unsubscribe()
+
+	tr.prioritize("0@3")
+	testutil.Equals(t, []string{"0@3", "0@1", "0@2"}, keys(tr.enqueue(groups)))
+
+	compID := ulid.MustNew(1, nil)
+	tr.started("0@3")
+	q := tr.queued()
+	testutil.Equals(t, 3, len(q))
+	testutil.Equals(t, QueuedGroup{ID: GroupID("0@3"), Key: "0@3", Labels: labels.FromStrings("a", "0@3"), Running: true, Prioritized: true}, q[0])
+	testutil.Assert(t, !q[1].Running && !q[1].Prioritized, "expected 0@1 to be waiting without priority")
+
+	// Group is prioritized as long as it has more to compact.
+	tr.finished("0@3", true, compID, nil)
+	testutil.Equals(t, 2, len(tr.queued()))
+	tr.started("0@1")
+	tr.finished("0@1", false, ulid.ULID{}, errors.New("failed"))
+	tr.iterationFinished()
+	testutil.Equals(t, 0, len(tr.queued()))
+	testutil.Equals(t, []string{"0@3", "0@1", "0@2"}, keys(tr.enqueue(groups)))
+
+	tr.started("0@3")
+	tr.finished("0@3", false, ulid.ULID{}, nil)
+	testutil.Equals(t, []string{"0@1", "0@2", "0@3"}, keys(tr.enqueue(groups)))
+
+	for _, exp := range []JobEvent{
+		{Type: JobStarted, Group: "0@3"},
+		{Type: JobFinished, Group: "0@3", ResultBlock: compID},
+		{Type: JobStarted, Group: "0@1"},
+		{Type: JobFailed, Group: "0@1"},
+		{Type: JobStarted, Group: "0@3"},
+		{Type: JobFinished, Group: "0@3"},
+	} {
+		e := <-events
+		testutil.Assert(t, !e.Time.IsZero(), "expected event time")
+		testutil.Equals(t, exp.Type, e.Type)
+		testutil.Equals(t, exp.Group, e.Group)
+		testutil.Equals(t, exp.ResultBlock, e.ResultBlock)
+		testutil.Equals(t, exp.Type == JobFailed, e.Err != nil)
+	}
+
+	// Subscriber not keeping up is unsubscribed.
+	for i := 0; i <= jobEventsBufferSize; i++ {
+		tr.started("0@1")
+	}
+	for i := 0; i < jobEventsBufferSize; i++ {
+		<-events
+	}
+	_, ok := <-events
+	testutil.Assert(t, !ok, "expected events channel to be closed")
+}
@@ -0,0 +1,65 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// ErrLeaseHeld is returned by RenewLease if the compactor lease is held by another compactor.
+var ErrLeaseHeld = errors.New("compactor lease is held by another compactor")
+
+// activeLease returns the compactor lease of the bucket held by other than the given holder, if it is active.
+func activeLease(ctx context.Context, logger log.Logger, bkt objstore.InstrumentedBucketReader, holder string, now time.Time) (*metadata.CompactorLease, error) {
+	lease, err := metadata.ReadCompactorLease(ctx, bkt, logger)
+	if err == metadata.ErrorCompactorLeaseNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read compactor lease")
+	}
+	if lease.Holder == holder || !lease.Active(now) {
+		return nil, nil
+	}
+	return lease, nil
+}
+
+// RenewLease acquires or renews the compactor lease of the bucket for the given holder for the given TTL, unless an
+// active lease of another holder exists, in which case ErrLeaseHeld is returned. Concurrent renewals are not atomic,
+// so the lease tells compactors about each other rather than excluding them.
+func RenewLease(ctx context.Context, logger log.Logger, bkt objstore.InstrumentedBucket, holder string, ttl time.Duration) error {
+	now := time.Now()
+	other, err := activeLease(ctx, logger, bkt, holder, now)
+	if err != nil {
+		return err
+	}
+	if other != nil {
+		return errors.Wrapf(ErrLeaseHeld, "holder %s, expiring at %s", other.Holder, time.Unix(other.ExpiryTime, 0))
+	}
+
+	lease, err := json.Marshal(metadata.CompactorLease{
+		Holder:     holder,
+		RenewTime:  now.Unix(),
+		ExpiryTime: now.Add(ttl).Unix(),
+		Version:    metadata.CompactorLeaseVersion1,
+	})
+	if err != nil {
+		return errors.Wrap(err, "json encode compactor lease")
+	}
+	if err := bkt.Upload(ctx, metadata.CompactorLeaseFilename, bytes.NewReader(lease)); err != nil {
+		return errors.Wrapf(err, "upload file %s to bucket", metadata.CompactorLeaseFilename)
+	}
+	level.Debug(logger).Log("msg", "renewed compactor lease", "holder", holder, "ttl", ttl)
+	return nil
+}
@@ -0,0 +1,154 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// loadAcksRefreshInterval is how long load acknowledgements are reused between evaluations, so deleting many blocks
+// does not read all acknowledgements for every block.
+const loadAcksRefreshInterval = 30 * time.Second
+
+// StoreLoadAckPolicy is a DeletionPolicy keeping blocks whose data was merged into other blocks, i.e. sources of
+// compactions and duplicates, until every store gateway that loaded them also loaded a replacement. Store gateways
+// acknowledge loaded blocks with metadata.LoadAck after each sync; a replacement is a block of the same resolution
+// created from all sources of the kept block. Without it, queries miss the data of the block from the time store
+// gateways drop it until they load the replacement. Store gateways not acknowledging for longer than maxAge are
+// considered gone and ignored. Go-routine safe.
+type StoreLoadAckPolicy struct {
+	logger log.Logger
+	bkt    objstore.Bucket
+	maxAge time.Duration
+	now    func() time.Time
+
+	mtx      sync.Mutex
+	acks     []*metadata.LoadAck
+	acksRead time.Time
+	// metas caches metas of acknowledged blocks, which are immutable for the purpose of finding replacements.
+	metas map[ulid.ULID]*metadata.Meta
+}
+
+// NewStoreLoadAckPolicy returns StoreLoadAckPolicy considering load acknowledgements updated within the given maxAge.
+func NewStoreLoadAckPolicy(logger log.Logger, bkt objstore.Bucket, maxAge time.Duration) *StoreLoadAckPolicy {
+	return &StoreLoadAckPolicy{
+		logger: logger,
+		bkt:    bkt,
+		maxAge: maxAge,
+		now:    time.Now,
+		metas:  map[ulid.ULID]*metadata.Meta{},
+	}
+}
+
+// AllowDeletion implements DeletionPolicy.
+func (p *StoreLoadAckPolicy) AllowDeletion(ctx context.Context, meta *metadata.Meta, reason metadata.DeletionReason) (bool, error) {
+	if reason != CompactedDeletionReason && reason != DuplicateDeletionReason {
+		return true, nil
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if err := p.refresh(ctx); err != nil {
+		return false, err
+	}
+	now := p.now()
+	for _, ack := range p.acks {
+		if now.Sub(ack.Updated()) > p.maxAge {
+			continue
+		}
+		loaded, replaced := false, false
+		for _, id := range ack.Blocks {
+			if id == meta.ULID {
+				loaded = true
+				continue
+			}
+			// Replacements are created after the blocks they replace.
+			if replaced || id.Time() < meta.ULID.Time() {
+				continue
+			}
+			m, err := p.meta(ctx, id)
+			if err != nil {
+				return false, err
+			}
+			replaced = m != nil && replaces(m, meta)
+		}
+		if loaded && !replaced {
+			level.Debug(p.logger).Log("msg", "store gateway did not load replacement of block yet", "block", meta.ULID, "store", ack.ID)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// refresh reads load acknowledgements if they were not read recently, and drops cached metas of blocks no longer
+// acknowledged.
+func (p *StoreLoadAckPolicy) refresh(ctx context.Context) error {
+	if !p.acksRead.IsZero() && p.now().Sub(p.acksRead) < loadAcksRefreshInterval {
+		return nil
+	}
+	acks, err := metadata.ReadLoadAcks(ctx, p.bkt, p.logger)
+	if err != nil {
+		return errors.Wrap(err, "read load acks")
+	}
+	p.acks, p.acksRead = acks, p.now()
+
+	acked := map[ulid.ULID]struct{}{}
+	for _, ack := range acks {
+		for _, id := range ack.Blocks {
+			acked[id] = struct{}{}
+		}
+	}
+	for id := range p.metas {
+		if _, ok := acked[id]; !ok {
+			delete(p.metas, id)
+		}
+	}
+	return nil
+}
+
+// meta returns the meta of the given acknowledged block, or nil if the block is no longer in the bucket.
+func (p *StoreLoadAckPolicy) meta(ctx context.Context, id ulid.ULID) (*metadata.Meta, error) {
+	if m, ok := p.metas[id]; ok {
+		return m, nil
+	}
+	m, err := block.DownloadMeta(ctx, p.logger, p.bkt, id)
+	if err != nil {
+		if p.bkt.IsObjNotFoundErr(errors.Cause(err)) {
+			p.metas[id] = nil
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "download meta of acknowledged block %s", id)
+	}
+	p.metas[id] = &m
+	return &m, nil
+}
+
+// replaces returns true if block r holds all data of block b.
+func replaces(r, b *metadata.Meta) bool {
+	if r.Thanos.Downsample.Resolution != b.Thanos.Downsample.Resolution {
+		return false
+	}
+	sources := make(map[ulid.ULID]struct{}, len(r.Compaction.Sources))
+	for _, s := range r.Compaction.Sources {
+		sources[s] = struct{}{}
+	}
+	for _, s := range b.Compaction.Sources {
+		if _, ok := sources[s]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestStoreLoadAckPolicy(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+
+	newMeta := func(ms uint64, sources ...ulid.ULID) *metadata.Meta {
+		id := ulid.MustNew(ms, nil)
+		m := &metadata.Meta{BlockMeta: tsdb.BlockMeta{ULID: id, Compaction: tsdb.BlockMetaCompaction{Sources: append([]ulid.ULID{id}, sources...)}}}
+		b, err := json.Marshal(m)
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), block.MetaFilename), bytes.NewReader(b)))
+		return m
+	}
+	var (
+		source    = newMeta(1000)
+		other     = newMeta(1500)
+		compacted = newMeta(2000, source.ULID, other.ULID)
+	)
+	// Downsampled block of the source is not its replacement.
+	downsampled := newMeta(2500, source.ULID)
+	downsampled.Thanos.Downsample.Resolution = int64(ResolutionLevel5m)
+	b, err := json.Marshal(downsampled)
+	testutil.Ok(t, err)
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(downsampled.ULID.String(), block.MetaFilename), bytes.NewReader(b)))
+
+	now := time.Now()
+	p := NewStoreLoadAckPolicy(log.NewNopLogger(), bkt, time.Hour)
+	p.now = func() time.Time { return now }
+	allow := func(reason metadata.DeletionReason) bool {
+		ok, err := p.AllowDeletion(ctx, source, reason)
+		testutil.Ok(t, err)
+		return ok
+	}
+
+	// Without acknowledgements there is nothing to wait for.
+	testutil.Assert(t, allow(CompactedDeletionReason))
+
+	// Store gateway not serving the source block does not need to load its replacement.
+	testutil.Ok(t, block.UploadLoadAck(ctx, bkt, "store-2", []ulid.ULID{other.ULID}))
+	testutil.Ok(t, block.UploadLoadAck(ctx, bkt, "store-1", []ulid.ULID{source.ULID, other.ULID, downsampled.ULID}))
+	now = now.Add(loadAcksRefreshInterval)
+	testutil.Assert(t, !allow(CompactedDeletionReason))
+	testutil.Assert(t, !allow(DuplicateDeletionReason))
+	testutil.Assert(t, allow(RetentionDeletionReason))
+
+	// Acknowledgements are reused until refreshed.
+	testutil.Ok(t, block.UploadLoadAck(ctx, bkt, "store-1", []ulid.ULID{source.ULID, other.ULID, compacted.ULID}))
+	testutil.Assert(t, !allow(CompactedDeletionReason))
+	now = now.Add(loadAcksRefreshInterval)
+	testutil.Assert(t, allow(CompactedDeletionReason))
+
+	// Stale acknowledgements are ignored.
+	testutil.Ok(t, block.UploadLoadAck(ctx, bkt, "store-1", []ulid.ULID{source.ULID}))
+	now = now.Add(loadAcksRefreshInterval)
+	testutil.Assert(t, !allow(CompactedDeletionReason))
+	now = now.Add(2 * time.Hour)
+	testutil.Assert(t, allow(CompactedDeletionReason))
+}
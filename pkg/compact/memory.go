@@ -0,0 +1,166 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// MemoryLimit returns the memory limit of the process in bytes: the lower of GOMEMLIMIT and the memory limit of its
+// cgroup, if any. It returns 0 if neither is set.
+func MemoryLimit() (uint64, error) {
+	limit, err := parseGoMemLimit(os.Getenv("GOMEMLIMIT"))
+	if err != nil {
+		return 0, errors.Wrap(err, "parse GOMEMLIMIT")
+	}
+	cgroupLimit, err := cgroupMemoryLimit()
+	if err != nil {
+		return 0, errors.Wrap(err, "read cgroup memory limit")
+	}
+	if cgroupLimit > 0 && (limit == 0 || cgroupLimit < limit) {
+		limit = cgroupLimit
+	}
+	return limit, nil
+}
+
+// parseGoMemLimit parses the value of GOMEMLIMIT, as accepted by the Go runtime: a number of bytes with an optional
+// B, KiB, MiB, GiB or TiB suffix. Empty value and "off" mean no limit, returned as 0.
+func parseGoMemLimit(v string) (uint64, error) {
+	if v == "" || v == "off" {
+		return 0, nil
+	}
+	num, mult := v, uint64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   uint64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40}, {"B", 1},
+	} {
+		if strings.HasSuffix(v, u.suffix) {
+			num, mult = strings.TrimSuffix(v, u.suffix), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid memory limit %q", v)
+	}
+	return n * mult, nil
+}
+
+// MemoryGovernor pauses starts of new group compactions while memory usage of the process is above the given fraction of
+// its memory limit, so that running compactions can finish and release their memory instead of the process being
+// OOM-killed in the middle of an upload. A compaction is always started if no other one is running, as usage is not
+// going to go down otherwise. Go-routine safe.
+type MemoryGovernor struct {
+	logger    log.Logger
+	limit     uint64
+	threshold uint64
+	interval  time.Duration
+	usage     func() (uint64, error)
+
+	mtx     sync.Mutex
+	running int
+
+	usageBytes     prometheus.Gauge
+	throttled      prometheus.Gauge
+	throttledTotal prometheus.Counter
+}
+
+// NewMemoryGovernor returns MemoryGovernor throttling compactions once memory usage of the process reaches the given
+// ratio of the given memory limit in bytes, checking the usage in the given interval while throttled.
+func NewMemoryGovernor(logger log.Logger, reg prometheus.Registerer, limit uint64, ratio float64, interval time.Duration) *MemoryGovernor {
+	g := &MemoryGovernor{
+		logger:    logger,
+		limit:     limit,
+		threshold: uint64(float64(limit) * ratio),
+		interval:  interval,
+		usage:     processMemory,
+		usageBytes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_memory_usage_bytes",
+			Help: "Memory usage of the process, as of the last check before starting a group compaction.",
+		}),
+		throttled: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_memory_throttled_groups",
+			Help: "Number of group compactions waiting for memory usage to go below the throttling threshold.",
+		}),
+		throttledTotal: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_memory_throttled_total",
+			Help: "Total number of group compactions delayed because of memory usage above the throttling threshold.",
+		}),
+	}
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "thanos_compact_memory_limit_bytes",
+		Help: "Memory limit of the process used for throttling group compactions.",
+	}, func() float64 { return float64(limit) })
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "thanos_compact_memory_throttle_threshold_bytes",
+		Help: "Memory usage above which new group compactions are not started.",
+	}, func() float64 { return float64(g.threshold) })
+	return g
+}
+
+// acquire blocks until a group compaction can be started, or the context is canceled. The returned function must be
+// called once the compaction finishes.
+func (g *MemoryGovernor) acquire(ctx context.Context) (release func(), err error) {
+	throttled := false
+	defer func() {
+		if throttled {
+			g.throttled.Dec()
+		}
+	}()
+	for {
+		ok, err := g.tryAcquire()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return g.release, nil
+		}
+		if !throttled {
+			throttled = true
+			g.throttled.Inc()
+			g.throttledTotal.Inc()
+			level.Warn(g.logger).Log("msg", "memory usage above threshold; delaying start of group compaction until it goes down", "threshold_bytes", g.threshold, "limit_bytes", g.limit)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(g.interval):
+		}
+	}
+}
+
+func (g *MemoryGovernor) tryAcquire() (bool, error) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	usage, err := g.usage()
+	if err != nil {
+		return false, errors.Wrap(err, "read memory usage")
+	}
+	g.usageBytes.Set(float64(usage))
+	if g.running > 0 && usage >= g.threshold {
+		return false, nil
+	}
+	g.running++
+	return true, nil
+}
+
+func (g *MemoryGovernor) release() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.running--
+}
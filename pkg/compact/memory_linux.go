@@ -0,0 +1,64 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	cgroupV2MemoryMax = "/sys/fs/cgroup/memory.max"
+	cgroupV1MemoryMax = "/sys/fs/cgroup/memory/memory.limit_in_bytes"
+
+	// cgroup v1 reports no limit as the largest page aligned int64, depending on the page size of the architecture.
+	cgroupV1Unlimited = 1 << 62
+)
+
+// cgroupMemoryLimit returns the memory limit of the cgroup (v2 or v1) of the process, or 0 if there is none.
+func cgroupMemoryLimit() (uint64, error) {
+	for _, f := range []string{cgroupV2MemoryMax, cgroupV1MemoryMax} {
+		b, err := ioutil.ReadFile(f)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		v := strings.TrimSpace(string(b))
+		if v == "max" {
+			return 0, nil
+		}
+		limit, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "parse %s", f)
+		}
+		if limit >= cgroupV1Unlimited {
+			return 0, nil
+		}
+		return limit, nil
+	}
+	return 0, nil
+}
+
+// processMemory returns the resident set size of the process, which is what the OOM killer accounts for.
+func processMemory() (uint64, error) {
+	b, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 2 {
+		return 0, errors.Errorf("unexpected /proc/self/statm content %q", string(b))
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "parse /proc/self/statm")
+	}
+	return pages * uint64(os.Getpagesize()), nil
+}
@@ -0,0 +1,20 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+//go:build !linux
+// +build !linux
+
+package compact
+
+import "runtime"
+
+func cgroupMemoryLimit() (uint64, error) {
+	return 0, nil
+}
+
+// processMemory returns memory obtained from the OS by the Go runtime and not yet returned to it.
+func processMemory() (uint64, error) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.Sys - ms.HeapReleased, nil
+}
@@ -0,0 +1,87 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestParseGoMemLimit(t *testing.T) {
+	for v, exp := range map[string]uint64{
+		"":       0,
+		"off":    0,
+		"1024":   1024,
+		"512B":   512,
+		"2KiB":   2 << 10,
+		"100MiB": 100 << 20,
+		"3GiB":   3 << 30,
+		"1TiB":   1 << 40,
+	} {
+		got, err := parseGoMemLimit(v)
+		testutil.Ok(t, err)
+		testutil.Equals(t, exp, got, "value %q", v)
+	}
+	for _, v := range []string{"1GB", "-1", "MiB", "1.5GiB"} {
+		_, err := parseGoMemLimit(v)
+		testutil.NotOk(t, err, "value %q", v)
+	}
+}
+
+func TestMemoryGovernor(t *testing.T) {
+	ctx := context.Background()
+	var usage uint64 = 100
+
+	g := NewMemoryGovernor(log.NewNopLogger(), prometheus.NewRegistry(), 1000, 0.8, time.Millisecond)
+	g.usage = func() (uint64, error) { return atomic.LoadUint64(&usage), nil }
+
+	release1, err := g.acquire(ctx)
+	testutil.Ok(t, err)
+
+	// First compaction is always started, even above the threshold.
+	release1()
+	atomic.StoreUint64(&usage, 900)
+	release1, err = g.acquire(ctx)
+	testutil.Ok(t, err)
+
+	// While another compaction runs, new ones wait for usage to go down.
+	acquired := make(chan func())
+	go func() {
+		release, err := g.acquire(ctx)
+		testutil.Ok(t, err)
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("compaction started above memory threshold")
+	case <-time.After(50 * time.Millisecond):
+	}
+	testutil.Equals(t, 1.0, promtest.ToFloat64(g.throttled))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(g.throttledTotal))
+
+	atomic.StoreUint64(&usage, 700)
+	release2 := <-acquired
+	testutil.Equals(t, 0.0, promtest.ToFloat64(g.throttled))
+	testutil.Equals(t, 700.0, promtest.ToFloat64(g.usageBytes))
+
+	// Waiting is canceled together with the context.
+	atomic.StoreUint64(&usage, 900)
+	cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = g.acquire(cctx)
+	testutil.NotOk(t, err)
+
+	release1()
+	release2()
+	_, err = g.acquire(ctx)
+	testutil.Ok(t, err)
+}
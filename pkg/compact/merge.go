@@ -0,0 +1,204 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+)
+
+// MergeFunc names a function merging overlapping chunks of the same series during vertical compaction.
+type MergeFunc string
+
+const (
+	// MergeFuncConcat concatenates overlapping chunks in order of their min time, so earlier chunks win where they overlap.
+	MergeFuncConcat MergeFunc = "concat"
+	// MergeFuncDedup merges samples of overlapping chunks, deduplicated by timestamp, as TSDB compaction does.
+	MergeFuncDedup MergeFunc = "dedup"
+	// MergeFuncCounter merges samples of overlapping chunks like MergeFuncDedup, but without counter resets that none of
+	// the chunks observed, e.g. replicas of counters scraped at different times.
+	MergeFuncCounter MergeFunc = "counter"
+)
+
+// MergeFuncNames are all valid values of MergeFunc.
+var MergeFuncNames = []string{
+	string(MergeFuncConcat),
+	string(MergeFuncDedup),
+	string(MergeFuncCounter),
+}
+
+// MergeFuncs are functions merging overlapping chunks by resolution of blocks. Resolutions without a function use
+// MergeFuncDedup for raw blocks and MergeFuncCounter for downsampled blocks.
+type MergeFuncs map[int64]MergeFunc
+
+// get returns the merge function of the given resolution.
+func (f MergeFuncs) get(resolution int64) MergeFunc {
+	if fn, ok := f[resolution]; ok && fn != "" {
+		return fn
+	}
+	if resolution == downsample.ResLevel0 {
+		return MergeFuncDedup
+	}
+	return MergeFuncCounter
+}
+
+// merger returns the chunks merger of the given resolution.
+func (f MergeFuncs) merger(resolution int64) (block.ChunksMerger, error) {
+	fn := f.get(resolution)
+	if resolution == downsample.ResLevel0 {
+		switch fn {
+		case MergeFuncConcat:
+			return block.ConcatChunks, nil
+		case MergeFuncDedup:
+			return block.DedupChunks, nil
+		case MergeFuncCounter:
+			return block.CounterChunks, nil
+		}
+		return nil, errors.Errorf("unknown merge function %q", fn)
+	}
+
+	var merge func([]chunks.Meta, int64) ([]chunks.Meta, error)
+	switch fn {
+	case MergeFuncConcat:
+		merge = downsample.ConcatAggrChunks
+	case MergeFuncDedup:
+		merge = downsample.DedupAggrChunks
+	case MergeFuncCounter:
+		merge = downsample.MergeAggrChunks
+	default:
+		return nil, errors.Errorf("unknown merge function %q", fn)
+	}
+	return func(chks []chunks.Meta) ([]chunks.Meta, error) {
+		return merge(chks, resolution)
+	}, nil
+}
+
+// Validate returns an error if any of the merge functions is unknown.
+func (f MergeFuncs) Validate() error {
+	for res := range f {
+		if _, err := f.merger(res); err != nil {
+			return errors.Wrapf(err, "resolution %d", res)
+		}
+	}
+	return nil
+}
+
+// ChunkPassthroughCompactor is a tsdb.Compactor which merges overlapping blocks with block.MergeBlocks, so chunks not
+// overlapping with chunks of the same series from other blocks are copied instead of being re-encoded. This cuts CPU
+// usage of vertical compaction of mostly disjoint blocks. Overlapping aggregate chunks of downsampled blocks are merged
+// with downsample.MergeAggrChunks, as TSDB compaction reads them as empty. Overlapping chunks are merged by the merge
+// function of the resolution of the blocks. Other compactions are done by the wrapped compactor.
+type ChunkPassthroughCompactor struct {
+	tsdb.Compactor
+
+	logger          log.Logger
+	pool            chunkenc.Pool
+	downsampledOnly bool
+	mergeFuncs      MergeFuncs
+	merges          prometheus.Counter
+	copiedChunks    prometheus.Counter
+	reencodedChunks prometheus.Counter
+}
+
+// NewChunkPassthroughCompactor returns ChunkPassthroughCompactor wrapping the given compactor. Merges obtain chunks from
+// the given pool, which should be the one used by the wrapped compactor, so chunks are reused across all compactions.
+// Overlapping chunks are merged by the given merge functions, which have to be valid.
+func NewChunkPassthroughCompactor(logger log.Logger, reg prometheus.Registerer, comp tsdb.Compactor, pool chunkenc.Pool, mergeFuncs MergeFuncs) *ChunkPassthroughCompactor {
+	return &ChunkPassthroughCompactor{
+		Compactor:  comp,
+		logger:     logger,
+		pool:       pool,
+		mergeFuncs: mergeFuncs,
+		merges: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_chunk_passthrough_merges_total",
+			Help: "Total number of compactions of overlapping blocks merged at the level of chunks.",
+		}),
+		copiedChunks: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_chunk_passthrough_copied_chunks_total",
+			Help: "Total number of source chunks copied verbatim by compactions merged at the level of chunks.",
+		}),
+		reencodedChunks: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_chunk_passthrough_reencoded_chunks_total",
+			Help: "Total number of overlapping source chunks re-encoded by compactions merged at the level of chunks.",
+		}),
+	}
+}
+
+// NewDownsampledMergeCompactor returns ChunkPassthroughCompactor merging only overlapping downsampled blocks, so
+// vertical compaction of downsampled blocks does not lose their data, while overlapping raw blocks are still compacted
+// by the wrapped compactor, unless their merge function is not MergeFuncDedup, the one of TSDB compaction.
+func NewDownsampledMergeCompactor(logger log.Logger, reg prometheus.Registerer, comp tsdb.Compactor, pool chunkenc.Pool, mergeFuncs MergeFuncs) *ChunkPassthroughCompactor {
+	c := NewChunkPassthroughCompactor(logger, reg, comp, pool, mergeFuncs)
+	c.downsampledOnly = true
+	return c
+}
+
+// Compact merges the given blocks at the level of chunks if they are blocks of the same resolution overlapping in time.
+// Otherwise the wrapped compactor is used.
+func (c *ChunkPassthroughCompactor) Compact(dest string, dirs []string, open []*tsdb.Block) (ulid.ULID, error) {
+	metas := make([]*metadata.Meta, 0, len(dirs))
+	for _, d := range dirs {
+		m, err := metadata.Read(d)
+		if err != nil {
+			return ulid.ULID{}, errors.Wrapf(err, "read meta of %s", d)
+		}
+		metas = append(metas, m)
+	}
+	resolution, ok := mergeable(metas)
+	if !ok || c.downsampledOnly && resolution == downsample.ResLevel0 && c.mergeFuncs.get(resolution) == MergeFuncDedup {
+		return c.Compactor.Compact(dest, dirs, open)
+	}
+	merger, err := c.mergeFuncs.merger(resolution)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+
+	begin := time.Now()
+	id, stats, err := block.MergeBlocksWith(c.logger, dest, dirs, c.pool, merger)
+	if err != nil {
+		return ulid.ULID{}, errors.Wrap(err, "merge blocks")
+	}
+	c.merges.Inc()
+	c.copiedChunks.Add(float64(stats.CopiedChunks))
+	c.reencodedChunks.Add(float64(stats.ReencodedChunks))
+	level.Info(c.logger).Log("msg", "merged overlapping blocks", "count", len(dirs), "ulid", id, "sources", fmt.Sprintf("%v", dirs),
+		"copied_chunks", stats.CopiedChunks, "reencoded_chunks", stats.ReencodedChunks, "merge_func", c.mergeFuncs.get(resolution), "duration", time.Since(begin))
+	return id, nil
+}
+
+// mergeable returns the resolution of the given blocks and true if they are all of the same resolution and any of them
+// overlap in time. Non overlapping blocks are already compacted without re-encoding any chunk.
+func mergeable(metas []*metadata.Meta) (int64, bool) {
+	if len(metas) == 0 {
+		return 0, false
+	}
+	resolution := metas[0].Thanos.Downsample.Resolution
+	for _, m := range metas {
+		if m.Thanos.Downsample.Resolution != resolution {
+			return 0, false
+		}
+	}
+	for i := range metas {
+		for j := i + 1; j < len(metas); j++ {
+			if metas[i].MinTime < metas[j].MaxTime && metas[j].MinTime < metas[i].MaxTime {
+				return resolution, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,132 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/block"
+)
+
+// MissingChunksAction is what group compaction does with source blocks whose chunk segment files are missing or
+// truncated in the bucket, e.g. because of an interrupted upload or a broken replication, once downloading them again
+// did not help.
+type MissingChunksAction string
+
+const (
+	// MissingChunksRetry fails the compaction with a retriable error, so it is retried in the next compaction run.
+	MissingChunksRetry MissingChunksAction = "retry"
+	// MissingChunksDropSeries compacts the block without the series with unreadable chunks.
+	MissingChunksDropSeries MissingChunksAction = "drop-series"
+	// MissingChunksQuarantine places the block under hold with QuarantineMissingChunksHoldReason, so it is not compacted
+	// until an operator restores its segments and removes the hold.
+	MissingChunksQuarantine MissingChunksAction = "quarantine"
+)
+
+// MissingChunksActions are all valid values of MissingChunksAction.
+var MissingChunksActions = []string{
+	string(MissingChunksRetry),
+	string(MissingChunksDropSeries),
+	string(MissingChunksQuarantine),
+}
+
+// QuarantineMissingChunksHoldReason prefixes reasons of holds placed on blocks with missing chunk segments.
+const QuarantineMissingChunksHoldReason = "quarantined: missing chunk segments"
+
+// missingChunksDownloadAttempts is the number of times a block with missing chunk segments is downloaded, as listings of
+// eventually consistent buckets may miss objects of recently uploaded blocks.
+const missingChunksDownloadAttempts = 3
+
+// MissingChunksMetrics counts source blocks of compactions with missing or truncated chunk segment files.
+type MissingChunksMetrics struct {
+	redownloads   prometheus.Counter
+	blocks        *prometheus.CounterVec
+	droppedSeries prometheus.Counter
+	droppedChunks prometheus.Counter
+}
+
+// NewMissingChunksMetrics returns MissingChunksMetrics registered in the given registerer.
+func NewMissingChunksMetrics(reg prometheus.Registerer) *MissingChunksMetrics {
+	m := &MissingChunksMetrics{
+		redownloads: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_missing_chunks_redownloads_total",
+			Help: "Total number of downloads of source blocks repeated because of missing or truncated chunk segments.",
+		}),
+		blocks: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_missing_chunks_blocks_total",
+			Help: "Total number of source blocks with missing or truncated chunk segments after all downloads, by action taken.",
+		}, []string{"action"}),
+		droppedSeries: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_missing_chunks_dropped_series_total",
+			Help: "Total number of series dropped from source blocks because of missing or truncated chunk segments.",
+		}),
+		droppedChunks: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_missing_chunks_dropped_chunks_total",
+			Help: "Total number of chunks in missing or truncated chunk segments of dropped series.",
+		}),
+	}
+	for _, a := range MissingChunksActions {
+		m.blocks.WithLabelValues(a)
+	}
+	return m
+}
+
+// handleMissingChunks checks chunk segments of the source block downloaded into the given directory, downloading it again
+// with the given function while segments are missing or truncated, and handling the remaining ones as configured by
+// WithMissingChunks.
+func (cg *Group) handleMissingChunks(ctx context.Context, id ulid.ULID, bdir string, download func() error) error {
+	if cg.opts.missingChunks == "" {
+		return nil
+	}
+	report, err := block.CheckChunkSegments(bdir)
+	if err != nil {
+		return errors.Wrapf(err, "check chunk segments of block %s", id)
+	}
+	for attempt := 1; !report.OK() && attempt < missingChunksDownloadAttempts; attempt++ {
+		level.Warn(cg.logger).Log("msg", "downloaded block has missing or truncated chunk segments; downloading it again", "block", id, "attempt", attempt, "err", report.Err())
+		cg.opts.missingChunksMetrics.redownloads.Inc()
+		if err := os.RemoveAll(bdir); err != nil {
+			return errors.Wrapf(err, "remove block dir %s", bdir)
+		}
+		if err := download(); err != nil {
+			return err
+		}
+		if report, err = block.CheckChunkSegments(bdir); err != nil {
+			return errors.Wrapf(err, "check chunk segments of block %s", id)
+		}
+	}
+	if report.OK() {
+		return nil
+	}
+
+	action := cg.opts.missingChunks
+	cg.opts.missingChunksMetrics.blocks.WithLabelValues(string(action)).Inc()
+	switch action {
+	case MissingChunksDropSeries:
+		if _, err := block.DropSeriesWithMissingChunks(cg.logger, bdir); err != nil {
+			return errors.Wrapf(err, "drop series with missing chunks from block %s", bdir)
+		}
+		cg.opts.missingChunksMetrics.droppedSeries.Add(float64(report.Series))
+		cg.opts.missingChunksMetrics.droppedChunks.Add(float64(report.Chunks))
+		return nil
+	case MissingChunksQuarantine:
+		reason := fmt.Sprintf("%s: %v", QuarantineMissingChunksHoldReason, report.Err())
+		level.Warn(cg.logger).Log("msg", "quarantining block with missing chunk segments", "block", id, "reason", reason)
+		if err := block.PlaceHold(ctx, cg.logger, cg.bkt, id, reason); err != nil {
+			return retry(errors.Wrapf(err, "quarantine block %s", id))
+		}
+		// The block is filtered out by its hold from the next sync on, so the group is compacted without it.
+		return retry(errors.Wrapf(report.Err(), "block %s quarantined", id))
+	default:
+		return retry(errors.Wrapf(report.Err(), "block %s has unreadable chunks after %d downloads", id, missingChunksDownloadAttempts))
+	}
+}
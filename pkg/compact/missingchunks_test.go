@@ -0,0 +1,83 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestGroup_HandleMissingChunks(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	ext := labels.FromStrings("cluster", "a")
+
+	for _, action := range []MissingChunksAction{MissingChunksRetry, MissingChunksDropSeries, MissingChunksQuarantine} {
+		t.Run(string(action), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "missing-chunks")
+			testutil.Ok(t, err)
+			defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+			id, err := e2eutil.CreateBlock(ctx, dir, []labels.Labels{labels.FromStrings("job", "x")}, 10, 0, 1000, ext, 0)
+			testutil.Ok(t, err)
+			bkt := objstore.NewInMemBucket()
+			testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String())))
+			testutil.Ok(t, bkt.Delete(ctx, path.Join(id.String(), block.ChunksDirname, "000001")))
+
+			m := NewMissingChunksMetrics(prometheus.NewRegistry())
+			g, err := NewGroup(logger, bkt, "0@1", ext, 0, false, false, GroupMetrics{}, WithMissingChunks(action, m))
+			testutil.Ok(t, err)
+
+			pdir := filepath.Join(dir, "compact", id.String())
+			downloads := 0
+			download := func() error {
+				downloads++
+				return block.Download(ctx, logger, bkt, id, pdir)
+			}
+			testutil.Ok(t, download())
+
+			err = g.handleMissingChunks(ctx, id, pdir, download)
+			testutil.Equals(t, missingChunksDownloadAttempts, downloads)
+			testutil.Equals(t, float64(missingChunksDownloadAttempts-1), promtest.ToFloat64(m.redownloads))
+			testutil.Equals(t, 1.0, promtest.ToFloat64(m.blocks.WithLabelValues(string(action))))
+
+			switch action {
+			case MissingChunksDropSeries:
+				testutil.Ok(t, err)
+				testutil.Equals(t, 1.0, promtest.ToFloat64(m.droppedSeries))
+				meta, err := metadata.Read(pdir)
+				testutil.Ok(t, err)
+				testutil.Equals(t, uint64(0), meta.Stats.NumSeries)
+				report, err := block.CheckChunkSegments(pdir)
+				testutil.Ok(t, err)
+				testutil.Assert(t, report.OK(), "unexpected report %+v", report)
+			case MissingChunksQuarantine:
+				testutil.NotOk(t, err)
+				testutil.Assert(t, IsRetryError(err), "expected retry error, got %v", err)
+				hold, err := metadata.ReadHoldMark(ctx, objstore.WithNoopInstr(bkt), logger, id.String())
+				testutil.Ok(t, err)
+				testutil.Assert(t, strings.HasPrefix(hold.Reason, QuarantineMissingChunksHoldReason), "unexpected hold reason %q", hold.Reason)
+			default:
+				testutil.NotOk(t, err)
+				testutil.Assert(t, IsRetryError(err), "expected retry error, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/block"
+)
+
+// IndexNormalizationMetrics counts source blocks normalized by group compactions.
+type IndexNormalizationMetrics struct {
+	blocks prometheus.Counter
+	series prometheus.Counter
+}
+
+// NewIndexNormalizationMetrics returns IndexNormalizationMetrics registered in the given registerer.
+func NewIndexNormalizationMetrics(reg prometheus.Registerer) *IndexNormalizationMetrics {
+	return &IndexNormalizationMetrics{
+		blocks: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_normalized_index_blocks_total",
+			Help: "Total number of source blocks whose index was normalized before compaction because of unsorted symbols, series or labels.",
+		}),
+		series: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_normalized_index_series_total",
+			Help: "Total number of series that were out of order or had out of order labels in normalized source blocks.",
+		}),
+	}
+}
+
+// DuplicateSeriesMetrics counts source blocks with duplicate series merged by group compactions.
+type DuplicateSeriesMetrics struct {
+	blocks prometheus.Counter
+	series prometheus.Counter
+}
+
+// NewDuplicateSeriesMetrics returns DuplicateSeriesMetrics registered in the given registerer.
+func NewDuplicateSeriesMetrics(reg prometheus.Registerer) *DuplicateSeriesMetrics {
+	return &DuplicateSeriesMetrics{
+		blocks: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_duplicate_series_blocks_total",
+			Help: "Total number of source blocks whose series with the same labels were merged before compaction.",
+		}),
+		series: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_duplicate_series_merged_total",
+			Help: "Total number of duplicate series merged into another series of the same labels in source blocks.",
+		}),
+	}
+}
+
+// needsNormalization returns true if the index with given stats violates sort order assumptions of compaction.
+func needsNormalization(stats block.Stats) bool {
+	return stats.UnsortedIndexErr() != nil || stats.PrometheusIssue5372Err() != nil || stats.DuplicateSeriesErr() != nil
+}
+
+// needsDuplicateSeriesMerge returns true if duplicate series of the index with given stats are merged before compaction.
+func (cg *Group) needsDuplicateSeriesMerge(stats block.Stats) bool {
+	return cg.opts.duplicateSeries != nil && stats.DuplicateSeriesErr() != nil
+}
+
+// mergeDuplicateSeries merges duplicate series of the downloaded source block in the given directory, if enabled and
+// the block has any, and returns index stats of the result. It runs before index normalization, which fails on
+// duplicates with overlapping chunks.
+func (cg *Group) mergeDuplicateSeries(id ulid.ULID, bdir string, stats block.Stats, gather func() (block.Stats, error)) (block.Stats, error) {
+	if !cg.needsDuplicateSeriesMerge(stats) {
+		return stats, nil
+	}
+
+	merged, err := block.MergeDuplicateSeries(cg.logger, bdir)
+	if err != nil {
+		return stats, errors.Wrapf(err, "merge duplicate series of block %s", bdir)
+	}
+	cg.opts.duplicateSeries.blocks.Inc()
+	cg.opts.duplicateSeries.series.Add(float64(merged))
+	level.Warn(cg.logger).Log("msg", "merged series with the same labels of block", "block", id,
+		"duplicate_series", stats.DuplicateSeries, "merged_series", merged)
+
+	// Gather stats again to make sure there are no other issues left.
+	return gather()
+}
+
+// normalizeIndex normalizes index of the downloaded source block in the given directory, if index normalization is
+// enabled and the block needs it, and returns index stats of the result.
+func (cg *Group) normalizeIndex(id ulid.ULID, bdir string, stats block.Stats, gather func() (block.Stats, error)) (block.Stats, error) {
+	if cg.opts.indexNormalization == nil || !needsNormalization(stats) {
+		return stats, nil
+	}
+
+	normalized, err := block.NormalizeIndex(cg.logger, bdir)
+	if err != nil {
+		return stats, errors.Wrapf(err, "normalize index of block %s", bdir)
+	}
+	cg.opts.indexNormalization.blocks.Inc()
+	cg.opts.indexNormalization.series.Add(float64(normalized))
+	level.Warn(cg.logger).Log("msg", "normalized index of block with unsorted symbols, series or labels", "block", id,
+		"unsorted_symbols", stats.UnsortedSymbols, "unsorted_series", stats.UnsortedSeries, "out_of_order_labels", stats.OutOfOrderLabels, "normalized_series", normalized)
+
+	// Gather stats again to make sure there are no other issues left.
+	return gather()
+}
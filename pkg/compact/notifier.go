@@ -0,0 +1,71 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// BlockNotifier is notified about blocks added to and deleted from the bucket by compaction, e.g. to invalidate index
+// caches of store gateways or bucket caches right away, instead of waiting for their next sync.
+type BlockNotifier interface {
+	// NotifyAdded is called once the block with the given meta is uploaded.
+	NotifyAdded(ctx context.Context, meta *metadata.Meta) error
+	// NotifyDeleted is called once source blocks with the given IDs are marked for deletion.
+	NotifyDeleted(ctx context.Context, ids []ulid.ULID) error
+}
+
+// NoopBlockNotifier ignores all notifications.
+type NoopBlockNotifier struct{}
+
+// NotifyAdded implements BlockNotifier.
+func (NoopBlockNotifier) NotifyAdded(context.Context, *metadata.Meta) error { return nil }
+
+// NotifyDeleted implements BlockNotifier.
+func (NoopBlockNotifier) NotifyDeleted(context.Context, []ulid.ULID) error { return nil }
+
+// notifyAdded notifies the group's BlockNotifier about the uploaded block. Notifications are best effort: the bucket is
+// already changed, so failures are only logged.
+func (cg *Group) notifyAdded(ctx context.Context, meta *metadata.Meta) {
+	if err := cg.opts.notifier.NotifyAdded(ctx, meta); err != nil {
+		level.Warn(cg.logger).Log("msg", "failed to notify about uploaded block", "block", meta.ULID, "err", err)
+	}
+}
+
+// notifyDeleted notifies the group's BlockNotifier about the source blocks marked for deletion, if any.
+func (cg *Group) notifyDeleted(ctx context.Context, ids []ulid.ULID) {
+	if len(ids) == 0 {
+		return
+	}
+	if err := cg.opts.notifier.NotifyDeleted(ctx, ids); err != nil {
+		level.Warn(cg.logger).Log("msg", "failed to notify about blocks marked for deletion", "blocks", fmt.Sprintf("%v", ids), "err", err)
+	}
+}
+
+// MetaStoreNotifier is a BlockNotifier storing metas of uploaded blocks in the metadata store, so readers of the store see
+// them before its next reconciliation. Blocks marked for deletion stay in the bucket, so they are kept in the store until
+// reconciliation finds them deleted.
+type MetaStoreNotifier struct {
+	store block.MetaStore
+}
+
+// NewMetaStoreNotifier returns MetaStoreNotifier updating the given store.
+func NewMetaStoreNotifier(store block.MetaStore) *MetaStoreNotifier {
+	return &MetaStoreNotifier{store: store}
+}
+
+// NotifyAdded implements BlockNotifier.
+func (n *MetaStoreNotifier) NotifyAdded(ctx context.Context, meta *metadata.Meta) error {
+	return n.store.Put(ctx, meta)
+}
+
+// NotifyDeleted implements BlockNotifier.
+func (n *MetaStoreNotifier) NotifyDeleted(context.Context, []ulid.ULID) error { return nil }
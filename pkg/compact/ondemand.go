@@ -0,0 +1,283 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+)
+
+// onDemandJobsHistory is the number of finished on-demand jobs kept for status queries.
+const onDemandJobsHistory = 100
+
+// OnDemandJobState is a state of an on-demand compaction job.
+type OnDemandJobState string
+
+const (
+	// OnDemandJobQueued is the state of jobs waiting for CompactOnDemand.
+	OnDemandJobQueued OnDemandJobState = "queued"
+	// OnDemandJobRunning is the state of the job being compacted.
+	OnDemandJobRunning OnDemandJobState = "running"
+	// OnDemandJobSucceeded is the state of jobs whose group has nothing left to compact.
+	OnDemandJobSucceeded OnDemandJobState = "succeeded"
+	// OnDemandJobFailed is the state of failed jobs, see OnDemandJob.Error.
+	OnDemandJobFailed OnDemandJobState = "failed"
+)
+
+// OnDemandRequest requests compaction of a single group, identified either by its key or short ID, or by blocks belonging
+// to it.
+type OnDemandRequest struct {
+	Group  string      `json:"group,omitempty"`
+	Blocks []ulid.ULID `json:"blocks,omitempty"`
+}
+
+// OnDemandJob describes an on-demand compaction requested with BucketCompactor.RequestCompaction.
+type OnDemandJob struct {
+	ID      string           `json:"id"`
+	Request OnDemandRequest  `json:"request"`
+	State   OnDemandJobState `json:"state"`
+	// Group is the key of the compacted group, once resolved.
+	Group     string    `json:"group,omitempty"`
+	Requested time.Time `json:"requested"`
+	Started   time.Time `json:"started,omitempty"`
+	Finished  time.Time `json:"finished,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	// ResultBlocks are blocks created by the job.
+	ResultBlocks []ulid.ULID `json:"resultBlocks,omitempty"`
+}
+
+// onDemandTracker queues on-demand compaction jobs and keeps recently finished ones. Go-routine safe.
+type onDemandTracker struct {
+	mtx      sync.Mutex
+	entropy  io.Reader
+	jobs     map[string]*OnDemandJob
+	queue    []string
+	finished []string
+	notify   chan struct{}
+}
+
+func newOnDemandTracker() *onDemandTracker {
+	return &onDemandTracker{
+		entropy: ulid.Monotonic(rand.New(rand.NewSource(time.Now().UnixNano())), 0),
+		jobs:    map[string]*OnDemandJob{},
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+func (t *onDemandTracker) request(req OnDemandRequest) OnDemandJob {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	j := &OnDemandJob{
+		ID:        ulid.MustNew(ulid.Now(), t.entropy).String(),
+		Request:   req,
+		State:     OnDemandJobQueued,
+		Group:     req.Group,
+		Requested: time.Now(),
+	}
+	t.jobs[j.ID] = j
+	t.queue = append(t.queue, j.ID)
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+	return *j
+}
+
+// next marks the oldest queued job as running and returns it.
+func (t *onDemandTracker) next() (OnDemandJob, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if len(t.queue) == 0 {
+		return OnDemandJob{}, false
+	}
+	j := t.jobs[t.queue[0]]
+	t.queue = t.queue[1:]
+	j.State, j.Started = OnDemandJobRunning, time.Now()
+	return *j, true
+}
+
+func (t *onDemandTracker) resolved(id, group string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.jobs[id].Group = group
+}
+
+func (t *onDemandTracker) finish(id string, results []ulid.ULID, err error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	j := t.jobs[id]
+	j.State, j.Finished, j.ResultBlocks = OnDemandJobSucceeded, time.Now(), results
+	if err != nil {
+		j.State, j.Error = OnDemandJobFailed, err.Error()
+	}
+	t.finished = append(t.finished, id)
+	if len(t.finished) > onDemandJobsHistory {
+		delete(t.jobs, t.finished[0])
+		t.finished = t.finished[1:]
+	}
+}
+
+func (t *onDemandTracker) get(id string) (OnDemandJob, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	j, ok := t.jobs[id]
+	if !ok {
+		return OnDemandJob{}, false
+	}
+	return *j, true
+}
+
+// list returns all known jobs, most recently requested first.
+func (t *onDemandTracker) list() []OnDemandJob {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	res := make([]OnDemandJob, 0, len(t.jobs))
+	for _, j := range t.jobs {
+		res = append(res, *j)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID > res[j].ID
+	})
+	return res
+}
+
+// RequestCompaction queues immediate compaction of the requested group. Queued jobs are run by CompactOnDemand, which
+// the caller is expected to invoke once OnDemandRequested fires. It returns the queued job, whose progress can be
+// followed with OnDemandJob or Status.
+func (c *BucketCompactor) RequestCompaction(req OnDemandRequest) (OnDemandJob, error) {
+	if (req.Group == "") == (len(req.Blocks) == 0) {
+		return OnDemandJob{}, errors.New("exactly one of group key and blocks has to be given")
+	}
+	j := c.onDemand.request(req)
+	level.Info(c.logger).Log("msg", "on-demand compaction requested", "job", j.ID, "group", req.Group, "blocks", len(req.Blocks))
+	return j, nil
+}
+
+// OnDemandRequested returns channel receiving a value when on-demand compaction is requested.
+func (c *BucketCompactor) OnDemandRequested() <-chan struct{} {
+	return c.onDemand.notify
+}
+
+// OnDemandJob returns the on-demand compaction job with the given ID, if it is queued, running or recently finished.
+func (c *BucketCompactor) OnDemandJob(id string) (OnDemandJob, bool) {
+	return c.onDemand.get(id)
+}
+
+// CompactOnDemand runs queued on-demand compaction jobs one by one. Each job syncs metas and compacts its group until
+// it has nothing left to compact, the same way workers of Compact do, except that groups over their error budget are
+// compacted as requested. It never runs concurrently with Compact. Failures are recorded in the failed jobs; only halt
+// errors and context cancellation are returned, after failing the job they interrupted.
+func (c *BucketCompactor) CompactOnDemand(ctx context.Context) error {
+	c.runMtx.Lock()
+	defer c.runMtx.Unlock()
+
+	for {
+		j, ok := c.onDemand.next()
+		if !ok {
+			return nil
+		}
+		results, err := c.compactOnDemand(ctx, j)
+		c.onDemand.finish(j.ID, results, err)
+		if err != nil {
+			level.Error(c.logger).Log("msg", "on-demand compaction failed", "job", j.ID, "group", j.Group, "err", err)
+		} else {
+			level.Info(c.logger).Log("msg", "on-demand compaction done", "job", j.ID, "group", j.Group, "result_blocks", len(results))
+		}
+
+		if IsHaltError(err) {
+			return err
+		}
+		if err := c.compactDirs.removeAll(); err != nil {
+			level.Error(c.logger).Log("msg", "failed to remove compaction work directory", "err", err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *BucketCompactor) compactOnDemand(ctx context.Context, j OnDemandJob) (results []ulid.ULID, _ error) {
+	for {
+		if err := c.compactDirs.removeAll(); err != nil {
+			return results, errors.Wrap(err, "clean up the compaction temporary directory")
+		}
+		if err := c.sy.SyncMetas(ctx); err != nil {
+			return results, errors.Wrap(err, "sync")
+		}
+		groups, err := c.grouper.Groups(c.sy.Metas())
+		if err != nil {
+			return results, errors.Wrap(err, "build compaction groups")
+		}
+		c.groups.add(groups...)
+		g, err := findOnDemandGroup(groups, j)
+		if err != nil {
+			return results, err
+		}
+		if len(c.skipPending([]*Group{g})) == 0 {
+			return results, errors.Errorf("group %s may contain blocks whose meta.json failed to load", g.Key())
+		}
+		if j.Group == "" {
+			// Requested blocks are gone once compacted, so following iterations look the group up by key.
+			j.Group = g.Key()
+			c.onDemand.resolved(j.ID, j.Group)
+		}
+
+		claimed, shouldRerun, compID, err := c.compactGroup(ctx, g)
+		if err != nil {
+			return results, err
+		}
+		if !claimed {
+			return results, errors.Errorf("group %s is claimed by another compactor", g.Key())
+		}
+		if compID != (ulid.ULID{}) {
+			results = append(results, compID)
+		}
+		if !shouldRerun {
+			return results, nil
+		}
+	}
+}
+
+// findOnDemandGroup returns the group requested by the job: the group with its key or, until it is resolved, the group
+// holding all of its blocks.
+func findOnDemandGroup(groups []*Group, j OnDemandJob) (*Group, error) {
+	if j.Group != "" {
+		for _, g := range groups {
+			if g.Key() == j.Group || g.ID() == j.Group {
+				return g, nil
+			}
+		}
+		return nil, errors.Errorf("no compaction group %s", j.Group)
+	}
+
+	for _, g := range groups {
+		blocks := 0
+		for _, id := range j.Request.Blocks {
+			if _, ok := g.blocks[id]; ok {
+				blocks++
+			}
+		}
+		if blocks == len(j.Request.Blocks) {
+			return g, nil
+		}
+		if blocks > 0 {
+			return nil, errors.Errorf("requested blocks belong to more than one compaction group, including %s", g.Key())
+		}
+	}
+	return nil, errors.New("requested blocks are not known to be in any compaction group")
+}
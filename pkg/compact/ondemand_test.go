@@ -0,0 +1,95 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestOnDemandTracker(t *testing.T) {
+	tr := newOnDemandTracker()
+
+	j1 := tr.request(OnDemandRequest{Group: "0@1"})
+	j2 := tr.request(OnDemandRequest{Blocks: []ulid.ULID{ulid.MustNew(1, nil)}})
+	testutil.Equals(t, OnDemandJobQueued, j1.State)
+	testutil.Equals(t, "0@1", j1.Group)
+	select {
+	case <-tr.notify:
+	default:
+		t.Fatal("expected notification of requested jobs")
+	}
+
+	j, ok := tr.next()
+	testutil.Assert(t, ok, "expected queued job")
+	testutil.Equals(t, j1.ID, j.ID)
+	testutil.Equals(t, OnDemandJobRunning, j.State)
+	tr.finish(j.ID, []ulid.ULID{ulid.MustNew(2, nil)}, nil)
+
+	j, ok = tr.next()
+	testutil.Assert(t, ok, "expected queued job")
+	testutil.Equals(t, j2.ID, j.ID)
+	tr.resolved(j.ID, "0@2")
+	tr.finish(j.ID, nil, errors.New("failed"))
+	_, ok = tr.next()
+	testutil.Assert(t, !ok, "expected no queued job")
+
+	j, ok = tr.get(j1.ID)
+	testutil.Assert(t, ok, "expected finished job")
+	testutil.Equals(t, OnDemandJobSucceeded, j.State)
+	testutil.Equals(t, []ulid.ULID{ulid.MustNew(2, nil)}, j.ResultBlocks)
+	j, _ = tr.get(j2.ID)
+	testutil.Equals(t, OnDemandJobFailed, j.State)
+	testutil.Equals(t, "0@2", j.Group)
+	testutil.Equals(t, "failed", j.Error)
+
+	// Most recent jobs are listed first and only the recently finished ones are kept.
+	testutil.Equals(t, []string{j2.ID, j1.ID}, []string{tr.list()[0].ID, tr.list()[1].ID})
+	for i := 0; i < onDemandJobsHistory; i++ {
+		tr.request(OnDemandRequest{Group: "0@1"})
+		j, _ := tr.next()
+		tr.finish(j.ID, nil, nil)
+	}
+	testutil.Equals(t, onDemandJobsHistory, len(tr.list()))
+	_, ok = tr.get(j1.ID)
+	testutil.Assert(t, !ok, "expected oldest job to be forgotten")
+}
+
+func TestFindOnDemandGroup(t *testing.T) {
+	var groups []*Group
+	for i, key := range []string{"0@1", "0@2"} {
+		lset := labels.FromStrings("a", key)
+		g, err := NewGroup(nil, nil, key, lset, 0, false, false, GroupMetrics{})
+		testutil.Ok(t, err)
+		for j := 0; j < 2; j++ {
+			id := ulid.MustNew(uint64(2*i+j), nil)
+			testutil.Ok(t, g.Add(&metadata.Meta{
+				BlockMeta: tsdb.BlockMeta{ULID: id},
+				Thanos:    metadata.Thanos{Labels: lset.Map()},
+			}))
+		}
+		groups = append(groups, g)
+	}
+
+	g, err := findOnDemandGroup(groups, OnDemandJob{Group: "0@2"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, "0@2", g.Key())
+	g, err = findOnDemandGroup(groups, OnDemandJob{Request: OnDemandRequest{Blocks: []ulid.ULID{ulid.MustNew(2, nil), ulid.MustNew(3, nil)}}})
+	testutil.Ok(t, err)
+	testutil.Equals(t, "0@2", g.Key())
+
+	_, err = findOnDemandGroup(groups, OnDemandJob{Group: "0@3"})
+	testutil.NotOk(t, err)
+	_, err = findOnDemandGroup(groups, OnDemandJob{Request: OnDemandRequest{Blocks: []ulid.ULID{ulid.MustNew(1, nil), ulid.MustNew(2, nil)}}})
+	testutil.NotOk(t, err)
+	_, err = findOnDemandGroup(groups, OnDemandJob{Request: OnDemandRequest{Blocks: []ulid.ULID{ulid.MustNew(5, nil)}}})
+	testutil.NotOk(t, err)
+}
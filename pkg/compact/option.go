@@ -0,0 +1,605 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/relabel"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/pool"
+)
+
+// DownloadBufferSize is the size of buffers obtained from the pool given to WithDownloadBufferPool.
+const DownloadBufferSize = 1 << 20
+
+// WithSeriesFilters makes group compaction write block.SeriesFilter of each compacted block with the given false positive
+// rate, uploaded next to its index, so readers can skip the block for queries selecting label pairs it does not have.
+func WithSeriesFilters(falsePositiveRate float64) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.seriesFilterFPRate = falsePositiveRate
+	})
+}
+
+type groupOptions struct {
+	skipOutOfOrderSeries   bool
+	indexNormalization     *IndexNormalizationMetrics
+	duplicateSeries        *DuplicateSeriesMetrics
+	seriesRelabelConfig    []*relabel.Config
+	extLabelCollisions     ExternalLabelCollisionAction
+	extLabelMetrics        *ExternalLabelCollisionMetrics
+	missingChunks          MissingChunksAction
+	missingChunksMetrics   *MissingChunksMetrics
+	maxBlocksPerCompaction int
+	compressedMeta         bool
+	fileHashes             bool
+	debugMetaPrefix        string
+	notifier               BlockNotifier
+	downloadOpts           []objstore.DownloadOption
+	deletionGate           *DeletionGate
+	planEstimates          *PlanEstimateMetrics
+	inspectIndexes         bool
+	resourceUsage          *GroupResourceMetrics
+	compactionRatios       *CompactionRatioMetrics
+	outputChecks           *OutputCheckMetrics
+	metaEnrichers          []MetaEnricher
+	outputMinSamplesRatio  float64
+	sampleLossAction       SampleLossAction
+	churnStats             *ChurnStatsTracker
+	sourcesGracePeriod     time.Duration
+	externalMerge          bool
+	appendMinRatio         float64
+	appendMetrics          *AppendCompactionMetrics
+	pipelinedUpload        bool
+	ulidEntropy            io.Reader
+	terminalBlocks         *TerminalBlocks
+	freshRange             time.Duration
+	freshQuiescence        time.Duration
+	freshRangeMetrics      *FreshRangeMetrics
+	seriesFilterFPRate     float64
+}
+
+// GroupOption overrides behavior of Group. Options passed to NewDefaultGrouper are applied to every group it creates.
+type GroupOption interface {
+	apply(*groupOptions)
+}
+
+type groupOptionFunc func(*groupOptions)
+
+func (f groupOptionFunc) apply(o *groupOptions) {
+	f(o)
+}
+
+func applyGroupOptions(opts []GroupOption) groupOptions {
+	o := groupOptions{notifier: NoopBlockNotifier{}}
+	for _, opt := range opts {
+		opt.apply(&o)
+	}
+	return o
+}
+
+// WithSkipOutOfOrderSeries makes group compaction drop series with out-of-order chunks from the source blocks,
+// instead of halting on them. Dropped series are recorded in the group's OutOfOrderSeriesReports, and so in the group's
+// status of BucketCompactor.Status.
+func WithSkipOutOfOrderSeries(skip bool) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.skipOutOfOrderSeries = skip
+	})
+}
+
+// WithIndexNormalization makes group compaction normalize the index of source blocks with unsorted symbols, series or
+// labels, as written by some third-party TSDB writers, instead of failing on them. Normalized blocks are counted in the
+// given metrics.
+func WithIndexNormalization(m *IndexNormalizationMetrics) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.indexNormalization = m
+	})
+}
+
+// WithDuplicateSeriesMerge makes group compaction merge series with the same labels in source blocks, as produced by
+// upstream bugs of some TSDB writers, instead of failing on them. Unlike index normalization, overlapping chunks of the
+// duplicates are merged too. Blocks with merged series are counted in the given metrics.
+func WithDuplicateSeriesMerge(m *DuplicateSeriesMetrics) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.duplicateSeries = m
+	})
+}
+
+// WithFreshRangeGuard makes compaction planning leave out blocks within the given range at the end of the group's time
+// range while blocks keep coming into it, i.e. until no block of the range was created for the given quiescence period,
+// so blocks uploaded late are compacted together with the rest of the range instead of causing compactions again. Blocks
+// left out are counted in the given metrics.
+func WithFreshRangeGuard(freshRange, quiescence time.Duration, m *FreshRangeMetrics) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.freshRange = freshRange
+		o.freshQuiescence = quiescence
+		o.freshRangeMetrics = m
+	})
+}
+
+// WithSeriesRelabelConfig makes group compaction rewrite labels of all series in the source blocks using given
+// relabel configuration before merging them. This allows applying label migrations (e.g. renaming a label) during
+// regular compaction. See ParseSeriesRelabelConfig for supported actions.
+func WithSeriesRelabelConfig(cfg []*relabel.Config) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.seriesRelabelConfig = cfg
+	})
+}
+
+// WithMaxBlocksPerCompaction limits number of source blocks compacted at once. Plans selecting more blocks are split into
+// parts compacted one after another, so only blocks of a single part have to be present on disk. Zero means no limit.
+// Other values below 2 are raised to 2, as parts of single blocks would never be compacted.
+func WithMaxBlocksPerCompaction(max int) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		if max != 0 && max < 2 {
+			max = 2
+		}
+		o.maxBlocksPerCompaction = max
+	})
+}
+
+// WithCompressedMeta makes group compaction upload compacted blocks together with a compressed copy of their meta.json.
+// See block.WithCompressedMeta.
+func WithCompressedMeta(enabled bool) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.compressedMeta = enabled
+	})
+}
+
+// WithFileHashes makes group compaction list files of compacted blocks in their meta.json with hashes of their content,
+// and verify hashes of downloaded source blocks listed with them. Sizes of files are listed and verified regardless.
+// See block.WithFileHashes.
+func WithFileHashes(enabled bool) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.fileHashes = enabled
+	})
+}
+
+// WithDebugMetaPrefix makes group compaction copy meta.json of compacted blocks to debug metas under the given prefix.
+// See block.WithDebugMetaPrefix.
+func WithDebugMetaPrefix(prefix string) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.debugMetaPrefix = prefix
+	})
+}
+
+// WithDownloadBufferPool makes group compaction download source blocks using copy buffers of DownloadBufferSize from the
+// given pool, instead of allocating a buffer for every downloaded file. The pool is meant to be shared by all groups.
+func WithDownloadBufferPool(p pool.BytesPool) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.downloadOpts = []objstore.DownloadOption{objstore.WithCopyBuffers(p, DownloadBufferSize)}
+	})
+}
+
+// WithBlockNotifier makes group compaction notify the given BlockNotifier about uploaded blocks and about source blocks
+// marked for deletion. By default NoopBlockNotifier is used.
+func WithBlockNotifier(n BlockNotifier) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.notifier = n
+	})
+}
+
+// WithDeletionGate makes group compaction ask the given DeletionGate before marking source blocks for deletion. Denied
+// source blocks of a regular compaction stay in the bucket, but are not compacted again, as their data is part of the
+// compacted block. Denied sources of a compaction yielding no samples are compacted again in the next iteration.
+func WithDeletionGate(g *DeletionGate) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.deletionGate = g
+	})
+}
+
+// WithPlanEstimateMetrics makes group compaction expose estimates of its planned compactions in the given metrics.
+func WithPlanEstimateMetrics(m *PlanEstimateMetrics) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.planEstimates = m
+	})
+}
+
+// WithIndexInspection makes group compaction refine estimates of its planned compactions with sizes of index tables of
+// the source blocks, read from their indexes in object storage by block.InspectRemoteIndex without downloading them.
+func WithIndexInspection() GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.inspectIndexes = true
+	})
+}
+
+// WithGroupResourceMetrics makes group compaction attribute resources consumed by its compactions to the group in the
+// given metrics.
+func WithGroupResourceMetrics(m *GroupResourceMetrics) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.resourceUsage = m
+	})
+}
+
+// WithExternalLabelCollisions makes group compaction detect series of source blocks with labels colliding with external
+// labels of the group, counted in the given metrics, and handle them with the given action.
+func WithExternalLabelCollisions(action ExternalLabelCollisionAction, m *ExternalLabelCollisionMetrics) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.extLabelCollisions = action
+		o.extLabelMetrics = m
+	})
+}
+
+// WithMissingChunks makes group compaction check that chunks of downloaded source blocks are in their chunk segment
+// files, downloading blocks with missing or truncated segments again, and handling the ones still missing them with the
+// given action. Outcomes are counted in the given metrics.
+func WithMissingChunks(action MissingChunksAction, m *MissingChunksMetrics) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.missingChunks = action
+		o.missingChunksMetrics = m
+	})
+}
+
+// WithOutputChecks makes group compaction compare compacted blocks with their source blocks before upload, using
+// CheckCompactionOutput with the given minimum ratio of samples, and log and count anomalies found in the given metrics.
+// Compacted blocks losing samples are handled with the given action.
+func WithOutputChecks(m *OutputCheckMetrics, minSamplesRatio float64, action SampleLossAction) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.outputChecks = m
+		o.outputMinSamplesRatio = minSamplesRatio
+		o.sampleLossAction = action
+	})
+}
+
+// WithMetaEnrichers makes group compaction add extensions derived by the given enrichers, applied in order, to metas
+// of compacted blocks. Extensions of source blocks are propagated to compacted blocks with or without enrichers.
+func WithMetaEnrichers(enrichers ...MetaEnricher) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.metaEnrichers = append(o.metaEnrichers, enrichers...)
+	})
+}
+
+// WithCompactionRatioMetrics makes group compaction expose ratios of output to input bytes and samples of its
+// compactions in the given metrics.
+func WithCompactionRatioMetrics(m *CompactionRatioMetrics) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.compactionRatios = m
+	})
+}
+
+// WithChurnStats makes group compaction compute series churn statistics of its compactions from indexes of the source
+// blocks and the compacted block, recorded in the given tracker.
+func WithChurnStats(t *ChurnStatsTracker) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.churnStats = t
+	})
+}
+
+// WithCompactedSourcesGracePeriod makes group compaction leave source blocks unmarked once the compacted block is
+// uploaded, if the given grace period is positive. The sources are hidden as duplicates of the compacted block and left to
+// garbage collection, so the Syncer of the compactor has to be given the same grace period with
+// WithDuplicatesGracePeriod; the grace period is enforced by garbage collection only.
+func WithCompactedSourcesGracePeriod(d time.Duration) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.sourcesGracePeriod = d
+	})
+}
+
+// WithExternalMerge makes group compaction merge source blocks with block.StreamMerge when the estimated disk usage of a
+// plan exceeds free space of the work directory. Only indexes of the sources are downloaded then, while their chunks are
+// streamed between objects of the bucket. Plans of overlapping blocks, series relabelling and source blocks which need
+// to be rewritten before merging are always compacted on disk.
+func WithExternalMerge(enabled bool) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.externalMerge = enabled
+	})
+}
+
+// WithAppendCompaction makes group compaction append small blocks to a large block, whose samples outnumber samples of
+// all other blocks of the plan at least minRatio times, by merging them with block.StreamMerge. Chunks of the large block
+// are copied into the compacted block as they are, server side if the bucket supports it, instead of being downloaded
+// and rewritten by every compaction of a slowly growing group.
+func WithAppendCompaction(minRatio float64, m *AppendCompactionMetrics) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.appendMinRatio = minRatio
+		o.appendMetrics = m
+	})
+}
+
+// WithPipelinedUpload makes group compaction upload chunk segments of the compacted block while TSDB compactor writes
+// it, removing them from the local disk once uploaded. See block.PipelinedUpload.
+func WithPipelinedUpload(enabled bool) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.pipelinedUpload = enabled
+	})
+}
+
+// WithCreatorFingerprint makes group compaction create IDs of compacted blocks embedding the given fingerprint, which
+// identifies their creator, e.g. in logs about ULID collisions. See block.Fingerprint.
+func WithCreatorFingerprint(f block.Fingerprint) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.ulidEntropy = f.Entropy()
+	})
+}
+
+// WithTerminalBlocks makes group compaction mark blocks that can never be compacted for no compaction before planning,
+// and skip blocks marked for no compaction in planning. See TerminalBlocks.
+func WithTerminalBlocks(t *TerminalBlocks) GroupOption {
+	return groupOptionFunc(func(o *groupOptions) {
+		o.terminalBlocks = t
+	})
+}
+
+type syncerOptions struct {
+	groupSizeAccounting bool
+	labelNormalizer     *block.LabelNormalizer
+	timePartition       *block.TimePartitionOwnershipFilter
+	deletionGate        *DeletionGate
+	duplicatesGrace     time.Duration
+	coverage            *CoverageVerifier
+	strictGC            bool
+	gcMaxStaleness      time.Duration
+	inventory           *objstore.InventoryReader
+}
+
+// SyncerOption overrides behavior of Syncer.
+type SyncerOption interface {
+	apply(*syncerOptions)
+}
+
+type syncerOptionFunc func(*syncerOptions)
+
+func (f syncerOptionFunc) apply(o *syncerOptions) {
+	f(o)
+}
+
+func applySyncerOptions(opts []SyncerOption) syncerOptions {
+	o := syncerOptions{}
+	for _, opt := range opts {
+		opt.apply(&o)
+	}
+	return o
+}
+
+// WithGroupSizeAccounting makes Syncer compute total size of objects of each compaction group on every sync and expose
+// it, together with its growth rate, as metrics. Each block's files are listed only once, when the block is first seen.
+func WithGroupSizeAccounting(enabled bool) SyncerOption {
+	return syncerOptionFunc(func(o *syncerOptions) {
+		o.groupSizeAccounting = enabled
+	})
+}
+
+// WithLabelNormalizationMigration makes Syncer rewrite meta.json of every block whose external labels were normalized by
+// the given LabelNormalizer during the sync, so the normalized labels are persisted in the bucket. The normalizer has to
+// be one of the modifiers of the Syncer's fetcher.
+func WithLabelNormalizationMigration(n *block.LabelNormalizer) SyncerOption {
+	return syncerOptionFunc(func(o *syncerOptions) {
+		o.labelNormalizer = n
+	})
+}
+
+// WithGarbageCollectionGate makes Syncer ask the given DeletionGate before marking outdated blocks for deletion during
+// garbage collection, as well as before marking broken blocks for deletion once their repaired copy is uploaded.
+func WithGarbageCollectionGate(g *DeletionGate) SyncerOption {
+	return syncerOptionFunc(func(o *syncerOptions) {
+		o.deletionGate = g
+	})
+}
+
+// WithDuplicatesGracePeriod makes Syncer keep outdated blocks during garbage collection until the block replacing them was
+// uploaded longer than the given grace period ago, as told by the modification time of its meta.json. It gives operators a
+// window to roll back a corrupted compacted block by deleting it, which makes its sources visible again.
+func WithDuplicatesGracePeriod(d time.Duration) SyncerOption {
+	return syncerOptionFunc(func(o *syncerOptions) {
+		o.duplicatesGrace = d
+	})
+}
+
+// WithCoverageVerification makes Syncer verify coverage of synced blocks across resolutions with the given
+// CoverageVerifier after each garbage collection.
+func WithCoverageVerification(v *CoverageVerifier) SyncerOption {
+	return syncerOptionFunc(func(o *syncerOptions) {
+		o.coverage = v
+	})
+}
+
+// WithStrictGarbageCollection separates consistency of reads of garbage collection: outdated blocks are found from the
+// synced view, re-synced first if it is older than maxStaleness (if non-zero), while right before marking each of them
+// for deletion Syncer checks in the bucket that its replacement still exists and is not marked for deletion and that the
+// block itself is not marked yet, so blocks are never marked based on a stale view.
+func WithStrictGarbageCollection(maxStaleness time.Duration) SyncerOption {
+	return syncerOptionFunc(func(o *syncerOptions) {
+		o.strictGC = true
+		o.gcMaxStaleness = maxStaleness
+	})
+}
+
+// WithInventory makes Syncer load the latest inventory report of the bucket with the given InventoryReader on every sync,
+// and use objects listed by it instead of requesting each object from the bucket: sizes of blocks listed with their
+// meta.json for group size accounting and existence of objects for strict garbage collection. Objects not listed are
+// requested from the bucket. The max age of reports must not exceed the delete delay, so blocks listed cannot be deleted
+// before their deletion mark is seen by strict garbage collection.
+func WithInventory(r *objstore.InventoryReader) SyncerOption {
+	return syncerOptionFunc(func(o *syncerOptions) {
+		o.inventory = r
+	})
+}
+
+type bucketCompactorOptions struct {
+	compactDirs []string
+	reg         prometheus.Registerer
+	heat        HeatProvider
+	dryRun      bool
+	backlogSLO  *BacklogSLO
+	memGovernor *MemoryGovernor
+	errBudget   *GroupErrorBudget
+	sizeClasses *SizeClassLimiter
+	profiles    *ProfileCapturer
+	slowGroup   time.Duration
+	profHalts   bool
+	skipGC      bool
+	stealing    *WorkStealer
+	deadline    *CycleDeadline
+	stages      *StagePolicies
+}
+
+// WithTimePartition tells Syncer it works on the given time partition of the bucket, so multiple compactors can work
+// on distinct time partitions of the same bucket. The same filter must be the first filter of the fetcher used by Syncer,
+// so that deduplication, garbage collection, deletion marks and their cleanup are scoped to the partition as well.
+// Partial blocks have no known time range, so they are reported only if the partition contains the current time.
+func WithTimePartition(p *block.TimePartitionOwnershipFilter) SyncerOption {
+	return syncerOptionFunc(func(o *syncerOptions) {
+		o.timePartition = p
+	})
+}
+
+// BucketCompactorOption overrides behavior of BucketCompactor.
+type BucketCompactorOption interface {
+	apply(*bucketCompactorOptions)
+}
+
+type bucketCompactorOptionFunc func(*bucketCompactorOptions)
+
+func (f bucketCompactorOptionFunc) apply(o *bucketCompactorOptions) {
+	f(o)
+}
+
+func applyBucketCompactorOptions(opts []BucketCompactorOption) bucketCompactorOptions {
+	o := bucketCompactorOptions{}
+	for _, opt := range opts {
+		opt.apply(&o)
+	}
+	return o
+}
+
+// WithRegisterer makes BucketCompactor register its metrics in the given registerer: metrics of its work directories and
+// gauges describing the last finished compaction run, as summarized in the log line emitted at the end of each
+// BucketCompactor.Compact call. Metrics of multiple BucketCompactors of a single process have to be registered in
+// registerers telling them apart, e.g. by prometheus.WrapRegistererWith.
+func WithRegisterer(reg prometheus.Registerer) BucketCompactorOption {
+	return bucketCompactorOptionFunc(func(o *bucketCompactorOptions) {
+		o.reg = reg
+	})
+}
+
+// WithCompactDirs makes BucketCompactor use given work directories instead of the single one it was created with, e.g. to
+// spread groups across multiple local volumes. Each group compaction is placed in the directory with the most free space
+// not reserved by running group compactions. The directories are owned by the compactor, which removes them.
+func WithCompactDirs(dirs ...string) BucketCompactorOption {
+	return bucketCompactorOptionFunc(func(o *bucketCompactorOptions) {
+		o.compactDirs = dirs
+	})
+}
+
+// WithHeatProvider makes BucketCompactor compact groups scored as hotter by the given HeatProvider first, on every
+// compaction iteration. Groups prioritized through the jobs API still go first. By default NoopHeatProvider is used.
+func WithHeatProvider(p HeatProvider) BucketCompactorOption {
+	return bucketCompactorOptionFunc(func(o *bucketCompactorOptions) {
+		o.heat = p
+	})
+}
+
+// WithDryRun makes BucketCompactor run the whole compaction cycle without changing the bucket: metas are synced, blocks
+// grouped and compactions planned as usual, but compactions, garbage collection and label migrations of its Syncer are
+// only logged. Each Compact call plans a single compaction per group.
+func WithDryRun(enabled bool) BucketCompactorOption {
+	return bucketCompactorOptionFunc(func(o *bucketCompactorOptions) {
+		o.dryRun = enabled
+	})
+}
+
+// WithSkipGarbageCollection makes BucketCompactor skip garbage collection of its Syncer on each compaction iteration,
+// e.g. because it is scheduled separately. Duplicate blocks are still hidden by the deduplicate filter of the Syncer.
+func WithSkipGarbageCollection(skip bool) BucketCompactorOption {
+	return bucketCompactorOptionFunc(func(o *bucketCompactorOptions) {
+		o.skipGC = skip
+	})
+}
+
+// WithBacklogSLO makes BucketCompactor record its compaction backlog at the beginning of each run, and the number of
+// blocks it compacted, in the given BacklogSLO.
+func WithBacklogSLO(s *BacklogSLO) BucketCompactorOption {
+	return bucketCompactorOptionFunc(func(o *bucketCompactorOptions) {
+		o.backlogSLO = s
+	})
+}
+
+// WithMemoryGovernor makes BucketCompactor start group compactions only once the given MemoryGovernor allows it.
+func WithMemoryGovernor(g *MemoryGovernor) BucketCompactorOption {
+	return bucketCompactorOptionFunc(func(o *bucketCompactorOptions) {
+		o.memGovernor = g
+	})
+}
+
+// WithGroupErrorBudget makes BucketCompactor skip groups that failed too many times in a row for a cool-down period, as
+// tracked by the given GroupErrorBudget. Failures still fail the compaction run they happen in.
+func WithGroupErrorBudget(b *GroupErrorBudget) BucketCompactorOption {
+	return bucketCompactorOptionFunc(func(o *bucketCompactorOptions) {
+		o.errBudget = b
+	})
+}
+
+// WithWorkStealing makes BucketCompactor claim groups through the GroupClaims of the given WorkStealer before compacting
+// them, skipping groups claimed by other compactors, and compact groups of other shards stolen by the WorkStealer once
+// its own groups have nothing left to compact. Work stealing is disabled in dry run mode.
+func WithWorkStealing(s *WorkStealer) BucketCompactorOption {
+	return bucketCompactorOptionFunc(func(o *bucketCompactorOptions) {
+		o.stealing = s
+	})
+}
+
+// WithSizeClassLimiter makes BucketCompactor limit the number of concurrently compacted groups of each size class, as
+// configured in the given SizeClassLimiter. Groups of classes at their limits are passed over by next groups in order.
+func WithSizeClassLimiter(l *SizeClassLimiter) BucketCompactorOption {
+	return bucketCompactorOptionFunc(func(o *bucketCompactorOptions) {
+		o.sizeClasses = l
+	})
+}
+
+// WithProfileCapturer makes BucketCompactor capture profiles with the given ProfileCapturer once a group compaction runs
+// longer than the given threshold, if non-zero, and once a group compaction fails with a halt error, if enabled.
+func WithProfileCapturer(p *ProfileCapturer, slowGroupThreshold time.Duration, onHalt bool) BucketCompactorOption {
+	return bucketCompactorOptionFunc(func(o *bucketCompactorOptions) {
+		o.profiles = p
+		o.slowGroup = slowGroupThreshold
+		o.profHalts = onHalt
+	})
+}
+
+// WithCycleDeadline makes BucketCompactor end each compaction cycle once the soft deadline of the given CycleDeadline
+// passes, cancelling compactions still running at its hard deadline, and carry the groups left over to the next cycle,
+// which compacts them first. Work is not stolen from other shards by cycles exceeding their deadline.
+func WithCycleDeadline(d *CycleDeadline) BucketCompactorOption {
+	return bucketCompactorOptionFunc(func(o *bucketCompactorOptions) {
+		o.deadline = d
+	})
+}
+
+// WithStagePolicies bounds downloads of source blocks and uploads of compacted blocks by the timeouts of the given
+// policies, retrying timed out and failed ones within the same compaction.
+func WithStagePolicies(p StagePolicies) BucketCompactorOption {
+	return bucketCompactorOptionFunc(func(o *bucketCompactorOptions) {
+		o.stages = &p
+	})
+}
+
+type blocksCleanerOptions struct {
+	readers     ReadersRegistry
+	maxDeferral time.Duration
+}
+
+// BlocksCleanerOption overrides behavior of BlocksCleaner.
+type BlocksCleanerOption interface {
+	apply(*blocksCleanerOptions)
+}
+
+type blocksCleanerOptionFunc func(*blocksCleanerOptions)
+
+func (f blocksCleanerOptionFunc) apply(o *blocksCleanerOptions) {
+	f(o)
+}
+
+// WithReadersRegistry makes BlocksCleaner defer deleting blocks pinned by readers of the given registry, until they are
+// unpinned or maxDeferral elapsed since they were due for deletion. If pinned blocks cannot be listed, deletions of all
+// blocks are deferred the same way.
+func WithReadersRegistry(r ReadersRegistry, maxDeferral time.Duration) BlocksCleanerOption {
+	return blocksCleanerOptionFunc(func(o *blocksCleanerOptions) {
+		o.readers = r
+		o.maxDeferral = maxDeferral
+	})
+}
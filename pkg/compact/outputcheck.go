@@ -0,0 +1,244 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// OutputAnomaly is a kind of inconsistency of a compacted block with its source blocks, which compaction itself never
+// causes, e.g. a block losing data because of a bug of the compactor or of a source block rewrite.
+type OutputAnomaly string
+
+const (
+	// OutputAnomalyShortRange is a compacted block not covering the whole time range of its sources.
+	OutputAnomalyShortRange OutputAnomaly = "short-range"
+	// OutputAnomalyTimeRangeDeviation is a compacted block starting before or ending after all of its sources.
+	OutputAnomalyTimeRangeDeviation OutputAnomaly = "time-range-deviation"
+	// OutputAnomalySampleLoss is a compacted block with fewer samples than expected from its sources, see
+	// CheckCompactionOutput.
+	OutputAnomalySampleLoss OutputAnomaly = "sample-loss"
+	// OutputAnomalySampleInflation is a compacted block with more samples than all of its sources together.
+	OutputAnomalySampleInflation OutputAnomaly = "sample-inflation"
+)
+
+// OutputAnomalies are all kinds of OutputAnomaly.
+var OutputAnomalies = []OutputAnomaly{
+	OutputAnomalyShortRange,
+	OutputAnomalyTimeRangeDeviation,
+	OutputAnomalySampleLoss,
+	OutputAnomalySampleInflation,
+}
+
+// SampleLossAction is what group compaction does with a compacted block found with OutputAnomalySampleLoss.
+type SampleLossAction string
+
+const (
+	// SampleLossWarn logs and counts the anomaly, but uploads the block as any other.
+	SampleLossWarn SampleLossAction = "warn"
+	// SampleLossHalt halts compaction without uploading the block, keeping its source blocks.
+	SampleLossHalt SampleLossAction = "halt"
+	// SampleLossQuarantine does not upload the block and places its source blocks under hold with
+	// QuarantineSampleLossHoldReason, so the group is compacted without them until an operator investigates the loss and
+	// removes the holds.
+	SampleLossQuarantine SampleLossAction = "quarantine"
+)
+
+// SampleLossActions are all valid values of SampleLossAction.
+var SampleLossActions = []string{
+	string(SampleLossWarn),
+	string(SampleLossHalt),
+	string(SampleLossQuarantine),
+}
+
+// QuarantineSampleLossHoldReason prefixes reasons of holds placed on source blocks of compactions losing samples.
+const QuarantineSampleLossHoldReason = "quarantined: compaction lost samples"
+
+// OutputFinding is an anomaly found by CheckCompactionOutput.
+type OutputFinding struct {
+	Anomaly OutputAnomaly
+	Details string
+}
+
+// CheckCompactionOutput compares the compacted block with its source blocks, as they were given to the compactor after
+// any rewrite by the compactor. The compacted block has to span exactly the time range of its sources and hold at most
+// the samples of all of them. It has to hold at least the given ratio of the samples expected by ExpectedSamples.
+func CheckCompactionOutput(sources []tsdb.BlockMeta, out tsdb.BlockMeta, vertical bool, minSamplesRatio float64) []OutputFinding {
+	if len(sources) == 0 {
+		return nil
+	}
+	var (
+		res              []OutputFinding
+		minTime, maxTime = sources[0].MinTime, sources[0].MaxTime
+		samples          uint64
+	)
+	for _, s := range sources {
+		if s.MinTime < minTime {
+			minTime = s.MinTime
+		}
+		if s.MaxTime > maxTime {
+			maxTime = s.MaxTime
+		}
+		samples += s.Stats.NumSamples
+	}
+
+	if out.MinTime > minTime || out.MaxTime < maxTime {
+		res = append(res, OutputFinding{Anomaly: OutputAnomalyShortRange, Details: fmt.Sprintf("spans %s of the %s spanned by sources",
+			time.Duration(out.MaxTime-out.MinTime)*time.Millisecond, time.Duration(maxTime-minTime)*time.Millisecond)})
+	}
+	if out.MinTime < minTime || out.MaxTime > maxTime {
+		res = append(res, OutputFinding{Anomaly: OutputAnomalyTimeRangeDeviation, Details: fmt.Sprintf("spans [%d, %d) beyond [%d, %d) spanned by sources",
+			out.MinTime, out.MaxTime, minTime, maxTime)})
+	}
+
+	expected := ExpectedSamples(sources, vertical)
+	if float64(out.Stats.NumSamples) < float64(expected)*minSamplesRatio {
+		res = append(res, OutputFinding{Anomaly: OutputAnomalySampleLoss, Details: fmt.Sprintf("holds %d samples, fewer than %.2f of the %d expected from sources",
+			out.Stats.NumSamples, minSamplesRatio, expected)})
+	}
+	if out.Stats.NumSamples > samples {
+		res = append(res, OutputFinding{Anomaly: OutputAnomalySampleInflation, Details: fmt.Sprintf("holds %d samples, more than the %d of all sources",
+			out.Stats.NumSamples, samples)})
+	}
+	return res
+}
+
+// ExpectedSamples returns the number of samples a block compacted from the given source blocks is expected to hold: the
+// samples of all sources, or for vertical compactions, which deduplicate samples of overlapping sources, as many samples
+// as the source with the most samples within each time range covered by overlapping sources, assuming samples are spread
+// evenly over the time range of each source. Replicas of the same data are thus expected to compact into as many samples
+// as the largest replica, and partially overlapping sources into more.
+func ExpectedSamples(sources []tsdb.BlockMeta, vertical bool) uint64 {
+	if !vertical {
+		var samples uint64
+		for _, s := range sources {
+			samples += s.Stats.NumSamples
+		}
+		return samples
+	}
+
+	bounds := make([]int64, 0, 2*len(sources))
+	for _, s := range sources {
+		bounds = append(bounds, s.MinTime, s.MaxTime)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	var expected float64
+	for i := 1; i < len(bounds); i++ {
+		from, to := bounds[i-1], bounds[i]
+		if from == to {
+			continue
+		}
+		var most float64
+		for _, s := range sources {
+			if s.MinTime > from || s.MaxTime < to || s.MaxTime <= s.MinTime {
+				continue
+			}
+			if n := float64(s.Stats.NumSamples) * float64(to-from) / float64(s.MaxTime-s.MinTime); n > most {
+				most = n
+			}
+		}
+		expected += most
+	}
+	// Sources with an empty time range hold no more than a few samples, which are counted as they are.
+	for _, s := range sources {
+		if s.MaxTime <= s.MinTime {
+			expected += float64(s.Stats.NumSamples)
+		}
+	}
+	return uint64(expected + 0.5)
+}
+
+// OutputCheckMetrics counts compacted blocks checked by CheckCompactionOutput and the anomalies found.
+type OutputCheckMetrics struct {
+	checked     prometheus.Counter
+	anomalies   *prometheus.CounterVec
+	sampleDelta *prometheus.GaugeVec
+}
+
+// NewOutputCheckMetrics returns OutputCheckMetrics registered in the given registerer.
+func NewOutputCheckMetrics(reg prometheus.Registerer) *OutputCheckMetrics {
+	return &OutputCheckMetrics{
+		checked: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_output_checks_total",
+			Help: "Total number of compacted blocks compared with their source blocks before upload.",
+		}),
+		anomalies: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_group_output_anomalies_total",
+			Help: "Total number of anomalies of compacted blocks of the group found before upload, by anomaly.",
+		}, []string{"group_id", "anomaly"}),
+		sampleDelta: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_group_output_samples_delta",
+			Help: "Number of samples of the last compacted block of the group minus the number expected from its source blocks, accounting for deduplication of vertical compactions. Negative if samples were lost.",
+		}, []string{"group_id"}),
+	}
+}
+
+// checkOutput compares the given compacted block with the source blocks of the plan in their directories and logs and counts
+// anomalies found, if enabled by WithOutputChecks. Anomalous blocks are still uploaded, unless samples were lost and
+// the SampleLossAction says otherwise.
+func (cg *Group) checkOutput(ctx context.Context, plan []string, out *metadata.Meta, vertical bool) error {
+	m := cg.opts.outputChecks
+	if m == nil {
+		return nil
+	}
+	sources := make([]tsdb.BlockMeta, 0, len(plan))
+	for _, pdir := range plan {
+		meta, err := metadata.Read(pdir)
+		if err != nil {
+			return errors.Wrapf(err, "read meta of source block %s", filepath.Base(pdir))
+		}
+		sources = append(sources, meta.BlockMeta)
+	}
+
+	m.checked.Inc()
+	for _, a := range OutputAnomalies {
+		m.anomalies.WithLabelValues(cg.id, string(a))
+	}
+	m.sampleDelta.WithLabelValues(cg.id).Set(float64(out.Stats.NumSamples) - float64(ExpectedSamples(sources, vertical)))
+
+	var loss *OutputFinding
+	for _, f := range CheckCompactionOutput(sources, out.BlockMeta, vertical, cg.opts.outputMinSamplesRatio) {
+		m.anomalies.WithLabelValues(cg.id, string(f.Anomaly)).Inc()
+		level.Warn(cg.logger).Log("msg", "compacted block looks anomalous compared with its source blocks", "result_block", out.ULID,
+			"anomaly", f.Anomaly, "details", f.Details, "blocks", fmt.Sprintf("%v", plan), "vertical", vertical)
+		if f.Anomaly == OutputAnomalySampleLoss {
+			f := f
+			loss = &f
+		}
+	}
+	if loss == nil {
+		return nil
+	}
+
+	err := errors.Errorf("compacted block %s of blocks %v %s", out.ULID, plan, loss.Details)
+	switch cg.opts.sampleLossAction {
+	case SampleLossHalt:
+		return halt(err)
+	case SampleLossQuarantine:
+		reason := fmt.Sprintf("%s: %s", QuarantineSampleLossHoldReason, err)
+		for _, s := range sources {
+			level.Warn(cg.logger).Log("msg", "quarantining source block of compaction losing samples", "block", s.ULID, "reason", reason)
+			if err := block.PlaceHold(ctx, cg.logger, cg.bkt, s.ULID, reason); err != nil {
+				return retry(errors.Wrapf(err, "quarantine block %s", s.ULID))
+			}
+		}
+		// Sources are filtered out by their holds from the next sync on, so the group is compacted without them.
+		return retry(errors.Wrap(err, "source blocks quarantined"))
+	}
+	return nil
+}
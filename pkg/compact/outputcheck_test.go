@@ -0,0 +1,102 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestCheckCompactionOutput(t *testing.T) {
+	newMeta := func(minTime, maxTime int64, samples uint64) tsdb.BlockMeta {
+		return tsdb.BlockMeta{MinTime: minTime, MaxTime: maxTime, Stats: tsdb.BlockStats{NumSamples: samples}}
+	}
+	anomalies := func(fs []OutputFinding) []OutputAnomaly {
+		var res []OutputAnomaly
+		for _, f := range fs {
+			res = append(res, f.Anomaly)
+		}
+		return res
+	}
+
+	for _, tcase := range []struct {
+		name     string
+		sources  []tsdb.BlockMeta
+		out      tsdb.BlockMeta
+		vertical bool
+		expected []OutputAnomaly
+	}{
+		{
+			name:    "consistent compaction",
+			sources: []tsdb.BlockMeta{newMeta(0, 100, 1000), newMeta(100, 200, 1000)},
+			out:     newMeta(0, 200, 2000),
+		},
+		{
+			name:    "samples lost within the ratio",
+			sources: []tsdb.BlockMeta{newMeta(0, 100, 1000), newMeta(100, 200, 1000)},
+			out:     newMeta(0, 200, 1950),
+		},
+		{
+			name:     "short range and lost samples",
+			sources:  []tsdb.BlockMeta{newMeta(0, 100, 1000), newMeta(100, 200, 1000)},
+			out:      newMeta(0, 100, 1000),
+			expected: []OutputAnomaly{OutputAnomalyShortRange, OutputAnomalySampleLoss},
+		},
+		{
+			name:     "shifted range",
+			sources:  []tsdb.BlockMeta{newMeta(0, 100, 1000), newMeta(100, 200, 1000)},
+			out:      newMeta(50, 250, 2000),
+			expected: []OutputAnomaly{OutputAnomalyShortRange, OutputAnomalyTimeRangeDeviation},
+		},
+		{
+			name:     "inflated samples",
+			sources:  []tsdb.BlockMeta{newMeta(0, 100, 1000), newMeta(100, 200, 1000)},
+			out:      newMeta(0, 200, 2001),
+			expected: []OutputAnomaly{OutputAnomalySampleInflation},
+		},
+		{
+			name:     "deduplicated replicas",
+			sources:  []tsdb.BlockMeta{newMeta(0, 100, 1000), newMeta(0, 100, 1100)},
+			out:      newMeta(0, 100, 1100),
+			vertical: true,
+		},
+		{
+			name:     "vertical compaction with fewer samples than the largest source",
+			sources:  []tsdb.BlockMeta{newMeta(0, 100, 1000), newMeta(0, 100, 2000)},
+			out:      newMeta(0, 100, 1000),
+			vertical: true,
+			expected: []OutputAnomaly{OutputAnomalySampleLoss},
+		},
+		{
+			name:     "vertical compaction of partially overlapping sources losing the non-overlapping part",
+			sources:  []tsdb.BlockMeta{newMeta(0, 100, 1000), newMeta(50, 150, 1000)},
+			out:      newMeta(0, 150, 1100),
+			vertical: true,
+			expected: []OutputAnomaly{OutputAnomalySampleLoss},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			testutil.Equals(t, tcase.expected, anomalies(CheckCompactionOutput(tcase.sources, tcase.out, tcase.vertical, 0.95)))
+		})
+	}
+}
+
+func TestExpectedSamples(t *testing.T) {
+	newMeta := func(minTime, maxTime int64, samples uint64) tsdb.BlockMeta {
+		return tsdb.BlockMeta{MinTime: minTime, MaxTime: maxTime, Stats: tsdb.BlockStats{NumSamples: samples}}
+	}
+
+	testutil.Equals(t, uint64(3000), ExpectedSamples([]tsdb.BlockMeta{newMeta(0, 100, 1000), newMeta(0, 100, 2000)}, false))
+	// Replicas deduplicate into the largest one.
+	testutil.Equals(t, uint64(2000), ExpectedSamples([]tsdb.BlockMeta{newMeta(0, 100, 1000), newMeta(0, 100, 2000)}, true))
+	// Overlapping halves deduplicate, the rest is kept.
+	testutil.Equals(t, uint64(1500), ExpectedSamples([]tsdb.BlockMeta{newMeta(0, 100, 1000), newMeta(50, 150, 1000)}, true))
+	// Within the overlap, the denser source wins.
+	testutil.Equals(t, uint64(3500), ExpectedSamples([]tsdb.BlockMeta{newMeta(0, 100, 1000), newMeta(50, 150, 3000)}, true))
+	// Disjoint sources are kept whole.
+	testutil.Equals(t, uint64(2000), ExpectedSamples([]tsdb.BlockMeta{newMeta(0, 100, 1000), newMeta(200, 300, 1000)}, true))
+}
@@ -0,0 +1,243 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// PreflightDir is the directory in the root of the bucket holding objects written by Preflight. They are deleted once
+// checked.
+const PreflightDir = "compactor-preflight"
+
+// Names of checks of PreflightReport.
+const (
+	PreflightCheckList         = "list"
+	PreflightCheckIndexRange   = "index-range"
+	PreflightCheckPut          = "put"
+	PreflightCheckWriteLatency = "write-latency"
+	PreflightCheckGet          = "get"
+	PreflightCheckMarker       = "marker"
+	PreflightCheckDelete       = "delete"
+	PreflightCheckLease        = "lease"
+)
+
+// PreflightConfig configures Preflight.
+type PreflightConfig struct {
+	// Holder is the identity of the compactor, as given to RenewLease.
+	Holder string
+	// MaxWriteLatency, if positive, fails the write latency check if uploading an object takes longer.
+	MaxWriteLatency time.Duration
+}
+
+// PreflightCheck is the outcome of a single check of Preflight.
+type PreflightCheck struct {
+	Name     string        `json:"name"`
+	OK       bool          `json:"ok"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// PreflightReport describes whether the bucket is fit for compaction.
+type PreflightReport struct {
+	Time   time.Time        `json:"time"`
+	Checks []PreflightCheck `json:"checks"`
+
+	// WriteLatency is how long uploading a small object took.
+	WriteLatency time.Duration `json:"writeLatency"`
+	// Blocks is the number of block directories in the root of the bucket.
+	Blocks int `json:"blocks"`
+	// InspectedBlock is the block whose index was read using range requests, and InspectedIndex the stats read.
+	InspectedBlock string                  `json:"inspectedBlock,omitempty"`
+	InspectedIndex *block.RemoteIndexStats `json:"inspectedIndex,omitempty"`
+	// OtherEntries are entries in the root of the bucket which are not block directories, e.g. bucket index, debug metas
+	// or objects of other tools, sorted as listed.
+	OtherEntries []string `json:"otherEntries,omitempty"`
+	// LeaseHolder is the holder of the active compactor lease of another compactor, if any.
+	LeaseHolder string `json:"leaseHolder,omitempty"`
+}
+
+// OK returns true if all checks passed.
+func (r PreflightReport) OK() bool {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Err returns an error describing failed checks, or nil if all passed.
+func (r PreflightReport) Err() error {
+	var failed []string
+	for _, c := range r.Checks {
+		if !c.OK {
+			failed = append(failed, fmt.Sprintf("%s: %s", c.Name, c.Error))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return errors.Errorf("preflight checks failed: %s", strings.Join(failed, "; "))
+}
+
+func (r *PreflightReport) check(name string, f func() error) bool {
+	begin := time.Now()
+	err := f()
+	c := PreflightCheck{Name: name, OK: err == nil, Duration: time.Since(begin)}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	r.Checks = append(r.Checks, c)
+	return c.OK
+}
+
+func (r *PreflightReport) skip(reason string, names ...string) {
+	for _, name := range names {
+		r.Checks = append(r.Checks, PreflightCheck{Name: name, Error: "skipped: " + reason})
+	}
+}
+
+// Preflight verifies that the compactor is able to list, get, upload and delete objects of the bucket, to read ranges of
+// block indexes as estimates of planned compactions do, how long uploads
+// take, that deletion marks are uploaded only if they do not exist yet, and that no other compactor holds an active
+// lease of the bucket, before the compactor changes anything in the bucket. Objects are written into PreflightDir only.
+// Failed checks are reported rather than returned, other than the context being done.
+func Preflight(ctx context.Context, logger log.Logger, bkt objstore.InstrumentedBucket, conf PreflightConfig) (PreflightReport, error) {
+	r := PreflightReport{Time: time.Now()}
+
+	var blockIDs []ulid.ULID
+	if !r.check(PreflightCheckList, func() error {
+		return bkt.Iter(ctx, "", func(name string) error {
+			if id, err := ulid.Parse(strings.TrimSuffix(name, objstore.DirDelim)); err == nil {
+				r.Blocks++
+				blockIDs = append(blockIDs, id)
+				return nil
+			}
+			r.OtherEntries = append(r.OtherEntries, name)
+			return nil
+		})
+	}) {
+		r.skip("list failed", PreflightCheckIndexRange)
+	} else {
+		// Blocks being uploaded or deleted have no index yet or anymore, so the first block with an index is inspected.
+		r.check(PreflightCheckIndexRange, func() error {
+			for _, id := range blockIDs {
+				s, err := block.InspectRemoteIndex(ctx, bkt, id)
+				if bkt.IsObjNotFoundErr(errors.Cause(err)) {
+					continue
+				}
+				if err != nil {
+					return errors.Wrapf(err, "inspect index of block %s", id)
+				}
+				r.InspectedBlock, r.InspectedIndex = id.String(), &s
+				return nil
+			}
+			return nil
+		})
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return r, errors.Wrap(err, "generate preflight object name")
+	}
+	var (
+		dir     = path.Join(PreflightDir, hex.EncodeToString(id))
+		name    = path.Join(dir, "probe")
+		marker  = path.Join(dir, "marker.json")
+		content = []byte("thanos compactor preflight")
+	)
+	defer func() {
+		for _, n := range []string{name, marker} {
+			if err := bkt.Delete(ctx, n); err != nil && !bkt.IsObjNotFoundErr(err) {
+				level.Warn(logger).Log("msg", "failed to delete preflight object", "name", n, "err", err)
+			}
+		}
+	}()
+
+	if !r.check(PreflightCheckPut, func() error {
+		begin := time.Now()
+		if err := bkt.Upload(ctx, name, bytes.NewReader(content)); err != nil {
+			return errors.Wrapf(err, "upload %s", name)
+		}
+		r.WriteLatency = time.Since(begin)
+		return nil
+	}) {
+		r.skip("put failed", PreflightCheckWriteLatency, PreflightCheckGet, PreflightCheckMarker, PreflightCheckDelete)
+	} else {
+		r.check(PreflightCheckWriteLatency, func() error {
+			if conf.MaxWriteLatency > 0 && r.WriteLatency > conf.MaxWriteLatency {
+				return errors.Errorf("upload took %s, more than %s", r.WriteLatency, conf.MaxWriteLatency)
+			}
+			return nil
+		})
+		r.check(PreflightCheckGet, func() error {
+			rc, err := bkt.Get(ctx, name)
+			if err != nil {
+				return errors.Wrapf(err, "get %s", name)
+			}
+			got, err := ioutil.ReadAll(rc)
+			_ = rc.Close()
+			if err != nil {
+				return errors.Wrapf(err, "read %s", name)
+			}
+			if !bytes.Equal(got, content) {
+				return errors.Errorf("got %d bytes of %s different from the %d bytes uploaded", len(got), name, len(content))
+			}
+			return nil
+		})
+		r.check(PreflightCheckMarker, func() error {
+			if err := objstore.UploadIfNotExists(ctx, bkt, marker, []byte(`{"version":1}`)); err != nil {
+				return errors.Wrapf(err, "upload %s", marker)
+			}
+			err := objstore.UploadIfNotExists(ctx, bkt, marker, []byte(`{"version":2}`))
+			if errors.Cause(err) != objstore.ErrObjectExists {
+				return errors.Errorf("upload of existing %s returned %v instead of %v, so concurrent marks may overwrite each other", marker, err, objstore.ErrObjectExists)
+			}
+			return objstore.VerifyContent(ctx, bkt, marker, []byte(`{"version":1}`))
+		})
+		r.check(PreflightCheckDelete, func() error {
+			if err := bkt.Delete(ctx, name); err != nil {
+				return errors.Wrapf(err, "delete %s", name)
+			}
+			exists, err := bkt.Exists(ctx, name)
+			if err != nil {
+				return errors.Wrapf(err, "check exists %s", name)
+			}
+			if exists {
+				return errors.Errorf("%s still exists after deletion", name)
+			}
+			return nil
+		})
+	}
+
+	r.check(PreflightCheckLease, func() error {
+		lease, err := activeLease(ctx, logger, bkt, conf.Holder, r.Time)
+		if err != nil {
+			return err
+		}
+		if lease != nil {
+			r.LeaseHolder = lease.Holder
+			return errors.Errorf("compactor %s holds an active lease until %s", lease.Holder, time.Unix(lease.ExpiryTime, 0))
+		}
+		return nil
+	})
+	return r, ctx.Err()
+}
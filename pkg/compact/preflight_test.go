@@ -0,0 +1,95 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestPreflight(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	checks := func(r PreflightReport) map[string]bool {
+		res := map[string]bool{}
+		for _, c := range r.Checks {
+			res[c.Name] = c.OK
+		}
+		return res
+	}
+
+	t.Run("fit bucket", func(t *testing.T) {
+		inmem := objstore.NewInMemBucket()
+		bkt := objstore.WithNoopInstr(inmem)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join("01DTVP434PA9VFXSW2JKB3392D", metadata.MetaFilename), bytes.NewBufferString("{}")))
+		testutil.Ok(t, bkt.Upload(ctx, metadata.BucketIndexFilename, bytes.NewBufferString("{}")))
+		testutil.Ok(t, RenewLease(ctx, logger, bkt, "me", time.Hour))
+
+		r, err := Preflight(ctx, logger, bkt, PreflightConfig{Holder: "me"})
+		testutil.Ok(t, err)
+		testutil.Ok(t, r.Err())
+		testutil.Equals(t, map[string]bool{
+			PreflightCheckList: true, PreflightCheckIndexRange: true, PreflightCheckPut: true, PreflightCheckWriteLatency: true, PreflightCheckGet: true,
+			PreflightCheckMarker: true, PreflightCheckDelete: true, PreflightCheckLease: true,
+		}, checks(r))
+		testutil.Equals(t, 1, r.Blocks)
+		// The only block has no index, e.g. as it is being uploaded, so no index is inspected.
+		testutil.Equals(t, "", r.InspectedBlock)
+		testutil.Equals(t, []string{metadata.BucketIndexFilename, metadata.CompactorLeaseFilename}, r.OtherEntries)
+
+		// Preflight objects are cleaned up.
+		testutil.Equals(t, 3, len(inmem.Objects()))
+	})
+	t.Run("read-only bucket", func(t *testing.T) {
+		bkt := objstore.NewReadOnlyBucket(logger, objstore.WithNoopInstr(objstore.NewInMemBucket()), prometheus.NewRegistry())
+
+		r, err := Preflight(ctx, logger, bkt, PreflightConfig{Holder: "me"})
+		testutil.Ok(t, err)
+		testutil.NotOk(t, r.Err())
+		testutil.Equals(t, map[string]bool{
+			PreflightCheckList: true, PreflightCheckIndexRange: true, PreflightCheckPut: false, PreflightCheckWriteLatency: false, PreflightCheckGet: false,
+			PreflightCheckMarker: false, PreflightCheckDelete: false, PreflightCheckLease: true,
+		}, checks(r))
+	})
+	t.Run("lease of another compactor", func(t *testing.T) {
+		bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+		testutil.Ok(t, RenewLease(ctx, logger, bkt, "other", time.Hour))
+
+		r, err := Preflight(ctx, logger, bkt, PreflightConfig{Holder: "me"})
+		testutil.Ok(t, err)
+		testutil.NotOk(t, r.Err())
+		testutil.Assert(t, !checks(r)[PreflightCheckLease], "lease check passed")
+		testutil.Equals(t, "other", r.LeaseHolder)
+	})
+}
+
+func TestRenewLease(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+
+	testutil.Ok(t, RenewLease(ctx, logger, bkt, "a", time.Hour))
+	testutil.Ok(t, RenewLease(ctx, logger, bkt, "a", time.Hour))
+	err := RenewLease(ctx, logger, bkt, "b", time.Hour)
+	testutil.Equals(t, ErrLeaseHeld, errors.Cause(err))
+
+	// Expired lease is taken over.
+	testutil.Ok(t, RenewLease(ctx, logger, bkt, "a", -time.Second))
+	testutil.Ok(t, RenewLease(ctx, logger, bkt, "b", time.Hour))
+	lease, err := metadata.ReadCompactorLease(ctx, bkt, logger)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "b", lease.Holder)
+}
@@ -0,0 +1,221 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+const (
+	// ProfileReasonSlowGroup is the reason of profiles captured while a group compaction runs longer than expected.
+	ProfileReasonSlowGroup = "slow_group"
+	// ProfileReasonHalt is the reason of profiles captured once a group compaction halts the compactor.
+	ProfileReasonHalt = "halt"
+
+	// ProfileInfoFilename is the name of the file of a profile bundle describing why it was captured.
+	ProfileInfoFilename = "info.json"
+)
+
+// ProfileInfo describes a bundle of profiles captured by ProfileCapturer.
+type ProfileInfo struct {
+	Reason   string        `json:"reason"`
+	Time     time.Time     `json:"time"`
+	GroupKey string        `json:"groupKey"`
+	Plan     *PlanEstimate `json:"plan,omitempty"`
+	// Running is how long the group compaction ran once profiling started.
+	Running time.Duration `json:"running"`
+	Err     string        `json:"err,omitempty"`
+}
+
+// ProfileCapturer captures CPU, heap and goroutine profiles of the process, bundled with the key and plan of the group
+// compaction they were captured for, for post-mortem analysis of slow or halted compactions. Bundles are written into
+// a local directory, or uploaded into a prefix of the bucket if it is given. Only one bundle is captured at a time;
+// captures requested meanwhile are skipped. Go-routine safe.
+type ProfileCapturer struct {
+	logger      log.Logger
+	dir         string
+	bkt         objstore.Bucket
+	prefix      string
+	cpuDuration time.Duration
+
+	mtx       sync.Mutex
+	capturing bool
+
+	captured *prometheus.CounterVec
+	failures prometheus.Counter
+	skipped  prometheus.Counter
+}
+
+// NewProfileCapturer returns ProfileCapturer writing bundles into the given directory, or uploading them under the given
+// prefix of the given bucket, if bucket is not nil. CPU profiles are sampled for the given duration, if non-zero.
+func NewProfileCapturer(logger log.Logger, reg prometheus.Registerer, dir string, bkt objstore.Bucket, prefix string, cpuDuration time.Duration) *ProfileCapturer {
+	return &ProfileCapturer{
+		logger:      logger,
+		dir:         dir,
+		bkt:         bkt,
+		prefix:      prefix,
+		cpuDuration: cpuDuration,
+		captured: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_profiles_captured_total",
+			Help: "Total number of profile bundles captured for group compactions, by the reason of capture.",
+		}, []string{"reason"}),
+		failures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_profile_capture_failures_total",
+			Help: "Total number of failures to capture or store a profile bundle.",
+		}),
+		skipped: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_profile_captures_skipped_total",
+			Help: "Total number of profile bundles not captured because another capture was in progress.",
+		}),
+	}
+}
+
+// Capture captures a bundle of profiles for the given reason and group compaction. CPU profile is captured only for
+// slow groups, as halted compactions are not running anymore. Failures are logged and counted, not returned.
+func (p *ProfileCapturer) Capture(ctx context.Context, info ProfileInfo) {
+	p.mtx.Lock()
+	if p.capturing {
+		p.mtx.Unlock()
+		p.skipped.Inc()
+		return
+	}
+	p.capturing = true
+	p.mtx.Unlock()
+	defer func() {
+		p.mtx.Lock()
+		p.capturing = false
+		p.mtx.Unlock()
+	}()
+
+	name, err := p.capture(ctx, info)
+	if err != nil {
+		p.failures.Inc()
+		level.Warn(p.logger).Log("msg", "failed to capture profiles", "reason", info.Reason, "group_id", GroupID(info.GroupKey), "err", err)
+		return
+	}
+	p.captured.WithLabelValues(info.Reason).Inc()
+	level.Info(p.logger).Log("msg", "captured profiles", "reason", info.Reason, "group_id", GroupID(info.GroupKey), "bundle", name)
+}
+
+func (p *ProfileCapturer) capture(ctx context.Context, info ProfileInfo) (string, error) {
+	files := map[string][]byte{}
+	if info.Reason == ProfileReasonSlowGroup && p.cpuDuration > 0 {
+		var buf bytes.Buffer
+		if err := pprof.StartCPUProfile(&buf); err != nil {
+			// E.g. CPU profile requested through the pprof HTTP endpoint at the same time.
+			level.Warn(p.logger).Log("msg", "skipping CPU profile", "err", err)
+		} else {
+			select {
+			case <-ctx.Done():
+			case <-time.After(p.cpuDuration):
+			}
+			pprof.StopCPUProfile()
+			files["cpu.pprof"] = buf.Bytes()
+		}
+	}
+	for _, prof := range []string{"heap", "goroutine"} {
+		var buf bytes.Buffer
+		if err := pprof.Lookup(prof).WriteTo(&buf, 0); err != nil {
+			return "", errors.Wrapf(err, "write %s profile", prof)
+		}
+		files[prof+".pprof"] = buf.Bytes()
+	}
+	b, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		return "", errors.Wrap(err, "marshal profile info")
+	}
+	files[ProfileInfoFilename] = b
+
+	// Default group keys are made of digits and '@' only, safe in both file and object names. Slashes of others are not.
+	name := info.Time.UTC().Format("20060102T150405Z") + "-" + info.Reason + "-" + strings.ReplaceAll(info.GroupKey, "/", "_")
+	if p.bkt != nil {
+		for f, content := range files {
+			objName := path.Join(p.prefix, name, f)
+			if err := p.bkt.Upload(ctx, objName, bytes.NewReader(content)); err != nil {
+				return "", errors.Wrapf(err, "upload %s", objName)
+			}
+		}
+		return path.Join(p.prefix, name), nil
+	}
+
+	dir := filepath.Join(p.dir, name)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", errors.Wrap(err, "create profile bundle directory")
+	}
+	for f, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), content, 0640); err != nil {
+			return "", errors.Wrapf(err, "write %s", f)
+		}
+	}
+	return dir, nil
+}
+
+// groupProfiler captures profiles of a single group compaction for BucketCompactor, if it has ProfileCapturer.
+type groupProfiler struct {
+	p     *ProfileCapturer
+	ctx   context.Context
+	key   string
+	start time.Time
+	halts bool
+	timer *time.Timer
+
+	mtx  sync.Mutex
+	plan *PlanEstimate
+}
+
+// profileGroup returns groupProfiler of the compaction of the group with the given key, starting now, capturing profiles
+// once the compaction runs longer than the slow group threshold.
+func (c *BucketCompactor) profileGroup(ctx context.Context, key string) *groupProfiler {
+	gp := &groupProfiler{p: c.profiles, ctx: ctx, key: key, start: time.Now(), halts: c.profHalts}
+	if c.profiles != nil && c.slowGroup > 0 {
+		gp.timer = time.AfterFunc(c.slowGroup, func() { gp.capture(ProfileReasonSlowGroup, nil) })
+	}
+	return gp
+}
+
+// planned records the last plan compacted by the group, bundled with its profiles.
+func (gp *groupProfiler) planned(e PlanEstimate) {
+	gp.mtx.Lock()
+	defer gp.mtx.Unlock()
+	gp.plan = &e
+}
+
+// finished stops waiting for the compaction to be slow, and captures profiles if it failed with a halt error, if enabled.
+func (gp *groupProfiler) finished(err error) {
+	if gp.timer != nil {
+		gp.timer.Stop()
+	}
+	if gp.p != nil && gp.halts && err != nil && IsHaltError(err) {
+		gp.capture(ProfileReasonHalt, err)
+	}
+}
+
+func (gp *groupProfiler) capture(reason string, err error) {
+	info := ProfileInfo{Reason: reason, Time: time.Now(), GroupKey: gp.key, Running: time.Since(gp.start)}
+	gp.mtx.Lock()
+	info.Plan = gp.plan
+	gp.mtx.Unlock()
+	if err != nil {
+		info.Err = err.Error()
+	}
+	gp.p.Capture(gp.ctx, info)
+}
@@ -0,0 +1,90 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestProfileCapturer(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("slow group into directory", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "profiles")
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+		p := NewProfileCapturer(log.NewNopLogger(), prometheus.NewRegistry(), dir, nil, "", 10*time.Millisecond)
+		c := &BucketCompactor{profiles: p, slowGroup: 50 * time.Millisecond}
+		gp := c.profileGroup(ctx, "0@123")
+		gp.planned(PlanEstimate{InputBytes: 10})
+		tctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		testutil.Ok(t, runutil.Retry(10*time.Millisecond, tctx.Done(), func() error {
+			if promtest.ToFloat64(p.captured.WithLabelValues(ProfileReasonSlowGroup)) != 1 {
+				return errors.New("profiles not captured yet")
+			}
+			return nil
+		}))
+		gp.finished(nil)
+
+		bundles, err := ioutil.ReadDir(dir)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(bundles))
+		testutil.Assert(t, strings.HasSuffix(bundles[0].Name(), "-slow_group-0@123"), bundles[0].Name())
+
+		files, err := ioutil.ReadDir(filepath.Join(dir, bundles[0].Name()))
+		testutil.Ok(t, err)
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		testutil.Equals(t, []string{"cpu.pprof", "goroutine.pprof", "heap.pprof", ProfileInfoFilename}, names)
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, bundles[0].Name(), ProfileInfoFilename))
+		testutil.Ok(t, err)
+		var info ProfileInfo
+		testutil.Ok(t, json.Unmarshal(b, &info))
+		testutil.Equals(t, "0@123", info.GroupKey)
+		testutil.Equals(t, int64(10), info.Plan.InputBytes)
+	})
+
+	t.Run("halt into bucket", func(t *testing.T) {
+		bkt := objstore.NewInMemBucket()
+		p := NewProfileCapturer(log.NewNopLogger(), prometheus.NewRegistry(), "", bkt, "debug/profiles", time.Hour)
+		c := &BucketCompactor{profiles: p, profHalts: true}
+
+		c.profileGroup(ctx, "0@1").finished(errors.New("not a halt"))
+		c.profileGroup(ctx, "0@1").finished(halt(errors.New("halt")))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(p.captured.WithLabelValues(ProfileReasonHalt)))
+
+		var names []string
+		testutil.Ok(t, bkt.Iter(ctx, "debug/profiles/", func(name string) error {
+			return bkt.Iter(ctx, name, func(name string) error {
+				names = append(names, name[strings.LastIndex(name, "/")+1:])
+				return nil
+			})
+		}))
+		sort.Strings(names)
+		// No CPU profile of halted compactions.
+		testutil.Equals(t, []string{"goroutine.pprof", "heap.pprof", ProfileInfoFilename}, names)
+	})
+}
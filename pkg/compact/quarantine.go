@@ -0,0 +1,134 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	"github.com/thanos-io/thanos/pkg/extprom"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+const (
+	// QuarantineHoldReason prefixes reasons of holds placed by QuarantineFilter.
+	QuarantineHoldReason = "quarantined: inconsistent compaction group membership"
+
+	quarantinedMeta = "quarantined"
+)
+
+// ValidateGroupMember returns error if the meta of the block is inconsistent with membership in the compaction group of
+// its resolution and labels, e.g. because of meta corruption. Parents of the block found in the given metas are checked
+// as well, as compaction never changes resolution.
+func ValidateGroupMember(m *metadata.Meta, metas map[ulid.ULID]*metadata.Meta) error {
+	if m.MinTime >= m.MaxTime {
+		return errors.Errorf("invalid time range [%d, %d)", m.MinTime, m.MaxTime)
+	}
+	if m.Compaction.Level < 1 || len(m.Compaction.Sources) == 0 {
+		return errors.Errorf("invalid compaction level %d with %d sources", m.Compaction.Level, len(m.Compaction.Sources))
+	}
+
+	// Blocks are downsampled only once they span the downsampling range of their resolution.
+	res := m.Thanos.Downsample.Resolution
+	switch res {
+	case downsample.ResLevel0:
+	case downsample.ResLevel1:
+		if m.MaxTime-m.MinTime < downsample.DownsampleRange0 {
+			return errors.Errorf("block of resolution %d spans %v, less than blocks are downsampled from", res, time.Duration(m.MaxTime-m.MinTime)*time.Millisecond)
+		}
+	case downsample.ResLevel2:
+		if m.MaxTime-m.MinTime < downsample.DownsampleRange1 {
+			return errors.Errorf("block of resolution %d spans %v, less than blocks are downsampled from", res, time.Duration(m.MaxTime-m.MinTime)*time.Millisecond)
+		}
+	default:
+		return errors.Errorf("unknown resolution %d", res)
+	}
+
+	for _, p := range m.Compaction.Parents {
+		pm, ok := metas[p.ULID]
+		if !ok {
+			continue
+		}
+		if pm.Thanos.Downsample.Resolution != res {
+			return errors.Errorf("block of resolution %d was compacted from block %s of resolution %d", res, p.ULID, pm.Thanos.Downsample.Resolution)
+		}
+	}
+	return nil
+}
+
+// QuarantineFilter is a MetadataFilter quarantining blocks whose meta fails ValidateGroupMember, instead of feeding them
+// into compaction, where they fail with cryptic errors or produce broken blocks. Quarantined blocks are placed under
+// hold with QuarantineHoldReason, so they are never compacted, removed by retention nor deleted until an operator
+// repairs their meta and removes the hold. It must be placed after IgnoreDeletionMarkFilter and before
+// DeduplicateFilter, so blocks compacted into quarantined ones are not garbage collected. Blocks already under hold are
+// filtered out without being quarantined again.
+// Filter is not go-routine safe.
+type QuarantineFilter struct {
+	logger log.Logger
+	bkt    objstore.Bucket
+	dryRun bool
+
+	quarantined prometheus.Counter
+}
+
+// NewQuarantineFilter returns QuarantineFilter. With dryRun, blocks that would be quarantined are only logged and
+// filtered out.
+func NewQuarantineFilter(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket, dryRun bool) *QuarantineFilter {
+	return &QuarantineFilter{
+		logger: logger,
+		bkt:    bkt,
+		dryRun: dryRun,
+		quarantined: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_quarantined_blocks_total",
+			Help: "Total number of blocks placed under hold because their meta is inconsistent with their compaction group.",
+		}),
+	}
+}
+
+// Filter filters out and quarantines blocks inconsistent with their compaction group.
+func (f *QuarantineFilter) Filter(ctx context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
+	invalid := map[ulid.ULID]error{}
+	for id, m := range metas {
+		if err := ValidateGroupMember(m, metas); err != nil {
+			invalid[id] = err
+		}
+	}
+
+	for id, verr := range invalid {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		held, err := f.bkt.Exists(ctx, path.Join(id.String(), metadata.HoldMarkFilename))
+		if err != nil {
+			return errors.Wrapf(err, "check hold of block %s", id)
+		}
+		reason := fmt.Sprintf("%s: %v", QuarantineHoldReason, verr)
+		if held {
+			level.Debug(f.logger).Log("msg", "block inconsistent with its compaction group is already under hold", "block", id)
+		} else if f.dryRun {
+			level.Warn(f.logger).Log("msg", "dry run: would quarantine block", "block", id, "reason", reason)
+		} else {
+			level.Warn(f.logger).Log("msg", "quarantining block", "block", id, "reason", reason)
+			if err := block.PlaceHold(ctx, f.logger, f.bkt, id, reason); err != nil {
+				return errors.Wrapf(err, "quarantine block %s", id)
+			}
+			f.quarantined.Inc()
+		}
+		synced.WithLabelValues(quarantinedMeta).Inc()
+		delete(metas, id)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestValidateGroupMember(t *testing.T) {
+	newMeta := func(id ulid.ULID, mint, maxt int64, res int64, parents ...ulid.ULID) *metadata.Meta {
+		m := &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: id, MinTime: mint, MaxTime: maxt, Compaction: tsdb.BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{id}}},
+			Thanos:    metadata.Thanos{Labels: map[string]string{"a": "1"}, Downsample: metadata.ThanosDownsample{Resolution: res}},
+		}
+		for _, p := range parents {
+			m.Compaction.Level = 2
+			m.Compaction.Parents = append(m.Compaction.Parents, tsdb.BlockDesc{ULID: p})
+		}
+		return m
+	}
+	metas := map[ulid.ULID]*metadata.Meta{
+		ulid.MustNew(1, nil): newMeta(ulid.MustNew(1, nil), 0, downsample.DownsampleRange0, downsample.ResLevel1),
+	}
+
+	for _, tcase := range []struct {
+		meta *metadata.Meta
+		err  string
+	}{
+		{meta: newMeta(ulid.MustNew(2, nil), 0, 1000, downsample.ResLevel0)},
+		{meta: newMeta(ulid.MustNew(2, nil), 0, downsample.DownsampleRange0, downsample.ResLevel1)},
+		{meta: newMeta(ulid.MustNew(2, nil), 0, downsample.DownsampleRange1, downsample.ResLevel2)},
+		{meta: newMeta(ulid.MustNew(2, nil), 0, 2*downsample.DownsampleRange0, downsample.ResLevel1, ulid.MustNew(1, nil))},
+		{meta: newMeta(ulid.MustNew(2, nil), 1000, 1000, downsample.ResLevel0), err: "invalid time range"},
+		{meta: newMeta(ulid.MustNew(2, nil), 0, 1000, 1234), err: "unknown resolution"},
+		{meta: newMeta(ulid.MustNew(2, nil), 0, 1000, downsample.ResLevel1), err: "less than blocks are downsampled from"},
+		{meta: newMeta(ulid.MustNew(2, nil), 0, downsample.DownsampleRange0, downsample.ResLevel2), err: "less than blocks are downsampled from"},
+		{meta: newMeta(ulid.MustNew(2, nil), 0, 2*downsample.DownsampleRange0, downsample.ResLevel0, ulid.MustNew(1, nil)), err: "was compacted from block"},
+		{meta: func() *metadata.Meta {
+			m := newMeta(ulid.MustNew(2, nil), 0, 1000, downsample.ResLevel0)
+			m.Compaction.Sources = nil
+			return m
+		}(), err: "invalid compaction level"},
+	} {
+		err := ValidateGroupMember(tcase.meta, metas)
+		if tcase.err == "" {
+			testutil.Ok(t, err)
+			continue
+		}
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), tcase.err), "unexpected error %v", err)
+	}
+}
+
+func TestQuarantineFilter(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+	logger := log.NewNopLogger()
+
+	upload := func(id ulid.ULID, res int64) {
+		m := metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{Version: 1, ULID: id, MinTime: 0, MaxTime: 1000, Compaction: tsdb.BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{id}}},
+			Thanos:    metadata.Thanos{Labels: map[string]string{"a": "1"}, Downsample: metadata.ThanosDownsample{Resolution: res}},
+		}
+		b, err := json.Marshal(&m)
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.MetaFilename), bytes.NewReader(b)))
+	}
+	valid, invalid := ulid.MustNew(1, nil), ulid.MustNew(2, nil)
+	upload(valid, downsample.ResLevel0)
+	upload(invalid, downsample.ResLevel1)
+
+	for _, dryRun := range []bool{true, false} {
+		f := NewQuarantineFilter(logger, nil, bkt, dryRun)
+		fetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, []block.MetadataFilter{f, block.NewHoldMarkFilter(logger, bkt)}, nil)
+		testutil.Ok(t, err)
+		metas, _, err := fetcher.Fetch(ctx)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(metas))
+		testutil.Assert(t, metas[valid] != nil, "valid block filtered out")
+
+		_, err = metadata.ReadHoldMark(ctx, bkt, logger, invalid.String())
+		if dryRun {
+			testutil.Equals(t, metadata.ErrorHoldMarkNotFound, err)
+			continue
+		}
+		testutil.Ok(t, err)
+	}
+
+	// Quarantined block stays under hold, so it is not validated again.
+	m, err := metadata.ReadHoldMark(ctx, bkt, logger, invalid.String())
+	testutil.Ok(t, err)
+	testutil.Assert(t, strings.HasPrefix(m.Reason, QuarantineHoldReason), "unexpected reason %q", m.Reason)
+	_, err = metadata.ReadHoldMark(ctx, bkt, logger, valid.String())
+	testutil.Equals(t, metadata.ErrorHoldMarkNotFound, err)
+}
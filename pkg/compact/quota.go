@@ -0,0 +1,94 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// BucketQuota tracks live bytes in the bucket, estimated from metas of blocks not marked for deletion, against a limit.
+// While the bucket is over its quota, the compactor applies retention and deletes marked blocks before compacting, and
+// defers compactions, which temporarily add bytes, until enough data was marked for deletion to get under the quota.
+// Go-routine safe.
+type BucketQuota struct {
+	logger log.Logger
+	limit  int64
+
+	mtx      sync.Mutex
+	exceeded bool
+
+	limitBytes    prometheus.Gauge
+	liveBytes     prometheus.Gauge
+	exceededGauge prometheus.Gauge
+	deferredRuns  prometheus.Counter
+}
+
+// NewBucketQuota returns BucketQuota of the given number of live bytes.
+func NewBucketQuota(logger log.Logger, reg prometheus.Registerer, limit int64) *BucketQuota {
+	q := &BucketQuota{
+		logger: logger,
+		limit:  limit,
+		limitBytes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_bucket_quota_limit_bytes",
+			Help: "Limit of live bytes in the bucket, above which retention and cleanup are prioritized over compaction.",
+		}),
+		liveBytes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_bucket_quota_live_bytes",
+			Help: "Size of blocks in the bucket not marked for deletion, estimated from their metas, as of the last quota check.",
+		}),
+		exceededGauge: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_bucket_quota_exceeded",
+			Help: "1 if live bytes in the bucket exceeded the quota by the last quota check, 0 otherwise.",
+		}),
+		deferredRuns: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_bucket_quota_deferred_compactions_total",
+			Help: "Total number of compaction runs deferred because the bucket stayed over its quota after retention and cleanup.",
+		}),
+	}
+	q.limitBytes.Set(float64(limit))
+	return q
+}
+
+// Check measures live bytes of the given snapshot and returns true if they exceed the quota.
+func (q *BucketQuota) Check(snapshot *MetaSnapshot) bool {
+	var live int64
+	for id, m := range snapshot.Metas {
+		// Blocks marked for deletion recently may still pass the fetcher filters.
+		if _, ok := snapshot.DeletionMarks[id]; ok {
+			continue
+		}
+		live += estimatedBlockBytes(m.Stats.NumSamples, m.Stats.NumSeries, m.Stats.NumChunks)
+	}
+	exceeded := live > q.limit
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if exceeded != q.exceeded {
+		if exceeded {
+			level.Warn(q.logger).Log("msg", "bucket exceeded its quota; prioritizing retention and cleanup over compaction", "live_bytes", live, "limit_bytes", q.limit)
+		} else {
+			level.Info(q.logger).Log("msg", "bucket is under its quota again; resuming compaction", "live_bytes", live, "limit_bytes", q.limit)
+		}
+	}
+	q.exceeded = exceeded
+	q.liveBytes.Set(float64(live))
+	if exceeded {
+		q.exceededGauge.Set(1)
+	} else {
+		q.exceededGauge.Set(0)
+	}
+	return exceeded
+}
+
+// Defer records a compaction run deferred because the bucket stayed over its quota.
+func (q *BucketQuota) Defer() {
+	q.deferredRuns.Inc()
+	level.Warn(q.logger).Log("msg", "bucket is still over its quota after retention and cleanup; deferring compaction", "limit_bytes", q.limit)
+}
@@ -0,0 +1,39 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestBucketQuota(t *testing.T) {
+	size := estimatedBlockBytes(1000, 10, 10)
+	q := NewBucketQuota(log.NewNopLogger(), prometheus.NewRegistry(), 2*size)
+
+	snapshot := emptyMetaSnapshot()
+	for i := uint64(1); i <= 3; i++ {
+		id := ulid.MustNew(i, nil)
+		snapshot.Metas[id] = &metadata.Meta{BlockMeta: tsdb.BlockMeta{ULID: id, Stats: tsdb.BlockStats{NumSamples: 1000, NumSeries: 10, NumChunks: 10}}}
+	}
+	testutil.Assert(t, q.Check(snapshot))
+	testutil.Equals(t, float64(3*size), promtest.ToFloat64(q.liveBytes))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(q.exceededGauge))
+
+	// Blocks marked for deletion are not live, even if they still pass the fetcher filters.
+	marked := snapshot.withDeleted(1, snapshot.SyncTime, ulid.MustNew(1, nil))
+	marked.Metas = snapshot.Metas
+	snapshot = marked
+	testutil.Assert(t, !q.Check(snapshot))
+	testutil.Equals(t, float64(2*size), promtest.ToFloat64(q.liveBytes))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(q.exceededGauge))
+}
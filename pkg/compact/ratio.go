@@ -0,0 +1,70 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// compactionRatioBuckets cover both savings (below 1) and inflation (above 1) of compactions.
+var compactionRatioBuckets = []float64{0.1, 0.25, 0.5, 0.75, 0.9, 1, 1.1, 1.25, 1.5, 2, 4}
+
+// CompactionRatioMetrics exposes ratios of output to input of compactions, so savings of compaction and deduplication
+// can be quantified. Ratios above 1 mean the compaction inflated data.
+type CompactionRatioMetrics struct {
+	bytesRatio       *prometheus.HistogramVec
+	samplesRatio     *prometheus.HistogramVec
+	inflatingByGroup *prometheus.CounterVec
+}
+
+// NewCompactionRatioMetrics returns CompactionRatioMetrics registered in the given registerer.
+func NewCompactionRatioMetrics(reg prometheus.Registerer) *CompactionRatioMetrics {
+	return &CompactionRatioMetrics{
+		bytesRatio: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "thanos_compact_compaction_bytes_ratio",
+			Help:    "Ratio of the size of compacted blocks to the size of their source blocks, by resolution.",
+			Buckets: compactionRatioBuckets,
+		}, []string{"resolution"}),
+		samplesRatio: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "thanos_compact_compaction_samples_ratio",
+			Help:    "Ratio of the number of samples of compacted blocks to the number of samples of their source blocks, by resolution.",
+			Buckets: compactionRatioBuckets,
+		}, []string{"resolution"}),
+		inflatingByGroup: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_group_inflating_compactions_total",
+			Help: "Total number of compactions of the group whose compacted block was larger than its source blocks.",
+		}, []string{"group_id"}),
+	}
+}
+
+// compactionTotals are sizes and numbers of samples of source blocks and the compacted block of a single compaction.
+type compactionTotals struct {
+	bytesIn, bytesOut     int64
+	samplesIn, samplesOut uint64
+}
+
+func (t compactionTotals) inflated() bool {
+	return t.bytesOut > t.bytesIn
+}
+
+// observe records the given compaction of the group with the given key and resolution. It is a no-op if m is nil.
+func (m *CompactionRatioMetrics) observe(group string, resolution int64, t compactionTotals) {
+	if m == nil {
+		return
+	}
+	res := strconv.FormatInt(resolution, 10)
+	if t.bytesIn > 0 {
+		m.bytesRatio.WithLabelValues(res).Observe(float64(t.bytesOut) / float64(t.bytesIn))
+	}
+	if t.samplesIn > 0 {
+		m.samplesRatio.WithLabelValues(res).Observe(float64(t.samplesOut) / float64(t.samplesIn))
+	}
+	m.inflatingByGroup.WithLabelValues(group)
+	if t.inflated() {
+		m.inflatingByGroup.WithLabelValues(group).Inc()
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestCompactionRatioMetrics(t *testing.T) {
+	m := NewCompactionRatioMetrics(prometheus.NewRegistry())
+
+	m.observe("a", 0, compactionTotals{bytesIn: 100, bytesOut: 50, samplesIn: 1000, samplesOut: 500})
+	m.observe("b", 0, compactionTotals{bytesIn: 100, bytesOut: 150, samplesIn: 1000, samplesOut: 1000})
+	m.observe("c", 300000, compactionTotals{})
+	// Nil metrics are a no-op.
+	(*CompactionRatioMetrics)(nil).observe("a", 0, compactionTotals{bytesIn: 1})
+
+	// Compactions of empty blocks have no ratio.
+	testutil.Equals(t, 1, promtest.CollectAndCount(m.bytesRatio))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(m.inflatingByGroup.WithLabelValues("a")))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.inflatingByGroup.WithLabelValues("b")))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(m.inflatingByGroup.WithLabelValues("c")))
+
+	testutil.Equals(t, 1, promtest.CollectAndCount(m.samplesRatio))
+}
@@ -0,0 +1,104 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// ReadersRegistry lists blocks pinned by readers of the bucket, e.g. read by queries of store gateways in flight.
+// BlocksCleaner defers deleting pinned blocks, so they do not disappear in the middle of queries.
+type ReadersRegistry interface {
+	// PinnedBlocks returns all blocks currently pinned by any reader.
+	PinnedBlocks(ctx context.Context) (map[ulid.ULID]struct{}, error)
+}
+
+// HTTPReadersRegistry asks readers serving metadata.ReaderPins under metadata.ReaderPinsPath, like store gateways do,
+// for blocks they pin.
+type HTTPReadersRegistry struct {
+	logger log.Logger
+	urls   []string
+	client *http.Client
+}
+
+// NewHTTPReadersRegistry returns HTTPReadersRegistry asking readers of the given base URLs, e.g. http://store:10902,
+// with the given timeout per reader.
+func NewHTTPReadersRegistry(logger log.Logger, urls []string, timeout time.Duration) *HTTPReadersRegistry {
+	return &HTTPReadersRegistry{logger: logger, urls: urls, client: &http.Client{Timeout: timeout}}
+}
+
+// PinnedBlocks implements ReadersRegistry. It fails if any reader cannot be asked, as its pins are unknown.
+func (r *HTTPReadersRegistry) PinnedBlocks(ctx context.Context) (map[ulid.ULID]struct{}, error) {
+	pinned := map[ulid.ULID]struct{}{}
+	for _, u := range r.urls {
+		pins, err := r.pins(ctx, strings.TrimSuffix(u, "/")+metadata.ReaderPinsPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range pins.Blocks {
+			pinned[id] = struct{}{}
+		}
+	}
+	return pinned, nil
+}
+
+func (r *HTTPReadersRegistry) pins(ctx context.Context, url string) (*metadata.ReaderPins, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create pinned blocks request")
+	}
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "query pinned blocks %s", url)
+	}
+	defer runutil.ExhaustCloseWithLogOnErr(r.logger, resp.Body, "pinned blocks response body")
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.Errorf("query pinned blocks %s: unexpected status %s: %s", url, resp.Status, bytes.TrimSpace(body))
+	}
+	var pins metadata.ReaderPins
+	if err := json.NewDecoder(resp.Body).Decode(&pins); err != nil {
+		return nil, errors.Wrapf(err, "decode pinned blocks of %s", url)
+	}
+	return &pins, nil
+}
+
+type readerPinsMetrics struct {
+	deferred        prometheus.Gauge
+	deferralExpired prometheus.Counter
+	failures        prometheus.Counter
+}
+
+func newReaderPinsMetrics(reg prometheus.Registerer) *readerPinsMetrics {
+	return &readerPinsMetrics{
+		deferred: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_deletion_pinned_blocks",
+			Help: "Number of blocks due for deletion whose deletion was deferred by the last cleanup, as pinned by readers.",
+		}),
+		deferralExpired: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_deletion_pin_deferral_expired_total",
+			Help: "Total number of blocks deleted while pinned by readers, as their deletion was deferred for the maximum deferral.",
+		}),
+		failures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_deletion_pins_failures_total",
+			Help: "Total number of cleanups failing to list blocks pinned by readers, deferring deletions of all blocks.",
+		}),
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+type staticReadersRegistry struct {
+	pinned map[ulid.ULID]struct{}
+	err    error
+}
+
+func (r *staticReadersRegistry) PinnedBlocks(context.Context) (map[ulid.ULID]struct{}, error) {
+	return r.pinned, r.err
+}
+
+func TestHTTPReadersRegistry(t *testing.T) {
+	ctx := context.Background()
+	id1, id2 := ulid.MustNew(1, nil), ulid.MustNew(2, nil)
+	serve := func(ids ...ulid.ULID) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			testutil.Equals(t, metadata.ReaderPinsPath, r.URL.Path)
+			testutil.Ok(t, json.NewEncoder(w).Encode(metadata.ReaderPins{Blocks: ids}))
+		}))
+	}
+	s1, s2 := serve(id1), serve(id1, id2)
+	defer s1.Close()
+	defer s2.Close()
+
+	pinned, err := NewHTTPReadersRegistry(log.NewNopLogger(), []string{s1.URL, s2.URL + "/"}, time.Second).PinnedBlocks(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[ulid.ULID]struct{}{id1: {}, id2: {}}, pinned)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	_, err = NewHTTPReadersRegistry(log.NewNopLogger(), []string{s1.URL, failing.URL}, time.Second).PinnedBlocks(ctx)
+	testutil.NotOk(t, err)
+}
+
+func TestBlocksCleaner_ReadersRegistry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+	logger := log.NewNopLogger()
+
+	// The first block was due for deletion longer ago than the maximum deferral.
+	var ids []ulid.ULID
+	for i, marked := range []time.Duration{-4 * time.Hour, -2 * time.Hour, -2 * time.Hour} {
+		id := ulid.MustNew(uint64(i+1), nil)
+		ids = append(ids, id)
+
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&metadata.Meta{BlockMeta: tsdb.BlockMeta{ULID: id, Version: 1}}))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.MetaFilename), &buf))
+		mark, err := json.Marshal(metadata.DeletionMark{ID: id, DeletionTime: time.Now().Add(marked).Unix(), Version: metadata.DeletionMarkVersion1})
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.DeletionMarkFilename), bytes.NewReader(mark)))
+	}
+	exists := func() (res []bool) {
+		for _, id := range ids {
+			ok, err := bkt.Exists(ctx, path.Join(id.String(), metadata.MetaFilename))
+			testutil.Ok(t, err)
+			res = append(res, ok)
+		}
+		return res
+	}
+
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, bkt, 0)
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, []block.MetadataFilter{ignoreDeletionMarkFilter}, nil)
+	testutil.Ok(t, err)
+	readers := &staticReadersRegistry{err: errors.New("reader unavailable")}
+	counter := prometheus.NewCounter(prometheus.CounterOpts{})
+	cleaner := NewBlocksCleanerWithBudget(logger, prometheus.NewRegistry(), bkt, ignoreDeletionMarkFilter, time.Hour, 1, DeletionBudget{}, counter, counter, WithReadersRegistry(readers, 2*time.Hour))
+
+	// Pins are unknown, so only the block deferred for the maximum deferral is deleted.
+	_, _, err = metaFetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Ok(t, cleaner.DeleteMarkedBlocks(ctx))
+	testutil.Equals(t, []bool{false, true, true}, exists())
+	testutil.Equals(t, 2.0, promtest.ToFloat64(cleaner.pinsMetrics.deferred))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(cleaner.pinsMetrics.deferralExpired))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(cleaner.pinsMetrics.failures))
+
+	// Unpinned blocks are deleted once readers can be asked.
+	readers.pinned, readers.err = map[ulid.ULID]struct{}{ids[2]: {}}, nil
+	_, _, err = metaFetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Ok(t, cleaner.DeleteMarkedBlocks(ctx))
+	testutil.Equals(t, []bool{false, false, true}, exists())
+	testutil.Equals(t, 1.0, promtest.ToFloat64(cleaner.pinsMetrics.deferred))
+}
@@ -0,0 +1,28 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"gopkg.in/yaml.v2"
+)
+
+// ParseSeriesRelabelConfig parses relabel configuration applied to labels of all series during compaction.
+// Only actions modifying labels are supported: replace, labelmap, labeldrop and labelkeep.
+func ParseSeriesRelabelConfig(contentYaml []byte) ([]*relabel.Config, error) {
+	var relabelConfig []*relabel.Config
+	if err := yaml.Unmarshal(contentYaml, &relabelConfig); err != nil {
+		return nil, errors.Wrap(err, "parsing series relabel configuration")
+	}
+	supportedActions := map[relabel.Action]struct{}{relabel.Replace: {}, relabel.LabelMap: {}, relabel.LabelDrop: {}, relabel.LabelKeep: {}}
+
+	for _, cfg := range relabelConfig {
+		if _, ok := supportedActions[cfg.Action]; !ok {
+			return nil, errors.Errorf("unsupported series relabel action: %v", cfg.Action)
+		}
+	}
+
+	return relabelConfig, nil
+}
@@ -18,7 +18,8 @@ import (
 )
 
 // ApplyRetentionPolicyByResolution removes blocks depending on the specified retentionByResolution based on blocks MaxTime.
-// A value of 0 disables the retention for its resolution.
+// A value of 0 disables the retention for its resolution. Blocks whose deletion is denied by the given, optional
+// DeletionGate are kept.
 func ApplyRetentionPolicyByResolution(
 	ctx context.Context,
 	logger log.Logger,
@@ -26,6 +27,7 @@ func ApplyRetentionPolicyByResolution(
 	metas map[ulid.ULID]*metadata.Meta,
 	retentionByResolution map[ResolutionLevel]time.Duration,
 	blocksMarkedForDeletion prometheus.Counter,
+	gate *DeletionGate,
 ) error {
 	level.Info(logger).Log("msg", "start optional retention")
 	for id, m := range metas {
@@ -36,6 +38,13 @@ func ApplyRetentionPolicyByResolution(
 
 		maxTime := time.Unix(m.MaxTime/1000, 0)
 		if time.Now().After(maxTime.Add(retentionDuration)) {
+			ok, err := gate.allow(ctx, m, RetentionDeletionReason)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
 			level.Info(logger).Log("msg", "applying retention: marking block for deletion", "id", id, "maxTime", maxTime.String())
 			if err := block.MarkForDeletion(ctx, logger, bkt, id, blocksMarkedForDeletion); err != nil {
 				return errors.Wrap(err, "delete block")
@@ -0,0 +1,203 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// RetentionRuleType is the type of RetentionRule declared in the configuration parsed by ParseRetentionRules.
+type RetentionRuleType string
+
+// KeepLastBlocksRetentionRule is the type of KeepLastBlocksRule.
+const KeepLastBlocksRetentionRule RetentionRuleType = "KEEP_LAST_BLOCKS"
+
+// RetentionRuleConfig declares a single RetentionRule of the given type with its type specific configuration.
+type RetentionRuleConfig struct {
+	Type   RetentionRuleType `yaml:"type"`
+	Config interface{}       `yaml:"config"`
+}
+
+// RetentionRule selects blocks to delete, in addition to retention by resolution, e.g. for groups where time based
+// retention is awkward.
+type RetentionRule interface {
+	// Expired returns IDs of the given blocks the rule deletes.
+	Expired(metas map[ulid.ULID]*metadata.Meta) []ulid.ULID
+	// Reason is recorded in deletion marks of blocks deleted by the rule and given to DeletionPolicy.
+	Reason() metadata.DeletionReason
+}
+
+// ParseRetentionRules parses the given YAML list of RetentionRuleConfig and returns the declared rules in the same
+// order. Empty configuration yields no rules.
+func ParseRetentionRules(confContentYaml []byte) ([]RetentionRule, error) {
+	var confs []RetentionRuleConfig
+	if err := yaml.UnmarshalStrict(confContentYaml, &confs); err != nil {
+		return nil, errors.Wrap(err, "parsing retention rules config YAML")
+	}
+
+	rules := make([]RetentionRule, 0, len(confs))
+	for i, c := range confs {
+		conf, err := yaml.Marshal(c.Config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "retention rule %d: marshal %s config", i, c.Type)
+		}
+		var r RetentionRule
+		switch RetentionRuleType(strings.ToUpper(string(c.Type))) {
+		case KeepLastBlocksRetentionRule:
+			r, err = newKeepLastBlocksRuleFromConfig(conf)
+		default:
+			return nil, errors.Errorf("retention rule %d: type %q is not supported", i, c.Type)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "retention rule %d: create %s rule", i, c.Type)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// KeepLastBlocksRule is a RetentionRule keeping only the given number of the newest blocks of each compaction group
+// whose external labels match all given matchers, e.g. for ephemeral test tenants. Blocks are ordered by their max
+// time. Sources of compacted blocks waiting for garbage collection are neither counted nor deleted by the rule, as
+// their data is part of the compacted blocks.
+type KeepLastBlocksRule struct {
+	matchers []*labels.Matcher
+	blocks   int
+}
+
+// NewKeepLastBlocksRule returns KeepLastBlocksRule keeping the given number of blocks, at least 1, of matching groups.
+func NewKeepLastBlocksRule(matchers []*labels.Matcher, blocks int) (*KeepLastBlocksRule, error) {
+	if blocks < 1 {
+		return nil, errors.Errorf("number of blocks to keep has to be at least 1, got %d", blocks)
+	}
+	return &KeepLastBlocksRule{matchers: matchers, blocks: blocks}, nil
+}
+
+type keepLastBlocksRuleConfig struct {
+	Matchers string `yaml:"matchers"`
+	Blocks   int    `yaml:"blocks"`
+}
+
+func newKeepLastBlocksRuleFromConfig(conf []byte) (RetentionRule, error) {
+	var c keepLastBlocksRuleConfig
+	if err := yaml.UnmarshalStrict(conf, &c); err != nil {
+		return nil, err
+	}
+	matchers, err := parser.ParseMetricSelector(c.Matchers)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse matchers")
+	}
+	return NewKeepLastBlocksRule(matchers, c.Blocks)
+}
+
+// Expired implements RetentionRule.
+func (r *KeepLastBlocksRule) Expired(metas map[ulid.ULID]*metadata.Meta) []ulid.ULID {
+	groups := map[string][]*metadata.Meta{}
+	for _, m := range metas {
+		if !matchesAll(r.matchers, labels.FromMap(m.Thanos.Labels)) {
+			continue
+		}
+		key := DefaultGroupKey(m.Thanos)
+		groups[key] = append(groups[key], m)
+	}
+
+	var expired []ulid.ULID
+	for _, ms := range groups {
+		ms = withoutCompactedSources(ms)
+		sort.Slice(ms, func(i, j int) bool {
+			if ms[i].MaxTime != ms[j].MaxTime {
+				return ms[i].MaxTime > ms[j].MaxTime
+			}
+			return ms[i].ULID.Compare(ms[j].ULID) > 0
+		})
+		for i := r.blocks; i < len(ms); i++ {
+			expired = append(expired, ms[i].ULID)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].Compare(expired[j]) < 0 })
+	return expired
+}
+
+// withoutCompactedSources returns the given metas of a single group without blocks whose sources are all sources of
+// another, bigger block of the group.
+func withoutCompactedSources(ms []*metadata.Meta) []*metadata.Meta {
+	sourceOf := map[ulid.ULID]int{}
+	for _, m := range ms {
+		for _, s := range m.Compaction.Sources {
+			if n := len(m.Compaction.Sources); n > sourceOf[s] {
+				sourceOf[s] = n
+			}
+		}
+	}
+	res := make([]*metadata.Meta, 0, len(ms))
+	for _, m := range ms {
+		compacted := len(m.Compaction.Sources) > 0
+		for _, s := range m.Compaction.Sources {
+			if sourceOf[s] <= len(m.Compaction.Sources) {
+				compacted = false
+				break
+			}
+		}
+		if !compacted {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// Reason implements RetentionRule.
+func (r *KeepLastBlocksRule) Reason() metadata.DeletionReason {
+	return metadata.KeepLastBlocksDeletionReason
+}
+
+// ApplyRetentionRules marks blocks expired by any of the given rules for deletion, recording the reason of the rule in
+// their deletion marks. Blocks whose deletion is denied by the given, optional DeletionGate are kept.
+func ApplyRetentionRules(
+	ctx context.Context,
+	logger log.Logger,
+	bkt objstore.Bucket,
+	metas map[ulid.ULID]*metadata.Meta,
+	rules []RetentionRule,
+	blocksMarkedForDeletion prometheus.Counter,
+	gate *DeletionGate,
+) error {
+	level.Info(logger).Log("msg", "start retention rules", "rules", len(rules))
+	marked := map[ulid.ULID]struct{}{}
+	for _, r := range rules {
+		for _, id := range r.Expired(metas) {
+			if _, ok := marked[id]; ok {
+				continue
+			}
+			ok, err := gate.allow(ctx, metas[id], r.Reason())
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			level.Info(logger).Log("msg", "applying retention rule: marking block for deletion", "id", id, "reason", r.Reason())
+			if err := block.MarkForDeletionWithReason(ctx, logger, bkt, id, r.Reason(), blocksMarkedForDeletion); err != nil {
+				return errors.Wrap(err, "delete block")
+			}
+			marked[id] = struct{}{}
+		}
+	}
+	level.Info(logger).Log("msg", "retention rules apply done", "marked", len(marked))
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestParseRetentionRules(t *testing.T) {
+	rules, err := compact.ParseRetentionRules([]byte(""))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(rules))
+
+	rules, err = compact.ParseRetentionRules([]byte(`
+- type: keep_last_blocks
+  config:
+    matchers: '{tenant=~"test-.*"}'
+    blocks: 2
+`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(rules))
+	testutil.Equals(t, metadata.KeepLastBlocksDeletionReason, rules[0].Reason())
+
+	for _, conf := range []string{
+		"- type: UNKNOWN",
+		"- type: KEEP_LAST_BLOCKS\n  config:\n    matchers: '{tenant=~\"test-.*\"}'",
+		"- type: KEEP_LAST_BLOCKS\n  config:\n    matchers: '{tenant'\n    blocks: 1",
+		"- type: KEEP_LAST_BLOCKS\n  config:\n    unknown: 1",
+	} {
+		_, err := compact.ParseRetentionRules([]byte(conf))
+		testutil.NotOk(t, err)
+	}
+}
+
+func TestApplyRetentionRules_KeepLastBlocks(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	metas := map[ulid.ULID]*metadata.Meta{}
+	add := func(id uint64, tenant string, minTime, maxTime int64, resolution int64, sources ...ulid.ULID) ulid.ULID {
+		u := ulid.MustNew(id, nil)
+		level := 2
+		if len(sources) == 0 {
+			level, sources = 1, []ulid.ULID{u}
+		}
+		metas[u] = &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: u, MinTime: minTime, MaxTime: maxTime, Version: 1, Compaction: tsdb.BlockMetaCompaction{Level: level, Sources: sources}},
+			Thanos:    metadata.Thanos{Labels: map[string]string{"tenant": tenant}, Downsample: metadata.ThanosDownsample{Resolution: resolution}},
+		}
+		return u
+	}
+	var (
+		test1 = add(1, "test-1", 0, 10, 0)
+		_     = add(2, "test-1", 10, 20, 0)
+		test3 = add(3, "test-1", 20, 30, 0)
+		test4 = add(4, "test-1", 30, 40, 0)
+		// Compacted from the two blocks above, which wait for garbage collection and are neither counted nor deleted.
+		_ = add(5, "test-1", 20, 40, 0, test3, test4)
+		// Downsampled blocks are a group of their own.
+		_ = add(6, "test-1", 0, 10, 300000, test1)
+		// Other groups matching the rule are evaluated on their own.
+		test7 = add(7, "test-2", 0, 10, 0)
+		_     = add(8, "test-2", 10, 20, 0)
+		_     = add(9, "test-2", 20, 30, 0)
+		// Groups not matching the rule are kept.
+		_ = add(10, "prod", 0, 10, 0)
+		_ = add(11, "prod", 10, 20, 0)
+		_ = add(12, "prod", 20, 30, 0)
+	)
+
+	rules, err := compact.ParseRetentionRules([]byte(`
+- type: KEEP_LAST_BLOCKS
+  config:
+    matchers: '{tenant=~"test-.*"}'
+    blocks: 2
+`))
+	testutil.Ok(t, err)
+
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+	marked := prometheus.NewCounter(prometheus.CounterOpts{})
+	testutil.Ok(t, compact.ApplyRetentionRules(ctx, logger, bkt, metas, rules, marked, nil))
+
+	expected := map[ulid.ULID]struct{}{test1: {}, test7: {}}
+	testutil.Equals(t, float64(len(expected)), promtest.ToFloat64(marked))
+	for id := range metas {
+		m, err := metadata.ReadDeletionMark(ctx, bkt, logger, id.String())
+		if _, ok := expected[id]; !ok {
+			testutil.Equals(t, metadata.ErrorDeletionMarkNotFound, err)
+			continue
+		}
+		testutil.Ok(t, err)
+		testutil.Equals(t, metadata.KeepLastBlocksDeletionReason, m.Reason)
+	}
+}
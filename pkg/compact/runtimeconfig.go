@@ -0,0 +1,239 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"gopkg.in/yaml.v2"
+)
+
+// RuntimeConfig is configuration of the compactor that can be changed while it runs, without restarting it and thus
+// syncing all metas again, see RuntimeConfigWatcher. Changes apply from the next compaction, retention or cleanup on.
+type RuntimeConfig struct {
+	RetentionRaw     model.Duration `yaml:"retention_raw"`
+	RetentionFiveMin model.Duration `yaml:"retention_5m"`
+	RetentionOneHour model.Duration `yaml:"retention_1h"`
+
+	CompactionConcurrency int `yaml:"compaction_concurrency"`
+	DeleteConcurrency     int `yaml:"delete_concurrency"`
+
+	DeleteDelay model.Duration `yaml:"delete_delay"`
+
+	// SelectorRelabelConfig selects blocks the compactor is responsible for, like --selector.relabel-config.
+	SelectorRelabelConfig []*relabel.Config `yaml:"selector_relabel_config"`
+}
+
+// RetentionByResolution returns retention of each resolution; zero means blocks are kept forever.
+func (c RuntimeConfig) RetentionByResolution() map[ResolutionLevel]time.Duration {
+	return map[ResolutionLevel]time.Duration{
+		ResolutionLevelRaw: time.Duration(c.RetentionRaw),
+		ResolutionLevel5m:  time.Duration(c.RetentionFiveMin),
+		ResolutionLevel1h:  time.Duration(c.RetentionOneHour),
+	}
+}
+
+// Validate returns error if the configuration is invalid.
+func (c RuntimeConfig) Validate() error {
+	if c.RetentionRaw < 0 || c.RetentionFiveMin < 0 || c.RetentionOneHour < 0 {
+		return errors.New("retention must not be negative")
+	}
+	if c.CompactionConcurrency < 1 {
+		return errors.Errorf("invalid compaction concurrency %d, must be > 0", c.CompactionConcurrency)
+	}
+	if c.DeleteConcurrency < 1 {
+		return errors.Errorf("invalid delete concurrency %d, must be > 0", c.DeleteConcurrency)
+	}
+	if c.DeleteDelay < 0 {
+		return errors.New("delete delay must not be negative")
+	}
+	supportedActions := map[relabel.Action]struct{}{relabel.Keep: {}, relabel.Drop: {}, relabel.HashMod: {}}
+	for _, cfg := range c.SelectorRelabelConfig {
+		if _, ok := supportedActions[cfg.Action]; !ok {
+			return errors.Errorf("unsupported selector relabel action: %v", cfg.Action)
+		}
+	}
+	return nil
+}
+
+// ParseRuntimeConfig parses the given YAML RuntimeConfig. Fields not set by it keep values of the given defaults, e.g.
+// configured by flags.
+func ParseRuntimeConfig(confContentYaml []byte, defaults RuntimeConfig) (RuntimeConfig, error) {
+	c := defaults
+	if err := yaml.UnmarshalStrict(confContentYaml, &c); err != nil {
+		return RuntimeConfig{}, errors.Wrap(err, "parsing runtime config YAML")
+	}
+	if err := c.Validate(); err != nil {
+		return RuntimeConfig{}, errors.Wrap(err, "invalid runtime config")
+	}
+	return c, nil
+}
+
+// RuntimeConfigWatcher holds the current RuntimeConfig, loaded from an optional file on top of defaults, and applies
+// new configurations to functions registered with Watch. Go-routine safe.
+type RuntimeConfigWatcher struct {
+	logger   log.Logger
+	file     string
+	defaults RuntimeConfig
+
+	mtx      sync.Mutex
+	current  RuntimeConfig
+	content  []byte
+	watchers []func(RuntimeConfig)
+	checks   []func(RuntimeConfig) error
+
+	lastReloadSuccessful   prometheus.Gauge
+	lastReloadSuccessTime  prometheus.Gauge
+	reloads, reloadFailure prometheus.Counter
+}
+
+// NewRuntimeConfigWatcher returns RuntimeConfigWatcher with the configuration of the given file, if any, on top of the
+// given defaults.
+func NewRuntimeConfigWatcher(logger log.Logger, reg prometheus.Registerer, file string, defaults RuntimeConfig) (*RuntimeConfigWatcher, error) {
+	if err := defaults.Validate(); err != nil {
+		return nil, err
+	}
+	w := &RuntimeConfigWatcher{
+		logger:   logger,
+		file:     file,
+		defaults: defaults,
+		current:  defaults,
+		lastReloadSuccessful: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_config_last_reload_successful",
+			Help: "Whether the last runtime configuration reload attempt was successful.",
+		}),
+		lastReloadSuccessTime: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful runtime configuration reload.",
+		}),
+		reloads: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_config_reloads_total",
+			Help: "Total number of runtime configuration reloads.",
+		}),
+		reloadFailure: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_config_reload_failures_total",
+			Help: "Total number of failed runtime configuration reloads.",
+		}),
+	}
+	if err := w.Reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Config returns the current configuration.
+func (w *RuntimeConfigWatcher) Config() RuntimeConfig {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.current
+}
+
+// Watch registers the given function, called with every configuration applied from now on.
+func (w *RuntimeConfigWatcher) Watch(f func(RuntimeConfig)) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.watchers = append(w.watchers, f)
+}
+
+// Check registers the given function, which rejects configurations applied from now on by returning an error, e.g. as
+// they are not supported by the way the compactor was started.
+func (w *RuntimeConfigWatcher) Check(f func(RuntimeConfig) error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.checks = append(w.checks, f)
+}
+
+// Apply validates the given configuration, makes it current and calls functions registered with Watch with it.
+func (w *RuntimeConfigWatcher) Apply(c RuntimeConfig) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	for _, f := range w.checks {
+		if err := f(c); err != nil {
+			return errors.Wrap(err, "rejected runtime config")
+		}
+	}
+	w.current = c
+	for _, f := range w.watchers {
+		f(c)
+	}
+	return nil
+}
+
+// Reload reads the configuration file again and applies it, if its content changed. Without file, it does nothing.
+func (w *RuntimeConfigWatcher) Reload() (err error) {
+	if w.file == "" {
+		return nil
+	}
+	w.reloads.Inc()
+	defer func() {
+		if err != nil {
+			w.reloadFailure.Inc()
+			w.lastReloadSuccessful.Set(0)
+			return
+		}
+		w.lastReloadSuccessful.Set(1)
+		w.lastReloadSuccessTime.SetToCurrentTime()
+	}()
+
+	content, err := ioutil.ReadFile(w.file)
+	if err != nil {
+		return errors.Wrapf(err, "read runtime config file %s", w.file)
+	}
+	w.mtx.Lock()
+	unchanged := w.content != nil && bytes.Equal(content, w.content)
+	w.mtx.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	c, err := ParseRuntimeConfig(content, w.defaults)
+	if err != nil {
+		return errors.Wrapf(err, "runtime config file %s", w.file)
+	}
+	if err := w.Apply(c); err != nil {
+		return err
+	}
+	w.mtx.Lock()
+	w.content = content
+	w.mtx.Unlock()
+	level.Info(w.logger).Log("msg", "applied runtime config", "file", w.file)
+	return nil
+}
+
+// Run reloads the configuration on every value received from the given channel, e.g. on SIGHUP, and every given
+// interval, if non-zero, until the context is done. Failed reloads keep the current configuration.
+func (w *RuntimeConfigWatcher) Run(ctx context.Context, reload <-chan struct{}, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+		case <-tick:
+		}
+		if err := w.Reload(); err != nil {
+			level.Error(w.logger).Log("msg", "reload of runtime config failed; keeping current config", "err", err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestParseRuntimeConfig(t *testing.T) {
+	defaults := RuntimeConfig{
+		RetentionRaw:          model.Duration(24 * time.Hour),
+		CompactionConcurrency: 1,
+		DeleteConcurrency:     1,
+		DeleteDelay:           model.Duration(48 * time.Hour),
+	}
+
+	c, err := ParseRuntimeConfig([]byte("retention_5m: 30d\ncompaction_concurrency: 4\n"), defaults)
+	testutil.Ok(t, err)
+	testutil.Equals(t, RuntimeConfig{
+		RetentionRaw:          model.Duration(24 * time.Hour),
+		RetentionFiveMin:      model.Duration(30 * 24 * time.Hour),
+		CompactionConcurrency: 4,
+		DeleteConcurrency:     1,
+		DeleteDelay:           model.Duration(48 * time.Hour),
+	}, c)
+	testutil.Equals(t, 30*24*time.Hour, c.RetentionByResolution()[ResolutionLevel5m])
+
+	c, err = ParseRuntimeConfig([]byte("selector_relabel_config:\n- action: drop\n  source_labels: [a]\n  regex: '1'\n"), defaults)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(c.SelectorRelabelConfig))
+
+	for _, content := range []string{
+		"delete_concurrency: 0",
+		"retention_raw: -1d",
+		"unknown: 1",
+		"selector_relabel_config:\n- action: labeldrop\n  regex: a\n",
+	} {
+		_, err := ParseRuntimeConfig([]byte(content), defaults)
+		testutil.NotOk(t, err, content)
+	}
+}
+
+func TestRuntimeConfigWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runtime-config")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	file := filepath.Join(dir, "runtime.yaml")
+	testutil.Ok(t, ioutil.WriteFile(file, []byte("delete_delay: 1h\n"), 0600))
+
+	defaults := RuntimeConfig{CompactionConcurrency: 1, DeleteConcurrency: 1, DeleteDelay: model.Duration(48 * time.Hour)}
+	reg := prometheus.NewRegistry()
+	w, err := NewRuntimeConfigWatcher(log.NewNopLogger(), reg, file, defaults)
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.Duration(time.Hour), w.Config().DeleteDelay)
+
+	var applied []RuntimeConfig
+	w.Watch(func(c RuntimeConfig) { applied = append(applied, c) })
+
+	// Unchanged content is not applied again.
+	testutil.Ok(t, w.Reload())
+	testutil.Equals(t, 0, len(applied))
+
+	// Fields removed from the file fall back to defaults.
+	testutil.Ok(t, ioutil.WriteFile(file, []byte("delete_concurrency: 3\n"), 0600))
+	testutil.Ok(t, w.Reload())
+	testutil.Equals(t, 1, len(applied))
+	testutil.Equals(t, RuntimeConfig{CompactionConcurrency: 1, DeleteConcurrency: 3, DeleteDelay: model.Duration(48 * time.Hour)}, applied[0])
+	testutil.Equals(t, applied[0], w.Config())
+
+	// Invalid configurations keep the current one.
+	testutil.Ok(t, ioutil.WriteFile(file, []byte("compaction_concurrency: 0\n"), 0600))
+	testutil.NotOk(t, w.Reload())
+	testutil.Equals(t, 1, len(applied))
+	testutil.Equals(t, applied[0], w.Config())
+	testutil.Equals(t, 0.0, promtest.ToFloat64(w.lastReloadSuccessful))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(w.reloadFailure))
+
+	// So do configurations rejected by checks.
+	w.Check(func(c RuntimeConfig) error {
+		if c.CompactionConcurrency > 2 {
+			return errors.New("too many")
+		}
+		return nil
+	})
+	testutil.Ok(t, ioutil.WriteFile(file, []byte("compaction_concurrency: 3\n"), 0600))
+	testutil.NotOk(t, w.Reload())
+	testutil.Equals(t, applied[0], w.Config())
+
+	// Run reloads on signals.
+	testutil.Ok(t, ioutil.WriteFile(file, []byte("compaction_concurrency: 2\n"), 0600))
+	ctx, cancel := context.WithCancel(context.Background())
+	reload := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx, reload, 0)
+		close(done)
+	}()
+	reload <- struct{}{}
+	cancel()
+	<-done
+	testutil.Equals(t, 2, w.Config().CompactionConcurrency)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(w.lastReloadSuccessful))
+}
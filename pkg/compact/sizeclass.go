@@ -0,0 +1,170 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/units"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SizeClass is a class of compaction groups by their size, limited in how many of its groups are compacted concurrently.
+type SizeClass struct {
+	Name string
+	// MinBytes is the size of blocks in a group, estimated from their metas, from which the group is in the class.
+	MinBytes int64
+	// MaxConcurrency is the maximum number of groups of the class compacted at the same time.
+	MaxConcurrency int
+}
+
+// ParseSizeClass parses a size class in the <name>:<min size>:<max concurrency> format, e.g. huge:100GiB:1.
+func ParseSizeClass(s string) (SizeClass, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 || parts[0] == "" {
+		return SizeClass{}, errors.Errorf("invalid size class %q, expected <name>:<min size>:<max concurrency>", s)
+	}
+	minBytes, err := units.ParseBase2Bytes(parts[1])
+	if err != nil {
+		return SizeClass{}, errors.Wrapf(err, "parse min size of size class %q", s)
+	}
+	maxConcurrency, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return SizeClass{}, errors.Wrapf(err, "parse max concurrency of size class %q", s)
+	}
+	if maxConcurrency <= 0 {
+		return SizeClass{}, errors.Errorf("max concurrency of size class %q must be > 0", s)
+	}
+	return SizeClass{Name: parts[0], MinBytes: int64(minBytes), MaxConcurrency: maxConcurrency}, nil
+}
+
+// SizeClassLimiter limits the number of groups of each size class compacted concurrently, so that a few huge groups
+// cannot saturate the disk while small groups wait behind them. Groups of a class at its limit are skipped in favor of
+// the next groups in order, until a group of the class finishes. Groups smaller than all classes are not limited.
+// Go-routine safe.
+type SizeClassLimiter struct {
+	classes []SizeClass
+
+	mtx      sync.Mutex
+	running  []int
+	acquired map[string]int
+	released chan struct{}
+
+	runningGauge *prometheus.GaugeVec
+	skipped      *prometheus.CounterVec
+}
+
+// NewSizeClassLimiter returns SizeClassLimiter of the given size classes.
+func NewSizeClassLimiter(reg prometheus.Registerer, classes []SizeClass) (*SizeClassLimiter, error) {
+	classes = append([]SizeClass(nil), classes...)
+	sort.Slice(classes, func(i, j int) bool { return classes[i].MinBytes > classes[j].MinBytes })
+	names := map[string]struct{}{}
+	for i, c := range classes {
+		if _, ok := names[c.Name]; ok {
+			return nil, errors.Errorf("duplicate size class %s", c.Name)
+		}
+		names[c.Name] = struct{}{}
+		if i > 0 && classes[i-1].MinBytes == c.MinBytes {
+			return nil, errors.Errorf("size classes %s and %s have the same min size", classes[i-1].Name, c.Name)
+		}
+	}
+
+	l := &SizeClassLimiter{
+		classes:  classes,
+		running:  make([]int, len(classes)),
+		acquired: map[string]int{},
+		released: make(chan struct{}, 1),
+		runningGauge: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_size_class_running_groups",
+			Help: "Number of groups of the size class being compacted.",
+		}, []string{"class"}),
+		skipped: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_size_class_skipped_total",
+			Help: "Total number of times a group was passed over by a smaller group because its size class was at its concurrency limit.",
+		}, []string{"class"}),
+	}
+	for _, c := range classes {
+		l.runningGauge.WithLabelValues(c.Name)
+		l.skipped.WithLabelValues(c.Name)
+	}
+	return l, nil
+}
+
+// class returns index of the size class of the given group, or -1 if the group is not in any class.
+func (l *SizeClassLimiter) class(g *Group) int {
+	g.mtx.Lock()
+	var size int64
+	for _, m := range g.blocks {
+		size += estimatedBlockBytes(m.Stats.NumSamples, m.Stats.NumSeries, m.Stats.NumChunks)
+	}
+	g.mtx.Unlock()
+
+	for i, c := range l.classes {
+		if size >= c.MinBytes {
+			return i
+		}
+	}
+	return -1
+}
+
+// take acquires the size class of the first of the given groups whose class is below its limit, and returns the group
+// with the rest of the groups, in the same order. It returns nil group if all classes of the groups are at their limits.
+// Nil limiter takes the first group.
+func (l *SizeClassLimiter) take(groups []*Group) (*Group, []*Group) {
+	if l == nil {
+		return groups[0], groups[1:]
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	for i, g := range groups {
+		c := l.class(g)
+		if c >= 0 && l.running[c] >= l.classes[c].MaxConcurrency {
+			l.skipped.WithLabelValues(l.classes[c].Name).Inc()
+			continue
+		}
+		if c >= 0 {
+			l.running[c]++
+			l.acquired[g.Key()] = c
+			l.runningGauge.WithLabelValues(l.classes[c].Name).Inc()
+		}
+		rest := make([]*Group, 0, len(groups)-1)
+		rest = append(append(rest, groups[:i]...), groups[i+1:]...)
+		return g, rest
+	}
+	return nil, groups
+}
+
+// release releases the size class acquired for the given group, if any.
+func (l *SizeClassLimiter) release(g *Group) {
+	if l == nil {
+		return
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	c, ok := l.acquired[g.Key()]
+	if !ok {
+		return
+	}
+	delete(l.acquired, g.Key())
+	l.running[c]--
+	l.runningGauge.WithLabelValues(l.classes[c].Name).Dec()
+	select {
+	case l.released <- struct{}{}:
+	default:
+	}
+}
+
+// wait returns channel notified once a size class is released after take returned nil group.
+func (l *SizeClassLimiter) wait() <-chan struct{} {
+	return l.released
+}
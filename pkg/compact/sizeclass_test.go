@@ -0,0 +1,76 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestParseSizeClass(t *testing.T) {
+	c, err := ParseSizeClass("huge:100GiB:1")
+	testutil.Ok(t, err)
+	testutil.Equals(t, SizeClass{Name: "huge", MinBytes: 100 << 30, MaxConcurrency: 1}, c)
+
+	for _, s := range []string{"huge", ":1GiB:1", "huge:1GiB", "huge:big:1", "huge:1GiB:0", "huge:1GiB:x"} {
+		_, err := ParseSizeClass(s)
+		testutil.NotOk(t, err, s)
+	}
+}
+
+func TestSizeClassLimiter(t *testing.T) {
+	group := func(key string, samples uint64) *Group {
+		m := &metadata.Meta{BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(uint64(len(key)), nil), Stats: tsdb.BlockStats{NumSamples: samples}}}
+		return &Group{key: key, blocks: map[ulid.ULID]*metadata.Meta{m.ULID: m}}
+	}
+	size := func(samples uint64) int64 { return estimatedBlockBytes(samples, 0, 0) }
+
+	_, err := NewSizeClassLimiter(prometheus.NewRegistry(), []SizeClass{{Name: "a", MinBytes: 1, MaxConcurrency: 1}, {Name: "a", MinBytes: 2, MaxConcurrency: 1}})
+	testutil.NotOk(t, err)
+
+	l, err := NewSizeClassLimiter(prometheus.NewRegistry(), []SizeClass{
+		{Name: "small", MinBytes: size(100), MaxConcurrency: 2},
+		{Name: "huge", MinBytes: size(1e6), MaxConcurrency: 1},
+	})
+	testutil.Ok(t, err)
+
+	huge1, huge2, small1, small2, small3, tiny := group("huge1", 1e7), group("huge2", 2e6), group("small1", 1000), group("small2", 1000), group("small3", 1000), group("tiny", 1)
+	pending := []*Group{huge1, huge2, small1, small2, small3, tiny}
+
+	var g *Group
+	g, pending = l.take(pending)
+	testutil.Equals(t, huge1, g)
+	// Second huge group waits behind the first one, while small ones go ahead of it.
+	g, pending = l.take(pending)
+	testutil.Equals(t, small1, g)
+	g, pending = l.take(pending)
+	testutil.Equals(t, small2, g)
+	// Groups below all classes are not limited.
+	g, pending = l.take(pending)
+	testutil.Equals(t, tiny, g)
+	g, pending = l.take(pending)
+	testutil.Assert(t, g == nil)
+	testutil.Equals(t, []*Group{huge2, small3}, pending)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(l.runningGauge.WithLabelValues("huge")))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(l.runningGauge.WithLabelValues("small")))
+
+	l.release(tiny)
+	l.release(huge1)
+	<-l.wait()
+	g, pending = l.take(pending)
+	testutil.Equals(t, huge2, g)
+	testutil.Equals(t, []*Group{small3}, pending)
+
+	// Nil limiter takes groups in order.
+	g, pending = (*SizeClassLimiter)(nil).take(pending)
+	testutil.Equals(t, small3, g)
+	testutil.Equals(t, 0, len(pending))
+}
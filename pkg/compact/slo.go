@@ -0,0 +1,204 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+)
+
+// CompactionBacklog returns the number of blocks awaiting compaction per resolution. A block awaits compaction if it is
+// shorter than maxRange and shares a complete window of that range, aligned the same way as compaction ranges, with
+// other blocks of its group. Blocks within the newest window of a group are not counted, as they are still being
+// filled up by new blocks.
+func CompactionBacklog(metas map[ulid.ULID]*metadata.Meta, maxRange int64) map[int64]int {
+	type window struct {
+		group string
+		start int64
+	}
+	var (
+		windows = map[window][]*metadata.Meta{}
+		newest  = map[string]int64{}
+	)
+	for _, m := range metas {
+		key := DefaultGroupKey(m.Thanos)
+		if m.MaxTime > newest[key] {
+			newest[key] = m.MaxTime
+		}
+		if m.MaxTime-m.MinTime >= maxRange {
+			continue
+		}
+		w := window{group: key, start: m.MinTime - m.MinTime%maxRange}
+		windows[w] = append(windows[w], m)
+	}
+
+	backlog := map[int64]int{}
+	for w, ms := range windows {
+		if len(ms) < 2 || w.start+maxRange > newest[w.group] {
+			continue
+		}
+		backlog[ms[0].Thanos.Downsample.Resolution] += len(ms)
+	}
+	return backlog
+}
+
+type backlogSample struct {
+	t       time.Time
+	backlog int
+}
+
+type compactedSample struct {
+	t      time.Time
+	blocks int
+}
+
+// BacklogSLO tracks the compaction backlog of each resolution and the rate the compactor works it down at, over a
+// sliding window. From those it projects time needed to drain the backlog, so alerts can fire when the backlog is
+// projected to grow indefinitely at the current throughput. Go-routine safe.
+type BacklogSLO struct {
+	maxRange int64
+	window   time.Duration
+	started  time.Time
+
+	mtx       sync.Mutex
+	backlog   map[int64][]backlogSample
+	compacted map[int64][]compactedSample
+
+	backlogBlocks  *prometheus.GaugeVec
+	compactionRate *prometheus.GaugeVec
+	burnDownRate   *prometheus.GaugeVec
+	timeToDrain    *prometheus.GaugeVec
+}
+
+// NewBacklogSLO returns BacklogSLO computing the backlog with the given largest compaction range in milliseconds and
+// all rates over the given window.
+func NewBacklogSLO(reg prometheus.Registerer, maxRange int64, window time.Duration) *BacklogSLO {
+	s := &BacklogSLO{
+		maxRange:  maxRange,
+		window:    window,
+		started:   time.Now(),
+		backlog:   map[int64][]backlogSample{},
+		compacted: map[int64][]compactedSample{},
+		backlogBlocks: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_backlog_blocks",
+			Help: "Number of blocks awaiting compaction, as of the beginning of the last compaction run.",
+		}, []string{"resolution"}),
+		compactionRate: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_backlog_compaction_rate_blocks_per_hour",
+			Help: "Number of source blocks compacted per hour over the backlog window.",
+		}, []string{"resolution"}),
+		burnDownRate: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_backlog_burn_down_rate_blocks_per_hour",
+			Help: "Net decrease of the compaction backlog per hour over the backlog window. Negative if the backlog grows.",
+		}, []string{"resolution"}),
+		timeToDrain: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_backlog_time_to_drain_seconds",
+			Help: "Projected time to drain the compaction backlog at the current burn down rate. +Inf if the backlog does not decrease.",
+		}, []string{"resolution"}),
+	}
+	for _, res := range []int64{downsample.ResLevel0, downsample.ResLevel1, downsample.ResLevel2} {
+		s.backlog[res] = nil
+		s.update(res, time.Now())
+	}
+	return s
+}
+
+// observeBacklog records the backlog of the given metas, synced at the given time.
+func (s *BacklogSLO) observeBacklog(now time.Time, metas map[ulid.ULID]*metadata.Meta) {
+	backlog := CompactionBacklog(metas, s.maxRange)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for res := range s.backlog {
+		if _, ok := backlog[res]; !ok {
+			backlog[res] = 0
+		}
+	}
+	for res, n := range backlog {
+		s.backlog[res] = append(s.backlog[res], backlogSample{t: now, backlog: n})
+		s.update(res, now)
+	}
+}
+
+// observeCompacted records the given number of source blocks of the given resolution compacted at the given time.
+func (s *BacklogSLO) observeCompacted(now time.Time, resolution int64, blocks int) {
+	if blocks == 0 {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.compacted[resolution] = append(s.compacted[resolution], compactedSample{t: now, blocks: blocks})
+	s.update(resolution, now)
+}
+
+// update drops samples out of the window and updates metrics of the given resolution. The latest backlog sample is
+// always kept, so the backlog is known even if the run took longer than the window.
+func (s *BacklogSLO) update(res int64, now time.Time) {
+	from := now.Add(-s.window)
+
+	backlog := s.backlog[res]
+	for len(backlog) > 1 && backlog[0].t.Before(from) {
+		backlog = backlog[1:]
+	}
+	s.backlog[res] = backlog
+	compacted := s.compacted[res]
+	for len(compacted) > 0 && compacted[0].t.Before(from) {
+		compacted = compacted[1:]
+	}
+	s.compacted[res] = compacted
+
+	l := strconv.FormatInt(res, 10)
+	if len(backlog) == 0 {
+		s.backlogBlocks.WithLabelValues(l).Set(0)
+		s.compactionRate.WithLabelValues(l).Set(0)
+		s.burnDownRate.WithLabelValues(l).Set(0)
+		s.timeToDrain.WithLabelValues(l).Set(0)
+		return
+	}
+
+	var blocks int
+	for _, c := range compacted {
+		blocks += c.blocks
+	}
+	// Until the SLO is tracked for the whole window, rates are computed over the time it is tracked for.
+	span := s.window
+	if d := now.Sub(s.started); d < span {
+		span = d
+	}
+	var rate float64
+	if span > 0 {
+		rate = float64(blocks) / span.Hours()
+	}
+	s.compactionRate.WithLabelValues(l).Set(rate)
+
+	first, last := backlog[0], backlog[len(backlog)-1]
+	s.backlogBlocks.WithLabelValues(l).Set(float64(last.backlog))
+
+	var burnDown float64
+	if d := last.t.Sub(first.t); d > 0 {
+		burnDown = float64(first.backlog-last.backlog) / d.Hours()
+	}
+	s.burnDownRate.WithLabelValues(l).Set(burnDown)
+
+	switch {
+	case last.backlog == 0:
+		s.timeToDrain.WithLabelValues(l).Set(0)
+	case burnDown <= 0:
+		s.timeToDrain.WithLabelValues(l).Set(math.Inf(1))
+	default:
+		s.timeToDrain.WithLabelValues(l).Set(float64(last.backlog) / burnDown * time.Hour.Seconds())
+	}
+}
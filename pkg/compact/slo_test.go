@@ -0,0 +1,96 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func backlogMetas(specs ...[3]int64) map[ulid.ULID]*metadata.Meta {
+	metas := map[ulid.ULID]*metadata.Meta{}
+	for i, s := range specs {
+		m := &metadata.Meta{}
+		m.ULID = ulid.MustNew(uint64(i), nil)
+		m.MinTime, m.MaxTime = s[0], s[1]
+		m.Thanos.Labels = map[string]string{"a": "1"}
+		m.Thanos.Downsample.Resolution = s[2]
+		metas[m.ULID] = m
+	}
+	return metas
+}
+
+func TestCompactionBacklog(t *testing.T) {
+	metas := backlogMetas(
+		// Complete window with multiple blocks.
+		[3]int64{0, 10, downsample.ResLevel0},
+		[3]int64{10, 20, downsample.ResLevel0},
+		[3]int64{20, 30, downsample.ResLevel0},
+		// Compacted block.
+		[3]int64{100, 200, downsample.ResLevel0},
+		// Complete window with a single block.
+		[3]int64{200, 210, downsample.ResLevel0},
+		// Newest window.
+		[3]int64{300, 310, downsample.ResLevel0},
+		[3]int64{310, 320, downsample.ResLevel0},
+		// Other resolution.
+		[3]int64{0, 50, downsample.ResLevel1},
+		[3]int64{50, 100, downsample.ResLevel1},
+		[3]int64{100, 200, downsample.ResLevel1},
+	)
+	testutil.Equals(t, map[int64]int{downsample.ResLevel0: 3, downsample.ResLevel1: 2}, CompactionBacklog(metas, 100))
+}
+
+func TestBacklogSLO(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	s := NewBacklogSLO(reg, 100, 4*time.Hour)
+	now := time.Now()
+	s.started = now
+
+	metric := func(g *prometheus.GaugeVec) float64 {
+		return promtest.ToFloat64(g.WithLabelValues("0"))
+	}
+	raw := func(n int) map[ulid.ULID]*metadata.Meta {
+		var specs [][3]int64
+		for i := 0; i < n; i++ {
+			specs = append(specs, [3]int64{int64(i), int64(i + 1), downsample.ResLevel0})
+		}
+		specs = append(specs, [3]int64{100, 200, downsample.ResLevel0})
+		return backlogMetas(specs...)
+	}
+
+	s.observeBacklog(now, raw(10))
+	testutil.Equals(t, 10.0, metric(s.backlogBlocks))
+	testutil.Equals(t, 0.0, metric(s.burnDownRate))
+	testutil.Equals(t, math.Inf(1), metric(s.timeToDrain))
+
+	s.observeCompacted(now.Add(time.Hour), downsample.ResLevel0, 6)
+	testutil.Equals(t, 6.0, metric(s.compactionRate))
+	s.observeBacklog(now.Add(2*time.Hour), raw(6))
+	testutil.Equals(t, 6.0, metric(s.backlogBlocks))
+	testutil.Equals(t, 2.0, metric(s.burnDownRate))
+	testutil.Equals(t, 3.0, metric(s.compactionRate))
+	testutil.Equals(t, (3 * time.Hour).Seconds(), metric(s.timeToDrain))
+
+	// Growing backlog is never drained.
+	s.observeBacklog(now.Add(4*time.Hour), raw(12))
+	testutil.Equals(t, -0.5, metric(s.burnDownRate))
+	testutil.Equals(t, math.Inf(1), metric(s.timeToDrain))
+
+	// Samples out of the window are dropped.
+	s.observeBacklog(now.Add(7*time.Hour), raw(0))
+	testutil.Equals(t, 0.0, metric(s.backlogBlocks))
+	testutil.Equals(t, 4.0, metric(s.burnDownRate))
+	testutil.Equals(t, 0.0, metric(s.compactionRate))
+	testutil.Equals(t, 0.0, metric(s.timeToDrain))
+}
@@ -0,0 +1,84 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// MetaSnapshot is a view of the bucket synced by a single MetaFetcher call of the Syncer. It is shared by all consumers
+// of the sync (compaction, garbage collection, downsampling and retention), so they do not need to fetch metas on their
+// own. Snapshots are immutable and safe to use concurrently; changes made by the Syncer create a new snapshot instead.
+type MetaSnapshot struct {
+	// Version increases with every new snapshot of the Syncer, whether it was fetched from the bucket or derived from the
+	// previous one, e.g. by garbage collection.
+	Version uint64
+	// SyncTime is the time when metas were fetched from the bucket. Snapshots derived from the fetched one share it.
+	SyncTime time.Time
+
+	// Metas are metas of blocks that passed all fetcher filters.
+	Metas map[ulid.ULID]*metadata.Meta
+	// Partial are blocks that have no or malformed meta.json.
+	Partial map[ulid.ULID]error
+	// DeletionMarks are deletion marks of all fetched blocks, also those not filtered out yet.
+	DeletionMarks map[ulid.ULID]*metadata.DeletionMark
+	// DuplicateIDs are blocks whose data is available as part of other blocks.
+	DuplicateIDs []ulid.ULID
+	// Pending are blocks whose meta.json failed to load, which the sync proceeded without as the fetcher allows partial
+	// results.
+	Pending map[ulid.ULID]error
+	// PendingMetas are metas of pending blocks as synced before their meta.json started to fail loading, if ever.
+	PendingMetas map[ulid.ULID]*metadata.Meta
+}
+
+func emptyMetaSnapshot() *MetaSnapshot {
+	return &MetaSnapshot{
+		Metas:         map[ulid.ULID]*metadata.Meta{},
+		Partial:       map[ulid.ULID]error{},
+		DeletionMarks: map[ulid.ULID]*metadata.DeletionMark{},
+		Pending:       map[ulid.ULID]error{},
+		PendingMetas:  map[ulid.ULID]*metadata.Meta{},
+	}
+}
+
+// mayContainPending returns true if any pending block may belong to the given group, i.e. it was never synced, so its
+// labels are unknown, or it was last synced with labels and resolution of the group. Compacting such a group without the
+// block would produce blocks overlapping with it once its meta.json becomes readable again.
+func (s *MetaSnapshot) mayContainPending(g *Group) bool {
+	for id := range s.Pending {
+		m, ok := s.PendingMetas[id]
+		if !ok {
+			return true
+		}
+		if m.Thanos.Downsample.Resolution == g.Resolution() && labels.Equal(labels.FromMap(m.Thanos.Labels), g.Labels()) {
+			return true
+		}
+	}
+	return false
+}
+
+// withDeleted returns a new snapshot with the given blocks marked for deletion at the given time, so they are no longer
+// part of Metas.
+func (s *MetaSnapshot) withDeleted(version uint64, deletionTime time.Time, ids ...ulid.ULID) *MetaSnapshot {
+	res := *s
+	res.Version = version
+	res.Metas = make(map[ulid.ULID]*metadata.Meta, len(s.Metas))
+	for id, m := range s.Metas {
+		res.Metas[id] = m
+	}
+	res.DeletionMarks = make(map[ulid.ULID]*metadata.DeletionMark, len(s.DeletionMarks)+len(ids))
+	for id, m := range s.DeletionMarks {
+		res.DeletionMarks[id] = m
+	}
+	for _, id := range ids {
+		delete(res.Metas, id)
+		res.DeletionMarks[id] = &metadata.DeletionMark{ID: id, DeletionTime: deletionTime.Unix(), Version: metadata.DeletionMarkVersion1}
+	}
+	return &res
+}
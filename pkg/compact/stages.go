@@ -0,0 +1,146 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// StageDownload is the stage of compactions downloading each source block.
+	StageDownload = "download"
+	// StageCompact is the stage of compactions compacting the downloaded blocks with the TSDB compactor. It has no
+	// policy, as TSDB compactors cannot be interrupted.
+	StageCompact = "compact"
+	// StageUpload is the stage of compactions uploading the compacted block.
+	StageUpload = "upload"
+)
+
+// StagePolicy bounds the duration of a stage of compactions and tells how the stage is retried.
+type StagePolicy struct {
+	// Timeout of each attempt of the stage. Zero means no timeout.
+	Timeout time.Duration
+	// Retries is the number of times a timed out or retriable failed attempt is retried within the same compaction.
+	// Once out of retries, the compaction fails with a retriable error, so it is planned again by the next cycle.
+	Retries int
+	// Backoff is the time to wait before retrying an attempt.
+	Backoff time.Duration
+}
+
+// StagePolicies are policies of stages of compactions transferring blocks, as a slow download or upload is usually
+// caused by the object storage and worth retrying. Compacting the downloaded blocks is not bounded: TSDB compactors cannot
+// be interrupted, so a timed out compaction would keep running and be planned again with the same blocks.
+type StagePolicies struct {
+	Download StagePolicy
+	Upload   StagePolicy
+}
+
+// Validate returns an error if the policies are invalid.
+func (p StagePolicies) Validate() error {
+	for stage, sp := range map[string]StagePolicy{StageDownload: p.Download, StageUpload: p.Upload} {
+		if sp.Timeout < 0 || sp.Retries < 0 || sp.Backoff < 0 {
+			return errors.Errorf("timeout, retries and backoff of %s stage must not be negative", stage)
+		}
+	}
+	return nil
+}
+
+// stageRunner runs stages of compactions of groups of a BucketCompactor with their policies.
+type stageRunner struct {
+	logger   log.Logger
+	policies StagePolicies
+
+	duration *prometheus.HistogramVec
+	timeouts *prometheus.CounterVec
+	retries  *prometheus.CounterVec
+}
+
+func newStageRunner(logger log.Logger, reg prometheus.Registerer, policies StagePolicies) *stageRunner {
+	s := &stageRunner{
+		logger:   logger,
+		policies: policies,
+		duration: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "thanos_compact_group_stage_duration_seconds",
+			Help:    "Duration of stages of compactions, including retries: of each download of a source block, of compacting the blocks and of uploading the compacted block.",
+			Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600, 1200, 3600, 7200},
+		}, []string{"stage"}),
+		timeouts: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_group_stage_timeouts_total",
+			Help: "Total number of attempts of stages of compactions that timed out.",
+		}, []string{"stage"}),
+		retries: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_group_stage_retries_total",
+			Help: "Total number of retries of stages of compactions within the same compaction.",
+		}, []string{"stage"}),
+	}
+	for _, stage := range []string{StageDownload, StageUpload} {
+		s.timeouts.WithLabelValues(stage)
+		s.retries.WithLabelValues(stage)
+	}
+	return s
+}
+
+func (s *stageRunner) policy(stage string) StagePolicy {
+	if stage == StageDownload {
+		return s.policies.Download
+	}
+	return s.policies.Upload
+}
+
+// run runs the given stage with its timeout, retrying attempts that timed out or failed with an error the given function
+// finds retriable, as long as retries are left. Without stageRunner, the stage is run once without timeout.
+func (s *stageRunner) run(ctx context.Context, stage string, retriable func(error) bool, f func(context.Context) error) error {
+	if s == nil {
+		return f(ctx)
+	}
+	p := s.policy(stage)
+	begin := time.Now()
+	defer func() { s.duration.WithLabelValues(stage).Observe(time.Since(begin).Seconds()) }()
+
+	for attempt := 0; ; attempt++ {
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if p.Timeout > 0 {
+			actx, cancel = context.WithTimeout(ctx, p.Timeout)
+		}
+		err := f(actx)
+		timedOut := err != nil && ctx.Err() == nil && actx.Err() == context.DeadlineExceeded
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if timedOut {
+			s.timeouts.WithLabelValues(stage).Inc()
+			err = errors.Wrapf(err, "%s timed out after %v", stage, p.Timeout)
+		}
+		if ctx.Err() != nil || attempt >= p.Retries || !timedOut && !retriable(err) {
+			return err
+		}
+
+		s.retries.WithLabelValues(stage).Inc()
+		level.Warn(s.logger).Log("msg", "retrying stage of compaction", "stage", stage, "attempt", attempt+1, "retries", p.Retries, "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(p.Backoff):
+		}
+	}
+}
+
+// compact runs the given compaction, observing its duration as the compaction stage.
+func (s *stageRunner) compact(f func() (ulid.ULID, error)) (ulid.ULID, error) {
+	if s == nil {
+		return f()
+	}
+	begin := time.Now()
+	defer func() { s.duration.WithLabelValues(StageCompact).Observe(time.Since(begin).Seconds()) }()
+	return f()
+}
@@ -0,0 +1,79 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestStagePolicies_Validate(t *testing.T) {
+	testutil.Ok(t, StagePolicies{Download: StagePolicy{Timeout: time.Minute, Retries: 3}}.Validate())
+	testutil.NotOk(t, StagePolicies{Upload: StagePolicy{Retries: -1}}.Validate())
+	testutil.NotOk(t, StagePolicies{Download: StagePolicy{Timeout: -time.Minute}}.Validate())
+}
+
+func TestStageRunner_Run(t *testing.T) {
+	ctx := context.Background()
+	s := newStageRunner(log.NewNopLogger(), prometheus.NewRegistry(), StagePolicies{
+		Download: StagePolicy{Timeout: 50 * time.Millisecond, Retries: 2},
+		Upload:   StagePolicy{Retries: 2},
+	})
+
+	// Attempts timing out are retried, each with its own timeout.
+	attempts := 0
+	testutil.Ok(t, s.run(ctx, StageDownload, IsRetryError, func(ctx context.Context) error {
+		attempts++
+		if attempts < 3 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}))
+	testutil.Equals(t, 3, attempts)
+	testutil.Equals(t, 2.0, promtest.ToFloat64(s.timeouts.WithLabelValues(StageDownload)))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(s.retries.WithLabelValues(StageDownload)))
+
+	// Out of retries, the last error is returned.
+	attempts = 0
+	err := s.run(ctx, StageDownload, IsRetryError, func(ctx context.Context) error {
+		attempts++
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 3, attempts)
+
+	// Errors not found retriable are not retried.
+	attempts = 0
+	err = s.run(ctx, StageUpload, IsRetryError, func(context.Context) error {
+		attempts++
+		return errors.New("collision")
+	})
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 1, attempts)
+
+	attempts = 0
+	testutil.Ok(t, s.run(ctx, StageUpload, IsRetryError, func(context.Context) error {
+		attempts++
+		if attempts < 2 {
+			return retry(errors.New("transient"))
+		}
+		return nil
+	}))
+	testutil.Equals(t, 2, attempts)
+	testutil.Equals(t, 0.0, promtest.ToFloat64(s.timeouts.WithLabelValues(StageUpload)))
+
+	// Without stage runner, stages are run once without timeout.
+	var none *stageRunner
+	testutil.NotOk(t, none.run(ctx, StageUpload, IsRetryError, func(context.Context) error { return retry(errors.New("transient")) }))
+}
@@ -0,0 +1,175 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+
+	"github.com/thanos-io/thanos/pkg/block"
+)
+
+// GroupStatus describes the outcome of the most recent compaction attempts of a single group.
+type GroupStatus struct {
+	// ID is the short ID of the group, see GroupID.
+	ID          string    `json:"id"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	LastFailure time.Time `json:"lastFailure"`
+	LastError   string    `json:"lastError,omitempty"`
+
+	// OutOfOrderSeries holds the latest report of series with out-of-order chunks dropped from each source block of the
+	// group, see WithSkipOutOfOrderSeries.
+	OutOfOrderSeries map[ulid.ULID]block.OutOfOrderSeriesReport `json:"outOfOrderSeries,omitempty"`
+}
+
+// Status is a point in time summary of BucketCompactor runs.
+type Status struct {
+	LastRunStart      time.Time `json:"lastRunStart"`
+	LastRunEnd        time.Time `json:"lastRunEnd"`
+	LastSuccessfulRun time.Time `json:"lastSuccessfulRun"`
+	LastRunError      string    `json:"lastRunError,omitempty"`
+
+	Halted    bool   `json:"halted"`
+	HaltError string `json:"haltError,omitempty"`
+
+	LastRunSummary RunSummary `json:"lastRunSummary"`
+
+	// Groups are statuses of groups of the last run, keyed by group key.
+	Groups map[string]GroupStatus `json:"groups"`
+
+	// OnDemandJobs are queued, running and recently finished on-demand compaction jobs, most recent first.
+	OnDemandJobs []OnDemandJob `json:"onDemandJobs,omitempty"`
+
+	// PendingBlocks are blocks whose meta.json failed to load on the last sync. Groups they may belong to are not
+	// compacted until it loads again.
+	PendingBlocks []PendingBlock `json:"pendingBlocks,omitempty"`
+}
+
+// PendingBlock is a block whose meta.json failed to load.
+type PendingBlock struct {
+	ID    ulid.ULID `json:"id"`
+	Error string    `json:"error"`
+}
+
+// statusTracker records compaction run outcomes. Go-routine safe.
+type statusTracker struct {
+	mtx    sync.Mutex
+	status Status
+
+	// seen holds keys of groups built or compacted by the ongoing run, if it got as far as building groups. Statuses
+	// of other groups are dropped once the run finishes, so groups whose blocks are gone do not pile up.
+	seen map[string]struct{}
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{status: Status{Groups: map[string]GroupStatus{}}}
+}
+
+func (t *statusTracker) runStarted() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.status.LastRunStart = time.Now()
+	t.seen = nil
+}
+
+func (t *statusTracker) groupsBuilt(groups []*Group) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.seen == nil {
+		t.seen = make(map[string]struct{}, len(groups))
+	}
+	for _, g := range groups {
+		t.seen[g.Key()] = struct{}{}
+	}
+}
+
+func (t *statusTracker) runFinished(err error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.status.LastRunEnd = time.Now()
+	if t.seen != nil {
+		for key := range t.status.Groups {
+			if _, ok := t.seen[key]; !ok {
+				delete(t.status.Groups, key)
+			}
+		}
+		t.seen = nil
+	}
+	if err == nil {
+		t.status.LastSuccessfulRun = t.status.LastRunEnd
+		t.status.LastRunError = ""
+		t.status.Halted = false
+		t.status.HaltError = ""
+		return
+	}
+
+	t.status.LastRunError = err.Error()
+	if IsHaltError(err) {
+		t.status.Halted = true
+		t.status.HaltError = err.Error()
+	}
+}
+
+func (t *statusTracker) setLastRunSummary(s RunSummary) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.status.LastRunSummary = s
+}
+
+func (t *statusTracker) groupFinished(key string, err error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.seen != nil {
+		t.seen[key] = struct{}{}
+	}
+	gs := t.status.Groups[key]
+	gs.ID = GroupID(key)
+	if err == nil {
+		gs.LastSuccess = time.Now()
+		gs.LastError = ""
+	} else {
+		gs.LastFailure = time.Now()
+		gs.LastError = err.Error()
+	}
+	t.status.Groups[key] = gs
+}
+
+func (t *statusTracker) outOfOrderSeriesDropped(key string, reports map[ulid.ULID]block.OutOfOrderSeriesReport) {
+	if len(reports) == 0 {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	gs := t.status.Groups[key]
+	gs.ID = GroupID(key)
+	ooo := make(map[ulid.ULID]block.OutOfOrderSeriesReport, len(gs.OutOfOrderSeries)+len(reports))
+	for id, r := range gs.OutOfOrderSeries {
+		ooo[id] = r
+	}
+	for id, r := range reports {
+		ooo[id] = r
+	}
+	gs.OutOfOrderSeries = ooo
+	t.status.Groups[key] = gs
+}
+
+func (t *statusTracker) get() Status {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	s := t.status
+	s.Groups = make(map[string]GroupStatus, len(t.status.Groups))
+	for k, v := range t.status.Groups {
+		s.Groups[k] = v
+	}
+	return s
+}
@@ -0,0 +1,95 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestStatusTracker(t *testing.T) {
+	tr := newStatusTracker()
+
+	tr.runStarted()
+	tr.groupFinished("0@1", nil)
+	tr.groupFinished("0@2", errors.New("group failed"))
+	tr.runFinished(errors.Wrap(halt(errors.New("overlap")), "group 0@2"))
+
+	s := tr.get()
+	testutil.Assert(t, s.Halted, "expected halted status")
+	testutil.Equals(t, "group 0@2: overlap", s.HaltError)
+	testutil.Assert(t, s.LastSuccessfulRun.IsZero(), "no run succeeded yet")
+	testutil.Equals(t, 2, len(s.Groups))
+	testutil.Assert(t, !s.Groups["0@1"].LastSuccess.IsZero(), "expected group success")
+	testutil.Equals(t, "group failed", s.Groups["0@2"].LastError)
+
+	// Returned status must not be affected by further updates.
+	tr.runStarted()
+	tr.groupFinished("0@2", nil)
+	tr.runFinished(nil)
+	testutil.Equals(t, "group failed", s.Groups["0@2"].LastError)
+
+	s = tr.get()
+	testutil.Assert(t, !s.Halted, "expected not halted status")
+	testutil.Equals(t, "", s.LastRunError)
+	testutil.Equals(t, s.LastRunEnd, s.LastSuccessfulRun)
+	testutil.Equals(t, "", s.Groups["0@2"].LastError)
+	testutil.Assert(t, !s.Groups["0@2"].LastFailure.IsZero(), "expected last failure to be retained")
+}
+
+func TestStatusTracker_OutOfOrderSeries(t *testing.T) {
+	tr := newStatusTracker()
+	id1, id2 := ulid.MustNew(1, nil), ulid.MustNew(2, nil)
+
+	tr.groupFinished("0@1", nil)
+	tr.outOfOrderSeriesDropped("0@1", nil)
+	testutil.Equals(t, 0, len(tr.get().Groups["0@1"].OutOfOrderSeries))
+
+	first := block.OutOfOrderSeriesReport{Series: 1, Chunks: 2, Examples: []labels.Labels{labels.FromStrings("a", "1")}}
+	tr.outOfOrderSeriesDropped("0@1", map[ulid.ULID]block.OutOfOrderSeriesReport{id1: first})
+	s := tr.get()
+	testutil.Equals(t, map[ulid.ULID]block.OutOfOrderSeriesReport{id1: first}, s.Groups["0@1"].OutOfOrderSeries)
+
+	// Reports of later runs are added to, or replace, reports of former ones, without affecting returned status.
+	latest := block.OutOfOrderSeriesReport{Series: 2, Chunks: 3, Examples: []labels.Labels{labels.FromStrings("a", "2")}}
+	other := block.OutOfOrderSeriesReport{Series: 1, Chunks: 1}
+	tr.outOfOrderSeriesDropped("0@1", map[ulid.ULID]block.OutOfOrderSeriesReport{id1: latest, id2: other})
+	testutil.Equals(t, map[ulid.ULID]block.OutOfOrderSeriesReport{id1: first}, s.Groups["0@1"].OutOfOrderSeries)
+	testutil.Equals(t, map[ulid.ULID]block.OutOfOrderSeriesReport{id1: latest, id2: other}, tr.get().Groups["0@1"].OutOfOrderSeries)
+	testutil.Assert(t, !tr.get().Groups["0@1"].LastSuccess.IsZero(), "expected group success to be retained")
+}
+
+func TestStatusTracker_PrunesGroups(t *testing.T) {
+	tr := newStatusTracker()
+	group := func(key string) *Group { return &Group{key: key} }
+
+	tr.runStarted()
+	tr.groupsBuilt([]*Group{group("0@1"), group("0@2")})
+	tr.groupFinished("0@1", nil)
+	tr.groupFinished("0@2", nil)
+	tr.runFinished(nil)
+	testutil.Equals(t, 2, len(tr.get().Groups))
+
+	// Statuses of groups no longer built, e.g. as their blocks were deleted by retention, are dropped, while groups
+	// compacted outside of built ones, e.g. stolen from other shards, are kept.
+	tr.runStarted()
+	tr.groupsBuilt([]*Group{group("0@1")})
+	tr.groupFinished("0@3", nil)
+	tr.runFinished(nil)
+	s := tr.get()
+	testutil.Equals(t, 2, len(s.Groups))
+	_, ok := s.Groups["0@2"]
+	testutil.Assert(t, !ok, "expected status of group 0@2 to be dropped")
+
+	// Runs failing before groups are built keep statuses as they are.
+	tr.runStarted()
+	tr.runFinished(errors.New("sync failed"))
+	testutil.Equals(t, 2, len(tr.get().Groups))
+}
@@ -0,0 +1,216 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block"
+)
+
+// WorkStealer lets a compactor sharing a bucket with other compactors by sharding, e.g. with hashmod relabelling of
+// external labels, compact groups of other shards once it has compacted all groups of its own shard. All compactors of
+// the bucket claim groups through GroupClaims before compacting them, so a stolen group is never compacted by its owner
+// at the same time, and source blocks are marked for deletion only while the claim is still held.
+type WorkStealer struct {
+	logger     log.Logger
+	claims     *GroupClaims
+	fetcher    block.MetadataFetcher
+	marks      *block.NoCompactMarkFilter
+	stealAfter time.Duration
+	maxGroups  int
+
+	stolen         prometheus.Counter
+	stolenFailures prometheus.Counter
+}
+
+// NewWorkStealer returns a WorkStealer claiming groups with the given claims. The given fetcher has to fetch metas of
+// blocks of all shards, filtered the same way as metas synced by the Syncer. Blocks found marked for no compaction by
+// the given, optional marks filter of the fetcher are skipped in planning of stolen groups, as by their owners. Up to
+// maxGroups groups are stolen after each compaction run, out of groups of other shards with anything to compact and no
+// block uploaded for at least stealAfter, as their owners seem to fall behind.
+func NewWorkStealer(logger log.Logger, reg prometheus.Registerer, claims *GroupClaims, fetcher block.MetadataFetcher, marks *block.NoCompactMarkFilter,
+	stealAfter time.Duration, maxGroups int) *WorkStealer {
+	return &WorkStealer{
+		logger:     logger,
+		claims:     claims,
+		fetcher:    fetcher,
+		marks:      marks,
+		stealAfter: stealAfter,
+		maxGroups:  maxGroups,
+		stolen: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_stolen_groups_total",
+			Help: "Total number of groups of other shards compacted by this compactor.",
+		}),
+		stolenFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_stolen_group_failures_total",
+			Help: "Total number of failed compactions of groups of other shards by this compactor.",
+		}),
+	}
+}
+
+// candidates returns groups not in the given set of own groups whose newest block is older than stealAfter, oldest
+// first.
+func (s *WorkStealer) candidates(groups []*Group, own map[string]struct{}, now time.Time) []*Group {
+	type candidate struct {
+		g      *Group
+		newest uint64
+	}
+	var res []candidate
+	for _, g := range groups {
+		if _, ok := own[g.Key()]; ok {
+			continue
+		}
+		ids := g.IDs()
+		if len(ids) < 2 {
+			continue
+		}
+		var newest uint64
+		for _, id := range ids {
+			if id.Time() > newest {
+				newest = id.Time()
+			}
+		}
+		if now.Sub(ulid.Time(newest)) < s.stealAfter {
+			continue
+		}
+		res = append(res, candidate{g: g, newest: newest})
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].newest < res[j].newest })
+	gs := make([]*Group, 0, len(res))
+	for _, c := range res {
+		gs = append(gs, c.g)
+	}
+	return gs
+}
+
+// verifyClaim returns ErrGroupClaimLost if the group was compacted under a claim it does not hold anymore.
+func (cg *Group) verifyClaim(ctx context.Context) error {
+	if cg.claims == nil {
+		return nil
+	}
+	return cg.claims.Verify(ctx, cg.Key())
+}
+
+// hasPlan returns true if compaction of the group would plan any compaction, without downloading any block.
+func (cg *Group) hasPlan(dir string, comp tsdb.Compactor) (bool, error) {
+	cg.mtx.Lock()
+	defer cg.mtx.Unlock()
+
+	subDir := filepath.Join(dir, cg.Key())
+	defer func() {
+		if err := os.RemoveAll(subDir); err != nil {
+			level.Error(cg.logger).Log("msg", "failed to remove compaction group work directory", "path", subDir, "err", err)
+		}
+	}()
+	if err := os.MkdirAll(subDir, 0777); err != nil {
+		return false, errors.Wrap(err, "create compaction group dir")
+	}
+	plan, _, err := cg.plan(subDir, comp)
+	if err != nil {
+		return false, err
+	}
+	return len(plan) > 0, nil
+}
+
+// claimGroup claims the given group for compaction, if work stealing is enabled. It returns false if the group is
+// claimed by another compactor and has to be skipped.
+func (c *BucketCompactor) claimGroup(ctx context.Context, g *Group) (bool, error) {
+	if c.stealing == nil || c.dryRun {
+		return true, nil
+	}
+	claimed, err := c.stealing.claims.Claim(ctx, g.Key())
+	if err != nil || !claimed {
+		return false, err
+	}
+	g.claims = c.stealing.claims
+	return true, nil
+}
+
+// releaseGroup releases the claim of the given group taken by claimGroup.
+func (c *BucketCompactor) releaseGroup(ctx context.Context, g *Group) {
+	if g.claims == nil {
+		return
+	}
+	g.claims.Release(ctx, g.Key())
+	g.claims = nil
+}
+
+// steal compacts groups of other shards, which are not in the given set of own groups, if work stealing is enabled.
+// Stolen groups are compacted the same way workers of Compact compact own groups, but their failures, halts included,
+// are left to their owners and do not fail this compactor.
+func (c *BucketCompactor) steal(ctx context.Context, own map[string]struct{}) error {
+	if c.stealing == nil || c.dryRun {
+		return nil
+	}
+	s := c.stealing
+	metas, _, err := s.fetcher.Fetch(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fetch metas of all shards")
+	}
+	groups, err := c.grouper.Groups(metas)
+	if err != nil {
+		return errors.Wrap(err, "build compaction groups of all shards")
+	}
+
+	candidates := s.candidates(groups, own, time.Now())
+	if c.errBudget != nil {
+		candidates = c.errBudget.filter(candidates)
+	}
+	stolen := 0
+	for _, g := range candidates {
+		if stolen >= s.maxGroups {
+			break
+		}
+		g.stolenNoCompactMarks = s.marks
+		// Planning only reads metas, so no space is reserved.
+		dir, releaseDir := c.compactDirs.pick(0)
+		ok, err := g.hasPlan(dir, c.comp)
+		releaseDir()
+		if err != nil {
+			level.Warn(s.logger).Log("msg", "failed to plan group of another shard; not stealing it", "group_id", g.ID(), "err", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if taken, _ := c.sizeClasses.take([]*Group{g}); taken == nil {
+			continue
+		}
+
+		// Metas of the group are not synced again, so the group is compacted once, and its owner or the next run of
+		// this compactor compacts what is left.
+		claimed, _, _, err := c.compactGroup(ctx, g)
+		c.sizeClasses.release(g)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if claimed {
+			stolen++
+			s.stolen.Inc()
+		}
+		if err != nil {
+			s.stolenFailures.Inc()
+			level.Warn(s.logger).Log("msg", "failed to compact stolen group; leaving it to its owner", "group_id", g.ID(), "err", err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		level.Info(s.logger).Log("msg", "compacted stolen group of another shard", "group_id", g.ID(), "blocks", len(g.IDs()))
+	}
+	return nil
+}
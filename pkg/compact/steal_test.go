@@ -0,0 +1,50 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestWorkStealer_Candidates(t *testing.T) {
+	now := time.Now()
+	newGroup := func(key string, ages ...time.Duration) *Group {
+		lset := labels.FromStrings("a", key)
+		g, err := NewGroup(nil, nil, key, lset, 0, false, false, GroupMetrics{})
+		testutil.Ok(t, err)
+		for i, age := range ages {
+			testutil.Ok(t, g.Add(&metadata.Meta{
+				BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(ulid.Timestamp(now.Add(-age)), nil), MinTime: int64(i) * 100, MaxTime: int64(i+1) * 100},
+				Thanos:    metadata.Thanos{Labels: lset.Map()},
+			}))
+		}
+		return g
+	}
+	s := NewWorkStealer(log.NewNopLogger(), prometheus.NewRegistry(), nil, nil, nil, time.Hour, 1)
+
+	groups := []*Group{
+		newGroup("0@1", 3*time.Hour, 2*time.Hour),
+		newGroup("0@2", 5*time.Hour, 4*time.Hour),
+		// Recently uploaded block; the owner keeps up.
+		newGroup("0@3", 5*time.Hour, time.Minute),
+		// Nothing to compact a single block with.
+		newGroup("0@4", 5*time.Hour),
+		newGroup("0@5", 8*time.Hour, 7*time.Hour),
+	}
+	var keys []string
+	for _, g := range s.candidates(groups, map[string]struct{}{"0@5": {}}, now) {
+		keys = append(keys, g.Key())
+	}
+	testutil.Equals(t, []string{"0@2", "0@1"}, keys)
+}
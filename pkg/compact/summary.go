@@ -0,0 +1,189 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	stageSync           = "sync"
+	stageGarbageCollect = "garbage_collect"
+	stageCompact        = "compact"
+)
+
+// RunSummary describes a single BucketCompactor run, summed across all its compaction iterations.
+type RunSummary struct {
+	Iterations int `json:"iterations"`
+	// Groups is the number of group compaction attempts, so a group taking part in multiple iterations is counted multiple times.
+	Groups      int `json:"groups"`
+	Compactions int `json:"compactions"`
+	// BytesIn is the total size of downloaded source blocks.
+	BytesIn int64 `json:"bytesIn"`
+	// BytesOut is the total size of uploaded compacted blocks.
+	BytesOut int64 `json:"bytesOut"`
+	// BlocksMarkedForDeletion includes both compacted source blocks and outdated blocks collected by the syncer.
+	BlocksMarkedForDeletion int `json:"blocksMarkedForDeletion"`
+
+	SyncDuration           time.Duration `json:"syncDuration"`
+	GarbageCollectDuration time.Duration `json:"garbageCollectDuration"`
+	CompactDuration        time.Duration `json:"compactDuration"`
+	Duration               time.Duration `json:"duration"`
+}
+
+func (s *RunSummary) addGroup(gs groupRunStats) {
+	s.Groups++
+	s.Compactions += gs.compactions
+	s.BytesIn += gs.bytesIn
+	s.BytesOut += gs.bytesOut
+	s.BlocksMarkedForDeletion += gs.blocksMarkedForDeletion
+}
+
+// groupRunStats accumulates work done by a single Group.
+type groupRunStats struct {
+	compactions             int
+	bytesIn                 int64
+	bytesOut                int64
+	blocksMarkedForDeletion int
+}
+
+// runSummaryRecorder accumulates the summary of the ongoing run and publishes it once the run finishes. Go-routine safe.
+type runSummaryRecorder struct {
+	logger log.Logger
+
+	mtx     sync.Mutex
+	begin   time.Time
+	current RunSummary
+
+	iterations              prometheus.Gauge
+	groups                  prometheus.Gauge
+	compactions             prometheus.Gauge
+	bytesIn                 prometheus.Gauge
+	bytesOut                prometheus.Gauge
+	blocksMarkedForDeletion prometheus.Gauge
+	stageDuration           *prometheus.GaugeVec
+	success                 prometheus.Gauge
+}
+
+func newRunSummaryRecorder(logger log.Logger, reg prometheus.Registerer) *runSummaryRecorder {
+	r := &runSummaryRecorder{
+		logger: logger,
+		iterations: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_last_run_iterations",
+			Help: "Number of compaction iterations of the last finished compaction run.",
+		}),
+		groups: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_last_run_groups",
+			Help: "Number of group compaction attempts of the last finished compaction run.",
+		}),
+		compactions: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_last_run_compactions",
+			Help: "Number of blocks created by the last finished compaction run.",
+		}),
+		bytesIn: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_last_run_input_bytes",
+			Help: "Total size of source blocks downloaded by the last finished compaction run.",
+		}),
+		bytesOut: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_last_run_output_bytes",
+			Help: "Total size of compacted blocks uploaded by the last finished compaction run.",
+		}),
+		blocksMarkedForDeletion: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_last_run_blocks_marked_for_deletion",
+			Help: "Number of blocks marked for deletion by the last finished compaction run.",
+		}),
+		stageDuration: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_last_run_stage_duration_seconds",
+			Help: "Wall time spent in each stage of the last finished compaction run.",
+		}, []string{"stage"}),
+		success: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_last_run_success",
+			Help: "Whether the last finished compaction run succeeded (1) or failed (0).",
+		}),
+	}
+	for _, stage := range []string{stageSync, stageGarbageCollect, stageCompact} {
+		r.stageDuration.WithLabelValues(stage)
+	}
+	return r
+}
+
+func (r *runSummaryRecorder) runStarted() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.begin = time.Now()
+	r.current = RunSummary{}
+}
+
+// update applies f to the summary of the ongoing run.
+func (r *runSummaryRecorder) update(f func(s *RunSummary)) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	f(&r.current)
+}
+
+// runFinished publishes the summary of the ongoing run as a log line and gauges, and returns it.
+func (r *runSummaryRecorder) runFinished(err error) RunSummary {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	s := r.current
+	s.Duration = time.Since(r.begin)
+
+	r.iterations.Set(float64(s.Iterations))
+	r.groups.Set(float64(s.Groups))
+	r.compactions.Set(float64(s.Compactions))
+	r.bytesIn.Set(float64(s.BytesIn))
+	r.bytesOut.Set(float64(s.BytesOut))
+	r.blocksMarkedForDeletion.Set(float64(s.BlocksMarkedForDeletion))
+	r.stageDuration.WithLabelValues(stageSync).Set(s.SyncDuration.Seconds())
+	r.stageDuration.WithLabelValues(stageGarbageCollect).Set(s.GarbageCollectDuration.Seconds())
+	r.stageDuration.WithLabelValues(stageCompact).Set(s.CompactDuration.Seconds())
+
+	kv := []interface{}{
+		"msg", "compaction run summary",
+		"iterations", s.Iterations,
+		"groups", s.Groups,
+		"compactions", s.Compactions,
+		"bytes_in", s.BytesIn,
+		"bytes_out", s.BytesOut,
+		"blocks_marked_for_deletion", s.BlocksMarkedForDeletion,
+		"sync_duration", s.SyncDuration,
+		"garbage_collect_duration", s.GarbageCollectDuration,
+		"compact_duration", s.CompactDuration,
+		"duration", s.Duration,
+	}
+	if err != nil {
+		r.success.Set(0)
+		level.Warn(r.logger).Log(append(kv, "err", err)...)
+		return s
+	}
+	r.success.Set(1)
+	level.Info(r.logger).Log(kv...)
+	return s
+}
+
+// dirSize returns total size of regular files within the given directory.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
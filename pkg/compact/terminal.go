@@ -0,0 +1,154 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// TerminalBlocks detects level 1 blocks that can never be compacted, because no other block of their group is left in
+// the time range of the highest compaction level around them and the part of the range before the retention of their
+// resolution can hold no more blocks, as retention deletes them. Such blocks are marked for no compaction with
+// metadata.TerminalNoCompactReason, and blocks marked for no compaction are skipped by compaction planning.
+// Blocks uploaded into the range after the retention of its beginning passed are not accounted for. Go-routine safe.
+type TerminalBlocks struct {
+	marks     *block.NoCompactMarkFilter
+	window    int64
+	retention map[ResolutionLevel]time.Duration
+
+	mtx    sync.Mutex
+	marked map[ulid.ULID]struct{}
+
+	terminal prometheus.Counter
+}
+
+// NewTerminalBlocks returns TerminalBlocks registered in the given registerer, for the given compaction ranges in
+// milliseconds and retention by resolution. No-compact marks are taken from the given filter, which must be one of filters
+// of the compactor's fetcher.
+func NewTerminalBlocks(reg prometheus.Registerer, marks *block.NoCompactMarkFilter, ranges []int64, retention map[ResolutionLevel]time.Duration) *TerminalBlocks {
+	var window int64
+	if len(ranges) > 0 {
+		window = ranges[len(ranges)-1]
+	}
+	return &TerminalBlocks{
+		marks:     marks,
+		window:    window,
+		retention: retention,
+		marked:    map[ulid.ULID]struct{}{},
+		terminal: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_terminal_blocks_total",
+			Help: "Total number of blocks marked for no compaction as no other block of their group can ever be compacted with them.",
+		}),
+	}
+}
+
+// SetRetention replaces retention by resolution, applied from the next planning on.
+func (t *TerminalBlocks) SetRetention(retention map[ResolutionLevel]time.Duration) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.retention = retention
+}
+
+// isMarked returns true if the block with the given ID is marked for no compaction.
+func (t *TerminalBlocks) isMarked(id ulid.ULID) bool {
+	if _, ok := t.marks.NoCompactMarkedBlocks()[id]; ok {
+		return true
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	_, ok := t.marked[id]
+	return ok
+}
+
+// terminalBlock is a block that can never be compacted, with the explanation recorded in its no-compact mark.
+type terminalBlock struct {
+	id      ulid.ULID
+	details string
+}
+
+// find returns blocks of the given ones, all of the same resolution, that can never be compacted at the given time.
+func (t *TerminalBlocks) find(blocks map[ulid.ULID]*metadata.Meta, resolution int64, now time.Time) []terminalBlock {
+	t.mtx.Lock()
+	retention := t.retention[ResolutionLevel(resolution)]
+	t.mtx.Unlock()
+	if retention <= 0 || t.window <= 0 {
+		return nil
+	}
+	cutoff := timestamp.FromTime(now.Add(-retention))
+
+	var res []terminalBlock
+	for id, m := range blocks {
+		if m.Compaction.Level != 1 || m.MaxTime < cutoff {
+			// Blocks past retention are deleted anyway.
+			continue
+		}
+		minT := m.MinTime - m.MinTime%t.window
+		maxT := minT + t.window
+		if minT >= cutoff || m.MaxTime > maxT {
+			continue
+		}
+		alone := true
+		for oid, o := range blocks {
+			if oid != id && o.MinTime < maxT && o.MaxTime > minT {
+				alone = false
+				break
+			}
+		}
+		if !alone {
+			continue
+		}
+		res = append(res, terminalBlock{
+			id: id,
+			details: fmt.Sprintf("only block of the group in compaction range [%s, %s); blocks of the range before %s are deleted by retention of %s",
+				timestamp.Time(minT).UTC().Format(time.RFC3339), timestamp.Time(maxT).UTC().Format(time.RFC3339), timestamp.Time(cutoff).UTC().Format(time.RFC3339), retention),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].id.Compare(res[j].id) < 0
+	})
+	return res
+}
+
+// markTerminalBlocks marks blocks of the group that can never be compacted for no compaction, if configured by
+// WithTerminalBlocks.
+func (cg *Group) markTerminalBlocks(ctx context.Context) error {
+	t := cg.opts.terminalBlocks
+	if t == nil {
+		return nil
+	}
+	for _, b := range t.find(cg.blocks, cg.resolution, time.Now()) {
+		if cg.noCompact(b.id) {
+			continue
+		}
+		if err := block.MarkForNoCompact(ctx, cg.logger, cg.bkt, b.id, metadata.TerminalNoCompactReason, b.details, t.terminal); err != nil {
+			return err
+		}
+		t.mtx.Lock()
+		t.marked[b.id] = struct{}{}
+		t.mtx.Unlock()
+	}
+	return nil
+}
+
+// noCompact returns true if the block with the given ID must be skipped by compaction planning.
+func (cg *Group) noCompact(id ulid.ULID) bool {
+	if cg.stolenNoCompactMarks != nil {
+		if _, ok := cg.stolenNoCompactMarks.NoCompactMarkedBlocks()[id]; ok {
+			return true
+		}
+	}
+	return cg.opts.terminalBlocks != nil && cg.opts.terminalBlocks.isMarked(id)
+}
@@ -0,0 +1,143 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestTerminalBlocks_Find(t *testing.T) {
+	const hour = int64(time.Hour / time.Millisecond)
+	var (
+		ranges    = []int64{2 * hour, 8 * hour, 48 * hour, 14 * 24 * hour}
+		retention = map[ResolutionLevel]time.Duration{ResolutionLevelRaw: 30 * 24 * time.Hour}
+		window    = ranges[len(ranges)-1]
+		// Retention cutoff is in the middle of the range of the highest compaction level.
+		cutoff = 100*window + window/2
+		now    = timestamp.Time(cutoff).Add(retention[ResolutionLevelRaw])
+	)
+	newMeta := func(id uint64, mint, maxt int64, lvl int) *metadata.Meta {
+		return &metadata.Meta{BlockMeta: tsdb.BlockMeta{
+			ULID: ulid.MustNew(id, nil), MinTime: mint, MaxTime: maxt,
+			Compaction: tsdb.BlockMetaCompaction{Level: lvl},
+		}}
+	}
+	metas := func(ms ...*metadata.Meta) map[ulid.ULID]*metadata.Meta {
+		res := map[ulid.ULID]*metadata.Meta{}
+		for _, m := range ms {
+			res[m.ULID] = m
+		}
+		return res
+	}
+
+	tb := NewTerminalBlocks(prometheus.NewRegistry(), nil, ranges, retention)
+	for _, tcase := range []struct {
+		name       string
+		blocks     map[ulid.ULID]*metadata.Meta
+		resolution int64
+		expected   []ulid.ULID
+	}{
+		{
+			name:     "single block across retention cutoff",
+			blocks:   metas(newMeta(1, cutoff-hour, cutoff+hour, 1)),
+			expected: []ulid.ULID{ulid.MustNew(1, nil)},
+		},
+		{
+			name:     "single block after retention cutoff",
+			blocks:   metas(newMeta(1, cutoff+hour, cutoff+3*hour, 1)),
+			expected: []ulid.ULID{ulid.MustNew(1, nil)},
+		},
+		{
+			name:   "block with partner in the range",
+			blocks: metas(newMeta(1, cutoff-hour, cutoff+hour, 1), newMeta(2, cutoff+5*hour, cutoff+7*hour, 1)),
+		},
+		{
+			name:     "partner in the next range",
+			blocks:   metas(newMeta(1, cutoff-hour, cutoff+hour, 1), newMeta(2, 101*window, 101*window+2*hour, 1)),
+			expected: []ulid.ULID{ulid.MustNew(1, nil)},
+		},
+		{
+			name:   "block past retention",
+			blocks: metas(newMeta(1, cutoff-3*hour, cutoff-hour, 1)),
+		},
+		{
+			name:   "range entirely within retention",
+			blocks: metas(newMeta(1, 101*window, 101*window+2*hour, 1)),
+		},
+		{
+			name:   "compacted block",
+			blocks: metas(newMeta(1, cutoff-hour, cutoff+7*hour, 2)),
+		},
+		{
+			name:       "resolution without retention",
+			blocks:     metas(newMeta(1, cutoff-hour, cutoff+hour, 1)),
+			resolution: int64(ResolutionLevel5m),
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			var ids []ulid.ULID
+			for _, b := range tb.find(tcase.blocks, tcase.resolution, now) {
+				testutil.Assert(t, b.details != "", "missing details of terminal block %s", b.id)
+				ids = append(ids, b.id)
+			}
+			testutil.Equals(t, tcase.expected, ids)
+		})
+	}
+}
+
+func TestGroup_MarkTerminalBlocks(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+
+	// A single raw block in the range of the highest compaction level before the current one, with retention cutoff in it.
+	const hour = int64(time.Hour / time.Millisecond)
+	ranges := []int64{2 * hour, 8 * hour}
+	mint := timestamp.FromTime(time.Now())/ranges[1]*ranges[1] - ranges[1]
+	m := &metadata.Meta{BlockMeta: tsdb.BlockMeta{
+		ULID: ulid.MustNew(1, nil), MinTime: mint + hour, MaxTime: mint + 3*hour,
+		Compaction: tsdb.BlockMetaCompaction{Level: 1},
+	}}
+	retention := map[ResolutionLevel]time.Duration{ResolutionLevelRaw: time.Since(timestamp.Time(mint + 2*hour))}
+
+	filter := block.NewNoCompactMarkFilter(logger, bkt)
+	tb := NewTerminalBlocks(prometheus.NewRegistry(), filter, ranges, retention)
+	g, err := NewGroup(logger, bkt, "0@1", labels.Labels{}, 0, false, false, GroupMetrics{}, WithTerminalBlocks(tb))
+	testutil.Ok(t, err)
+	testutil.Ok(t, g.Add(m))
+
+	testutil.Ok(t, filter.Filter(ctx, map[ulid.ULID]*metadata.Meta{m.ULID: m}, nil))
+	testutil.Assert(t, !g.noCompact(m.ULID), "block marked before detection")
+
+	testutil.Ok(t, g.markTerminalBlocks(ctx))
+	testutil.Assert(t, g.noCompact(m.ULID), "terminal block not marked")
+	testutil.Equals(t, 1.0, promtest.ToFloat64(tb.terminal))
+
+	mark, err := metadata.ReadNoCompactMark(ctx, bkt, logger, m.ULID.String())
+	testutil.Ok(t, err)
+	testutil.Equals(t, metadata.TerminalNoCompactReason, mark.Reason)
+	testutil.Assert(t, mark.Details != "", "missing details of no-compact mark")
+
+	// Marks gathered by the filter are not uploaded again.
+	testutil.Ok(t, filter.Filter(ctx, map[ulid.ULID]*metadata.Meta{m.ULID: m}, nil))
+	tb.marked = map[ulid.ULID]struct{}{}
+	testutil.Ok(t, g.markTerminalBlocks(ctx))
+	testutil.Assert(t, g.noCompact(m.ULID), "terminal block not marked")
+	testutil.Equals(t, 1.0, promtest.ToFloat64(tb.terminal))
+}
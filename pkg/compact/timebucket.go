@@ -0,0 +1,99 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// TimeBucketGrouper is a Grouper splitting groups of DefaultGrouper by time buckets of the given size, so that blocks of
+// enormous long-lived label sets are compacted in manageable units. Blocks shorter than the bucket are grouped by the
+// bucket of their min time, and compacted within the bucket up to blocks of the bucket size. Blocks of the bucket size
+// or longer form the group of their labels and resolution, as by DefaultGrouper, merged across buckets by the remaining
+// compaction levels.
+// The bucket size must be one of the compaction levels, so that lower levels never cross bucket boundaries.
+type TimeBucketGrouper struct {
+	*DefaultGrouper
+
+	bucket int64
+}
+
+// NewTimeBucketGrouper returns TimeBucketGrouper creating groups with the given DefaultGrouper, splitting them by time
+// buckets of the given size in milliseconds.
+func NewTimeBucketGrouper(g *DefaultGrouper, bucket int64) (*TimeBucketGrouper, error) {
+	if bucket <= 0 {
+		return nil, errors.Errorf("invalid time bucket size %d, must be > 0", bucket)
+	}
+	return &TimeBucketGrouper{DefaultGrouper: g, bucket: bucket}, nil
+}
+
+// TimeBucketGroupKey returns the key of the group of blocks of the given labels and resolution within the time bucket
+// starting at the given time.
+func TimeBucketGroupKey(meta metadata.Thanos, bucketStart int64) string {
+	return fmt.Sprintf("%s@%d", DefaultGroupKey(meta), bucketStart)
+}
+
+// Groups returns the compaction groups for all blocks currently known to the syncer.
+// It creates all groups from the scratch on every call.
+func (g *TimeBucketGrouper) Groups(blocks map[ulid.ULID]*metadata.Meta) (res []*Group, err error) {
+	// No more blocks come into a bucket once blocks of the same labels and resolution start past it.
+	newest := map[string]int64{}
+	for _, m := range blocks {
+		key := DefaultGroupKey(m.Thanos)
+		if t, ok := newest[key]; !ok || m.MinTime > t {
+			newest[key] = m.MinTime
+		}
+	}
+
+	groups := map[string]*Group{}
+	for _, m := range blocks {
+		metricsKey := DefaultGroupKey(m.Thanos)
+		groupKey := metricsKey
+		var bucketEnd int64
+		if m.MaxTime-m.MinTime < g.bucket {
+			start := bucketStart(m.MinTime, g.bucket)
+			groupKey = TimeBucketGroupKey(m.Thanos, start)
+			bucketEnd = start + g.bucket
+		}
+
+		group, ok := groups[groupKey]
+		if !ok {
+			group, err = g.newGroup(groupKey, metricsKey, m)
+			if err != nil {
+				return nil, err
+			}
+			if bucketEnd != 0 && newest[metricsKey] >= bucketEnd {
+				group.planHorizon = bucketEnd
+			}
+			groups[groupKey] = group
+			res = append(res, group)
+		}
+		if err := group.Add(m); err != nil {
+			return nil, errors.Wrap(err, "add compaction group")
+		}
+		// Blocks starting within the bucket may end past it.
+		if group.planHorizon != 0 && m.MaxTime > group.planHorizon {
+			group.planHorizon = m.MaxTime
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key() < res[j].Key()
+	})
+	return res, nil
+}
+
+// bucketStart returns the start of the time bucket of the given size containing the given time.
+func bucketStart(t, bucket int64) int64 {
+	start := t - t%bucket
+	if t < 0 && t%bucket != 0 {
+		start -= bucket
+	}
+	return start
+}
@@ -0,0 +1,84 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestTimeBucketGrouper(t *testing.T) {
+	const h = int64(time.Hour / time.Millisecond)
+
+	blocks := map[ulid.ULID]*metadata.Meta{}
+	add := func(mint, maxt int64) ulid.ULID {
+		id := ulid.MustNew(uint64(len(blocks)+1), nil)
+		blocks[id] = &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: id, MinTime: mint, MaxTime: maxt, Version: 1, Compaction: tsdb.BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{id}}},
+			Thanos:    metadata.Thanos{Labels: map[string]string{"a": "1"}, Source: metadata.TestSource},
+		}
+		return id
+	}
+	// Two full buckets of four 2h blocks each, a bucket of a single block and a block of the bucket size.
+	for mint := int64(0); mint < 16*h; mint += 2 * h {
+		add(mint, mint+2*h)
+	}
+	add(16*h, 18*h)
+	add(24*h, 32*h)
+
+	bkt := objstore.NewInMemBucket()
+	reg := prometheus.NewRegistry()
+	def := NewDefaultGrouper(log.NewNopLogger(), bkt, false, false, reg, prometheus.NewCounter(prometheus.CounterOpts{}), prometheus.NewCounter(prometheus.CounterOpts{}))
+	_, err := NewTimeBucketGrouper(def, 0)
+	testutil.NotOk(t, err)
+	grouper, err := NewTimeBucketGrouper(def, 8*h)
+	testutil.Ok(t, err)
+
+	groups, err := grouper.Groups(blocks)
+	testutil.Ok(t, err)
+	meta := blocks[ulid.MustNew(1, nil)].Thanos
+	var keys []string
+	for _, g := range groups {
+		keys = append(keys, g.Key())
+	}
+	testutil.Equals(t, []string{DefaultGroupKey(meta), TimeBucketGroupKey(meta, 0), TimeBucketGroupKey(meta, 8*h), TimeBucketGroupKey(meta, 16*h)}, keys)
+	testutil.Equals(t, 1, len(groups[0].IDs()))
+	testutil.Equals(t, 4, len(groups[1].IDs()))
+	testutil.Equals(t, 4, len(groups[2].IDs()))
+	testutil.Equals(t, 1, len(groups[3].IDs()))
+	testutil.Equals(t, 8*h, groups[1].planHorizon)
+	testutil.Equals(t, 16*h, groups[2].planHorizon)
+	// Closed by the block of the bucket size starting past it.
+	testutil.Equals(t, 24*h, groups[3].planHorizon)
+
+	comp, err := tsdb.NewLeveledCompactor(context.Background(), reg, log.NewNopLogger(), []int64{2 * h, 8 * h, 48 * h}, nil)
+	testutil.Ok(t, err)
+	dir, err := ioutil.TempDir("", "time-bucket-grouper")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	// All blocks of a closed bucket are compacted, including its most recent one.
+	plan, _, err := groups[1].plan(filepath.Join(dir, "closed"), comp)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 4, len(plan))
+
+	// Without the horizon, as for open buckets, blocks wait for more blocks next to the most recent one.
+	groups[1].planHorizon = 0
+	plan, _, err = groups[1].plan(filepath.Join(dir, "open"), comp)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(plan))
+}
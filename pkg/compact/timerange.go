@@ -0,0 +1,340 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/extprom"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// TimeRangeAction is what TimeRangeFilter does with blocks whose index has chunks outside of the time range of their
+// meta, which makes the planner plan compactions with wrong time ranges and produce overlapping blocks.
+type TimeRangeAction string
+
+const (
+	// TimeRangeSkip filters the block out of compaction, retention and garbage collection while the compactor runs.
+	TimeRangeSkip TimeRangeAction = "skip"
+	// TimeRangeRepair uploads a copy of the block under a new ID with a time range covering all its chunks, and marks the
+	// block for deletion. The copy may overlap neighbouring blocks, as its data did all along.
+	TimeRangeRepair TimeRangeAction = "repair"
+	// TimeRangeQuarantine places the block under hold with QuarantineTimeRangeHoldReason, so it is not compacted until an
+	// operator repairs its meta and removes the hold.
+	TimeRangeQuarantine TimeRangeAction = "quarantine"
+)
+
+// TimeRangeActions are all valid values of TimeRangeAction.
+var TimeRangeActions = []string{
+	string(TimeRangeSkip),
+	string(TimeRangeRepair),
+	string(TimeRangeQuarantine),
+}
+
+// QuarantineTimeRangeHoldReason prefixes reasons of holds placed on blocks whose index does not match their meta.
+const QuarantineTimeRangeHoldReason = "quarantined: meta time range not matching index"
+
+const timeRangeMismatchMeta = "time-range-mismatch"
+
+// TimeRangeFilter is a MetadataFilter checking that chunks of indexes of blocks are within the time range of their meta,
+// once per block, and handling blocks failing the check with its TimeRangeAction. Blocks created by compaction are not
+// checked, as their time range is derived from their checked sources. Blocks failing to be checked, e.g. because their
+// index cannot be downloaded, are passed through and checked again on the next sync. It must be placed after
+// IgnoreDeletionMarkFilter and before DeduplicateFilter.
+type TimeRangeFilter struct {
+	logger                  log.Logger
+	bkt                     objstore.Bucket
+	dir                     string
+	action                  TimeRangeAction
+	sampleEvery             int
+	gate                    *DeletionGate
+	blocksMarkedForDeletion prometheus.Counter
+	dryRun                  bool
+
+	// mtx guards checked, which is shared with filters returned by ForAllShards.
+	mtx *sync.Mutex
+	// checked holds results of checks by block: nil for blocks matching their meta, the mismatch otherwise.
+	checked map[ulid.ULID]error
+	// forget is true if results of blocks not passed to Filter are forgotten, which only the filter seeing the most blocks
+	// may do.
+	forget bool
+
+	checks     *prometheus.CounterVec
+	mismatches *prometheus.CounterVec
+	skipped    prometheus.Gauge
+}
+
+// NewTimeRangeFilter returns TimeRangeFilter downloading indexes into the given directory and checking the given ratio of
+// their series. Deletions of repaired blocks are subject to the given, optional DeletionGate. With dryRun, mismatching
+// blocks are only logged and filtered out.
+func NewTimeRangeFilter(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket, dir string, action TimeRangeAction, sampleRatio float64,
+	gate *DeletionGate, blocksMarkedForDeletion prometheus.Counter, dryRun bool) (*TimeRangeFilter, error) {
+	if sampleRatio <= 0 || sampleRatio > 1 {
+		return nil, errors.Errorf("sample ratio of series %v must be within (0, 1]", sampleRatio)
+	}
+	f := &TimeRangeFilter{
+		logger:                  logger,
+		bkt:                     bkt,
+		dir:                     dir,
+		action:                  action,
+		sampleEvery:             int(math.Round(1 / sampleRatio)),
+		gate:                    gate,
+		blocksMarkedForDeletion: blocksMarkedForDeletion,
+		dryRun:                  dryRun,
+		mtx:                     &sync.Mutex{},
+		checked:                 map[ulid.ULID]error{},
+		forget:                  true,
+		checks: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_time_range_checks_total",
+			Help: "Total number of checks of time ranges of chunks of blocks against their meta, by result.",
+		}, []string{"result"}),
+		mismatches: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_time_range_mismatches_total",
+			Help: "Total number of blocks with chunks outside of the time range of their meta, by action taken.",
+		}, []string{"action"}),
+		skipped: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_time_range_mismatched_blocks",
+			Help: "Number of blocks with chunks outside of the time range of their meta filtered out on the last sync.",
+		}),
+	}
+	for _, r := range []string{"match", "mismatch", "failure"} {
+		f.checks.WithLabelValues(r)
+	}
+	for _, a := range TimeRangeActions {
+		f.mismatches.WithLabelValues(a)
+	}
+	return f, nil
+}
+
+// ForAllShards returns a TimeRangeFilter for a fetcher of blocks of all shards, e.g. the one of WorkStealer, while f
+// filters blocks of the compactor's own shard. Both share configuration, metrics, except the gauge of blocks filtered
+// out, and results of checks, so each block is checked once. From now on results of blocks gone are forgotten by the
+// returned filter only, as f does not see blocks of other shards.
+func (f *TimeRangeFilter) ForAllShards() *TimeRangeFilter {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	all := *f
+	all.skipped = nil
+	all.forget = true
+	f.forget = false
+	return &all
+}
+
+// Filter filters out blocks whose index has chunks outside of the time range of their meta, handling them with the
+// configured action.
+func (f *TimeRangeFilter) Filter(ctx context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.forget {
+		for id := range f.checked {
+			if _, ok := metas[id]; !ok {
+				delete(f.checked, id)
+			}
+		}
+	}
+
+	skipped := 0
+	for id, m := range metas {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if m.Thanos.Source == metadata.CompactorSource {
+			continue
+		}
+		if _, ok := f.checked[id]; !ok {
+			if err := f.check(ctx, m); err != nil {
+				level.Warn(f.logger).Log("msg", "failed to check time range of block; checking it on next sync", "block", id, "err", err)
+				f.checks.WithLabelValues("failure").Inc()
+				continue
+			}
+		}
+		if f.checked[id] == nil {
+			continue
+		}
+		skipped++
+		synced.WithLabelValues(timeRangeMismatchMeta).Inc()
+		delete(metas, id)
+	}
+	if f.skipped != nil {
+		f.skipped.Set(float64(skipped))
+	}
+	return nil
+}
+
+// check checks the block and handles a mismatch with the configured action, remembering the mismatch, if any. Nothing is
+// remembered if checking or handling the mismatch failed, so it is retried on next check.
+func (f *TimeRangeFilter) check(ctx context.Context, m *metadata.Meta) error {
+	// Repaired blocks are removed by deletion delay, during which they must not be checked and repaired again.
+	if f.action == TimeRangeRepair {
+		repairedID, done, err := f.repaired(ctx, m.ULID)
+		if err != nil {
+			return err
+		}
+		if done {
+			if err := f.markRepaired(ctx, m, repairedID); err != nil {
+				return err
+			}
+			f.checked[m.ULID] = errors.Errorf("repaired as block %s", repairedID)
+			return nil
+		}
+	}
+
+	report, err := f.checkIndex(ctx, m, f.sampleEvery)
+	if err != nil {
+		return err
+	}
+	if report.OK() {
+		f.checks.WithLabelValues("match").Inc()
+		f.checked[m.ULID] = nil
+		return nil
+	}
+	f.checks.WithLabelValues("mismatch").Inc()
+	mismatch := report.Err()
+
+	action := f.action
+	if action == TimeRangeRepair {
+		if ok, err := f.gate.allow(ctx, m, RepairedDeletionReason); err != nil {
+			return err
+		} else if !ok {
+			level.Warn(f.logger).Log("msg", "deletion policy denied deletion of block with mismatching time range; skipping it instead of repairing it", "block", m.ULID)
+			action = TimeRangeSkip
+		}
+	}
+	level.Warn(f.logger).Log("msg", "block has chunks outside of the time range of its meta", "block", m.ULID, "action", action, "err", mismatch)
+	if f.dryRun && action != TimeRangeSkip {
+		level.Warn(f.logger).Log("msg", "dry run: would handle block with mismatching time range", "block", m.ULID, "action", action)
+		action = TimeRangeSkip
+	}
+
+	switch action {
+	case TimeRangeRepair:
+		// The time range of the copy has to cover all chunks, not only the sampled ones.
+		if report.Sampled {
+			if report, err = f.checkIndex(ctx, m, 1); err != nil {
+				return err
+			}
+		}
+		repairedID, err := f.repair(ctx, m, report)
+		if err != nil {
+			return errors.Wrapf(err, "repair block %s", m.ULID)
+		}
+		mismatch = errors.Wrapf(mismatch, "repaired as block %s", repairedID)
+	case TimeRangeQuarantine:
+		reason := fmt.Sprintf("%s: %v", QuarantineTimeRangeHoldReason, mismatch)
+		if err := block.PlaceHold(ctx, f.logger, f.bkt, m.ULID, reason); err != nil {
+			return errors.Wrapf(err, "quarantine block %s", m.ULID)
+		}
+	}
+	f.mismatches.WithLabelValues(string(action)).Inc()
+	f.checked[m.ULID] = mismatch
+	return nil
+}
+
+// checkIndex downloads the index of the block and checks every sampleEvery-th series against the meta.
+func (f *TimeRangeFilter) checkIndex(ctx context.Context, m *metadata.Meta, sampleEvery int) (block.IndexTimeRangeReport, error) {
+	fn := filepath.Join(f.dir, m.ULID.String(), block.IndexFilename)
+	defer func() {
+		if err := os.RemoveAll(filepath.Join(f.dir, m.ULID.String())); err != nil {
+			level.Warn(f.logger).Log("msg", "failed to remove downloaded index", "block", m.ULID, "err", err)
+		}
+	}()
+	if err := os.MkdirAll(filepath.Dir(fn), os.ModePerm); err != nil {
+		return block.IndexTimeRangeReport{}, errors.Wrap(err, "create dir")
+	}
+	if err := objstore.DownloadFile(ctx, f.logger, f.bkt, path.Join(m.ULID.String(), block.IndexFilename), fn); err != nil {
+		return block.IndexTimeRangeReport{}, errors.Wrapf(err, "download index of block %s", m.ULID)
+	}
+	return block.CheckIndexTimeRange(fn, m.MinTime, m.MaxTime, sampleEvery)
+}
+
+// repairedID returns the ID of the repaired copy of the given block. It is derived from the ID of the block, so a block
+// is repaired only once, also across restarts.
+func repairedID(id ulid.ULID) (ulid.ULID, error) {
+	h := sha256.Sum256(append([]byte("time-range-repair:"), id[:]...))
+	return ulid.New(id.Time(), bytes.NewReader(h[:]))
+}
+
+// repaired returns the ID of the repaired copy of the given block and whether it was uploaded already.
+func (f *TimeRangeFilter) repaired(ctx context.Context, id ulid.ULID) (ulid.ULID, bool, error) {
+	newID, err := repairedID(id)
+	if err != nil {
+		return ulid.ULID{}, false, err
+	}
+	ok, err := f.bkt.Exists(ctx, path.Join(newID.String(), block.MetaFilename))
+	if err != nil {
+		return ulid.ULID{}, false, errors.Wrapf(err, "check repaired block %s", newID)
+	}
+	return newID, ok, nil
+}
+
+// repair uploads a copy of the block under its repaired ID with the time range of the given report of all its chunks,
+// and marks the block for deletion.
+func (f *TimeRangeFilter) repair(ctx context.Context, m *metadata.Meta, report block.IndexTimeRangeReport) (ulid.ULID, error) {
+	newID, err := repairedID(m.ULID)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	bdir := filepath.Join(f.dir, m.ULID.String())
+	defer func() {
+		for _, dir := range []string{bdir, filepath.Join(f.dir, newID.String())} {
+			if err := os.RemoveAll(dir); err != nil {
+				level.Warn(f.logger).Log("msg", "failed to remove repaired block dir", "dir", dir, "err", err)
+			}
+		}
+	}()
+	if err := block.Download(ctx, f.logger, f.bkt, m.ULID, bdir); err != nil {
+		return ulid.ULID{}, errors.Wrap(err, "download block")
+	}
+	meta, err := metadata.Read(bdir)
+	if err != nil {
+		return ulid.ULID{}, errors.Wrap(err, "read meta")
+	}
+	if report.MinTime < meta.MinTime {
+		meta.MinTime = report.MinTime
+	}
+	if report.MaxTime > meta.MaxTime {
+		meta.MaxTime = report.MaxTime
+	}
+	meta.Thanos.Source = metadata.CompactorRepairSource
+	if err := metadata.Write(f.logger, bdir, meta); err != nil {
+		return ulid.ULID{}, errors.Wrap(err, "write repaired meta")
+	}
+	if err := block.ReidentifyAs(f.logger, f.dir, m.ULID, newID); err != nil {
+		return ulid.ULID{}, err
+	}
+	level.Info(f.logger).Log("msg", "uploading block with repaired time range", "block", m.ULID, "newID", newID, "mint", meta.MinTime, "maxt", meta.MaxTime)
+	if err := block.Upload(ctx, f.logger, f.bkt, filepath.Join(f.dir, newID.String())); err != nil {
+		return ulid.ULID{}, errors.Wrapf(err, "upload repaired block %s", newID)
+	}
+	return newID, f.markRepaired(ctx, m, newID)
+}
+
+// markRepaired marks the block repaired as the given block for deletion, unless it is already marked.
+func (f *TimeRangeFilter) markRepaired(ctx context.Context, m *metadata.Meta, repairedID ulid.ULID) error {
+	ok, err := f.bkt.Exists(ctx, path.Join(m.ULID.String(), metadata.DeletionMarkFilename))
+	if err != nil || ok {
+		return errors.Wrapf(err, "check deletion mark of block %s", m.ULID)
+	}
+	level.Info(f.logger).Log("msg", "marking block with mismatching time range for deletion", "block", m.ULID, "repaired", repairedID)
+	return block.MarkForDeletionWithReason(ctx, f.logger, f.bkt, m.ULID, RepairedDeletionReason, f.blocksMarkedForDeletion)
+}
@@ -0,0 +1,150 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestTimeRangeFilter(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	dir, err := ioutil.TempDir("", "time-range-filter")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	series := []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "2"), labels.FromStrings("a", "3")}
+	// upload uploads blocks spanning [0, 1000) with the given meta time range.
+	upload := func(bkt objstore.Bucket, mint, maxt int64) ulid.ULID {
+		id, err := e2eutil.CreateBlock(ctx, dir, series, 100, 0, 1000, labels.Labels{{Name: "e", Value: "1"}}, 0)
+		testutil.Ok(t, err)
+		bdir := filepath.Join(dir, id.String())
+		meta, err := metadata.Read(bdir)
+		testutil.Ok(t, err)
+		meta.MinTime, meta.MaxTime = mint, maxt
+		testutil.Ok(t, metadata.Write(logger, bdir, meta))
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, bdir))
+		return id
+	}
+	fetch := func(bkt objstore.InstrumentedBucket, f *TimeRangeFilter) map[ulid.ULID]*metadata.Meta {
+		ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, bkt, 0)
+		fetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, []block.MetadataFilter{ignoreDeletionMarkFilter, f, block.NewHoldMarkFilter(logger, bkt)}, nil)
+		testutil.Ok(t, err)
+		metas, _, err := fetcher.Fetch(ctx)
+		testutil.Ok(t, err)
+		return metas
+	}
+
+	_, err = NewTimeRangeFilter(logger, nil, nil, dir, TimeRangeSkip, 0, nil, nil, false)
+	testutil.NotOk(t, err)
+
+	t.Run("skip", func(t *testing.T) {
+		bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+		valid, invalid := upload(bkt, 0, 1000), upload(bkt, 0, 500)
+
+		f, err := NewTimeRangeFilter(logger, prometheus.NewRegistry(), bkt, filepath.Join(dir, "check"), TimeRangeSkip, 0.5, nil, nil, false)
+		testutil.Ok(t, err)
+		for i := 0; i < 2; i++ {
+			metas := fetch(bkt, f)
+			testutil.Equals(t, 1, len(metas))
+			testutil.Assert(t, metas[valid] != nil, "valid block filtered out")
+		}
+		_, invalidChecked := f.checked[invalid]
+		testutil.Assert(t, invalidChecked, "expected mismatch remembered")
+		// Blocks are checked only once.
+		testutil.Equals(t, 1.0, promtest.ToFloat64(f.checks.WithLabelValues("match")))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(f.checks.WithLabelValues("mismatch")))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(f.skipped))
+		_, err = metadata.ReadHoldMark(ctx, bkt, logger, invalid.String())
+		testutil.Equals(t, metadata.ErrorHoldMarkNotFound, err)
+	})
+
+	t.Run("all shards", func(t *testing.T) {
+		bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+		valid, invalid := upload(bkt, 0, 1000), upload(bkt, 0, 500)
+
+		f, err := NewTimeRangeFilter(logger, prometheus.NewRegistry(), bkt, filepath.Join(dir, "check"), TimeRangeSkip, 1, nil, nil, false)
+		testutil.Ok(t, err)
+		all := f.ForAllShards()
+		testutil.Equals(t, 1, len(fetch(bkt, all)))
+		testutil.Equals(t, 1, len(fetch(bkt, f)))
+		// Results of checks are shared.
+		testutil.Equals(t, 1.0, promtest.ToFloat64(f.checks.WithLabelValues("match")))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(f.checks.WithLabelValues("mismatch")))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(f.skipped))
+
+		// Blocks not seen by the filter of the own shard might be blocks of other shards, so only the other one forgets them.
+		metas := fetch(bkt, f)
+		delete(metas, invalid)
+		testutil.Ok(t, f.Filter(ctx, metas, nil))
+		_, ok := f.checked[invalid]
+		testutil.Assert(t, ok, "expected mismatch remembered")
+		testutil.Ok(t, all.Filter(ctx, metas, nil))
+		_, ok = f.checked[invalid]
+		testutil.Assert(t, !ok, "expected mismatch forgotten")
+		testutil.Assert(t, metas[valid] != nil, "valid block filtered out")
+	})
+
+	t.Run("quarantine", func(t *testing.T) {
+		bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+		invalid := upload(bkt, 500, 1000)
+
+		f, err := NewTimeRangeFilter(logger, nil, bkt, filepath.Join(dir, "check"), TimeRangeQuarantine, 1, nil, nil, false)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0, len(fetch(bkt, f)))
+		m, err := metadata.ReadHoldMark(ctx, bkt, logger, invalid.String())
+		testutil.Ok(t, err)
+		testutil.Assert(t, strings.HasPrefix(m.Reason, QuarantineTimeRangeHoldReason), "unexpected reason %q", m.Reason)
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+		invalid := upload(bkt, 0, 500)
+		marked := prometheus.NewCounter(prometheus.CounterOpts{})
+
+		f, err := NewTimeRangeFilter(logger, nil, bkt, filepath.Join(dir, "check"), TimeRangeRepair, 0.5, nil, marked, false)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0, len(fetch(bkt, f)))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(marked))
+
+		repaired, err := repairedID(invalid)
+		testutil.Ok(t, err)
+		meta, err := block.DownloadMeta(ctx, logger, bkt, repaired)
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(0), meta.MinTime)
+		// The last of 100 samples spread over [0, 1000) is at 891.
+		testutil.Equals(t, int64(892), meta.MaxTime)
+		testutil.Equals(t, metadata.CompactorRepairSource, meta.Thanos.Source)
+		testutil.Equals(t, []ulid.ULID{invalid}, meta.Compaction.Sources)
+
+		// The repaired block is synced from the next sync on, while the broken one is not repaired again after restarts.
+		f, err = NewTimeRangeFilter(logger, nil, bkt, filepath.Join(dir, "check"), TimeRangeRepair, 1, nil, marked, false)
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Delete(ctx, path.Join(invalid.String(), metadata.DeletionMarkFilename)))
+		metas := fetch(bkt, f)
+		testutil.Equals(t, 1, len(metas))
+		testutil.Assert(t, metas[repaired] != nil, "repaired block filtered out")
+		testutil.Equals(t, 2.0, promtest.ToFloat64(marked))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(f.checks.WithLabelValues("match")))
+		testutil.Equals(t, 0.0, promtest.ToFloat64(f.checks.WithLabelValues("mismatch")))
+	})
+}
@@ -0,0 +1,94 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// GroupResourceMetrics exposes resources consumed by compactions of each group, e.g. for chargeback or showback of
+// tenants sharing a bucket.
+type GroupResourceMetrics struct {
+	cpuSeconds      *prometheus.CounterVec
+	downloadedBytes *prometheus.CounterVec
+	uploadedBytes   *prometheus.CounterVec
+	peakDiskBytes   *prometheus.GaugeVec
+}
+
+// NewGroupResourceMetrics returns GroupResourceMetrics registered in the given registerer.
+func NewGroupResourceMetrics(reg prometheus.Registerer) *GroupResourceMetrics {
+	return &GroupResourceMetrics{
+		cpuSeconds: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_group_cpu_seconds_total",
+			Help: "Total CPU time spent by compactions of the group, including download, verification and upload of blocks. " +
+				"CPU time of background work like garbage collection is not attributed. Only measured on Linux.",
+		}, []string{"group_id"}),
+		downloadedBytes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_group_downloaded_bytes_total",
+			Help: "Total size of source blocks downloaded by compactions of the group.",
+		}, []string{"group_id"}),
+		uploadedBytes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_group_uploaded_bytes_total",
+			Help: "Total size of blocks uploaded by compactions of the group.",
+		}, []string{"group_id"}),
+		peakDiskBytes: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_group_peak_disk_bytes",
+			Help: "Disk space taken in the work directory by the last compaction of the group, once source blocks were downloaded and compacted.",
+		}, []string{"group_id"}),
+	}
+}
+
+// groupResourceUsage measures resources consumed by a single compaction of a group.
+type groupResourceUsage struct {
+	m     *GroupResourceMetrics
+	group string
+	stats *groupRunStats
+
+	cpuBegin          time.Duration
+	cpuErr            error
+	bytesIn, bytesOut int64
+}
+
+// track starts measuring a compaction of the group with the given key, whose transfers are accounted in the given
+// stats, until the returned usage ends. The calling goroutine is locked to its OS thread meanwhile, so CPU time of the
+// thread is the CPU time of the compaction. It returns nil, which is a no-op usage, if m is nil.
+func (m *GroupResourceMetrics) track(group string, stats *groupRunStats) *groupResourceUsage {
+	if m == nil {
+		return nil
+	}
+	runtime.LockOSThread()
+	u := &groupResourceUsage{m: m, group: group, stats: stats, bytesIn: stats.bytesIn, bytesOut: stats.bytesOut}
+	u.cpuBegin, u.cpuErr = threadCPUTime()
+	return u
+}
+
+// observeDisk records the disk space taken by the compaction, at its peak.
+func (u *groupResourceUsage) observeDisk(dir string) {
+	if u == nil {
+		return
+	}
+	if size, err := dirSize(dir); err == nil {
+		u.m.peakDiskBytes.WithLabelValues(u.group).Set(float64(size))
+	}
+}
+
+// end records resources consumed by the compaction since track.
+func (u *groupResourceUsage) end() {
+	if u == nil {
+		return
+	}
+	if u.cpuErr == nil {
+		if cpu, err := threadCPUTime(); err == nil {
+			u.m.cpuSeconds.WithLabelValues(u.group).Add((cpu - u.cpuBegin).Seconds())
+		}
+	}
+	runtime.UnlockOSThread()
+
+	u.m.downloadedBytes.WithLabelValues(u.group).Add(float64(u.stats.bytesIn - u.bytesIn))
+	u.m.uploadedBytes.WithLabelValues(u.group).Add(float64(u.stats.bytesOut - u.bytesOut))
+}
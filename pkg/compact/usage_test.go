@@ -0,0 +1,54 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestGroupResourceMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-group-resource-usage")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(dir, "chunk"), make([]byte, 1000), os.ModePerm))
+
+	m := NewGroupResourceMetrics(prometheus.NewRegistry())
+	stats := groupRunStats{bytesIn: 100, bytesOut: 10}
+
+	for i := 0; i < 2; i++ {
+		u := m.track("group", &stats)
+		// Burn some CPU to be measured.
+		x := 0
+		for j := 0; j < 10000000; j++ {
+			x += j % 7
+		}
+		testutil.Assert(t, x > 0, "")
+		stats.bytesIn += 50
+		stats.bytesOut += 20
+		u.observeDisk(dir)
+		u.end()
+	}
+
+	testutil.Equals(t, 100.0, promtest.ToFloat64(m.downloadedBytes.WithLabelValues("group")))
+	testutil.Equals(t, 40.0, promtest.ToFloat64(m.uploadedBytes.WithLabelValues("group")))
+	testutil.Equals(t, 1000.0, promtest.ToFloat64(m.peakDiskBytes.WithLabelValues("group")))
+	if runtime.GOOS == "linux" {
+		testutil.Assert(t, promtest.ToFloat64(m.cpuSeconds.WithLabelValues("group")) > 0, "no CPU time attributed")
+	}
+
+	// Usage of nil metrics is a no-op.
+	var nilMetrics *GroupResourceMetrics
+	u := nilMetrics.track("group", &stats)
+	u.observeDisk(dir)
+	u.end()
+}
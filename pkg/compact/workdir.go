@@ -0,0 +1,107 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"os"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	terrors "github.com/prometheus/prometheus/tsdb/errors"
+)
+
+// workDirs manages compaction work directories, possibly located on different volumes. The directories are owned by the
+// compactor, which removes them with all their content.
+type workDirs struct {
+	logger    log.Logger
+	dirs      []string
+	freeBytes func(dir string) (uint64, error)
+
+	mtx sync.Mutex
+	// reserved is disk space of each directory reserved by group compactions placed in it and still running.
+	reserved map[string]uint64
+
+	freeBytesGauge *prometheus.GaugeVec
+	groupsPlaced   *prometheus.CounterVec
+}
+
+func newWorkDirs(logger log.Logger, reg prometheus.Registerer, dirs []string) *workDirs {
+	w := &workDirs{
+		logger:    logger,
+		dirs:      dirs,
+		freeBytes: freeBytes,
+		reserved:  map[string]uint64{},
+		freeBytesGauge: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_work_dir_free_bytes",
+			Help: "Free space in bytes of the volume of the compaction work directory, as seen when a group was last placed.",
+		}, []string{"dir"}),
+		groupsPlaced: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_work_dir_groups_placed_total",
+			Help: "Total number of group compactions placed in the compaction work directory.",
+		}, []string{"dir"}),
+	}
+	for _, dir := range dirs {
+		w.groupsPlaced.WithLabelValues(dir)
+	}
+	return w
+}
+
+// pick returns the work directory with the most free space not reserved by groups placed before and still running, and
+// reserves the given bytes in it until the returned function is called. If free space cannot be determined for any
+// directory, the first one is returned.
+func (w *workDirs) pick(reserve uint64) (string, func()) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	best, bestFree := w.dirs[0], uint64(0)
+	for _, dir := range w.dirs {
+		free, err := w.free(dir)
+		if err != nil {
+			level.Debug(w.logger).Log("msg", "failed to determine free space of compaction work directory", "dir", dir, "err", err)
+			continue
+		}
+		w.freeBytesGauge.WithLabelValues(dir).Set(float64(free))
+		if r := w.reserved[dir]; r < free {
+			free -= r
+		} else {
+			free = 0
+		}
+		if free > bestFree {
+			best, bestFree = dir, free
+		}
+	}
+	w.groupsPlaced.WithLabelValues(best).Inc()
+	w.reserved[best] += reserve
+
+	var once sync.Once
+	return best, func() {
+		once.Do(func() {
+			w.mtx.Lock()
+			defer w.mtx.Unlock()
+			w.reserved[best] -= reserve
+		})
+	}
+}
+
+func (w *workDirs) free(dir string) (uint64, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return 0, errors.Wrap(err, "create work dir")
+	}
+	return w.freeBytes(dir)
+}
+
+// removeAll removes all work directories.
+func (w *workDirs) removeAll() error {
+	var errs terrors.MultiError
+	for _, dir := range w.dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			errs.Add(errors.Wrapf(err, "remove %s", dir))
+		}
+	}
+	return errs.Err()
+}
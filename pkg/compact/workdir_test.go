@@ -0,0 +1,66 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestWorkDirs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-work-dirs")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	dirA, dirB, dirC := filepath.Join(tmpDir, "a"), filepath.Join(tmpDir, "b"), filepath.Join(tmpDir, "c")
+	free := map[string]uint64{dirA: 10, dirB: 20}
+
+	w := newWorkDirs(log.NewNopLogger(), prometheus.NewRegistry(), []string{dirA, dirB, dirC})
+	w.freeBytes = func(dir string) (uint64, error) {
+		f, ok := free[dir]
+		if !ok {
+			return 0, errors.New("unknown volume")
+		}
+		return f, nil
+	}
+
+	pick := func(reserve uint64) string {
+		dir, release := w.pick(reserve)
+		release()
+		return dir
+	}
+	testutil.Equals(t, dirB, pick(0))
+	free[dirA] = 30
+	testutil.Equals(t, dirA, pick(0))
+
+	// Space reserved by groups still running is not free for next groups.
+	dir, release := w.pick(25)
+	testutil.Equals(t, dirA, dir)
+	testutil.Equals(t, dirB, pick(0))
+	release()
+	release()
+	testutil.Equals(t, dirA, pick(0))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(w.groupsPlaced.WithLabelValues(dirB)))
+	testutil.Equals(t, 30.0, promtest.ToFloat64(w.freeBytesGauge.WithLabelValues(dirA)))
+
+	// Directories are created when picking.
+	for _, dir := range []string{dirA, dirB, dirC} {
+		_, err := os.Stat(dir)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, w.removeAll())
+	for _, dir := range []string{dirA, dirB, dirC} {
+		_, err := os.Stat(dir)
+		testutil.Assert(t, os.IsNotExist(err), "expected %s to be removed", dir)
+	}
+}
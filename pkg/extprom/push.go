@@ -0,0 +1,27 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extprom
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// PushMetrics pushes all metrics of the given gatherer to the Pushgateway compatible endpoint at the given URL, replacing
+// metrics pushed before with the same job and grouping labels. It is meant for short-lived runs, which are likely to
+// exit before being scraped.
+func PushMetrics(url, job string, grouping map[string]string, g prometheus.Gatherer, timeout time.Duration) error {
+	p := push.New(url, job).Gatherer(g).Client(&http.Client{Timeout: timeout})
+	for name, value := range grouping {
+		p = p.Grouping(name, value)
+	}
+	if err := p.Push(); err != nil {
+		return errors.Wrapf(err, "push metrics to %s", url)
+	}
+	return nil
+}
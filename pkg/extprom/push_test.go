@@ -0,0 +1,42 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extprom
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestPushMetrics(t *testing.T) {
+	var (
+		method, path string
+		body         []byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	promauto.With(reg).NewCounter(prometheus.CounterOpts{Name: "test_runs_total", Help: "Test."}).Inc()
+
+	testutil.Ok(t, PushMetrics(srv.URL, "thanos-compact", map[string]string{"shard": "0"}, reg, time.Minute))
+	testutil.Equals(t, http.MethodPut, method)
+	testutil.Equals(t, "/metrics/job/thanos-compact/shard/0", path)
+	testutil.Assert(t, strings.Contains(string(body), "test_runs_total"), "pushed metrics miss counter")
+
+	srv.Close()
+	testutil.NotOk(t, PushMetrics(srv.URL, "thanos-compact", nil, reg, time.Minute))
+}
@@ -0,0 +1,210 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"path"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// CapabilityProbeDir is the directory in the root of the bucket holding objects written by DiscoverCapabilities. They are
+// deleted once probed.
+const CapabilityProbeDir = "capability-probe"
+
+// Copier is implemented by buckets that are able to copy objects within the bucket without transferring their content
+// through the client. Like ConditionalUploader, support is probed with SupportsServerSideCopy.
+type Copier interface {
+	// SupportsServerSideCopy returns true if Copy is supported.
+	SupportsServerSideCopy() bool
+
+	// Copy copies the object src into the object dst, replacing it if it exists.
+	Copy(ctx context.Context, src, dst string) error
+}
+
+// BatchDeleter is implemented by buckets that are able to delete multiple objects with a single request. Like
+// ConditionalUploader, support is probed with SupportsBatchDelete.
+type BatchDeleter interface {
+	// SupportsBatchDelete returns true if DeleteObjects is supported.
+	SupportsBatchDelete() bool
+
+	// DeleteObjects deletes the given objects. Objects that do not exist are ignored.
+	DeleteObjects(ctx context.Context, names []string) error
+}
+
+// SupportsServerSideCopy returns true if the given bucket is able to copy objects without transferring their content.
+func SupportsServerSideCopy(bkt Bucket) bool {
+	c, ok := bkt.(Copier)
+	return ok && c.SupportsServerSideCopy()
+}
+
+// SupportsBatchDelete returns true if the given bucket is able to delete multiple objects with a single request.
+func SupportsBatchDelete(bkt Bucket) bool {
+	d, ok := bkt.(BatchDeleter)
+	return ok && d.SupportsBatchDelete()
+}
+
+// copyObject delegates Copy of a wrapping bucket to the wrapped one.
+func copyObject(ctx context.Context, bkt Bucket, src, dst string) error {
+	if !SupportsServerSideCopy(bkt) {
+		return errors.Errorf("bucket %s does not support server side copy", bkt.Name())
+	}
+	return bkt.(Copier).Copy(ctx, src, dst)
+}
+
+// deleteObjects delegates DeleteObjects of a wrapping bucket to the wrapped one.
+func deleteObjects(ctx context.Context, bkt Bucket, names []string) error {
+	if !SupportsBatchDelete(bkt) {
+		return errors.Errorf("bucket %s does not support batch delete", bkt.Name())
+	}
+	return bkt.(BatchDeleter).DeleteObjects(ctx, names)
+}
+
+// Copy copies the object src into the object dst of the bucket. Buckets supporting server side copy do it without
+// transferring the content, otherwise the object is downloaded and uploaded again.
+func Copy(ctx context.Context, bkt Bucket, src, dst string) error {
+	if SupportsServerSideCopy(bkt) {
+		return bkt.(Copier).Copy(ctx, src, dst)
+	}
+
+	rc, err := bkt.Get(ctx, src)
+	if err != nil {
+		return errors.Wrapf(err, "get %s", src)
+	}
+	defer func() { _ = rc.Close() }()
+
+	if err := bkt.Upload(ctx, dst, rc); err != nil {
+		return errors.Wrapf(err, "upload %s", dst)
+	}
+	return nil
+}
+
+// DeleteObjects deletes the given objects from the bucket, ignoring objects that do not exist. Buckets supporting batch
+// delete do it with a single request, otherwise objects are deleted one by one.
+func DeleteObjects(ctx context.Context, bkt Bucket, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	if SupportsBatchDelete(bkt) {
+		return bkt.(BatchDeleter).DeleteObjects(ctx, names)
+	}
+	for _, name := range names {
+		if err := bkt.Delete(ctx, name); err != nil && !bkt.IsObjNotFoundErr(err) {
+			return errors.Wrapf(err, "delete %s", name)
+		}
+	}
+	return nil
+}
+
+// Capabilities are optional features of a bucket's provider, so callers can pick the optimal way of doing things instead
+// of the one working with all providers.
+type Capabilities struct {
+	// RangeGet is true if GetRange returns only the requested range. Some S3 compatible providers ignore ranges and
+	// return whole objects.
+	RangeGet bool
+	// ConditionalUpload is true if objects can be uploaded only if they do not exist yet (see ConditionalUploader).
+	ConditionalUpload bool
+	// BatchDelete is true if multiple objects can be deleted with a single request (see BatchDeleter).
+	BatchDelete bool
+	// ServerSideCopy is true if objects can be copied without transferring their content (see Copier).
+	ServerSideCopy bool
+	// ConsistentListing is true if listing reflects uploads and deletions right away.
+	ConsistentListing bool
+
+	// Probed is true if RangeGet and ConsistentListing were probed, as they cannot be told from the bucket client.
+	Probed bool
+}
+
+// Map returns all capabilities by name.
+func (c Capabilities) Map() map[string]bool {
+	return map[string]bool{
+		"range_get":          c.RangeGet,
+		"conditional_upload": c.ConditionalUpload,
+		"batch_delete":       c.BatchDelete,
+		"server_side_copy":   c.ServerSideCopy,
+		"consistent_listing": c.ConsistentListing,
+	}
+}
+
+// DiscoverCapabilities returns capabilities of the given bucket. Capabilities implemented by the bucket client are
+// reported as is. If probe is true, the others are probed by writing, reading, listing and deleting an object in
+// CapabilityProbeDir, otherwise they are assumed to be missing.
+func DiscoverCapabilities(ctx context.Context, logger log.Logger, bkt Bucket, probe bool) (Capabilities, error) {
+	c := Capabilities{
+		ConditionalUpload: SupportsConditionalUpload(bkt),
+		BatchDelete:       SupportsBatchDelete(bkt),
+		ServerSideCopy:    SupportsServerSideCopy(bkt),
+	}
+	if !probe {
+		return c, nil
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return c, errors.Wrap(err, "generate probe name")
+	}
+	dir := path.Join(CapabilityProbeDir, hex.EncodeToString(id))
+	name := path.Join(dir, "probe")
+	content := []byte("thanos capability probe")
+
+	if err := bkt.Upload(ctx, name, bytes.NewReader(content)); err != nil {
+		return c, errors.Wrapf(err, "upload probe %s", name)
+	}
+	deleted := false
+	defer func() {
+		if deleted {
+			return
+		}
+		if err := bkt.Delete(ctx, name); err != nil {
+			level.Warn(logger).Log("msg", "failed to delete capability probe", "name", name, "err", err)
+		}
+	}()
+
+	rc, err := bkt.GetRange(ctx, name, 2, 3)
+	if err != nil {
+		return c, errors.Wrapf(err, "get range of probe %s", name)
+	}
+	got, err := ioutil.ReadAll(io.LimitReader(rc, int64(len(content))+1))
+	_ = rc.Close()
+	if err != nil {
+		return c, errors.Wrapf(err, "read range of probe %s", name)
+	}
+	c.RangeGet = bytes.Equal(got, content[2:5])
+
+	listed, err := lists(ctx, bkt, dir, name)
+	if err != nil {
+		return c, err
+	}
+	if err := bkt.Delete(ctx, name); err != nil {
+		return c, errors.Wrapf(err, "delete probe %s", name)
+	}
+	deleted = true
+	stillListed, err := lists(ctx, bkt, dir, name)
+	if err != nil {
+		return c, err
+	}
+	c.ConsistentListing = listed && !stillListed
+	c.Probed = true
+	return c, nil
+}
+
+// lists returns true if listing of dir contains the given object.
+func lists(ctx context.Context, bkt Bucket, dir, name string) (bool, error) {
+	found := false
+	if err := bkt.Iter(ctx, dir, func(n string) error {
+		found = found || n == name
+		return nil
+	}); err != nil {
+		return false, errors.Wrapf(err, "list %s", dir)
+	}
+	return found, nil
+}
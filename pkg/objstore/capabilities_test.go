@@ -0,0 +1,64 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// basicBucket hides optional capabilities of the wrapped bucket.
+type basicBucket struct {
+	Bucket
+}
+
+func TestDiscoverCapabilities(t *testing.T) {
+	ctx := context.Background()
+	bkt := NewInMemBucket()
+
+	c, err := DiscoverCapabilities(ctx, log.NewNopLogger(), bkt, false)
+	testutil.Ok(t, err)
+	testutil.Equals(t, Capabilities{ConditionalUpload: true, BatchDelete: true, ServerSideCopy: true}, c)
+
+	c, err = DiscoverCapabilities(ctx, log.NewNopLogger(), WithNoopInstr(bkt), true)
+	testutil.Ok(t, err)
+	testutil.Equals(t, Capabilities{RangeGet: true, ConditionalUpload: true, BatchDelete: true, ServerSideCopy: true, ConsistentListing: true, Probed: true}, c)
+	// Probe objects are cleaned up.
+	testutil.Equals(t, 0, len(bkt.Objects()))
+
+	c, err = DiscoverCapabilities(ctx, log.NewNopLogger(), basicBucket{bkt}, false)
+	testutil.Ok(t, err)
+	testutil.Equals(t, Capabilities{}, c)
+}
+
+func TestCopyAndDeleteObjects(t *testing.T) {
+	ctx := context.Background()
+
+	for _, bkt := range []Bucket{WithNoopInstr(NewInMemBucket()), basicBucket{NewInMemBucket()}} {
+		testutil.Ok(t, bkt.Upload(ctx, "a/1", strings.NewReader("content")))
+		testutil.Ok(t, Copy(ctx, bkt, "a/1", "b/1"))
+
+		rc, err := bkt.Get(ctx, "b/1")
+		testutil.Ok(t, err)
+		got, err := ioutil.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		testutil.Assert(t, bytes.Equal([]byte("content"), got), "unexpected content %q", got)
+
+		// Missing objects are ignored.
+		testutil.Ok(t, DeleteObjects(ctx, bkt, []string{"a/1", "b/1", "c/1"}))
+		for _, name := range []string{"a/1", "b/1"} {
+			exists, err := bkt.Exists(ctx, name)
+			testutil.Ok(t, err)
+			testutil.Assert(t, !exists, "%s not deleted", name)
+		}
+	}
+}
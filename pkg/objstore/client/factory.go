@@ -7,11 +7,13 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/azure"
 	"github.com/thanos-io/thanos/pkg/objstore/cos"
@@ -38,6 +40,36 @@ const (
 type BucketConfig struct {
 	Type   ObjProvider `yaml:"type"`
 	Config interface{} `yaml:"config"`
+	// ListingConsistencyDelay, if non-zero, makes listings stable on object storages with eventual list-after-write
+	// consistency, by listing twice the delay apart. See objstore.StableListingBucket.
+	ListingConsistencyDelay model.Duration `yaml:"listing_consistency_delay,omitempty"`
+	// BlockPathScheme, if set, places blocks under prefix directories instead of the root of the bucket. See
+	// objstore.BlockLayoutBucket.
+	BlockPathScheme *BlockPathSchemeConfig `yaml:"block_path_scheme,omitempty"`
+}
+
+type BlockPathSchemeType string
+
+const (
+	HASHED BlockPathSchemeType = "HASHED"
+)
+
+// BlockPathSchemeConfig configures the objstore.BlockPathScheme of blocks.
+type BlockPathSchemeConfig struct {
+	Type BlockPathSchemeType `yaml:"type"`
+	// Levels and Width are the number of levels of prefix directories and the length of their names.
+	Levels int `yaml:"levels"`
+	Width  int `yaml:"width"`
+}
+
+// newBlockPathScheme returns the objstore.BlockPathScheme of the given configuration.
+func newBlockPathScheme(conf *BlockPathSchemeConfig) (objstore.BlockPathScheme, error) {
+	switch strings.ToUpper(string(conf.Type)) {
+	case string(HASHED):
+		return objstore.NewHashedBlockPathScheme(conf.Levels, conf.Width)
+	default:
+		return nil, errors.Errorf("block path scheme with type %s is not supported", conf.Type)
+	}
 }
 
 // NewBucket initializes and returns new object storage clients.
@@ -76,5 +108,15 @@ func NewBucket(logger log.Logger, confContentYaml []byte, reg prometheus.Registe
 	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("create %s client", bucketConf.Type))
 	}
+	if bucketConf.ListingConsistencyDelay > 0 {
+		bucket = objstore.NewStableListingBucket(bucket, time.Duration(bucketConf.ListingConsistencyDelay))
+	}
+	if bucketConf.BlockPathScheme != nil {
+		scheme, err := newBlockPathScheme(bucketConf.BlockPathScheme)
+		if err != nil {
+			return nil, errors.Wrap(err, "create block path scheme")
+		}
+		bucket = objstore.NewBlockLayoutBucket(logger, bucket, scheme)
+	}
 	return objstore.NewTracingBucket(objstore.BucketWithMetrics(bucket.Name(), bucket, reg)), nil
 }
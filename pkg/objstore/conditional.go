@@ -0,0 +1,84 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// ErrObjectExists is returned by conditional uploads if the object already exists.
+var ErrObjectExists = errors.New("object already exists")
+
+// ConditionalUploader is implemented by buckets that are able to upload an object only if it does not exist yet.
+// Wrapping buckets implement it by delegating to the wrapped bucket, so support is probed with
+// SupportsConditionalUpload rather than by type assertion.
+type ConditionalUploader interface {
+	// SupportsConditionalUpload returns true if UploadIfNotExists is supported.
+	SupportsConditionalUpload() bool
+
+	// UploadIfNotExists atomically uploads the contents of the reader as an object into the bucket, unless the object
+	// already exists, in which case ErrObjectExists is returned.
+	UploadIfNotExists(ctx context.Context, name string, r io.Reader) error
+}
+
+// SupportsConditionalUpload returns true if the given bucket is able to upload objects only if they do not exist yet.
+func SupportsConditionalUpload(bkt Bucket) bool {
+	cu, ok := bkt.(ConditionalUploader)
+	return ok && cu.SupportsConditionalUpload()
+}
+
+// uploadIfNotExists delegates UploadIfNotExists of a wrapping bucket to the wrapped one.
+func uploadIfNotExists(ctx context.Context, bkt Bucket, name string, r io.Reader) error {
+	if !SupportsConditionalUpload(bkt) {
+		return errors.Errorf("bucket %s does not support conditional uploads", bkt.Name())
+	}
+	return bkt.(ConditionalUploader).UploadIfNotExists(ctx, name, r)
+}
+
+// UploadIfNotExists uploads the given content as an object into the bucket, unless the object already exists, in which
+// case ErrObjectExists is returned. Buckets supporting conditional uploads do it atomically. For other buckets existence
+// is checked before the upload and the object is read back after it, so a concurrent writer of different content is
+// detected by at least one of the writers, though it cannot be prevented from overwriting the object.
+func UploadIfNotExists(ctx context.Context, bkt Bucket, name string, content []byte) error {
+	if SupportsConditionalUpload(bkt) {
+		return bkt.(ConditionalUploader).UploadIfNotExists(ctx, name, bytes.NewReader(content))
+	}
+
+	exists, err := bkt.Exists(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "check exists %s in bucket", name)
+	}
+	if exists {
+		return ErrObjectExists
+	}
+	if err := bkt.Upload(ctx, name, bytes.NewReader(content)); err != nil {
+		return err
+	}
+	// Read after write verification: the object is overwritten by the last of concurrent writers.
+	return VerifyContent(ctx, bkt, name, content)
+}
+
+// VerifyContent returns ErrObjectExists if the object in the bucket has different content than the given one.
+func VerifyContent(ctx context.Context, bkt Bucket, name string, content []byte) error {
+	r, err := bkt.Get(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "get %s from bucket", name)
+	}
+	got, err := ioutil.ReadAll(r)
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "read %s from bucket", name)
+	}
+	if !bytes.Equal(got, content) {
+		return errors.Wrapf(ErrObjectExists, "object %s", name)
+	}
+	return nil
+}
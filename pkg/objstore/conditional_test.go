@@ -0,0 +1,77 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// unconditionalBucket hides conditional uploads of the wrapped bucket. It optionally overwrites uploaded objects with
+// other content, as if a concurrent writer won the race.
+type unconditionalBucket struct {
+	Bucket
+	overwrite []byte
+}
+
+func (b unconditionalBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if b.overwrite != nil {
+		r = bytes.NewReader(b.overwrite)
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestUploadIfNotExists(t *testing.T) {
+	ctx := context.Background()
+	content := func(bkt Bucket, name string) string {
+		r, err := bkt.Get(ctx, name)
+		testutil.Ok(t, err)
+		b, err := ioutil.ReadAll(r)
+		testutil.Ok(t, err)
+		testutil.Ok(t, r.Close())
+		return string(b)
+	}
+
+	for _, tcase := range []struct {
+		name          string
+		bkt           Bucket
+		isConditional bool
+	}{
+		{name: "conditional", bkt: NewInMemBucket(), isConditional: true},
+		{name: "conditional wrapped", bkt: NewTracingBucket(BucketWithMetrics("test", NewInMemBucket(), nil)), isConditional: true},
+		{name: "wrapped with noop instrumentation", bkt: WithNoopInstr(NewInMemBucket()), isConditional: true},
+		{name: "fallback", bkt: WithNoopInstr(unconditionalBucket{Bucket: NewInMemBucket()})},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			testutil.Equals(t, tcase.isConditional, SupportsConditionalUpload(tcase.bkt))
+
+			testutil.Ok(t, UploadIfNotExists(ctx, tcase.bkt, "obj", []byte("a")))
+			testutil.Ok(t, VerifyContent(ctx, tcase.bkt, "obj", []byte("a")))
+
+			for _, c := range []string{"a", "b"} {
+				err := UploadIfNotExists(ctx, tcase.bkt, "obj", []byte(c))
+				testutil.NotOk(t, err)
+				testutil.Equals(t, ErrObjectExists, errors.Cause(err))
+			}
+			testutil.Equals(t, "a", content(tcase.bkt, "obj"))
+			testutil.Equals(t, ErrObjectExists, errors.Cause(VerifyContent(ctx, tcase.bkt, "obj", []byte("b"))))
+		})
+	}
+
+	// Concurrent writer overwriting the object is detected by reading it back.
+	bkt := unconditionalBucket{Bucket: NewInMemBucket(), overwrite: []byte("other")}
+	err := UploadIfNotExists(ctx, bkt, "obj", []byte("a"))
+	testutil.NotOk(t, err)
+	testutil.Equals(t, ErrObjectExists, errors.Cause(err))
+
+	// Wrappers of buckets without conditional uploads do not pretend to support them.
+	testutil.NotOk(t, WithNoopInstr(unconditionalBucket{Bucket: NewInMemBucket()}).(ConditionalUploader).UploadIfNotExists(ctx, "obj", bytes.NewReader(nil)))
+}
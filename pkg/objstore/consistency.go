@@ -0,0 +1,126 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StableListingBucket is a Bucket giving stable listings on object storages with eventual list-after-write consistency,
+// as long as objects become listable, and stop being listed once deleted, within the configured delay.
+// Each directory is listed twice, the delay apart. Entries of the second listing are listed, as are entries of the
+// first listing only that still exist, which reads are strongly consistent about. Deleted objects lingering in both
+// listings are not detected, so the delay should exceed the time the storage takes to converge.
+type StableListingBucket struct {
+	Bucket
+
+	delay time.Duration
+}
+
+// NewStableListingBucket returns StableListingBucket wrapping the given bucket. Listing of a directory waits for the
+// given delay.
+func NewStableListingBucket(bkt Bucket, delay time.Duration) *StableListingBucket {
+	return &StableListingBucket{Bucket: bkt, delay: delay}
+}
+
+// Iter implements Bucket.
+func (b *StableListingBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	first, err := b.list(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(b.delay):
+	}
+
+	second, err := b.list(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[string]struct{}, len(second))
+	for _, name := range second {
+		listed[name] = struct{}{}
+		if err := f(name); err != nil {
+			return err
+		}
+	}
+	for _, name := range first {
+		if _, ok := listed[name]; ok {
+			continue
+		}
+		exists, err := b.exists(ctx, name)
+		if err != nil {
+			return errors.Wrapf(err, "reconcile listing of %s", name)
+		}
+		if !exists {
+			continue
+		}
+		if err := f(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list returns a single listing of the given directory.
+func (b *StableListingBucket) list(ctx context.Context, dir string) ([]string, error) {
+	var names []string
+	if err := b.Bucket.Iter(ctx, dir, func(name string) error {
+		names = append(names, name)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// exists returns true if the given listed entry is an existing object or a directory holding at least one entry.
+func (b *StableListingBucket) exists(ctx context.Context, name string) (bool, error) {
+	if !strings.HasSuffix(name, DirDelim) {
+		return b.Bucket.Exists(ctx, name)
+	}
+
+	found := false
+	errFound := errors.New("found")
+	if err := b.Bucket.Iter(ctx, name, func(string) error {
+		found = true
+		return errFound
+	}); err != nil && err != errFound {
+		return false, err
+	}
+	return found, nil
+}
+
+func (b *StableListingBucket) SupportsConditionalUpload() bool {
+	return SupportsConditionalUpload(b.Bucket)
+}
+
+func (b *StableListingBucket) UploadIfNotExists(ctx context.Context, name string, r io.Reader) error {
+	return uploadIfNotExists(ctx, b.Bucket, name, r)
+}
+
+func (b *StableListingBucket) SupportsServerSideCopy() bool {
+	return SupportsServerSideCopy(b.Bucket)
+}
+
+func (b *StableListingBucket) Copy(ctx context.Context, src, dst string) error {
+	return copyObject(ctx, b.Bucket, src, dst)
+}
+
+func (b *StableListingBucket) SupportsBatchDelete() bool {
+	return SupportsBatchDelete(b.Bucket)
+}
+
+func (b *StableListingBucket) DeleteObjects(ctx context.Context, names []string) error {
+	return deleteObjects(ctx, b.Bucket, names)
+}
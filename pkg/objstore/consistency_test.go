@@ -0,0 +1,73 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// laggingBucket lists the given stale entries, and hides the given fresh entries, on the first listing of the root.
+type laggingBucket struct {
+	Bucket
+
+	stale, fresh map[string]struct{}
+	listings     int
+}
+
+func (b *laggingBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	if dir == "" {
+		b.listings++
+	}
+	first := dir == "" && b.listings == 1
+	if first {
+		for name := range b.stale {
+			if err := f(name); err != nil {
+				return err
+			}
+		}
+	}
+	return b.Bucket.Iter(ctx, dir, func(name string) error {
+		if _, ok := b.fresh[name]; ok && first {
+			return nil
+		}
+		return f(name)
+	})
+}
+
+func TestStableListingBucket(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	for _, name := range []string{"a/meta.json", "b/meta.json", "c/meta.json"} {
+		testutil.Ok(t, inmem.Upload(ctx, name, strings.NewReader("{}")))
+	}
+
+	lagging := &laggingBucket{
+		Bucket: inmem,
+		stale:  map[string]struct{}{"deleted/": {}, "a/": {}},
+		fresh:  map[string]struct{}{"c/": {}},
+	}
+	bkt := NewStableListingBucket(lagging, time.Millisecond)
+
+	var names []string
+	testutil.Ok(t, bkt.Iter(ctx, "", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	sort.Strings(names)
+	testutil.Equals(t, []string{"a/", "b/", "c/"}, names)
+	testutil.Equals(t, 2, lagging.listings)
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	testutil.Equals(t, context.Canceled, NewStableListingBucket(inmem, time.Hour).Iter(cctx, "", func(string) error { return nil }))
+
+	testutil.Assert(t, SupportsBatchDelete(NewStableListingBucket(inmem, 0)))
+	testutil.Assert(t, !SupportsBatchDelete(NewStableListingBucket(basicBucket{inmem}, 0)))
+}
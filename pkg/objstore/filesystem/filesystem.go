@@ -182,6 +182,49 @@ func (b *Bucket) Upload(_ context.Context, name string, r io.Reader) (err error)
 	return nil
 }
 
+// SupportsConditionalUpload implements objstore.ConditionalUploader.
+func (b *Bucket) SupportsConditionalUpload() bool { return true }
+
+// UploadIfNotExists writes the file specified in `name` to the bucket, unless it already exists. The content is written
+// to a temporary file first, which is then linked under the given name, so the object never exists partially written.
+func (b *Bucket) UploadIfNotExists(_ context.Context, name string, r io.Reader) (err error) {
+	file := filepath.Join(b.rootDir, name)
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return err
+	}
+	if _, err := os.Stat(file); err == nil {
+		return objstore.ErrObjectExists
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := os.Remove(tmp.Name()); rerr != nil && err == nil {
+			err = errors.Wrapf(rerr, "remove %s", tmp.Name())
+		}
+	}()
+	// Closed explicitly before linking, the deferred close only handles failed copies.
+	defer runutil.CloseWithLogOnErr(nil, tmp, "close")
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return errors.Wrapf(err, "copy to %s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "close %s", tmp.Name())
+	}
+
+	// Unlike rename, link fails if the file already exists.
+	if err := os.Link(tmp.Name(), file); err != nil {
+		if os.IsExist(err) {
+			return objstore.ErrObjectExists
+		}
+		return errors.Wrapf(err, "link %s", file)
+	}
+	return nil
+}
+
 func isDirEmpty(name string) (ok bool, err error) {
 	f, err := os.Open(name)
 	if err != nil {
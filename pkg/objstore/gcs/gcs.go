@@ -8,6 +8,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"runtime"
 	"strings"
 	"testing"
@@ -18,6 +19,7 @@ import (
 	"github.com/prometheus/common/version"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"gopkg.in/yaml.v2"
@@ -164,11 +166,37 @@ func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
 	return w.Close()
 }
 
+// SupportsConditionalUpload implements objstore.ConditionalUploader.
+func (b *Bucket) SupportsConditionalUpload() bool { return true }
+
+// UploadIfNotExists writes the file specified in `name` to GCS with precondition that it does not exist yet.
+func (b *Bucket) UploadIfNotExists(ctx context.Context, name string, r io.Reader) error {
+	w := b.bkt.Object(name).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	err := w.Close()
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusPreconditionFailed {
+		return objstore.ErrObjectExists
+	}
+	return err
+}
+
 // Delete removes the object with the given name.
 func (b *Bucket) Delete(ctx context.Context, name string) error {
 	return b.bkt.Object(name).Delete(ctx)
 }
 
+// SupportsServerSideCopy implements objstore.Copier.
+func (b *Bucket) SupportsServerSideCopy() bool { return true }
+
+// Copy copies the object src into the object dst within the bucket.
+func (b *Bucket) Copy(ctx context.Context, src, dst string) error {
+	_, err := b.bkt.Object(dst).CopierFrom(b.bkt.Object(src)).Run(ctx)
+	return err
+}
+
 // IsObjNotFoundErr returns true if error means that object is not found. Relevant to Get operations.
 func (b *Bucket) IsObjNotFoundErr(err error) bool {
 	return err == storage.ErrObjectNotExist
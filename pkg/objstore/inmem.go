@@ -176,6 +176,28 @@ func (b *InMemBucket) Upload(_ context.Context, name string, r io.Reader) error
 	return nil
 }
 
+// SupportsConditionalUpload implements ConditionalUploader.
+func (b *InMemBucket) SupportsConditionalUpload() bool { return true }
+
+// UploadIfNotExists writes the file specified in `name` to the bucket, unless it already exists.
+func (b *InMemBucket) UploadIfNotExists(_ context.Context, name string, r io.Reader) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if _, ok := b.objects[name]; ok {
+		return ErrObjectExists
+	}
+	b.objects[name] = body
+	b.attrs[name] = ObjectAttributes{
+		Size:         int64(len(body)),
+		LastModified: time.Now(),
+	}
+	return nil
+}
+
 // Delete removes all data prefixed with the dir.
 func (b *InMemBucket) Delete(_ context.Context, name string) error {
 	b.mtx.Lock()
@@ -188,6 +210,39 @@ func (b *InMemBucket) Delete(_ context.Context, name string) error {
 	return nil
 }
 
+// SupportsServerSideCopy implements Copier.
+func (b *InMemBucket) SupportsServerSideCopy() bool { return true }
+
+// Copy copies the object src into the object dst.
+func (b *InMemBucket) Copy(_ context.Context, src, dst string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	body, ok := b.objects[src]
+	if !ok {
+		return errNotFound
+	}
+	b.objects[dst] = body
+	b.attrs[dst] = ObjectAttributes{
+		Size:         int64(len(body)),
+		LastModified: time.Now(),
+	}
+	return nil
+}
+
+// SupportsBatchDelete implements BatchDeleter.
+func (b *InMemBucket) SupportsBatchDelete() bool { return true }
+
+// DeleteObjects removes all given objects that exist.
+func (b *InMemBucket) DeleteObjects(_ context.Context, names []string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for _, name := range names {
+		delete(b.objects, name)
+		delete(b.attrs, name)
+	}
+	return nil
+}
+
 // IsObjNotFoundErr returns true if error means that object is not found. Relevant to Get operations.
 func (b *InMemBucket) IsObjNotFoundErr(err error) bool {
 	return errors.Cause(err) == errNotFound
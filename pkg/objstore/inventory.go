@@ -0,0 +1,403 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// InventoryFormat is the format of inventory reports exported by an object storage provider.
+type InventoryFormat string
+
+const (
+	// InventoryFormatS3 is the CSV format of S3 Inventory, with a manifest.json listing gzipped CSV files without header,
+	// whose columns are given by the fileSchema of the manifest.
+	InventoryFormatS3 InventoryFormat = "s3"
+	// InventoryFormatGCS is the CSV format of GCS Storage Insights inventory reports, with a manifest listing CSV shards
+	// next to it, each with a header row.
+	InventoryFormatGCS InventoryFormat = "gcs"
+)
+
+// InventoryFormats are all supported inventory formats.
+var InventoryFormats = []string{string(InventoryFormatS3), string(InventoryFormatGCS)}
+
+// InventoryManifestSuffix is the suffix of names of manifests of inventory reports.
+const InventoryManifestSuffix = "manifest.json"
+
+// Inventory is a snapshot of objects of a bucket loaded from an inventory report. To keep its memory independent of the
+// number of objects nested deeper, e.g. chunk segments of blocks, it holds sizes of objects in the root and in top
+// directories of the bucket only, e.g. meta.json of blocks, and total sizes of all objects of each top directory.
+type Inventory struct {
+	// Time is the time the report was taken at. Objects created or deleted since are not reflected.
+	Time time.Time
+
+	objects  map[string]int64
+	dirSizes map[string]int64
+}
+
+func newInventory(t time.Time) *Inventory {
+	return &Inventory{Time: t, objects: map[string]int64{}, dirSizes: map[string]int64{}}
+}
+
+func (i *Inventory) add(name string, size int64) {
+	parts := strings.SplitN(name, DirDelim, 3)
+	if len(parts) > 1 {
+		i.dirSizes[parts[0]] += size
+	}
+	if len(parts) < 3 {
+		i.objects[name] = size
+	}
+}
+
+// Len returns the number of objects held by the inventory.
+func (i *Inventory) Len() int {
+	return len(i.objects)
+}
+
+// Size returns the size of the object with the given name, which has to be in the root or in a top directory of the
+// bucket, and false if the object was not in the bucket when the report was taken.
+func (i *Inventory) Size(name string) (int64, bool) {
+	s, ok := i.objects[name]
+	return s, ok
+}
+
+// DirSize returns the total size of all objects of the given top directory, recursively, and false if the directory was
+// empty when the report was taken.
+func (i *Inventory) DirSize(dir string) (int64, bool) {
+	s, ok := i.dirSizes[strings.TrimSuffix(dir, DirDelim)]
+	return s, ok
+}
+
+// LatestInventoryManifest returns the name of the latest manifest of inventory reports under the given directory of the
+// bucket, searched recursively, and an empty name if there is none. Providers name reports by the time they were taken
+// at, so the latest manifest is the last one in lexical order.
+func LatestInventoryManifest(ctx context.Context, bkt BucketReader, dir string) (string, error) {
+	var latest string
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		return bkt.Iter(ctx, dir, func(name string) error {
+			if strings.HasSuffix(name, DirDelim) {
+				return walk(name)
+			}
+			if strings.HasSuffix(name, InventoryManifestSuffix) && name > latest {
+				latest = name
+			}
+			return nil
+		})
+	}
+	if err := walk(dir); err != nil {
+		return "", errors.Wrapf(err, "find inventory manifests in %s", dir)
+	}
+	return latest, nil
+}
+
+// s3InventoryManifest is the manifest.json of an S3 Inventory report.
+type s3InventoryManifest struct {
+	// CreationTimestamp is the unix time in milliseconds the report was taken at.
+	CreationTimestamp string `json:"creationTimestamp"`
+	FileFormat        string `json:"fileFormat"`
+	// FileSchema is the comma separated list of columns of the files.
+	FileSchema string `json:"fileSchema"`
+	Files      []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// gcsInventoryManifest is the manifest of a GCS Storage Insights inventory report.
+type gcsInventoryManifest struct {
+	SnapshotTime time.Time `json:"snapshot_time"`
+	// ShardFileNames are names of CSV shards of the report, relative to the directory of the manifest.
+	ShardFileNames []string `json:"report_shards_file_names"`
+}
+
+// LoadInventory loads the inventory report with the given manifest from the bucket.
+func LoadInventory(ctx context.Context, logger log.Logger, bkt BucketReader, manifest string, format InventoryFormat) (*Inventory, error) {
+	b, err := readAll(ctx, logger, bkt, manifest)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case InventoryFormatS3:
+		var m s3InventoryManifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, errors.Wrapf(err, "decode inventory manifest %s", manifest)
+		}
+		if m.FileFormat != "CSV" {
+			return nil, errors.Errorf("unsupported file format %q of inventory report %s, only CSV is supported", m.FileFormat, manifest)
+		}
+		ms, err := strconv.ParseInt(m.CreationTimestamp, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse creation timestamp of inventory manifest %s", manifest)
+		}
+		columns := strings.Split(m.FileSchema, ",")
+		for i := range columns {
+			columns[i] = strings.TrimSpace(columns[i])
+		}
+		inv := newInventory(time.Unix(0, ms*int64(time.Millisecond)))
+		for _, f := range m.Files {
+			if err := loadInventoryFile(ctx, logger, bkt, f.Key, true, columns, inv); err != nil {
+				return nil, err
+			}
+		}
+		return inv, nil
+	case InventoryFormatGCS:
+		var m gcsInventoryManifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, errors.Wrapf(err, "decode inventory manifest %s", manifest)
+		}
+		inv := newInventory(m.SnapshotTime)
+		for _, f := range m.ShardFileNames {
+			if err := loadInventoryFile(ctx, logger, bkt, path.Join(path.Dir(manifest), f), strings.HasSuffix(f, ".gz"), nil, inv); err != nil {
+				return nil, err
+			}
+		}
+		return inv, nil
+	default:
+		return nil, errors.Errorf("unknown inventory format %q", format)
+	}
+}
+
+func readAll(ctx context.Context, logger log.Logger, bkt BucketReader, name string) ([]byte, error) {
+	r, err := bkt.Get(ctx, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get %s", name)
+	}
+	defer runutil.CloseWithLogOnErr(logger, r, "close %s", name)
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", name)
+	}
+	return b, nil
+}
+
+// loadInventoryFile adds objects of the given CSV file of an inventory report to the inventory. Without columns, they are
+// read from the header row of the file. S3 Inventory URL-encodes object names and, for versioned buckets, lists all
+// versions and delete markers, of which only latest versions that are not delete markers are added.
+func loadInventoryFile(ctx context.Context, logger log.Logger, bkt BucketReader, name string, gzipped bool, columns []string, inv *Inventory) (err error) {
+	rc, err := bkt.Get(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "get inventory file %s", name)
+	}
+	defer runutil.CloseWithLogOnErr(logger, rc, "close inventory file %s", name)
+
+	var r io.Reader = rc
+	if gzipped {
+		gz, err := gzip.NewReader(rc)
+		if err != nil {
+			return errors.Wrapf(err, "decompress inventory file %s", name)
+		}
+		defer runutil.CloseWithErrCapture(&err, gz, "close gzip reader")
+		r = gz
+	}
+
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	cr.FieldsPerRecord = -1
+	encoded := columns != nil
+	if !encoded {
+		header, err := cr.Read()
+		if err != nil {
+			return errors.Wrapf(err, "read header of inventory file %s", name)
+		}
+		columns = append([]string(nil), header...)
+	}
+	idx := map[string]int{}
+	for i, c := range columns {
+		idx[strings.ToLower(c)] = i
+	}
+	keyCol, ok := idx["key"]
+	if !ok {
+		keyCol, ok = idx["name"]
+	}
+	sizeCol, sizeOK := idx["size"]
+	if !ok || !sizeOK {
+		return errors.Errorf("inventory file %s has no object name and size columns, got %v", name, columns)
+	}
+	latestCol, hasLatest := idx["islatest"]
+	deleteMarkerCol, hasDeleteMarker := idx["isdeletemarker"]
+
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "read inventory file %s", name)
+		}
+		if len(rec) != len(columns) {
+			return errors.Errorf("inventory file %s has record of %d fields, expected %d", name, len(rec), len(columns))
+		}
+		if hasLatest && rec[latestCol] != "true" || hasDeleteMarker && rec[deleteMarkerCol] == "true" {
+			continue
+		}
+		key := rec[keyCol]
+		if encoded {
+			if key, err = url.QueryUnescape(key); err != nil {
+				return errors.Wrapf(err, "decode object name %q of inventory file %s", rec[keyCol], name)
+			}
+		}
+		size, err := strconv.ParseInt(rec[sizeCol], 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "parse size of %s in inventory file %s", key, name)
+		}
+		inv.add(key, size)
+	}
+}
+
+// InventoryReader keeps the latest inventory report of a bucket loaded, as a cheap alternative source of existence and
+// sizes of objects of buckets with millions of objects, saving a request per object. Reports older than the max age are
+// not used, so callers fall back to the bucket. As objects created since the report was taken are missing in it, only
+// objects listed by the report can be trusted; the max age bounds how long objects listed may have been deleted already.
+type InventoryReader struct {
+	logger log.Logger
+	bkt    BucketReader
+	dir    string
+	format InventoryFormat
+	maxAge time.Duration
+
+	mtx      sync.Mutex
+	manifest string
+	inv      *Inventory
+
+	objects prometheus.Gauge
+	age     prometheus.Gauge
+	loads   *prometheus.CounterVec
+	lookups *prometheus.CounterVec
+}
+
+// NewInventoryReader returns InventoryReader of inventory reports of the given format, exported into the given directory
+// of the given bucket, using reports up to the given max age.
+func NewInventoryReader(logger log.Logger, reg prometheus.Registerer, bkt BucketReader, dir string, format InventoryFormat, maxAge time.Duration) (*InventoryReader, error) {
+	if format != InventoryFormatS3 && format != InventoryFormatGCS {
+		return nil, errors.Errorf("unknown inventory format %q", format)
+	}
+	if maxAge <= 0 {
+		return nil, errors.Errorf("max age of inventory reports has to be positive, got %v", maxAge)
+	}
+	r := &InventoryReader{
+		logger: logger,
+		bkt:    bkt,
+		dir:    dir,
+		format: format,
+		maxAge: maxAge,
+		objects: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_objstore_inventory_objects",
+			Help: "Number of objects in the root and top directories of the bucket listed by the loaded inventory report.",
+		}),
+		age: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_objstore_inventory_report_timestamp_seconds",
+			Help: "Unix time the loaded inventory report was taken at.",
+		}),
+		loads: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_objstore_inventory_loads_total",
+			Help: "Total number of attempts to load inventory reports, by result.",
+		}, []string{"result"}),
+		lookups: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_objstore_inventory_lookups_total",
+			Help: "Total number of lookups of objects and directories in the inventory report, by result. Misses and lookups while no report within the max age is loaded go to the bucket.",
+		}, []string{"result"}),
+	}
+	for _, res := range []string{"success", "failure"} {
+		r.loads.WithLabelValues(res)
+	}
+	for _, res := range []string{"hit", "miss", "stale"} {
+		r.lookups.WithLabelValues(res)
+	}
+	return r, nil
+}
+
+// Sync loads the latest inventory report if it is newer than the loaded one. The loaded report is kept on failure.
+func (r *InventoryReader) Sync(ctx context.Context) error {
+	manifest, err := LatestInventoryManifest(ctx, r.bkt, r.dir)
+	if err != nil {
+		r.loads.WithLabelValues("failure").Inc()
+		return err
+	}
+	r.mtx.Lock()
+	loaded := r.manifest
+	r.mtx.Unlock()
+	if manifest == "" || manifest == loaded {
+		return nil
+	}
+
+	begin := time.Now()
+	inv, err := LoadInventory(ctx, r.logger, r.bkt, manifest, r.format)
+	if err != nil {
+		r.loads.WithLabelValues("failure").Inc()
+		return errors.Wrapf(err, "load inventory report %s", manifest)
+	}
+	r.loads.WithLabelValues("success").Inc()
+	level.Info(r.logger).Log("msg", "loaded inventory report", "manifest", manifest, "taken_at", inv.Time, "objects", inv.Len(), "duration", time.Since(begin))
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.manifest, r.inv = manifest, inv
+	r.objects.Set(float64(inv.Len()))
+	r.age.Set(float64(inv.Time.Unix()))
+	return nil
+}
+
+// current returns the loaded report, nil if there is none within the max age.
+func (r *InventoryReader) current() *Inventory {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.inv == nil || time.Since(r.inv.Time) > r.maxAge {
+		r.lookups.WithLabelValues("stale").Inc()
+		return nil
+	}
+	return r.inv
+}
+
+func (r *InventoryReader) observe(ok bool) {
+	if ok {
+		r.lookups.WithLabelValues("hit").Inc()
+		return
+	}
+	r.lookups.WithLabelValues("miss").Inc()
+}
+
+// Size returns the size of the object with the given name, which has to be in the root or in a top directory of the
+// bucket, and true if the object is listed by the report.
+func (r *InventoryReader) Size(name string) (int64, bool) {
+	inv := r.current()
+	if inv == nil {
+		return 0, false
+	}
+	s, ok := inv.Size(name)
+	r.observe(ok)
+	return s, ok
+}
+
+// DirSize returns the total size of all objects of the given top directory, and true if the directory is listed by the
+// report.
+func (r *InventoryReader) DirSize(dir string) (int64, bool) {
+	inv := r.current()
+	if inv == nil {
+		return 0, false
+	}
+	s, ok := inv.DirSize(dir)
+	r.observe(ok)
+	return s, ok
+}
@@ -0,0 +1,135 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestLoadInventory(t *testing.T) {
+	ctx := context.Background()
+	bkt := NewInMemBucket()
+	upload := func(name, content string) {
+		testutil.Ok(t, bkt.Upload(ctx, name, strings.NewReader(content)))
+	}
+	gzipped := func(content string) string {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		_, err := w.Write([]byte(content))
+		testutil.Ok(t, err)
+		testutil.Ok(t, w.Close())
+		return b.String()
+	}
+	expect := func(inv *Inventory) {
+		testutil.Equals(t, 3, inv.Len())
+		s, ok := inv.Size("01A/meta.json")
+		testutil.Assert(t, ok, "expected meta.json listed")
+		testutil.Equals(t, int64(10), s)
+		_, ok = inv.Size("01A/chunks/000001")
+		testutil.Assert(t, !ok, "expected nested objects not to be held")
+		_, ok = inv.Size("01A/deletion-mark.json")
+		testutil.Assert(t, !ok, "expected deleted object not to be listed")
+		s, ok = inv.DirSize("01A/")
+		testutil.Assert(t, ok, "expected directory listed")
+		testutil.Equals(t, int64(1110), s)
+		s, ok = inv.DirSize("01B")
+		testutil.Assert(t, ok, "expected directory listed")
+		testutil.Equals(t, int64(5), s)
+		_, ok = inv.DirSize("01C")
+		testutil.Assert(t, !ok, "expected missing directory not to be listed")
+	}
+
+	// S3 Inventory of a versioned bucket, with URL-encoded names.
+	upload("inv/s3/bkt/cfg/2021-01-01T00-00Z/manifest.json", `{"creationTimestamp": "1609459200000", "fileFormat": "CSV",
+		"fileSchema": "Bucket, Key, VersionId, IsLatest, IsDeleteMarker, Size", "files": [{"key": "inv/s3/bkt/cfg/data/1.csv.gz"}, {"key": "inv/s3/bkt/cfg/data/2.csv.gz"}]}`)
+	upload("inv/s3/bkt/cfg/data/1.csv.gz", gzipped("\"bkt\",\"01A%2Fmeta.json\",\"v2\",\"true\",\"false\",\"10\"\n\"bkt\",\"01A%2Fmeta.json\",\"v1\",\"false\",\"false\",\"9\"\n\"bkt\",\"01A%2Fchunks%2F000001\",\"v1\",\"true\",\"false\",\"1000\"\n"))
+	upload("inv/s3/bkt/cfg/data/2.csv.gz", gzipped("\"bkt\",\"01A%2Findex\",\"v1\",\"true\",\"false\",\"100\"\n\"bkt\",\"01A%2Fdeletion-mark.json\",\"v1\",\"true\",\"true\",\"\"\n\"bkt\",\"01B%2Findex\",\"v1\",\"true\",\"false\",\"5\"\n"))
+	upload("inv/s3/bkt/cfg/hive/dt=2021-01-01-00-00/symlink.txt", "")
+
+	manifest, err := LatestInventoryManifest(ctx, bkt, "inv/s3")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "inv/s3/bkt/cfg/2021-01-01T00-00Z/manifest.json", manifest)
+	inv, err := LoadInventory(ctx, log.NewNopLogger(), bkt, manifest, InventoryFormatS3)
+	testutil.Ok(t, err)
+	testutil.Equals(t, time.Unix(1609459200, 0), inv.Time)
+	expect(inv)
+
+	// GCS Storage Insights report with header.
+	upload("inv/gcs/cfg_2021-01-01_manifest.json", `{"snapshot_time": "2021-01-01T00:00:00Z", "report_shards_file_names": ["cfg_2021-01-01_0.csv", "cfg_2021-01-01_1.csv"]}`)
+	upload("inv/gcs/cfg_2021-01-01_0.csv", "bucket,name,size\nbkt,01A/meta.json,10\nbkt,01A/index,100\n")
+	upload("inv/gcs/cfg_2021-01-01_1.csv", "bucket,name,size\nbkt,01A/chunks/000001,1000\nbkt,01B/index,5\n")
+	inv, err = LoadInventory(ctx, log.NewNopLogger(), bkt, "inv/gcs/cfg_2021-01-01_manifest.json", InventoryFormatGCS)
+	testutil.Ok(t, err)
+	testutil.Equals(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), inv.Time.UTC())
+	expect(inv)
+
+	upload("inv/gcs/broken_manifest.json", `{"snapshot_time": "2021-01-01T00:00:00Z", "report_shards_file_names": ["broken.csv"]}`)
+	upload("inv/gcs/broken.csv", "bucket,key\nbkt,01A/meta.json\n")
+	_, err = LoadInventory(ctx, log.NewNopLogger(), bkt, "inv/gcs/broken_manifest.json", InventoryFormatGCS)
+	testutil.NotOk(t, err)
+}
+
+func TestInventoryReader(t *testing.T) {
+	ctx := context.Background()
+	bkt := NewInMemBucket()
+	report := func(date string, taken time.Time, objects ...string) {
+		manifest := fmt.Sprintf(`{"snapshot_time": %q, "report_shards_file_names": ["cfg_%s_0.csv"]}`, taken.Format(time.RFC3339), date)
+		testutil.Ok(t, bkt.Upload(ctx, "inv/cfg_"+date+"_manifest.json", strings.NewReader(manifest)))
+		csv := "name,size\n"
+		for _, o := range objects {
+			csv += o + ",1\n"
+		}
+		testutil.Ok(t, bkt.Upload(ctx, "inv/cfg_"+date+"_0.csv", strings.NewReader(csv)))
+	}
+
+	_, err := NewInventoryReader(log.NewNopLogger(), nil, bkt, "inv", "csv", time.Hour)
+	testutil.NotOk(t, err)
+
+	reg := prometheus.NewRegistry()
+	r, err := NewInventoryReader(log.NewNopLogger(), reg, bkt, "inv", InventoryFormatGCS, time.Hour)
+	testutil.Ok(t, err)
+
+	// Without reports, all lookups go to the bucket.
+	testutil.Ok(t, r.Sync(ctx))
+	_, ok := r.Size("01A/meta.json")
+	testutil.Assert(t, !ok, "expected no object listed without report")
+
+	// Reports beyond max age are not used.
+	report("2021-01-01", time.Now().Add(-2*time.Hour), "01A/meta.json")
+	testutil.Ok(t, r.Sync(ctx))
+	_, ok = r.Size("01A/meta.json")
+	testutil.Assert(t, !ok, "expected stale report not to be used")
+	testutil.Equals(t, 2.0, promtest.ToFloat64(r.lookups.WithLabelValues("stale")))
+
+	report("2021-01-02", time.Now(), "01A/meta.json", "01A/index")
+	testutil.Ok(t, r.Sync(ctx))
+	_, ok = r.Size("01A/meta.json")
+	testutil.Assert(t, ok, "expected object listed by latest report")
+	s, ok := r.DirSize("01A")
+	testutil.Assert(t, ok, "expected directory listed by latest report")
+	testutil.Equals(t, int64(2), s)
+	_, ok = r.Size("01B/meta.json")
+	testutil.Assert(t, !ok, "expected object created since the report not to be listed")
+	testutil.Equals(t, 2.0, promtest.ToFloat64(r.lookups.WithLabelValues("hit")))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(r.lookups.WithLabelValues("miss")))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(r.loads.WithLabelValues("success")))
+
+	// Failing to load a newer report keeps the loaded one.
+	testutil.Ok(t, bkt.Upload(ctx, "inv/cfg_2021-01-03_manifest.json", strings.NewReader("{")))
+	testutil.NotOk(t, r.Sync(ctx))
+	_, ok = r.Size("01A/index")
+	testutil.Assert(t, ok, "expected loaded report to be kept")
+}
@@ -0,0 +1,250 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"encoding/hex"
+	"hash/fnv"
+	"io"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+)
+
+// BlockPathScheme places directories of blocks under prefix directories instead of the root of the bucket, e.g. to
+// spread requests over prefixes of object storages rate limiting requests per prefix.
+type BlockPathScheme interface {
+	// Prefix returns the prefix directories of the directory of the given block, ending with DirDelim, e.g. "3f/".
+	Prefix(id ulid.ULID) string
+	// Depth returns the number of prefix directories of each block.
+	Depth() int
+	// IsPrefixDir returns true if the given directory name, without DirDelim, may be a prefix directory of a block.
+	IsPrefixDir(name string) bool
+}
+
+// HashedBlockPathScheme is a BlockPathScheme placing each block under levels of prefix directories with names of width
+// hexadecimal digits of the hash of the block's ULID, e.g. "3f/01DQWN3K9BX6VQ3RR4Z6CRKJ9G/" for one level of width 2.
+type HashedBlockPathScheme struct {
+	levels, width int
+}
+
+// NewHashedBlockPathScheme returns HashedBlockPathScheme with the given number of levels and width of prefix directories.
+func NewHashedBlockPathScheme(levels, width int) (*HashedBlockPathScheme, error) {
+	if levels < 1 || width < 1 {
+		return nil, errors.Errorf("levels and width of prefix directories have to be positive, got %d and %d", levels, width)
+	}
+	if levels*width > 8 {
+		return nil, errors.Errorf("prefix directories with %d levels of width %d need more than the 8 hexadecimal digits of a hash", levels, width)
+	}
+	return &HashedBlockPathScheme{levels: levels, width: width}, nil
+}
+
+// Prefix implements BlockPathScheme.
+func (s *HashedBlockPathScheme) Prefix(id ulid.ULID) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id.String()))
+	digits := hex.EncodeToString(h.Sum(nil))
+
+	var b strings.Builder
+	for i := 0; i < s.levels; i++ {
+		b.WriteString(digits[i*s.width : (i+1)*s.width])
+		b.WriteString(DirDelim)
+	}
+	return b.String()
+}
+
+// Depth implements BlockPathScheme.
+func (s *HashedBlockPathScheme) Depth() int { return s.levels }
+
+// IsPrefixDir implements BlockPathScheme.
+func (s *HashedBlockPathScheme) IsPrefixDir(name string) bool {
+	if len(name) != s.width {
+		return false
+	}
+	for _, c := range name {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// BlockLayoutBucket is a Bucket storing blocks under prefix directories given by a BlockPathScheme, while its callers see
+// blocks in directories named by their ULID at the root of the bucket, as everywhere else. Names of objects whose first
+// directory is a ULID are mapped onto the scheme; all other objects, e.g. debug metas, stay where they are.
+// Listing the root lists blocks of all prefix directories. Block directories at the root itself are not listed, as none
+// of their objects can be read through the scheme, and they would be taken for partially uploaded blocks otherwise.
+type BlockLayoutBucket struct {
+	Bucket
+
+	logger log.Logger
+	scheme BlockPathScheme
+}
+
+// NewBlockLayoutBucket returns BlockLayoutBucket wrapping the given bucket with blocks placed by the given scheme.
+func NewBlockLayoutBucket(logger log.Logger, bkt Bucket, scheme BlockPathScheme) *BlockLayoutBucket {
+	return &BlockLayoutBucket{Bucket: bkt, logger: logger, scheme: scheme}
+}
+
+// blockName returns the name of the given object in the wrapped bucket, and the prefix added to it, if any.
+func (b *BlockLayoutBucket) blockName(name string) (string, string) {
+	first := name
+	if i := strings.Index(name, DirDelim); i >= 0 {
+		first = name[:i]
+	}
+	id, err := ulid.Parse(first)
+	if err != nil {
+		return name, ""
+	}
+	prefix := b.scheme.Prefix(id)
+	return prefix + name, prefix
+}
+
+// Iter implements Bucket.
+func (b *BlockLayoutBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	if strings.Trim(dir, DirDelim) == "" {
+		return b.iterRoot(ctx, f)
+	}
+	name, prefix := b.blockName(dir)
+	return b.Bucket.Iter(ctx, name, func(name string) error {
+		return f(strings.TrimPrefix(name, prefix))
+	})
+}
+
+// iterRoot lists entries of the root that are not prefix directories, and directories of blocks of all prefix
+// directories.
+func (b *BlockLayoutBucket) iterRoot(ctx context.Context, f func(string) error) error {
+	var prefixes []string
+	if err := b.Bucket.Iter(ctx, "", func(name string) error {
+		dir := strings.TrimSuffix(name, DirDelim)
+		if dir == name {
+			return f(name)
+		}
+		if b.scheme.IsPrefixDir(dir) {
+			prefixes = append(prefixes, name)
+			return nil
+		}
+		if _, err := ulid.Parse(dir); err == nil {
+			level.Warn(b.logger).Log("msg", "ignoring block directory at the root of bucket with blocks under prefix directories", "block", dir)
+			return nil
+		}
+		return f(name)
+	}); err != nil {
+		return err
+	}
+
+	for _, p := range prefixes {
+		if err := b.iterPrefix(ctx, p, 1, f); err != nil {
+			return errors.Wrapf(err, "list prefix directory %s", p)
+		}
+	}
+	return nil
+}
+
+// iterPrefix lists directories of blocks under the given prefix directory of the given level.
+func (b *BlockLayoutBucket) iterPrefix(ctx context.Context, prefix string, depth int, f func(string) error) error {
+	var prefixes []string
+	if err := b.Bucket.Iter(ctx, prefix, func(name string) error {
+		dir := strings.TrimSuffix(strings.TrimPrefix(name, prefix), DirDelim)
+		if dir+DirDelim != strings.TrimPrefix(name, prefix) {
+			return nil
+		}
+		if depth < b.scheme.Depth() {
+			if b.scheme.IsPrefixDir(dir) {
+				prefixes = append(prefixes, name)
+			}
+			return nil
+		}
+		id, err := ulid.Parse(dir)
+		if err != nil {
+			return nil
+		}
+		if b.scheme.Prefix(id) != prefix {
+			level.Warn(b.logger).Log("msg", "ignoring block directory under prefix directory of another block path scheme", "block", name)
+			return nil
+		}
+		return f(dir + DirDelim)
+	}); err != nil {
+		return err
+	}
+
+	for _, p := range prefixes {
+		if err := b.iterPrefix(ctx, p, depth+1, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get implements Bucket.
+func (b *BlockLayoutBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	name, _ = b.blockName(name)
+	return b.Bucket.Get(ctx, name)
+}
+
+// GetRange implements Bucket.
+func (b *BlockLayoutBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	name, _ = b.blockName(name)
+	return b.Bucket.GetRange(ctx, name, off, length)
+}
+
+// Exists implements Bucket.
+func (b *BlockLayoutBucket) Exists(ctx context.Context, name string) (bool, error) {
+	name, _ = b.blockName(name)
+	return b.Bucket.Exists(ctx, name)
+}
+
+// Attributes implements Bucket.
+func (b *BlockLayoutBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	name, _ = b.blockName(name)
+	return b.Bucket.Attributes(ctx, name)
+}
+
+// Upload implements Bucket.
+func (b *BlockLayoutBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	name, _ = b.blockName(name)
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+// Delete implements Bucket.
+func (b *BlockLayoutBucket) Delete(ctx context.Context, name string) error {
+	name, _ = b.blockName(name)
+	return b.Bucket.Delete(ctx, name)
+}
+
+func (b *BlockLayoutBucket) SupportsConditionalUpload() bool {
+	return SupportsConditionalUpload(b.Bucket)
+}
+
+func (b *BlockLayoutBucket) UploadIfNotExists(ctx context.Context, name string, r io.Reader) error {
+	name, _ = b.blockName(name)
+	return uploadIfNotExists(ctx, b.Bucket, name, r)
+}
+
+func (b *BlockLayoutBucket) SupportsServerSideCopy() bool {
+	return SupportsServerSideCopy(b.Bucket)
+}
+
+func (b *BlockLayoutBucket) Copy(ctx context.Context, src, dst string) error {
+	src, _ = b.blockName(src)
+	dst, _ = b.blockName(dst)
+	return copyObject(ctx, b.Bucket, src, dst)
+}
+
+func (b *BlockLayoutBucket) SupportsBatchDelete() bool {
+	return SupportsBatchDelete(b.Bucket)
+}
+
+func (b *BlockLayoutBucket) DeleteObjects(ctx context.Context, names []string) error {
+	mapped := make([]string, 0, len(names))
+	for _, name := range names {
+		name, _ = b.blockName(name)
+		mapped = append(mapped, name)
+	}
+	return deleteObjects(ctx, b.Bucket, mapped)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestBlockLayoutBucket(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	scheme, err := NewHashedBlockPathScheme(2, 1)
+	testutil.Ok(t, err)
+	bkt := NewBlockLayoutBucket(log.NewNopLogger(), inmem, scheme)
+
+	a := ulid.MustNew(1, nil).String()
+	b := ulid.MustNew(2, nil).String()
+	flat := ulid.MustNew(3, nil).String()
+	for _, name := range []string{a + "/meta.json", a + "/chunks/000001", b + "/meta.json", "debug/metas/" + a + ".json"} {
+		testutil.Ok(t, bkt.Upload(ctx, name, strings.NewReader("{}")))
+	}
+	testutil.Ok(t, inmem.Upload(ctx, flat+"/meta.json", strings.NewReader("{}")))
+
+	// Blocks are stored under prefix directories, other objects are not.
+	pa := scheme.Prefix(ulid.MustParse(a))
+	testutil.Equals(t, 4, len(pa))
+	ok, err := inmem.Exists(ctx, pa+a+"/chunks/000001")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "block object not under prefix directory")
+	ok, err = inmem.Exists(ctx, "debug/metas/"+a+".json")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "non block object moved under prefix directory")
+
+	list := func(dir string) []string {
+		var names []string
+		testutil.Ok(t, bkt.Iter(ctx, dir, func(name string) error {
+			names = append(names, name)
+			return nil
+		}))
+		sort.Strings(names)
+		return names
+	}
+	// Blocks at the root are not listed.
+	testutil.Equals(t, []string{a + "/", b + "/", "debug/"}, list(""))
+	testutil.Equals(t, []string{a + "/chunks/", a + "/meta.json"}, list(a))
+	testutil.Equals(t, []string{a + "/chunks/000001"}, list(a+"/chunks/"))
+
+	rc, err := bkt.Get(ctx, a+"/meta.json")
+	testutil.Ok(t, err)
+	c, err := ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "{}", string(c))
+
+	testutil.Ok(t, UploadIfNotExists(ctx, bkt, b+"/deletion-mark.json", []byte("{}")))
+	testutil.Equals(t, ErrObjectExists, UploadIfNotExists(ctx, bkt, b+"/deletion-mark.json", []byte("{}")))
+
+	for _, name := range []string{a + "/meta.json", a + "/chunks/000001"} {
+		testutil.Ok(t, bkt.Delete(ctx, name))
+	}
+	testutil.Equals(t, []string{b + "/", "debug/"}, list(""))
+	testutil.Ok(t, DeleteObjects(ctx, bkt, []string{b + "/meta.json", b + "/deletion-mark.json"}))
+	testutil.Equals(t, []string{"debug/"}, list(""))
+	testutil.Equals(t, 2, len(inmem.Objects()))
+}
+
+func TestNewHashedBlockPathScheme(t *testing.T) {
+	_, err := NewHashedBlockPathScheme(0, 2)
+	testutil.NotOk(t, err)
+	_, err = NewHashedBlockPathScheme(3, 3)
+	testutil.NotOk(t, err)
+
+	s, err := NewHashedBlockPathScheme(1, 2)
+	testutil.Ok(t, err)
+	testutil.Assert(t, s.IsPrefixDir("3f"), "hex prefix rejected")
+	testutil.Assert(t, !s.IsPrefixDir("3F"), "upper case prefix accepted")
+	testutil.Assert(t, !s.IsPrefixDir("debug"), "long prefix accepted")
+}
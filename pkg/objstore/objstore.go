@@ -18,6 +18,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
+	"github.com/thanos-io/thanos/pkg/pool"
 	"github.com/thanos-io/thanos/pkg/runutil"
 )
 
@@ -29,6 +30,8 @@ const (
 	OpUpload     = "upload"
 	OpDelete     = "delete"
 	OpAttributes = "attributes"
+	OpCopy       = "copy"
+	OpDeleteMany = "delete_many"
 )
 
 // Bucket provides read and write access to an object storage bucket.
@@ -162,10 +165,63 @@ func UploadFile(ctx context.Context, logger log.Logger, bkt Bucket, src, dst str
 // DirDelim is the delimiter used to model a directory structure in an object store bucket.
 const DirDelim = "/"
 
+type downloadOptions struct {
+	buffers    pool.BytesPool
+	bufferSize int
+}
+
+// DownloadOption overrides behavior of DownloadFile and DownloadDir.
+type DownloadOption interface {
+	apply(*downloadOptions)
+}
+
+type downloadOptionFunc func(*downloadOptions)
+
+func (f downloadOptionFunc) apply(o *downloadOptions) {
+	f(o)
+}
+
+func applyDownloadOptions(opts []DownloadOption) downloadOptions {
+	o := downloadOptions{}
+	for _, opt := range opts {
+		opt.apply(&o)
+	}
+	return o
+}
+
+// WithCopyBuffers makes downloads copy objects into files using buffers of the given size obtained from the given pool,
+// instead of allocating a new buffer for every file. Files are downloaded with an allocated buffer if the pool fails to
+// provide one.
+func WithCopyBuffers(p pool.BytesPool, size int) DownloadOption {
+	return downloadOptionFunc(func(o *downloadOptions) {
+		o.buffers = p
+		o.bufferSize = size
+	})
+}
+
+// copyObject copies the object from the reader into the file, using a buffer from the pool if configured.
+func (o downloadOptions) copyObject(f io.Writer, r io.Reader) error {
+	if o.buffers == nil {
+		_, err := io.Copy(f, r)
+		return err
+	}
+	b, err := o.buffers.Get(o.bufferSize)
+	if err != nil {
+		_, err := io.Copy(f, r)
+		return err
+	}
+	defer o.buffers.Put(b)
+
+	_, err = io.CopyBuffer(f, r, (*b)[:o.bufferSize])
+	return err
+}
+
 // DownloadFile downloads the src file from the bucket to dst. If dst is an existing
 // directory, a file with the same name as the source is created in dst.
 // If destination file is already existing, download file will overwrite it.
-func DownloadFile(ctx context.Context, logger log.Logger, bkt BucketReader, src, dst string) (err error) {
+func DownloadFile(ctx context.Context, logger log.Logger, bkt BucketReader, src, dst string, opts ...DownloadOption) (err error) {
+	o := applyDownloadOptions(opts)
+
 	if fi, err := os.Stat(dst); err == nil {
 		if fi.IsDir() {
 			dst = filepath.Join(dst, filepath.Base(src))
@@ -193,14 +249,14 @@ func DownloadFile(ctx context.Context, logger log.Logger, bkt BucketReader, src,
 	}()
 	defer runutil.CloseWithLogOnErr(logger, f, "download block's output file")
 
-	if _, err = io.Copy(f, rc); err != nil {
+	if err = o.copyObject(f, rc); err != nil {
 		return errors.Wrap(err, "copy object to file")
 	}
 	return nil
 }
 
 // DownloadDir downloads all object found in the directory into the local directory.
-func DownloadDir(ctx context.Context, logger log.Logger, bkt BucketReader, src, dst string) error {
+func DownloadDir(ctx context.Context, logger log.Logger, bkt BucketReader, src, dst string, opts ...DownloadOption) error {
 	if err := os.MkdirAll(dst, 0777); err != nil {
 		return errors.Wrap(err, "create dir")
 	}
@@ -208,9 +264,9 @@ func DownloadDir(ctx context.Context, logger log.Logger, bkt BucketReader, src,
 	var downloadedFiles []string
 	if err := bkt.Iter(ctx, src, func(name string) error {
 		if strings.HasSuffix(name, DirDelim) {
-			return DownloadDir(ctx, logger, bkt, name, filepath.Join(dst, filepath.Base(name)))
+			return DownloadDir(ctx, logger, bkt, name, filepath.Join(dst, filepath.Base(name)), opts...)
 		}
-		if err := DownloadFile(ctx, logger, bkt, name, dst); err != nil {
+		if err := DownloadFile(ctx, logger, bkt, name, dst, opts...); err != nil {
 			return err
 		}
 
@@ -272,6 +328,8 @@ func BucketWithMetrics(name string, b Bucket, reg prometheus.Registerer) *metric
 		OpUpload,
 		OpDelete,
 		OpAttributes,
+		OpCopy,
+		OpDeleteMany,
 	} {
 		bkt.ops.WithLabelValues(op)
 		bkt.opsFailures.WithLabelValues(op)
@@ -406,6 +464,26 @@ func (b *metricBucket) Upload(ctx context.Context, name string, r io.Reader) err
 	return nil
 }
 
+func (b *metricBucket) SupportsConditionalUpload() bool {
+	return SupportsConditionalUpload(b.bkt)
+}
+
+func (b *metricBucket) UploadIfNotExists(ctx context.Context, name string, r io.Reader) error {
+	const op = OpUpload
+	b.ops.WithLabelValues(op).Inc()
+
+	start := time.Now()
+	if err := uploadIfNotExists(ctx, b.bkt, name, r); err != nil {
+		if errors.Cause(err) != ErrObjectExists && !b.isOpFailureExpected(err) {
+			b.opsFailures.WithLabelValues(op).Inc()
+		}
+		return err
+	}
+	b.lastSuccessfulUploadTime.WithLabelValues(b.bkt.Name()).SetToCurrentTime()
+	b.opsDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	return nil
+}
+
 func (b *metricBucket) Delete(ctx context.Context, name string) error {
 	const op = OpDelete
 	b.ops.WithLabelValues(op).Inc()
@@ -422,6 +500,44 @@ func (b *metricBucket) Delete(ctx context.Context, name string) error {
 	return nil
 }
 
+func (b *metricBucket) SupportsServerSideCopy() bool {
+	return SupportsServerSideCopy(b.bkt)
+}
+
+func (b *metricBucket) Copy(ctx context.Context, src, dst string) error {
+	const op = OpCopy
+	b.ops.WithLabelValues(op).Inc()
+
+	start := time.Now()
+	if err := copyObject(ctx, b.bkt, src, dst); err != nil {
+		if !b.isOpFailureExpected(err) {
+			b.opsFailures.WithLabelValues(op).Inc()
+		}
+		return err
+	}
+	b.opsDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	return nil
+}
+
+func (b *metricBucket) SupportsBatchDelete() bool {
+	return SupportsBatchDelete(b.bkt)
+}
+
+func (b *metricBucket) DeleteObjects(ctx context.Context, names []string) error {
+	const op = OpDeleteMany
+	b.ops.WithLabelValues(op).Inc()
+
+	start := time.Now()
+	if err := deleteObjects(ctx, b.bkt, names); err != nil {
+		if !b.isOpFailureExpected(err) {
+			b.opsFailures.WithLabelValues(op).Inc()
+		}
+		return err
+	}
+	b.opsDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	return nil
+}
+
 func (b *metricBucket) IsObjNotFoundErr(err error) bool {
 	return b.bkt.IsObjNotFoundErr(err)
 }
@@ -4,19 +4,26 @@
 package objstore
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/go-kit/kit/log"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 
+	"github.com/thanos-io/thanos/pkg/pool"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
 
 func TestMetricBucket_Close(t *testing.T) {
 	bkt := BucketWithMetrics("abc", NewInMemBucket(), nil)
 	// Expected initialized metrics.
-	testutil.Equals(t, 7, promtest.CollectAndCount(bkt.ops))
-	testutil.Equals(t, 7, promtest.CollectAndCount(bkt.opsFailures))
-	testutil.Equals(t, 7, promtest.CollectAndCount(bkt.opsDuration))
+	testutil.Equals(t, 9, promtest.CollectAndCount(bkt.ops))
+	testutil.Equals(t, 9, promtest.CollectAndCount(bkt.opsFailures))
+	testutil.Equals(t, 9, promtest.CollectAndCount(bkt.opsDuration))
 
 	AcceptanceTest(t, bkt.WithExpectedErrs(bkt.IsObjNotFoundErr))
 	testutil.Equals(t, float64(6), promtest.ToFloat64(bkt.ops.WithLabelValues(OpIter)))
@@ -26,7 +33,7 @@ func TestMetricBucket_Close(t *testing.T) {
 	testutil.Equals(t, float64(2), promtest.ToFloat64(bkt.ops.WithLabelValues(OpExists)))
 	testutil.Equals(t, float64(6), promtest.ToFloat64(bkt.ops.WithLabelValues(OpUpload)))
 	testutil.Equals(t, float64(2), promtest.ToFloat64(bkt.ops.WithLabelValues(OpDelete)))
-	testutil.Equals(t, 7, promtest.CollectAndCount(bkt.ops))
+	testutil.Equals(t, 9, promtest.CollectAndCount(bkt.ops))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(bkt.opsFailures.WithLabelValues(OpIter)))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(bkt.opsFailures.WithLabelValues(OpAttributes)))
 	testutil.Equals(t, float64(1), promtest.ToFloat64(bkt.opsFailures.WithLabelValues(OpGet)))
@@ -34,8 +41,8 @@ func TestMetricBucket_Close(t *testing.T) {
 	testutil.Equals(t, float64(0), promtest.ToFloat64(bkt.opsFailures.WithLabelValues(OpExists)))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(bkt.opsFailures.WithLabelValues(OpUpload)))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(bkt.opsFailures.WithLabelValues(OpDelete)))
-	testutil.Equals(t, 7, promtest.CollectAndCount(bkt.opsFailures))
-	testutil.Equals(t, 7, promtest.CollectAndCount(bkt.opsDuration))
+	testutil.Equals(t, 9, promtest.CollectAndCount(bkt.opsFailures))
+	testutil.Equals(t, 9, promtest.CollectAndCount(bkt.opsDuration))
 	lastUpload := promtest.ToFloat64(bkt.lastSuccessfulUploadTime)
 	testutil.Assert(t, lastUpload > 0, "last upload not greater than 0, val: %f", lastUpload)
 
@@ -49,7 +56,7 @@ func TestMetricBucket_Close(t *testing.T) {
 	testutil.Equals(t, float64(4), promtest.ToFloat64(bkt.ops.WithLabelValues(OpExists)))
 	testutil.Equals(t, float64(12), promtest.ToFloat64(bkt.ops.WithLabelValues(OpUpload)))
 	testutil.Equals(t, float64(4), promtest.ToFloat64(bkt.ops.WithLabelValues(OpDelete)))
-	testutil.Equals(t, 7, promtest.CollectAndCount(bkt.ops))
+	testutil.Equals(t, 9, promtest.CollectAndCount(bkt.ops))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(bkt.opsFailures.WithLabelValues(OpIter)))
 	// Not expected not found error here.
 	testutil.Equals(t, float64(1), promtest.ToFloat64(bkt.opsFailures.WithLabelValues(OpAttributes)))
@@ -59,7 +66,49 @@ func TestMetricBucket_Close(t *testing.T) {
 	testutil.Equals(t, float64(0), promtest.ToFloat64(bkt.opsFailures.WithLabelValues(OpExists)))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(bkt.opsFailures.WithLabelValues(OpUpload)))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(bkt.opsFailures.WithLabelValues(OpDelete)))
-	testutil.Equals(t, 7, promtest.CollectAndCount(bkt.opsFailures))
-	testutil.Equals(t, 7, promtest.CollectAndCount(bkt.opsDuration))
+	testutil.Equals(t, 9, promtest.CollectAndCount(bkt.opsFailures))
+	testutil.Equals(t, 9, promtest.CollectAndCount(bkt.opsDuration))
 	testutil.Assert(t, promtest.ToFloat64(bkt.lastSuccessfulUploadTime) > lastUpload)
 }
+
+type countingBytesPool struct {
+	pool.BytesPool
+	gets, puts int
+}
+
+func (p *countingBytesPool) Get(sz int) (*[]byte, error) {
+	p.gets++
+	return p.BytesPool.Get(sz)
+}
+
+func (p *countingBytesPool) Put(b *[]byte) {
+	p.puts++
+	p.BytesPool.Put(b)
+}
+
+func TestDownloadDir_WithCopyBuffers(t *testing.T) {
+	ctx := context.Background()
+	bkt := NewInMemBucket()
+	testutil.Ok(t, bkt.Upload(ctx, "dir/a", strings.NewReader("content of a")))
+	testutil.Ok(t, bkt.Upload(ctx, "dir/sub/b", strings.NewReader(strings.Repeat("b", 100))))
+
+	tmpDir, err := ioutil.TempDir("", "test-download-dir")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bp, err := pool.NewBucketedBytesPool(16, 16, 2, 0)
+	testutil.Ok(t, err)
+	buffers := &countingBytesPool{BytesPool: bp}
+	testutil.Ok(t, DownloadDir(ctx, log.NewNopLogger(), bkt, "dir", tmpDir, WithCopyBuffers(buffers, 16)))
+
+	b, err := ioutil.ReadFile(filepath.Join(tmpDir, "a"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "content of a", string(b))
+	b, err = ioutil.ReadFile(filepath.Join(tmpDir, "sub", "b"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, strings.Repeat("b", 100), string(b))
+
+	// Every obtained buffer is returned.
+	testutil.Equals(t, 2, buffers.gets)
+	testutil.Equals(t, 2, buffers.puts)
+}
@@ -0,0 +1,342 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objtesting
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// ErrInjectedFault is the cause of errors injected by FaultyBucket.
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultConfig configures faults injected by FaultyBucket.
+type FaultConfig struct {
+	// ErrorRate is the probability of an operation failing with ErrInjectedFault instead of reaching the bucket.
+	ErrorRate float64
+	// Ops limits errors to the given operations, e.g. objstore.OpUpload. Errors are injected into all operations if empty.
+	Ops []string
+	// Latency is added to every operation, unless the context is done meanwhile.
+	Latency time.Duration
+	// PartialReadRate is the probability of a reader returned by Get or GetRange failing with ErrInjectedFault before
+	// the end of the object.
+	PartialReadRate float64
+	// ListingDelay emulates eventually consistent listings: objects uploaded through the bucket, and directories holding
+	// only such objects, are not listed by Iter until the delay passes, while objects deleted through the bucket are still
+	// listed. Reads stay strongly consistent, as assumed by objstore.Bucket.
+	ListingDelay time.Duration
+	// Seed of the random generator deciding which operations fail, so faults are reproducible.
+	Seed int64
+}
+
+// FaultyBucket is an objstore.Bucket injecting faults configured by FaultConfig into operations of the wrapped bucket,
+// e.g. to test retries of code using the bucket. Go-routine safe.
+type FaultyBucket struct {
+	objstore.Bucket
+
+	cfg FaultConfig
+	ops map[string]struct{}
+	now func() time.Time
+
+	mtx      sync.Mutex
+	rnd      *rand.Rand
+	uploaded map[string]time.Time
+	deleted  map[string]time.Time
+	injected map[string]int
+}
+
+// NewFaultyBucket returns FaultyBucket wrapping the given bucket.
+func NewFaultyBucket(bkt objstore.Bucket, cfg FaultConfig) *FaultyBucket {
+	b := &FaultyBucket{
+		Bucket:   bkt,
+		cfg:      cfg,
+		now:      time.Now,
+		rnd:      rand.New(rand.NewSource(cfg.Seed)),
+		uploaded: map[string]time.Time{},
+		deleted:  map[string]time.Time{},
+		injected: map[string]int{},
+	}
+	if len(cfg.Ops) > 0 {
+		b.ops = map[string]struct{}{}
+		for _, op := range cfg.Ops {
+			b.ops[op] = struct{}{}
+		}
+	}
+	return b
+}
+
+// Injected returns the number of faults injected into the given operation so far, including partial reads.
+func (b *FaultyBucket) Injected(op string) int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.injected[op]
+}
+
+// Settle makes all uploads and deletions done so far visible to listings, as if ListingDelay passed.
+func (b *FaultyBucket) Settle() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.uploaded = map[string]time.Time{}
+	b.deleted = map[string]time.Time{}
+}
+
+// fault waits for the configured latency and returns the error to inject into the given operation, if any.
+func (b *FaultyBucket) fault(ctx context.Context, op string) error {
+	if b.cfg.Latency > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(b.cfg.Latency):
+		}
+	}
+	if b.ops != nil {
+		if _, ok := b.ops[op]; !ok {
+			return nil
+		}
+	}
+	if !b.roll(op, b.cfg.ErrorRate) {
+		return nil
+	}
+	return errors.Wrapf(ErrInjectedFault, "%s", op)
+}
+
+// roll returns true with the given probability, counting it as a fault injected into the given operation.
+func (b *FaultyBucket) roll(op string, p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.rnd.Float64() >= p {
+		return false
+	}
+	b.injected[op]++
+	return true
+}
+
+// Iter implements objstore.Bucket.
+func (b *FaultyBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	if err := b.fault(ctx, objstore.OpIter); err != nil {
+		return err
+	}
+	if b.cfg.ListingDelay <= 0 {
+		return b.Bucket.Iter(ctx, dir, f)
+	}
+
+	if dir != "" && !strings.HasSuffix(dir, objstore.DirDelim) {
+		dir += objstore.DirDelim
+	}
+
+	b.mtx.Lock()
+	var (
+		now     = b.now()
+		pending = map[string]struct{}{}
+		deleted = map[string]struct{}{}
+	)
+	for name, t := range b.uploaded {
+		if now.Sub(t) < b.cfg.ListingDelay {
+			pending[name] = struct{}{}
+		}
+	}
+	for name, t := range b.deleted {
+		if now.Sub(t) < b.cfg.ListingDelay && strings.HasPrefix(name, dir) {
+			deleted[entry(dir, name)] = struct{}{}
+		}
+	}
+	b.mtx.Unlock()
+
+	listed := map[string]struct{}{}
+	if err := b.Bucket.Iter(ctx, dir, func(name string) error {
+		listed[name] = struct{}{}
+		visible, err := b.visible(ctx, name, pending)
+		if err != nil || !visible {
+			return err
+		}
+		return f(name)
+	}); err != nil {
+		return err
+	}
+	for name := range deleted {
+		if _, ok := listed[name]; ok {
+			continue
+		}
+		if err := f(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entry returns the entry of the given directory listed for the object with the given name within the directory.
+func entry(dir, name string) string {
+	rest := strings.TrimPrefix(name, dir)
+	if i := strings.Index(rest, objstore.DirDelim); i >= 0 {
+		return dir + rest[:i+1]
+	}
+	return name
+}
+
+// visible returns true if the listed entry is an object not pending in listings or a directory with such an object.
+func (b *FaultyBucket) visible(ctx context.Context, name string, pending map[string]struct{}) (bool, error) {
+	if !strings.HasSuffix(name, objstore.DirDelim) {
+		_, ok := pending[name]
+		return !ok, nil
+	}
+	hasPending := false
+	for p := range pending {
+		if strings.HasPrefix(p, name) {
+			hasPending = true
+			break
+		}
+	}
+	if !hasPending {
+		return true, nil
+	}
+
+	visible := false
+	errFound := errors.New("found")
+	err := b.Bucket.Iter(ctx, name, func(child string) error {
+		v, err := b.visible(ctx, child, pending)
+		if err != nil {
+			return err
+		}
+		if v {
+			visible = true
+			return errFound
+		}
+		return nil
+	})
+	if err != nil && err != errFound {
+		return false, err
+	}
+	return visible, nil
+}
+
+// Get implements objstore.Bucket.
+func (b *FaultyBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.fault(ctx, objstore.OpGet); err != nil {
+		return nil, err
+	}
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return b.partialReader(ctx, objstore.OpGet, name, rc, -1), nil
+}
+
+// GetRange implements objstore.Bucket.
+func (b *FaultyBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.fault(ctx, objstore.OpGetRange); err != nil {
+		return nil, err
+	}
+	rc, err := b.Bucket.GetRange(ctx, name, off, length)
+	if err != nil {
+		return nil, err
+	}
+	return b.partialReader(ctx, objstore.OpGetRange, name, rc, length), nil
+}
+
+// partialReader returns a reader failing before the end of the given object or range of the given length, if the
+// partial read rate says so. Length of -1 means the whole object.
+func (b *FaultyBucket) partialReader(ctx context.Context, op, name string, rc io.ReadCloser, length int64) io.ReadCloser {
+	if !b.roll(op, b.cfg.PartialReadRate) {
+		return rc
+	}
+	if length < 0 {
+		attrs, err := b.Bucket.Attributes(ctx, name)
+		if err != nil {
+			return rc
+		}
+		length = attrs.Size
+	}
+
+	b.mtx.Lock()
+	var limit int64
+	if length > 0 {
+		limit = b.rnd.Int63n(length)
+	}
+	b.mtx.Unlock()
+	return &failingReader{ReadCloser: rc, remaining: limit, err: errors.Wrapf(ErrInjectedFault, "partial %s of %s", op, name)}
+}
+
+// failingReader fails with the given error once it read the given number of bytes.
+type failingReader struct {
+	io.ReadCloser
+
+	remaining int64
+	err       error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, r.err
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// Exists implements objstore.Bucket.
+func (b *FaultyBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.fault(ctx, objstore.OpExists); err != nil {
+		return false, err
+	}
+	return b.Bucket.Exists(ctx, name)
+}
+
+// Attributes implements objstore.Bucket.
+func (b *FaultyBucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	if err := b.fault(ctx, objstore.OpAttributes); err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	return b.Bucket.Attributes(ctx, name)
+}
+
+// Upload implements objstore.Bucket.
+func (b *FaultyBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.fault(ctx, objstore.OpUpload); err != nil {
+		return err
+	}
+	if err := b.Bucket.Upload(ctx, name, r); err != nil {
+		return err
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.uploaded[name] = b.now()
+	delete(b.deleted, name)
+	return nil
+}
+
+// Delete implements objstore.Bucket.
+func (b *FaultyBucket) Delete(ctx context.Context, name string) error {
+	if err := b.fault(ctx, objstore.OpDelete); err != nil {
+		return err
+	}
+	if err := b.Bucket.Delete(ctx, name); err != nil {
+		return err
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.deleted[name] = b.now()
+	delete(b.uploaded, name)
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objtesting
+
+import (
+	"context"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestFaultyBucket(t *testing.T) {
+	ctx := context.Background()
+	list := func(bkt objstore.Bucket, dir string) []string {
+		var names []string
+		testutil.Ok(t, bkt.Iter(ctx, dir, func(name string) error {
+			names = append(names, name)
+			return nil
+		}))
+		sort.Strings(names)
+		return names
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		bkt := NewFaultyBucket(objstore.NewInMemBucket(), FaultConfig{ErrorRate: 1, Ops: []string{objstore.OpUpload}})
+		err := bkt.Upload(ctx, "a", strings.NewReader("a"))
+		testutil.NotOk(t, err)
+		testutil.Equals(t, ErrInjectedFault, errors.Cause(err))
+		testutil.Equals(t, 1, bkt.Injected(objstore.OpUpload))
+
+		exists, err := bkt.Exists(ctx, "a")
+		testutil.Ok(t, err)
+		testutil.Assert(t, !exists)
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		bkt := NewFaultyBucket(objstore.NewInMemBucket(), FaultConfig{Latency: time.Hour})
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		testutil.Equals(t, context.Canceled, bkt.Upload(cctx, "a", strings.NewReader("a")))
+	})
+
+	t.Run("partial reads", func(t *testing.T) {
+		bkt := NewFaultyBucket(objstore.NewInMemBucket(), FaultConfig{PartialReadRate: 1})
+		testutil.Ok(t, bkt.Upload(ctx, "a", strings.NewReader("abcdefgh")))
+
+		rc, err := bkt.Get(ctx, "a")
+		testutil.Ok(t, err)
+		b, err := ioutil.ReadAll(rc)
+		testutil.Equals(t, ErrInjectedFault, errors.Cause(err))
+		testutil.Assert(t, len(b) < 8, "read whole object")
+		testutil.Ok(t, rc.Close())
+
+		rc, err = bkt.GetRange(ctx, "a", 2, 4)
+		testutil.Ok(t, err)
+		b, err = ioutil.ReadAll(rc)
+		testutil.Equals(t, ErrInjectedFault, errors.Cause(err))
+		testutil.Assert(t, len(b) < 4, "read whole range")
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, 1, bkt.Injected(objstore.OpGetRange))
+	})
+
+	t.Run("listing delay", func(t *testing.T) {
+		inmem := objstore.NewInMemBucket()
+		testutil.Ok(t, inmem.Upload(ctx, "dir/old", strings.NewReader("a")))
+		testutil.Ok(t, inmem.Upload(ctx, "gone/obj", strings.NewReader("a")))
+
+		bkt := NewFaultyBucket(inmem, FaultConfig{ListingDelay: time.Hour})
+		testutil.Ok(t, bkt.Upload(ctx, "dir/new", strings.NewReader("a")))
+		testutil.Ok(t, bkt.Upload(ctx, "new/obj", strings.NewReader("a")))
+		testutil.Ok(t, bkt.Delete(ctx, "gone/obj"))
+
+		testutil.Equals(t, []string{"dir/", "gone/"}, list(bkt, ""))
+		testutil.Equals(t, []string{"dir/old"}, list(bkt, "dir"))
+		testutil.Equals(t, []string{"gone/obj"}, list(bkt, "gone/"))
+		// Reads are consistent.
+		exists, err := bkt.Exists(ctx, "new/obj")
+		testutil.Ok(t, err)
+		testutil.Assert(t, exists)
+
+		bkt.Settle()
+		testutil.Equals(t, []string{"dir/", "new/"}, list(bkt, ""))
+		testutil.Equals(t, []string{"dir/new", "dir/old"}, list(bkt, "dir"))
+	})
+}
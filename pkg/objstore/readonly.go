@@ -0,0 +1,77 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrReadOnly is returned by ReadOnlyBucket for all operations changing the bucket.
+var ErrReadOnly = errors.New("bucket is read-only")
+
+// ReadOnlyBucket is a Bucket rejecting all operations changing the bucket with ErrReadOnly, logging and counting them,
+// e.g. to run a component against a production bucket from a staging environment. Conditional uploads, server-side
+// copies and batch deletes are not supported, so helpers of this package fall back to the rejected Upload and Delete.
+type ReadOnlyBucket struct {
+	Bucket
+
+	instr  InstrumentedBucket
+	logger log.Logger
+	denied *prometheus.CounterVec
+}
+
+// NewReadOnlyBucket returns ReadOnlyBucket wrapping the given bucket, registering its metrics in the given registerer.
+func NewReadOnlyBucket(logger log.Logger, bkt InstrumentedBucket, reg prometheus.Registerer) *ReadOnlyBucket {
+	b := &ReadOnlyBucket{
+		Bucket: bkt,
+		instr:  bkt,
+		logger: logger,
+		denied: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name:        "thanos_objstore_bucket_denied_operations_total",
+			Help:        "Total number of operations changing the read-only bucket that were denied.",
+			ConstLabels: prometheus.Labels{"bucket": bkt.Name()},
+		}, []string{"operation"}),
+	}
+	b.denied.WithLabelValues(OpUpload)
+	b.denied.WithLabelValues(OpDelete)
+	return b
+}
+
+// WithExpectedErrs implements InstrumentedBucket. The returned bucket is read-only as well.
+func (b *ReadOnlyBucket) WithExpectedErrs(fn IsOpFailureExpectedFunc) Bucket {
+	return &ReadOnlyBucket{Bucket: b.instr.WithExpectedErrs(fn), instr: b.instr, logger: b.logger, denied: b.denied}
+}
+
+// ReaderWithExpectedErrs implements InstrumentedBucket.
+func (b *ReadOnlyBucket) ReaderWithExpectedErrs(fn IsOpFailureExpectedFunc) BucketReader {
+	return b.instr.ReaderWithExpectedErrs(fn)
+}
+
+// Upload implements Bucket. It always fails with ErrReadOnly.
+func (b *ReadOnlyBucket) Upload(_ context.Context, name string, _ io.Reader) error {
+	return b.deny(OpUpload, name)
+}
+
+// Delete implements Bucket. It always fails with ErrReadOnly.
+func (b *ReadOnlyBucket) Delete(_ context.Context, name string) error {
+	return b.deny(OpDelete, name)
+}
+
+func (b *ReadOnlyBucket) deny(op, name string) error {
+	b.denied.WithLabelValues(op).Inc()
+	level.Warn(b.logger).Log("msg", "denied operation changing read-only bucket", "operation", op, "name", name)
+	return errors.Wrapf(ErrReadOnly, "%s %s", op, name)
+}
+
+// IsReadOnlyErr returns true if the error is caused by an operation denied by ReadOnlyBucket.
+func IsReadOnlyErr(err error) bool {
+	return errors.Cause(err) == ErrReadOnly
+}
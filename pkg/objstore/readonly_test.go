@@ -0,0 +1,51 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestReadOnlyBucket(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "a", bytes.NewReader([]byte("content"))))
+
+	b := NewReadOnlyBucket(log.NewNopLogger(), BucketWithMetrics("", inmem, nil), prometheus.NewRegistry())
+	testutil.Assert(t, !SupportsConditionalUpload(b), "conditional uploads must not be delegated")
+	testutil.Assert(t, !SupportsServerSideCopy(b), "server side copies must not be delegated")
+	testutil.Assert(t, !SupportsBatchDelete(b), "batch deletes must not be delegated")
+
+	// Reads are passed through.
+	rc, err := b.Get(ctx, "a")
+	testutil.Ok(t, err)
+	content, err := ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "content", string(content))
+
+	for _, err := range []error{
+		b.Upload(ctx, "b", bytes.NewReader([]byte("content"))),
+		b.WithExpectedErrs(b.IsObjNotFoundErr).Delete(ctx, "a"),
+		b.Delete(ctx, "a"),
+		UploadIfNotExists(ctx, b, "b", []byte("content")),
+		Copy(ctx, b, "a", "b"),
+		DeleteObjects(ctx, b, []string{"a"}),
+	} {
+		testutil.NotOk(t, err)
+		testutil.Assert(t, IsReadOnlyErr(err), "expected read-only error, got %v", err)
+	}
+	testutil.Equals(t, 3.0, promtest.ToFloat64(b.denied.WithLabelValues(OpUpload)))
+	testutil.Equals(t, 3.0, promtest.ToFloat64(b.denied.WithLabelValues(OpDelete)))
+	testutil.Equals(t, map[string][]byte{"a": []byte("content")}, inmem.Objects())
+}
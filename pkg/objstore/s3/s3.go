@@ -55,6 +55,10 @@ var DefaultConfig = Config{
 	// Minimum file size after which an HTTP multipart request should be used to upload objects to storage.
 	// Set to 128 MiB as in the minio client.
 	PartSize: 1024 * 1024 * 128,
+	Capabilities: CapabilitiesConfig{
+		BatchDelete:    true,
+		ServerSideCopy: true,
+	},
 }
 
 // Config stores the configuration for s3 bucket.
@@ -70,8 +74,18 @@ type Config struct {
 	HTTPConfig      HTTPConfig        `yaml:"http_config"`
 	TraceConfig     TraceConfig       `yaml:"trace"`
 	// PartSize used for multipart upload. Only used if uploaded object size is known and larger than configured PartSize.
-	PartSize  uint64    `yaml:"part_size"`
-	SSEConfig SSEConfig `yaml:"sse_config"`
+	PartSize     uint64             `yaml:"part_size"`
+	SSEConfig    SSEConfig          `yaml:"sse_config"`
+	Capabilities CapabilitiesConfig `yaml:"capabilities"`
+}
+
+// CapabilitiesConfig enables optional S3 APIs, which some S3 compatible providers do not implement. Disabled APIs are
+// replaced by the basic ones, e.g. objects are deleted one by one.
+type CapabilitiesConfig struct {
+	// BatchDelete enables deletion of multiple objects with a single DeleteObjects request.
+	BatchDelete bool `yaml:"batch_delete"`
+	// ServerSideCopy enables copying of objects within the bucket with CopyObject and UploadPartCopy requests.
+	ServerSideCopy bool `yaml:"server_side_copy"`
 }
 
 // SSEConfig deals with the configuration of SSE for Minio. The following options are valid:
@@ -102,6 +116,7 @@ type Bucket struct {
 	sse             encrypt.ServerSide
 	putUserMetadata map[string]string
 	partSize        uint64
+	capabilities    CapabilitiesConfig
 }
 
 // parseConfig unmarshals a buffer into a Config with default HTTPConfig values.
@@ -234,6 +249,7 @@ func NewBucketWithConfig(logger log.Logger, config Config, component string) (*B
 		sse:             sse,
 		putUserMetadata: config.PutUserMetadata,
 		partSize:        config.PartSize,
+		capabilities:    config.Capabilities,
 	}
 	return bkt, nil
 }
@@ -414,6 +430,49 @@ func (b *Bucket) Delete(ctx context.Context, name string) error {
 	return b.client.RemoveObject(ctx, b.name, name, minio.RemoveObjectOptions{})
 }
 
+// SupportsServerSideCopy implements objstore.Copier.
+func (b *Bucket) SupportsServerSideCopy() bool { return b.capabilities.ServerSideCopy }
+
+// Copy copies the object src into the object dst within the bucket. Objects larger than 5GiB are copied part by part.
+func (b *Bucket) Copy(ctx context.Context, src, dst string) error {
+	dstOpts := minio.CopyDestOptions{
+		Bucket:          b.name,
+		Object:          dst,
+		Encryption:      b.sse,
+		UserMetadata:    b.putUserMetadata,
+		ReplaceMetadata: len(b.putUserMetadata) > 0,
+	}
+	srcOpts := minio.CopySrcOptions{
+		Bucket:     b.name,
+		Object:     src,
+		Encryption: encrypt.SSECopy(b.sse),
+	}
+	if _, err := b.client.ComposeObject(ctx, dstOpts, srcOpts); err != nil {
+		return errors.Wrap(err, "copy s3 object")
+	}
+	return nil
+}
+
+// SupportsBatchDelete implements objstore.BatchDeleter.
+func (b *Bucket) SupportsBatchDelete() bool { return b.capabilities.BatchDelete }
+
+// DeleteObjects deletes the given objects with DeleteObjects requests of up to 1000 objects each.
+func (b *Bucket) DeleteObjects(ctx context.Context, names []string) error {
+	objects := make(chan minio.ObjectInfo, len(names))
+	for _, name := range names {
+		objects <- minio.ObjectInfo{Key: name}
+	}
+	close(objects)
+
+	var firstErr error
+	for err := range b.client.RemoveObjects(ctx, b.name, objects, minio.RemoveObjectsOptions{}) {
+		if firstErr == nil && !b.IsObjNotFoundErr(err.Err) {
+			firstErr = errors.Wrapf(err.Err, "delete s3 object %s", err.ObjectName)
+		}
+	}
+	return firstErr
+}
+
 // IsObjNotFoundErr returns true if error means that object is not found. Relevant to Get operations.
 func (b *Bucket) IsObjNotFoundErr(err error) bool {
 	return minio.ToErrorResponse(err).Code == "NoSuchKey"
@@ -6,6 +6,7 @@ package objstore
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"sort"
@@ -79,6 +80,30 @@ func (b noopInstrumentedBucket) ReaderWithExpectedErrs(IsOpFailureExpectedFunc)
 	return b
 }
 
+func (b noopInstrumentedBucket) SupportsConditionalUpload() bool {
+	return SupportsConditionalUpload(b.Bucket)
+}
+
+func (b noopInstrumentedBucket) UploadIfNotExists(ctx context.Context, name string, r io.Reader) error {
+	return uploadIfNotExists(ctx, b.Bucket, name, r)
+}
+
+func (b noopInstrumentedBucket) SupportsServerSideCopy() bool {
+	return SupportsServerSideCopy(b.Bucket)
+}
+
+func (b noopInstrumentedBucket) Copy(ctx context.Context, src, dst string) error {
+	return copyObject(ctx, b.Bucket, src, dst)
+}
+
+func (b noopInstrumentedBucket) SupportsBatchDelete() bool {
+	return SupportsBatchDelete(b.Bucket)
+}
+
+func (b noopInstrumentedBucket) DeleteObjects(ctx context.Context, names []string) error {
+	return deleteObjects(ctx, b.Bucket, names)
+}
+
 func AcceptanceTest(t *testing.T, bkt Bucket) {
 	ctx := context.Background()
 
@@ -81,6 +81,18 @@ func (t TracingBucket) Upload(ctx context.Context, name string, r io.Reader) (er
 	return
 }
 
+func (t TracingBucket) SupportsConditionalUpload() bool {
+	return SupportsConditionalUpload(t.bkt)
+}
+
+func (t TracingBucket) UploadIfNotExists(ctx context.Context, name string, r io.Reader) (err error) {
+	tracing.DoWithSpan(ctx, "bucket_upload_if_not_exists", func(spanCtx context.Context, span opentracing.Span) {
+		span.LogKV("name", name)
+		err = uploadIfNotExists(spanCtx, t.bkt, name, r)
+	})
+	return
+}
+
 func (t TracingBucket) Delete(ctx context.Context, name string) (err error) {
 	tracing.DoWithSpan(ctx, "bucket_delete", func(spanCtx context.Context, span opentracing.Span) {
 		span.LogKV("name", name)
@@ -89,6 +101,30 @@ func (t TracingBucket) Delete(ctx context.Context, name string) (err error) {
 	return
 }
 
+func (t TracingBucket) SupportsServerSideCopy() bool {
+	return SupportsServerSideCopy(t.bkt)
+}
+
+func (t TracingBucket) Copy(ctx context.Context, src, dst string) (err error) {
+	tracing.DoWithSpan(ctx, "bucket_copy", func(spanCtx context.Context, span opentracing.Span) {
+		span.LogKV("src", src, "dst", dst)
+		err = copyObject(spanCtx, t.bkt, src, dst)
+	})
+	return
+}
+
+func (t TracingBucket) SupportsBatchDelete() bool {
+	return SupportsBatchDelete(t.bkt)
+}
+
+func (t TracingBucket) DeleteObjects(ctx context.Context, names []string) (err error) {
+	tracing.DoWithSpan(ctx, "bucket_delete_many", func(spanCtx context.Context, span opentracing.Span) {
+		span.LogKV("objects", len(names))
+		err = deleteObjects(spanCtx, t.bkt, names)
+	})
+	return
+}
+
 func (t TracingBucket) Name() string {
 	return "tracing: " + t.bkt.Name()
 }
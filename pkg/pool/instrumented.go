@@ -0,0 +1,122 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package pool
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// InstrumentedBytesPool is a BytesPool exposing its utilization as metrics labeled with the name of the pool.
+type InstrumentedBytesPool struct {
+	BytesPool
+
+	inUse    int64
+	gets     prometheus.Counter
+	failures prometheus.Counter
+}
+
+// NewInstrumentedBytesPool returns InstrumentedBytesPool wrapping the given pool.
+func NewInstrumentedBytesPool(reg prometheus.Registerer, name string, p BytesPool) *InstrumentedBytesPool {
+	ip := &InstrumentedBytesPool{
+		BytesPool: p,
+		gets: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "thanos_bytes_pool_gets_total",
+			Help:        "Total number of byte slices obtained from the pool.",
+			ConstLabels: prometheus.Labels{"pool": name},
+		}),
+		failures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "thanos_bytes_pool_get_failures_total",
+			Help:        "Total number of failed attempts to obtain a byte slice from the pool, e.g. because it is exhausted.",
+			ConstLabels: prometheus.Labels{"pool": name},
+		}),
+	}
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "thanos_bytes_pool_in_use_bytes",
+		Help:        "Capacity of byte slices obtained from the pool and not returned yet.",
+		ConstLabels: prometheus.Labels{"pool": name},
+	}, func() float64 { return float64(atomic.LoadInt64(&ip.inUse)) })
+	return ip
+}
+
+// Get implements BytesPool.
+func (p *InstrumentedBytesPool) Get(sz int) (*[]byte, error) {
+	b, err := p.BytesPool.Get(sz)
+	if err != nil {
+		p.failures.Inc()
+		return nil, err
+	}
+	p.gets.Inc()
+	atomic.AddInt64(&p.inUse, int64(cap(*b)))
+	return b, nil
+}
+
+// Put implements BytesPool.
+func (p *InstrumentedBytesPool) Put(b *[]byte) {
+	if b == nil {
+		return
+	}
+	atomic.AddInt64(&p.inUse, -int64(cap(*b)))
+	p.BytesPool.Put(b)
+}
+
+// InstrumentedChunkPool is a chunkenc.Pool exposing its utilization as metrics labeled with the name of the pool and
+// the chunk encoding.
+type InstrumentedChunkPool struct {
+	chunkenc.Pool
+
+	gets *prometheus.CounterVec
+	puts *prometheus.CounterVec
+}
+
+// NewInstrumentedChunkPool returns InstrumentedChunkPool wrapping the given pool.
+func NewInstrumentedChunkPool(reg prometheus.Registerer, name string, p chunkenc.Pool) *InstrumentedChunkPool {
+	return &InstrumentedChunkPool{
+		Pool: p,
+		gets: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name:        "thanos_chunk_pool_gets_total",
+			Help:        "Total number of chunks obtained from the pool.",
+			ConstLabels: prometheus.Labels{"pool": name},
+		}, []string{"encoding"}),
+		puts: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name:        "thanos_chunk_pool_puts_total",
+			Help:        "Total number of chunks returned to the pool for reuse.",
+			ConstLabels: prometheus.Labels{"pool": name},
+		}, []string{"encoding"}),
+	}
+}
+
+// Get implements chunkenc.Pool.
+func (p *InstrumentedChunkPool) Get(e chunkenc.Encoding, b []byte) (chunkenc.Chunk, error) {
+	c, err := p.Pool.Get(e, b)
+	if err != nil {
+		return nil, err
+	}
+	p.gets.WithLabelValues(encodingLabel(e)).Inc()
+	return c, nil
+}
+
+// Put implements chunkenc.Pool.
+func (p *InstrumentedChunkPool) Put(c chunkenc.Chunk) error {
+	e := c.Encoding()
+	if err := p.Pool.Put(c); err != nil {
+		return err
+	}
+	p.puts.WithLabelValues(encodingLabel(e)).Inc()
+	return nil
+}
+
+// encodingLabel returns name of the given chunk encoding, or its number for encodings unknown to TSDB, e.g. the Thanos
+// aggregated chunk encoding.
+func encodingLabel(e chunkenc.Encoding) string {
+	switch e {
+	case chunkenc.EncNone, chunkenc.EncXOR:
+		return e.String()
+	}
+	return strconv.Itoa(int(e))
+}
@@ -11,6 +11,9 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
 	"go.uber.org/goleak"
 
 	"github.com/thanos-io/thanos/pkg/testutil"
@@ -124,3 +127,38 @@ func TestRacePutGet(t *testing.T) {
 	default:
 	}
 }
+
+func TestInstrumentedBytesPool(t *testing.T) {
+	bp, err := NewBucketedBytesPool(10, 100, 2, 100)
+	testutil.Ok(t, err)
+	p := NewInstrumentedBytesPool(prometheus.NewRegistry(), "test", bp)
+
+	b1, err := p.Get(15)
+	testutil.Ok(t, err)
+	b2, err := p.Get(30)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(60), p.inUse)
+	testutil.Equals(t, 2.0, promtest.ToFloat64(p.gets))
+
+	_, err = p.Get(80)
+	testutil.Equals(t, ErrPoolExhausted, err)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(p.failures))
+
+	p.Put(b1)
+	p.Put(b2)
+	p.Put(nil)
+	testutil.Equals(t, int64(0), p.inUse)
+}
+
+func TestInstrumentedChunkPool(t *testing.T) {
+	p := NewInstrumentedChunkPool(prometheus.NewRegistry(), "test", chunkenc.NewPool())
+
+	c, err := p.Get(chunkenc.EncXOR, nil)
+	testutil.Ok(t, err)
+	testutil.Ok(t, p.Put(c))
+	_, err = p.Get(chunkenc.Encoding(0xff), nil)
+	testutil.NotOk(t, err)
+
+	testutil.Equals(t, 1.0, promtest.ToFloat64(p.gets.WithLabelValues("XOR")))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(p.puts.WithLabelValues("XOR")))
+}
@@ -24,6 +24,7 @@ import (
 	grpc_health "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
 
+	"github.com/thanos-io/thanos/pkg/compact/compactpb"
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/prober"
 	"github.com/thanos-io/thanos/pkg/rules/rulespb"
@@ -44,6 +45,7 @@ type Server struct {
 
 // New creates a new gRPC Store API.
 // If rulesSrv is not nil, it also registers Rules API to the returned server.
+// If storeSrv is nil, neither Store nor Rules API is registered, e.g. to serve only the Compactor API.
 func New(logger log.Logger, reg prometheus.Registerer, tracer opentracing.Tracer, comp component.Component, probe *prober.GRPCProbe, storeSrv storepb.StoreServer, rulesSrv rulespb.RulesServer, opts ...Option) *Server {
 	logger = log.With(logger, "service", "gRPC/server", "component", comp.String())
 	options := options{
@@ -87,14 +89,20 @@ func New(logger log.Logger, reg prometheus.Registerer, tracer opentracing.Tracer
 	}
 	s := grpc.NewServer(grpcOpts...)
 
-	if rulesSrv != nil {
+	switch {
+	case storeSrv == nil:
+	case rulesSrv != nil:
 		rulespb.RegisterRulesServer(s, rulesSrv)
 		storepb.RegisterStoreServer(s, storeSrv)
 		level.Info(logger).Log("msg", "registering as gRPC StoreAPI and RulesAPI")
-	} else {
+	default:
 		storepb.RegisterStoreServer(s, storeSrv)
 		level.Info(logger).Log("msg", "registering as gRPC StoreAPI")
 	}
+	if options.compactorSrv != nil {
+		compactpb.RegisterCompactorServer(s, options.compactorSrv)
+		level.Info(logger).Log("msg", "registering as gRPC CompactorAPI")
+	}
 
 	met.InitializeMetrics(s)
 	reg.MustRegister(met)
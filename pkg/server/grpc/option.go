@@ -6,6 +6,8 @@ package grpc
 import (
 	"crypto/tls"
 	"time"
+
+	"github.com/thanos-io/thanos/pkg/compact/compactpb"
 )
 
 const UnixSocket = "/tmp/test.sock"
@@ -16,6 +18,8 @@ type options struct {
 	network     string
 
 	tlsConfig *tls.Config
+
+	compactorSrv compactpb.CompactorServer
 }
 
 // Option overrides behavior of Server.
@@ -58,3 +62,10 @@ func WithTLSConfig(cfg *tls.Config) Option {
 		o.tlsConfig = cfg
 	})
 }
+
+// WithCompactorServer registers the given Compactor API server.
+func WithCompactorServer(srv compactpb.CompactorServer) Option {
+	return optionFunc(func(o *options) {
+		o.compactorSrv = srv
+	})
+}
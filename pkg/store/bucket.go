@@ -31,6 +31,7 @@ import (
 	"github.com/prometheus/prometheus/tsdb/chunks"
 	"github.com/prometheus/prometheus/tsdb/encoding"
 	"github.com/prometheus/prometheus/tsdb/index"
+	"go.uber.org/atomic"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -569,6 +570,32 @@ func (s *BucketStore) removeBlock(id ulid.ULID) error {
 	return os.RemoveAll(b.dir)
 }
 
+// LoadedBlocks returns IDs of all blocks loaded by the store.
+func (s *BucketStore) LoadedBlocks() []ulid.ULID {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	ids := make([]ulid.ULID, 0, len(s.blocks))
+	for id := range s.blocks {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// PinnedBlocks returns IDs of loaded blocks currently read by queries.
+func (s *BucketStore) PinnedBlocks() []ulid.ULID {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	ids := []ulid.ULID{}
+	for id, b := range s.blocks {
+		if b.readers.Load() > 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
 // TimeRange returns the minimum and maximum timestamp of data available in the store.
 func (s *BucketStore) TimeRange() (mint, maxt int64) {
 	s.mtx.RLock()
@@ -1298,6 +1325,8 @@ type bucketBlock struct {
 	chunkObjs []string
 
 	pendingReaders sync.WaitGroup
+	// readers is the number of pending readers, which pin the block so the compactor defers its deletion.
+	readers atomic.Int64
 
 	partitioner partitioner
 
@@ -1398,11 +1427,13 @@ func (b *bucketBlock) readChunkRange(ctx context.Context, seq int, off, length i
 
 func (b *bucketBlock) indexReader(ctx context.Context) *bucketIndexReader {
 	b.pendingReaders.Add(1)
+	b.readers.Inc()
 	return newBucketIndexReader(ctx, b)
 }
 
 func (b *bucketBlock) chunkReader(ctx context.Context) *bucketChunkReader {
 	b.pendingReaders.Add(1)
+	b.readers.Inc()
 	return newBucketChunkReader(ctx, b)
 }
 
@@ -1992,6 +2023,7 @@ func (r *bucketIndexReader) LoadedSeries(ref uint64, lset *labels.Labels, chks *
 
 // Close released the underlying resources of the reader.
 func (r *bucketIndexReader) Close() error {
+	r.block.readers.Dec()
 	r.block.pendingReaders.Done()
 	return nil
 }
@@ -2173,6 +2205,7 @@ func (b rawChunk) NumSamples() int {
 }
 
 func (r *bucketChunkReader) Close() error {
+	r.block.readers.Dec()
 	r.block.pendingReaders.Done()
 
 	for _, b := range r.chunkBytes {
@@ -592,6 +592,18 @@ func TestBucketStore_Info(t *testing.T) {
 	testutil.Equals(t, []storepb.Label(nil), resp.Labels)
 }
 
+func TestBucketStore_PinnedBlocks(t *testing.T) {
+	id1, id2 := ulid.MustNew(1, nil), ulid.MustNew(2, nil)
+	b1, b2 := &bucketBlock{}, &bucketBlock{}
+	s := &BucketStore{blocks: map[ulid.ULID]*bucketBlock{id1: b1, id2: b2}}
+	testutil.Equals(t, []ulid.ULID{}, s.PinnedBlocks())
+
+	r := b2.chunkReader(context.Background())
+	testutil.Equals(t, []ulid.ULID{id2}, s.PinnedBlocks())
+	testutil.Ok(t, r.Close())
+	testutil.Equals(t, []ulid.ULID{}, s.PinnedBlocks())
+}
+
 type recorder struct {
 	mtx sync.Mutex
 	objstore.Bucket
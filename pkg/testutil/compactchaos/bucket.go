@@ -0,0 +1,313 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+// Package compactchaos injects faults into the compactor, i.e. compact.BucketCompactor, to test invariants it has to
+// keep across crashes, duplicate executions of compactions and lagging deletions of objects. It is meant for tests only,
+// also of downstream projects embedding the compactor.
+package compactchaos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// ErrCrashed is the cause of errors of all operations of Bucket once it crashed.
+var ErrCrashed = errors.New("compactor crashed")
+
+// Config configures faults injected by Bucket.
+type Config struct {
+	// CrashAfterUploads crashes the compactor once it uploaded this many new blocks since its last restart, right after
+	// meta.json of the last one, i.e. after a compaction uploaded its block but before it marked its sources for
+	// deletion. Zero disables crashes.
+	CrashAfterUploads int
+	// DuplicateUploads makes each new block uploaded once more under another ID, as if another compactor executed the
+	// same plan concurrently.
+	DuplicateUploads bool
+	// DeletionDelay delays deletions of objects: they succeed right away, while the objects are still read and listed
+	// until the delay passes or ApplyDeletions is called.
+	DeletionDelay time.Duration
+	// Seed of the random generator of IDs of duplicate blocks, so faults are reproducible.
+	Seed int64
+}
+
+// Bucket is an objstore.Bucket injecting faults configured by Config into the compactor using it. Once crashed, all its
+// operations fail with ErrCrashed until Restart is called, as no changes of a crashed process reach the bucket.
+// Go-routine safe.
+type Bucket struct {
+	objstore.Bucket
+
+	cfg Config
+	now func() time.Time
+
+	mtx        sync.Mutex
+	rnd        *rand.Rand
+	crashed    chan struct{}
+	uploads    int
+	duplicates map[ulid.ULID]ulid.ULID
+	pending    map[string]time.Time
+}
+
+// NewBucket returns Bucket wrapping the given bucket.
+func NewBucket(bkt objstore.Bucket, cfg Config) *Bucket {
+	return &Bucket{
+		Bucket:     bkt,
+		cfg:        cfg,
+		now:        time.Now,
+		rnd:        rand.New(rand.NewSource(cfg.Seed)),
+		crashed:    make(chan struct{}),
+		duplicates: map[ulid.ULID]ulid.ULID{},
+		pending:    map[string]time.Time{},
+	}
+}
+
+// Crashed returns a channel closed once the bucket crashed.
+func (b *Bucket) Crashed() <-chan struct{} {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.crashed
+}
+
+// Restart makes a crashed bucket usable again, as if the compactor restarted.
+func (b *Bucket) Restart() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	select {
+	case <-b.crashed:
+		b.crashed = make(chan struct{})
+	default:
+	}
+	b.uploads = 0
+}
+
+// Duplicates returns IDs of duplicate blocks uploaded so far by the IDs of the blocks they duplicate.
+func (b *Bucket) Duplicates() map[ulid.ULID]ulid.ULID {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	res := make(map[ulid.ULID]ulid.ULID, len(b.duplicates))
+	for id, dup := range b.duplicates {
+		res[id] = dup
+	}
+	return res
+}
+
+// ApplyDeletions deletes all objects whose deletion is delayed, as if DeletionDelay passed.
+func (b *Bucket) ApplyDeletions(ctx context.Context) error {
+	return b.applyDeletions(ctx, true)
+}
+
+func (b *Bucket) applyDeletions(ctx context.Context, all bool) error {
+	b.mtx.Lock()
+	var due []string
+	now := b.now()
+	for name, t := range b.pending {
+		if all || now.Sub(t) >= b.cfg.DeletionDelay {
+			due = append(due, name)
+			delete(b.pending, name)
+		}
+	}
+	b.mtx.Unlock()
+
+	for _, name := range due {
+		if err := b.Bucket.Delete(ctx, name); err != nil && !b.Bucket.IsObjNotFoundErr(err) {
+			return errors.Wrapf(err, "apply delayed deletion of %s", name)
+		}
+	}
+	return nil
+}
+
+// check fails with ErrCrashed once crashed and applies delayed deletions that are due.
+func (b *Bucket) check(ctx context.Context, op string) error {
+	select {
+	case <-b.Crashed():
+		return errors.Wrapf(ErrCrashed, "%s", op)
+	default:
+	}
+	if b.cfg.DeletionDelay > 0 {
+		return b.applyDeletions(ctx, false)
+	}
+	return nil
+}
+
+func (b *Bucket) deletionPending(name string) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	_, ok := b.pending[name]
+	return ok
+}
+
+// Iter implements objstore.Bucket.
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	if err := b.check(ctx, objstore.OpIter); err != nil {
+		return err
+	}
+	return b.Bucket.Iter(ctx, dir, f)
+}
+
+// Get implements objstore.Bucket.
+func (b *Bucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.check(ctx, objstore.OpGet); err != nil {
+		return nil, err
+	}
+	return b.Bucket.Get(ctx, name)
+}
+
+// GetRange implements objstore.Bucket.
+func (b *Bucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.check(ctx, objstore.OpGetRange); err != nil {
+		return nil, err
+	}
+	return b.Bucket.GetRange(ctx, name, off, length)
+}
+
+// Exists implements objstore.Bucket.
+func (b *Bucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.check(ctx, objstore.OpExists); err != nil {
+		return false, err
+	}
+	return b.Bucket.Exists(ctx, name)
+}
+
+// Attributes implements objstore.Bucket.
+func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	if err := b.check(ctx, objstore.OpAttributes); err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	return b.Bucket.Attributes(ctx, name)
+}
+
+// Upload implements objstore.Bucket. Uploads of meta.json of new blocks are counted towards crashes and duplicated.
+func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.check(ctx, objstore.OpUpload); err != nil {
+		return err
+	}
+	id, isMeta := blockMeta(name)
+	if !isMeta {
+		return b.Bucket.Upload(ctx, name, r)
+	}
+
+	exists, err := b.Bucket.Exists(ctx, name)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", name)
+	}
+	if err := b.Bucket.Upload(ctx, name, bytes.NewReader(content)); err != nil || exists {
+		return err
+	}
+
+	if b.cfg.DuplicateUploads {
+		if err := b.duplicate(ctx, id, content); err != nil {
+			return errors.Wrapf(err, "duplicate block %s", id)
+		}
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.uploads++
+	if b.cfg.CrashAfterUploads > 0 && b.uploads >= b.cfg.CrashAfterUploads {
+		select {
+		case <-b.crashed:
+		default:
+			close(b.crashed)
+		}
+	}
+	return nil
+}
+
+// Delete implements objstore.Bucket. With DeletionDelay, the object is deleted once the delay passes.
+func (b *Bucket) Delete(ctx context.Context, name string) error {
+	if err := b.check(ctx, objstore.OpDelete); err != nil {
+		return err
+	}
+	if b.cfg.DeletionDelay <= 0 {
+		return b.Bucket.Delete(ctx, name)
+	}
+	if b.deletionPending(name) {
+		return nil
+	}
+	exists, err := b.Bucket.Exists(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.Errorf("delete %s: object does not exist", name)
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.pending[name] = b.now()
+	return nil
+}
+
+// blockMeta returns the ID of the block of the given object and true if it is meta.json of a block.
+func blockMeta(name string) (ulid.ULID, bool) {
+	dir, file := path.Split(name)
+	if file != metadata.MetaFilename {
+		return ulid.ULID{}, false
+	}
+	id, err := ulid.Parse(strings.TrimSuffix(dir, objstore.DirDelim))
+	return id, err == nil
+}
+
+// duplicate copies all objects of the given block uploaded with the given meta.json under a new ID, uploading its
+// meta.json last, like a block uploaded by another compactor.
+func (b *Bucket) duplicate(ctx context.Context, id ulid.ULID, metaContent []byte) error {
+	var meta metadata.Meta
+	if err := json.Unmarshal(metaContent, &meta); err != nil {
+		return errors.Wrap(err, "decode meta.json")
+	}
+	b.mtx.Lock()
+	dup := ulid.MustNew(ulid.Timestamp(b.now()), b.rnd)
+	b.mtx.Unlock()
+
+	if err := copyDir(ctx, b.Bucket, id.String(), dup.String()); err != nil {
+		return err
+	}
+	meta.ULID = dup
+	dupContent, err := json.Marshal(&meta)
+	if err != nil {
+		return errors.Wrap(err, "encode meta.json")
+	}
+	if err := b.Bucket.Upload(ctx, path.Join(dup.String(), metadata.MetaFilename), bytes.NewReader(dupContent)); err != nil {
+		return err
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.duplicates[id] = dup
+	return nil
+}
+
+// copyDir copies all objects of the given directory of the bucket into the other directory, recursively, except
+// meta.json.
+func copyDir(ctx context.Context, bkt objstore.Bucket, src, dst string) error {
+	return bkt.Iter(ctx, src, func(name string) error {
+		target := path.Join(dst, strings.TrimPrefix(name, src+objstore.DirDelim))
+		if strings.HasSuffix(name, objstore.DirDelim) {
+			return copyDir(ctx, bkt, strings.TrimSuffix(name, objstore.DirDelim), target)
+		}
+		if path.Base(name) == metadata.MetaFilename {
+			return nil
+		}
+		return objstore.Copy(ctx, bkt, name, target)
+	})
+}
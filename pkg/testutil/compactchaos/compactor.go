@@ -0,0 +1,177 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compactchaos
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// NewCompactorFunc returns a new BucketCompactor, with a new Syncer, working on the given bucket, as after a restart of
+// the compactor.
+type NewCompactorFunc func(bkt objstore.InstrumentedBucket) (*compact.BucketCompactor, error)
+
+// Compactor runs compaction cycles of a BucketCompactor against Bucket, restarting it after crashes.
+type Compactor struct {
+	bkt          *Bucket
+	newCompactor NewCompactorFunc
+
+	comp     *compact.BucketCompactor
+	restarts int
+}
+
+// NewCompactor returns Compactor injecting faults configured by the given Config into compactors returned by the given
+// function, working on the given bucket.
+func NewCompactor(bkt objstore.Bucket, cfg Config, newCompactor NewCompactorFunc) *Compactor {
+	return &Compactor{bkt: NewBucket(bkt, cfg), newCompactor: newCompactor}
+}
+
+// Bucket returns the bucket injecting faults into the compactor.
+func (c *Compactor) Bucket() *Bucket {
+	return c.bkt
+}
+
+// Restarts returns the number of times the compactor was restarted after crashes.
+func (c *Compactor) Restarts() int {
+	return c.restarts
+}
+
+// Run runs a single compaction cycle, i.e. BucketCompactor.Compact. If the compactor crashes meanwhile, the cycle is
+// cancelled and Run returns an error caused by ErrCrashed; the next Run restarts the compactor first.
+func (c *Compactor) Run(ctx context.Context) error {
+	if c.comp == nil {
+		c.bkt.Restart()
+		comp, err := c.newCompactor(objstore.WithNoopInstr(c.bkt))
+		if err != nil {
+			return errors.Wrap(err, "create compactor")
+		}
+		c.comp = comp
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	crashed := c.bkt.Crashed()
+	go func() {
+		select {
+		case <-crashed:
+			cancel()
+		case <-runCtx.Done():
+		}
+	}()
+
+	err := c.comp.Compact(runCtx)
+	select {
+	case <-crashed:
+		c.comp = nil
+		c.restarts++
+		return errors.Wrapf(ErrCrashed, "compaction cycle: %v", err)
+	default:
+	}
+	return err
+}
+
+// IsCrashed returns true if the error is caused by a crash injected by Bucket.
+func IsCrashed(err error) bool {
+	return errors.Cause(err) == ErrCrashed
+}
+
+// liveBlocks returns metas of blocks of the bucket with meta.json and without deletion mark.
+func liveBlocks(ctx context.Context, logger log.Logger, bkt objstore.Bucket) (map[ulid.ULID]metadata.Meta, error) {
+	res := map[ulid.ULID]metadata.Meta{}
+	err := bkt.Iter(ctx, "", func(name string) error {
+		id, err := ulid.Parse(strings.TrimSuffix(name, objstore.DirDelim))
+		if err != nil {
+			return nil
+		}
+		if ok, err := bkt.Exists(ctx, path.Join(id.String(), metadata.MetaFilename)); err != nil || !ok {
+			return err
+		}
+		if ok, err := bkt.Exists(ctx, path.Join(id.String(), metadata.DeletionMarkFilename)); err != nil || ok {
+			return err
+		}
+		meta, err := block.DownloadMeta(ctx, logger, bkt, id)
+		if err != nil {
+			return err
+		}
+		res[id] = meta
+		return nil
+	})
+	return res, err
+}
+
+// CheckCoverage returns an error unless each of the given source blocks is among the sources of a block of the bucket
+// with meta.json, not marked for deletion and of raw resolution, with its index and chunk segments. This has to
+// hold at any time, including right after a crash: data must never be lost.
+func CheckCoverage(ctx context.Context, logger log.Logger, bkt objstore.Bucket, sources []ulid.ULID) error {
+	live, err := liveBlocks(ctx, logger, bkt)
+	if err != nil {
+		return errors.Wrap(err, "list blocks")
+	}
+	covered := map[ulid.ULID]struct{}{}
+	for id, m := range live {
+		if m.Thanos.Downsample.Resolution != 0 {
+			continue
+		}
+		if ok, err := bkt.Exists(ctx, path.Join(id.String(), block.IndexFilename)); err != nil {
+			return errors.Wrapf(err, "check index of %s", id)
+		} else if !ok {
+			return errors.Errorf("block %s has meta.json but no index", id)
+		}
+		segments := 0
+		if err := bkt.Iter(ctx, path.Join(id.String(), block.ChunksDirname), func(string) error {
+			segments++
+			return nil
+		}); err != nil {
+			return errors.Wrapf(err, "list chunk segments of %s", id)
+		}
+		if m.Stats.NumChunks > 0 && segments == 0 {
+			return errors.Errorf("block %s of %d chunks has meta.json but no chunk segments", id, m.Stats.NumChunks)
+		}
+		for _, s := range m.Compaction.Sources {
+			covered[s] = struct{}{}
+		}
+	}
+	for _, s := range sources {
+		if _, ok := covered[s]; !ok {
+			return errors.Errorf("source block %s is not covered by any block of the bucket", s)
+		}
+	}
+	return nil
+}
+
+// CheckNoDuplicates returns an error if any source block is among the sources of more than one block of the bucket
+// with meta.json and without deletion mark, of the same resolution. This has to hold once compactions and garbage
+// collection caught up after the last fault, as duplicates left over by crashes and duplicate executions are garbage
+// collected.
+func CheckNoDuplicates(ctx context.Context, logger log.Logger, bkt objstore.Bucket) error {
+	live, err := liveBlocks(ctx, logger, bkt)
+	if err != nil {
+		return errors.Wrap(err, "list blocks")
+	}
+	type key struct {
+		source     ulid.ULID
+		resolution int64
+	}
+	seen := map[key]ulid.ULID{}
+	for id, m := range live {
+		for _, s := range m.Compaction.Sources {
+			k := key{source: s, resolution: m.Thanos.Downsample.Resolution}
+			if other, ok := seen[k]; ok {
+				return errors.Errorf("source block %s is covered by both blocks %s and %s of resolution %d", s, other, id, k.resolution)
+			}
+			seen[k] = id
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compactchaos
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/compact"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+// setup uploads raw blocks to be compacted into the bucket and returns their IDs and the function creating compactors.
+func setup(t *testing.T, ctx context.Context, bkt objstore.Bucket, dir string) ([]ulid.ULID, NewCompactorFunc) {
+	logger := log.NewNopLogger()
+	extLset := labels.Labels{{Name: "e1", Value: "1"}}
+	series := []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "2")}
+
+	var sources []ulid.ULID
+	// Due to TSDB compaction delay (not compacting fresh block), the last block is not compacted.
+	for i := int64(0); i < 7; i++ {
+		id, err := e2eutil.CreateBlock(ctx, dir, series, 100, i*1000, (i+1)*1000, extLset, 0)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String())))
+		sources = append(sources, id)
+	}
+
+	return sources, func(bkt objstore.InstrumentedBucket) (*compact.BucketCompactor, error) {
+		ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, bkt, 0)
+		duplicateBlocksFilter := block.NewDeduplicateFilter()
+		metaFetcher, err := block.NewMetaFetcher(logger, 32, bkt, "", nil, []block.MetadataFilter{
+			ignoreDeletionMarkFilter,
+			duplicateBlocksFilter,
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+		blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+		garbageCollectedBlocks := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+		sy, err := compact.NewSyncer(logger, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks, 5)
+		if err != nil {
+			return nil, err
+		}
+		comp, err := tsdb.NewLeveledCompactor(ctx, nil, logger, []int64{1000, 3000}, nil)
+		if err != nil {
+			return nil, err
+		}
+		grouper := compact.NewDefaultGrouper(logger, bkt, false, false, nil, blocksMarkedForDeletion, garbageCollectedBlocks)
+		return compact.NewBucketCompactor(logger, sy, grouper, comp, filepath.Join(dir, "compact"), bkt, 1)
+	}
+}
+
+// converge runs compaction cycles until one completes without fault, checking that no data is lost in the given bucket,
+// wrapped by the compactor, after each cycle.
+func converge(t *testing.T, ctx context.Context, c *Compactor, bkt objstore.Bucket, sources []ulid.ULID) {
+	for i := 0; ; i++ {
+		testutil.Assert(t, i < 20, "compactor did not converge")
+
+		err := c.Run(ctx)
+		testutil.Ok(t, CheckCoverage(ctx, log.NewNopLogger(), bkt, sources))
+		if err == nil {
+			return
+		}
+		testutil.Assert(t, IsCrashed(err), "expected crash, got %v", err)
+	}
+}
+
+func TestCompactor_CrashAfterUpload(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "compact-chaos")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	sources, newCompactor := setup(t, ctx, bkt, dir)
+	c := NewCompactor(bkt, Config{CrashAfterUploads: 1}, newCompactor)
+
+	// Each restart compacts one more block before crashing, until nothing is left to compact.
+	converge(t, ctx, c, bkt, sources)
+	testutil.Assert(t, c.Restarts() > 0, "expected compactor to crash")
+
+	// Sources abandoned by crashes are garbage collected by the cycles after.
+	testutil.Ok(t, c.Run(ctx))
+	testutil.Ok(t, CheckNoDuplicates(ctx, log.NewNopLogger(), bkt))
+}
+
+func TestCompactor_DuplicateUploadsAndDelayedDeletions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "compact-chaos")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	sources, newCompactor := setup(t, ctx, bkt, dir)
+	c := NewCompactor(bkt, Config{DuplicateUploads: true, DeletionDelay: time.Hour, CrashAfterUploads: 2}, newCompactor)
+
+	converge(t, ctx, c, bkt, sources)
+	testutil.Assert(t, len(c.Bucket().Duplicates()) > 0, "expected duplicate blocks")
+
+	testutil.Ok(t, c.Run(ctx))
+	testutil.Ok(t, c.Bucket().ApplyDeletions(ctx))
+	testutil.Ok(t, CheckCoverage(ctx, log.NewNopLogger(), bkt, sources))
+	testutil.Ok(t, CheckNoDuplicates(ctx, log.NewNopLogger(), bkt))
+}
@@ -25,7 +25,7 @@ PATH=${PATH}:/tmp/protobin
 GOGOPROTO_ROOT="$(GO111MODULE=on go list -modfile=.bingo/protoc-gen-gogofast.mod -f '{{ .Dir }}' -m github.com/gogo/protobuf)"
 GOGOPROTO_PATH="${GOGOPROTO_ROOT}:${GOGOPROTO_ROOT}/protobuf"
 
-DIRS="store/storepb/ store/storepb/prompb/ rules/rulespb store/hintspb"
+DIRS="store/storepb/ store/storepb/prompb/ rules/rulespb store/hintspb compact/compactpb"
 echo "generating code"
 pushd "pkg"
 for dir in ${DIRS}; do